@@ -0,0 +1,225 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// ProducerMessage is a message sent with an AsyncProducer. The same message is
+// returned on Successes, with Offset set, or as part of a ProducerError.
+type ProducerMessage struct {
+	Topic     string
+	Partition int32
+	Key       []byte
+	Value     []byte
+
+	// Metadata is not written to Kafka. It's returned with the message so
+	// that the caller can match results to what it sent.
+	Metadata interface{}
+
+	// Offset is the offset the message was written at. Set for messages
+	// returned on Successes.
+	Offset int64
+}
+
+// ProducerError is a message an AsyncProducer failed to write, with the error
+// of the last attempt. proto.IsTransient tells whether writing it again may
+// succeed.
+type ProducerError struct {
+	Msg *ProducerMessage
+	Err error
+}
+
+func (e *ProducerError) Error() string {
+	return fmt.Sprintf("cannot produce to %s:%d: %s", e.Msg.Topic, e.Msg.Partition, e.Err)
+}
+
+// AsyncProducerConf is the configuration of an AsyncProducer.
+type AsyncProducerConf struct {
+	// Producer writes the batches. Required. Every batch is passed to a
+	// single Produce call, so failed batches are retried as the producer
+	// is configured to, e.g. by the RetryLimit and RetryWait of ProducerConf.
+	Producer Producer
+
+	// FlushFrequency is the longest time a message waits for more messages
+	// to the same partition before its batch is written.
+	//
+	// Defaults to 10ms.
+	FlushFrequency time.Duration
+
+	// FlushByteLimit is the size of the keys and values of a partition's
+	// batch at which it is written right away.
+	//
+	// Defaults to 64KB.
+	FlushByteLimit int
+
+	// ChannelBufferSize is the capacity of the Input, Successes and Errors
+	// channels, and of the queue of every partition.
+	//
+	// Defaults to 256.
+	ChannelBufferSize int
+}
+
+// NewAsyncProducerConf returns the default configuration, without a
+// producer.
+func NewAsyncProducerConf() AsyncProducerConf {
+	return AsyncProducerConf{
+		Producer:          nil,
+		FlushFrequency:    10 * time.Millisecond,
+		FlushByteLimit:    64 << 10,
+		ChannelBufferSize: 256,
+	}
+}
+
+// AsyncProducer writes the messages sent to Input in batches per partition
+// and reports the result of every message on Successes or Errors. Batches of
+// a partition are written one after the other, so messages to the same
+// partition are written in the order they were sent, including retries by
+// the producer.
+//
+// Successes and Errors must be read until they are closed, which happens
+// after Close, or the producer stops once they are full.
+type AsyncProducer struct {
+	conf      AsyncProducerConf
+	input     chan *ProducerMessage
+	successes chan *ProducerMessage
+	errors    chan *ProducerError
+
+	closeOnce *sync.Once
+	done      chan struct{}
+}
+
+// NewAsyncProducer returns a producer that writes batches with the configured
+// producer.
+func NewAsyncProducer(conf AsyncProducerConf) (*AsyncProducer, error) {
+	if conf.Producer == nil {
+		return nil, fmt.Errorf("AsyncProducerConf.Producer is required")
+	}
+	if conf.FlushByteLimit < 1 {
+		return nil, fmt.Errorf("invalid FlushByteLimit %d", conf.FlushByteLimit)
+	}
+	if conf.ChannelBufferSize < 0 {
+		return nil, fmt.Errorf("invalid ChannelBufferSize %d", conf.ChannelBufferSize)
+	}
+	p := &AsyncProducer{
+		conf:      conf,
+		input:     make(chan *ProducerMessage, conf.ChannelBufferSize),
+		successes: make(chan *ProducerMessage, conf.ChannelBufferSize),
+		errors:    make(chan *ProducerError, conf.ChannelBufferSize),
+		closeOnce: &sync.Once{},
+		done:      make(chan struct{}),
+	}
+	go p.dispatch()
+	return p, nil
+}
+
+// Input is the channel to send messages to. It must not be used after Close.
+func (p *AsyncProducer) Input() chan<- *ProducerMessage {
+	return p.input
+}
+
+// Successes returns the messages that were written, with their offsets.
+func (p *AsyncProducer) Successes() <-chan *ProducerMessage {
+	return p.successes
+}
+
+// Errors returns the messages that could not be written.
+func (p *AsyncProducer) Errors() <-chan *ProducerError {
+	return p.errors
+}
+
+// Close writes the messages that are still waiting and blocks until the result
+// of every message sent to Input was delivered to Successes or Errors, which
+// are closed then. Successes and Errors must be read while Close waits. The
+// configured producer is not closed.
+func (p *AsyncProducer) Close() {
+	p.closeOnce.Do(func() { close(p.input) })
+	<-p.done
+}
+
+// dispatch passes the messages from Input to the goroutine of their
+// partition, until Input is closed.
+func (p *AsyncProducer) dispatch() {
+	var wg sync.WaitGroup
+	queues := make(map[topicPartition]chan *ProducerMessage)
+	for msg := range p.input {
+		tp := topicPartition{msg.Topic, msg.Partition}
+		queue := queues[tp]
+		if queue == nil {
+			queue = make(chan *ProducerMessage, p.conf.ChannelBufferSize)
+			queues[tp] = queue
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.runPartition(tp, queue)
+			}()
+		}
+		queue <- msg
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	close(p.successes)
+	close(p.errors)
+	close(p.done)
+}
+
+// runPartition collects batches until the queue is closed. A batch is started
+// by the first message after the previous batch was written and is written
+// once it reaches FlushByteLimit, FlushFrequency passed or the queue was
+// closed.
+func (p *AsyncProducer) runPartition(tp topicPartition, queue chan *ProducerMessage) {
+	for {
+		msg, ok := <-queue
+		if !ok {
+			return
+		}
+		batch := []*ProducerMessage{msg}
+		size := len(msg.Key) + len(msg.Value)
+
+		timer := time.NewTimer(p.conf.FlushFrequency)
+	collect:
+		for size < p.conf.FlushByteLimit {
+			select {
+			case msg, ok = <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, msg)
+				size += len(msg.Key) + len(msg.Value)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		p.flush(tp, batch)
+		if !ok {
+			return
+		}
+	}
+}
+
+// flush writes the batch as a single produce and reports the result of every
+// message in it.
+func (p *AsyncProducer) flush(tp topicPartition, batch []*ProducerMessage) {
+	messages := make([]*proto.Message, len(batch))
+	for i, msg := range batch {
+		messages[i] = &proto.Message{Key: msg.Key, Value: msg.Value}
+	}
+
+	offset, err := p.conf.Producer.Produce(tp.topic, tp.partition, messages...)
+	for i, msg := range batch {
+		if err != nil {
+			p.errors <- &ProducerError{Msg: msg, Err: err}
+			continue
+		}
+		msg.Offset = offset + int64(i)
+		p.successes <- msg
+	}
+}
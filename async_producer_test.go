@@ -0,0 +1,205 @@
+package kafka
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&AsyncProducerSuite{})
+
+type AsyncProducerSuite struct{}
+
+func (s *AsyncProducerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// asyncResults reads the results of p until its channels are closed.
+func asyncResults(p *AsyncProducer) (chan []*ProducerMessage, chan []*ProducerError) {
+	successes := make(chan []*ProducerMessage, 1)
+	errs := make(chan []*ProducerError, 1)
+	go func() {
+		var all []*ProducerMessage
+		for msg := range p.Successes() {
+			all = append(all, msg)
+		}
+		successes <- all
+	}()
+	go func() {
+		var all []*ProducerError
+		for err := range p.Errors() {
+			all = append(all, err)
+		}
+		errs <- all
+	}()
+	return successes, errs
+}
+
+func (s *AsyncProducerSuite) TestEveryMessageReportedOnce(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 2)
+	srv.InjectError(ProduceRequest, "test", 0, proto.ErrNotLeaderForPartition, 3)
+	srv.InjectError(ProduceRequest, "test", 1, proto.ErrMessageSizeTooLarge, -1)
+
+	conf := NewBrokerConf("tester")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	broker, err := NewBroker("test-cluster-async", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	producerConf := NewProducerConf()
+	producerConf.RetryWait = time.Millisecond
+	asyncConf := NewAsyncProducerConf()
+	asyncConf.Producer = broker.Producer(producerConf)
+	asyncConf.FlushByteLimit = 50
+	p, err := NewAsyncProducer(asyncConf)
+	c.Assert(err, IsNil)
+	successes, errs := asyncResults(p)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		p.Input() <- &ProducerMessage{
+			Topic:     "test",
+			Partition: int32(i % 2),
+			Value:     []byte("0123456789"),
+			Metadata:  i,
+		}
+	}
+	p.Close()
+
+	reported := make(map[int]int)
+	var offsets []int64
+	for _, msg := range <-successes {
+		reported[msg.Metadata.(int)]++
+		c.Assert(msg.Partition, Equals, int32(0))
+		offsets = append(offsets, msg.Offset)
+	}
+	for _, perr := range <-errs {
+		reported[perr.Msg.Metadata.(int)]++
+		c.Assert(perr.Msg.Partition, Equals, int32(1))
+		c.Assert(perr.Err, Equals, proto.ErrMessageSizeTooLarge)
+	}
+	c.Assert(reported, HasLen, n)
+	for i := 0; i < n; i++ {
+		c.Assert(reported[i], Equals, 1, Commentf("message %d", i))
+	}
+
+	// the partition with transient errors was written in order
+	c.Assert(offsets, HasLen, n/2)
+	for i, offset := range offsets {
+		c.Assert(offset, Equals, int64(i))
+	}
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = 0
+	consConf.RetryLimit = 0
+	consumer, err := broker.BatchConsumer(consConf)
+	c.Assert(err, IsNil)
+	var written int
+	for {
+		batch, err := consumer.ConsumeBatch()
+		if err == ErrNoData {
+			break
+		}
+		c.Assert(err, IsNil)
+		written += len(batch)
+	}
+	c.Assert(written, Equals, n/2)
+}
+
+func (s *AsyncProducerSuite) TestRetriesLeftToProducer(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+	srv.InjectError(ProduceRequest, "test", 0, proto.ErrNotLeaderForPartition, -1)
+
+	broker, err := NewBroker("test-cluster-async-retries", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	producerConf := NewProducerConf()
+	producerConf.RetryLimit = 2
+	producerConf.RetryWait = time.Millisecond
+	asyncConf := NewAsyncProducerConf()
+	asyncConf.Producer = broker.Producer(producerConf)
+	p, err := NewAsyncProducer(asyncConf)
+	c.Assert(err, IsNil)
+	successes, errs := asyncResults(p)
+
+	p.Input() <- &ProducerMessage{Topic: "test", Partition: 0, Value: []byte("msg")}
+	p.Close()
+
+	c.Assert(<-successes, HasLen, 0)
+	perrs := <-errs
+	c.Assert(perrs, HasLen, 1)
+	c.Assert(perrs[0].Err, Equals, proto.ErrNotLeaderForPartition)
+	c.Assert(proto.IsTransient(perrs[0].Err), Equals, true)
+
+	// the batch was written once, and retried by the producer alone
+	c.Assert(srv.RequestCount(ProduceRequest), Equals, producerConf.RetryLimit+1)
+}
+
+func (s *AsyncProducerSuite) TestCloseFlushes(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewAsyncProducerConf()
+	conf.Producer = rec
+	conf.FlushFrequency = time.Hour
+	p, err := NewAsyncProducer(conf)
+	c.Assert(err, IsNil)
+	successes, errs := asyncResults(p)
+
+	for i := 0; i < 3; i++ {
+		p.Input() <- &ProducerMessage{Topic: "test", Partition: 7, Value: []byte("msg"), Metadata: i}
+	}
+	p.Close()
+
+	msgs := <-successes
+	c.Assert(msgs, HasLen, 3)
+	for i, msg := range msgs {
+		c.Assert(msg.Metadata, Equals, i)
+		c.Assert(msg.Offset, Equals, int64(i))
+	}
+	c.Assert(<-errs, HasLen, 0)
+	c.Assert(rec.batches[7], DeepEquals, []int{3})
+
+	// closing again is fine
+	p.Close()
+}
+
+func (s *AsyncProducerSuite) TestFlushByteLimitAndFrequency(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewAsyncProducerConf()
+	conf.Producer = rec
+	conf.FlushByteLimit = 10
+	conf.FlushFrequency = 20 * time.Millisecond
+	p, err := NewAsyncProducer(conf)
+	c.Assert(err, IsNil)
+	successes, _ := asyncResults(p)
+
+	// two full batches of 10 bytes, and one written by the timer
+	for i := 0; i < 5; i++ {
+		p.Input() <- &ProducerMessage{Topic: "test", Partition: 0, Key: []byte("k"), Value: []byte("vvvv")}
+	}
+	time.Sleep(100 * time.Millisecond)
+	rec.mu.Lock()
+	c.Assert(rec.batches[0], DeepEquals, []int{2, 2, 1})
+	rec.mu.Unlock()
+
+	p.Close()
+	c.Assert(<-successes, HasLen, 5)
+}
+
+func (s *AsyncProducerSuite) TestInvalidConf(c *C) {
+	conf := NewAsyncProducerConf()
+	_, err := NewAsyncProducer(conf)
+	c.Assert(err, ErrorMatches, ".*Producer is required")
+
+	conf.Producer = newBatchRecordingProducer()
+	conf.FlushByteLimit = 0
+	_, err = NewAsyncProducer(conf)
+	c.Assert(err, ErrorMatches, "invalid FlushByteLimit 0")
+}
@@ -0,0 +1,314 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// ErrBatchingProducerClosed is returned by Produce once the batching producer
+// was closed.
+var ErrBatchingProducerClosed = errors.New("batching producer closed")
+
+// FlushReason tells why a batch was written.
+type FlushReason int
+
+const (
+	// FlushFull is used for batches that reached BatchSize.
+	FlushFull FlushReason = iota
+	// FlushTimer is used for batches written once FlushInterval passed.
+	FlushTimer
+	// FlushClose is used for batches written because the producer was closed.
+	FlushClose
+)
+
+func (r FlushReason) String() string {
+	switch r {
+	case FlushFull:
+		return "full"
+	case FlushTimer:
+		return "timer"
+	case FlushClose:
+		return "close"
+	}
+	return fmt.Sprintf("FlushReason(%d)", int(r))
+}
+
+// BatchingProducerConf is the configuration of a BatchingProducer.
+type BatchingProducerConf struct {
+	// Producer writes the batches. Required.
+	Producer Producer
+
+	// BatchSize is the number of messages at which a partition's batch is
+	// written right away. A single Produce call is never split, so batches
+	// can be larger.
+	//
+	// Defaults to 100.
+	BatchSize int
+
+	// FlushInterval is the longest time a message waits for more messages to
+	// the same partition before its batch is written.
+	//
+	// Defaults to 10ms.
+	FlushInterval time.Duration
+}
+
+// NewBatchingProducerConf returns the default batching configuration, without
+// a producer.
+func NewBatchingProducerConf() BatchingProducerConf {
+	return BatchingProducerConf{
+		Producer:      nil,
+		BatchSize:     100,
+		FlushInterval: 10 * time.Millisecond,
+	}
+}
+
+// PartitionBatchStats are the statistics of the batches written to a single
+// partition.
+type PartitionBatchStats struct {
+	Topic     string
+	Partition int32
+
+	// Batches and Messages are the number of batches written and the number
+	// of messages in them.
+	Batches  int
+	Messages int
+
+	// Flushes counts the batches written for every reason.
+	Flushes map[FlushReason]int
+}
+
+// BatchingProducer is a Producer that coalesces the messages of concurrent
+// Produce calls to the same partition into batches. Every partition has its
+// own batch and flush timer, so a busy partition is written as soon as its
+// batch is full while an idle one never holds up the others.
+//
+// Produce blocks until the batch holding the messages was written and
+// returns the result of that write. Batches of a partition are written one
+// after the other, in the order the Produce calls were made.
+type BatchingProducer struct {
+	conf BatchingProducerConf
+	wg   *sync.WaitGroup
+
+	// mu protects closed. It's held for reading while a produce is queued,
+	// so that Close does not close the queue under it.
+	mu     *sync.RWMutex
+	closed bool
+
+	// partitionsMu protects partitions.
+	partitionsMu *sync.Mutex
+	partitions   map[topicPartition]*partitionBatcher
+}
+
+var _ Producer = &BatchingProducer{}
+var _ BatchedProducer = &BatchingProducer{}
+
+// NewBatchingProducer returns a producer that batches writes to the configured
+// producer.
+func NewBatchingProducer(conf BatchingProducerConf) (*BatchingProducer, error) {
+	if conf.Producer == nil {
+		return nil, fmt.Errorf("BatchingProducerConf.Producer is required")
+	}
+	if conf.BatchSize < 1 {
+		return nil, fmt.Errorf("invalid BatchSize %d", conf.BatchSize)
+	}
+	return &BatchingProducer{
+		conf:         conf,
+		wg:           &sync.WaitGroup{},
+		mu:           &sync.RWMutex{},
+		partitionsMu: &sync.Mutex{},
+		partitions:   make(map[topicPartition]*partitionBatcher),
+	}, nil
+}
+
+// Produce adds the messages to the batch of the partition and waits until it
+// was written. Returns the offset of the first of the messages.
+func (p *BatchingProducer) Produce(topic string, partition int32, messages ...*proto.Message) (int64, error) {
+	res := <-p.ProduceBatched(topic, partition, messages...)
+	return res.Offset, res.Err
+}
+
+// ProduceBatched adds the messages to the batch of the partition and returns
+// a channel that receives the result once the batch was written.
+func (p *BatchingProducer) ProduceBatched(topic string, partition int32, messages ...*proto.Message) <-chan BatchResult {
+	req := &batchedProduce{messages: messages, result: make(chan BatchResult, 1)}
+	if err := p.enqueue(topicPartition{topic, partition}, req); err != nil {
+		req.result <- BatchResult{Err: err}
+	}
+	return req.result
+}
+
+func (p *BatchingProducer) enqueue(tp topicPartition, req *batchedProduce) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrBatchingProducerClosed
+	}
+	p.batcher(tp).queue <- req
+	return nil
+}
+
+// batcher returns the batcher of the partition, starting it if needed.
+func (p *BatchingProducer) batcher(tp topicPartition) *partitionBatcher {
+	p.partitionsMu.Lock()
+	defer p.partitionsMu.Unlock()
+
+	batcher := p.partitions[tp]
+	if batcher == nil {
+		batcher = p.newPartitionBatcher(tp)
+		p.partitions[tp] = batcher
+	}
+	return batcher
+}
+
+// Stats returns the batch statistics of every partition written to so far.
+func (p *BatchingProducer) Stats() []PartitionBatchStats {
+	p.partitionsMu.Lock()
+	defer p.partitionsMu.Unlock()
+
+	stats := make([]PartitionBatchStats, 0, len(p.partitions))
+	for _, batcher := range p.partitions {
+		stats = append(stats, batcher.Stats())
+	}
+	return stats
+}
+
+// Close writes the messages that are still waiting and stops the producer.
+// Produce returns ErrBatchingProducerClosed from then on. The configured
+// producer is not closed.
+func (p *BatchingProducer) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.partitionsMu.Lock()
+	for _, batcher := range p.partitions {
+		close(batcher.queue)
+	}
+	p.partitionsMu.Unlock()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// batchedProduce is a single Produce call waiting for its batch to be written.
+type batchedProduce struct {
+	messages []*proto.Message
+	result   chan BatchResult
+}
+
+// partitionBatcher collects the produce calls of a single partition and
+// writes them from its own goroutine.
+type partitionBatcher struct {
+	topic     string
+	partition int32
+	conf      BatchingProducerConf
+	queue     chan *batchedProduce
+
+	// mu protects stats.
+	mu    *sync.Mutex
+	stats PartitionBatchStats
+}
+
+func (p *BatchingProducer) newPartitionBatcher(tp topicPartition) *partitionBatcher {
+	batcher := &partitionBatcher{
+		topic:     tp.topic,
+		partition: tp.partition,
+		conf:      p.conf,
+		queue:     make(chan *batchedProduce, p.conf.BatchSize),
+		mu:        &sync.Mutex{},
+		stats: PartitionBatchStats{
+			Topic:     tp.topic,
+			Partition: tp.partition,
+			Flushes:   make(map[FlushReason]int),
+		},
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		batcher.run()
+	}()
+	return batcher
+}
+
+// run collects batches until the queue is closed. A batch is started by the
+// first produce after the previous batch was written and is written once it
+// holds BatchSize messages, FlushInterval passed or the queue was closed.
+func (b *partitionBatcher) run() {
+	for {
+		req, ok := <-b.queue
+		if !ok {
+			return
+		}
+		batch := []*batchedProduce{req}
+		size := len(req.messages)
+
+		timer := time.NewTimer(b.conf.FlushInterval)
+		reason := FlushFull
+	collect:
+		for size < b.conf.BatchSize {
+			select {
+			case req, ok := <-b.queue:
+				if !ok {
+					reason = FlushClose
+					break collect
+				}
+				batch = append(batch, req)
+				size += len(req.messages)
+			case <-timer.C:
+				reason = FlushTimer
+				break collect
+			}
+		}
+		timer.Stop()
+
+		b.flush(batch, size, reason)
+		if reason == FlushClose {
+			return
+		}
+	}
+}
+
+// flush writes the batch as a single produce and reports the result to every
+// produce call in it.
+func (b *partitionBatcher) flush(batch []*batchedProduce, size int, reason FlushReason) {
+	messages := make([]*proto.Message, 0, size)
+	for _, req := range batch {
+		messages = append(messages, req.messages...)
+	}
+
+	offset, err := b.conf.Producer.Produce(b.topic, b.partition, messages...)
+	for _, req := range batch {
+		if err != nil {
+			req.result <- BatchResult{Err: err}
+			continue
+		}
+		req.result <- BatchResult{Offset: offset}
+		offset += int64(len(req.messages))
+	}
+
+	b.mu.Lock()
+	b.stats.Batches++
+	b.stats.Messages += size
+	b.stats.Flushes[reason]++
+	b.mu.Unlock()
+}
+
+// Stats returns a copy of the partition's statistics.
+func (b *partitionBatcher) Stats() PartitionBatchStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.Flushes = make(map[FlushReason]int, len(b.stats.Flushes))
+	for reason, count := range b.stats.Flushes {
+		stats.Flushes[reason] = count
+	}
+	return stats
+}
@@ -0,0 +1,207 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&BatchingProducerSuite{})
+
+type BatchingProducerSuite struct{}
+
+func (s *BatchingProducerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// batchRecordingProducer records the size of every produce call and assigns
+// offsets per partition.
+type batchRecordingProducer struct {
+	mu      sync.Mutex
+	batches map[int32][]int
+	offsets map[int32]int64
+}
+
+func newBatchRecordingProducer() *batchRecordingProducer {
+	return &batchRecordingProducer{
+		batches: make(map[int32][]int),
+		offsets: make(map[int32]int64),
+	}
+}
+
+func (p *batchRecordingProducer) Produce(topic string, part int32, msgs ...*proto.Message) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.batches[part] = append(p.batches[part], len(msgs))
+	offset := p.offsets[part]
+	p.offsets[part] += int64(len(msgs))
+	return offset, nil
+}
+
+func (s *BatchingProducerSuite) TestConcurrentProducesAreBatched(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewBatchingProducerConf()
+	conf.Producer = rec
+	conf.BatchSize = 10
+	conf.FlushInterval = 10 * time.Second
+	p, err := NewBatchingProducer(conf)
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	offsets := make(chan int64, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			offset, err := p.Produce("test", 0, &proto.Message{})
+			c.Check(err, IsNil)
+			offsets <- offset
+		}()
+	}
+	wg.Wait()
+	close(offsets)
+
+	seen := make(map[int64]bool)
+	for offset := range offsets {
+		seen[offset] = true
+	}
+	c.Assert(seen, HasLen, 10)
+	c.Assert(rec.batches[0], DeepEquals, []int{10})
+
+	stats := p.Stats()
+	c.Assert(stats, HasLen, 1)
+	c.Assert(stats[0].Batches, Equals, 1)
+	c.Assert(stats[0].Messages, Equals, 10)
+	c.Assert(stats[0].Flushes, DeepEquals, map[FlushReason]int{FlushFull: 1})
+}
+
+func (s *BatchingProducerSuite) TestPartitionsFlushIndependently(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewBatchingProducerConf()
+	conf.Producer = rec
+	conf.BatchSize = 5
+	conf.FlushInterval = 50 * time.Millisecond
+	p, err := NewBatchingProducer(conf)
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	// a busy partition is written as soon as the batch is full
+	start := time.Now()
+	messages := make([]*proto.Message, 5)
+	for i := range messages {
+		messages[i] = &proto.Message{}
+	}
+	_, err = p.Produce("test", 0, messages...)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) < conf.FlushInterval, Equals, true)
+
+	// an idle one waits for the timer
+	start = time.Now()
+	offset, err := p.Produce("test", 1, &proto.Message{})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(0))
+	c.Assert(time.Since(start) >= conf.FlushInterval, Equals, true)
+
+	c.Assert(rec.batches, DeepEquals, map[int32][]int{0: {5}, 1: {1}})
+	flushes := make(map[int32]map[FlushReason]int)
+	for _, stats := range p.Stats() {
+		flushes[stats.Partition] = stats.Flushes
+	}
+	c.Assert(flushes, DeepEquals, map[int32]map[FlushReason]int{
+		0: {FlushFull: 1},
+		1: {FlushTimer: 1},
+	})
+}
+
+func (s *BatchingProducerSuite) TestCloseFlushes(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewBatchingProducerConf()
+	conf.Producer = rec
+	conf.FlushInterval = 10 * time.Second
+	p, err := NewBatchingProducer(conf)
+	c.Assert(err, IsNil)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := p.Produce("test", 0, &proto.Message{})
+		errc <- err
+	}()
+	for len(p.Stats()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Close()
+	c.Assert(<-errc, IsNil)
+	c.Assert(p.Stats()[0].Flushes, DeepEquals, map[FlushReason]int{FlushClose: 1})
+
+	_, err = p.Produce("test", 0, &proto.Message{})
+	c.Assert(err, Equals, ErrBatchingProducerClosed)
+}
+
+func (s *BatchingProducerSuite) TestProduceBatched(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 2)
+
+	broker, metrics := newMetricsBroker(c, srv, "test-cluster-produce-batched")
+	defer broker.Close()
+
+	conf := NewProducerConf()
+	conf.BatchMaxSize = 4
+	conf.BatchLinger = 10 * time.Second
+	producer := broker.Producer(conf).(BatchedProducer)
+
+	// the calls of a partition are written together once the batch is full
+	first := producer.ProduceBatched("test", 0, &proto.Message{Value: []byte("a")})
+	second := producer.ProduceBatched("test", 0, &proto.Message{Value: []byte("b")}, &proto.Message{Value: []byte("c")})
+	pending := producer.ProduceBatched("test", 1, &proto.Message{Value: []byte("d")})
+	third := producer.ProduceBatched("test", 0, &proto.Message{Value: []byte("e")})
+	c.Assert(<-first, DeepEquals, BatchResult{Offset: 0})
+	c.Assert(<-second, DeepEquals, BatchResult{Offset: 1})
+	c.Assert(<-third, DeepEquals, BatchResult{Offset: 3})
+	c.Assert(metrics.Snapshot().Requests[proto.ProduceReqKind].Count, Equals, int64(1))
+
+	// closing writes the batches still lingering
+	select {
+	case res := <-pending:
+		c.Fatalf("batch written before linger or close: %+v", res)
+	default:
+	}
+	producer.Close()
+	c.Assert(<-pending, DeepEquals, BatchResult{Offset: 0})
+	c.Assert(metrics.Snapshot().Requests[proto.ProduceReqKind].Count, Equals, int64(2))
+
+	res := <-producer.ProduceBatched("test", 0, &proto.Message{Value: []byte("f")})
+	c.Assert(res.Err, Equals, ErrBatchingProducerClosed)
+}
+
+func (s *BatchingProducerSuite) TestProduceBatchedLinger(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	broker, err := NewBroker("test-cluster-produce-batched-linger", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewProducerConf()
+	conf.BatchLinger = 20 * time.Millisecond
+	producer := broker.Producer(conf).(BatchedProducer)
+	defer producer.Close()
+
+	start := time.Now()
+	res := <-producer.ProduceBatched("test", 0, &proto.Message{Value: []byte("a")})
+	c.Assert(res, DeepEquals, BatchResult{Offset: 0})
+	c.Assert(time.Since(start) >= 20*time.Millisecond, Equals, true)
+
+	// an invalid configuration fails every call
+	conf.BatchMaxSize = -1
+	res = <-broker.Producer(conf).(BatchedProducer).ProduceBatched("test", 0, &proto.Message{})
+	c.Assert(res.Err, ErrorMatches, "invalid producer configuration: negative BatchMaxSize -1")
+}
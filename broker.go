@@ -1,17 +1,22 @@
 package kafka
 
 import (
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"os"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/zorkian/kafka/proto"
 	"github.com/jpillora/backoff"
+	"github.com/zorkian/kafka/proto"
 )
 
 const (
@@ -33,11 +38,30 @@ var (
 	// ErrNoData is returned by consumers on Fetch when the retry limit is set and exceeded.
 	ErrNoData = errors.New("no data")
 
+	// ErrTopicNotFound is returned by producers configured with VerifyTopicExists when
+	// the topic is not known to the cluster.
+	ErrTopicNotFound = errors.New("topic not found")
+
+	// ErrHandoff is returned by a consumer stopped with StopAtCommit once all
+	// fetched messages were consumed and the offset after them was committed.
+	ErrHandoff = errors.New("consumer stopped at committed offset")
+
+	// ErrDeadlineExceeded is returned by ProduceBefore when the deadline
+	// passed before the messages were sent, and by RequestReply when no
+	// reply arrived in time.
+	ErrDeadlineExceeded = errors.New("deadline exceeded")
+
 	// Make sure interfaces are implemented
-	_ Client            = &Broker{}
-	_ Consumer          = &consumer{}
-	_ Producer          = &producer{}
-	_ OffsetCoordinator = &offsetCoordinator{}
+	_ Client                = &Broker{}
+	_ Consumer              = &consumer{}
+	_ PeekConsumer          = &consumer{}
+	_ HandoffConsumer       = &consumer{}
+	_ SeekConsumer          = &consumer{}
+	_ Producer              = &producer{}
+	_ ResultProducer        = &producer{}
+	_ DeadlineProducer      = &producer{}
+	_ OffsetCoordinator     = &offsetCoordinator{}
+	_ GenerationCoordinator = &offsetCoordinator{}
 )
 
 // Client is the interface implemented by Broker.
@@ -67,6 +91,50 @@ type BatchConsumer interface {
 	ConsumeBatch() ([]*proto.Message, error)
 }
 
+// PeekConsumer is the interface that wraps the Peek method.
+//
+// Peek returns the next message without consuming it, so that the following
+// call to Consume returns the same message. If no message is buffered, Peek
+// fetches new messages just like Consume would.
+type PeekConsumer interface {
+	Peek() (*proto.Message, error)
+}
+
+// HandoffConsumer is the interface that wraps the StopAtCommit method.
+//
+// StopAtCommit stops the consumer from fetching new messages, so that the
+// partition can be handed over to another consumer. Messages that were
+// already fetched are still returned. Once they are all consumed, the offset
+// of the next message is committed with the given coordinator and ErrHandoff
+// is returned; the new owner of the partition continues from that offset.
+type HandoffConsumer interface {
+	StopAtCommit(coordinator OffsetCoordinator)
+}
+
+// SeekConsumer is the interface that wraps the SeekTo method.
+//
+// SeekTo moves the consumer to the given offset, discarding the messages that
+// were fetched but not consumed yet, so that the next call to Consume returns
+// the message at that offset. It returns proto.ErrOffsetOutOfRange if the
+// offset is before the oldest message of the partition or after the offset
+// of the next message produced to it.
+//
+// SeekTo does not wait for a call to Consume in progress. Unless that call
+// already received messages, it drops those fetched from the old offset and
+// returns messages from the new one.
+type SeekConsumer interface {
+	SeekTo(offset int64) error
+}
+
+// GenerationCoordinator is the interface that wraps the SetGeneration method.
+//
+// SetGeneration sets the group generation and member ID sent with the
+// following commits, and should be called after every rebalance. Commits of
+// a member that was fenced are then rejected by the coordinator.
+type GenerationCoordinator interface {
+	SetGeneration(generationID int32, memberID string)
+}
+
 // Producer is the interface that wraps the Produce method.
 //
 // Produce writes the messages to the given topic and partition.
@@ -76,6 +144,67 @@ type Producer interface {
 	Produce(topic string, partition int32, messages ...*proto.Message) (offset int64, err error)
 }
 
+// ResultProducer is the interface that wraps the ProduceWithResult method.
+//
+// ProduceWithResult works like Produce, but returns everything the broker
+// reported about the write instead of only the offset.
+type ResultProducer interface {
+	ProduceWithResult(topic string, partition int32, messages ...*proto.Message) (*ProduceResult, error)
+}
+
+// BatchedProducer is the interface that wraps the ProduceBatched and Close
+// methods.
+//
+// ProduceBatched adds the messages to a batch of their partition and returns
+// right away. The batch is written by a single produce request together with
+// the messages of other calls, and the returned channel receives the result
+// once it was. Close writes the batches that are still waiting and returns
+// once they were, so that no message handed to ProduceBatched is lost;
+// ProduceBatched fails with ErrBatchingProducerClosed afterwards.
+//
+// Producers returned by Broker.Producer implement it, batching as configured
+// by ProducerConf.BatchLinger and BatchMaxSize. They must be closed before the
+// broker.
+type BatchedProducer interface {
+	ProduceBatched(topic string, partition int32, messages ...*proto.Message) <-chan BatchResult
+	Close()
+}
+
+// BatchResult is the result of a ProduceBatched call.
+type BatchResult struct {
+	// Offset is the offset of the first of the messages.
+	Offset int64
+	Err    error
+}
+
+// DeadlineProducer is the interface that wraps the ProduceBefore method.
+//
+// ProduceBefore works like Produce, but gives up with ErrDeadlineExceeded
+// once the deadline passed, and doesn't let the broker wait for replicas
+// beyond it either.
+type DeadlineProducer interface {
+	ProduceBefore(deadline time.Time, topic string, partition int32, messages ...*proto.Message) (int64, error)
+}
+
+// ProduceResult is the broker's answer to a produce request.
+type ProduceResult struct {
+	// Offset is the offset of the first message written.
+	Offset int64
+
+	// LogAppendTime is the time the broker appended the messages. It is only
+	// set for topics using log append time, and requires RequestVersion 2.
+	LogAppendTime time.Time
+
+	// ThrottleTime is the time the request was delayed by a broker quota. It
+	// requires RequestVersion 1 or later.
+	ThrottleTime time.Duration
+
+	// LogStartOffset is the offset of the oldest message the partition still
+	// has, after retention and deletions. It requires RequestVersion 5 or
+	// later and is -1 otherwise.
+	LogStartOffset int64
+}
+
 // OffsetCoordinator is the interface which wraps the Commit and Offset methods.
 type OffsetCoordinator interface {
 	Commit(topic string, partition int32, offset int64) error
@@ -91,7 +220,7 @@ func (tp topicPartition) String() string {
 	return fmt.Sprintf("%s:%d", tp.topic, tp.partition)
 }
 
-//BrokerConf is the broker configuration container.
+// BrokerConf is the broker configuration container.
 type BrokerConf struct {
 	// Kafka client ID.
 	ClientID string
@@ -119,6 +248,48 @@ type BrokerConf struct {
 	// Defaults to False.
 	AllowTopicCreation bool
 
+	// PreferredNode is the address (host:port) of a broker that, when it is
+	// reachable, is used for metadata and other requests that are not bound
+	// to a partition leader, such as group coordinator discovery. Produce and
+	// fetch requests are still routed to the partition leader. This is mostly
+	// useful for debugging and single broker test setups.
+	//
+	// Defaults to "", which picks a random broker for every request.
+	PreferredNode string
+
+	// CloseTimeout limits how long Close waits for requests that are in flight
+	// to finish before closing the connections anyway.
+	//
+	// Defaults to 5s.
+	CloseTimeout time.Duration
+
+	// RetryBudget limits the retries of all requests of this broker together,
+	// so that an outage failing many requests at once doesn't cause a storm
+	// of retries. Up to RetryBudget retries can be made in a burst, after
+	// that RetryBudgetRate retries per second. A request that is out of
+	// budget fails with the error of its last attempt, see
+	// Broker.RetryBudgetExhausted.
+	//
+	// Defaults to 0 which means retries are only limited per request.
+	RetryBudget int
+
+	// RetryBudgetRate is the number of retries per second added to the
+	// RetryBudget.
+	//
+	// Defaults to 10.
+	RetryBudgetRate float64
+
+	// Metrics receives measurements of the requests of this broker.
+	//
+	// Defaults to nil which means nothing is measured.
+	Metrics Metrics
+
+	// Tracer, if set, is called around every produce, fetch and metadata
+	// request sent by this broker, see Tracer.
+	//
+	// Defaults to nil.
+	Tracer Tracer
+
 	// Configuration specific to the connections to the cluster.
 	ClusterConnectionConf ClusterConnectionConf
 }
@@ -130,6 +301,9 @@ func NewBrokerConf(clientID string) BrokerConf {
 		AllowTopicCreation:    false,
 		LeaderRetryLimit:      10,
 		LeaderRetryWait:       500 * time.Millisecond,
+		CloseTimeout:          5 * time.Second,
+		RetryBudget:           0,
+		RetryBudgetRate:       10,
 		ClusterConnectionConf: NewClusterConnectionConf(),
 	}
 }
@@ -140,9 +314,17 @@ type NodeMap map[int32]string
 // Broker is an abstract connection to kafka cluster for the given configuration, and can be used to
 // create clients to the cluster.
 type Broker struct {
-	conf    BrokerConf
-	conns   *connectionPool
-	cluster *Cluster
+	conf     BrokerConf
+	conns    *connectionPool
+	cluster  *Cluster
+	retries  *retryBudget
+	metrics  Metrics
+	throttle *throttler
+
+	// mu protects closed. inFlight counts the operations that Close waits for.
+	mu       *sync.Mutex
+	closed   bool
+	inFlight *sync.WaitGroup
 }
 
 // NewBroker returns a broker to a given list of kafka addresses.
@@ -161,18 +343,123 @@ func NewBroker(clusterName string, nodeAddresses []string, conf BrokerConf) (*Br
 		return nil, err
 	}
 
+	var metrics Metrics = NopMetrics{}
+	if conf.Metrics != nil {
+		metrics = conf.Metrics
+	}
+
 	return &Broker{
-		conf,
-		metadataConnPool,
-		metadata,
+		conf:     conf,
+		conns:    metadataConnPool,
+		cluster:  metadata,
+		retries:  newRetryBudget(conf.RetryBudget, conf.RetryBudgetRate),
+		metrics:  metrics,
+		throttle: newThrottler(),
+		mu:       &sync.Mutex{},
+		inFlight: &sync.WaitGroup{},
 	}, nil
 }
 
+// Close shuts the broker down. No new requests are accepted and producers,
+// consumers and offset coordinators created from this broker return ErrClosed
+// from then on. Close waits up to CloseTimeout for requests that are in flight
+// to finish, then closes the connections of this broker, which cancels the
+// requests still waiting for a response. Those are logged, see also
+// InFlightRequests.
+//
+// Brokers created with the same client ID share their connections, which are
+// only closed once all of those brokers are closed.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(b.conf.CloseTimeout):
+		log.Warningf("closing broker %s with requests still in flight", b.conf.ClientID)
+		for _, req := range b.InFlightRequests() {
+			log.Warningf("in flight for %s: %s request %d to %s for %s:%d",
+				req.Age, req.Kind, req.CorrelationID, req.Addr, req.Topic, req.Partition)
+		}
+	}
+
+	b.cluster.releaseConnectionPool(b.conf.ClientID)
+}
+
+// isClosed returns whether Close was called.
+func (b *Broker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.closed
+}
+
+// track registers an operation so that Close waits for it to finish. Every
+// successful call must be paired with a call to untrack. Returns ErrClosed if
+// the broker was closed.
+func (b *Broker) track() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	b.inFlight.Add(1)
+	return nil
+}
+
+// untrack marks an operation registered with track as finished. Any error of
+// an operation that raced with Close is replaced with ErrClosed, so callers
+// see a stable error rather than whatever the closed connection returned.
+func (b *Broker) untrack(err error) error {
+	b.inFlight.Done()
+	if err != nil && b.isClosed() {
+		return ErrClosed
+	}
+	return err
+}
+
 // Metadata returns a copy of the metadata. This does not require a lock as it's fetching
 // a new copy from Kafka, we never use our internal state.
-func (b *Broker) Metadata() (*proto.MetadataResp, error) {
-	resp, err := b.cluster.Fetch(b.conf.ClientID)
-	return resp, err
+func (b *Broker) Metadata() (resp *proto.MetadataResp, err error) {
+	return b.metadata(nil)
+}
+
+// metadata works like Metadata, but gives up with errCanceled once cancel is
+// closed.
+func (b *Broker) metadata(cancel <-chan struct{}) (resp *proto.MetadataResp, err error) {
+	if err := b.track(); err != nil {
+		return nil, err
+	}
+	defer func() { err = b.untrack(err) }()
+
+	return b.cluster.fetch(b.conf.Tracer, b.metrics, cancel, b.conf.PreferredNode, b.conf.ClientID)
+}
+
+// RetryBudgetExhausted returns how many retries were not made because the
+// RetryBudget was used up.
+func (b *Broker) RetryBudgetExhausted() int64 {
+	return b.retries.Exhausted()
+}
+
+// retry takes a retry from the retry budget and reports it to Metrics with
+// the error that caused it. It returns false if the budget is used up.
+func (b *Broker) retry(reason error) bool {
+	if !b.retries.take() {
+		return false
+	}
+	b.metrics.CountRetry(reason)
+	return true
 }
 
 // PartitionCount returns the count of partitions in a topic, or 0 and an error if the topic
@@ -181,10 +468,273 @@ func (b *Broker) PartitionCount(topic string) (int32, error) {
 	return b.cluster.PartitionCount(topic)
 }
 
+// ClusterInfo returns the brokers of the cluster with the rack each of them is
+// in, according to the metadata cached by the broker. Racks are only known
+// with ClusterConnectionConf.MetadataRequestVersion 1.
+func (b *Broker) ClusterInfo() ClusterInfo {
+	return b.cluster.info()
+}
+
+// TopicInfo describes a topic of the cluster, as returned by ListTopics.
+type TopicInfo struct {
+	Name       string
+	Partitions int32
+
+	// Internal is set for topics Kafka uses for its own bookkeeping, such as
+	// consumer group offsets.
+	Internal bool
+}
+
+// internalTopics are the topics created and used by Kafka itself. Version 0
+// metadata responses do not flag internal topics, so they are known by name.
+var internalTopics = map[string]bool{
+	"__consumer_offsets":  true,
+	"__transaction_state": true,
+}
+
+// ListTopics returns all topics of the cluster except internal ones, sorted by
+// name. It always fetches fresh metadata.
+func (b *Broker) ListTopics() ([]TopicInfo, error) {
+	return b.listTopics(false)
+}
+
+// ListAllTopics works like ListTopics, but includes internal topics.
+func (b *Broker) ListAllTopics() ([]TopicInfo, error) {
+	return b.listTopics(true)
+}
+
+func (b *Broker) listTopics(includeInternal bool) ([]TopicInfo, error) {
+	resp, err := b.Metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]TopicInfo, 0, len(resp.Topics))
+	for _, topic := range resp.Topics {
+		info := TopicInfo{
+			Name:       topic.Name,
+			Partitions: int32(len(topic.Partitions)),
+			Internal:   topic.IsInternal || internalTopics[topic.Name],
+		}
+		if info.Internal && !includeInternal {
+			continue
+		}
+		topics = append(topics, info)
+	}
+	sort.Sort(byTopicName(topics))
+	return topics, nil
+}
+
+// WaitForMinISR waits until the partition has at least minISR in-sync
+// replicas, fetching fresh metadata every LeaderRetryWait. It returns
+// proto.ErrNotEnoughReplicas if the partition still has fewer after timeout,
+// so that critical writes can be held back until replication is healthy. A
+// timeout of zero checks only once.
+func (b *Broker) WaitForMinISR(topic string, partition int32, minISR int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		isr, err := b.inSyncReplicas(topic, partition)
+		if err != nil {
+			return err
+		}
+		if isr >= minISR {
+			return nil
+		}
+		if !time.Now().Add(b.conf.LeaderRetryWait).Before(deadline) {
+			log.Infof("%s:%d has %d in-sync replicas, want %d", topic, partition, isr, minISR)
+			return proto.ErrNotEnoughReplicas
+		}
+		time.Sleep(b.conf.LeaderRetryWait)
+	}
+}
+
+// inSyncReplicas returns the number of in-sync replicas of the partition
+// according to fresh metadata.
+func (b *Broker) inSyncReplicas(topic string, partition int32) (int, error) {
+	resp, err := b.Metadata()
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range resp.Topics {
+		if t.Name != topic {
+			continue
+		}
+		if t.Err != nil {
+			return 0, t.Err
+		}
+		for _, p := range t.Partitions {
+			if p.ID == partition {
+				return len(p.Isrs), nil
+			}
+		}
+	}
+	return 0, proto.ErrUnknownTopicOrPartition
+}
+
+type byTopicName []TopicInfo
+
+func (s byTopicName) Len() int           { return len(s) }
+func (s byTopicName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTopicName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// ConnectionStates returns, for every broker this client knows about, the number
+// of open connections, the number of in-flight requests and the time the broker
+// was last used. This is meant for debugging connection problems; nothing is
+// tracked beyond what the connection pool needs anyway.
+func (b *Broker) ConnectionStates() []ConnectionState {
+	nodeIDs := make(map[string]int32)
+	for nodeID, addr := range b.cluster.GetNodes() {
+		nodeIDs[addr] = nodeID
+	}
+
+	states := b.conns.ConnectionStates()
+	for i := range states {
+		if nodeID, ok := nodeIDs[states[i].Addr]; ok {
+			states[i].NodeID = nodeID
+		}
+	}
+	sort.Sort(byConnectionAddr(states))
+	return states
+}
+
+// InFlightRequests returns the requests that are waiting for a response from
+// any broker, oldest first. Brokers created with the same client ID share
+// their connections, so the requests of all of them are returned. Like
+// ConnectionStates, this is meant for debugging, e.g. of requests that keep
+// Close from returning.
+func (b *Broker) InFlightRequests() []InFlightRequest {
+	reqs := b.conns.InFlightRequests()
+	sort.Sort(byRequestAge(reqs))
+	return reqs
+}
+
+type byRequestAge []InFlightRequest
+
+func (s byRequestAge) Len() int           { return len(s) }
+func (s byRequestAge) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRequestAge) Less(i, j int) bool { return s[i].Age > s[j].Age }
+
+type byConnectionAddr []ConnectionState
+
+func (s byConnectionAddr) Len() int           { return len(s) }
+func (s byConnectionAddr) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byConnectionAddr) Less(i, j int) bool { return s[i].Addr < s[j].Addr }
+
+// Fetch sends the fetch request as it is to the leaders of the requested
+// partitions and returns their combined response. The request is split into
+// one request per leader, which are sent at the same time. Nothing is
+// retried: any error, including one failing to find a leader, fails the whole
+// fetch, while errors of single partitions are reported in the response.
+//
+// Fetch is meant for tooling that needs full control over the request. Use a
+// Consumer to read a partition.
+func (b *Broker) Fetch(req *proto.FetchReq) (resp *proto.FetchResp, err error) {
+	return b.fetch(req, nil)
+}
+
+// fetch works like Fetch, but gives up with errCanceled once cancel is
+// closed.
+func (b *Broker) fetch(req *proto.FetchReq, cancel <-chan struct{}) (resp *proto.FetchResp, err error) {
+	if err := b.track(); err != nil {
+		return nil, err
+	}
+	defer func() { err = b.untrack(err) }()
+
+	// split the request by leader, keeping the order of topics
+	byNode := make(map[int32]*proto.FetchReq)
+	var nodes []int32
+	for _, topic := range req.Topics {
+		for _, part := range topic.Partitions {
+			nodeID, err := b.getLeaderEndpoint(topic.Name, part.ID, cancel)
+			if err != nil {
+				return nil, err
+			}
+			nodeReq, ok := byNode[nodeID]
+			if !ok {
+				nodeReq = &proto.FetchReq{
+					Version:     req.Version,
+					ClientID:    req.ClientID,
+					MaxWaitTime: req.MaxWaitTime,
+					MinBytes:    req.MinBytes,
+				}
+				if nodeReq.ClientID == "" {
+					nodeReq.ClientID = b.conf.ClientID
+				}
+				byNode[nodeID] = nodeReq
+				nodes = append(nodes, nodeID)
+			}
+			if n := len(nodeReq.Topics); n == 0 || nodeReq.Topics[n-1].Name != topic.Name {
+				nodeReq.Topics = append(nodeReq.Topics, proto.FetchReqTopic{Name: topic.Name})
+			}
+			t := &nodeReq.Topics[len(nodeReq.Topics)-1]
+			t.Partitions = append(t.Partitions, part)
+		}
+	}
+
+	resps := make([]*proto.FetchResp, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, nodeID := range nodes {
+		wg.Add(1)
+		go func(i int, nodeID int32) {
+			defer wg.Done()
+			resps[i], errs[i] = b.fetchFromNode(nodeID, byNode[nodeID], cancel)
+		}(i, nodeID)
+	}
+	wg.Wait()
+
+	resp = &proto.FetchResp{Version: req.Version, CorrelationID: req.CorrelationID}
+	for i := range nodes {
+		if errs[i] != nil {
+			if canceled(cancel) {
+				return nil, errCanceled
+			}
+			return nil, errs[i]
+		}
+		resp.Topics = append(resp.Topics, resps[i].Topics...)
+	}
+	return resp, nil
+}
+
+// fetchFromNode sends a single fetch request to the given node.
+func (b *Broker) fetchFromNode(nodeID int32, req *proto.FetchReq, cancel <-chan struct{}) (*proto.FetchResp, error) {
+	addr := b.cluster.GetNodeAddress(nodeID)
+	if addr == "" {
+		return nil, fmt.Errorf("unknown broker id %d", nodeID)
+	}
+	conn, err := b.conns.GetConnectionByAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	req.CorrelationID = newCorrelationID()
+	span := &RequestSpan{
+		Request:       "fetch",
+		Broker:        addr,
+		CorrelationID: req.CorrelationID,
+	}
+	var resp *proto.FetchResp
+	interrupted := interruptOnCancel(conn, cancel)
+	err = measureRequest(b.metrics, proto.FetchReqKind, conn, func() error {
+		return traceRequest(b.conf.Tracer, span, func() (err error) {
+			resp, err = conn.Fetch(req)
+			return err
+		})
+	})
+	if interrupted() {
+		resp, err = nil, errCanceled
+	}
+	if err != nil {
+		_ = conn.Close()
+	}
+	go b.conns.Idle(conn)
+	return resp, err
+}
+
 // getLeaderEndpoint returns the ID of the node responsible for a topic/partition.
 // This may refresh metadata and may also initiate topic creation if the topic is
 // unknown and such is enabled. This method may take a long time to return.
-func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error) {
+func (b *Broker) getLeaderEndpoint(topic string, partition int32, cancel <-chan struct{}) (int32, error) {
 	// Attempt to learn where this topic/partition is. This may return an error in which
 	// case we don't know about it and should refresh metadata.
 	if nodeID, err := b.cluster.GetEndpoint(topic, partition); err == nil {
@@ -192,7 +742,7 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 	}
 
 	// Endpoint is unknown, refresh metadata (synchronous, blocks a while)
-	if err := b.cluster.RefreshMetadata(); err != nil {
+	if err := b.cluster.refreshMetadataAfter(b.cluster.metadataEpoch(), cancel); err != nil {
 		log.Warningf("[getLeaderEndpoint %s:%d] cannot refresh metadata: %s",
 			topic, partition, err)
 		return 0, err
@@ -212,7 +762,7 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 
 	// Try to create the topic by requesting the metadata for that one specific topic
 	// (this is the hack Kafka uses to allow topics to be created on demand)
-	if _, err := b.cluster.Fetch(b.conf.ClientID, topic); err != nil {
+	if _, err := b.cluster.fetch(b.conf.Tracer, b.metrics, cancel, b.conf.PreferredNode, b.conf.ClientID, topic); err != nil {
 		log.Warningf("[getLeaderEndpoint %s:%d] failed to get metadata for topic: %s",
 			topic, partition, err)
 		return 0, err
@@ -229,6 +779,16 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 	return 0, proto.ErrUnknownTopicOrPartition
 }
 
+// leaderAddr returns the address of the leader of given partition according
+// to the cached metadata, or an empty string if it's not known.
+func (b *Broker) leaderAddr(topic string, partition int32) string {
+	nodeID, err := b.cluster.GetEndpoint(topic, partition)
+	if err != nil {
+		return ""
+	}
+	return b.cluster.GetNodeAddress(nodeID)
+}
+
 // leaderConnection returns connection to leader for given partition. If
 // connection does not exist, broker will try to connect.
 //
@@ -238,19 +798,42 @@ func (b *Broker) getLeaderEndpoint(topic string, partition int32) (int32, error)
 // the leader we will return a random broker. The broker will error if we end
 // up producing to it incorrectly (i.e., our metadata happened to be out of
 // date).
-func (b *Broker) leaderConnection(topic string, partition int32) (*connection, error) {
+//
+// Waiting between retries and for metadata is given up with errCanceled once
+// cancel is closed, or with ErrDeadlineExceeded once the deadline, unless it
+// is zero, passed.
+func (b *Broker) leaderConnection(topic string, partition int32, deadline time.Time, cancel <-chan struct{}) (conn *connection, err error) {
+	stop, release := cancelBefore(cancel, deadline)
+	defer release()
+	defer func() {
+		if err == errCanceled && !canceled(cancel) {
+			err = ErrDeadlineExceeded
+		}
+	}()
+
 	retry := &backoff.Backoff{Min: b.conf.LeaderRetryWait, Jitter: true}
 	var resErr error
 	for try := 0; try < b.conf.LeaderRetryLimit; try++ {
+		if b.isClosed() {
+			return nil, ErrClosed
+		}
 		if try != 0 {
+			if !b.retry(resErr) {
+				break
+			}
 			sleepFor := retry.Duration()
 			log.Debugf("cannot get leader connection for %s:%d: retry=%d, sleep=%s",
 				topic, partition, try, sleepFor)
-			time.Sleep(sleepFor)
+			if !sleep(sleepFor, stop) {
+				return nil, errCanceled
+			}
 		}
 
 		// Figure out which broker (node/endpoint) is presently leader for this t/p
-		nodeID, err := b.getLeaderEndpoint(topic, partition)
+		nodeID, err := b.getLeaderEndpoint(topic, partition, stop)
+		if err == errCanceled {
+			return nil, err
+		}
 		if err != nil {
 			resErr = err
 			continue
@@ -268,6 +851,9 @@ func (b *Broker) leaderConnection(topic string, partition int32) (*connection, e
 				resErr = err
 				log.Warningf("[leaderConnection %s:%d] failed to connect to %s: %s",
 					topic, partition, addr, err)
+				if _, ok := err.(*AuthenticationError); ok {
+					return nil, err
+				}
 				if _, ok := err.(*NoConnectionsAvailable); !ok {
 					// Forget the endpoint. It's possible this broker has failed and we want to wait
 					// for Kafka to elect a new leader. To trick our algorithm into working we have to
@@ -294,18 +880,15 @@ func (b *Broker) leaderConnection(topic string, partition int32) (*connection, e
 // that this connection is eventually returned to the pool with Idle.
 func (b *Broker) coordinatorConnection(consumerGroup string) (*connection, error) {
 	// Get group coordinator
-	resp, err := b.getGroupCoordinator(consumerGroup)
+	addr, err := b.coordinatorAddr(consumerGroup)
 	if err != nil {
-		log.Warningf("coordinatorConnection: failed to discover coordinator: %s", err)
-		return nil, proto.ErrNoCoordinator
+		return nil, err
 	}
 
 	// Now get connection to actual coordinator
-	addr := fmt.Sprintf("%s:%d", resp.CoordinatorHost, resp.CoordinatorPort)
 	conn, err := b.conns.GetConnectionByAddr(addr)
 	if err != nil {
-		log.Errorf("coordinatorConnection: failed to reach node %d at %s: %s",
-			resp.CoordinatorID, addr, err)
+		log.Errorf("coordinatorConnection: failed to reach coordinator at %s: %s", addr, err)
 		return nil, proto.ErrNoCoordinator
 	}
 
@@ -313,11 +896,33 @@ func (b *Broker) coordinatorConnection(consumerGroup string) (*connection, error
 	return conn, nil
 }
 
+// coordinatorAddr returns the address of the coordinator of the given group,
+// or proto.ErrNoCoordinator if it cannot be found.
+func (b *Broker) coordinatorAddr(consumerGroup string) (string, error) {
+	resp, err := b.getGroupCoordinator(consumerGroup)
+	if err != nil {
+		log.Warningf("coordinatorAddr: failed to discover coordinator: %s", err)
+		return "", proto.ErrNoCoordinator
+	}
+	return net.JoinHostPort(resp.CoordinatorHost, strconv.Itoa(int(resp.CoordinatorPort))), nil
+}
+
 // getGroupCoordinator is an internal function that fetches a group coordinator.
 func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordinatorResp, error) {
-	// Attempt to get idle connection first, else, try all possible brokers
-	// randomly permuted
-	conn := b.conns.GetIdleConnection()
+	// Attempt to use the preferred node, then an idle connection, else, try all
+	// possible brokers randomly permuted
+	var conn *connection
+	if b.conf.PreferredNode != "" {
+		var err error
+		conn, err = b.conns.GetConnectionByAddr(b.conf.PreferredNode)
+		if err != nil {
+			log.Warningf("coordinatorConnection: preferred node %s not available: %s",
+				b.conf.PreferredNode, err)
+		}
+	}
+	if conn == nil {
+		conn = b.conns.GetIdleConnection()
+	}
 	if conn == nil {
 		addrs := b.conns.GetAllAddrs()
 		for _, idx := range rndPerm(len(addrs)) {
@@ -338,9 +943,13 @@ func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordina
 	defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
 
 	// Now fetch coordinator from this broker
-	resp, err := conn.GroupCoordinator(&proto.GroupCoordinatorReq{
-		ClientID:      b.conf.ClientID,
-		ConsumerGroup: consumerGroup,
+	var resp *proto.GroupCoordinatorResp
+	err := measureRequest(b.metrics, proto.GroupCoordinatorReqKind, conn, func() (err error) {
+		resp, err = conn.GroupCoordinator(&proto.GroupCoordinatorReq{
+			ClientID:      b.conf.ClientID,
+			ConsumerGroup: consumerGroup,
+		})
+		return err
 	})
 	if err != nil {
 		log.Errorf("coordinatorConnection: metadata error for %s: %s",
@@ -358,6 +967,17 @@ func (b *Broker) getGroupCoordinator(consumerGroup string) (*proto.GroupCoordina
 // offset will return offset value for given partition. Use timems to specify
 // which offset value should be returned.
 func (b *Broker) offset(topic string, partition int32, timems int64) (int64, error) {
+	offsets, err := b.offsets(topic, partition, timems)
+	// Happens when there are no messages in the partition
+	if len(offsets) == 0 {
+		return 0, err
+	}
+	return offsets[0], err
+}
+
+// offsets returns the offsets Kafka reports for given partition and timems,
+// latest first.
+func (b *Broker) offsets(topic string, partition int32, timems int64) ([]int64, error) {
 	req := &proto.OffsetReq{
 		ClientID:  b.conf.ClientID,
 		ReplicaID: -1, // any client
@@ -380,25 +1000,33 @@ func (b *Broker) offset(topic string, partition int32, timems int64) (int64, err
 offsetRetryLoop:
 	for try := 0; try < b.conf.LeaderRetryLimit; try++ {
 		if try != 0 {
+			if !b.retry(resErr) {
+				break
+			}
 			time.Sleep(retry.Duration())
 		}
 
-		conn, err := b.leaderConnection(topic, partition)
+		epoch := b.cluster.metadataEpoch()
+		conn, err := b.leaderConnection(topic, partition, time.Time{}, nil)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
 
-		resp, err := conn.Offset(req)
+		var resp *proto.OffsetResp
+		err = measureRequest(b.metrics, proto.OffsetReqKind, conn, func() (err error) {
+			resp, err = conn.Offset(req)
+			return err
+		})
 		if err != nil {
-			if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+			if isConnErr(err) {
 				log.Debugf("connection died while sending message to %s:%d: %s",
 					topic, partition, err)
 				_ = conn.Close()
 				resErr = err
 				continue
 			}
-			return 0, err
+			return nil, err
 		}
 
 		for _, t := range resp.Topics {
@@ -410,48 +1038,115 @@ offsetRetryLoop:
 				}
 				resErr = p.Err
 
-				switch p.Err {
-				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
-					proto.ErrBrokerNotAvailable, proto.ErrUnknownTopicOrPartition:
+				if proto.ShouldRefreshMetadata(p.Err) {
 					// Failover happened, so we probably need to talk to a different broker. Let's
 					// kick off a metadata refresh.
 					log.Warningf("cannot fetch offset: %s", p.Err)
-					if err := b.cluster.RefreshMetadata(); err != nil {
-						log.Warningf("cannot refresh metadata: %s", err)
-					}
+					b.cluster.staleLeader(topic, partition, epoch)
 					continue offsetRetryLoop
 				}
 
-				// Happens when there are no messages in the partition
-				if len(p.Offsets) == 0 {
-					return 0, p.Err
-				}
-				return p.Offsets[0], p.Err
+				return p.Offsets, p.Err
 			}
 		}
 	}
 
 	if resErr == nil {
-		return 0, errors.New("incomplete fetch response")
+		return nil, errors.New("incomplete fetch response")
 	}
-	return 0, resErr
+	return nil, resErr
 }
 
 // OffsetEarliest returns the oldest offset available on the given partition.
-func (b *Broker) OffsetEarliest(topic string, partition int32) (int64, error) {
+func (b *Broker) OffsetEarliest(topic string, partition int32) (offset int64, err error) {
+	if err := b.track(); err != nil {
+		return 0, err
+	}
+	defer func() { err = b.untrack(err) }()
+
 	return b.offset(topic, partition, -2)
 }
 
 // OffsetLatest return the offset of the next message produced in given partition
-func (b *Broker) OffsetLatest(topic string, partition int32) (int64, error) {
+func (b *Broker) OffsetLatest(topic string, partition int32) (offset int64, err error) {
+	if err := b.track(); err != nil {
+		return 0, err
+	}
+	defer func() { err = b.untrack(err) }()
+
 	return b.offset(topic, partition, -1)
 }
 
+// OffsetForTime returns the offset to consume given partition from to receive
+// all messages written to it since t. Kafka answers with the first offset of
+// a log segment written before t, so older messages may be received as well.
+// If all messages of the partition were written after t, the oldest offset is
+// returned.
+func (b *Broker) OffsetForTime(topic string, partition int32, t time.Time) (offset int64, err error) {
+	if err := b.track(); err != nil {
+		return 0, err
+	}
+	defer func() { err = b.untrack(err) }()
+
+	// negative times ask for the latest or earliest offset
+	timems := t.UnixNano() / int64(time.Millisecond)
+	if timems < 0 {
+		timems = 0
+	}
+	offsets, err := b.offsets(topic, partition, timems)
+	if err != nil {
+		return 0, err
+	}
+	if len(offsets) == 0 {
+		return b.offset(topic, partition, -2)
+	}
+	return offsets[0], nil
+}
+
 // ProducerConf is the configuration for a producer.
 type ProducerConf struct {
 	// Compression method to use, defaulting to proto.CompressionNone.
+	// proto.CompressionZstd requires RequestVersion 7.
 	Compression proto.Compression
 
+	// SnappyFraming frames snappy compressed messages like the Java client
+	// does, for Java consumers before 0.8.2 that can't read plain snappy.
+	//
+	// Defaults to false.
+	SnappyFraming bool
+
+	// CompressionLevel is the gzip compression level, from gzip.BestSpeed
+	// (1) to gzip.BestCompression (9). Other compression methods ignore it.
+	//
+	// Defaults to 0, which uses gzip's default level.
+	CompressionLevel int
+
+	// CompressionMinBytes is the size of the keys and values of a batch
+	// below which it is sent uncompressed, as compressing small batches
+	// costs more than it saves. Set it to 0 to compress every batch.
+	//
+	// Defaults to 1024.
+	CompressionMinBytes int
+
+	// ShouldCompress, if set, is called with every batch of messages before
+	// it is sent and decides whether Compression is applied to that batch.
+	// Use it to skip compression for batches that are dominated by payloads
+	// which are already compressed, e.g. images.
+	//
+	// Defaults to nil, which compresses every batch.
+	ShouldCompress func(messages []*proto.Message) bool
+
+	// BeforeSend, if set, is called with every message once before it is
+	// sent, and may modify it in place, e.g. to rewrite its key or value.
+	// The partition was already chosen at that point, so changing the key
+	// doesn't move a message chosen by a DistributingProducer. If it returns
+	// an error for any message, none of the messages passed to the same
+	// Produce call are sent and that error is returned. Retries don't call
+	// it again.
+	//
+	// Defaults to nil.
+	BeforeSend func(msg *proto.Message) error
+
 	// Timeout of single produce request. By default, 5 seconds.
 	RequestTimeout time.Duration
 
@@ -472,31 +1167,215 @@ type ProducerConf struct {
 	//
 	// Defaults to 200ms.
 	RetryWait time.Duration
+
+	// VerifyTopicExists makes the producer check the cluster metadata the
+	// first time it produces to a topic, and return ErrTopicNotFound right
+	// away if the topic does not exist instead of retrying. Topics are never
+	// created by producing when this is set, regardless of the broker's
+	// AllowTopicCreation setting.
+	//
+	// Defaults to false.
+	VerifyTopicExists bool
+
+	// RequestVersion is the version of the produce requests, 0 to 7. Version
+	// 1 makes the broker report throttle time and version 2 additionally the
+	// log append time, see ResultProducer. Both need Kafka 0.10 or later.
+	// Version 3 writes messages in format 2, which carries their headers,
+	// and needs Kafka 0.11 or later. From version 6 (Kafka 2.0) on, the
+	// producer waits out throttling itself. Version 7 allows zstd
+	// compression and needs Kafka 2.1 or later.
+	//
+	// Defaults to 0.
+	RequestVersion int16
+
+	// MessageFormat is the format that messages with Format 0 are written
+	// in by produce requests before version 3: 0, or 1 to write their
+	// Timestamp, which requires RequestVersion 2. Their Format is set to it.
+	//
+	// Defaults to 0.
+	MessageFormat int8
+
+	// SequenceHeaderKey, if set, is the key of a header added to every
+	// message, holding a number in decimal that the producer increments
+	// with every message, starting at 0. Gaps in the numbers seen
+	// downstream show lost messages. The numbers are local to the value
+	// returned by Broker.Producer, and unrelated to the sequence numbers of
+	// idempotent producers. A message that already has the header keeps
+	// it, so that producing it again after an error doesn't number it
+	// again. Requires RequestVersion 3.
+	//
+	// Defaults to "", which adds no header.
+	SequenceHeaderKey string
+
+	// AttachOriginHeaders adds the headers OriginHostHeader, holding the
+	// host name, and OriginPIDHeader, holding the process ID in decimal, to
+	// every message, so that consumers can tell where it was produced. Both
+	// are looked up once when the producer is created. Messages that
+	// already have one of the headers keep it. Requires RequestVersion 3.
+	//
+	// Defaults to false.
+	AttachOriginHeaders bool
+
+	// BatchLinger is the longest time messages handed to ProduceBatched wait
+	// for more messages to the same partition before their batch is written,
+	// see BatchedProducer.
+	//
+	// Defaults to 10ms.
+	BatchLinger time.Duration
+
+	// BatchMaxSize is the number of messages at which a partition's batch of
+	// ProduceBatched calls is written without waiting for BatchLinger. A
+	// single call is never split, so batches can be larger.
+	//
+	// Defaults to 100. Zero writes every call on its own.
+	BatchMaxSize int
 }
 
+// The keys of the headers added by ProducerConf.AttachOriginHeaders.
+const (
+	OriginHostHeader = "origin-host"
+	OriginPIDHeader  = "origin-pid"
+)
+
 // NewProducerConf returns a default producer configuration.
 func NewProducerConf() ProducerConf {
 	return ProducerConf{
-		Compression:    proto.CompressionNone,
-		RequestTimeout: 5 * time.Second,
-		RequiredAcks:   proto.RequiredAcksAll,
-		RetryLimit:     10,
-		RetryWait:      200 * time.Millisecond,
+		Compression:         proto.CompressionNone,
+		CompressionMinBytes: 1024,
+		RequestTimeout:      5 * time.Second,
+		RequiredAcks:        proto.RequiredAcksAll,
+		RetryLimit:          10,
+		RetryWait:           200 * time.Millisecond,
+		BatchLinger:         10 * time.Millisecond,
+		BatchMaxSize:        100,
 	}
 }
 
-// producer is the link to the client with extra configuration.
+// Validate returns an error describing the first invalid setting, or nil if
+// the configuration is valid.
+func (conf ProducerConf) Validate() error {
+	switch {
+	case conf.Compression != proto.CompressionNone &&
+		conf.Compression != proto.CompressionGzip &&
+		conf.Compression != proto.CompressionSnappy &&
+		conf.Compression != proto.CompressionLZ4 &&
+		conf.Compression != proto.CompressionZstd:
+		return fmt.Errorf("unknown Compression %d", conf.Compression)
+	case conf.Compression == proto.CompressionZstd && conf.RequestVersion < 7:
+		return fmt.Errorf("zstd Compression requires produce request version 7, not %d", conf.RequestVersion)
+	case conf.CompressionLevel < 0 || conf.CompressionLevel > gzip.BestCompression:
+		return fmt.Errorf("invalid CompressionLevel %d", conf.CompressionLevel)
+	case conf.CompressionMinBytes < 0:
+		return fmt.Errorf("negative CompressionMinBytes %d", conf.CompressionMinBytes)
+	case conf.RequestTimeout < 0:
+		return fmt.Errorf("negative RequestTimeout %s", conf.RequestTimeout)
+	case conf.RequiredAcks < proto.RequiredAcksAll:
+		return fmt.Errorf("invalid RequiredAcks %d", conf.RequiredAcks)
+	case conf.RetryLimit < 0:
+		return fmt.Errorf("negative RetryLimit %d", conf.RetryLimit)
+	case conf.RetryWait < 0:
+		return fmt.Errorf("negative RetryWait %s", conf.RetryWait)
+	case conf.RequestVersion < 0 || conf.RequestVersion > 7:
+		return fmt.Errorf("unsupported produce request version %d", conf.RequestVersion)
+	case conf.MessageFormat != 0 && conf.MessageFormat != 1:
+		return fmt.Errorf("unsupported MessageFormat %d", conf.MessageFormat)
+	case conf.MessageFormat == 1 && conf.RequestVersion < 2:
+		return fmt.Errorf("MessageFormat 1 requires produce request version 2, not %d", conf.RequestVersion)
+	case conf.SequenceHeaderKey != "" && conf.RequestVersion < 3:
+		return fmt.Errorf("SequenceHeaderKey requires produce request version 3, not %d", conf.RequestVersion)
+	case conf.AttachOriginHeaders && conf.RequestVersion < 3:
+		return fmt.Errorf("AttachOriginHeaders requires produce request version 3, not %d", conf.RequestVersion)
+	case conf.BatchLinger < 0:
+		return fmt.Errorf("negative BatchLinger %s", conf.BatchLinger)
+	case conf.BatchMaxSize < 0:
+		return fmt.Errorf("negative BatchMaxSize %d", conf.BatchMaxSize)
+	}
+	return nil
+}
+
+// producer is the link to the client with extra configuration.
 type producer struct {
-	conf   ProducerConf
-	broker *Broker
+	conf    ProducerConf
+	confErr error // returned by every produce if the configuration is invalid
+	broker  *Broker
+
+	// mu protects knownTopics, the topics verified to exist if VerifyTopicExists is set,
+	// and sequence, the number of the next message if SequenceHeaderKey is set.
+	mu          *sync.Mutex
+	knownTopics map[string]bool
+	sequence    uint64
+
+	// origin are the headers added if AttachOriginHeaders is set.
+	origin []proto.RecordHeader
+
+	// batching writes the messages of ProduceBatched.
+	batching *BatchingProducer
 }
 
-// Producer returns new producer instance, bound to the broker.
+// Producer returns new producer instance, bound to the broker. If the
+// configuration is invalid, every produce fails with the error returned by
+// its Validate method.
 func (b *Broker) Producer(conf ProducerConf) Producer {
-	return &producer{
-		conf:   conf,
-		broker: b,
+	confErr := conf.Validate()
+	if confErr != nil {
+		confErr = fmt.Errorf("invalid producer configuration: %s", confErr)
+		log.Errorf("%s", confErr)
 	}
+	p := &producer{
+		conf:        conf,
+		confErr:     confErr,
+		broker:      b,
+		mu:          &sync.Mutex{},
+		knownTopics: make(map[string]bool),
+	}
+	if conf.AttachOriginHeaders {
+		host, err := os.Hostname()
+		if err != nil {
+			log.Warningf("cannot look up host name for origin headers: %s", err)
+		}
+		p.origin = []proto.RecordHeader{
+			{Key: OriginHostHeader, Value: []byte(host)},
+			{Key: OriginPIDHeader, Value: []byte(strconv.Itoa(os.Getpid()))},
+		}
+	}
+	batchSize := conf.BatchMaxSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	// the batching producer starts no goroutines until it is used, and can't
+	// fail with a producer and a positive batch size
+	p.batching, _ = NewBatchingProducer(BatchingProducerConf{
+		Producer:      p,
+		BatchSize:     batchSize,
+		FlushInterval: conf.BatchLinger,
+	})
+	return p
+}
+
+// verifyTopic returns ErrTopicNotFound if the topic does not exist. The cluster
+// metadata is refreshed once if the topic is not known yet; topics which were
+// found are not checked again.
+func (p *producer) verifyTopic(topic string) error {
+	p.mu.Lock()
+	known := p.knownTopics[topic]
+	p.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	if _, err := p.broker.cluster.PartitionCount(topic); err != nil {
+		if err := p.broker.cluster.RefreshMetadata(); err != nil {
+			return err
+		}
+		if _, err := p.broker.cluster.PartitionCount(topic); err != nil {
+			return ErrTopicNotFound
+		}
+	}
+
+	p.mu.Lock()
+	p.knownTopics[topic] = true
+	p.mu.Unlock()
+	return nil
 }
 
 // Produce writes messages to the given destination. Writes within the call are
@@ -505,47 +1384,253 @@ func (b *Broker) Producer(conf ProducerConf) Producer {
 // errors are encountered.  This behaviour can be configured with the
 // RetryLimit and RetryWait attributes.
 //
+// If the leader of the partition moved or the connection to it broke, the
+// metadata is refreshed and the messages are sent to the new leader. Messages
+// sent on a connection that broke may have been written nonetheless, so they
+// can be written twice.
+//
 // Upon a successful call, the message's Offset field is updated.
 func (p *producer) Produce(
 	topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
 
-	offset, err = p.produce(topic, partition, messages...)
-	switch err {
-	case nil:
-		// offset is the offset value of first published messages
-		for i, msg := range messages {
-			msg.Offset = int64(i) + offset
-		}
-	case io.EOF, syscall.EPIPE:
-		// Connection dying / network issues won't be fixed by a metadata refresh.
-	default:
-		// NoConnectionsAvailable also indicates the issue won't be fixed by metadata refresh.
-		if _, ok := err.(*NoConnectionsAvailable); !ok {
-			// Try to refresh metadata in the background, in case the produce failed due to stale
-			// leadership information.
-			go func() {
-				_ = p.broker.cluster.RefreshMetadata()
-			}()
-		}
+	res, err := p.ProduceWithResult(topic, partition, messages...)
+	if err != nil {
+		return 0, err
 	}
-	return offset, err
+	return res.Offset, nil
 }
 
-// produce send produce request to leader for given destination.
-func (p *producer) produce(
-	topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
+// ProduceWithResult writes messages to the given destination like Produce and
+// returns the full result reported by the broker.
+func (p *producer) ProduceWithResult(
+	topic string, partition int32, messages ...*proto.Message) (*ProduceResult, error) {
+
+	return p.produceBefore(time.Time{}, nil, topic, partition, messages...)
+}
+
+// ProduceBatched adds the messages to the batch of the given destination,
+// which is written once it holds BatchMaxSize messages or BatchLinger passed,
+// and returns a channel that receives the result of that write.
+func (p *producer) ProduceBatched(topic string, partition int32, messages ...*proto.Message) <-chan BatchResult {
+	if p.confErr != nil {
+		result := make(chan BatchResult, 1)
+		result <- BatchResult{Err: p.confErr}
+		return result
+	}
+	return p.batching.ProduceBatched(topic, partition, messages...)
+}
+
+// Close writes the batches of ProduceBatched calls that are still waiting.
+func (p *producer) Close() {
+	p.batching.Close()
+}
 
-	conn, err := p.broker.leaderConnection(topic, partition)
+// ProduceBefore writes messages to the given destination like Produce, unless
+// the deadline passes first. The time the broker waits for replicas to
+// acknowledge the write, RequestTimeout, is shortened to the time left until
+// the deadline. Once the request is sent, the response is awaited as usual.
+// A failed request is not retried if the deadline would pass while waiting.
+func (p *producer) ProduceBefore(deadline time.Time,
+	topic string, partition int32, messages ...*proto.Message) (int64, error) {
+
+	res, err := p.produceBefore(deadline, nil, topic, partition, messages...)
 	if err != nil {
 		return 0, err
 	}
+	return res.Offset, nil
+}
+
+// produceBefore writes messages to the given destination. A zero deadline
+// means no deadline. Once cancel is closed, produceBefore gives up with
+// errCanceled, abandoning the request if it was sent already.
+func (p *producer) produceBefore(deadline time.Time, cancel <-chan struct{},
+	topic string, partition int32, messages ...*proto.Message) (res *ProduceResult, err error) {
+
+	start := time.Now()
+	if p.confErr != nil {
+		return nil, p.confErr
+	}
+	if err := p.broker.track(); err != nil {
+		return nil, err
+	}
+	defer func() { err = p.broker.untrack(err) }()
+
+	if p.conf.VerifyTopicExists {
+		if err := p.verifyTopic(topic); err != nil {
+			return nil, err
+		}
+	}
+	if p.conf.BeforeSend != nil {
+		for _, msg := range messages {
+			if err := p.conf.BeforeSend(msg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.conf.SequenceHeaderKey != "" {
+		p.numberMessages(messages)
+	}
+	for _, h := range p.origin {
+		for _, msg := range messages {
+			if _, ok := messageHeader(msg, h.Key); !ok {
+				msg.Headers = append(msg.Headers, h)
+			}
+		}
+	}
+	if p.conf.MessageFormat != 0 && p.conf.RequestVersion < 3 {
+		for _, msg := range messages {
+			if msg.Format == 0 {
+				msg.Format = p.conf.MessageFormat
+			}
+		}
+	}
+
+	retry := &backoff.Backoff{Min: p.conf.RetryWait, Jitter: true}
+	for try := 0; ; try++ {
+		epoch := p.broker.cluster.metadataEpoch()
+		// Wait out the throttle time the leader reported for an earlier
+		// produce before leasing a connection, so that it stays available
+		// to other requests meanwhile.
+		if !p.broker.throttle.wait(p.broker.leaderAddr(topic, partition), cancel) {
+			return nil, errCanceled
+		}
+		// leaderConnection retries on its own, so its errors are final
+		conn, err := p.broker.leaderConnection(topic, partition, deadline, cancel)
+		if err != nil {
+			return nil, err
+		}
+		res, err = p.produce(start, deadline, cancel, conn, topic, partition, messages...)
+		if err == nil {
+			// offset is the offset value of first published messages
+			for i, msg := range messages {
+				msg.Offset = int64(i) + res.Offset
+			}
+			return res, nil
+		}
+		// a request that timed out, which closed its connection, is retried
+		// like one whose connection broke
+		timedOut := err == proto.ErrRequestTimeout && conn.IsClosed()
+		if !timedOut && !isLeaderChangeErr(err) {
+			return nil, err
+		}
+
+		log.Debugf("cannot produce to %s:%d (try %d): %s", topic, partition, try, err)
+		if try >= p.conf.RetryLimit || !p.broker.retry(err) {
+			return nil, err
+		}
+		wait := retry.Duration()
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		// The partition may have moved to another node, so look up its
+		// leader in fresh metadata before retrying. Produces that give up
+		// leave the cached leader alone.
+		p.broker.cluster.staleLeader(topic, partition, epoch)
+		if !sleep(wait, cancel) {
+			return nil, errCanceled
+		}
+	}
+}
+
+// numberMessages adds the SequenceHeaderKey header to the messages that
+// don't have it yet.
+func (p *producer) numberMessages(messages []*proto.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, msg := range messages {
+		if _, ok := messageHeader(msg, p.conf.SequenceHeaderKey); ok {
+			continue
+		}
+		msg.Headers = append(msg.Headers, proto.RecordHeader{
+			Key:   p.conf.SequenceHeaderKey,
+			Value: strconv.AppendUint(nil, p.sequence, 10),
+		})
+		p.sequence++
+	}
+}
+
+// messageHeader returns the value of the first header of msg with the given
+// key, and whether there is one.
+func messageHeader(msg *proto.Message, key string) ([]byte, bool) {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return nil, false
+}
+
+// isLeaderChangeErr returns true if a request failed with err because the
+// leader of the partition moved or went away, so that it can succeed once
+// the new leader is looked up.
+func isLeaderChangeErr(err error) bool {
+	if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		return true
+	}
+	return proto.ShouldRefreshMetadata(err)
+}
+
+// isConnErr returns true if a request failed with err because its connection
+// broke or its response didn't arrive within ResponseTimeout. Errors Kafka
+// reports for single partitions are part of the response, so a
+// proto.ErrRequestTimeout returned for the request itself is always a timeout
+// of the connection.
+func isConnErr(err error) bool {
+	if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		return true
+	}
+	return err == proto.ErrRequestTimeout
+}
+
+// compression returns the compression method to use for the given batch.
+func (p *producer) compression(messages []*proto.Message) proto.Compression {
+	if p.conf.Compression == proto.CompressionNone {
+		return proto.CompressionNone
+	}
+	if p.conf.CompressionMinBytes > 0 {
+		var size int
+		for _, m := range messages {
+			size += len(m.Key) + len(m.Value)
+		}
+		if size < p.conf.CompressionMinBytes {
+			return proto.CompressionNone
+		}
+	}
+	if p.conf.ShouldCompress != nil && !p.conf.ShouldCompress(messages) {
+		return proto.CompressionNone
+	}
+	return p.conf.Compression
+}
+
+// produce sends a single produce request using conn, a connection to the
+// leader, and returns conn to the pool. Once it is acknowledged, the time
+// since start and the time of the request alone are reported to the broker's
+// Metrics.
+func (p *producer) produce(start, deadline time.Time, cancel <-chan struct{}, conn *connection,
+	topic string, partition int32, messages ...*proto.Message) (*ProduceResult, error) {
+
 	defer func(lconn *connection) { go p.broker.conns.Idle(lconn) }(conn)
 
+	timeout := p.conf.RequestTimeout
+	if !deadline.IsZero() {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, ErrDeadlineExceeded
+		}
+		if left < timeout {
+			timeout = left
+		}
+	}
+
 	req := proto.ProduceReq{
-		ClientID:     p.broker.conf.ClientID,
-		Compression:  p.conf.Compression,
-		RequiredAcks: p.conf.RequiredAcks,
-		Timeout:      p.conf.RequestTimeout,
+		Version:          p.conf.RequestVersion,
+		CorrelationID:    newCorrelationID(),
+		ClientID:         p.broker.conf.ClientID,
+		Compression:      p.compression(messages),
+		CompressionLevel: p.conf.CompressionLevel,
+		SnappyFraming:    p.conf.SnappyFraming,
+		RequiredAcks:     p.conf.RequiredAcks,
+		Timeout:          timeout,
 		Topics: []proto.ProduceReqTopic{
 			{
 				Name: topic,
@@ -559,9 +1644,29 @@ func (p *producer) produce(
 		},
 	}
 
-	resp, err := conn.Produce(&req)
+	var resp *proto.ProduceResp
+	span := &RequestSpan{
+		Request:       "produce",
+		Broker:        conn.addr,
+		Topic:         topic,
+		Partition:     partition,
+		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
+	}
+	requestStart := time.Now()
+	interrupted := interruptOnCancel(conn, cancel)
+	err := measureRequest(p.broker.metrics, proto.ProduceReqKind, conn, func() error {
+		return traceRequest(p.broker.conf.Tracer, span, func() (err error) {
+			resp, err = conn.Produce(&req)
+			return err
+		})
+	})
+	requestTime := time.Since(requestStart)
+	if interrupted() {
+		return nil, errCanceled
+	}
 	if err != nil {
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		if isConnErr(err) {
 			// Connection is broken, so should be closed, but the error is
 			// still valid and should be returned so that retry mechanism have
 			// chance to react.
@@ -569,12 +1674,17 @@ func (p *producer) produce(
 				topic, partition, err)
 			_ = conn.Close()
 		}
-		return 0, err
+		return nil, err
 	}
 
 	// No response if we've asked for no acks
+	metrics := p.broker.metrics
+	if resp != nil && req.Version >= clientThrottleVersion {
+		p.broker.throttle.throttle(conn.addr, resp.ThrottleTime)
+	}
 	if req.RequiredAcks == proto.RequiredAcksNone {
-		return 0, err
+		metrics.ProduceLatency(topic, partition, time.Since(start), requestTime)
+		return &ProduceResult{LogStartOffset: -1}, nil
 	}
 
 	// Presently we only handle producing to a single topic/partition so return it as
@@ -587,13 +1697,26 @@ func (p *producer) produce(
 				continue
 			}
 
-			return p.Offset, p.Err
+			if p.Err != nil {
+				return nil, p.Err
+			}
+			metrics.ProduceLatency(topic, partition, time.Since(start), requestTime)
+			res := &ProduceResult{
+				Offset:         p.Offset,
+				LogAppendTime:  p.LogAppendTime,
+				ThrottleTime:   resp.ThrottleTime,
+				LogStartOffset: p.LogStartOffset,
+			}
+			if req.Version < 5 {
+				res.LogStartOffset = -1
+			}
+			return res, nil
 		}
 	}
 
 	// If we get here we didn't find the topic/partition in the response, this is an
 	// error condition of some kind
-	return 0, errors.New("incomplete produce response")
+	return nil, errors.New("incomplete produce response")
 }
 
 // ConsumerConf represents consumer configuration.
@@ -635,6 +1758,36 @@ type ConsumerConf struct {
 	// Default is 500ms.
 	RetryErrWait time.Duration
 
+	// ReplicaRetryLimit limits the number of retry attempts when a fetch
+	// fails with ErrReplicaNotAvailable, which happens briefly while a
+	// partition is being reassigned. These retries are not counted against
+	// RetryErrLimit.
+	//
+	// Default is 10.
+	ReplicaRetryLimit int
+
+	// ReplicaRetryWait controls the wait duration between retries after a
+	// fetch failed with ErrReplicaNotAvailable. This follows the exponential
+	// backoff curve and should be kept short.
+	//
+	// Default is 20ms.
+	ReplicaRetryWait time.Duration
+
+	// Busy, if set, is called before every fetch request. While it returns true
+	// the consumer does not fetch new messages and instead waits BusyWait
+	// before asking again. Messages already fetched are still returned. This
+	// lets applications apply backpressure when their downstream cannot keep
+	// up.
+	//
+	// Default is nil, which never pauses.
+	Busy func() bool
+
+	// BusyWait controls how long the consumer waits before calling Busy again
+	// after it returned true.
+	//
+	// Default is 50ms.
+	BusyWait time.Duration
+
 	// MinFetchSize is the minimum size of messages to fetch in bytes.
 	//
 	// Default is 1 to fetch any message available.
@@ -646,6 +1799,55 @@ type ConsumerConf struct {
 	// Default is 2000000 bytes.
 	MaxFetchSize int32
 
+	// MaxMessagesPerFetch limits the number of messages a single ConsumeBatch
+	// call returns. The rest of the fetched messages are buffered and returned
+	// by the following calls without fetching again.
+	//
+	// Default is 0, which returns all fetched messages at once.
+	MaxMessagesPerFetch int
+
+	// DecompressionLimiter bounds how many compressed message sets are
+	// decompressed at the same time and reuses the decompression buffers.
+	// Share a single limiter between all consumers whose memory use should be
+	// bounded together.
+	//
+	// Default is nil, which decompresses without limits.
+	DecompressionLimiter *proto.DecompressionLimiter
+
+	// SkipCRCValidation turns off checking fetched messages against their
+	// crc, which saves computing it for every message. When checked, a
+	// corrupt message makes Consume return proto.ErrInvalidMessageCRC once
+	// the messages before it were consumed.
+	//
+	// Default is false.
+	SkipCRCValidation bool
+
+	// MaxTimestampSkew is how far the timestamp of a message may be ahead of
+	// the clock of the consumer. Messages with timestamps further ahead,
+	// usually written by a producer with a wrong clock, have their
+	// FutureTimestamp set and are counted by Metrics.CountFutureTimestamp.
+	// Timestamps require RequestVersion 2 or later.
+	//
+	// Default is 0, which doesn't check timestamps.
+	MaxTimestampSkew time.Duration
+
+	// ClampFutureTimestamps sets the Timestamp of messages found ahead by
+	// MaxTimestampSkew to the time they were fetched, so that windows and
+	// retention computed from timestamps downstream are not thrown off.
+	//
+	// Default is false, which only flags them.
+	ClampFutureTimestamps bool
+
+	// MaxMessageAge, if positive, makes the consumer skip messages whose
+	// timestamp is longer ago than that, for applications that have no use
+	// for old data after falling behind. Skipped messages are consumed like
+	// others, moving the offset past them, and counted by
+	// Metrics.CountStaleMessages. Messages without a timestamp are never
+	// skipped. Timestamps require RequestVersion 2 or later.
+	//
+	// Default is 0, which doesn't skip messages.
+	MaxMessageAge time.Duration
+
 	// Consumer cursor starting point. Set to StartOffsetNewest to receive only
 	// newly created messages or StartOffsetOldest to read everything. Assign
 	// any offset value to manually set cursor -- consuming starts with the
@@ -653,22 +1855,86 @@ type ConsumerConf struct {
 	//
 	// Default is StartOffsetOldest.
 	StartOffset int64
+
+	// RequestVersion is the version of the fetch requests, 0 to 10. Version 2
+	// returns messages in format 1 with their timestamps and needs Kafka 0.10
+	// or later. Version 4 returns messages in format 2 with their headers,
+	// including those of aborted transactions, and needs Kafka 0.11 or later.
+	// Brokers only return zstd compressed messages for version 10, which
+	// needs Kafka 2.1 or later.
+	//
+	// Default is 0.
+	RequestVersion int16
 }
 
 // NewConsumerConf returns the default consumer configuration.
 func NewConsumerConf(topic string, partition int32) ConsumerConf {
 	return ConsumerConf{
-		Topic:          topic,
-		Partition:      partition,
-		RequestTimeout: time.Millisecond * 50,
-		RetryLimit:     -1,
-		RetryWait:      time.Millisecond * 50,
-		RetryErrLimit:  10,
-		RetryErrWait:   time.Millisecond * 500,
-		MinFetchSize:   1,
-		MaxFetchSize:   2000000,
-		StartOffset:    StartOffsetOldest,
+		Topic:             topic,
+		Partition:         partition,
+		RequestTimeout:    time.Millisecond * 50,
+		RetryLimit:        -1,
+		RetryWait:         time.Millisecond * 50,
+		RetryErrLimit:     10,
+		RetryErrWait:      time.Millisecond * 500,
+		ReplicaRetryLimit: 10,
+		ReplicaRetryWait:  time.Millisecond * 20,
+		BusyWait:          time.Millisecond * 50,
+		MinFetchSize:      1,
+		MaxFetchSize:      2000000,
+		StartOffset:       StartOffsetOldest,
+	}
+}
+
+// Validate returns an error describing the first invalid setting, or nil if
+// the configuration is valid.
+func (conf ConsumerConf) Validate() error {
+	switch {
+	case conf.Topic == "":
+		return errors.New("missing Topic")
+	case conf.Partition < 0:
+		return fmt.Errorf("negative Partition %d", conf.Partition)
+	case conf.RequestTimeout < 0:
+		return fmt.Errorf("negative RequestTimeout %s", conf.RequestTimeout)
+	case conf.RetryLimit < -1:
+		return fmt.Errorf("invalid RetryLimit %d, use -1 for no limit", conf.RetryLimit)
+	case conf.RetryWait < 0:
+		return fmt.Errorf("negative RetryWait %s", conf.RetryWait)
+	case conf.RetryErrLimit < 1:
+		return fmt.Errorf("RetryErrLimit %d allows no fetch at all", conf.RetryErrLimit)
+	case conf.RetryErrWait < 0:
+		return fmt.Errorf("negative RetryErrWait %s", conf.RetryErrWait)
+	case conf.ReplicaRetryLimit < 0:
+		return fmt.Errorf("negative ReplicaRetryLimit %d", conf.ReplicaRetryLimit)
+	case conf.ReplicaRetryWait < 0:
+		return fmt.Errorf("negative ReplicaRetryWait %s", conf.ReplicaRetryWait)
+	case conf.Busy != nil && conf.BusyWait <= 0:
+		return fmt.Errorf("BusyWait %s must be positive when Busy is set", conf.BusyWait)
+	case conf.MinFetchSize < 0:
+		return fmt.Errorf("negative MinFetchSize %d", conf.MinFetchSize)
+	case conf.MaxFetchSize < 1:
+		return fmt.Errorf("MaxFetchSize %d must be positive", conf.MaxFetchSize)
+	case conf.MaxFetchSize < conf.MinFetchSize:
+		return fmt.Errorf("MaxFetchSize %d is smaller than MinFetchSize %d",
+			conf.MaxFetchSize, conf.MinFetchSize)
+	case conf.MaxMessagesPerFetch < 0:
+		return fmt.Errorf("negative MaxMessagesPerFetch %d", conf.MaxMessagesPerFetch)
+	case conf.StartOffset < StartOffsetNewest:
+		return fmt.Errorf("invalid StartOffset %d", conf.StartOffset)
+	case conf.RequestVersion < 0 || conf.RequestVersion > 10:
+		return fmt.Errorf("unsupported fetch request version %d", conf.RequestVersion)
+	case conf.MaxTimestampSkew < 0:
+		return fmt.Errorf("negative MaxTimestampSkew %s", conf.MaxTimestampSkew)
+	case conf.MaxTimestampSkew > 0 && conf.RequestVersion < 2:
+		return fmt.Errorf("MaxTimestampSkew requires fetch request version 2, not %d", conf.RequestVersion)
+	case conf.ClampFutureTimestamps && conf.MaxTimestampSkew == 0:
+		return errors.New("ClampFutureTimestamps requires MaxTimestampSkew")
+	case conf.MaxMessageAge < 0:
+		return fmt.Errorf("negative MaxMessageAge %s", conf.MaxMessageAge)
+	case conf.MaxMessageAge > 0 && conf.RequestVersion < 2:
+		return fmt.Errorf("MaxMessageAge requires fetch request version 2, not %d", conf.RequestVersion)
 	}
+	return nil
 }
 
 // Consumer represents a single partition reading buffer. Consumer is also
@@ -681,6 +1947,14 @@ type consumer struct {
 	mu     *sync.Mutex
 	offset int64 // offset of next NOT consumed message
 	msgbuf []*proto.Message
+
+	// seekTo is the offset set by SeekTo that the consumer did not move to
+	// yet, or -1. It is accessed atomically, so that seeking does not wait for
+	// a fetch holding mu.
+	seekTo *int64
+
+	handoff   OffsetCoordinator // set by StopAtCommit
+	handedOff bool              // offset was committed after StopAtCommit
 }
 
 // Consumer creates a new consumer instance, bound to the broker.
@@ -694,6 +1968,9 @@ func (b *Broker) BatchConsumer(conf ConsumerConf) (BatchConsumer, error) {
 }
 
 func (b *Broker) consumer(conf ConsumerConf) (*consumer, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid consumer configuration: %s", err)
+	}
 	offset := conf.StartOffset
 	if offset < 0 {
 		switch offset {
@@ -713,12 +1990,14 @@ func (b *Broker) consumer(conf ConsumerConf) (*consumer, error) {
 			return nil, fmt.Errorf("invalid start offset: %d", conf.StartOffset)
 		}
 	}
+	seekTo := int64(-1)
 	c := &consumer{
 		broker: b,
 		mu:     &sync.Mutex{},
 		conf:   conf,
 		msgbuf: make([]*proto.Message, 0),
 		offset: offset,
+		seekTo: &seekTo,
 	}
 	return c, nil
 }
@@ -731,12 +2010,27 @@ func (b *Broker) consumer(conf ConsumerConf) (*consumer, error) {
 // consume can retry sending request on common errors. This behaviour can
 // be configured with RetryErrLimit and RetryErrWait consumer configuration
 // attributes.
-func (c *consumer) consume() ([]*proto.Message, error) {
+//
+// Once cancel is closed, consume gives up with errCanceled.
+func (c *consumer) consume(cancel <-chan struct{}) ([]*proto.Message, error) {
 	var msgbuf []*proto.Message
 	var retry int
 	for len(msgbuf) == 0 {
+		if !c.waitWhileBusy(cancel) {
+			return nil, errCanceled
+		}
+		if c.broker.isClosed() {
+			return nil, ErrClosed
+		}
+
 		var err error
-		msgbuf, err = c.fetch()
+		msgbuf, err = c.fetch(cancel)
+		if err == nil && c.applySeek() {
+			// the consumer was moved during the fetch, so the messages are
+			// from the old offset
+			msgbuf = nil
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -745,8 +2039,8 @@ func (c *consumer) consume() ([]*proto.Message, error) {
 			if c.conf.RetryLimit != -1 && retry > c.conf.RetryLimit {
 				return nil, ErrNoData
 			}
-			if c.conf.RetryWait > 0 {
-				time.Sleep(c.conf.RetryWait)
+			if c.conf.RetryWait > 0 && !sleep(c.conf.RetryWait, cancel) {
+				return nil, errCanceled
 			}
 		}
 	}
@@ -754,59 +2048,235 @@ func (c *consumer) consume() ([]*proto.Message, error) {
 	return msgbuf, nil
 }
 
+// waitWhileBusy blocks for as long as the configured Busy predicate reports
+// that the application cannot accept more messages. It returns false if
+// cancel was closed while waiting.
+func (c *consumer) waitWhileBusy(cancel <-chan struct{}) bool {
+	if c.conf.Busy == nil {
+		return true
+	}
+	for c.conf.Busy() && !c.broker.isClosed() {
+		if !sleep(c.conf.BusyWait, cancel) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *consumer) Consume() (*proto.Message, error) {
+	return c.consumeOne(nil)
+}
+
+// consumeOne works like Consume, but gives up with errCanceled once cancel is
+// closed.
+func (c *consumer) consumeOne(cancel <-chan struct{}) (*proto.Message, error) {
+	batch, err := c.next(1, cancel)
+	if err != nil {
+		return nil, err
+	}
+	msg := batch[0]
+	// don't keep the message alive through the buffer
+	batch[0] = nil
+	return msg, nil
+}
+
+func (c *consumer) Peek() (msg *proto.Message, err error) {
+	if err := c.broker.track(); err != nil {
+		return nil, err
+	}
+	defer func() { err = c.broker.untrack(err) }()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if len(c.msgbuf) == 0 {
-		var err error
-		c.msgbuf, err = c.consume()
-		if err != nil {
-			return nil, err
-		}
+	c.applySeek()
+	if err := c.fill(nil); err != nil {
+		return nil, err
 	}
-
-	msg := c.msgbuf[0]
-	c.msgbuf[0] = nil
-	c.msgbuf = c.msgbuf[1:]
-	c.offset = msg.Offset + 1
-	return msg, nil
+	return c.msgbuf[0], nil
 }
 
 func (c *consumer) ConsumeBatch() ([]*proto.Message, error) {
+	return c.next(c.conf.MaxMessagesPerFetch, nil)
+}
+
+// next removes up to max messages from the buffer, or all of them if max is
+// not positive, and advances the offset past them. If the buffer is empty, it
+// is filled first, unless cancel is closed before.
+func (c *consumer) next(max int, cancel <-chan struct{}) (batch []*proto.Message, err error) {
+	if err := c.broker.track(); err != nil {
+		return nil, err
+	}
+	defer func() { err = c.broker.untrack(err) }()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	batch, err := c.consume()
-	if err != nil {
+	c.applySeek()
+	if err := c.fill(cancel); err != nil {
 		return nil, err
 	}
-	c.offset = batch[len(batch)-1].Offset + 1
-
+	if c.conf.MaxMessageAge > 0 {
+		// stale messages between the taken ones are dropped
+		for len(c.msgbuf) > 0 && (max <= 0 || len(batch) < max) {
+			batch = append(batch, c.msgbuf[0])
+			c.offset = c.msgbuf[0].Offset + 1
+			c.msgbuf[0] = nil
+			c.msgbuf = c.msgbuf[1:]
+			c.dropStale()
+		}
+		return batch, nil
+	}
+	n := len(c.msgbuf)
+	if max > 0 && n > max {
+		n = max
+	}
+	batch, c.msgbuf = c.msgbuf[:n:n], c.msgbuf[n:]
+	c.offset = batch[n-1].Offset + 1
 	return batch, nil
 }
 
-func (c *consumer) SeekToLatest() error {
+// fill fetches new messages into the buffer if it is empty, unless the
+// consumer was stopped by StopAtCommit, in which case the offset is committed
+// and ErrHandoff returned. Messages older than MaxMessageAge at the head of
+// the buffer are dropped first, fetching again if none are left. Must be
+// called with mu held.
+func (c *consumer) fill(cancel <-chan struct{}) error {
+	c.dropStale()
+	for len(c.msgbuf) == 0 {
+		if c.handoff != nil {
+			return c.commitHandoff()
+		}
+		msgbuf, err := c.consume(cancel)
+		if err != nil {
+			return err
+		}
+		c.checkTimestamps(msgbuf)
+		c.msgbuf = msgbuf
+		c.dropStale()
+	}
+	return nil
+}
+
+// dropStale removes the messages older than MaxMessageAge from the head of
+// the buffer, advancing the offset past them, and reports them to
+// Metrics.CountStaleMessages. Must be called with mu held.
+func (c *consumer) dropStale() {
+	if c.conf.MaxMessageAge == 0 {
+		return
+	}
+	var n int
+	for len(c.msgbuf) > 0 {
+		age, ok := c.msgbuf[0].Age()
+		if !ok || age <= c.conf.MaxMessageAge {
+			break
+		}
+		c.offset = c.msgbuf[0].Offset + 1
+		c.msgbuf[0] = nil
+		c.msgbuf = c.msgbuf[1:]
+		n++
+	}
+	if n > 0 {
+		c.broker.metrics.CountStaleMessages(c.conf.Topic, c.conf.Partition, n)
+	}
+}
+
+// checkTimestamps flags the messages whose timestamps are more than
+// MaxTimestampSkew ahead of the local clock and, with ClampFutureTimestamps,
+// sets their timestamps to the current time.
+func (c *consumer) checkTimestamps(msgbuf []*proto.Message) {
+	if c.conf.MaxTimestampSkew == 0 {
+		return
+	}
+	now := time.Now()
+	for _, msg := range msgbuf {
+		if msg.Timestamp.IsZero() {
+			continue
+		}
+		ahead := msg.Timestamp.Sub(now)
+		if ahead <= c.conf.MaxTimestampSkew {
+			continue
+		}
+		msg.FutureTimestamp = true
+		if c.conf.ClampFutureTimestamps {
+			msg.Timestamp = now
+		}
+		c.broker.metrics.CountFutureTimestamp(c.conf.Topic, c.conf.Partition, ahead)
+	}
+}
+
+func (c *consumer) StopAtCommit(coordinator OffsetCoordinator) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.handoff = coordinator
+}
+
+// commitHandoff commits the offset of the next message after StopAtCommit
+// and returns ErrHandoff, or the error of the commit, in which case the commit
+// is tried again by the next call. Must be called with mu held.
+func (c *consumer) commitHandoff() error {
+	if c.handedOff {
+		return ErrHandoff
+	}
+	if err := c.handoff.Commit(c.conf.Topic, c.conf.Partition, c.offset); err != nil {
+		return err
+	}
+	c.handedOff = true
+	log.Infof("Consumer for [%s:%d] stopped at committed offset %d",
+		c.conf.Topic, c.conf.Partition, c.offset)
+	return ErrHandoff
+}
+
+func (c *consumer) SeekToLatest() error {
+	// OffsetLatest takes care of returning ErrClosed.
 	off, err := c.broker.OffsetLatest(c.conf.Topic, c.conf.Partition)
 	if err != nil {
 		return err
 	}
-	oldOffset := c.offset
-	c.offset = off
-	c.msgbuf = make([]*proto.Message, 0)
-	log.Infof("SeekToLatest moving [%s:%d] offset %d -> %d.",
-		c.conf.Topic, c.conf.Partition, oldOffset, c.offset)
+	atomic.StoreInt64(c.seekTo, off)
+	return nil
+}
+
+func (c *consumer) SeekTo(offset int64) error {
+	// OffsetEarliest and OffsetLatest take care of returning ErrClosed.
+	earliest, err := c.broker.OffsetEarliest(c.conf.Topic, c.conf.Partition)
+	if err != nil {
+		return err
+	}
+	latest, err := c.broker.OffsetLatest(c.conf.Topic, c.conf.Partition)
+	if err != nil {
+		return err
+	}
+	if offset < earliest || offset > latest {
+		return proto.ErrOffsetOutOfRange
+	}
+	atomic.StoreInt64(c.seekTo, offset)
 	return nil
 }
 
+// applySeek moves the consumer to the offset set by SeekTo or SeekToLatest,
+// discarding the buffered messages, and returns true if there was one. Must
+// be called with mu held.
+func (c *consumer) applySeek() bool {
+	offset := atomic.SwapInt64(c.seekTo, -1)
+	if offset < 0 {
+		return false
+	}
+	log.Infof("Seek moving [%s:%d] offset %d -> %d.",
+		c.conf.Topic, c.conf.Partition, c.offset, offset)
+	c.offset = offset
+	c.msgbuf = make([]*proto.Message, 0)
+	return true
+}
+
 // fetch and return next batch of messages. In case of certain set of errors,
 // retry sending fetch request. Retry behaviour can be configured with
-// RetryErrLimit and RetryErrWait consumer configuration attributes.
-func (c *consumer) fetch() ([]*proto.Message, error) {
+// RetryErrLimit and RetryErrWait consumer configuration attributes. Once
+// cancel is closed, fetch gives up with errCanceled.
+func (c *consumer) fetch(cancel <-chan struct{}) ([]*proto.Message, error) {
 	req := proto.FetchReq{
+		Version:     c.conf.RequestVersion,
 		ClientID:    c.broker.conf.ClientID,
 		MaxWaitTime: c.conf.RequestTimeout,
 		MinBytes:    c.conf.MinFetchSize,
@@ -826,33 +2296,69 @@ func (c *consumer) fetch() ([]*proto.Message, error) {
 
 	var resErr error
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+	replicaRetry := &backoff.Backoff{Min: c.conf.ReplicaRetryWait, Jitter: true}
+	replicaTries := 0
+	skipWait := false
 consumeRetryLoop:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
-		if try != 0 {
-			time.Sleep(retry.Duration())
+		if try != 0 && !c.broker.retry(resErr) {
+			break
+		}
+		if try != 0 && !skipWait && !sleep(retry.Duration(), cancel) {
+			return nil, errCanceled
 		}
+		skipWait = false
 
-		conn, err := c.broker.leaderConnection(c.conf.Topic, c.conf.Partition)
-		if err != nil {
+		epoch := c.broker.cluster.metadataEpoch()
+		conn, err := c.broker.leaderConnection(c.conf.Topic, c.conf.Partition, time.Time{}, cancel)
+		if err == ErrClosed || err == errCanceled {
+			return nil, err
+		} else if err != nil {
 			resErr = err
 			continue
 		}
 		defer func(lconn *connection) { go c.broker.conns.Idle(lconn) }(conn)
 
-		resp, err := conn.Fetch(&req)
+		var resp *proto.FetchResp
+		var size int
+		req.CorrelationID = newCorrelationID()
+		span := &RequestSpan{
+			Request:       "fetch",
+			Broker:        conn.addr,
+			Topic:         c.conf.Topic,
+			Partition:     c.conf.Partition,
+			CorrelationID: req.CorrelationID,
+		}
+		interrupted := interruptOnCancel(conn, cancel)
+		err = measureRequest(c.broker.metrics, proto.FetchReqKind, conn, func() error {
+			return traceRequest(c.broker.conf.Tracer, span, func() (err error) {
+				resp, size, err = conn.fetchSized(&req, c.conf.DecompressionLimiter, c.conf.SkipCRCValidation)
+				return err
+			})
+		})
+		if interrupted() {
+			return nil, errCanceled
+		}
 		resErr = err
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		if isConnErr(err) {
 			log.Debugf("connection died while fetching messages from %s:%d: %s",
 				c.conf.Topic, c.conf.Partition, err)
 			_ = conn.Close()
+			// the leader may have gone away with the connection
+			c.broker.cluster.staleLeader(c.conf.Topic, c.conf.Partition, epoch)
 			continue
 		}
 
 		if err != nil {
-			log.Debugf("cannot fetch messages (try %d): %s", retry, err)
+			log.Debugf("cannot fetch messages (try %d): %s", try, err)
 			_ = conn.Close()
 			continue
 		}
+		if resp.Err != nil {
+			log.Debugf("cannot fetch messages (try %d): %s", try, resp.Err)
+			resErr = resp.Err
+			continue
+		}
 
 		// Should only be a single topic/partition in the response, the one we asked about.
 		for _, t := range resp.Topics {
@@ -863,18 +2369,43 @@ consumeRetryLoop:
 					continue
 				}
 
-				switch p.Err {
-				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
-					proto.ErrBrokerNotAvailable, proto.ErrUnknownTopicOrPartition:
+				switch {
+				case proto.ShouldRefreshMetadata(p.Err):
 					// Failover happened, so we probably need to talk to a different broker. Let's
 					// kick off a metadata refresh.
-					log.Warningf("cannot fetch messages (try %d): %s", retry, p.Err)
-					if err := c.broker.cluster.RefreshMetadata(); err != nil {
-						log.Warningf("cannot refresh metadata: %s", err)
+					log.Warningf("cannot fetch messages (try %d): %s", try, p.Err)
+					resErr = p.Err
+					c.broker.cluster.staleLeader(c.conf.Topic, c.conf.Partition, epoch)
+					continue consumeRetryLoop
+				case p.Err == proto.ErrReplicaNotAvailable:
+					// Transient during partition reassignment, retry quickly without
+					// using up the general error retries.
+					resErr = p.Err
+					if replicaTries < c.conf.ReplicaRetryLimit {
+						replicaTries++
+						c.broker.metrics.CountRetry(p.Err)
+						log.Debugf("replica not available for %s:%d (try %d)",
+							c.conf.Topic, c.conf.Partition, replicaTries)
+						if !sleep(replicaRetry.Duration(), cancel) {
+							return nil, errCanceled
+						}
+						try--
+						skipWait = true
 					}
 					continue consumeRetryLoop
+				case p.Err == proto.ErrInvalidMessageCRC:
+					// The messages before the corrupt one are consumed
+					// first, so that the error is returned by the fetch
+					// starting at it.
+					if messages := skipBefore(p.Messages, req.Topics[0].Partitions[0].FetchOffset); len(messages) != 0 {
+						return messages, nil
+					}
+					return nil, p.Err
 				}
-				return p.Messages, p.Err
+				if p.Err == nil {
+					c.broker.metrics.FetchSize(c.conf.Topic, c.conf.Partition, size, len(p.Messages))
+				}
+				return skipBefore(p.Messages, req.Topics[0].Partitions[0].FetchOffset), p.Err
 			}
 		}
 		return nil, errors.New("incomplete fetch response")
@@ -883,6 +2414,18 @@ consumeRetryLoop:
 	return nil, resErr
 }
 
+// skipBefore returns the messages from the one at offset on. Brokers return
+// whole record batches, and compressed message sets, so the first messages of
+// a fetch response may precede the requested offset.
+func skipBefore(messages []*proto.Message, offset int64) []*proto.Message {
+	for i, msg := range messages {
+		if msg.Offset >= offset {
+			return messages[i:]
+		}
+	}
+	return nil
+}
+
 // OffsetCoordinatorConf is configuration for the offset coordinatior.
 type OffsetCoordinatorConf struct {
 	ConsumerGroup string
@@ -893,6 +2436,15 @@ type OffsetCoordinatorConf struct {
 	// RetryErrWait controls wait duration between retries after failed fetch
 	// request. By default 500ms.
 	RetryErrWait time.Duration
+
+	// GenerationID and MemberID are sent with every commit, so that the
+	// coordinator rejects commits made after this member lost its partitions
+	// with proto.ErrIllegalGeneration or proto.ErrUnknownConsumerID. Both
+	// change whenever the group rebalances, see GenerationCoordinator.
+	//
+	// Default is no MemberID, which commits without group membership.
+	GenerationID int32
+	MemberID     string
 }
 
 // NewOffsetCoordinatorConf returns default OffsetCoordinator configuration.
@@ -908,39 +2460,131 @@ type offsetCoordinator struct {
 	conf   OffsetCoordinatorConf
 	broker *Broker
 
-	mu   *sync.Mutex
-	conn *connection
+	// mu protects the following.
+	mu           *sync.Mutex
+	generationID int32
+	memberID     string
+	addr         string // address of the coordinator, empty until looked up
 }
 
 // OffsetCoordinator returns offset management coordinator for single consumer
 // group, bound to broker.
 func (b *Broker) OffsetCoordinator(conf OffsetCoordinatorConf) (OffsetCoordinator, error) {
 	c := &offsetCoordinator{
-		broker: b,
-		conf:   conf,
+		broker:       b,
+		conf:         conf,
+		mu:           &sync.Mutex{},
+		generationID: conf.GenerationID,
+		memberID:     conf.MemberID,
 	}
 	return c, nil
 }
 
+// SetGeneration replaces the generation and member ID sent with the
+// following commits.
+func (c *offsetCoordinator) SetGeneration(generationID int32, memberID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generationID = generationID
+	c.memberID = memberID
+}
+
+// connection returns a connection to the coordinator of the group and its
+// address. The coordinator is looked up unless its address is known from an
+// earlier call. The connection must be returned to the pool with Idle.
+func (c *offsetCoordinator) connection() (*connection, string, error) {
+	c.mu.Lock()
+	addr := c.addr
+	c.mu.Unlock()
+
+	if addr == "" {
+		var err error
+		if addr, err = c.broker.coordinatorAddr(c.conf.ConsumerGroup); err != nil {
+			return nil, "", err
+		}
+		c.mu.Lock()
+		c.addr = addr
+		c.mu.Unlock()
+	}
+
+	conn, err := c.broker.conns.GetConnectionByAddr(addr)
+	if err != nil {
+		log.Warningf("cannot connect to coordinator of %s at %s: %s",
+			c.conf.ConsumerGroup, addr, err)
+		c.forget(addr)
+		return nil, "", proto.ErrNoCoordinator
+	}
+	return conn, addr, nil
+}
+
+// forget makes the next request look up the coordinator again, because the
+// one at addr failed. If another request found a new coordinator meanwhile,
+// that one is kept.
+func (c *offsetCoordinator) forget(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.addr == addr {
+		c.addr = ""
+	}
+}
+
+// retryCommitErr returns true if a commit or offset fetch that failed with
+// the given error of its partition can succeed when retried. If the
+// coordinator moved, it is forgotten first.
+func (c *offsetCoordinator) retryCommitErr(err error, addr string) bool {
+	switch err {
+	case proto.ErrNotCoordinator, proto.ErrNoCoordinator:
+		c.forget(addr)
+		return true
+	case proto.ErrOffsetLoadInProgress:
+		return true
+	}
+	return false
+}
+
+// generation returns the generation and member ID to commit with.
+func (c *offsetCoordinator) generation() (int32, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generationID, c.memberID
+}
+
 // Commit is saving offset information for given topic and partition.
 //
 // Commit can retry saving offset information on common errors. This behaviour
 // can be configured with with RetryErrLimit and RetryErrWait coordinator
-// configuration attributes.
-func (c *offsetCoordinator) Commit(topic string, partition int32, offset int64) error {
-	return c.commit(topic, partition, offset, "")
+// configuration attributes. If the coordinator moved or the connection to it
+// was lost, the coordinator is looked up again before retrying.
+func (c *offsetCoordinator) Commit(topic string, partition int32, offset int64) (err error) {
+	if err := c.broker.track(); err != nil {
+		return err
+	}
+	defer func() { err = c.broker.untrack(err) }()
+
+	return c.commit(topic, partition, offset, "", nil)
 }
 
 // Commit works exactly like Commit method, but store extra metadata string
 // together with offset information.
-func (c *offsetCoordinator) CommitFull(topic string, partition int32, offset int64, metadata string) error {
-	return c.commit(topic, partition, offset, metadata)
+func (c *offsetCoordinator) CommitFull(
+	topic string, partition int32, offset int64, metadata string) (err error) {
+	if err := c.broker.track(); err != nil {
+		return err
+	}
+	defer func() { err = c.broker.untrack(err) }()
+
+	return c.commit(topic, partition, offset, metadata, nil)
 }
 
 // commit is saving offset and metadata information. Provides limited error
-// handling configurable through OffsetCoordinatorConf.
+// handling configurable through OffsetCoordinatorConf. Once cancel is closed,
+// commit gives up with errCanceled.
 func (c *offsetCoordinator) commit(
-	topic string, partition int32, offset int64, metadata string) (resErr error) {
+	topic string, partition int32, offset int64, metadata string,
+	cancel <-chan struct{}) (resErr error) {
 	// Eliminate the scenario where Kafka erroneously returns -1 as the offset
 	// which then gets made permanent via an immediate flush.
 	//
@@ -954,54 +2598,82 @@ func (c *offsetCoordinator) commit(
 			offset, topic, partition)
 	}
 
+	generationID, memberID := c.generation()
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+commitRetryLoop:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
+		if c.broker.isClosed() {
+			return ErrClosed
+		}
 		if try != 0 {
-			time.Sleep(retry.Duration())
+			if !c.broker.retry(resErr) {
+				break
+			}
+			if !sleep(retry.Duration(), cancel) {
+				return errCanceled
+			}
 		}
 
-		// get a copy of our connection with the lock, this might establish a new
-		// connection so can take a bit
-		conn, err := c.broker.coordinatorConnection(c.conf.ConsumerGroup)
-		if conn == nil {
+		// this might look up the coordinator and establish a new connection,
+		// so can take a bit
+		conn, addr, err := c.connection()
+		if err != nil {
 			resErr = err
 			continue
 		}
 		defer func(lconn *connection) { go c.broker.conns.Idle(lconn) }(conn)
 
-		resp, err := conn.OffsetCommit(&proto.OffsetCommitReq{
-			ClientID:      c.broker.conf.ClientID,
-			ConsumerGroup: c.conf.ConsumerGroup,
-			Topics: []proto.OffsetCommitReqTopic{
-				{
-					Name: topic,
-					Partitions: []proto.OffsetCommitReqPartition{
-						{ID: partition, Offset: offset, Metadata: metadata},
+		var resp *proto.OffsetCommitResp
+		interrupted := interruptOnCancel(conn, cancel)
+		err = measureRequest(c.broker.metrics, proto.OffsetCommitReqKind, conn, func() (err error) {
+			resp, err = conn.OffsetCommit(&proto.OffsetCommitReq{
+				ClientID:      c.broker.conf.ClientID,
+				ConsumerGroup: c.conf.ConsumerGroup,
+				GenerationID:  generationID,
+				MemberID:      memberID,
+				Topics: []proto.OffsetCommitReqTopic{
+					{
+						Name: topic,
+						Partitions: []proto.OffsetCommitReqPartition{
+							{ID: partition, Offset: offset, Metadata: metadata},
+						},
 					},
 				},
-			},
+			})
+			return err
 		})
+		if interrupted() {
+			return errCanceled
+		}
 		resErr = err
 
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		if err != nil {
+			// The coordinator may have gone away with the connection.
 			log.Debugf("connection died while committing on %s:%d for %s: %s",
 				topic, partition, c.conf.ConsumerGroup, err)
 			_ = conn.Close()
+			c.forget(addr)
+			continue
+		}
 
-		} else if err == nil {
-			// Should be a single response in the payload.
-			for _, t := range resp.Topics {
-				for _, p := range t.Partitions {
-					if t.Name != topic || p.ID != partition {
-						log.Warningf("commit response with unexpected data for %s:%d",
-							t.Name, p.ID)
-						continue
-					}
-					return p.Err
+		// Should be a single response in the payload.
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if t.Name != topic || p.ID != partition {
+					log.Warningf("commit response with unexpected data for %s:%d",
+						t.Name, p.ID)
+					continue
 				}
+				if c.retryCommitErr(p.Err, addr) {
+					log.Debugf("cannot commit on %s:%d for %s (try %d): %s",
+						topic, partition, c.conf.ConsumerGroup, try, p.Err)
+					resErr = p.Err
+					continue commitRetryLoop
+				}
+				return p.Err
 			}
-			return errors.New("response does not contain commit information")
 		}
+		return errors.New("response does not contain commit information")
 	}
 	return resErr
 }
@@ -1011,68 +2683,107 @@ func (c *offsetCoordinator) commit(
 //
 // Offset can retry sending request on common errors. This behaviour can be
 // configured with with RetryErrLimit and RetryErrWait coordinator
-// configuration attributes.
+// configuration attributes. Like Commit, it follows the coordinator when it
+// moves.
 func (c *offsetCoordinator) Offset(
 	topic string, partition int32) (
 	offset int64, metadata string, resErr error) {
 
+	return c.offset(topic, partition, nil)
+}
+
+// offset works like Offset, but gives up with errCanceled once cancel is
+// closed.
+func (c *offsetCoordinator) offset(
+	topic string, partition int32, cancel <-chan struct{}) (
+	offset int64, metadata string, resErr error) {
+
+	if err := c.broker.track(); err != nil {
+		return 0, "", err
+	}
+	defer func() { resErr = c.broker.untrack(resErr) }()
+
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+offsetRetryLoop:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
+		if c.broker.isClosed() {
+			return 0, "", ErrClosed
+		}
 		if try != 0 {
-			time.Sleep(retry.Duration())
+			if !c.broker.retry(resErr) {
+				break
+			}
+			if !sleep(retry.Duration(), cancel) {
+				return 0, "", errCanceled
+			}
 		}
 
-		// get a copy of our connection with the lock, this might establish a new
-		// connection so can take a bit
-		conn, err := c.broker.coordinatorConnection(c.conf.ConsumerGroup)
-		if conn == nil {
+		// this might look up the coordinator and establish a new connection,
+		// so can take a bit
+		conn, addr, err := c.connection()
+		if err != nil {
 			resErr = err
 			continue
 		}
 		defer func(lconn *connection) { go c.broker.conns.Idle(lconn) }(conn)
 
-		resp, err := conn.OffsetFetch(&proto.OffsetFetchReq{
-			ConsumerGroup: c.conf.ConsumerGroup,
-			Topics: []proto.OffsetFetchReqTopic{
-				{
-					Name:       topic,
-					Partitions: []int32{partition},
+		var resp *proto.OffsetFetchResp
+		interrupted := interruptOnCancel(conn, cancel)
+		err = measureRequest(c.broker.metrics, proto.OffsetFetchReqKind, conn, func() (err error) {
+			resp, err = conn.OffsetFetch(&proto.OffsetFetchReq{
+				ConsumerGroup: c.conf.ConsumerGroup,
+				Topics: []proto.OffsetFetchReqTopic{
+					{
+						Name:       topic,
+						Partitions: []int32{partition},
+					},
 				},
-			},
+			})
+			return err
 		})
+		if interrupted() {
+			return 0, "", errCanceled
+		}
 		resErr = err
 
-		switch err {
-		case io.EOF, syscall.EPIPE:
+		if err != nil {
+			// The coordinator may have gone away with the connection.
 			log.Debugf("connection died while fetching offsets on %s:%d for %s: %s",
 				topic, partition, c.conf.ConsumerGroup, err)
 			_ = conn.Close()
+			c.forget(addr)
+			continue
+		}
 
-		case nil:
-			for _, t := range resp.Topics {
-				for _, p := range t.Partitions {
-					if t.Name != topic || p.ID != partition {
-						log.Warningf("offset response with unexpected data for %s:%d",
-							t.Name, p.ID)
-						continue
-					}
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if t.Name != topic || p.ID != partition {
+					log.Warningf("offset response with unexpected data for %s:%d",
+						t.Name, p.ID)
+					continue
+				}
 
-					if p.Err != nil {
-						return 0, "", p.Err
-					}
-					// This is expected in and only in the case where the consumer group, topic
-					// pair is brand new. However, it appears there may be race conditions
-					// where Kafka returns -1 erroneously. Not sure how to handle this yet,
-					// but adding debugging in the meantime.
-					if p.Offset < 0 {
-						log.Errorf("negative offset response %d for %s:%d",
-							p.Offset, t.Name, p.ID)
-					}
-					return p.Offset, p.Metadata, nil
+				if c.retryCommitErr(p.Err, addr) {
+					log.Debugf("cannot fetch offset on %s:%d for %s (try %d): %s",
+						topic, partition, c.conf.ConsumerGroup, try, p.Err)
+					resErr = p.Err
+					continue offsetRetryLoop
+				}
+				if p.Err != nil {
+					return 0, "", p.Err
+				}
+				// This is expected in and only in the case where the consumer group, topic
+				// pair is brand new. However, it appears there may be race conditions
+				// where Kafka returns -1 erroneously. Not sure how to handle this yet,
+				// but adding debugging in the meantime.
+				if p.Offset < 0 {
+					log.Errorf("negative offset response %d for %s:%d",
+						p.Offset, t.Name, p.ID)
 				}
+				return p.Offset, p.Metadata, nil
 			}
-			return 0, "", errors.New("response does not contain offset information")
 		}
+		return 0, "", errors.New("response does not contain offset information")
 	}
 
 	return 0, "", resErr
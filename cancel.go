@@ -0,0 +1,108 @@
+package kafka
+
+import (
+	"errors"
+	"time"
+)
+
+// CanceledError is returned by the context aware methods, such as
+// ConsumeContext, when the context is done before the operation finished.
+// Err is the error of the context, context.Canceled or
+// context.DeadlineExceeded.
+type CanceledError struct {
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return "kafka: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the context.
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// errCanceled is returned by operations that gave up because their cancel
+// channel was closed. The context aware methods turn it into a
+// *CanceledError.
+var errCanceled = errors.New("canceled")
+
+// Operations that can be cancelled take a cancel channel, which is the Done
+// channel of a context. A nil channel is never closed, so the methods without
+// a context pass nil.
+
+// canceled returns true if cancel is closed.
+func canceled(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, returning false if cancel was closed first.
+func sleep(d time.Duration, cancel <-chan struct{}) bool {
+	if cancel == nil {
+		time.Sleep(d)
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// cancelBefore returns a channel that is closed once cancel is closed or the
+// deadline passed, and a function to call once the channel is no longer
+// needed. A zero deadline leaves cancel as it is.
+func cancelBefore(cancel <-chan struct{}, deadline time.Time) (<-chan struct{}, func()) {
+	if deadline.IsZero() {
+		return cancel, func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	go func() {
+		select {
+		case <-timer.C:
+		case <-cancel:
+		case <-done:
+			return
+		}
+		close(stop)
+	}()
+	return stop, func() {
+		timer.Stop()
+		close(done)
+	}
+}
+
+// interruptOnCancel closes conn once cancel is closed, abandoning the request
+// in flight on it, until the returned function is called after the request.
+// That function returns true if the connection was closed, in which case the
+// result of the request must be ignored.
+func interruptOnCancel(conn *connection, cancel <-chan struct{}) func() bool {
+	if cancel == nil {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-cancel:
+			_ = conn.Close()
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-interrupted
+	}
+}
@@ -0,0 +1,99 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// ChannelConsumerConf is the configuration of a ChannelConsumer.
+type ChannelConsumerConf struct {
+	// BufferSize is the number of messages, and separately errors, that are
+	// read ahead while the application is busy.
+	//
+	// Defaults to 100.
+	BufferSize int
+}
+
+// NewChannelConsumerConf returns the default configuration.
+func NewChannelConsumerConf() ChannelConsumerConf {
+	return ChannelConsumerConf{
+		BufferSize: 100,
+	}
+}
+
+// ChannelConsumer delivers the messages of a consumer on a channel, to be used
+// in a select loop instead of calling Consume. Errors are delivered on a
+// separate channel and don't stop consumption, except ErrNoData and ErrClosed,
+// after which both channels are closed.
+type ChannelConsumer struct {
+	consumer Consumer
+	msgc     chan *proto.Message
+	errc     chan error
+
+	stop      chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewChannelConsumer starts reading from the consumer. The consumer must not be
+// used directly anymore.
+func NewChannelConsumer(consumer Consumer, conf ChannelConsumerConf) *ChannelConsumer {
+	c := &ChannelConsumer{
+		consumer:  consumer,
+		msgc:      make(chan *proto.Message, conf.BufferSize),
+		errc:      make(chan error, conf.BufferSize),
+		stop:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	go c.read()
+	return c
+}
+
+// Messages returns the channel messages are delivered on.
+func (c *ChannelConsumer) Messages() <-chan *proto.Message {
+	return c.msgc
+}
+
+// Errors returns the channel errors are delivered on. It should be read along
+// with Messages, because once it is full, no further messages are delivered.
+func (c *ChannelConsumer) Errors() <-chan error {
+	return c.errc
+}
+
+// Close stops reading. Both channels are closed once the Consume call in
+// progress, if any, returns; its result is dropped.
+func (c *ChannelConsumer) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+}
+
+func (c *ChannelConsumer) read() {
+	defer close(c.errc)
+	defer close(c.msgc)
+
+	for {
+		msg, err := c.consumer.Consume()
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			select {
+			case c.errc <- err:
+			case <-c.stop:
+				return
+			}
+			if err == ErrNoData || err == ErrClosed {
+				return
+			}
+			continue
+		}
+
+		select {
+		case c.msgc <- msg:
+		case <-c.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package kafka
+
+import (
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&ChannelConsumerSuite{})
+
+type ChannelConsumerSuite struct{}
+
+func (s *ChannelConsumerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *ChannelConsumerSuite) TestMessagesAndErrors(c *C) {
+	src := newChanConsumer()
+	cc := NewChannelConsumer(src, NewChannelConsumerConf())
+	defer cc.Close()
+
+	failure := errors.New("broken")
+	src.results <- consumeResult{msg: &proto.Message{Offset: 1}}
+	src.results <- consumeResult{err: failure}
+	src.results <- consumeResult{msg: &proto.Message{Offset: 2}}
+
+	timeout := time.After(time.Second)
+	var offsets []int64
+	var errs []error
+	for len(offsets) < 2 || len(errs) < 1 {
+		select {
+		case msg := <-cc.Messages():
+			offsets = append(offsets, msg.Offset)
+		case err := <-cc.Errors():
+			errs = append(errs, err)
+		case <-timeout:
+			c.Fatal("timeout waiting for channel consumer")
+		}
+	}
+	c.Assert(offsets, DeepEquals, []int64{1, 2})
+	c.Assert(errs, DeepEquals, []error{failure})
+
+	// running out of data closes both channels
+	close(src.results)
+	c.Assert(<-cc.Errors(), Equals, ErrNoData)
+	_, ok := <-cc.Messages()
+	c.Assert(ok, Equals, false)
+	_, ok = <-cc.Errors()
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ChannelConsumerSuite) TestClose(c *C) {
+	cc := NewChannelConsumer(&seqConsumer{topic: "test"}, ChannelConsumerConf{BufferSize: 1})
+	msg := <-cc.Messages()
+	c.Assert(msg.Offset, Equals, int64(1))
+
+	cc.Close()
+	cc.Close()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-cc.Messages():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.Fatal("messages channel not closed")
+		}
+	}
+}
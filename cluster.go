@@ -3,6 +3,9 @@ package kafka
 import (
 	"errors"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,6 +32,8 @@ type Cluster struct {
 	timeout    time.Duration
 	created    time.Time
 	nodes      NodeMap                  // node ID to address
+	racks      map[int32]string         // node ID to rack
+	controller int32                    // node ID of the controller
 	endpoints  map[topicPartition]int32 // partition to leader node ID
 	partitions map[string]int32         // topic to number of partitions
 }
@@ -62,6 +67,9 @@ func newCluster(conf ClusterConnectionConf, pool *connectionPool, connPoolCache
 // NewCluster connects to a cluster from a given list of kafka addresses and after successful
 // metadata fetch, returns Cluster.
 func NewCluster(nodeAddresses []string, conf ClusterConnectionConf) (*Cluster, error) {
+	if conf.MetadataRequestVersion < 0 || conf.MetadataRequestVersion > 1 {
+		return nil, fmt.Errorf("unsupported metadata request version %d", conf.MetadataRequestVersion)
+	}
 	connPoolCache := newConnPoolCache()
 	metadataConnPool, err := connPoolCache.getOrCreateConnectionPool(
 		metadataCacheClientID, conf, nodeAddresses)
@@ -93,6 +101,10 @@ func NewCluster(nodeAddresses []string, conf ClusterConnectionConf) (*Cluster, e
 				return clusterMetadata, nil
 			}
 			log.Errorf("cannot fetch metadata: %s", err)
+			if _, ok := err.(*AuthenticationError); ok {
+				// retrying with the same credentials is pointless
+				return nil, err
+			}
 		case <-time.After(conf.DialTimeout):
 			log.Error("timeout fetching metadata")
 		}
@@ -118,14 +130,20 @@ func (cm *Cluster) cache(resp *proto.MetadataResp) {
 
 	cm.created = time.Now()
 	cm.nodes = make(NodeMap)
+	cm.racks = make(map[int32]string)
+	cm.controller = -1
+	if resp.Version >= 1 {
+		cm.controller = resp.ControllerID
+	}
 	cm.endpoints = make(map[topicPartition]int32)
 	cm.partitions = make(map[string]int32)
 
 	addrs := make([]string, 0)
 	for _, node := range resp.Brokers {
-		addr := fmt.Sprintf("%s:%d", node.Host, node.Port)
+		addr := net.JoinHostPort(node.Host, strconv.Itoa(int(node.Port)))
 		addrs = append(addrs, addr)
 		cm.nodes[node.NodeID] = addr
+		cm.racks[node.NodeID] = node.Rack
 	}
 	for _, topic := range resp.Topics {
 		for _, part := range topic.Partitions {
@@ -142,17 +160,35 @@ func (cm *Cluster) connectionPoolForClient(clientID string, conf ClusterConnecti
 	return cm.connPoolCache.getOrCreateConnectionPool(clientID, conf, cm.metadataConnPool.GetAllAddrs())
 }
 
+// releaseConnectionPool releases the connectionPool of the given client ID, as returned by
+// connectionPoolForClient. The pool is closed once nobody uses it anymore.
+func (cm *Cluster) releaseConnectionPool(clientID string) {
+	cm.connPoolCache.releaseConnectionPool(clientID)
+}
+
 // RefreshMetadata is requesting metadata information from any node and refresh
 // internal cached representation. This method can block for a long time depending
 // on how long it takes to update metadata.
 func (cm *Cluster) RefreshMetadata() error {
+	return cm.refreshMetadataAfter(cm.metadataEpoch(), nil)
+}
+
+// metadataEpoch returns the counter of metadata refreshes, which tells what
+// metadata a lookup was based on.
+func (cm *Cluster) metadataEpoch() int64 {
+	return atomic.LoadInt64(cm.epoch)
+}
+
+// refreshMetadataAfter refreshes the metadata unless that was done since the
+// given epoch. Once cancel is closed, it stops waiting for the refresh, which
+// goes on for the other callers, and returns errCanceled.
+func (cm *Cluster) refreshMetadataAfter(ctr1 int64, cancel <-chan struct{}) error {
 	updateChan := make(chan error, 1)
 
 	go func() {
 		// The goal of this code is to ensure that only one person refreshes the metadata at a time
 		// and that everybody waiting for metadata can return whenever it's updated. The epoch
 		// counter is updated every time we get new metadata.
-		ctr1 := atomic.LoadInt64(cm.epoch)
 		cm.refLock.Lock()
 		defer cm.refLock.Unlock()
 
@@ -184,6 +220,8 @@ func (cm *Cluster) RefreshMetadata() error {
 		return err
 	case <-time.After(cm.getTimeout()):
 		return errors.New("timed out refreshing metadata")
+	case <-cancel:
+		return errCanceled
 	}
 }
 
@@ -195,30 +233,79 @@ func (cm *Cluster) RefreshMetadata() error {
 // If "topics" are specified, only fetch metadata for those topics (can be
 // used to create a topic)
 func (cm *Cluster) Fetch(clientID string, topics ...string) (*proto.MetadataResp, error) {
-	// Get all addresses, then walk the array in permuted random order.
-	addrs := cm.metadataConnPool.GetAllAddrs()
+	return cm.fetch(nil, NopMetrics{}, nil, "", clientID, topics...)
+}
+
+// fetch works like Fetch, but if preferred is not empty, that address is tried
+// before any other node. Requests are reported to tracer if it is not nil and
+// to metrics. Once cancel is closed, the request in flight is abandoned and
+// errCanceled returned.
+func (cm *Cluster) fetch(tracer Tracer, metrics Metrics, cancel <-chan struct{}, preferred string, clientID string, topics ...string) (*proto.MetadataResp, error) {
+	// Get all addresses, then walk the array in permuted random order, starting
+	// with the preferred address if we have one.
+	allAddrs := cm.metadataConnPool.GetAllAddrs()
+	addrs := make([]string, 0, len(allAddrs)+1)
+	if preferred != "" {
+		addrs = append(addrs, preferred)
+	}
+	for _, idx := range rndPerm(len(allAddrs)) {
+		if allAddrs[idx] != preferred {
+			addrs = append(addrs, allAddrs[idx])
+		}
+	}
 	log.Infof("metadata fetch addrs: %s", addrs)
 	// split the timeout so that we can try getting the metadata from more than one broker.
 	perBrokerTimeout := cm.getTimeout() / 2
-	for _, idx := range rndPerm(len(addrs)) {
+	var authErr error
+	for _, addr := range addrs {
+		if canceled(cancel) {
+			return nil, errCanceled
+		}
 		// Directly connect, ignoring connection pool limits. This connection must be closed here.
-		conn, err := newTCPConnection(addrs[idx], perBrokerTimeout)
+		conn, err := newTCPConnection(cm.conf.dialFunc(), addr, perBrokerTimeout, cm.conf.responseTimeout())
 		if err != nil {
-			log.Warningf("metadata fetch failed to connect to node %s: %s", addrs[idx], err)
+			log.Warningf("metadata fetch failed to connect to node %s: %s", addr, err)
+			if _, ok := err.(*AuthenticationError); ok {
+				authErr = err
+			}
 			continue
 		}
-		resp, err := conn.Metadata(&proto.MetadataReq{
-			ClientID: clientID,
-			Topics:   topics,
+		req := &proto.MetadataReq{
+			Version:       cm.conf.MetadataRequestVersion,
+			CorrelationID: newCorrelationID(),
+			ClientID:      clientID,
+			Topics:        topics,
+		}
+		span := &RequestSpan{
+			Request:       "metadata",
+			Broker:        addr,
+			CorrelationID: req.CorrelationID,
+		}
+		if len(topics) == 1 {
+			span.Topic = topics[0]
+		}
+		var resp *proto.MetadataResp
+		interrupted := interruptOnCancel(conn, cancel)
+		err = measureRequest(metrics, proto.MetadataReqKind, conn, func() error {
+			return traceRequest(tracer, span, func() (err error) {
+				resp, err = conn.Metadata(req)
+				return err
+			})
 		})
 		_ = conn.Close()
+		if interrupted() {
+			return nil, errCanceled
+		}
 		if err != nil {
-			log.Warningf("cannot fetch metadata from node %s: %s", addrs[idx], err)
+			log.Warningf("cannot fetch metadata from node %s: %s", addr, err)
 			continue
 		}
 		return resp, nil
 	}
 
+	if authErr != nil {
+		return nil, authErr
+	}
 	return nil, errors.New("cannot fetch metadata")
 }
 
@@ -255,6 +342,19 @@ func (cm *Cluster) ForgetEndpoint(topic string, partition int32) {
 	delete(cm.endpoints, topicPartition{topic, partition})
 }
 
+// staleLeader is called when the leader of a partition, looked up in the
+// metadata of the given epoch, refused a request because it no longer leads
+// the partition or could not be reached. The metadata is refreshed unless that
+// was done since, so that many partitions failing at once cause a single
+// refresh. If that fails, the leader is forgotten, so that the next lookup
+// tries again.
+func (cm *Cluster) staleLeader(topic string, partition int32, epoch int64) {
+	if err := cm.refreshMetadataAfter(epoch, nil); err != nil {
+		log.Warningf("cannot refresh metadata: %s", err)
+		cm.ForgetEndpoint(topic, partition)
+	}
+}
+
 // GetNodes returns a map of nodes that exist in the cluster.
 func (cm *Cluster) GetNodes() NodeMap {
 	cm.mu.RLock()
@@ -267,6 +367,53 @@ func (cm *Cluster) GetNodes() NodeMap {
 	return nodes
 }
 
+// ClusterInfo describes the brokers of a cluster, as returned by
+// Broker.ClusterInfo.
+type ClusterInfo struct {
+	// Brokers of the cluster, sorted by node ID.
+	Brokers []BrokerInfo
+
+	// ControllerID is the node ID of the controller broker, or -1 if it is
+	// not known, which it isn't with MetadataRequestVersion 0.
+	ControllerID int32
+}
+
+// BrokerInfo describes a broker of the cluster.
+type BrokerInfo struct {
+	NodeID int32
+	// Addr is the address (host:port) the broker advertises.
+	Addr string
+	// Rack is the rack the broker is configured with, or "" if it has none
+	// or MetadataRequestVersion is 0.
+	Rack string
+}
+
+type byNodeID []BrokerInfo
+
+func (s byNodeID) Len() int           { return len(s) }
+func (s byNodeID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNodeID) Less(i, j int) bool { return s[i].NodeID < s[j].NodeID }
+
+// info returns the brokers of the cluster according to the cached metadata.
+func (cm *Cluster) info() ClusterInfo {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	info := ClusterInfo{
+		Brokers:      make([]BrokerInfo, 0, len(cm.nodes)),
+		ControllerID: cm.controller,
+	}
+	for nodeID, addr := range cm.nodes {
+		info.Brokers = append(info.Brokers, BrokerInfo{
+			NodeID: nodeID,
+			Addr:   addr,
+			Rack:   cm.racks[nodeID],
+		})
+	}
+	sort.Sort(byNodeID(info.Brokers))
+	return info
+}
+
 // GetNodeAddress returns the address to a node if we know it.
 func (cm *Cluster) GetNodeAddress(nodeID int32) string {
 	cm.mu.RLock()
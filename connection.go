@@ -3,11 +3,12 @@ package kafka
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,26 +18,72 @@ import (
 // ErrClosed is returned as result of any request made using closed connection.
 var ErrClosed = errors.New("closed")
 
-type readResp struct {
-	bytes *bytes.Reader
-	err   error
-}
-
 // Low level abstraction over connection to Kafka. This structure is NOT THREAD
 // SAFE and must be only owned by one caller at a time.
 type connection struct {
 	addr      string
 	startTime time.Time
-	rw        io.ReadWriteCloser
+	rw        net.Conn
 	rd        *bufio.Reader
 	rnd       *rand.Rand
-	timeout   time.Duration
 	closed    *int32
+
+	// responseTimeout is how long a request may wait for its response on top
+	// of the time the broker is asked to hold it, see requestTimeout. Zero
+	// means no limit.
+	responseTimeout time.Duration
+
+	// lastUsed is the time, in unix nanoseconds, of the last request sent using
+	// this connection. It is read by the pool to close idle connections and
+	// for debugging via ConnectionStates.
+	lastUsed *int64
+
+	// sent and received count the bytes of the requests written to and the
+	// responses read from this connection, for reporting to Metrics.
+	sent     *int64
+	received *int64
+
+	// mu protects requests, the requests currently waiting for a response by
+	// correlation ID. They are only read for debugging via ConnectionStates
+	// and InFlightRequests.
+	mu       *sync.Mutex
+	requests map[int32]pendingRequest
+}
+
+type pendingRequest struct {
+	info    InFlightRequest
+	started time.Time
 }
 
-// newConnection returns new, initialized connection or error
-func newTCPConnection(address string, timeout time.Duration) (*connection, error) {
-	conn, err := net.DialTimeout("tcp", address, timeout)
+// InFlightRequest describes a request that is waiting for a response. It is
+// intended for debugging only and reflects the state at the time it was taken.
+type InFlightRequest struct {
+	// Addr is the address of the broker the request was sent to.
+	Addr string
+
+	// Kind is the type of the request, e.g. "produce" or "fetch".
+	Kind string
+
+	// Topic and Partition are the first partition of the request, or empty
+	// and -1 for requests that are not about partitions, such as metadata.
+	Topic     string
+	Partition int32
+
+	CorrelationID int32
+
+	// Age is how long the request has been waiting for a response.
+	Age time.Duration
+}
+
+// newConnection returns new, initialized connection or error. The connection is
+// established using dial, or net.DialTimeout if dial is nil, within timeout.
+// Requests sent using the connection fail if their response doesn't arrive
+// within responseTimeout, see requestTimeout.
+func newTCPConnection(dial DialFunc, address string, timeout, responseTimeout time.Duration) (*connection, error) {
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	conn, err := dial("tcp", address, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -44,22 +91,194 @@ func newTCPConnection(address string, timeout time.Duration) (*connection, error
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	c := &connection{
-		addr:      address,
-		rw:        conn,
-		rd:        bufio.NewReader(conn),
-		rnd:       rnd,
-		closed:    new(int32),
-		startTime: time.Now(),
-		timeout:   timeout,
+		addr:            address,
+		rw:              conn,
+		rd:              bufio.NewReader(conn),
+		rnd:             rnd,
+		closed:          new(int32),
+		startTime:       time.Now(),
+		responseTimeout: responseTimeout,
+		lastUsed:        new(int64),
+		sent:            new(int64),
+		received:        new(int64),
+		mu:              &sync.Mutex{},
+		requests:        make(map[int32]pendingRequest),
 	}
 	return c, nil
 }
 
+// tlsDial returns a DialFunc that establishes connections using dial and
+// performs a TLS handshake on them with config. The handshake has to finish
+// within the timeout of the dial, and its failure is returned as a *net.OpError
+// like a failure to connect.
+func tlsDial(dial DialFunc, config *tls.Config) DialFunc {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := config
+		if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			cfg = cloneTLSConfig(config)
+			cfg.ServerName = host
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if timeout > 0 {
+			_ = tlsConn.SetDeadline(start.Add(timeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, &net.OpError{
+				Op:     "dial",
+				Net:    network,
+				Source: conn.LocalAddr(),
+				Addr:   conn.RemoteAddr(),
+				Err:    err,
+			}
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
+
+// keepAliveDial returns a DialFunc that establishes connections using dial and
+// enables TCP keepalives with the given period on them. Without keepalives, a
+// connection to a broker whose host went away without closing it, or that a
+// NAT silently dropped, looks healthy until a request on it times out.
+// Connections that are not TCP connections are returned as they are.
+func keepAliveDial(dial DialFunc, period time.Duration) DialFunc {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		conn, err := dial(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.SetKeepAlive(true)
+			_ = tcpConn.SetKeepAlivePeriod(period)
+		}
+		return conn, nil
+	}
+}
+
 // StartTime returns the time the connection was established.
 func (c *connection) StartTime() time.Time {
 	return c.startTime
 }
 
+// LastUsed returns the time the last request was sent using this connection,
+// or the zero time if the connection was never used.
+func (c *connection) LastUsed() time.Time {
+	if ns := atomic.LoadInt64(c.lastUsed); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// InFlight returns the number of requests that are waiting for a response.
+func (c *connection) InFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.requests)
+}
+
+// InFlightRequests returns the requests that are waiting for a response.
+func (c *connection) InFlightRequests() []InFlightRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	reqs := make([]InFlightRequest, 0, len(c.requests))
+	for _, req := range c.requests {
+		req.info.Age = now.Sub(req.started)
+		reqs = append(reqs, req.info)
+	}
+	return reqs
+}
+
+// register records req as waiting for a response until the returned function
+// is called.
+func (c *connection) register(req proto.Request, reqID int32) func() {
+	info := describeRequest(req)
+	info.Addr = c.addr
+	info.CorrelationID = reqID
+
+	c.mu.Lock()
+	c.requests[reqID] = pendingRequest{info: info, started: time.Now()}
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		delete(c.requests, reqID)
+		c.mu.Unlock()
+	}
+}
+
+// describeRequest returns the kind and the first partition of the request.
+func describeRequest(req proto.Request) InFlightRequest {
+	info := InFlightRequest{Partition: -1}
+	switch r := req.(type) {
+	case *proto.ProduceReq:
+		info.Kind = "produce"
+		if len(r.Topics) > 0 && len(r.Topics[0].Partitions) > 0 {
+			info.Topic, info.Partition = r.Topics[0].Name, r.Topics[0].Partitions[0].ID
+		}
+	case *proto.FetchReq:
+		info.Kind = "fetch"
+		if len(r.Topics) > 0 && len(r.Topics[0].Partitions) > 0 {
+			info.Topic, info.Partition = r.Topics[0].Name, r.Topics[0].Partitions[0].ID
+		}
+	case *proto.OffsetReq:
+		info.Kind = "offset"
+		if len(r.Topics) > 0 && len(r.Topics[0].Partitions) > 0 {
+			info.Topic, info.Partition = r.Topics[0].Name, r.Topics[0].Partitions[0].ID
+		}
+	case *proto.OffsetCommitReq:
+		info.Kind = "offset commit"
+		if len(r.Topics) > 0 && len(r.Topics[0].Partitions) > 0 {
+			info.Topic, info.Partition = r.Topics[0].Name, r.Topics[0].Partitions[0].ID
+		}
+	case *proto.OffsetFetchReq:
+		info.Kind = "offset fetch"
+		if len(r.Topics) > 0 && len(r.Topics[0].Partitions) > 0 {
+			info.Topic, info.Partition = r.Topics[0].Name, r.Topics[0].Partitions[0]
+		}
+	case *proto.MetadataReq:
+		info.Kind = "metadata"
+	case *proto.GroupCoordinatorReq:
+		info.Kind = "group coordinator"
+	case *proto.JoinGroupReq:
+		info.Kind = "join group"
+	case *proto.SyncGroupReq:
+		info.Kind = "sync group"
+	case *proto.HeartbeatReq:
+		info.Kind = "heartbeat"
+	case *proto.LeaveGroupReq:
+		info.Kind = "leave group"
+	default:
+		info.Kind = fmt.Sprintf("%T", req)
+	}
+	return info
+}
+
+// markUsed records that a request is being sent using this connection.
+func (c *connection) markUsed() {
+	atomic.StoreInt64(c.lastUsed, time.Now().UnixNano())
+}
+
+// transferred returns the number of bytes sent and received using this
+// connection.
+func (c *connection) transferred() (sent, received int64) {
+	return atomic.LoadInt64(c.sent), atomic.LoadInt64(c.received)
+}
+
 // IsClosed returns whether or not this connection has been closed.
 func (c *connection) IsClosed() bool {
 	return atomic.LoadInt32(c.closed) == 1
@@ -74,24 +293,49 @@ func (c *connection) Close() error {
 	return nil
 }
 
-// sendRequest calls sendRequestHelper with timeout, closing the connection if it is hit.
+// requestTimeout returns how long to wait for the response to req: the
+// response timeout of the connection plus the time the broker is asked to
+// hold the request, which is the MaxWaitTime of a fetch, the Timeout of a
+// produce and the SessionTimeout of a join group request.
+func (c *connection) requestTimeout(req proto.Request) time.Duration {
+	switch r := req.(type) {
+	case *proto.FetchReq:
+		return c.responseTimeout + r.MaxWaitTime
+	case *proto.ProduceReq:
+		return c.responseTimeout + r.Timeout
+	case *proto.JoinGroupReq:
+		return c.responseTimeout + r.SessionTimeout
+	default:
+		return c.responseTimeout
+	}
+}
+
+// setDeadline sets the deadline for writing req and reading its response,
+// unless the connection has no response timeout.
+func (c *connection) setDeadline(req proto.Request) {
+	if c.responseTimeout > 0 {
+		_ = c.rw.SetDeadline(time.Now().Add(c.requestTimeout(req)))
+	}
+}
+
+// sendRequest calls sendRequestHelper within the deadline of the request,
+// closing the connection if it fails. A request that hits the deadline fails
+// with proto.ErrRequestTimeout.
 func (c *connection) sendRequest(req proto.Request, reqID int32) (*bytes.Reader, error) {
-	readRespChan := make(chan readResp, 1)
-	go func() {
-		bytes, err := c.sendRequestHelper(req, reqID)
-		readRespChan <- readResp{bytes, err}
-	}()
-	select {
-	case result := <-readRespChan:
-		if result.err != nil {
-			c.Close()
-		}
-		return result.bytes, result.err
-	case <-time.After(2 * c.timeout):
+	c.markUsed()
+	defer c.register(req, reqID)()
+
+	c.setDeadline(req)
+	b, err := c.sendRequestHelper(req, reqID)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			log.Warningf("no response from %s within %s, closing connection",
+				c.addr, c.requestTimeout(req))
+			err = proto.ErrRequestTimeout
+		}
 		_ = c.Close()
-		log.Warning("sendRequest hit timeout")
-		return nil, proto.ErrRequestTimeout
 	}
+	return b, err
 }
 
 // sendRequestHelper handles the raw material of sending a request up to Kafka and
@@ -99,7 +343,9 @@ func (c *connection) sendRequest(req proto.Request, reqID int32) (*bytes.Reader,
 func (c *connection) sendRequestHelper(req proto.Request, reqID int32) (
 	*bytes.Reader, error) {
 
-	if _, err := req.WriteTo(c.rw); err != nil {
+	n, err := req.WriteTo(c.rw)
+	atomic.AddInt64(c.sent, n)
+	if err != nil {
 		log.Errorf("cannot write: %s", err)
 		return nil, err
 	}
@@ -107,6 +353,7 @@ func (c *connection) sendRequestHelper(req proto.Request, reqID int32) (
 	if correlationID, b, err := proto.ReadResp(c.rd); err != nil {
 		return nil, err
 	} else {
+		atomic.AddInt64(c.received, int64(len(b)))
 		if correlationID != reqID {
 			_ = c.Close()
 			return nil, fmt.Errorf("got unexpected correlation ID %d instead of %d",
@@ -126,7 +373,7 @@ func (c *connection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, erro
 	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
 		return nil, err
 	} else {
-		return proto.ReadMetadataResp(b)
+		return proto.ReadVersionedMetadataResp(b, req.Version)
 	}
 }
 
@@ -142,7 +389,10 @@ func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error)
 	// This sad, dumb degenerate case is one where the server will never send us
 	// a response. We write blindly and return.
 	if req.RequiredAcks == proto.RequiredAcksNone {
-		_, err := req.WriteTo(c.rw)
+		c.markUsed()
+		c.setDeadline(req)
+		n, err := req.WriteTo(c.rw)
+		atomic.AddInt64(c.sent, n)
 		return nil, err
 	}
 
@@ -150,23 +400,45 @@ func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error)
 	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
 		return nil, err
 	} else {
-		return proto.ReadProduceResp(b)
+		return proto.ReadVersionedProduceResp(b, req.Version)
 	}
 }
 
 // Fetch sends given fetch request to kafka node and returns related response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
+	return c.FetchLimited(req, nil)
+}
+
+// FetchLimited works like Fetch, but decompresses the returned messages
+// within the limits of the given limiter, which may be nil.
+func (c *connection) FetchLimited(req *proto.FetchReq, limiter *proto.DecompressionLimiter) (*proto.FetchResp, error) {
+	resp, _, err := c.fetchSized(req, limiter, false)
+	return resp, err
+}
+
+// fetchSized works like FetchLimited, and also returns the size of the
+// response in bytes. If skipCRC is true, messages are not checked against
+// their crc.
+func (c *connection) fetchSized(
+	req *proto.FetchReq, limiter *proto.DecompressionLimiter, skipCRC bool) (*proto.FetchResp, int, error) {
+
 	var resp *proto.FetchResp
+	var size int
 
 	if req.CorrelationID == 0 {
 		req.CorrelationID = c.rnd.Int31()
 	}
 	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
-		return nil, err
+		return nil, 0, err
 	} else {
-		if resp, err = proto.ReadFetchResp(b); err != nil {
-			return nil, err
+		size = b.Len()
+		read := proto.ReadVersionedFetchResp
+		if skipCRC {
+			read = proto.ReadVersionedFetchRespSkipCRC
+		}
+		if resp, err = read(b, req.Version, limiter); err != nil {
+			return nil, 0, err
 		}
 	}
 
@@ -190,7 +462,7 @@ func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
 			partition.Messages = partition.Messages[i:]
 		}
 	}
-	return resp, nil
+	return resp, size, nil
 }
 
 // Offset sends given offset request to kafka node and returns related response.
@@ -243,3 +515,47 @@ func (c *connection) OffsetFetch(req *proto.OffsetFetchReq) (*proto.OffsetFetchR
 		return proto.ReadOffsetFetchResp(b)
 	}
 }
+
+func (c *connection) JoinGroup(req *proto.JoinGroupReq) (*proto.JoinGroupResp, error) {
+	if req.CorrelationID == 0 {
+		req.CorrelationID = c.rnd.Int31()
+	}
+	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+		return nil, err
+	} else {
+		return proto.ReadJoinGroupResp(b)
+	}
+}
+
+func (c *connection) SyncGroup(req *proto.SyncGroupReq) (*proto.SyncGroupResp, error) {
+	if req.CorrelationID == 0 {
+		req.CorrelationID = c.rnd.Int31()
+	}
+	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+		return nil, err
+	} else {
+		return proto.ReadSyncGroupResp(b)
+	}
+}
+
+func (c *connection) Heartbeat(req *proto.HeartbeatReq) (*proto.HeartbeatResp, error) {
+	if req.CorrelationID == 0 {
+		req.CorrelationID = c.rnd.Int31()
+	}
+	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+		return nil, err
+	} else {
+		return proto.ReadHeartbeatResp(b)
+	}
+}
+
+func (c *connection) LeaveGroup(req *proto.LeaveGroupReq) (*proto.LeaveGroupResp, error) {
+	if req.CorrelationID == 0 {
+		req.CorrelationID = c.rnd.Int31()
+	}
+	if b, err := c.sendRequest(req, req.CorrelationID); err != nil {
+		return nil, err
+	} else {
+		return proto.ReadLeaveGroupResp(b)
+	}
+}
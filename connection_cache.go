@@ -8,6 +8,8 @@ import (
 type connectionPoolCache struct {
 	lock              sync.Mutex
 	connectionPoolMap map[string]*connectionPool
+	// refs counts the users of every connection pool, see releaseConnectionPool.
+	refs map[string]int
 }
 
 // connectionPoolCache is a threadsafe cache of ConnectionPool by clientID.  One connectionPoolCache
@@ -18,6 +20,7 @@ func newConnPoolCache() *connectionPoolCache {
 	return &connectionPoolCache{
 		lock:              sync.Mutex{},
 		connectionPoolMap: make(map[string]*connectionPool),
+		refs:              make(map[string]int),
 	}
 
 }
@@ -33,15 +36,36 @@ func (c *connectionPoolCache) getOrCreateConnectionPool(
 
 	log.Infof("Retrieving connection pool for clientID %s from LockingMap", clientID)
 	if connectionPool, ok := c.connectionPoolMap[clientID]; ok {
+		c.refs[clientID]++
 		return connectionPool, nil
 	}
 	log.Infof("ConnectionPool for cluster %s being created.", nodeAddresses)
 
 	connPool := newConnectionPool(conf, nodeAddresses)
 	c.connectionPoolMap[clientID] = connPool
+	c.refs[clientID] = 1
 	return connPool, nil
 }
 
+// releaseConnectionPool drops a reference to the connection pool of the given client ID, as
+// taken by getOrCreateConnectionPool. When the last reference is dropped, the pool is closed
+// and removed from the cache.
+func (c *connectionPoolCache) releaseConnectionPool(clientID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.refs[clientID]--
+	if c.refs[clientID] > 0 {
+		return
+	}
+	if connPool, ok := c.connectionPoolMap[clientID]; ok {
+		log.Infof("Closing connection pool for clientID %s", clientID)
+		connPool.Close()
+		delete(c.connectionPoolMap, clientID)
+	}
+	delete(c.refs, clientID)
+}
+
 func (c *connectionPoolCache) reinitializeAddrs(nodeAddresses []string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
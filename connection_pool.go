@@ -1,7 +1,9 @@
 package kafka
 
 import (
+	"crypto/tls"
 	"errors"
+	"net"
 	"sync"
 	"time"
 )
@@ -20,6 +22,10 @@ type backend struct {
 	addr    string
 	channel chan *connection
 
+	// dialSlots is shared by all backends of a pool and bounds the number of
+	// connections being established at once. Nil means no limit.
+	dialSlots chan struct{}
+
 	// Used for storing links to all connections we ever make, this is a debugging
 	// tool to try to help find leaks of connections. All access is protected by mu.
 	mu             *sync.Mutex
@@ -35,10 +41,9 @@ func (b *backend) GetIdleConnection() *connection {
 	for {
 		select {
 		case conn := <-b.channel:
-			if !conn.IsClosed() {
+			if !b.retire(conn) {
 				return conn
 			}
-			b.removeConnection(conn)
 
 		default:
 			return nil
@@ -74,10 +79,9 @@ func (b *backend) GetConnection() (*connection, error) {
 		// Optimal case: a connection is immediately available in the the channel
 		// where we keep idle connections.
 		case conn := <-b.channel:
-			if !conn.IsClosed() {
+			if !b.retire(conn) {
 				return conn, nil
 			}
-			b.removeConnection(conn)
 
 		// Wait a small amount of time for an idle connection. If nothing arrives,
 		// attempt to make a new connection. This might fail if we're at the connection
@@ -115,8 +119,19 @@ func (b *backend) debugHitMaxConnections() {
 // getNewConnection establishes a new connection if and only if we haven't hit the limit, else
 // it will return nil. If an error is returned, we failed to connect to the server and should
 // abort the flow. This takes a lock on the mutex which means we can only have a single new
-// connection request in-flight at one time. Takes the mutex.
+// connection request in-flight at one time. Takes the mutex, once a dial slot is free, so
+// that waiting for one doesn't block the connections of the backend from being returned or
+// removed.
 func (b *backend) getNewConnection() (*connection, error) {
+	if b.dialSlots != nil {
+		select {
+		case b.dialSlots <- struct{}{}:
+			defer func() { <-b.dialSlots }()
+		case <-time.After(b.conf.DialTimeout):
+			return nil, nil
+		}
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -144,7 +159,7 @@ func (b *backend) getNewConnection() (*connection, error) {
 		b.counter = len(newConns)
 	}
 
-	conn, err := newTCPConnection(b.addr, b.conf.DialTimeout)
+	conn, err := newTCPConnection(b.conf.dialFunc(), b.addr, b.conf.DialTimeout, b.conf.responseTimeout())
 	if err == nil {
 		b.counter++
 		b.conns = append(b.conns, conn)
@@ -167,12 +182,42 @@ func (b *backend) removeConnection(conn *connection) {
 	}
 }
 
-// Idle is called when a connection should be returned to the store.
-func (b *backend) Idle(conn *connection) {
-	// If the connection is closed, throw it away. But if the connection pool is closed, then
-	// close the connection.
+// retire removes the given idle connection if it is closed, older than
+// ConnectionMaxLifetime or unused for IdleTimeout, closing it in the latter
+// cases. Returns true if the connection was removed and must not be used
+// anymore.
+func (b *backend) retire(conn *connection) bool {
 	if conn.IsClosed() {
 		b.removeConnection(conn)
+		return true
+	}
+	if b.conf.ConnectionMaxLifetime > 0 &&
+		time.Since(conn.StartTime()) >= b.conf.ConnectionMaxLifetime {
+		log.Debugf("closing connection to %s after max lifetime", b.addr)
+		b.removeConnection(conn)
+		_ = conn.Close()
+		return true
+	}
+	if b.conf.IdleTimeout > 0 {
+		lastUsed := conn.LastUsed()
+		if lastUsed.IsZero() {
+			lastUsed = conn.StartTime()
+		}
+		if time.Since(lastUsed) >= b.conf.IdleTimeout {
+			log.Debugf("closing connection to %s after idle timeout", b.addr)
+			b.removeConnection(conn)
+			_ = conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// Idle is called when a connection should be returned to the store.
+func (b *backend) Idle(conn *connection) {
+	// If the connection is closed or too old, throw it away. But if the connection pool is
+	// closed, then close the connection.
+	if b.retire(conn) {
 		return
 	}
 
@@ -196,6 +241,40 @@ func (b *backend) NumOpenConnections() int {
 	return b.counter
 }
 
+// State returns a snapshot of the connections open to this backend.
+func (b *backend) State() ConnectionState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := ConnectionState{Addr: b.addr, NodeID: -1}
+	for _, conn := range b.conns {
+		if conn.IsClosed() {
+			continue
+		}
+		state.Connections++
+		state.InFlight += conn.InFlight()
+		if lastUsed := conn.LastUsed(); lastUsed.After(state.LastUsed) {
+			state.LastUsed = lastUsed
+		}
+	}
+	return state
+}
+
+// InFlightRequests returns the requests waiting for a response on any
+// connection to this backend.
+func (b *backend) InFlightRequests() []InFlightRequest {
+	b.mu.Lock()
+	conns := make([]*connection, len(b.conns))
+	copy(conns, b.conns)
+	b.mu.Unlock()
+
+	var reqs []InFlightRequest
+	for _, conn := range conns {
+		reqs = append(reqs, conn.InFlightRequests()...)
+	}
+	return reqs
+}
+
 // Close shuts down all connections.
 func (b *backend) Close() {
 	b.mu.Lock()
@@ -207,6 +286,27 @@ func (b *backend) Close() {
 	b.counter = 0
 }
 
+// ConnectionState describes the connections open to a single broker. It is
+// intended for debugging only and reflects the state at the time it was taken.
+type ConnectionState struct {
+	// Addr is the address of the broker, as used to establish connections.
+	Addr string
+
+	// NodeID is the ID of the broker node, or -1 if the address is not (yet)
+	// known to belong to a node, e.g. for a seed address.
+	NodeID int32
+
+	// Connections is the number of open connections to the broker.
+	Connections int
+
+	// InFlight is the number of requests waiting for a response.
+	InFlight int
+
+	// LastUsed is the time a request was last sent to the broker, or the zero
+	// time if no request was sent yet.
+	LastUsed time.Time
+}
+
 // ClusterConnectionConf is configuration for the cluster connection pool.
 type ClusterConnectionConf struct {
 	// ConnectionLimit sets a limit on how many outstanding connections may exist to a
@@ -261,6 +361,115 @@ type ClusterConnectionConf struct {
 	//
 	// Defaults to 0 which means disabled.
 	MetadataRefreshFrequency time.Duration
+
+	// MetadataRequestVersion is the version of the metadata requests, 0 or
+	// 1. Version 1 requires Kafka 0.10 or later and returns the rack of each
+	// broker, the controller and which topics are internal, see
+	// Broker.ClusterInfo.
+	//
+	// Defaults to 0.
+	MetadataRequestVersion int16
+
+	// DialConcurrency limits how many connections to the cluster a client ID
+	// establishes at the same time. When many consumers and producers start at
+	// once against a large cluster, this connects to the brokers a few at a
+	// time instead of opening connections to all of them in a burst.
+	//
+	// Defaults to 0 which means no limit.
+	DialConcurrency int
+
+	// ConnectionMaxLifetime is the time after which a connection is closed
+	// and replaced by a new one, even if it is in use. A connection is only
+	// ever used by one request at a time, so it is closed once the request
+	// using it is done and the next request gets a new connection. This picks
+	// up DNS and network changes on long running clients.
+	//
+	// Defaults to 0 which means connections are kept open.
+	ConnectionMaxLifetime time.Duration
+
+	// IdleTimeout is the time after which a connection that wasn't used is
+	// closed instead of being reused, and a new one is established once it
+	// is needed. Set it below the idle timeout of load balancers and NATs
+	// between the client and the cluster, which may drop idle connections
+	// without telling either end.
+	//
+	// Defaults to 0 which means idle connections are kept open.
+	IdleTimeout time.Duration
+
+	// KeepAlive is the period of TCP keepalive probes on connections to the
+	// cluster. They detect connections to brokers whose host went away
+	// without closing them, so that requests on them fail instead of hanging.
+	//
+	// Defaults to 30s. Zero disables keepalives.
+	KeepAlive time.Duration
+
+	// ResponseTimeout limits how long a request waits for its response. The
+	// time the broker is asked to hold a request is added to it, which is
+	// the MaxWaitTime of a fetch, the Timeout of a produce and the
+	// SessionTimeout of a consumer group join. A request that times out
+	// fails like one that lost its connection: the connection is closed and
+	// the request is retried according to the retry configuration of the
+	// producer, consumer or offset coordinator.
+	//
+	// Defaults to 30s. Zero or less uses the default too, so that a request
+	// can't wait forever on a broker that stopped responding.
+	ResponseTimeout time.Duration
+
+	// Dial establishes all connections to the cluster, including those used
+	// for metadata requests. Replace it to dial through a proxy, from a
+	// specific source address or over an in-memory transport in tests.
+	//
+	// Defaults to net.DialTimeout.
+	Dial DialFunc
+
+	// TLSConfig, if set, makes all connections to the cluster use TLS on top
+	// of the connections established by Dial. Unless it sets ServerName, the
+	// certificate of each broker is verified against the host it is dialed at,
+	// which for all but the seed brokers is the host it advertises in metadata
+	// responses.
+	//
+	// Defaults to nil which means plain TCP connections.
+	TLSConfig *tls.Config
+
+	// SASL, if set, makes all connections to the cluster authenticate with
+	// SASL before any other request is sent. Connections to brokers that
+	// reject the credentials fail with an *AuthenticationError.
+	//
+	// Defaults to nil which means no authentication.
+	SASL *SASLConf
+}
+
+// DialFunc connects to the given address, giving up after timeout. It has the
+// signature of net.DialTimeout.
+type DialFunc func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// responseTimeout returns ResponseTimeout, or its default if it isn't
+// positive.
+func (conf *ClusterConnectionConf) responseTimeout() time.Duration {
+	if conf.ResponseTimeout <= 0 {
+		return NewClusterConnectionConf().ResponseTimeout
+	}
+	return conf.ResponseTimeout
+}
+
+// dialFunc returns the function that establishes connections to the cluster,
+// which is Dial with keepalives enabled, wrapped in TLS if TLSConfig is set
+// and authenticated if SASL is set.
+func (conf *ClusterConnectionConf) dialFunc() DialFunc {
+	dial := conf.Dial
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	if conf.KeepAlive > 0 {
+		dial = keepAliveDial(dial, conf.KeepAlive)
+	}
+	if conf.TLSConfig != nil {
+		dial = tlsDial(dial, conf.TLSConfig)
+	}
+	if conf.SASL != nil {
+		dial = saslDial(dial, conf.SASL)
+	}
+	return dial
 }
 
 // NewClusterConnectionConf constructs a default configuration.
@@ -273,6 +482,13 @@ func NewClusterConnectionConf() ClusterConnectionConf {
 		DialRetryWait:            500 * time.Millisecond,
 		MetadataRefreshTimeout:   30 * time.Second,
 		MetadataRefreshFrequency: 0,
+		MetadataRequestVersion:   0,
+		DialConcurrency:          0,
+		ConnectionMaxLifetime:    0,
+		IdleTimeout:              0,
+		KeepAlive:                30 * time.Second,
+		ResponseTimeout:          30 * time.Second,
+		Dial:                     net.DialTimeout,
 	}
 }
 
@@ -289,6 +505,10 @@ type connectionPool struct {
 	// If an addr is removed, any active backend pointing to it will be closed and no further
 	// connections can be made.
 	backends map[string]*backend
+	// closed is set once Close was called; no new connections are handed out after that.
+	closed bool
+	// dialSlots bounds concurrent dials to DialConcurrency, see backend.dialSlots.
+	dialSlots chan struct{}
 }
 
 // newConnectionPool creates a connection pool and initializes it.
@@ -298,6 +518,9 @@ func newConnectionPool(conf ClusterConnectionConf, nodes []string) *connectionPo
 		mu:       &sync.RWMutex{},
 		backends: make(map[string]*backend),
 	}
+	if conf.DialConcurrency > 0 {
+		connPool.dialSlots = make(chan struct{}, conf.DialConcurrency)
+	}
 
 	connPool.InitializeAddrs(nodes)
 
@@ -307,10 +530,11 @@ func newConnectionPool(conf ClusterConnectionConf, nodes []string) *connectionPo
 // newBackend creates a new backend structure.
 func (cp *connectionPool) newBackend(addr string) *backend {
 	return &backend{
-		mu:      &sync.Mutex{},
-		conf:    cp.conf,
-		addr:    addr,
-		channel: make(chan *connection, cp.conf.ConnectionLimit),
+		mu:        &sync.Mutex{},
+		conf:      cp.conf,
+		addr:      addr,
+		channel:   make(chan *connection, cp.conf.ConnectionLimit),
+		dialSlots: cp.dialSlots,
 	}
 }
 
@@ -365,9 +589,65 @@ func (cp *connectionPool) InitializeAddrs(addrs []string) {
 	}
 }
 
+// ConnectionStates returns the state of the connections to every known address.
+func (cp *connectionPool) ConnectionStates() []ConnectionState {
+	cp.mu.RLock()
+	backends := make([]*backend, 0, len(cp.backends))
+	for _, be := range cp.backends {
+		backends = append(backends, be)
+	}
+	cp.mu.RUnlock()
+
+	states := make([]ConnectionState, 0, len(backends))
+	for _, be := range backends {
+		states = append(states, be.State())
+	}
+	return states
+}
+
+// InFlightRequests returns the requests waiting for a response on any
+// connection of the pool.
+func (cp *connectionPool) InFlightRequests() []InFlightRequest {
+	cp.mu.RLock()
+	backends := make([]*backend, 0, len(cp.backends))
+	for _, be := range cp.backends {
+		backends = append(backends, be)
+	}
+	cp.mu.RUnlock()
+
+	var reqs []InFlightRequest
+	for _, be := range backends {
+		reqs = append(reqs, be.InFlightRequests()...)
+	}
+	return reqs
+}
+
+// Close shuts down all connections of the pool. Connections that are in use are closed as
+// well, so their users will see errors. After Close, no connections are handed out anymore.
+func (cp *connectionPool) Close() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.closed = true
+	for _, be := range cp.backends {
+		be.Close()
+	}
+}
+
+// IsClosed returns whether Close was called on this pool.
+func (cp *connectionPool) IsClosed() bool {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	return cp.closed
+}
+
 // GetIdleConnection returns a random idle connection from the set of connections that we
 // happen to have open. If no connections are available or idle, this returns nil.
 func (cp *connectionPool) GetIdleConnection() *connection {
+	if cp.IsClosed() {
+		return nil
+	}
 	addrs := cp.GetAllAddrs()
 
 	for _, idx := range rndPerm(len(addrs)) {
@@ -386,6 +666,9 @@ func (cp *connectionPool) GetIdleConnection() *connection {
 //
 // See comments on GetConnection for details on the error returned.
 func (cp *connectionPool) GetConnectionByAddr(addr string) (*connection, error) {
+	if cp.IsClosed() {
+		return nil, ErrClosed
+	}
 	if be := cp.getBackend(addr); be != nil {
 		return be.GetConnection()
 	}
@@ -400,6 +683,9 @@ func (cp *connectionPool) Idle(conn *connection) {
 		return
 	}
 
+	if cp.IsClosed() {
+		_ = conn.Close()
+	}
 	if be := cp.getBackend(conn.addr); be != nil {
 		be.Idle(conn)
 	} else {
@@ -25,7 +25,7 @@ func (s *ConnectionPoolSuite) TestConnectionLimit(c *C) {
 	conf.ClusterConnectionConf.ConnectionLimit = 2
 	conf.ClusterConnectionConf.DialTimeout = 1 * time.Second
 	addresses := []string{srv.Address()}
-	cp := NewConnectionPool(conf.ClusterConnectionConf, addresses)
+	cp := newConnectionPool(conf.ClusterConnectionConf, addresses)
 	cp.InitializeAddrs(addresses)
 	be := cp.getBackend(srv.Address())
 
@@ -94,7 +94,7 @@ func (s *ConnectionPoolSuite) TestGetConnectionError(c *C) {
 	conf.IdleConnectionWait = 200 * time.Millisecond
 
 	addresses := []string{srv.Address()}
-	cp := NewConnectionPool(conf, addresses)
+	cp := newConnectionPool(conf, addresses)
 	cp.InitializeAddrs([]string{srv.Address()})
 	be := cp.getBackend(srv.Address())
 
@@ -130,9 +130,86 @@ func (s *ConnectionPoolSuite) TestGetConnectionError(c *C) {
 	c.Assert(conn3, IsNil)
 }
 
+func (s *ConnectionPoolSuite) TestConnectionMaxLifetime(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewBrokerConf("foo").ClusterConnectionConf
+	conf.ConnectionLimit = 1
+	conf.ConnectionMaxLifetime = 100 * time.Millisecond
+	addresses := []string{srv.Address()}
+	cp := newConnectionPool(conf, addresses)
+	be := cp.getBackend(srv.Address())
+
+	conn, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	cp.Idle(conn)
+	c.Assert(cp.GetIdleConnection(), Equals, conn)
+
+	// a connection in use is not closed, even once it is too old
+	time.Sleep(150 * time.Millisecond)
+	_, err = conn.Metadata(&proto.MetadataReq{})
+	c.Assert(err, IsNil)
+	c.Assert(conn.IsClosed(), Equals, false)
+
+	// it is closed when it's returned, and replaced by the next request
+	cp.Idle(conn)
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(be.NumOpenConnections(), Equals, 0)
+	conn2, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	c.Assert(conn2, Not(Equals), conn)
+	c.Assert(be.NumOpenConnections(), Equals, 1)
+
+	// idle connections that got too old are closed when taken from the pool
+	cp.Idle(conn2)
+	time.Sleep(150 * time.Millisecond)
+	c.Assert(cp.GetIdleConnection(), IsNil)
+	c.Assert(conn2.IsClosed(), Equals, true)
+	c.Assert(be.NumOpenConnections(), Equals, 0)
+}
+
+func (s *ConnectionPoolSuite) TestIdleTimeout(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewBrokerConf("foo").ClusterConnectionConf
+	conf.ConnectionLimit = 1
+	conf.IdleTimeout = 100 * time.Millisecond
+	addresses := []string{srv.Address()}
+	cp := newConnectionPool(conf, addresses)
+	be := cp.getBackend(srv.Address())
+
+	// a connection that is used keeps being reused
+	conn, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err = conn.Metadata(&proto.MetadataReq{})
+		c.Assert(err, IsNil)
+		cp.Idle(conn)
+		c.Assert(cp.GetIdleConnection(), Equals, conn)
+	}
+
+	// an idle connection is closed when taken from the pool, and replaced
+	// by the next request
+	cp.Idle(conn)
+	time.Sleep(150 * time.Millisecond)
+	c.Assert(cp.GetIdleConnection(), IsNil)
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(be.NumOpenConnections(), Equals, 0)
+	conn2, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	c.Assert(conn2, Not(Equals), conn)
+	_, err = conn2.Metadata(&proto.MetadataReq{})
+	c.Assert(err, IsNil)
+}
+
 func (s *ConnectionPoolSuite) TestTrimDeadAddrs(c *C) {
 	addresses := []string{"foo", "bar", "baz"}
-	cp := NewConnectionPool(NewClusterConnectionConf(), addresses)
+	cp := newConnectionPool(NewClusterConnectionConf(), addresses)
 	cp.InitializeAddrs(addresses)
 	c.Assert(len(cp.GetAllAddrs()), Equals, 3)
 	c.Assert(cp.getBackend("foo"), NotNil)
@@ -142,3 +219,171 @@ func (s *ConnectionPoolSuite) TestTrimDeadAddrs(c *C) {
 	c.Assert(cp.getBackend("qux"), NotNil)
 	c.Assert(cp.getBackend("foo"), IsNil)
 }
+
+func (s *ConnectionPoolSuite) TestConnectionStates(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	conf := NewBrokerConf("test-connection-states")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	broker, err := NewBroker("test-cluster-connection-states", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+
+	states := broker.ConnectionStates()
+	c.Assert(states, HasLen, 1)
+	c.Assert(states[0].Addr, Equals, srv.Address())
+	c.Assert(states[0].NodeID, Equals, int32(1))
+	c.Assert(states[0].Connections, Equals, 0)
+	c.Assert(states[0].LastUsed.IsZero(), Equals, true)
+
+	before := time.Now()
+	conn, err := broker.conns.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	_, err = conn.Metadata(&proto.MetadataReq{})
+	c.Assert(err, IsNil)
+
+	states = broker.ConnectionStates()
+	c.Assert(states, HasLen, 1)
+	c.Assert(states[0].Connections, Equals, 1)
+	c.Assert(states[0].InFlight, Equals, 0)
+	c.Assert(states[0].LastUsed.Before(before), Equals, false)
+
+	_ = conn.Close()
+	broker.conns.Idle(conn)
+	states = broker.ConnectionStates()
+	c.Assert(states[0].Connections, Equals, 0)
+}
+
+func (s *ConnectionPoolSuite) TestInFlightRequests(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		<-release
+		return nil
+	})
+
+	conf := NewBrokerConf("test-in-flight-requests")
+	conf.ClusterConnectionConf.DialTimeout = 400 * time.Millisecond
+	conf.CloseTimeout = 50 * time.Millisecond
+	broker, err := NewBroker("test-cluster-in-flight-requests", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	c.Assert(broker.InFlightRequests(), HasLen, 0)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := broker.Producer(NewProducerConf()).Produce("test", 1, &proto.Message{})
+		errc <- err
+	}()
+
+	var reqs []InFlightRequest
+	for i := 0; i < 100 && len(reqs) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+		reqs = broker.InFlightRequests()
+	}
+	c.Assert(reqs, HasLen, 1)
+	c.Assert(reqs[0].Addr, Equals, srv.Address())
+	c.Assert(reqs[0].Kind, Equals, "produce")
+	c.Assert(reqs[0].Topic, Equals, "test")
+	c.Assert(reqs[0].Partition, Equals, int32(1))
+	c.Assert(reqs[0].Age > 0, Equals, true)
+	c.Assert(broker.ConnectionStates()[0].InFlight, Equals, 1)
+
+	// the request is canceled once the grace period is over
+	broker.Close()
+	select {
+	case err := <-errc:
+		c.Assert(err, Equals, ErrClosed)
+	case <-time.After(time.Second):
+		c.Fatal("produce not canceled by Close")
+	}
+	c.Assert(broker.InFlightRequests(), HasLen, 0)
+}
+
+func (s *ConnectionPoolSuite) TestDialConcurrency(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewClusterConnectionConf()
+	conf.DialConcurrency = 1
+	conf.DialTimeout = 100 * time.Millisecond
+	conf.IdleConnectionWait = 10 * time.Millisecond
+	addresses := []string{srv.Address()}
+	cp := newConnectionPool(conf, addresses)
+
+	// Hold the only dial slot, as if another dial was in progress.
+	cp.dialSlots <- struct{}{}
+	conn, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(conn, IsNil)
+	c.Assert(err, FitsTypeOf, &NoConnectionsAvailable{})
+
+	<-cp.dialSlots
+	conn, err = cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+	c.Assert(conn, NotNil)
+	c.Assert(cp.dialSlots, HasLen, 0)
+	conn.Close()
+}
+
+func (s *ConnectionPoolSuite) TestDialSlotWaitDoesNotLockBackend(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conf := NewClusterConnectionConf()
+	conf.DialConcurrency = 1
+	conf.DialTimeout = time.Second
+	addresses := []string{srv.Address()}
+	cp := newConnectionPool(conf, addresses)
+	conn, err := cp.GetConnectionByAddr(srv.Address())
+	c.Assert(err, IsNil)
+
+	// While a new connection waits for the dial slot, closed connections
+	// of the same backend can still be returned and removed.
+	cp.dialSlots <- struct{}{}
+	be := cp.getBackend(srv.Address())
+	waiting := make(chan struct{})
+	go func() {
+		defer close(waiting)
+		if conn, err := be.getNewConnection(); err == nil && conn != nil {
+			conn.Close()
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	conn.Close()
+	idle := make(chan struct{})
+	go func() {
+		be.Idle(conn)
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-time.After(500 * time.Millisecond):
+		c.Fatal("returning a connection blocked by a dial slot wait")
+	}
+
+	<-cp.dialSlots
+	<-waiting
+	cp.Close()
+}
+
+func (s *ConnectionPoolSuite) TestResponseTimeoutDefault(c *C) {
+	conf := NewClusterConnectionConf()
+	conf.ResponseTimeout = time.Second
+	c.Assert(conf.responseTimeout(), Equals, time.Second)
+
+	// requests never wait without a limit
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		conf.ResponseTimeout = timeout
+		c.Assert(conf.responseTimeout(), Equals, 30*time.Second)
+	}
+}
@@ -1,6 +1,7 @@
 package kafka
 
 import (
+	"crypto/tls"
 	"net"
 	"reflect"
 	"strings"
@@ -139,7 +140,7 @@ func (s *ConnectionSuite) TestConnectionMetadata(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -198,7 +199,7 @@ func (s *ConnectionSuite) TestConnectionProduce(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -314,7 +315,7 @@ func (s *ConnectionSuite) TestConnectionFetch(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -377,7 +378,7 @@ func (s *ConnectionSuite) TestConnectionOffset(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -410,7 +411,7 @@ func (s *ConnectionSuite) TestConnectionProduceNoAck(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -455,7 +456,7 @@ func (s *ConnectionSuite) TestClosedConnectionWriter(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -494,7 +495,7 @@ func (s *ConnectionSuite) TestClosedConnectionReader(c *C) {
 	if err != nil {
 		c.Fatalf("test server error: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -533,7 +534,7 @@ func (s *ConnectionSuite) TestConnectionReaderAfterEOF(c *C) {
 		_ = ln.Close()
 	}()
 
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, time.Second)
 	if err != nil {
 		c.Fatalf("could not connect to test server: %s", err)
 	}
@@ -567,3 +568,52 @@ func (s *ConnectionSuite) TestConnectionReaderAfterEOF(c *C) {
 		c.Fatal("fetching from closed connection succeeded")
 	}
 }
+
+func (s *ConnectionSuite) TestTLSHandshakeTimeout(c *C) {
+	// a server that accepts connections but never answers the handshake
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dial := tlsDial(net.DialTimeout, &tls.Config{})
+	start := time.Now()
+	_, err = newTCPConnection(dial, ln.Addr().String(), 100*time.Millisecond, time.Second)
+	c.Assert(err, NotNil)
+	_, ok := err.(*net.OpError)
+	c.Assert(ok, Equals, true)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *ConnectionSuite) TestConnectionResponseTimeout(c *C) {
+	// a server that accepts connections but never responds
+	ln, _, err := testServer2()
+	c.Assert(err, IsNil)
+	defer ln.Close()
+
+	conn, err := newTCPConnection(nil, ln.Addr().String(), time.Second, 100*time.Millisecond)
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	_, err = conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, proto.ErrRequestTimeout)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(conn.InFlight(), Equals, 0)
+
+	// fetches are given MaxWaitTime on top of the response timeout
+	conn, err = newTCPConnection(nil, ln.Addr().String(), time.Second, 100*time.Millisecond)
+	c.Assert(err, IsNil)
+	start = time.Now()
+	_, err = conn.Fetch(&proto.FetchReq{ClientID: "tester", MaxWaitTime: 300 * time.Millisecond})
+	c.Assert(err, Equals, proto.ErrRequestTimeout)
+	c.Assert(time.Since(start) >= 400*time.Millisecond, Equals, true, Commentf("took %s", time.Since(start)))
+}
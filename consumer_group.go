@@ -0,0 +1,879 @@
+package kafka
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// Assignor computes the partition assignment of a consumer group. It runs on
+// the member the coordinator elected group leader.
+type Assignor interface {
+	// Name is the name of the assignment protocol. All members of a group
+	// have to use the same one.
+	Name() string
+
+	// Assign returns the partitions of every topic assigned to every member,
+	// given the topics every member consumes and the partition count of
+	// every topic.
+	Assign(members map[string][]string, partitions map[string]int32) map[string]map[string][]int32
+}
+
+// RangeAssignor assigns every member a range of consecutive partitions of
+// every topic it consumes, like the range assignor of the Java client. The
+// first members in the order of their IDs get one more partition if the
+// partitions can't be split evenly.
+type RangeAssignor struct{}
+
+func (RangeAssignor) Name() string {
+	return "range"
+}
+
+func (RangeAssignor) Assign(members map[string][]string, partitions map[string]int32) map[string]map[string][]int32 {
+	assignment := make(map[string]map[string][]int32, len(members))
+	for topic, consumers := range topicConsumers(members) {
+		count := partitions[topic]
+		n := int(count) / len(consumers)
+		extra := int(count) % len(consumers)
+		start := 0
+		for i, memberID := range consumers {
+			size := n
+			if i < extra {
+				size++
+			}
+			for p := start; p < start+size; p++ {
+				assign(assignment, memberID, topic, int32(p))
+			}
+			start += size
+		}
+	}
+	return assignment
+}
+
+// RoundRobinAssignor assigns the partitions of all topics to the members in
+// turn, like the round robin assignor of the Java client. Partitions are
+// ordered by topic name and partition ID, and members by their IDs; members
+// that don't consume a topic are skipped for its partitions.
+type RoundRobinAssignor struct{}
+
+func (RoundRobinAssignor) Name() string {
+	return "roundrobin"
+}
+
+func (RoundRobinAssignor) Assign(members map[string][]string, partitions map[string]int32) map[string]map[string][]int32 {
+	assignment := make(map[string]map[string][]int32, len(members))
+	ids := make([]string, 0, len(members))
+	for memberID := range members {
+		ids = append(ids, memberID)
+	}
+	sort.Strings(ids)
+
+	consumers := topicConsumers(members)
+	topics := make([]string, 0, len(consumers))
+	for topic := range consumers {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	next := 0
+	for _, topic := range topics {
+		subscribed := make(map[string]bool, len(consumers[topic]))
+		for _, memberID := range consumers[topic] {
+			subscribed[memberID] = true
+		}
+		for p := int32(0); p < partitions[topic]; p++ {
+			for !subscribed[ids[next%len(ids)]] {
+				next++
+			}
+			assign(assignment, ids[next%len(ids)], topic, p)
+			next++
+		}
+	}
+	return assignment
+}
+
+// topicConsumers returns the sorted IDs of the members consuming every topic.
+func topicConsumers(members map[string][]string) map[string][]string {
+	consumers := make(map[string][]string)
+	for memberID, topics := range members {
+		for _, topic := range topics {
+			consumers[topic] = append(consumers[topic], memberID)
+		}
+	}
+	for _, ids := range consumers {
+		sort.Strings(ids)
+	}
+	return consumers
+}
+
+// assign adds a partition to the assignment of a member.
+func assign(assignment map[string]map[string][]int32, memberID, topic string, partition int32) {
+	if assignment[memberID] == nil {
+		assignment[memberID] = make(map[string][]int32)
+	}
+	assignment[memberID][topic] = append(assignment[memberID][topic], partition)
+}
+
+// ConsumerGroupConf is the configuration of a ConsumerGroup.
+type ConsumerGroupConf struct {
+	// SessionTimeout is how long the coordinator waits for a heartbeat
+	// before it removes the member from the group, and for members to
+	// rejoin once the group rebalances. Join and sync requests wait for up
+	// to this long. Join requests are given the time, but sync requests are
+	// not, so it must be shorter than ClusterConnectionConf.ResponseTimeout.
+	//
+	// Defaults to 10s.
+	SessionTimeout time.Duration
+
+	// HeartbeatInterval is how often the member tells the coordinator that
+	// it's alive. The member learns about rebalances with the heartbeat, so
+	// this is also how long it takes at most to start rejoining.
+	//
+	// Defaults to 3s.
+	HeartbeatInterval time.Duration
+
+	// AutoCommitInterval is how often the offsets of the messages returned
+	// so far are committed. Offsets are also committed before rejoining
+	// and on Close.
+	//
+	// Defaults to 5s. Set to 0 to commit only with Commit, before rejoining
+	// and on Close.
+	AutoCommitInterval time.Duration
+
+	// Assignor computes the assignment if this member is the group leader.
+	//
+	// Defaults to RangeAssignor.
+	Assignor Assignor
+
+	// Consumer is the configuration of the consumers of the assigned
+	// partitions. Topic and Partition are set for every partition, and
+	// StartOffset is only used for partitions without a committed offset.
+	//
+	// Defaults to NewConsumerConf.
+	Consumer ConsumerConf
+
+	// ConsumeTimeout is the longest Consume and ConsumeBatch wait for
+	// messages before they return ErrNoData.
+	//
+	// Defaults to 0, which waits until there are messages or the group is
+	// closed.
+	ConsumeTimeout time.Duration
+
+	// RetryErrWait is the wait before joining again after joining the group
+	// failed. This follows an exponential backoff model.
+	//
+	// Defaults to 500ms.
+	RetryErrWait time.Duration
+}
+
+// NewConsumerGroupConf returns the default consumer group configuration.
+func NewConsumerGroupConf() ConsumerGroupConf {
+	return ConsumerGroupConf{
+		SessionTimeout:     10 * time.Second,
+		HeartbeatInterval:  3 * time.Second,
+		AutoCommitInterval: 5 * time.Second,
+		Assignor:           RangeAssignor{},
+		Consumer:           NewConsumerConf("", 0),
+		ConsumeTimeout:     0,
+		RetryErrWait:       500 * time.Millisecond,
+	}
+}
+
+// Validate returns an error describing the first invalid setting, or nil if
+// the configuration is valid.
+func (conf ConsumerGroupConf) Validate() error {
+	switch {
+	case conf.SessionTimeout <= 0:
+		return fmt.Errorf("SessionTimeout %s must be positive", conf.SessionTimeout)
+	case conf.HeartbeatInterval <= 0:
+		return fmt.Errorf("HeartbeatInterval %s must be positive", conf.HeartbeatInterval)
+	case conf.HeartbeatInterval >= conf.SessionTimeout:
+		return fmt.Errorf("HeartbeatInterval %s must be shorter than SessionTimeout %s",
+			conf.HeartbeatInterval, conf.SessionTimeout)
+	case conf.AutoCommitInterval < 0:
+		return fmt.Errorf("negative AutoCommitInterval %s", conf.AutoCommitInterval)
+	case conf.Assignor == nil:
+		return errors.New("missing Assignor")
+	case conf.ConsumeTimeout < 0:
+		return fmt.Errorf("negative ConsumeTimeout %s", conf.ConsumeTimeout)
+	case conf.RetryErrWait < 0:
+		return fmt.Errorf("negative RetryErrWait %s", conf.RetryErrWait)
+	}
+	consumerConf := conf.Consumer
+	consumerConf.Topic = "-"
+	if err := consumerConf.Validate(); err != nil {
+		return fmt.Errorf("invalid consumer configuration: %s", err)
+	}
+	return nil
+}
+
+// ConsumerGroup consumes topics together with the other members of a Kafka
+// consumer group. The coordinator of the group spreads the partitions of the
+// topics over the members and rebalances them whenever members join or
+// leave. Messages of all partitions assigned to this member are returned as a
+// single stream.
+//
+// The offset committed for a partition is that of the message following the
+// last one returned by Consume or ConsumeBatch. On a rebalance, the offsets
+// are committed before the partitions are handed over, and messages that were
+// fetched but not returned yet are dropped, so that the next owner of a
+// partition continues right after the last message returned here.
+//
+// Consume and ConsumeBatch must not be called concurrently.
+type ConsumerGroup struct {
+	broker  *Broker
+	groupID string
+	topics  []string
+	conf    ConsumerGroupConf
+
+	// memberID is only used by the goroutine joining the group.
+	memberID string
+
+	// commitMu serializes commits, so that an older offset never overwrites
+	// a newer one.
+	commitMu *sync.Mutex
+
+	// mu protects the following.
+	mu      *sync.Mutex
+	gen     *groupGeneration // nil while joining
+	err     error            // error of the last failed join
+	closed  bool
+	changed chan struct{} // closed and replaced whenever the above change
+
+	stop chan struct{} // closed by Close
+	done chan struct{} // closed once the group was left
+}
+
+// groupGeneration is the state of a single generation of the group, from
+// joining it until the next rebalance.
+type groupGeneration struct {
+	id          int32
+	partitions  []topicPartition
+	coordinator *offsetCoordinator // commits with the generation's ID
+
+	batches   chan []*proto.Message // fetched by the partition consumers
+	stop      chan struct{}         // closed once the generation ends
+	rebalance chan struct{}         // signalled when a commit saw a rebalance
+	wg        sync.WaitGroup        // partition consumers
+
+	// Protected by ConsumerGroup.mu.
+	pending   []*proto.Message         // fetched, but not returned yet
+	positions map[topicPartition]int64 // offset after the last returned message
+	committed map[topicPartition]int64
+}
+
+// ConsumerGroup joins the group with the given ID as a new member consuming
+// the given topics. It returns once the member received its first
+// assignment.
+func (b *Broker) ConsumerGroup(groupID string, topics []string, conf ConsumerGroupConf) (*ConsumerGroup, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid consumer group configuration: %s", err)
+	}
+	if groupID == "" {
+		return nil, errors.New("missing group ID")
+	}
+	if len(topics) == 0 {
+		return nil, errors.New("no topics to consume")
+	}
+	if timeout := b.conf.ClusterConnectionConf.responseTimeout(); conf.SessionTimeout >= timeout {
+		return nil, fmt.Errorf("SessionTimeout %s must be shorter than ResponseTimeout %s",
+			conf.SessionTimeout, timeout)
+	}
+
+	g := &ConsumerGroup{
+		broker:   b,
+		groupID:  groupID,
+		topics:   topics,
+		conf:     conf,
+		commitMu: &sync.Mutex{},
+		mu:       &sync.Mutex{},
+		changed:  make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	gen, err := g.join()
+	if err != nil {
+		return nil, err
+	}
+	g.start(gen)
+	go g.run(gen)
+	return g, nil
+}
+
+// Partitions returns the partitions currently assigned to this member, or
+// none while the group is rebalancing.
+func (g *ConsumerGroup) Partitions() map[string][]int32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	partitions := make(map[string][]int32)
+	if g.gen != nil {
+		for _, tp := range g.gen.partitions {
+			partitions[tp.topic] = append(partitions[tp.topic], tp.partition)
+		}
+	}
+	return partitions
+}
+
+// Consume returns the next message of any of the assigned partitions.
+func (g *ConsumerGroup) Consume() (*proto.Message, error) {
+	batch, err := g.next(1)
+	if err != nil {
+		return nil, err
+	}
+	return batch[0], nil
+}
+
+// ConsumeBatch returns the next messages of one of the assigned partitions.
+func (g *ConsumerGroup) ConsumeBatch() ([]*proto.Message, error) {
+	return g.next(0)
+}
+
+// next returns up to max messages, or all buffered messages if max is 0,
+// waiting for messages if there are none.
+func (g *ConsumerGroup) next(max int) ([]*proto.Message, error) {
+	var timeout <-chan time.Time
+	if g.conf.ConsumeTimeout > 0 {
+		timer := time.NewTimer(g.conf.ConsumeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		g.mu.Lock()
+		if g.closed || g.broker.isClosed() {
+			g.mu.Unlock()
+			return nil, ErrClosed
+		}
+		gen, changed, err := g.gen, g.changed, g.err
+		if gen != nil && len(gen.pending) > 0 {
+			batch := gen.take(max)
+			g.mu.Unlock()
+			return batch, nil
+		}
+		g.mu.Unlock()
+
+		var batches chan []*proto.Message
+		if gen != nil {
+			batches = gen.batches
+		} else if err != nil {
+			return nil, err
+		}
+		select {
+		case batch := <-batches:
+			g.mu.Lock()
+			// messages of a generation that ended are dropped, their
+			// partitions were committed without them
+			if g.gen == gen {
+				gen.pending = append(gen.pending, batch...)
+			}
+			g.mu.Unlock()
+		case <-changed:
+		case <-timeout:
+			return nil, ErrNoData
+		}
+	}
+}
+
+// take removes up to max messages, or all if max is 0, from the pending
+// messages and moves the positions of their partitions past them. Must be
+// called with ConsumerGroup.mu held.
+func (gen *groupGeneration) take(max int) []*proto.Message {
+	n := len(gen.pending)
+	if max > 0 && max < n {
+		n = max
+	}
+	batch := make([]*proto.Message, n)
+	copy(batch, gen.pending)
+	for i := range gen.pending[:n] {
+		gen.pending[i] = nil
+	}
+	gen.pending = gen.pending[n:]
+
+	for _, msg := range batch {
+		gen.positions[topicPartition{msg.Topic, msg.Partition}] = msg.Offset + 1
+	}
+	return batch
+}
+
+// Commit commits the offsets of the messages returned so far.
+func (g *ConsumerGroup) Commit() error {
+	g.mu.Lock()
+	gen := g.gen
+	g.mu.Unlock()
+	if gen == nil {
+		// offsets were committed when the last generation ended
+		return nil
+	}
+	return g.commit(gen)
+}
+
+// commit commits the offsets of the messages of the generation returned so
+// far. If the coordinator reports a rebalance, the generation is ended.
+func (g *ConsumerGroup) commit(gen *groupGeneration) error {
+	g.commitMu.Lock()
+	defer g.commitMu.Unlock()
+
+	g.mu.Lock()
+	offsets := make(map[topicPartition]int64)
+	for tp, offset := range gen.positions {
+		if committed, ok := gen.committed[tp]; !ok || committed != offset {
+			offsets[tp] = offset
+		}
+	}
+	g.mu.Unlock()
+
+	var resErr error
+	for tp, offset := range offsets {
+		if err := gen.coordinator.Commit(tp.topic, tp.partition, offset); err != nil {
+			log.Errorf("cannot commit %s of group %s at %d: %s", tp, g.groupID, offset, err)
+			if isRebalanceError(err) {
+				select {
+				case gen.rebalance <- struct{}{}:
+				default:
+				}
+			}
+			if resErr == nil {
+				resErr = err
+			}
+			continue
+		}
+		g.mu.Lock()
+		gen.committed[tp] = offset
+		g.mu.Unlock()
+	}
+	return resErr
+}
+
+// isRebalanceError returns true if err tells that the member has to rejoin
+// the group.
+func isRebalanceError(err error) bool {
+	switch err {
+	case proto.ErrRebalanceInProgress, proto.ErrIllegalGeneration, proto.ErrUnknownConsumerID:
+		return true
+	}
+	return false
+}
+
+// Close commits the offsets of the messages returned so far and leaves the
+// group, so that its partitions are assigned to the other members right away.
+// Consume and ConsumeBatch return ErrClosed afterwards.
+func (g *ConsumerGroup) Close() {
+	g.mu.Lock()
+	if !g.closed {
+		g.closed = true
+		close(g.stop)
+		g.notify()
+	}
+	g.mu.Unlock()
+	<-g.done
+}
+
+// notify wakes up Consume calls waiting for the generation. Must be called
+// with mu held.
+func (g *ConsumerGroup) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// run keeps the member in the group, rejoining whenever the group rebalances,
+// until the group is closed.
+func (g *ConsumerGroup) run(gen *groupGeneration) {
+	defer close(g.done)
+
+	for {
+		rejoin := g.heartbeat(gen)
+		g.end(gen)
+		if !rejoin {
+			break
+		}
+		if gen = g.rejoin(); gen == nil {
+			break
+		}
+		g.start(gen)
+	}
+
+	if !g.broker.isClosed() {
+		g.leave()
+	}
+}
+
+// heartbeat sends heartbeats and commits offsets until the generation ends,
+// returning true if the member has to rejoin or false if the group was
+// closed.
+func (g *ConsumerGroup) heartbeat(gen *groupGeneration) bool {
+	ticker := time.NewTicker(g.conf.HeartbeatInterval)
+	defer ticker.Stop()
+	var autoCommit <-chan time.Time
+	if g.conf.AutoCommitInterval > 0 {
+		commitTicker := time.NewTicker(g.conf.AutoCommitInterval)
+		defer commitTicker.Stop()
+		autoCommit = commitTicker.C
+	}
+
+	lastHeartbeat := time.Now()
+	for {
+		select {
+		case <-g.stop:
+			return false
+		case <-gen.rebalance:
+			return true
+		case <-autoCommit:
+			_ = g.commit(gen)
+		case <-ticker.C:
+			if g.broker.isClosed() {
+				return false
+			}
+			err := g.sendHeartbeat(gen)
+			switch {
+			case err == nil:
+				lastHeartbeat = time.Now()
+			case isRebalanceError(err):
+				log.Infof("group %s is rebalancing: %s", g.groupID, err)
+				if err == proto.ErrUnknownConsumerID {
+					g.memberID = ""
+				}
+				return true
+			case time.Since(lastHeartbeat) > g.conf.SessionTimeout:
+				log.Errorf("no heartbeat of group %s for %s, rejoining: %s",
+					g.groupID, time.Since(lastHeartbeat), err)
+				return true
+			default:
+				log.Warningf("cannot send heartbeat of group %s: %s", g.groupID, err)
+			}
+		}
+	}
+}
+
+// sendHeartbeat sends a single heartbeat for the generation.
+func (g *ConsumerGroup) sendHeartbeat(gen *groupGeneration) error {
+	conn, err := g.broker.coordinatorConnection(g.groupID)
+	if err != nil {
+		return err
+	}
+	defer func(lconn *connection) { go g.broker.conns.Idle(lconn) }(conn)
+
+	var resp *proto.HeartbeatResp
+	err = measureRequest(g.broker.metrics, proto.HeartbeatReqKind, conn, func() (err error) {
+		resp, err = conn.Heartbeat(&proto.HeartbeatReq{
+			ClientID:      g.broker.conf.ClientID,
+			ConsumerGroup: g.groupID,
+			GenerationID:  gen.id,
+			MemberID:      g.memberID,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Err
+}
+
+// start consumes the partitions assigned in the generation and makes it the
+// current one.
+func (g *ConsumerGroup) start(gen *groupGeneration) {
+	for _, tp := range gen.partitions {
+		gen.wg.Add(1)
+		go func(tp topicPartition) {
+			defer gen.wg.Done()
+			g.consume(gen, tp)
+		}(tp)
+	}
+
+	g.mu.Lock()
+	g.gen = gen
+	g.err = nil
+	g.notify()
+	g.mu.Unlock()
+}
+
+// end stops the partition consumers of the generation and commits the
+// offsets of the messages returned by then.
+func (g *ConsumerGroup) end(gen *groupGeneration) {
+	g.mu.Lock()
+	close(gen.stop)
+	g.gen = nil
+	g.notify()
+	g.mu.Unlock()
+
+	if !g.broker.isClosed() {
+		_ = g.commit(gen)
+	}
+	gen.wg.Wait()
+}
+
+// rejoin joins the group until it succeeds or the group is closed, in which
+// case it returns nil.
+func (g *ConsumerGroup) rejoin() *groupGeneration {
+	retry := &backoff.Backoff{Min: g.conf.RetryErrWait, Jitter: true}
+	for {
+		select {
+		case <-g.stop:
+			return nil
+		default:
+		}
+		if g.broker.isClosed() {
+			return nil
+		}
+
+		gen, err := g.join()
+		if err == nil {
+			return gen
+		}
+		log.Errorf("cannot join group %s: %s", g.groupID, err)
+		g.mu.Lock()
+		g.err = err
+		g.notify()
+		g.mu.Unlock()
+
+		select {
+		case <-g.stop:
+			return nil
+		case <-time.After(retry.Duration()):
+		}
+	}
+}
+
+// join joins the group and returns the generation with this member's
+// assignment. The group leader computes the assignment of all members.
+func (g *ConsumerGroup) join() (*groupGeneration, error) {
+	conn, err := g.broker.coordinatorConnection(g.groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer func(lconn *connection) { go g.broker.conns.Idle(lconn) }(conn)
+
+	metadata, err := (&proto.GroupMemberMetadata{Topics: g.topics}).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	var joinResp *proto.JoinGroupResp
+	err = measureRequest(g.broker.metrics, proto.JoinGroupReqKind, conn, func() (err error) {
+		joinResp, err = conn.JoinGroup(&proto.JoinGroupReq{
+			ClientID:       g.broker.conf.ClientID,
+			ConsumerGroup:  g.groupID,
+			SessionTimeout: g.conf.SessionTimeout,
+			MemberID:       g.memberID,
+			ProtocolType:   proto.ConsumerProtocolType,
+			GroupProtocols: []proto.GroupProtocol{
+				{Name: g.conf.Assignor.Name(), Metadata: metadata},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if joinResp.Err != nil {
+		if joinResp.Err == proto.ErrUnknownConsumerID {
+			g.memberID = ""
+		}
+		return nil, joinResp.Err
+	}
+	g.memberID = joinResp.MemberID
+
+	var assignments []proto.GroupAssignment
+	if joinResp.LeaderID == joinResp.MemberID {
+		if assignments, err = g.assign(joinResp.Members); err != nil {
+			return nil, err
+		}
+	}
+	var syncResp *proto.SyncGroupResp
+	err = measureRequest(g.broker.metrics, proto.SyncGroupReqKind, conn, func() (err error) {
+		syncResp, err = conn.SyncGroup(&proto.SyncGroupReq{
+			ClientID:         g.broker.conf.ClientID,
+			ConsumerGroup:    g.groupID,
+			GenerationID:     joinResp.GenerationID,
+			MemberID:         g.memberID,
+			GroupAssignments: assignments,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if syncResp.Err != nil {
+		return nil, syncResp.Err
+	}
+	assignment, err := proto.ReadGroupMemberAssignment(bytes.NewReader(syncResp.MemberAssignment))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read assignment: %s", err)
+	}
+
+	coordinatorConf := NewOffsetCoordinatorConf(g.groupID)
+	coordinatorConf.GenerationID = joinResp.GenerationID
+	coordinatorConf.MemberID = g.memberID
+	coordinator, err := g.broker.OffsetCoordinator(coordinatorConf)
+	if err != nil {
+		return nil, err
+	}
+	gen := &groupGeneration{
+		id:          joinResp.GenerationID,
+		coordinator: coordinator.(*offsetCoordinator),
+		batches:     make(chan []*proto.Message),
+		stop:        make(chan struct{}),
+		rebalance:   make(chan struct{}, 1),
+		positions:   make(map[topicPartition]int64),
+		committed:   make(map[topicPartition]int64),
+	}
+	for _, topic := range assignment.Topics {
+		for _, partition := range topic.Partitions {
+			gen.partitions = append(gen.partitions, topicPartition{topic.Name, partition})
+		}
+	}
+	log.Infof("joined group %s as %s in generation %d with partitions %v",
+		g.groupID, g.memberID, gen.id, gen.partitions)
+	return gen, nil
+}
+
+// assign computes the assignment of the members of the group, as the group
+// leader. Metadata is refreshed first to pick up new partitions.
+func (g *ConsumerGroup) assign(members []proto.GroupMember) ([]proto.GroupAssignment, error) {
+	if err := g.broker.cluster.RefreshMetadata(); err != nil {
+		return nil, err
+	}
+
+	subscriptions := make(map[string][]string, len(members))
+	partitions := make(map[string]int32)
+	for _, member := range members {
+		metadata, err := proto.ReadGroupMemberMetadata(bytes.NewReader(member.Metadata))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read metadata of member %s: %s", member.MemberID, err)
+		}
+		subscriptions[member.MemberID] = metadata.Topics
+		for _, topic := range metadata.Topics {
+			if _, ok := partitions[topic]; ok {
+				continue
+			}
+			count, err := g.broker.PartitionCount(topic)
+			if err != nil {
+				log.Warningf("cannot assign partitions of %s: %s", topic, err)
+			}
+			partitions[topic] = count
+		}
+	}
+
+	assignment := g.conf.Assignor.Assign(subscriptions, partitions)
+	assignments := make([]proto.GroupAssignment, 0, len(members))
+	for _, member := range members {
+		memberAssignment := &proto.GroupMemberAssignment{}
+		topics := make([]string, 0, len(assignment[member.MemberID]))
+		for topic := range assignment[member.MemberID] {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		for _, topic := range topics {
+			memberAssignment.Topics = append(memberAssignment.Topics, proto.GroupMemberAssignmentTopic{
+				Name:       topic,
+				Partitions: assignment[member.MemberID][topic],
+			})
+		}
+		b, err := memberAssignment.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, proto.GroupAssignment{
+			MemberID:   member.MemberID,
+			Assignment: b,
+		})
+	}
+	return assignments, nil
+}
+
+// consume fetches the messages of a partition from its committed offset and
+// passes them to Consume until the generation ends.
+func (g *ConsumerGroup) consume(gen *groupGeneration, tp topicPartition) {
+	retry := &backoff.Backoff{Min: g.conf.Consumer.RetryErrWait, Jitter: true}
+	wait := func(d time.Duration) bool {
+		select {
+		case <-gen.stop:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	var c *consumer
+	for c == nil {
+		offset, _, err := gen.coordinator.Offset(tp.topic, tp.partition)
+		if err == nil {
+			conf := g.conf.Consumer
+			conf.Topic = tp.topic
+			conf.Partition = tp.partition
+			// only wait for a single fetch, to notice the end of the
+			// generation in time
+			conf.RetryLimit = 0
+			if offset >= 0 {
+				conf.StartOffset = offset
+			}
+			c, err = g.broker.consumer(conf)
+		}
+		if err != nil {
+			log.Errorf("cannot consume %s of group %s: %s", tp, g.groupID, err)
+			if err == ErrClosed || !wait(retry.Duration()) {
+				return
+			}
+		}
+	}
+
+	for {
+		batch, err := c.ConsumeBatch()
+		switch err {
+		case nil:
+			select {
+			case gen.batches <- batch:
+				continue
+			case <-gen.stop:
+				return
+			}
+		case ErrNoData:
+			if !wait(g.conf.Consumer.RetryWait) {
+				return
+			}
+		case ErrClosed:
+			return
+		default:
+			log.Errorf("cannot consume %s of group %s: %s", tp, g.groupID, err)
+			if !wait(retry.Duration()) {
+				return
+			}
+		}
+	}
+}
+
+// leave leaves the group, so that the coordinator rebalances it right away
+// instead of once the session timed out.
+func (g *ConsumerGroup) leave() {
+	if g.memberID == "" {
+		return
+	}
+	conn, err := g.broker.coordinatorConnection(g.groupID)
+	if err != nil {
+		log.Warningf("cannot leave group %s: %s", g.groupID, err)
+		return
+	}
+	defer func(lconn *connection) { go g.broker.conns.Idle(lconn) }(conn)
+
+	var resp *proto.LeaveGroupResp
+	err = measureRequest(g.broker.metrics, proto.LeaveGroupReqKind, conn, func() (err error) {
+		resp, err = conn.LeaveGroup(&proto.LeaveGroupReq{
+			ClientID:      g.broker.conf.ClientID,
+			ConsumerGroup: g.groupID,
+			MemberID:      g.memberID,
+		})
+		return err
+	})
+	if err == nil {
+		err = resp.Err
+	}
+	if err != nil {
+		log.Warningf("cannot leave group %s: %s", g.groupID, err)
+	}
+}
@@ -0,0 +1,238 @@
+package kafka
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&ConsumerGroupSuite{})
+
+type ConsumerGroupSuite struct{}
+
+func (s *ConsumerGroupSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *ConsumerGroupSuite) TestRangeAssignor(c *C) {
+	assignment := RangeAssignor{}.Assign(
+		map[string][]string{
+			"b": {"foo", "bar"},
+			"a": {"foo"},
+			"c": {"foo", "bar"},
+		},
+		map[string]int32{"foo": 5, "bar": 2},
+	)
+	c.Assert(assignment, DeepEquals, map[string]map[string][]int32{
+		"a": {"foo": {0, 1}},
+		"b": {"foo": {2, 3}, "bar": {0}},
+		"c": {"foo": {4}, "bar": {1}},
+	})
+}
+
+func (s *ConsumerGroupSuite) TestRoundRobinAssignor(c *C) {
+	assignment := RoundRobinAssignor{}.Assign(
+		map[string][]string{
+			"b": {"foo", "bar"},
+			"a": {"foo"},
+			"c": {"foo", "bar"},
+		},
+		map[string]int32{"foo": 4, "bar": 3},
+	)
+	// bar:0-2 then foo:0-3, skipping a for bar
+	c.Assert(assignment, DeepEquals, map[string]map[string][]int32{
+		"a": {"foo": {1}},
+		"b": {"bar": {0, 2}, "foo": {2}},
+		"c": {"bar": {1}, "foo": {0, 3}},
+	})
+}
+
+func (s *ConsumerGroupSuite) TestInvalidConf(c *C) {
+	conf := NewConsumerGroupConf()
+	c.Assert(conf.Validate(), IsNil)
+
+	conf.HeartbeatInterval = conf.SessionTimeout
+	c.Assert(conf.Validate(), ErrorMatches, "HeartbeatInterval 10s must be shorter than SessionTimeout 10s")
+
+	conf = NewConsumerGroupConf()
+	conf.Consumer.MaxFetchSize = 0
+	c.Assert(conf.Validate(), ErrorMatches, "invalid consumer configuration: MaxFetchSize 0 must be positive")
+}
+
+func (s *ConsumerGroupSuite) TestRebalanceErrorCodes(c *C) {
+	// heartbeat responses as sent by a broker, with the error code last
+	heartbeat := func(code byte) error {
+		resp, err := proto.ReadHeartbeatResp(bytes.NewReader([]byte{0, 0, 0, 6, 0, 0, 0, 1, 0, code}))
+		c.Assert(err, IsNil)
+		return resp.Err
+	}
+
+	// REBALANCE_IN_PROGRESS
+	c.Assert(isRebalanceError(heartbeat(27)), Equals, true)
+	// GROUP_AUTHORIZATION_FAILED does not make the member rejoin
+	c.Assert(heartbeat(30), Equals, proto.ErrGroupAuthorizationFailed)
+	c.Assert(isRebalanceError(heartbeat(30)), Equals, false)
+}
+
+// newTestConsumerGroup joins the group with a broker of its own.
+func newTestConsumerGroup(c *C, srv *Server, clientID string) (*Broker, *ConsumerGroup) {
+	broker, err := NewBroker("test-cluster-group", []string{srv.Address()}, NewBrokerConf(clientID))
+	c.Assert(err, IsNil)
+
+	conf := NewConsumerGroupConf()
+	conf.SessionTimeout = time.Second
+	conf.HeartbeatInterval = 20 * time.Millisecond
+	conf.AutoCommitInterval = 0
+	conf.ConsumeTimeout = 300 * time.Millisecond
+	group, err := broker.ConsumerGroup("group", []string{"test"}, conf)
+	c.Assert(err, IsNil)
+	return broker, group
+}
+
+// waitPartitions waits for the group to be assigned the given partitions.
+func waitPartitions(c *C, group *ConsumerGroup, expected map[string][]int32) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if reflect.DeepEqual(group.Partitions(), expected) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("assigned %v, expected %v", group.Partitions(), expected)
+}
+
+// consumeAll consumes from the group until there are no more messages,
+// counting every message by partition and offset.
+func consumeAll(c *C, group *ConsumerGroup, seen map[string]int, n int) {
+	for i := 0; n < 0 || i < n; i++ {
+		msg, err := group.Consume()
+		if err == ErrNoData && n < 0 {
+			return
+		}
+		c.Assert(err, IsNil)
+		c.Assert(string(msg.Value), Equals, fmt.Sprintf("%d-%d", msg.Partition, msg.Offset))
+		seen[string(msg.Value)]++
+	}
+}
+
+// addGroupMessages adds n messages to every partition of the topic.
+func addGroupMessages(srv *Server, partitions int, n int) {
+	for p := 0; p < partitions; p++ {
+		msgs, _ := srv.partitionMessages("test", int32(p))
+		first := len(msgs)
+		for i := 0; i < n; i++ {
+			srv.AddMessages("test", int32(p), &proto.Message{Value: []byte(fmt.Sprintf("%d-%d", p, first+i))})
+		}
+	}
+}
+
+func (s *ConsumerGroupSuite) TestRebalance(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 4)
+	addGroupMessages(srv, 4, 20)
+
+	seen := make(map[string]int)
+	brokerA, a := newTestConsumerGroup(c, srv, "a")
+	defer brokerA.Close()
+	c.Assert(a.Partitions(), DeepEquals, map[string][]int32{"test": {0, 1, 2, 3}})
+	consumeAll(c, a, seen, 10)
+
+	// the second member joins once the first one rejoined
+	brokerB, b := newTestConsumerGroup(c, srv, "b")
+	defer brokerB.Close()
+	c.Assert(b.Partitions(), DeepEquals, map[string][]int32{"test": {2, 3}})
+	waitPartitions(c, a, map[string][]int32{"test": {0, 1}})
+
+	consumeAll(c, a, seen, -1)
+	consumeAll(c, b, seen, -1)
+	c.Assert(a.Commit(), IsNil)
+	c.Assert(b.Commit(), IsNil)
+	c.Assert(seen, HasLen, 80)
+	for value, count := range seen {
+		c.Assert(count, Equals, 1, Commentf("message %s", value))
+	}
+	for p := int32(0); p < 4; p++ {
+		offset, _, ok := srv.CommittedOffset("group", "test", p)
+		c.Assert(ok, Equals, true)
+		c.Assert(offset, Equals, int64(20))
+	}
+
+	// once the first member left, the second one takes over its partitions
+	a.Close()
+	_, err := a.Consume()
+	c.Assert(err, Equals, ErrClosed)
+	addGroupMessages(srv, 4, 5)
+	waitPartitions(c, b, map[string][]int32{"test": {0, 1, 2, 3}})
+	consumeAll(c, b, seen, -1)
+	b.Close()
+
+	c.Assert(seen, HasLen, 100)
+	for value, count := range seen {
+		c.Assert(count, Equals, 1, Commentf("message %s", value))
+	}
+	for p := int32(0); p < 4; p++ {
+		offset, _, ok := srv.CommittedOffset("group", "test", p)
+		c.Assert(ok, Equals, true)
+		c.Assert(offset, Equals, int64(25))
+	}
+}
+
+func (s *ConsumerGroupSuite) TestRebalanceResumesFromReturnedMessages(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 2)
+	addGroupMessages(srv, 2, 50)
+
+	seen := make(map[string]int)
+	brokerA, a := newTestConsumerGroup(c, srv, "a")
+	defer brokerA.Close()
+
+	// the first member has fetched more messages than it returned when
+	// the group rebalances
+	consumeAll(c, a, seen, 3)
+	brokerB, b := newTestConsumerGroup(c, srv, "b")
+	defer brokerB.Close()
+
+	consumeAll(c, a, seen, -1)
+	consumeAll(c, b, seen, -1)
+	a.Close()
+	b.Close()
+
+	c.Assert(seen, HasLen, 100)
+	for value, count := range seen {
+		c.Assert(count, Equals, 1, Commentf("message %s", value))
+	}
+}
+
+func (s *ConsumerGroupSuite) TestStaleGenerationCannotCommit(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+	addGroupMessages(srv, 1, 5)
+
+	broker, group := newTestConsumerGroup(c, srv, "a")
+	defer broker.Close()
+	defer group.Close()
+	consumeAll(c, group, make(map[string]int), 5)
+
+	coordinatorConf := NewOffsetCoordinatorConf("group")
+	coordinatorConf.GenerationID = 0
+	coordinatorConf.MemberID = "a-1"
+	coordinator, err := broker.OffsetCoordinator(coordinatorConf)
+	c.Assert(err, IsNil)
+	c.Assert(coordinator.Commit("test", 0, 1), Equals, proto.ErrIllegalGeneration)
+
+	c.Assert(group.Commit(), IsNil)
+	offset, _, ok := srv.CommittedOffset("group", "test", 0)
+	c.Assert(ok, Equals, true)
+	c.Assert(offset, Equals, int64(5))
+}
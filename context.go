@@ -0,0 +1,146 @@
+//go:build go1.7
+// +build go1.7
+
+package kafka
+
+import (
+	"context"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var (
+	_ ContextConsumer          = &consumer{}
+	_ ContextProducer          = &producer{}
+	_ ContextOffsetCoordinator = &offsetCoordinator{}
+)
+
+// ContextConsumer is the interface that wraps the ConsumeContext method.
+//
+// ConsumeContext works like Consume, but gives up once the context is done,
+// returning a *CanceledError. Waiting between retries is cut short and a
+// fetch in flight is abandoned by closing its connection.
+type ContextConsumer interface {
+	ConsumeContext(ctx context.Context) (*proto.Message, error)
+}
+
+// ContextProducer is the interface that wraps the ProduceContext method.
+//
+// ProduceContext works like Produce, but gives up once the context is done,
+// returning a *CanceledError. If the context has a deadline, the time the
+// broker waits for replicas is shortened like ProduceBefore does. Messages
+// of a produce request that was abandoned may still have been written.
+type ContextProducer interface {
+	ProduceContext(ctx context.Context, topic string, partition int32, messages ...*proto.Message) (int64, error)
+}
+
+// ContextOffsetCoordinator is the interface that wraps the CommitContext and
+// OffsetContext methods, which work like Commit and Offset, but give up once
+// the context is done, returning a *CanceledError.
+type ContextOffsetCoordinator interface {
+	CommitContext(ctx context.Context, topic string, partition int32, offset int64) error
+	OffsetContext(ctx context.Context, topic string, partition int32) (offset int64, metadata string, err error)
+}
+
+// contextError returns err, or a *CanceledError if the operation gave up
+// because the context is done.
+func contextError(ctx context.Context, err error) error {
+	if err == errCanceled {
+		return &CanceledError{Err: ctx.Err()}
+	}
+	return err
+}
+
+// doneError returns a *CanceledError if the context is done already.
+func doneError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &CanceledError{Err: err}
+	}
+	return nil
+}
+
+// MetadataContext works like Metadata, but gives up once the context is done,
+// returning a *CanceledError.
+func (b *Broker) MetadataContext(ctx context.Context) (*proto.MetadataResp, error) {
+	if err := doneError(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := b.metadata(ctx.Done())
+	return resp, contextError(ctx, err)
+}
+
+// FetchContext works like Fetch, but gives up once the context is done,
+// returning a *CanceledError.
+func (b *Broker) FetchContext(ctx context.Context, req *proto.FetchReq) (*proto.FetchResp, error) {
+	if err := doneError(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := b.fetch(req, ctx.Done())
+	return resp, contextError(ctx, err)
+}
+
+func (c *consumer) ConsumeContext(ctx context.Context) (*proto.Message, error) {
+	if err := doneError(ctx); err != nil {
+		return nil, err
+	}
+	msg, err := c.consumeOne(ctx.Done())
+	return msg, contextError(ctx, err)
+}
+
+func (p *producer) ProduceContext(ctx context.Context,
+	topic string, partition int32, messages ...*proto.Message) (int64, error) {
+
+	if err := doneError(ctx); err != nil {
+		return 0, err
+	}
+	deadline, _ := ctx.Deadline()
+	res, err := p.produceBefore(deadline, ctx.Done(), topic, partition, messages...)
+	if err == ErrDeadlineExceeded {
+		// the only deadline is the one of the context
+		return 0, &CanceledError{Err: context.DeadlineExceeded}
+	}
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+	return res.Offset, nil
+}
+
+func (c *offsetCoordinator) CommitContext(ctx context.Context,
+	topic string, partition int32, offset int64) (err error) {
+
+	if err := doneError(ctx); err != nil {
+		return err
+	}
+	if err := c.broker.track(); err != nil {
+		return err
+	}
+	defer func() { err = c.broker.untrack(err) }()
+
+	return contextError(ctx, c.commit(topic, partition, offset, "", ctx.Done()))
+}
+
+func (c *offsetCoordinator) OffsetContext(ctx context.Context,
+	topic string, partition int32) (int64, string, error) {
+
+	if err := doneError(ctx); err != nil {
+		return 0, "", err
+	}
+	offset, metadata, err := c.offset(topic, partition, ctx.Done())
+	return offset, metadata, contextError(ctx, err)
+}
+
+// ConsumeContext works like Consume, but gives up once the context is done,
+// returning a *CanceledError. The merged consumers keep being read.
+func (p *Mx) ConsumeContext(ctx context.Context) (*proto.Message, error) {
+	if err := doneError(ctx); err != nil {
+		return nil, err
+	}
+	msg, err := p.consume(ctx.Done())
+	return msg, contextError(ctx, err)
+}
+
+// ConsumeContext works like Consume, but gives up once the context is done,
+// returning a *CanceledError. The partitions keep being consumed.
+func (c *PatternConsumer) ConsumeContext(ctx context.Context) (*proto.Message, error) {
+	return c.mx.ConsumeContext(ctx)
+}
@@ -0,0 +1,259 @@
+//go:build go1.7
+// +build go1.7
+
+package kafka
+
+import (
+	"context"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&ContextSuite{})
+
+type ContextSuite struct{}
+
+func (s *ContextSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// assertCanceled checks that err is a *CanceledError with the given error of
+// the context.
+func assertCanceled(c *C, err error, ctxErr error) {
+	canceledErr, ok := err.(*CanceledError)
+	c.Assert(ok, Equals, true, Commentf("got %#v", err))
+	c.Assert(canceledErr.Err, Equals, ctxErr)
+}
+
+// cancelAfterRequest cancels once the server received another request of the
+// given kind and returns the time it did so.
+func cancelAfterRequest(c *C, srv *Server, kind int16, cancel context.CancelFunc) <-chan time.Time {
+	canceled := make(chan time.Time, 1)
+	received := srv.RequestCount(kind)
+	go func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for srv.RequestCount(kind) == received && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		// leave the request time to be waiting for a response
+		time.Sleep(20 * time.Millisecond)
+		canceled <- time.Now()
+		cancel()
+	}()
+	return canceled
+}
+
+func (s *ContextSuite) TestConsumeContextAbandonsLongPoll(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	broker, err := NewBroker("test-cluster-consume-context", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewConsumerConf("test", 0)
+	conf.StartOffset = StartOffsetOldest
+	conf.RequestTimeout = 10 * time.Second
+	conf.RetryLimit = -1
+	consumer, err := broker.Consumer(conf)
+	c.Assert(err, IsNil)
+
+	// the fetch handler waits for messages for up to RequestTimeout
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := cancelAfterRequest(c, srv, FetchRequest, cancel)
+	_, err = consumer.(ContextConsumer).ConsumeContext(ctx)
+	returned := time.Now()
+	assertCanceled(c, err, context.Canceled)
+	c.Assert(returned.Sub(<-canceled) < 50*time.Millisecond, Equals, true)
+
+	// the consumer keeps working with a new connection
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("first")})
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "first")
+
+	_, err = consumer.(ContextConsumer).ConsumeContext(ctx)
+	assertCanceled(c, err, context.Canceled)
+}
+
+func (s *ContextSuite) TestConsumeContextInterruptsRetryWait(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	broker, err := NewBroker("test-cluster-consume-context-wait", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewConsumerConf("test", 0)
+	conf.StartOffset = StartOffsetOldest
+	conf.RequestTimeout = 0
+	conf.RetryLimit = -1
+	conf.RetryWait = 10 * time.Second
+	consumer, err := broker.Consumer(conf)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = consumer.(ContextConsumer).ConsumeContext(ctx)
+	assertCanceled(c, err, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *ContextSuite) TestProduceContext(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	broker, err := NewBroker("test-cluster-produce-context", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+	producer := broker.Producer(NewProducerConf()).(ContextProducer)
+
+	offset, err := producer.ProduceContext(context.Background(), "test", 0, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(0))
+
+	// nothing is sent with a context that is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = producer.ProduceContext(ctx, "test", 0, &proto.Message{Value: []byte("second")})
+	assertCanceled(c, err, context.Canceled)
+	c.Assert(srv.RequestCount(ProduceRequest), Equals, 1)
+
+	// a request waiting for its response is abandoned
+	srv.SetLatency(ProduceRequest, 10*time.Second)
+	ctx, cancel = context.WithCancel(context.Background())
+	canceled := cancelAfterRequest(c, srv, ProduceRequest, cancel)
+	_, err = producer.ProduceContext(ctx, "test", 0, &proto.Message{Value: []byte("third")})
+	returned := time.Now()
+	assertCanceled(c, err, context.Canceled)
+	c.Assert(returned.Sub(<-canceled) < 50*time.Millisecond, Equals, true)
+}
+
+func (s *ContextSuite) TestOffsetCoordinatorContext(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	broker, err := NewBroker("test-cluster-coordinator-context", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+	coordinator, err := broker.OffsetCoordinator(NewOffsetCoordinatorConf("group"))
+	c.Assert(err, IsNil)
+	ctxCoordinator := coordinator.(ContextOffsetCoordinator)
+
+	c.Assert(ctxCoordinator.CommitContext(context.Background(), "test", 0, 5), IsNil)
+	offset, _, err := ctxCoordinator.OffsetContext(context.Background(), "test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(5))
+
+	srv.SetLatency(OffsetCommitRequest, 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = ctxCoordinator.CommitContext(ctx, "test", 0, 6)
+	assertCanceled(c, err, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+
+	srv.SetLatency(OffsetFetchRequest, 10*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = ctxCoordinator.OffsetContext(ctx, "test", 0)
+	assertCanceled(c, err, context.DeadlineExceeded)
+}
+
+func (s *ContextSuite) TestBrokerContext(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	broker, err := NewBroker("test-cluster-broker-context", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	resp, err := broker.MetadataContext(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics, HasLen, 1)
+
+	req := &proto.FetchReq{
+		MaxWaitTime: 10 * time.Second,
+		MinBytes:    1,
+		Topics: []proto.FetchReqTopic{
+			{
+				Name:       "test",
+				Partitions: []proto.FetchReqPartition{{ID: 0, MaxBytes: 1024}},
+			},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := cancelAfterRequest(c, srv, FetchRequest, cancel)
+	_, err = broker.FetchContext(ctx, req)
+	returned := time.Now()
+	assertCanceled(c, err, context.Canceled)
+	c.Assert(returned.Sub(<-canceled) < 50*time.Millisecond, Equals, true)
+
+	srv.SetLatency(MetadataRequest, 10*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = broker.MetadataContext(ctx)
+	assertCanceled(c, err, context.DeadlineExceeded)
+}
+
+func (s *ContextSuite) TestMxConsumeContext(c *C) {
+	for _, roundRobin := range []bool{false, true} {
+		conf := NewMxConf()
+		conf.RoundRobin = roundRobin
+		consumer := newChanConsumer()
+		mx := NewMx(conf, consumer)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := mx.ConsumeContext(ctx)
+		cancel()
+		assertCanceled(c, err, context.DeadlineExceeded)
+
+		// the consumers are still read
+		consumer.results <- consumeResult{msg: &proto.Message{Value: []byte("1")}}
+		msg, err := mx.ConsumeContext(context.Background())
+		c.Assert(err, IsNil)
+		c.Assert(string(msg.Value), Equals, "1")
+		mx.Close()
+	}
+}
+
+func (s *ContextSuite) TestPatternConsumerContext(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("orders", 1)
+
+	broker, err := NewBroker("test-cluster-context", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewPatternConsumerConf()
+	conf.Consumer.RetryWait = time.Millisecond
+	consumer, err := broker.PatternConsumer("orders", conf)
+	c.Assert(err, IsNil)
+	defer consumer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err = consumer.ConsumeContext(ctx)
+	cancel()
+	assertCanceled(c, err, context.DeadlineExceeded)
+
+	srv.AddMessages("orders", 0, &proto.Message{Value: []byte("first")})
+	msg, err := consumer.ConsumeContext(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "first")
+}
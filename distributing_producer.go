@@ -35,11 +35,16 @@ type PartitionCountSource interface {
 // PartitionFetchTimeout: optional. Controls how long Distribute will wait
 // to get a partition in the case where they are all unavailable due to
 // error averse backoff.
+// PartitionCounts: optional. Partition counts of topics known in advance,
+// used instead of asking the PartitionCountSource. A topic's count is
+// dropped, and the source used from then on, once a produce to the topic
+// fails with an unknown topic or partition error.
 type errorAverseRRProducerConf struct {
 	PartitionCountSource  PartitionCountSource
 	Producer              Producer
 	ErrorAverseBackoff    *backoff.Backoff
 	PartitionFetchTimeout time.Duration
+	PartitionCounts       map[string]int32
 }
 
 func NewErrorAverseRRProducerConf() *errorAverseRRProducerConf {
@@ -53,6 +58,7 @@ func NewErrorAverseRRProducerConf() *errorAverseRRProducerConf {
 			Jitter: true,
 		},
 		PartitionFetchTimeout: time.Duration(10 * time.Second),
+		PartitionCounts:       nil,
 	}
 }
 
@@ -63,6 +69,11 @@ type errorAverseRRProducer struct {
 	partitionCountSource PartitionCountSource
 	producer             Producer
 	partitionManager     *partitionManager
+
+	// mu protects partitionCounts, the counts given in the configuration
+	// that were not found to be wrong yet.
+	mu              *sync.Mutex
+	partitionCounts map[string]int32
 }
 
 type NoPartitionsAvailable struct{}
@@ -72,9 +83,15 @@ func (NoPartitionsAvailable) Error() string {
 }
 
 func NewErrorAverseRRProducer(conf *errorAverseRRProducerConf) DistributingProducer {
+	partitionCounts := make(map[string]int32, len(conf.PartitionCounts))
+	for topic, count := range conf.PartitionCounts {
+		partitionCounts[topic] = count
+	}
 	return &errorAverseRRProducer{
 		partitionCountSource: conf.PartitionCountSource,
 		producer:             conf.Producer,
+		mu:                   &sync.Mutex{},
+		partitionCounts:      partitionCounts,
 		partitionManager: &partitionManager{
 			availablePartitions: make(map[string]chan *partitionData),
 			lock:                &sync.RWMutex{},
@@ -86,7 +103,9 @@ func NewErrorAverseRRProducer(conf *errorAverseRRProducerConf) DistributingProdu
 func (d *errorAverseRRProducer) Distribute(topic string, messages ...*proto.Message) (
 	partition int32, offset int64, err error) {
 
-	if count, err := d.partitionCountSource.PartitionCount(topic); err == nil {
+	if count, ok := d.fixedPartitionCount(topic); ok {
+		d.partitionManager.SetPartitionCount(topic, count)
+	} else if count, err := d.partitionCountSource.PartitionCount(topic); err == nil {
 		d.partitionManager.SetPartitionCount(topic, count)
 	} else {
 		// This topic doesn't exist, so we pretend it has one partition for now.
@@ -102,6 +121,9 @@ func (d *errorAverseRRProducer) Distribute(topic string, messages ...*proto.Mess
 	if offset, err := d.producer.Produce(topic, partitionData.Partition, messages...); err != nil {
 		log.Errorf("Failed to produce [%s:%d]: %s", topic, partitionData.Partition, err)
 		partitionData.Failure()
+		if err == proto.ErrUnknownTopicOrPartition {
+			d.dropFixedPartitionCount(topic)
+		}
 		return 0, 0, err
 	} else {
 		partitionData.Success()
@@ -109,6 +131,28 @@ func (d *errorAverseRRProducer) Distribute(topic string, messages ...*proto.Mess
 	}
 }
 
+// fixedPartitionCount returns the configured partition count of the topic, if
+// there is one.
+func (d *errorAverseRRProducer) fixedPartitionCount(topic string) (int32, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count, ok := d.partitionCounts[topic]
+	return count, ok
+}
+
+// dropFixedPartitionCount forgets the configured partition count of the topic,
+// so that the PartitionCountSource is used for it from now on.
+func (d *errorAverseRRProducer) dropFixedPartitionCount(topic string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.partitionCounts[topic]; ok {
+		log.Warningf("Configured partition count of %s is wrong, using metadata", topic)
+		delete(d.partitionCounts, topic)
+	}
+}
+
 // partitionData wraps a retry tracker and the partitionManager's chan for
 // a particular partition. We have a pointer to the chan instead of the
 // partitionManager because the partitionManager will throw away and rebuild
@@ -251,13 +295,133 @@ func (p *partitionManager) GetPartition(topic string) (*partitionData, error) {
 		select {
 		case partitionData, ok := <-availablePartitions:
 			if !ok {
-				return nil, fmt.Errorf(fmt.Sprintf("Programmer error in GetPartition(%s)! "+
-					"This should never happen.", topic))
+				return nil, fmt.Errorf("Programmer error in GetPartition(%s)! "+
+					"This should never happen.", topic)
 			}
 			defer partitionData.reEnqueue()
 			return partitionData, nil
 		case <-time.After(p.getTimeout):
-			return nil, fmt.Errorf(fmt.Sprintf("Timeout waiting for partition for %s.", topic))
+			return nil, fmt.Errorf("Timeout waiting for partition for %s.", topic)
 		}
 	}
 }
+
+// StickyProducerConf is the configuration of the producer returned by
+// NewStickyProducer.
+type StickyProducerConf struct {
+	// PartitionCountSource tells how many partitions a topic has. Required.
+	PartitionCountSource PartitionCountSource
+
+	// Producer writes the messages. Required.
+	Producer Producer
+
+	// RotateMessages is the number of messages written to a partition of a
+	// topic before moving on to the next one.
+	//
+	// Defaults to 1000.
+	RotateMessages int
+
+	// RotateInterval is the longest time messages are written to the same
+	// partition of a topic before moving on to the next one.
+	//
+	// Defaults to 1s.
+	RotateInterval time.Duration
+}
+
+// NewStickyProducerConf returns the default configuration, without partition
+// count source and producer.
+func NewStickyProducerConf() StickyProducerConf {
+	return StickyProducerConf{
+		PartitionCountSource: nil,
+		Producer:             nil,
+		RotateMessages:       1000,
+		RotateInterval:       time.Second,
+	}
+}
+
+// stickyProducer writes all messages of a topic to one partition until
+// RotateMessages were written or RotateInterval passed, then moves on to the
+// next partition. Compared to writing every call to the next partition, this
+// gives larger batches while still spreading the messages evenly over time.
+type stickyProducer struct {
+	conf StickyProducerConf
+
+	// mu protects topics.
+	mu     *sync.Mutex
+	topics map[string]*stickyPartition
+}
+
+// stickyPartition is the partition currently written to for a topic.
+type stickyPartition struct {
+	count     int32 // number of partitions of the topic
+	partition int32
+	written   int
+	since     time.Time
+}
+
+// NewStickyProducer returns a DistributingProducer that sticks to a partition
+// of a topic for a while before rotating to the next one. Message keys are not
+// used to choose the partition.
+func NewStickyProducer(conf StickyProducerConf) (DistributingProducer, error) {
+	if conf.PartitionCountSource == nil {
+		return nil, fmt.Errorf("StickyProducerConf.PartitionCountSource is required")
+	}
+	if conf.Producer == nil {
+		return nil, fmt.Errorf("StickyProducerConf.Producer is required")
+	}
+	return &stickyProducer{
+		conf:   conf,
+		mu:     &sync.Mutex{},
+		topics: make(map[string]*stickyPartition),
+	}, nil
+}
+
+func (d *stickyProducer) Distribute(topic string, messages ...*proto.Message) (
+	partition int32, offset int64, err error) {
+
+	count, err := d.conf.PartitionCountSource.PartitionCount(topic)
+	if err != nil || count < 1 {
+		// This topic doesn't exist, so we pretend it has one partition for now.
+		count = 1
+	}
+
+	partition = d.partition(topic, count, len(messages))
+	offset, err = d.conf.Producer.Produce(topic, partition, messages...)
+	if err != nil {
+		log.Errorf("Failed to produce [%s:%d]: %s", topic, partition, err)
+		d.rotate(topic, partition)
+		return 0, 0, err
+	}
+	return partition, offset, nil
+}
+
+// partition returns the partition to write the given number of messages to,
+// rotating to the next partition first if it's time to.
+func (d *stickyProducer) partition(topic string, count int32, messages int) int32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	sp := d.topics[topic]
+	switch {
+	case sp == nil || sp.count != count:
+		sp = &stickyPartition{count: count, partition: int32(rndIntn(int(count))), since: now}
+		d.topics[topic] = sp
+	case sp.written >= d.conf.RotateMessages || now.Sub(sp.since) >= d.conf.RotateInterval:
+		sp.partition = (sp.partition + 1) % count
+		sp.written = 0
+		sp.since = now
+	}
+	sp.written += messages
+	return sp.partition
+}
+
+// rotate makes the next call move on from the given partition, which failed.
+func (d *stickyProducer) rotate(topic string, partition int32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if sp := d.topics[topic]; sp != nil && sp.partition == partition {
+		sp.written = d.conf.RotateMessages
+	}
+}
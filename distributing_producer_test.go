@@ -130,6 +130,59 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerBasics(c *C) {
 	}
 }
 
+// missingPartitionProducer fails writes to partitions at or above count
+// like a broker that does not have them.
+type missingPartitionProducer struct {
+	count    int32
+	produced []int32
+}
+
+func (p *missingPartitionProducer) Produce(topic string, part int32, msgs ...*proto.Message) (int64, error) {
+	if part >= p.count {
+		return 0, proto.ErrUnknownTopicOrPartition
+	}
+	p.produced = append(p.produced, part)
+	return 0, nil
+}
+
+func (s *DistProducerSuite) TestErrorAverseRRProducerPartitionCounts(c *C) {
+	sourceCalls := 0
+	prod := &missingPartitionProducer{count: 1}
+	conf := NewErrorAverseRRProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) {
+			sourceCalls++
+			return 1, nil
+		},
+	}
+	conf.Producer = prod
+	conf.PartitionFetchTimeout = time.Second
+	conf.PartitionCounts = map[string]int32{"test-topic": 2}
+	p := NewErrorAverseRRProducer(conf)
+
+	// the configured count is used without asking the source
+	partition, _, err := p.Distribute("test-topic", &proto.Message{})
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(0))
+	c.Assert(sourceCalls, Equals, 0)
+
+	// until a partition turns out not to exist
+	_, _, err = p.Distribute("test-topic", &proto.Message{})
+	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(sourceCalls, Equals, 0)
+
+	partition, _, err = p.Distribute("test-topic", &proto.Message{})
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(0))
+	c.Assert(sourceCalls, Equals, 1)
+	c.Assert(prod.produced, DeepEquals, []int32{0, 0})
+
+	// other topics are not affected
+	_, _, err = p.Distribute("other-topic", &proto.Message{})
+	c.Assert(err, IsNil)
+	c.Assert(sourceCalls, Equals, 2)
+}
+
 func (s *DistProducerSuite) TestErrorAverseRRProducerDeadPartition(c *C) {
 	rec := newRecordingProducer(map[int32]struct{}{
 		1: struct{}{},
@@ -445,3 +498,80 @@ func (s *DistProducerSuite) TestErrorAverseRRProducerIncreasePartitionCount(c *C
 		c.Errorf("Wrong number of disabledWrites. Expected % d but got %d", 0, rec.disabledWrites)
 	}
 }
+
+func (s *DistProducerSuite) TestStickyProducerRotatesEvenly(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewStickyProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 4, nil },
+	}
+	conf.Producer = rec
+	conf.RotateMessages = 10
+	conf.RotateInterval = time.Hour
+	p, err := NewStickyProducer(conf)
+	c.Assert(err, IsNil)
+
+	var partitions []int32
+	for i := 0; i < 1000; i++ {
+		partition, _, err := p.Distribute("test", &proto.Message{})
+		c.Assert(err, IsNil)
+		partitions = append(partitions, partition)
+	}
+
+	// runs of ten messages to the same partition, each to the next one
+	for i := 0; i < len(partitions); i += 10 {
+		for j := i; j < i+10; j++ {
+			c.Assert(partitions[j], Equals, partitions[i])
+		}
+		if i > 0 {
+			c.Assert(partitions[i], Equals, (partitions[i-1]+1)%4)
+		}
+	}
+	for partition := int32(0); partition < 4; partition++ {
+		c.Assert(rec.batches[partition], HasLen, 250)
+	}
+}
+
+func (s *DistProducerSuite) TestStickyProducerRotatesOverTime(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewStickyProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 2, nil },
+	}
+	conf.Producer = rec
+	conf.RotateInterval = 20 * time.Millisecond
+	p, err := NewStickyProducer(conf)
+	c.Assert(err, IsNil)
+
+	first, _, err := p.Distribute("test", &proto.Message{})
+	c.Assert(err, IsNil)
+	partition, _, err := p.Distribute("test", &proto.Message{})
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, first)
+
+	time.Sleep(30 * time.Millisecond)
+	partition, _, err = p.Distribute("test", &proto.Message{})
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, 1-first)
+}
+
+func (s *DistProducerSuite) TestStickyProducerRotatesOnFailure(c *C) {
+	prod := &missingPartitionProducer{count: 1}
+	conf := NewStickyProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 2, nil },
+	}
+	conf.Producer = prod
+	p, err := NewStickyProducer(conf)
+	c.Assert(err, IsNil)
+
+	// whichever partition is picked first, partition 0 is used after at
+	// most one failure
+	for i := 0; i < 3; i++ {
+		if partition, _, err := p.Distribute("test", &proto.Message{}); err == nil {
+			c.Assert(partition, Equals, int32(0))
+		} else {
+			c.Assert(i, Equals, 0)
+		}
+	}
+}
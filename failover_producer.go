@@ -0,0 +1,227 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// FailoverProducerConf is the configuration of a FailoverProducer.
+type FailoverProducerConf struct {
+	// Primary is the broker of the cluster that is written to while it is
+	// reachable. Required.
+	Primary *Broker
+
+	// Secondary is the broker of the cluster that is written to while the
+	// primary cluster is unreachable. Required.
+	Secondary *Broker
+
+	// ProducerConf configures the producers of both brokers.
+	ProducerConf ProducerConf
+
+	// FailoverAfter is how long every write to the primary cluster has to
+	// fail before writes go to the secondary cluster. Errors reported by the
+	// cluster itself, such as an unknown topic, don't count since the
+	// cluster is reachable; any other error does.
+	//
+	// Defaults to 30s.
+	FailoverAfter time.Duration
+
+	// FailbackInterval is how often the primary cluster is checked while
+	// writes go to the secondary cluster. Writes go back to the primary
+	// cluster as soon as its metadata can be fetched again.
+	//
+	// Defaults to 10s.
+	FailbackInterval time.Duration
+
+	// OnFailover, if set, is called after writes switched to the secondary
+	// cluster, with the error of the last failed write to the primary.
+	OnFailover func(err error)
+
+	// OnFailback, if set, is called after writes switched back to the
+	// primary cluster.
+	OnFailback func()
+}
+
+// NewFailoverProducerConf returns the default configuration.
+func NewFailoverProducerConf() FailoverProducerConf {
+	return FailoverProducerConf{
+		ProducerConf:     NewProducerConf(),
+		FailoverAfter:    30 * time.Second,
+		FailbackInterval: 10 * time.Second,
+	}
+}
+
+// FailoverProducer writes to a primary cluster and switches to a secondary
+// cluster while the primary can't be reached, for active-passive setups.
+// Messages written to the secondary cluster are not copied back, and the
+// offsets returned by Produce are those of whichever cluster was written to.
+type FailoverProducer struct {
+	conf      FailoverProducerConf
+	primary   Producer
+	secondary Producer
+	probe     func() error // checks whether the primary cluster is reachable
+
+	// mu protects the following.
+	mu          *sync.Mutex
+	failingFrom time.Time // first failure of the current streak, zero if none
+	failedOver  bool
+	closed      bool
+	stop        chan struct{} // closed to stop probing the primary cluster
+}
+
+var _ Producer = &FailoverProducer{}
+
+// NewFailoverProducer returns a producer writing to the primary cluster.
+func NewFailoverProducer(conf FailoverProducerConf) (*FailoverProducer, error) {
+	if conf.Primary == nil {
+		return nil, fmt.Errorf("FailoverProducerConf.Primary is required")
+	}
+	if conf.Secondary == nil {
+		return nil, fmt.Errorf("FailoverProducerConf.Secondary is required")
+	}
+	if conf.FailbackInterval <= 0 {
+		return nil, fmt.Errorf("invalid failback interval %s", conf.FailbackInterval)
+	}
+	if err := conf.ProducerConf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid producer configuration: %s", err)
+	}
+	probe := func() error {
+		_, err := conf.Primary.Metadata()
+		return err
+	}
+	return newFailoverProducer(conf,
+		conf.Primary.Producer(conf.ProducerConf),
+		conf.Secondary.Producer(conf.ProducerConf),
+		probe), nil
+}
+
+func newFailoverProducer(
+	conf FailoverProducerConf, primary, secondary Producer, probe func() error) *FailoverProducer {
+
+	return &FailoverProducer{
+		conf:      conf,
+		primary:   primary,
+		secondary: secondary,
+		probe:     probe,
+		mu:        &sync.Mutex{},
+	}
+}
+
+// Produce writes the messages to the currently active cluster. If this write
+// makes the producer fail over, the messages are written to the secondary
+// cluster right away.
+func (p *FailoverProducer) Produce(topic string, partition int32, messages ...*proto.Message) (int64, error) {
+	if p.FailedOver() {
+		return p.secondary.Produce(topic, partition, messages...)
+	}
+
+	offset, err := p.primary.Produce(topic, partition, messages...)
+	if !isUnreachable(err) {
+		p.mu.Lock()
+		p.failingFrom = time.Time{}
+		p.mu.Unlock()
+		return offset, err
+	}
+	if !p.failover(err) {
+		return offset, err
+	}
+	return p.secondary.Produce(topic, partition, messages...)
+}
+
+// FailedOver returns true while writes go to the secondary cluster.
+func (p *FailoverProducer) FailedOver() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failedOver
+}
+
+// Close stops checking the primary cluster. It doesn't close the brokers.
+func (p *FailoverProducer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// failover records a failed write to the primary cluster and switches to the
+// secondary cluster once the primary was failing for long enough. It returns
+// true if writes go to the secondary cluster.
+func (p *FailoverProducer) failover(err error) bool {
+	p.mu.Lock()
+	if p.failedOver {
+		p.mu.Unlock()
+		return true
+	}
+	now := time.Now()
+	if p.failingFrom.IsZero() {
+		p.failingFrom = now
+	}
+	if p.closed || now.Sub(p.failingFrom) < p.conf.FailoverAfter {
+		p.mu.Unlock()
+		return false
+	}
+	p.failedOver = true
+	p.failingFrom = time.Time{}
+	p.stop = make(chan struct{})
+	go p.watchPrimary(p.stop)
+	p.mu.Unlock()
+
+	log.Warningf("Primary cluster unreachable for %s, failing over: %s", p.conf.FailoverAfter, err)
+	if p.conf.OnFailover != nil {
+		p.conf.OnFailover(err)
+	}
+	return true
+}
+
+// watchPrimary checks the primary cluster every FailbackInterval and switches
+// back to it once it is reachable.
+func (p *FailoverProducer) watchPrimary(stop chan struct{}) {
+	ticker := time.NewTicker(p.conf.FailbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := p.probe(); err != nil {
+			log.Debugf("Primary cluster still unreachable: %s", err)
+			continue
+		}
+
+		p.mu.Lock()
+		if p.stop != stop {
+			// closed while probing
+			p.mu.Unlock()
+			return
+		}
+		p.failedOver = false
+		p.stop = nil
+		p.mu.Unlock()
+
+		log.Infof("Primary cluster reachable again, failing back")
+		if p.conf.OnFailback != nil {
+			p.conf.OnFailback()
+		}
+		return
+	}
+}
+
+// isUnreachable returns true if the error was not reported by the cluster,
+// which means it couldn't be reached. ErrClosed is not a problem of the
+// cluster either.
+func isUnreachable(err error) bool {
+	if err == nil || err == ErrClosed {
+		return false
+	}
+	_, kafkaErr := err.(*proto.KafkaError)
+	return !kafkaErr
+}
@@ -0,0 +1,139 @@
+package kafka
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&FailoverProducerSuite{})
+
+type FailoverProducerSuite struct{}
+
+func (s *FailoverProducerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// switchableProducer fails every produce with err while it is set.
+type switchableProducer struct {
+	mu       sync.Mutex
+	err      error
+	produced int
+}
+
+func (p *switchableProducer) Produce(topic string, partition int32, messages ...*proto.Message) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return 0, p.err
+	}
+	p.produced += len(messages)
+	return int64(p.produced), nil
+}
+
+func (p *switchableProducer) fail(err error) {
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+}
+
+func (p *switchableProducer) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.produced
+}
+
+func (s *FailoverProducerSuite) TestFailoverAndFailback(c *C) {
+	primary := &switchableProducer{}
+	secondary := &switchableProducer{}
+	unreachable := errors.New("cannot connect")
+
+	failovers := make(chan error, 1)
+	failbacks := make(chan struct{}, 1)
+	conf := NewFailoverProducerConf()
+	conf.FailoverAfter = 50 * time.Millisecond
+	conf.FailbackInterval = 10 * time.Millisecond
+	conf.OnFailover = func(err error) { failovers <- err }
+	conf.OnFailback = func() { failbacks <- struct{}{} }
+	probe := func() error {
+		primary.mu.Lock()
+		defer primary.mu.Unlock()
+		return primary.err
+	}
+	p := newFailoverProducer(conf, primary, secondary, probe)
+	defer p.Close()
+
+	msg := &proto.Message{Value: []byte("a")}
+	_, err := p.Produce("test", 0, msg)
+	c.Assert(err, IsNil)
+	c.Assert(primary.count(), Equals, 1)
+
+	// errors reported by the cluster never cause a failover
+	primary.fail(proto.ErrUnknownTopicOrPartition)
+	_, err = p.Produce("test", 0, msg)
+	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	time.Sleep(60 * time.Millisecond)
+	_, err = p.Produce("test", 0, msg)
+	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(p.FailedOver(), Equals, false)
+
+	// unreachable for less than FailoverAfter
+	primary.fail(unreachable)
+	_, err = p.Produce("test", 0, msg)
+	c.Assert(err, Equals, unreachable)
+	c.Assert(p.FailedOver(), Equals, false)
+
+	// the write that crosses FailoverAfter goes to the secondary
+	time.Sleep(60 * time.Millisecond)
+	_, err = p.Produce("test", 0, msg)
+	c.Assert(err, IsNil)
+	c.Assert(p.FailedOver(), Equals, true)
+	c.Assert(<-failovers, Equals, unreachable)
+	_, err = p.Produce("test", 0, msg)
+	c.Assert(err, IsNil)
+	c.Assert(secondary.count(), Equals, 2)
+
+	primary.fail(nil)
+	select {
+	case <-failbacks:
+	case <-time.After(time.Second):
+		c.Fatal("no failback")
+	}
+	c.Assert(p.FailedOver(), Equals, false)
+	_, err = p.Produce("test", 0, msg)
+	c.Assert(err, IsNil)
+	c.Assert(primary.count(), Equals, 2)
+	c.Assert(secondary.count(), Equals, 2)
+}
+
+func (s *FailoverProducerSuite) TestSuccessResetsFailures(c *C) {
+	primary := &switchableProducer{}
+	conf := NewFailoverProducerConf()
+	conf.FailoverAfter = 50 * time.Millisecond
+	p := newFailoverProducer(conf, primary, &switchableProducer{}, func() error { return nil })
+	defer p.Close()
+
+	unreachable := errors.New("cannot connect")
+	primary.fail(unreachable)
+	_, err := p.Produce("test", 0, &proto.Message{})
+	c.Assert(err, Equals, unreachable)
+
+	primary.fail(nil)
+	_, err = p.Produce("test", 0, &proto.Message{})
+	c.Assert(err, IsNil)
+
+	time.Sleep(60 * time.Millisecond)
+	primary.fail(unreachable)
+	_, err = p.Produce("test", 0, &proto.Message{})
+	c.Assert(err, Equals, unreachable)
+	c.Assert(p.FailedOver(), Equals, false)
+}
+
+func (s *FailoverProducerSuite) TestRequiredFields(c *C) {
+	_, err := NewFailoverProducer(NewFailoverProducerConf())
+	c.Assert(err, ErrorMatches, "FailoverProducerConf.Primary is required")
+}
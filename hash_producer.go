@@ -0,0 +1,248 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// ErrPartitionCountChanged is returned by a hash producer with
+// PinPartitionCount set when the partition count of a topic changed since
+// the first message was written to it.
+var ErrPartitionCountChanged = errors.New("partition count changed")
+
+// Partitioner chooses the partition of a message by its key.
+type Partitioner interface {
+	Partition(key []byte, numPartitions int32) (int32, error)
+}
+
+// KeyExtractor derives the key of a message from its value.
+type KeyExtractor func(value []byte) []byte
+
+// Murmur2Partitioner hashes keys with murmur2, like the default partitioner
+// of the Java client, so that both write messages with the same key to the
+// same partition.
+type Murmur2Partitioner struct{}
+
+func (Murmur2Partitioner) Partition(key []byte, numPartitions int32) (int32, error) {
+	if numPartitions < 1 {
+		return 0, fmt.Errorf("invalid partition count %d", numPartitions)
+	}
+	return int32(murmur2(key)&0x7fffffff) % numPartitions, nil
+}
+
+// FNVPartitioner hashes keys with 32 bit FNV-1a.
+type FNVPartitioner struct{}
+
+func (FNVPartitioner) Partition(key []byte, numPartitions int32) (int32, error) {
+	if numPartitions < 1 {
+		return 0, fmt.Errorf("invalid partition count %d", numPartitions)
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int32(h.Sum32()&0x7fffffff) % numPartitions, nil
+}
+
+// murmur2 is the murmur2 hash as implemented by the Java client.
+func murmur2(data []byte) uint32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// HashProducerConf is the configuration of the producer returned by
+// NewHashProducer.
+type HashProducerConf struct {
+	// PartitionCountSource tells how many partitions a topic has. A Broker
+	// reports the counts of its latest metadata, which is refreshed as the
+	// cluster changes. Required.
+	PartitionCountSource PartitionCountSource
+
+	// Producer writes the messages. Required.
+	Producer Producer
+
+	// Partitioner chooses the partition of messages with a key.
+	//
+	// Defaults to Murmur2Partitioner.
+	Partitioner Partitioner
+
+	// KeyExtractor derives the key of every message without one from its
+	// value before the partition is chosen, so that the message is hashed
+	// by that key and stored with it, e.g. for log compaction.
+	//
+	// Defaults to nil, which leaves messages without a key to go round
+	// robin.
+	KeyExtractor KeyExtractor
+
+	// PinPartitionCount makes the producer remember the partition count of
+	// every topic it writes to and fail with ErrPartitionCountChanged once
+	// the count changes, instead of hashing keys with the new count. Keys
+	// moving to other partitions when partitions are added breaks the
+	// ordering of their messages, which this makes explicit.
+	//
+	// Defaults to false.
+	PinPartitionCount bool
+}
+
+// NewHashProducerConf returns the default configuration, without partition
+// count source and producer.
+func NewHashProducerConf() HashProducerConf {
+	return HashProducerConf{
+		PartitionCountSource: nil,
+		Producer:             nil,
+		Partitioner:          Murmur2Partitioner{},
+		KeyExtractor:         nil,
+		PinPartitionCount:    false,
+	}
+}
+
+// hashProducer writes messages with a key to the partition chosen by the key
+// and messages without one round robin.
+type hashProducer struct {
+	conf HashProducerConf
+
+	// mu protects the following.
+	mu     *sync.Mutex
+	next   map[string]int32 // next round robin partition of a topic
+	pinned map[string]int32 // first partition count seen of a topic
+}
+
+// NewHashProducer returns a DistributingProducer that writes all messages
+// with the same key to the same partition of a topic. Messages without a key
+// are spread over the partitions round robin.
+//
+// The messages of a single Distribute call are written together, so their
+// keys must all map to the same partition. Messages without a key go with
+// those that have one.
+func NewHashProducer(conf HashProducerConf) (DistributingProducer, error) {
+	if conf.PartitionCountSource == nil {
+		return nil, fmt.Errorf("HashProducerConf.PartitionCountSource is required")
+	}
+	if conf.Producer == nil {
+		return nil, fmt.Errorf("HashProducerConf.Producer is required")
+	}
+	if conf.Partitioner == nil {
+		conf.Partitioner = Murmur2Partitioner{}
+	}
+	return &hashProducer{
+		conf:   conf,
+		mu:     &sync.Mutex{},
+		next:   make(map[string]int32),
+		pinned: make(map[string]int32),
+	}, nil
+}
+
+func (d *hashProducer) Distribute(topic string, messages ...*proto.Message) (
+	partition int32, offset int64, err error) {
+
+	count, err := d.partitionCount(topic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	partition = -1
+	for _, msg := range messages {
+		if msg.Key == nil && d.conf.KeyExtractor != nil {
+			msg.Key = d.conf.KeyExtractor(msg.Value)
+		}
+		if msg.Key == nil {
+			continue
+		}
+		p, err := d.conf.Partitioner.Partition(msg.Key, count)
+		if err != nil {
+			return 0, 0, err
+		}
+		if partition != -1 && p != partition {
+			return 0, 0, fmt.Errorf("keys of messages map to partitions %d and %d of %s",
+				partition, p, topic)
+		}
+		partition = p
+	}
+	if partition == -1 {
+		partition = d.roundRobin(topic, count)
+	}
+
+	offset, err = d.conf.Producer.Produce(topic, partition, messages...)
+	if err != nil {
+		log.Errorf("Failed to produce [%s:%d]: %s", topic, partition, err)
+		return 0, 0, err
+	}
+	return partition, offset, nil
+}
+
+// partitionCount returns the partition count of the topic to hash keys with.
+func (d *hashProducer) partitionCount(topic string) (int32, error) {
+	count, err := d.conf.PartitionCountSource.PartitionCount(topic)
+	if err != nil {
+		return 0, err
+	}
+	if count < 1 {
+		return 0, fmt.Errorf("invalid partition count %d of %s", count, topic)
+	}
+	if !d.conf.PinPartitionCount {
+		return count, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pinned, ok := d.pinned[topic]
+	if !ok {
+		d.pinned[topic] = count
+		return count, nil
+	}
+	if pinned != count {
+		log.Errorf("Partition count of %s changed from %d to %d", topic, pinned, count)
+		return 0, ErrPartitionCountChanged
+	}
+	return count, nil
+}
+
+// roundRobin returns the next partition of the topic for messages without a
+// key.
+func (d *hashProducer) roundRobin(topic string, count int32) int32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	partition, ok := d.next[topic]
+	if !ok {
+		partition = int32(rndIntn(int(count)))
+	}
+	partition %= count
+	d.next[topic] = partition + 1
+	return partition
+}
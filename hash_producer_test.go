@@ -0,0 +1,208 @@
+package kafka
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&HashProducerSuite{})
+
+type HashProducerSuite struct{}
+
+func (s *HashProducerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// murmur2Keys are keys with their murmur2 hash and partitions as computed by
+// the Java client's Utils.murmur2 and default partitioner.
+var murmur2Keys = []struct {
+	key          string
+	hash         int32
+	partition10  int32
+	partition100 int32
+}{
+	{"21", -973932308, 0, 40},
+	{"foobar", -790332482, 6, 66},
+	{"a-little-bit-long-string", -985981536, 2, 12},
+	{"a-little-bit-longer-string", -1486304829, 9, 19},
+	{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971, 7, 77},
+	{"abc", 479470107, 7, 7},
+}
+
+func (s *HashProducerSuite) TestMurmur2(c *C) {
+	for _, tc := range murmur2Keys {
+		c.Assert(int32(murmur2([]byte(tc.key))), Equals, tc.hash, Commentf("key %q", tc.key))
+	}
+}
+
+func (s *HashProducerSuite) TestMurmur2Partitioner(c *C) {
+	var p Murmur2Partitioner
+	for _, tc := range murmur2Keys {
+		partition, err := p.Partition([]byte(tc.key), 10)
+		c.Assert(err, IsNil)
+		c.Assert(partition, Equals, tc.partition10, Commentf("key %q", tc.key))
+		partition, err = p.Partition([]byte(tc.key), 100)
+		c.Assert(err, IsNil)
+		c.Assert(partition, Equals, tc.partition100, Commentf("key %q", tc.key))
+	}
+
+	_, err := p.Partition([]byte("foobar"), 0)
+	c.Assert(err, ErrorMatches, "invalid partition count 0")
+}
+
+func (s *HashProducerSuite) TestFNVPartitioner(c *C) {
+	var p FNVPartitioner
+	partition, err := p.Partition([]byte("foobar"), 10)
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(2))
+
+	for i := 0; i < 100; i++ {
+		key := []byte{byte(i), byte(i * 7)}
+		partition, err := p.Partition(key, 7)
+		c.Assert(err, IsNil)
+		c.Assert(partition >= 0 && partition < 7, Equals, true)
+	}
+}
+
+func (s *HashProducerSuite) TestHashProducer(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewHashProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 10, nil },
+	}
+	conf.Producer = rec
+	p, err := NewHashProducer(conf)
+	c.Assert(err, IsNil)
+
+	for _, tc := range murmur2Keys {
+		for i := 0; i < 3; i++ {
+			partition, _, err := p.Distribute("test", &proto.Message{Key: []byte(tc.key)})
+			c.Assert(err, IsNil)
+			c.Assert(partition, Equals, tc.partition10)
+		}
+	}
+
+	// messages without a key go with those that have one
+	partition, _, err := p.Distribute("test",
+		&proto.Message{}, &proto.Message{Key: []byte("foobar")}, &proto.Message{Key: []byte("foobar")})
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(6))
+
+	_, _, err = p.Distribute("test",
+		&proto.Message{Key: []byte("foobar")}, &proto.Message{Key: []byte("21")})
+	c.Assert(err, ErrorMatches, "keys of messages map to partitions 6 and 0 of test")
+}
+
+func (s *HashProducerSuite) TestHashProducerKeyExtractor(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewHashProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 10, nil },
+	}
+	conf.Producer = rec
+	conf.KeyExtractor = func(value []byte) []byte {
+		return bytes.SplitN(value, []byte(":"), 2)[0]
+	}
+	p, err := NewHashProducer(conf)
+	c.Assert(err, IsNil)
+
+	msg := &proto.Message{Value: []byte("foobar:login")}
+	partition, _, err := p.Distribute("test", msg)
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(6))
+	c.Assert(string(msg.Key), Equals, "foobar")
+
+	// explicit keys are kept
+	msg = &proto.Message{Key: []byte("21"), Value: []byte("foobar:logout")}
+	partition, _, err = p.Distribute("test", msg)
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(0))
+	c.Assert(string(msg.Key), Equals, "21")
+}
+
+func (s *HashProducerSuite) TestHashProducerNilKeysRoundRobin(c *C) {
+	rec := newBatchRecordingProducer()
+	conf := NewHashProducerConf()
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 4, nil },
+	}
+	conf.Producer = rec
+	conf.Partitioner = FNVPartitioner{}
+	p, err := NewHashProducer(conf)
+	c.Assert(err, IsNil)
+
+	var last int32 = -1
+	for i := 0; i < 40; i++ {
+		partition, _, err := p.Distribute("test", &proto.Message{Value: []byte("no key")})
+		c.Assert(err, IsNil)
+		if last != -1 {
+			c.Assert(partition, Equals, (last+1)%4)
+		}
+		last = partition
+	}
+	for partition := int32(0); partition < 4; partition++ {
+		c.Assert(rec.batches[partition], HasLen, 10)
+	}
+}
+
+func (s *HashProducerSuite) TestHashProducerPartitionCountGrows(c *C) {
+	count := int32(10)
+	source := &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return atomic.LoadInt32(&count), nil },
+	}
+
+	conf := NewHashProducerConf()
+	conf.PartitionCountSource = source
+	conf.Producer = newBatchRecordingProducer()
+	rehashing, err := NewHashProducer(conf)
+	c.Assert(err, IsNil)
+
+	conf.PinPartitionCount = true
+	pinned, err := NewHashProducer(conf)
+	c.Assert(err, IsNil)
+
+	for _, p := range []DistributingProducer{rehashing, pinned} {
+		partition, _, err := p.Distribute("test", &proto.Message{Key: []byte("foobar")})
+		c.Assert(err, IsNil)
+		c.Assert(partition, Equals, int32(6))
+	}
+
+	atomic.StoreInt32(&count, 100)
+
+	// keys are hashed with the new count, unless it's pinned
+	partition, _, err := rehashing.Distribute("test", &proto.Message{Key: []byte("foobar")})
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(66))
+
+	_, _, err = pinned.Distribute("test", &proto.Message{Key: []byte("foobar")})
+	c.Assert(err, Equals, ErrPartitionCountChanged)
+	_, _, err = pinned.Distribute("test", &proto.Message{})
+	c.Assert(err, Equals, ErrPartitionCountChanged)
+
+	// other topics are pinned to their own count
+	partition, _, err = pinned.Distribute("other", &proto.Message{Key: []byte("foobar")})
+	c.Assert(err, IsNil)
+	c.Assert(partition, Equals, int32(66))
+}
+
+func (s *HashProducerSuite) TestHashProducerInvalidConf(c *C) {
+	conf := NewHashProducerConf()
+	_, err := NewHashProducer(conf)
+	c.Assert(err, ErrorMatches, ".*PartitionCountSource is required")
+
+	conf.PartitionCountSource = &dummyPartitionCountSource{
+		impl: func(string) (int32, error) { return 0, nil },
+	}
+	_, err = NewHashProducer(conf)
+	c.Assert(err, ErrorMatches, ".*Producer is required")
+
+	conf.Producer = newBatchRecordingProducer()
+	p, err := NewHashProducer(conf)
+	c.Assert(err, IsNil)
+	_, _, err = p.Distribute("test", &proto.Message{})
+	c.Assert(err, ErrorMatches, "invalid partition count 0 of test")
+}
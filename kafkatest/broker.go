@@ -16,9 +16,10 @@ var (
 	ErrNotImplemented = errors.New("not implemented")
 
 	// test implementation should implement the interface
-	_ kafka.Client   = &Broker{}
-	_ kafka.Producer = &Producer{}
-	_ kafka.Consumer = &Consumer{}
+	_ kafka.Client       = &Broker{}
+	_ kafka.Producer     = &Producer{}
+	_ kafka.Consumer     = &Consumer{}
+	_ kafka.SeekConsumer = &Consumer{}
 )
 
 // Broker is mock version of kafka's broker. It's implementing Broker interface
@@ -26,8 +27,11 @@ var (
 type Broker struct {
 	produced chan *ProducedMessages
 
+	// mu protects consumers and scripts, the scripted results of calls, see
+	// ScriptConsume.
 	mu        sync.Mutex
 	consumers map[string]map[int32]*Consumer
+	scripts   map[scriptKey][]interface{}
 
 	// OffsetEarliestHandler is callback function called whenever
 	// OffsetEarliest method of the broker is called. Overwrite to change
@@ -38,11 +42,17 @@ type Broker struct {
 	// method of the broker is called. Overwrite to change default behaviour --
 	// always returning ErrUnknownTopicOrPartition
 	OffsetLatestHandler func(string, int32) (int64, error)
+
+	// OffsetForTimeHandler is callback function called whenever
+	// OffsetForTime method of the broker is called. Overwrite to change
+	// default behaviour -- always returning ErrUnknownTopicOrPartition
+	OffsetForTimeHandler func(string, int32, time.Time) (int64, error)
 }
 
 func NewBroker() *Broker {
 	return &Broker{
 		consumers: make(map[string]map[int32]*Consumer),
+		scripts:   make(map[scriptKey][]interface{}),
 		produced:  make(chan *ProducedMessages),
 	}
 }
@@ -69,6 +79,15 @@ func (b *Broker) OffsetLatest(topic string, partition int32) (int64, error) {
 	return 0, proto.ErrUnknownTopicOrPartition
 }
 
+// OffsetForTime return result of OffsetForTimeHandler callback set on the
+// broker. If not set, always return ErrUnknownTopicOrPartition
+func (b *Broker) OffsetForTime(topic string, partition int32, t time.Time) (int64, error) {
+	if b.OffsetForTimeHandler != nil {
+		return b.OffsetForTimeHandler(topic, partition, t)
+	}
+	return 0, proto.ErrUnknownTopicOrPartition
+}
+
 // Consumer returns consumer mock and never error.
 //
 // At most one consumer for every topic-partition pair can be created --
@@ -108,8 +127,9 @@ func (b *Broker) Producer(kafka.ProducerConf) kafka.Producer {
 // successful, so you can always ignore returned error.
 func (b *Broker) OffsetCoordinator(conf kafka.OffsetCoordinatorConf) (kafka.OffsetCoordinator, error) {
 	c := &OffsetCoordinator{
-		Broker: b,
-		conf:   conf,
+		Broker:  b,
+		conf:    conf,
+		Offsets: make(map[string]int64),
 	}
 	return c, nil
 }
@@ -141,10 +161,31 @@ type Consumer struct {
 	Errors chan error
 }
 
-// Consume returns message or error pushed through consumers Messages and Errors
+// Consume returns the next result scripted with the broker's ScriptConsume,
+// or else message or error pushed through consumers Messages and Errors
 // channel. Function call will block until data on at least one of those
 // channels is available.
 func (c *Consumer) Consume() (*proto.Message, error) {
+	key := scriptKey{scriptConsume, c.conf.Topic, c.conf.Partition}
+	for {
+		scripted, ok := c.Broker.nextScripted(key)
+		if !ok {
+			break
+		}
+		res := scripted.(ConsumeResult)
+		if res.Delay > 0 {
+			time.Sleep(res.Delay)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		if res.Message != nil {
+			res.Message.Topic = c.conf.Topic
+			res.Message.Partition = c.conf.Partition
+			return res.Message, nil
+		}
+	}
+
 	select {
 	case msg := <-c.Messages:
 		msg.Topic = c.conf.Topic
@@ -171,6 +212,12 @@ func (c *Consumer) SeekToLatest() error {
 	}
 }
 
+// SeekTo discards all messages currently enqueued like SeekToLatest, so that
+// the messages pushed afterwards can be those of the new offset.
+func (c *Consumer) SeekTo(offset int64) error {
+	return c.SeekToLatest()
+}
+
 // Producer mocks kafka's producer.
 type Producer struct {
 	Broker *Broker
@@ -194,13 +241,31 @@ type ProducedMessages struct {
 
 // Produce is settings messages Crc and Offset attributes and pushing all
 // passed arguments to broker. Produce call is blocking until pushed message
-// will be read with broker's ReadProduces.
+// will be read with broker's ReadProduces. Results scripted with the
+// broker's ScriptProduce take precedence over ResponseOffset and
+// ResponseError.
 func (p *Producer) Produce(topic string, partition int32, messages ...*proto.Message) (int64, error) {
+	if scripted, ok := p.Broker.nextScripted(scriptKey{scriptProduce, topic, partition}); ok {
+		res := scripted.(ProduceResult)
+		if res.Err != nil {
+			return 0, res.Err
+		}
+		p.publish(topic, partition, res.Offset, messages)
+		return res.Offset, nil
+	}
+
 	if p.ResponseError != nil {
 		return 0, p.ResponseError
 	}
 	off := p.ResponseOffset
+	p.publish(topic, partition, off, messages)
+	p.ResponseOffset += int64(len(messages))
+	return off, nil
+}
 
+// publish sets the offsets of messages, starting at off, and pushes them to
+// the broker.
+func (p *Producer) publish(topic string, partition int32, off int64, messages []*proto.Message) {
 	for i, msg := range messages {
 		msg.Offset = off + int64(i)
 		msg.Crc = proto.ComputeCrc(msg, proto.CompressionNone)
@@ -211,8 +276,6 @@ func (p *Producer) Produce(topic string, partition int32, messages ...*proto.Mes
 		Partition: partition,
 		Messages:  messages,
 	}
-	p.ResponseOffset += int64(len(messages))
-	return off, nil
 }
 
 type OffsetCoordinator struct {
@@ -234,10 +297,15 @@ type OffsetCoordinator struct {
 	OffsetHandler func(consumerGroup string, topic string, partition int32) (offset int64, metadata string, err error)
 }
 
-// Commit return result of CommitHandler callback set on coordinator. If
-// handler is nil, this method will use Offsets attribute to store data for
-// further use.
+// Commit returns the next error scripted with the broker's ScriptCommit, or
+// else result of CommitHandler callback set on coordinator. If handler is
+// nil, this method will use Offsets attribute to store data for further
+// use.
 func (c *OffsetCoordinator) Commit(topic string, partition int32, offset int64) error {
+	if scripted, ok := c.Broker.nextScripted(scriptKey{scriptCommit, topic, partition}); ok {
+		err, _ := scripted.(error)
+		return err
+	}
 	if c.CommitHandler != nil {
 		return c.CommitHandler(c.conf.ConsumerGroup, topic, partition, offset)
 	}
@@ -245,11 +313,16 @@ func (c *OffsetCoordinator) Commit(topic string, partition int32, offset int64)
 	return nil
 }
 
-// Offset return result of OffsetHandler callback set on coordinator. If
-// handler is nil, this method will use Offsets attribute to retrieve committed
-// offset. If no offset for given topic and partition pair was saved,
+// Offset returns the next result scripted with the broker's ScriptOffset, or
+// else result of OffsetHandler callback set on coordinator. If handler is
+// nil, this method will use Offsets attribute to retrieve committed offset.
+// If no offset for given topic and partition pair was saved,
 // proto.ErrUnknownTopicOrPartition is returned.
 func (c *OffsetCoordinator) Offset(topic string, partition int32) (offset int64, metadata string, err error) {
+	if scripted, ok := c.Broker.nextScripted(scriptKey{scriptOffset, topic, partition}); ok {
+		res := scripted.(OffsetResult)
+		return res.Offset, res.Metadata, res.Err
+	}
 	if c.OffsetHandler != nil {
 		return c.OffsetHandler(c.conf.ConsumerGroup, topic, partition)
 	}
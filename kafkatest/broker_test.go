@@ -0,0 +1,217 @@
+package kafkatest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/zorkian/kafka"
+	"github.com/zorkian/kafka/proto"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&BrokerSuite{})
+
+type BrokerSuite struct{}
+
+func (s *BrokerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// reporter records the errors reported by AssertScriptsConsumed.
+type reporter struct {
+	errors []string
+}
+
+func (r *reporter) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (s *BrokerSuite) TestScriptConsume(c *C) {
+	broker := NewBroker()
+	consumer, err := broker.Consumer(kafka.NewConsumerConf("test", 1))
+	c.Assert(err, IsNil)
+
+	broker.ScriptConsume("test", 1,
+		ConsumeError(kafka.ErrNoData),
+		ConsumeError(kafka.ErrNoData),
+		ConsumeMessage(&proto.Message{Offset: 3, Value: []byte("first")}),
+		ConsumeError(io.EOF))
+	// scripts of other partitions are not used
+	broker.ScriptConsume("test", 0, ConsumeError(io.ErrUnexpectedEOF))
+
+	for i := 0; i < 2; i++ {
+		_, err = consumer.Consume()
+		c.Assert(err, Equals, kafka.ErrNoData)
+	}
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "first")
+	c.Assert(msg.Topic, Equals, "test")
+	c.Assert(msg.Partition, Equals, int32(1))
+	c.Assert(msg.Offset, Equals, int64(3))
+	_, err = consumer.Consume()
+	c.Assert(err, Equals, io.EOF)
+
+	// once the script is used up, the channels are read again
+	go func() {
+		consumer.(*Consumer).Messages <- &proto.Message{Value: []byte("second")}
+	}()
+	msg, err = consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "second")
+
+	r := &reporter{}
+	broker.AssertScriptsConsumed(r)
+	c.Assert(r.errors, DeepEquals, []string{"consume test:0: 1 scripted results left"})
+}
+
+func (s *BrokerSuite) TestScriptConsumeDelay(c *C) {
+	broker := NewBroker()
+	consumer, err := broker.Consumer(kafka.NewConsumerConf("test", 0))
+	c.Assert(err, IsNil)
+
+	broker.ScriptConsume("test", 0,
+		ConsumeDelay(50*time.Millisecond),
+		ConsumeResult{Delay: 50 * time.Millisecond, Err: kafka.ErrNoData})
+
+	start := time.Now()
+	_, err = consumer.Consume()
+	c.Assert(err, Equals, kafka.ErrNoData)
+	c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+
+	r := &reporter{}
+	broker.AssertScriptsConsumed(r)
+	c.Assert(r.errors, HasLen, 0)
+}
+
+func (s *BrokerSuite) TestScriptProduce(c *C) {
+	broker := NewBroker()
+	producer := broker.Producer(kafka.NewProducerConf())
+
+	broker.ScriptProduce("test", 0,
+		ProduceResult{Err: proto.ErrNotLeaderForPartition},
+		ProduceResult{Offset: 42})
+
+	_, err := producer.Produce("test", 0, &proto.Message{Value: []byte("first")})
+	c.Assert(err, Equals, proto.ErrNotLeaderForPartition)
+
+	produced := make(chan *ProducedMessages, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			p, err := broker.ReadProducers(time.Second)
+			if err != nil {
+				close(produced)
+				return
+			}
+			produced <- p
+		}
+	}()
+
+	offset, err := producer.Produce("test", 0,
+		&proto.Message{Value: []byte("first")},
+		&proto.Message{Value: []byte("second")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(42))
+	p := <-produced
+	c.Assert(p.Messages, HasLen, 2)
+	c.Assert(p.Messages[1].Offset, Equals, int64(43))
+
+	// once the script is used up, ResponseOffset is used again
+	offset, err = producer.Produce("test", 0, &proto.Message{Value: []byte("third")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(1))
+	p = <-produced
+	c.Assert(string(p.Messages[0].Value), Equals, "third")
+
+	r := &reporter{}
+	broker.AssertScriptsConsumed(r)
+	c.Assert(r.errors, HasLen, 0)
+}
+
+func (s *BrokerSuite) TestScriptOffsetCoordinator(c *C) {
+	broker := NewBroker()
+	coordinator, err := broker.OffsetCoordinator(kafka.NewOffsetCoordinatorConf("group"))
+	c.Assert(err, IsNil)
+
+	errCommit := errors.New("cannot commit")
+	broker.ScriptCommit("test", 0, errCommit, nil)
+	broker.ScriptOffset("test", 0,
+		OffsetResult{Err: proto.ErrOffsetLoadInProgress},
+		OffsetResult{Offset: 7, Metadata: "scripted"})
+
+	c.Assert(coordinator.Commit("test", 0, 1), Equals, errCommit)
+	c.Assert(coordinator.Commit("test", 0, 2), IsNil)
+	_, _, err = coordinator.Offset("test", 0)
+	c.Assert(err, Equals, proto.ErrOffsetLoadInProgress)
+	offset, metadata, err := coordinator.Offset("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(7))
+	c.Assert(metadata, Equals, "scripted")
+
+	// scripted commits are not stored, later ones are
+	_, _, err = coordinator.Offset("test", 0)
+	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(coordinator.Commit("test", 0, 3), IsNil)
+	offset, _, err = coordinator.Offset("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(3))
+
+	r := &reporter{}
+	broker.AssertScriptsConsumed(r)
+	c.Assert(r.errors, HasLen, 0)
+}
+
+func (s *BrokerSuite) TestScriptConcurrentCalls(c *C) {
+	broker := NewBroker()
+	consumer, err := broker.Consumer(kafka.NewConsumerConf("test", 0))
+	c.Assert(err, IsNil)
+	coordinator, err := broker.OffsetCoordinator(kafka.NewOffsetCoordinatorConf("group"))
+	c.Assert(err, IsNil)
+
+	const n = 100
+	results := make([]ConsumeResult, n)
+	errs := make([]error, n)
+	for i := range results {
+		results[i] = ConsumeMessage(&proto.Message{Offset: int64(i)})
+		errs[i] = proto.ErrNotCoordinator
+	}
+	broker.ScriptConsume("test", 0, results...)
+	broker.ScriptCommit("test", 0, errs...)
+
+	var mu sync.Mutex
+	seen := make(map[int64]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n/4; i++ {
+				msg, err := consumer.Consume()
+				if err != nil {
+					c.Error(err)
+					return
+				}
+				mu.Lock()
+				seen[msg.Offset] = true
+				mu.Unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n/4; i++ {
+				if err := coordinator.Commit("test", 0, int64(i)); err != proto.ErrNotCoordinator {
+					c.Errorf("unexpected commit error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(seen, HasLen, n)
+	broker.AssertScriptsConsumed(c)
+}
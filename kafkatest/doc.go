@@ -4,5 +4,8 @@ Package kafkatest provides mock objects for high level kafka interface.
 
 Use NewBroker function to create mock broker object and standard methods to create producers and consumers.
 
+Sequences of results of consumer, producer and offset coordinator calls can be scripted with the
+broker's ScriptConsume, ScriptProduce, ScriptCommit and ScriptOffset methods.
+
 */
 package kafkatest
@@ -87,6 +87,34 @@ func ExampleBroker_Consumer() {
 	// Error: expected error is expected
 }
 
+func ExampleBroker_ScriptConsume() {
+	broker := NewBroker()
+
+	// script the results of consecutive Consume calls, which are returned
+	// before anything pushed through the consumer's channels
+	broker.ScriptConsume("my-topic", 0,
+		ConsumeError(kafka.ErrNoData),
+		ConsumeDelay(time.Millisecond*20),
+		ConsumeMessage(&proto.Message{Value: []byte("first")}),
+		ConsumeError(errors.New("connection reset")))
+
+	consumer, _ := broker.Consumer(kafka.NewConsumerConf("my-topic", 0))
+	for i := 0; i < 3; i++ {
+		m, err := consumer.Consume()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+		} else {
+			fmt.Printf("Value: %q\n", m.Value)
+		}
+	}
+
+	// output:
+	//
+	// Error: no data
+	// Value: "first"
+	// Error: connection reset
+}
+
 func ExampleServer() {
 	// symulate server latency for all fetch requests
 	delayFetch := func(nodeID int32, reqKind int16, content []byte) Response {
@@ -0,0 +1,173 @@
+package kafkatest
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// ConsumeResult is a scripted result of a consumer's Consume call, see
+// Broker.ScriptConsume.
+type ConsumeResult struct {
+	// Delay is how long the call blocks before returning. A result with
+	// neither Message nor Err set only delays the call, which then returns
+	// the next result.
+	Delay time.Duration
+
+	// Message is returned by the call, unless Err is set.
+	Message *proto.Message
+
+	// Err is returned by the call.
+	Err error
+}
+
+// ConsumeMessage returns a result of a Consume call that returns msg.
+func ConsumeMessage(msg *proto.Message) ConsumeResult {
+	return ConsumeResult{Message: msg}
+}
+
+// ConsumeError returns a result of a Consume call that returns err.
+func ConsumeError(err error) ConsumeResult {
+	return ConsumeResult{Err: err}
+}
+
+// ConsumeDelay returns a result that delays a Consume call by d.
+func ConsumeDelay(d time.Duration) ConsumeResult {
+	return ConsumeResult{Delay: d}
+}
+
+// ProduceResult is a scripted result of a producer's Produce call, see
+// Broker.ScriptProduce.
+type ProduceResult struct {
+	// Offset is the offset of the first produced message.
+	Offset int64
+
+	// Err, if set, is returned by the call without publishing the messages.
+	Err error
+}
+
+// OffsetResult is a scripted result of an offset coordinator's Offset call,
+// see Broker.ScriptOffset.
+type OffsetResult struct {
+	Offset   int64
+	Metadata string
+	Err      error
+}
+
+// Reporter is the part of *testing.T used by AssertScriptsConsumed. It is
+// implemented by gocheck's *check.C as well.
+type Reporter interface {
+	Errorf(format string, args ...interface{})
+}
+
+// scriptKey identifies the scripted results of one kind of call for a
+// topic-partition.
+type scriptKey struct {
+	call      string
+	topic     string
+	partition int32
+}
+
+func (k scriptKey) String() string {
+	return fmt.Sprintf("%s %s:%d", k.call, k.topic, k.partition)
+}
+
+const (
+	scriptConsume = "consume"
+	scriptProduce = "produce"
+	scriptCommit  = "commit"
+	scriptOffset  = "offset"
+)
+
+// ScriptConsume queues results for the Consume calls of the consumer of
+// given topic and partition. Every call returns the next result in order,
+// and once they are used up, calls return what is pushed through the
+// consumer's Messages and Errors channels again. Scripted results are not
+// discarded by SeekTo and SeekToLatest.
+func (b *Broker) ScriptConsume(topic string, partition int32, results ...ConsumeResult) {
+	scripted := make([]interface{}, len(results))
+	for i, res := range results {
+		scripted[i] = res
+	}
+	b.script(scriptKey{scriptConsume, topic, partition}, scripted)
+}
+
+// ScriptProduce queues results for Produce calls to given topic and
+// partition by any producer of the broker. A scripted error is returned
+// without publishing the messages, otherwise the messages are given the
+// scripted offsets and published to ReadProducers like by default. Once
+// the results are used up, Produce calls behave as by default again.
+func (b *Broker) ScriptProduce(topic string, partition int32, results ...ProduceResult) {
+	scripted := make([]interface{}, len(results))
+	for i, res := range results {
+		scripted[i] = res
+	}
+	b.script(scriptKey{scriptProduce, topic, partition}, scripted)
+}
+
+// ScriptCommit queues errors, which may be nil, to be returned by Commit
+// calls for given topic and partition by any offset coordinator of the
+// broker. Scripted commits are not stored. Once the errors are used up,
+// Commit calls behave as by default again.
+func (b *Broker) ScriptCommit(topic string, partition int32, errs ...error) {
+	scripted := make([]interface{}, len(errs))
+	for i, err := range errs {
+		scripted[i] = err
+	}
+	b.script(scriptKey{scriptCommit, topic, partition}, scripted)
+}
+
+// ScriptOffset queues results for Offset calls for given topic and
+// partition by any offset coordinator of the broker. Once they are used up,
+// Offset calls behave as by default again.
+func (b *Broker) ScriptOffset(topic string, partition int32, results ...OffsetResult) {
+	scripted := make([]interface{}, len(results))
+	for i, res := range results {
+		scripted[i] = res
+	}
+	b.script(scriptKey{scriptOffset, topic, partition}, scripted)
+}
+
+// script appends results to the script of key.
+func (b *Broker) script(key scriptKey, results []interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.scripts[key] = append(b.scripts[key], results...)
+}
+
+// nextScripted removes and returns the next result of the script of key.
+// It returns false if there is none.
+func (b *Broker) nextScripted(key scriptKey) (interface{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	results := b.scripts[key]
+	if len(results) == 0 {
+		return nil, false
+	}
+	if len(results) == 1 {
+		delete(b.scripts, key)
+	} else {
+		b.scripts[key] = results[1:]
+	}
+	return results[0], true
+}
+
+// AssertScriptsConsumed reports an error to t for every script with
+// results that were not returned by a call yet.
+func (b *Broker) AssertScriptsConsumed(t Reporter) {
+	b.mu.Lock()
+	var remaining []string
+	for key, results := range b.scripts {
+		remaining = append(remaining, fmt.Sprintf("%s: %d scripted results left", key, len(results)))
+	}
+	b.mu.Unlock()
+
+	sort.Strings(remaining)
+	for _, msg := range remaining {
+		t.Errorf("%s", msg)
+	}
+}
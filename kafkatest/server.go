@@ -2,23 +2,41 @@ package kafkatest
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/zorkian/kafka/proto"
 )
 
+// AnyRequest matches requests of every kind, where a request kind is
+// expected.
+const AnyRequest = -1
+
 type topicOffset struct {
 	offset   int64
 	metadata string
 }
 
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
 // Server is container for fake kafka server data.
 type Server struct {
 	mu          *sync.RWMutex
@@ -29,6 +47,158 @@ type Server struct {
 	middlewares []Middleware
 	started     bool
 	stopped     bool
+
+	// leaders holds the partitions moved by SetLeader, and moved those of
+	// them that clients weren't told about yet by a metadata response.
+	leaders map[topicPartition]int32
+	moved   map[topicPartition]bool
+
+	// seeded holds the offsets set with SetOffset by partition and time.
+	seeded map[topicPartition]map[int64]int64
+
+	// requests are the requests received so far, oldest first, up to
+	// requestLimit of them if it's set. counts are the number of requests
+	// received of every kind, including those dropped from requests.
+	requests     []Request
+	requestLimit int
+	counts       map[int16]int
+
+	// answered counts the requests of every kind that were answered, for
+	// Await. answeredc is closed and replaced whenever one is.
+	answered  map[int16]int
+	answeredc chan struct{}
+	notify    []notification
+
+	// metaBrokers and metaTopics, if set, are served by metadata requests
+	// instead of the server itself and its topics.
+	metaBrokers []proto.MetadataRespBroker
+	metaTopics  []proto.MetadataRespTopic
+
+	// conns are the open client connections.
+	conns map[net.Conn]struct{}
+
+	// topicHandlers are the handlers registered with HandleTopic, by kind
+	// and topic.
+	topicHandlers map[int16]map[string]Middleware
+
+	// injected are the errors set with InjectError.
+	injected []*injectedError
+
+	// latency is how long responses to requests of every kind are delayed,
+	// unless latencyFn is set.
+	latency   map[int16]time.Duration
+	latencyFn func(kind int16) time.Duration
+
+	// apiVersions, if set, are served by API versions requests instead of
+	// the versions the server supports.
+	apiVersions []proto.APIVersion
+
+	// fetchCompression is how messages of fetch responses are compressed.
+	fetchCompression proto.Compression
+
+	// strict makes produce requests with invalid messages fail.
+	strict bool
+
+	// onError is called instead of logging errors that close connections.
+	onError func(conn net.Conn, err error)
+
+	// stored is closed and replaced whenever messages are stored, to wake up
+	// fetches waiting for them. closing is closed by Close, to interrupt
+	// delayed responses and waiting fetches.
+	stored  chan struct{}
+	closing chan struct{}
+
+	// network, addr and tlsConfig are where and how the server listens,
+	// kept to listen the same way again after Close. wg tracks the
+	// goroutines serving the listener and the clients.
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	wg        sync.WaitGroup
+
+	// nodeID is the ID of the server in metadata. cluster is set for the
+	// servers of a Cluster, which share their lock, topics and offsets.
+	nodeID  int32
+	cluster *Cluster
+}
+
+// Request is a request received by the server, see Requests.
+type Request struct {
+	Kind          int16
+	CorrelationID int32
+	ClientID      string
+	RemoteAddr    string
+
+	// Bytes is the whole request as read, which can be decoded with the
+	// proto package's reader for its kind, such as proto.ReadFetchReq.
+	Bytes []byte
+}
+
+// notification is a channel the requests of given kind are sent to once
+// they're answered, see Notify.
+type notification struct {
+	kind int16
+	ch   chan Request
+}
+
+// injectedError is an error requests are answered with instead of being
+// handled, see InjectError.
+type injectedError struct {
+	kind      int16
+	topic     string
+	partition int32
+	err       error
+	count     int // requests left to fail, or -1 for all
+}
+
+// matches returns true if the error is injected into responses for given
+// partition to requests of given kind.
+func (inj *injectedError) matches(kind int16, topic string, partition int32) bool {
+	if inj.kind != AnyRequest && inj.kind != kind {
+		return false
+	}
+	return inj.topic == "" || (inj.topic == topic && inj.partition == partition)
+}
+
+// injection looks up the errors injected into a single request. Injected
+// errors are used up once per request, no matter how many of its partitions
+// they apply to.
+type injection struct {
+	s    *Server
+	kind int16
+	used map[*injectedError]bool
+}
+
+// err returns the error injected for given partition, or nil.
+func (in *injection) err(topic string, partition int32) error {
+	for _, inj := range in.s.injected {
+		if inj.count != 0 && inj.matches(in.kind, topic, partition) {
+			in.used[inj] = true
+			return inj.err
+		}
+	}
+	return nil
+}
+
+// done uses up the injected errors the request was answered with.
+func (in *injection) done() {
+	injected := in.s.injected[:0]
+	for _, inj := range in.s.injected {
+		if in.used[inj] && inj.count > 0 {
+			inj.count--
+		}
+		if inj.count != 0 {
+			injected = append(injected, inj)
+		}
+	}
+	in.s.injected = injected
+}
+
+// injection returns the lookup of injected errors for a request of given
+// kind. The caller must hold the lock and call done once the response is
+// ready.
+func (s *Server) injection(kind int16) *injection {
+	return &injection{s: s, kind: kind, used: make(map[*injectedError]bool)}
 }
 
 // Middleware is function that is called for every incomming kafka message,
@@ -49,11 +219,24 @@ type Response interface {
 // other middleware is called nor the default handler is executed.
 func NewServer(middlewares ...Middleware) *Server {
 	s := &Server{
-		brokers:     make([]proto.MetadataRespBroker, 0),
-		topics:      make(map[string]map[int32][]*proto.Message),
-		offsets:     make(map[string]map[int32]map[string]*topicOffset),
-		middlewares: middlewares,
-		mu:          &sync.RWMutex{},
+		brokers:       make([]proto.MetadataRespBroker, 0),
+		topics:        make(map[string]map[int32][]*proto.Message),
+		offsets:       make(map[string]map[int32]map[string]*topicOffset),
+		middlewares:   middlewares,
+		mu:            &sync.RWMutex{},
+		leaders:       make(map[topicPartition]int32),
+		moved:         make(map[topicPartition]bool),
+		seeded:        make(map[topicPartition]map[int64]int64),
+		counts:        make(map[int16]int),
+		answered:      make(map[int16]int),
+		answeredc:     make(chan struct{}),
+		conns:         make(map[net.Conn]struct{}),
+		topicHandlers: make(map[int16]map[string]Middleware),
+		latency:       make(map[int16]time.Duration),
+		strict:        true,
+		stored:        make(chan struct{}),
+		closing:       make(chan struct{}),
+		nodeID:        100,
 	}
 	return s
 }
@@ -75,13 +258,333 @@ func (s *Server) Addr() string {
 	panic("server should be running but isn't, no addr available")
 }
 
-// Reset will clear out local messages and topics.
+// Reset will clear out local messages, topics and the received requests.
 func (s *Server) Reset() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.topics = make(map[string]map[int32][]*proto.Message)
-	s.offsets = make(map[string]map[int32]map[string]*topicOffset)
+	// the maps are cleared rather than replaced, as the servers of a
+	// cluster share them
+	for topic := range s.topics {
+		delete(s.topics, topic)
+	}
+	for topic := range s.offsets {
+		delete(s.offsets, topic)
+	}
+	for tp := range s.seeded {
+		delete(s.seeded, tp)
+	}
+	s.requests = nil
+}
+
+// Requests returns the requests the server received since it was created or
+// Reset, oldest first, including those answered by a middleware. Only the
+// latest requests are kept if a limit is set with SetRequestLimit.
+func (s *Server) Requests() []Request {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	requests := make([]Request, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+// RequestsOf returns the requests of given kind the server received, oldest
+// first, like Requests.
+func (s *Server) RequestsOf(kind int16) []Request {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var requests []Request
+	for _, req := range s.requests {
+		if req.Kind == kind {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+// SetRequestLimit sets the number of latest requests the server keeps for
+// Requests, dropping older ones. Default, 0, keeps all of them.
+func (s *Server) SetRequestLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+	s.requestLimit = n
+	s.trimRequests()
+}
+
+// trimRequests drops the oldest requests beyond the request limit. The
+// caller must hold the lock.
+func (s *Server) trimRequests() {
+	if over := len(s.requests) - s.requestLimit; s.requestLimit > 0 && over > 0 {
+		s.requests = append([]Request(nil), s.requests[over:]...)
+	}
+}
+
+// RequestCount returns the number of requests of given kind the server
+// received, including those no longer kept for Requests.
+func (s *Server) RequestCount(kind int16) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.counts[kind]
+}
+
+// TotalRequests returns the number of requests the server received.
+func (s *Server) TotalRequests() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	total := 0
+	for _, n := range s.counts {
+		total += n
+	}
+	return total
+}
+
+// record appends a request to the requests received.
+func (s *Server) record(kind int16, b []byte, conn net.Conn) Request {
+	req := Request{Kind: kind, Bytes: b, RemoteAddr: conn.RemoteAddr().String()}
+	// size, kind and version precede the correlation and client IDs
+	if len(b) >= 14 {
+		req.CorrelationID = int32(binary.BigEndian.Uint32(b[8:]))
+		req.ClientID = proto.NewDecoder(bytes.NewReader(b[12:])).DecodeString()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	s.trimRequests()
+	s.counts[kind]++
+	return req
+}
+
+// Await blocks until the server answered at least n requests of given kind,
+// or of any kind for AnyRequest, counting from its creation. It returns an
+// error if that doesn't happen within timeout.
+func (s *Server) Await(kind int16, n int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.mu.RLock()
+		answered := s.answered[kind]
+		if kind == AnyRequest {
+			answered = 0
+			for _, count := range s.answered {
+				answered += count
+			}
+		}
+		changed := s.answeredc
+		s.mu.RUnlock()
+
+		if answered >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("timed out waiting for %d requests of kind %d, got %d", n, kind, answered)
+		}
+	}
+}
+
+// Notify returns a channel every request of given kind, or of any kind for
+// AnyRequest, is sent to once the server wrote its response. The channel is
+// buffered, but once it's full the client waits for the request to be
+// received, or for the server to close.
+func (s *Server) Notify(kind int16) <-chan Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan Request, 100)
+	s.notify = append(s.notify, notification{kind: kind, ch: ch})
+	return ch
+}
+
+// answer counts req as answered and sends it to the channels returned by
+// Notify, unless closing is closed first.
+func (s *Server) answer(req Request, closing chan struct{}) {
+	s.mu.Lock()
+	s.answered[req.Kind]++
+	close(s.answeredc)
+	s.answeredc = make(chan struct{})
+	var notify []chan Request
+	for _, n := range s.notify {
+		if n.kind == AnyRequest || n.kind == req.Kind {
+			notify = append(notify, n.ch)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, ch := range notify {
+		select {
+		case ch <- req:
+		case <-closing:
+			return
+		}
+	}
+}
+
+// Use adds middlewares to those passed to NewServer, called after them.
+func (s *Server) Use(middlewares ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
+// HandleTopic registers middleware for requests of given kind for topic,
+// called when no middleware passed to NewServer or Use answered the request.
+// Produce and fetch requests for several topics are split: middleware gets
+// the part of the request for topic, re-encoded, and the server merges its
+// response with those for the other topics. Requests of other kinds are
+// passed to middleware only if topic is the only topic they are for. If
+// middleware returns nil, the topic is handled by the server.
+func (s *Server) HandleTopic(reqKind int16, topic string, middleware Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.topicHandlers[reqKind] == nil {
+		s.topicHandlers[reqKind] = make(map[string]Middleware)
+	}
+	s.topicHandlers[reqKind][topic] = middleware
+}
+
+// InjectError makes the server respond with err to the next count requests
+// of given kind for given partition, instead of handling them. A count of -1
+// injects the error until ClearErrors is called. AnyRequest matches requests
+// of every kind and an empty topic matches every partition, as well as
+// requests without partitions. Requests answered by a middleware are not
+// affected.
+func (s *Server) InjectError(reqKind int16, topic string, partition int32, err error, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.injected = append(s.injected, &injectedError{
+		kind:      reqKind,
+		topic:     topic,
+		partition: partition,
+		err:       err,
+		count:     count,
+	})
+}
+
+// ClearErrors removes all errors injected with InjectError.
+func (s *Server) ClearErrors() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.injected = nil
+}
+
+// SetLatency delays responses to requests of given kind by d. Latency set
+// for AnyRequest applies to kinds without latency of their own. Responses
+// are no longer delayed once the server is closed.
+func (s *Server) SetLatency(reqKind int16, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency[reqKind] = d
+}
+
+// SetLatencyFunc delays responses by the duration fn returns for the kind of
+// the request, e.g. to add jitter. It overrides latency set with SetLatency,
+// until it's reset with nil.
+func (s *Server) SetLatencyFunc(fn func(kind int16) time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencyFn = fn
+}
+
+// delay waits for the latency of requests of given kind, and returns false
+// if closing is closed first.
+func (s *Server) delay(kind int16, closing chan struct{}) bool {
+	s.mu.RLock()
+	d, ok := s.latency[kind]
+	if !ok {
+		d = s.latency[AnyRequest]
+	}
+	if s.latencyFn != nil {
+		d = s.latencyFn(kind)
+	}
+	s.mu.RUnlock()
+
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-closing:
+		return false
+	}
+}
+
+// SetAPIVersions sets the versions of requests API versions requests are
+// answered with, e.g. to pretend to be an older broker. Passing none returns
+// the versions the server supports again.
+func (s *Server) SetAPIVersions(versions ...proto.APIVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiVersions = append([]proto.APIVersion(nil), versions...)
+}
+
+// SetFetchCompression makes the server compress the messages of every
+// partition in fetch responses into a single wrapper message.
+func (s *Server) SetFetchCompression(compression proto.Compression) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetchCompression = compression
+}
+
+// SetStrictValidation sets whether produce requests are validated like a
+// broker does, failing partitions with corrupt messages with
+// proto.ErrInvalidMessage and the like, instead of storing whatever is
+// sent. Default is true.
+func (s *Server) SetStrictValidation(strict bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.strict = strict
+}
+
+// OnError sets the function called with every error that makes the server
+// close a client connection, such as a request that can't be decoded or a
+// middleware that panicked, instead of logging it. Clients closing their
+// connection are not reported.
+func (s *Server) OnError(fn func(conn net.Conn, err error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onError = fn
+}
+
+// fail reports an error that makes the server close client connection conn.
+func (s *Server) fail(conn net.Conn, err error) {
+	s.mu.RLock()
+	fn := s.onError
+	s.mu.RUnlock()
+
+	if fn != nil {
+		fn(conn, err)
+		return
+	}
+	log.Errorf("closing connection from %s: %s", conn.RemoteAddr(), err)
+}
+
+// SetOffset makes offset requests for the partition with given time answer
+// offset, instead of the one computed from the messages of the partition.
+// Time is -1 for the latest offset, -2 for the earliest one, or a timestamp
+// in milliseconds. A partition that has an offset set is known to offset
+// requests even if it has no messages.
+func (s *Server) SetOffset(topic string, partition int32, time, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tp := topicPartition{topic: topic, partition: partition}
+	if s.seeded[tp] == nil {
+		s.seeded[tp] = make(map[int64]int64)
+	}
+	s.seeded[tp][time] = offset
 }
 
 // ResetTopic removes all messages and committed offsets for a topic, but
@@ -98,17 +601,108 @@ func (s *Server) ResetTopic(topic string) {
 	delete(s.offsets, topic)
 }
 
-// Close shut down server if running. It is safe to call it more than once.
-func (s *Server) Close() (err error) {
+// SetLeader pretends that the leader of the partition moved to the node with
+// the given ID. Produce and fetch requests for the partition fail with
+// proto.ErrNotLeaderForPartition until the next metadata response about the
+// partition, which reports the new leader. The server keeps serving the
+// partition itself, so a node ID that is not known yet is added to the
+// brokers of the metadata with the address of the server. To move partitions
+// between the servers of a Cluster, use Cluster.SetLeader.
+func (s *Server) SetLeader(topic string, partition int32, nodeID int32) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.stopped = true
+	tp := topicPartition{topic: topic, partition: partition}
+	s.leaders[tp] = nodeID
+	s.moved[tp] = true
 
-	if s.ln != nil {
-		err = s.ln.Close()
-		s.ln = nil
+	for _, broker := range s.brokers {
+		if broker.NodeID == nodeID {
+			return
+		}
+	}
+	if len(s.brokers) > 0 {
+		broker := s.brokers[0]
+		broker.NodeID = nodeID
+		s.brokers = append(s.brokers, broker)
 	}
+}
+
+// SetBrokers sets the brokers returned by metadata requests, instead of the
+// server itself, to simulate a cluster of several brokers. Passing nil
+// returns the server itself again.
+func (s *Server) SetBrokers(brokers []proto.MetadataRespBroker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metaBrokers = brokers
+}
+
+// SetTopics sets the topics returned by metadata requests, with the leader,
+// replicas and in-sync replicas of every partition, instead of the topics of
+// the server led by itself. Requested topics that are not set are reported
+// with proto.ErrUnknownTopicOrPartition, and leaders moved with SetLeader
+// are not applied. Passing nil returns the topics of the server again.
+func (s *Server) SetTopics(topics []proto.MetadataRespTopic) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metaTopics = topics
+}
+
+// leader returns the ID of the node that leads the partition.
+func (s *Server) leader(nodeID int32, topic string, partition int32) int32 {
+	if s.cluster != nil {
+		return s.cluster.leader(topic, partition)
+	}
+	if leader, ok := s.leaders[topicPartition{topic: topic, partition: partition}]; ok {
+		return leader
+	}
+	return nodeID
+}
+
+// notLeader returns whether the partition moved since the last metadata
+// response about it, or is led by another server of the cluster.
+func (s *Server) notLeader(topic string, partition int32) bool {
+	if s.cluster != nil {
+		return s.cluster.leader(topic, partition) != s.nodeID
+	}
+	return s.moved[topicPartition{topic: topic, partition: partition}]
+}
+
+// CloseConnections closes all open client connections, as if the broker went
+// away, but keeps accepting new ones.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Close shut down server if running, closing all client connections and
+// waiting for the requests being handled. It is safe to call it more than
+// once. A closed server can be spawned again, on the same address, to
+// simulate a broker restart.
+func (s *Server) Close() (err error) {
+	s.mu.Lock()
+	s.stopped = true
+	if s.ln == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	close(s.closing)
+	err = s.ln.Close()
+	s.ln = nil
+	for conn := range s.conns {
+		_ = conn.Close()
+		delete(s.conns, conn)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
 	return err
 }
 
@@ -135,6 +729,14 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// AddTopic creates a topic with given number of partitions, or adds
+// partitions to it if it has fewer.
+func (s *Server) AddTopic(name string, partitions int) {
+	if partitions > 0 {
+		s.AddMessages(name, int32(partitions-1))
+	}
+}
+
 // AddMessages append messages to given topic/partition. If topic or partition
 // does not exists, it is being created.
 // To only create topic/partition, call this method withough giving any
@@ -155,67 +757,75 @@ func (s *Server) AddMessages(topic string, partition int32, messages ...*proto.M
 		}
 	}
 	if len(messages) > 0 {
-		start := len(parts[partition])
-		for i, msg := range messages {
-			msg.Offset = int64(start + i)
-			msg.Partition = partition
-			msg.Topic = topic
-		}
-		parts[partition] = append(parts[partition], messages...)
+		s.appendMessages(topic, partition, messages)
+	}
+}
+
+// appendMessages appends messages to an existing partition, setting their
+// offsets, and wakes up the fetches waiting for them. The caller must hold
+// the lock.
+func (s *Server) appendMessages(topic string, partition int32, messages []*proto.Message) {
+	parts := s.topics[topic]
+	for _, msg := range messages {
+		msg.Offset = int64(len(parts[partition]))
+		msg.Partition = partition
+		msg.Topic = topic
+		parts[partition] = append(parts[partition], msg)
+	}
+
+	servers := []*Server{s}
+	if s.cluster != nil {
+		servers = s.cluster.servers
+	}
+	for _, srv := range servers {
+		close(srv.stored)
+		srv.stored = make(chan struct{})
+	}
+}
+
+// CommittedOffset returns the offset and metadata last committed for given
+// consumer group and partition. The last value is false if nothing was
+// committed.
+func (s *Server) CommittedOffset(group, topic string, partition int32) (int64, string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	toffset, ok := s.offsets[topic][partition][group]
+	if !ok {
+		return -1, "", false
 	}
+	return toffset.offset, toffset.metadata, true
 }
 
 // Run starts kafka mock server listening on given address. Function only
 // returns when the listener has exited.
 func (s *Server) Run(addr string) error {
-	const nodeID = 100
-
-	ln, err := func() (net.Listener, error) {
+	ln, closing, err := func() (net.Listener, chan struct{}, error) {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 
-		if s.ln != nil {
-			log.Errorf("server already running: %s", s.ln.Addr())
-			return nil, fmt.Errorf("server already running: %s", s.ln.Addr())
-		}
-
-		ln, err := net.Listen("tcp4", addr)
+		ln, err := s.listen("tcp4", addr)
 		if err != nil {
-			log.Errorf("cannot listen on address %q: %s", addr, err)
-			return nil, fmt.Errorf("cannot listen: %s", err)
+			log.Errorf("%s", err)
+			return nil, nil, err
 		}
-
-		s.ln = ln
-		s.started = true
-
-		if host, port, err := net.SplitHostPort(ln.Addr().String()); err != nil {
-			log.Errorf("cannot extract host/port from %q: %s", ln.Addr(), err)
-			return nil, fmt.Errorf("cannot extract host/port from %q: %s", ln.Addr(), err)
-		} else {
-			prt, err := strconv.Atoi(port)
-			if err != nil {
-				log.Errorf("invalid port %q: %s", port, err)
-				return nil, fmt.Errorf("invalid port %q: %s", port, err)
-			}
-			s.brokers = append(s.brokers, proto.MetadataRespBroker{
-				NodeID: nodeID,
-				Host:   host,
-				Port:   int32(prt),
-			})
-		}
-		return ln, nil
+		return ln, s.closing, nil
 	}()
 	if err != nil {
 		return err
 	}
 
-	// Defer the stop/close so we shut down properly
+	// Defer the stop/close so we shut down properly, once the clients
+	// being served by this goroutine are counted
 	defer s.Close()
+	s.wg.Add(1)
+	defer s.wg.Done()
 
 	// Handle incoming connections for a long time
 	for {
 		if conn, err := ln.Accept(); err == nil {
-			go s.handleClient(nodeID, conn)
+			s.wg.Add(1)
+			go s.handleClient(conn, closing)
 		} else {
 			log.Errorf("failed to accept: %s", err)
 			return fmt.Errorf("failed to accept: %s", err)
@@ -224,200 +834,662 @@ func (s *Server) Run(addr string) error {
 }
 
 // MustSpawn run server in the background on random port. It panics if server
-// cannot be spawned.
+// cannot be spawned. A server spawned again after Close listens on the same
+// address as before.
 // Use Close method to stop spawned server.
 func (s *Server) MustSpawn() {
-	const nodeID = 100
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.addr != "" {
+		s.spawn(s.network, s.addr)
+	} else {
+		s.spawn("tcp4", ":0")
+	}
+}
 
+// MustSpawnOn runs server in the background on given network and address,
+// e.g. "tcp6" and "[::1]:0", like MustSpawn.
+func (s *Server) MustSpawnOn(network, addr string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.spawn(network, addr)
+}
+
+// MustSpawnTLS runs server in the background on a random port of 127.0.0.1,
+// like MustSpawn, serving TLS clients with the given configuration. The
+// server keeps using TLS when spawned again after Close.
+func (s *Server) MustSpawnTLS(cfg *tls.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tlsConfig = cfg
+	s.spawn("tcp4", "127.0.0.1:0")
+}
+
+// spawn serves clients in the background, unless the server is running
+// already. The caller must hold the lock.
+func (s *Server) spawn(network, addr string) {
 	if s.ln != nil {
 		return
 	}
+	ln, err := s.listen(network, addr)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	closing := s.closing
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go s.handleClient(conn, closing)
+		}
+	}()
+}
+
+// listen starts listening on given network and address, and advertises the
+// address in metadata. The caller must hold the lock.
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	if s.ln != nil {
+		return nil, fmt.Errorf("server already running: %s", s.ln.Addr())
+	}
 
-	ln, err := net.Listen("tcp4", ":0")
+	ln, err := net.Listen(network, addr)
 	if err != nil {
-		panic(fmt.Sprintf("cannot listen: %s", err))
+		return nil, fmt.Errorf("cannot listen on address %q: %s", addr, err)
+	}
+	host, port, err := splitHostPort(ln.Addr().String())
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
 	}
-	s.ln = ln
-	s.started = true
 
-	if host, port, err := net.SplitHostPort(ln.Addr().String()); err != nil {
-		panic(fmt.Sprintf("cannot extract host/port from %q: %s", ln.Addr(), err))
-	} else {
-		prt, err := strconv.Atoi(port)
-		if err != nil {
-			panic(fmt.Sprintf("invalid port %q: %s", port, err))
+	// on restart, the brokers added by SetLeader move along with the server
+	if oldHost, oldPort, err := splitHostPort(s.addr); err == nil {
+		for i, broker := range s.brokers {
+			if broker.Host == oldHost && broker.Port == oldPort {
+				s.brokers[i].Host = host
+				s.brokers[i].Port = port
+			}
 		}
+	} else {
 		s.brokers = append(s.brokers, proto.MetadataRespBroker{
-			NodeID: nodeID,
+			NodeID: s.nodeID,
 			Host:   host,
-			Port:   int32(prt),
+			Port:   port,
 		})
 	}
 
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err == nil {
-				go s.handleClient(nodeID, conn)
-			}
-		}
-	}()
+	s.ln = ln
+	s.network = network
+	s.addr = ln.Addr().String()
+	s.started = true
+	s.stopped = false
+	s.closing = make(chan struct{})
+	return ln, nil
+}
+
+// splitHostPort splits an address into its host, without brackets for IPv6,
+// and port.
+func splitHostPort(addr string) (string, int32, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot extract host/port from %q: %s", addr, err)
+	}
+	prt, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q: %s", port, err)
+	}
+	return host, int32(prt), nil
+}
+
+// LocalhostCertificate returns a new self-signed certificate for localhost,
+// 127.0.0.1 and ::1, to serve TLS clients with MustSpawnTLS. Its Leaf is
+// set, so that clients can trust it.
+func LocalhostCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// isClosedConnError returns true for the error of reading from a connection
+// that was closed on this side, e.g. by Close.
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
 }
 
-func (s *Server) handleClient(nodeID int32, conn net.Conn) {
+func (s *Server) handleClient(conn net.Conn, closing chan struct{}) {
+	defer s.wg.Done()
+
+	s.mu.Lock()
+	select {
+	case <-closing:
+		// accepted while closing
+		s.mu.Unlock()
+		_ = conn.Close()
+		return
+	default:
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
 	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
 		_ = conn.Close()
 	}()
 
 	for {
 		kind, b, err := proto.ReadReq(conn)
 		if err != nil {
-			if err != io.EOF {
-				log.Errorf("client read error: %s", err)
+			if err != io.EOF && !isClosedConnError(err) {
+				s.fail(conn, fmt.Errorf("client read error: %s", err))
 			}
 			return
 		}
+		req := s.record(kind, b, conn)
 
-		var resp response
+		resp, err := s.respond(conn, kind, b)
+		if err != nil {
+			s.fail(conn, err)
+			return
+		}
+		if !s.delay(kind, closing) {
+			return
+		}
+		b, err = resp.Bytes()
+		if err != nil {
+			s.fail(conn, fmt.Errorf("cannot serialize %T response: %s", resp, err))
+			return
+		}
+		if _, err := conn.Write(b); err != nil {
+			s.fail(conn, fmt.Errorf("cannot write %T response: %s", resp, err))
+			return
+		}
+		s.answer(req, closing)
+	}
+}
 
-		for _, middleware := range s.middlewares {
-			resp = middleware(nodeID, kind, b)
-			if resp != nil {
-				break
-			}
+// respond returns the response to request b of given kind, from the first
+// middleware that answers it, the middleware registered for its topic, or
+// the server itself. A middleware that panics fails the request.
+func (s *Server) respond(conn net.Conn, kind int16, b []byte) (resp Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot handle request %d: %v", kind, r)
 		}
+	}()
 
-		if resp == nil {
-			switch kind {
-			case proto.ProduceReqKind:
-				req, err := proto.ReadProduceReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse produce request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleProduceRequest(nodeID, conn, req)
-			case proto.FetchReqKind:
-				req, err := proto.ReadFetchReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse fetch request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleFetchRequest(nodeID, conn, req)
-			case proto.OffsetReqKind:
-				req, err := proto.ReadOffsetReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse offset request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleOffsetRequest(nodeID, conn, req)
-			case proto.MetadataReqKind:
-				req, err := proto.ReadMetadataReq(bytes.NewBuffer(b))
+	s.mu.RLock()
+	middlewares := s.middlewares
+	topicHandlers := make(map[string]Middleware, len(s.topicHandlers[kind]))
+	for topic, middleware := range s.topicHandlers[kind] {
+		topicHandlers[topic] = middleware
+	}
+	s.mu.RUnlock()
+
+	for _, middleware := range middlewares {
+		if resp = middleware(s.nodeID, kind, b); resp != nil {
+			return resp, nil
+		}
+	}
+
+	req, err := readRequest(kind, b)
+	if err != nil {
+		return nil, err
+	}
+	if len(topicHandlers) > 0 {
+		resp, err = s.routeTopics(conn, kind, b, req, topicHandlers)
+	} else {
+		resp = s.handleRequest(conn, req)
+	}
+	if err == nil && resp == nil {
+		err = fmt.Errorf("no response for %d", kind)
+	}
+	return resp, err
+}
+
+// readRequest decodes request b of given kind.
+func readRequest(kind int16, b []byte) (Response, error) {
+	var req Response
+	var err error
+	switch kind {
+	case proto.ProduceReqKind:
+		req, err = proto.ReadProduceReq(bytes.NewBuffer(b))
+	case proto.FetchReqKind:
+		req, err = proto.ReadFetchReq(bytes.NewBuffer(b))
+	case proto.OffsetReqKind:
+		req, err = proto.ReadOffsetReq(bytes.NewBuffer(b))
+	case proto.MetadataReqKind:
+		req, err = proto.ReadMetadataReq(bytes.NewBuffer(b))
+	case proto.OffsetCommitReqKind:
+		req, err = proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
+	case proto.OffsetFetchReqKind:
+		req, err = proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
+	case proto.GroupCoordinatorReqKind:
+		req, err = proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
+	case proto.APIVersionsReqKind:
+		req, err = proto.ReadAPIVersionsReq(bytes.NewBuffer(b))
+	default:
+		return nil, fmt.Errorf("unknown request: %d", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse request %d: %s", kind, err)
+	}
+	return req, nil
+}
+
+// handleRequest returns the response of the server itself to a decoded
+// request.
+func (s *Server) handleRequest(conn net.Conn, request Response) Response {
+	switch req := request.(type) {
+	case *proto.ProduceReq:
+		return s.handleProduceRequest(s.nodeID, conn, req)
+	case *proto.FetchReq:
+		s.awaitFetch(req)
+		return s.handleFetchRequest(s.nodeID, conn, req)
+	case *proto.OffsetReq:
+		return s.handleOffsetRequest(s.nodeID, conn, req)
+	case *proto.MetadataReq:
+		return s.handleMetadataRequest(s.nodeID, conn, req)
+	case *proto.OffsetCommitReq:
+		return s.handleOffsetCommitRequest(s.nodeID, conn, req)
+	case *proto.OffsetFetchReq:
+		return s.handleOffsetFetchRequest(s.nodeID, conn, req)
+	case *proto.GroupCoordinatorReq:
+		return s.handleGroupCoordinatorRequest(s.nodeID, conn, req)
+	case *proto.APIVersionsReq:
+		return s.handleAPIVersionsRequest(s.nodeID, conn, req)
+	}
+	return nil
+}
+
+// routeTopics returns the response to request req of given kind, encoded as
+// b, from the middlewares registered for its topics with HandleTopic, merged
+// with that of the server for the other topics.
+func (s *Server) routeTopics(
+	conn net.Conn, kind int16, b []byte, req Response, handlers map[string]Middleware) (Response, error) {
+
+	switch req := req.(type) {
+	case *proto.ProduceReq:
+		rest := *req
+		rest.Topics = nil
+		var resps []*proto.ProduceResp
+		for _, topic := range req.Topics {
+			if middleware, ok := handlers[topic.Name]; ok {
+				sub := *req
+				sub.Topics = []proto.ProduceReqTopic{topic}
+				resp, err := callTopicHandler(middleware, s.nodeID, kind, &sub)
 				if err != nil {
-					log.Errorf("cannot parse metadata request: %s\n%s", err, b)
-					return
+					return nil, err
 				}
-				resp = s.handleMetadataRequest(nodeID, conn, req)
-			case proto.OffsetCommitReqKind:
-				req, err := proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse offset commit request: %s\n%s", err, b)
-					return
+				if resp != nil {
+					produceResp, ok := resp.(*proto.ProduceResp)
+					if !ok {
+						return nil, fmt.Errorf("cannot merge %T into produce response", resp)
+					}
+					resps = append(resps, produceResp)
+					continue
 				}
-				resp = s.handleOffsetCommitRequest(nodeID, conn, req)
-			case proto.OffsetFetchReqKind:
-				req, err := proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
+			}
+			rest.Topics = append(rest.Topics, topic)
+		}
+		if len(rest.Topics) > 0 {
+			resps = append(resps, s.handleProduceRequest(s.nodeID, conn, &rest).(*proto.ProduceResp))
+		}
+		return mergeProduceResps(req, resps), nil
+	case *proto.FetchReq:
+		rest := *req
+		rest.Topics = nil
+		var resps []*proto.FetchResp
+		for _, topic := range req.Topics {
+			if middleware, ok := handlers[topic.Name]; ok {
+				sub := *req
+				sub.Topics = []proto.FetchReqTopic{topic}
+				resp, err := callTopicHandler(middleware, s.nodeID, kind, &sub)
 				if err != nil {
-					log.Errorf("cannot parse offset fetch request: %s\n%s", err, b)
-					return
+					return nil, err
 				}
-				resp = s.handleOffsetFetchRequest(nodeID, conn, req)
-			case proto.GroupCoordinatorReqKind:
-				req, err := proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse consumer metadata request: %s\n%s", err, b)
-					return
+				if resp != nil {
+					fetchResp, ok := resp.(*proto.FetchResp)
+					if !ok {
+						return nil, fmt.Errorf("cannot merge %T into fetch response", resp)
+					}
+					resps = append(resps, fetchResp)
+					continue
 				}
-				resp = s.handleGroupCoordinatorRequest(nodeID, conn, req)
-			default:
-				log.Errorf("unknown request: %d\n%s", kind, b)
-				return
 			}
+			rest.Topics = append(rest.Topics, topic)
+		}
+		if len(rest.Topics) > 0 {
+			s.awaitFetch(&rest)
+			resps = append(resps, s.handleFetchRequest(s.nodeID, conn, &rest).(*proto.FetchResp))
 		}
+		return mergeFetchResps(req, resps), nil
+	}
 
-		if resp == nil {
-			log.Errorf("no response for %d", kind)
-			return
+	if topic, ok := singleTopic(req); ok {
+		if middleware, ok := handlers[topic]; ok {
+			if resp := middleware(s.nodeID, kind, b); resp != nil {
+				return resp, nil
+			}
 		}
-		b, err = resp.Bytes()
-		if err != nil {
-			log.Errorf("cannot serialize %T response: %s", resp, err)
+	}
+	return s.handleRequest(conn, req), nil
+}
+
+// callTopicHandler passes the part of a request for a single topic to the
+// middleware registered for it.
+func callTopicHandler(middleware Middleware, nodeID int32, kind int16, req Response) (Response, error) {
+	b, err := req.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot serialize %T for topic handler: %s", req, err)
+	}
+	return middleware(nodeID, kind, b), nil
+}
+
+// singleTopic returns the topic of a request that isn't split by topic, if it
+// is for a single topic.
+func singleTopic(req Response) (string, bool) {
+	var names []string
+	switch req := req.(type) {
+	case *proto.MetadataReq:
+		names = req.Topics
+	case *proto.OffsetReq:
+		for _, t := range req.Topics {
+			names = append(names, t.Name)
 		}
-		if _, err := conn.Write(b); err != nil {
-			log.Errorf("cannot write %T response: %s", resp, err)
-			return
+	case *proto.OffsetCommitReq:
+		for _, t := range req.Topics {
+			names = append(names, t.Name)
+		}
+	case *proto.OffsetFetchReq:
+		for _, t := range req.Topics {
+			names = append(names, t.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	for _, name := range names[1:] {
+		if name != names[0] {
+			return "", false
+		}
+	}
+	return names[0], true
+}
+
+// mergeOrder returns the indexes of the responded topics in the order the
+// topics are requested, followed by topics that weren't requested.
+func mergeOrder(requested, responded []string) []int {
+	order := make([]int, 0, len(responded))
+	added := make(map[string]bool)
+	for _, name := range requested {
+		if added[name] {
+			continue
+		}
+		added[name] = true
+		for i, n := range responded {
+			if n == name {
+				order = append(order, i)
+			}
+		}
+	}
+	for i, n := range responded {
+		if !added[n] {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// mergeProduceResps merges the responses to the parts of produce request req
+// into a response to the whole request.
+func mergeProduceResps(req *proto.ProduceReq, resps []*proto.ProduceResp) *proto.ProduceResp {
+	merged := &proto.ProduceResp{
+		Version:       req.Version,
+		CorrelationID: req.CorrelationID,
+	}
+	var requested, responded []string
+	var topics []proto.ProduceRespTopic
+	for _, t := range req.Topics {
+		requested = append(requested, t.Name)
+	}
+	for _, resp := range resps {
+		for _, t := range resp.Topics {
+			topics = append(topics, t)
+			responded = append(responded, t.Name)
+		}
+		if resp.ThrottleTime > merged.ThrottleTime {
+			merged.ThrottleTime = resp.ThrottleTime
+		}
+	}
+	for _, i := range mergeOrder(requested, responded) {
+		merged.Topics = append(merged.Topics, topics[i])
+	}
+	return merged
+}
+
+// mergeFetchResps merges the responses to the parts of fetch request req into
+// a response to the whole request.
+func mergeFetchResps(req *proto.FetchReq, resps []*proto.FetchResp) *proto.FetchResp {
+	merged := &proto.FetchResp{
+		Version:       req.Version,
+		CorrelationID: req.CorrelationID,
+	}
+	if len(resps) > 0 {
+		merged.Compression = resps[0].Compression
+	}
+	var requested, responded []string
+	var topics []proto.FetchRespTopic
+	for _, t := range req.Topics {
+		requested = append(requested, t.Name)
+	}
+	for _, resp := range resps {
+		for _, t := range resp.Topics {
+			topics = append(topics, t)
+			responded = append(responded, t.Name)
 		}
 	}
+	for _, i := range mergeOrder(requested, responded) {
+		merged.Topics = append(merged.Topics, topics[i])
+	}
+	return merged
 }
 
 type response interface {
 	Bytes() ([]byte, error)
 }
 
+// validateProduce returns the error a broker answers the part of produce
+// request req for given partition with, if it is invalid and the server is
+// strict. The caller must hold the lock.
+func (s *Server) validateProduce(req *proto.ProduceReq, topic string, part proto.ProduceReqPartition) error {
+	if !s.strict {
+		return nil
+	}
+	switch {
+	case req.RequiredAcks < proto.RequiredAcksAll || req.RequiredAcks > proto.RequiredAcksLocal:
+		return proto.ErrInvalidRequiredAcks
+	case topic == "":
+		return proto.ErrInvalidTopic
+	case part.ID < 0:
+		return proto.ErrUnknownTopicOrPartition
+	}
+	// Compressed messages are decoded, so the crc of every message covers
+	// it uncompressed. Messages of format 2 have no crc of their own, their
+	// record batch was checked when decoding it.
+	for _, msg := range part.Messages {
+		if msg.Format < 2 && msg.Crc != proto.ComputeCrc(msg, proto.CompressionNone) {
+			return proto.ErrInvalidMessage
+		}
+	}
+	return nil
+}
+
 func (s *Server) handleProduceRequest(
 	nodeID int32, conn net.Conn, req *proto.ProduceReq) response {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	inj := s.injection(proto.ProduceReqKind)
+	defer inj.done()
+
 	resp := &proto.ProduceResp{
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.ProduceRespTopic, len(req.Topics)),
 	}
 
 	for ti, topic := range req.Topics {
-		t, ok := s.topics[topic.Name]
-		if !ok {
-			t = make(map[int32][]*proto.Message)
-			s.topics[topic.Name] = t
-		}
-
 		respParts := make([]proto.ProduceRespPartition, len(topic.Partitions))
 		resp.Topics[ti].Name = topic.Name
 		resp.Topics[ti].Partitions = respParts
 
 		for pi, part := range topic.Partitions {
-			p, ok := t[part.ID]
+			respParts[pi].ID = part.ID
+			if err := inj.err(topic.Name, part.ID); err != nil {
+				respParts[pi].Err = err
+				respParts[pi].Offset = -1
+				continue
+			}
+			if err := s.validateProduce(req, topic.Name, part); err != nil {
+				respParts[pi].Err = err
+				respParts[pi].Offset = -1
+				continue
+			}
+			if s.notLeader(topic.Name, part.ID) {
+				respParts[pi].Err = proto.ErrNotLeaderForPartition
+				continue
+			}
+
+			t, ok := s.topics[topic.Name]
 			if !ok {
-				p = make([]*proto.Message, 0)
-				t[part.ID] = p
+				t = make(map[int32][]*proto.Message)
+				s.topics[topic.Name] = t
+			}
+			if _, ok := t[part.ID]; !ok {
+				t[part.ID] = make([]*proto.Message, 0)
 			}
 
 			log.Infof("produced %d messages to %s:%d at offset %d",
 				len(part.Messages), topic.Name, part.ID, len(t[part.ID]))
-			for _, msg := range part.Messages {
-				msg.Offset = int64(len(t[part.ID]))
-				msg.Topic = topic.Name
-				t[part.ID] = append(t[part.ID], msg)
-			}
+			s.appendMessages(topic.Name, part.ID, part.Messages)
 
-			respParts[pi].ID = part.ID
 			respParts[pi].Offset = int64(len(t[part.ID])) - 1
 		}
 	}
 	return resp
 }
 
+// awaitFetch holds fetch request req until the messages after the fetched
+// offsets amount to its MinBytes, for at most its MaxWaitTime, or until the
+// server is closed.
+func (s *Server) awaitFetch(req *proto.FetchReq) {
+	if req.MinBytes <= 0 || req.MaxWaitTime <= 0 {
+		return
+	}
+	deadline := time.NewTimer(req.MaxWaitTime)
+	defer deadline.Stop()
+
+	for {
+		s.mu.RLock()
+		ready := s.fetchReady(req)
+		stored, closing := s.stored, s.closing
+		s.mu.RUnlock()
+
+		if ready {
+			return
+		}
+		select {
+		case <-stored:
+		case <-closing:
+			return
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+// fetchReady returns true if fetch request req can be answered right away,
+// either with at least MinBytes of messages or with an error. The caller
+// must hold the lock.
+func (s *Server) fetchReady(req *proto.FetchReq) bool {
+	var size int
+	for _, topic := range req.Topics {
+		for _, part := range topic.Partitions {
+			messages, ok := s.topics[topic.Name][part.ID]
+			if !ok || s.notLeader(topic.Name, part.ID) || part.FetchOffset < 0 {
+				return true
+			}
+			for _, inj := range s.injected {
+				if inj.count != 0 && inj.matches(proto.FetchReqKind, topic.Name, part.ID) {
+					return true
+				}
+			}
+			if part.FetchOffset >= int64(len(messages)) {
+				continue
+			}
+			for _, msg := range messages[part.FetchOffset:] {
+				// offset, size, crc, magic byte, attributes, key and value
+				size += 8 + 4 + 4 + 1 + 1 + 4 + len(msg.Key) + 4 + len(msg.Value)
+			}
+		}
+	}
+	return size >= int(req.MinBytes)
+}
+
 func (s *Server) handleFetchRequest(
 	nodeID int32, conn net.Conn, req *proto.FetchReq) response {
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inj := s.injection(proto.FetchReqKind)
+	defer inj.done()
 
 	resp := &proto.FetchResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
+		Compression:   s.fetchCompression,
 		Topics:        make([]proto.FetchRespTopic, len(req.Topics)),
 	}
 	for ti, topic := range req.Topics {
@@ -426,6 +1498,14 @@ func (s *Server) handleFetchRequest(
 		resp.Topics[ti].Partitions = respParts
 		for pi, part := range topic.Partitions {
 			respParts[pi].ID = part.ID
+			if err := inj.err(topic.Name, part.ID); err != nil {
+				respParts[pi].Err = err
+				continue
+			}
+			if s.notLeader(topic.Name, part.ID) {
+				respParts[pi].Err = proto.ErrNotLeaderForPartition
+				continue
+			}
 
 			partitions, ok := s.topics[topic.Name]
 			if !ok {
@@ -437,12 +1517,16 @@ func (s *Server) handleFetchRequest(
 				respParts[pi].Err = proto.ErrUnknownTopicOrPartition
 				continue
 			}
-			if part.FetchOffset > int64(len(messages)) {
+			if part.FetchOffset < 0 {
 				respParts[pi].Err = proto.ErrOffsetOutOfRange
 				continue
 			}
 			respParts[pi].TipOffset = int64(len(messages))
-			respParts[pi].Messages = messages[part.FetchOffset:]
+			// like a broker waiting for new messages, an offset beyond
+			// the tip gets no messages rather than an error
+			if part.FetchOffset < int64(len(messages)) {
+				respParts[pi].Messages = messages[part.FetchOffset:]
+			}
 			numFetched := len(respParts[pi].Messages)
 			if numFetched > 0 || !strings.HasPrefix(topic.Name, "__") {
 				log.Infof("fetched %d messages from %s:%d at offset %d",
@@ -457,8 +1541,11 @@ func (s *Server) handleFetchRequest(
 func (s *Server) handleOffsetRequest(
 	nodeID int32, conn net.Conn, req *proto.OffsetReq) response {
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inj := s.injection(proto.OffsetReqKind)
+	defer inj.done()
 
 	resp := &proto.OffsetResp{
 		CorrelationID: req.CorrelationID,
@@ -470,6 +1557,23 @@ func (s *Server) handleOffsetRequest(
 		resp.Topics[ti].Partitions = respPart
 		for pi, part := range topic.Partitions {
 			respPart[pi].ID = part.ID
+			if err := inj.err(topic.Name, part.ID); err != nil {
+				respPart[pi].Err = err
+				continue
+			}
+			seeded := s.seeded[topicPartition{topic: topic.Name, partition: part.ID}]
+			if offset, ok := seeded[part.TimeMs]; ok {
+				respPart[pi].Offsets = []int64{offset}
+				log.Infof("requested offset %d from %s:%d, returning set %d",
+					part.TimeMs, topic.Name, part.ID, offset)
+				continue
+			}
+			if _, ok := s.topics[topic.Name][part.ID]; !ok && seeded == nil {
+				respPart[pi].Offsets = []int64{0}
+				respPart[pi].Err = proto.ErrUnknownTopicOrPartition
+				continue
+			}
+
 			switch part.TimeMs {
 			case -1: // latest
 				msgs := len(s.topics[topic.Name][part.ID])
@@ -481,40 +1585,103 @@ func (s *Server) handleOffsetRequest(
 				log.Infof("requested earliest offset from %s:%d, returning %d",
 					topic.Name, part.ID, 0)
 			default:
-				log.Errorf("offset time for %s:%d not supported: %d",
-					topic.Name, part.ID, part.TimeMs)
-				return nil
+				// like a broker writing every message to a log segment
+				// of its own, return the offsets of the messages
+				// written before the time, latest first
+				offsets := offsetsBefore(s.topics[topic.Name][part.ID], part.TimeMs)
+				respPart[pi].Offsets = offsets
+				log.Infof("requested offset before %d from %s:%d, returning %v",
+					part.TimeMs, topic.Name, part.ID, offsets)
 			}
 
 			// Now if they've asked for fewer, cut some off -- unclear if this
 			// is correct but it seems so given what we support right now
-			respPart[pi].Offsets = respPart[pi].Offsets[0:part.MaxOffsets]
+			if int(part.MaxOffsets) < len(respPart[pi].Offsets) {
+				respPart[pi].Offsets = respPart[pi].Offsets[0:part.MaxOffsets]
+			}
 		}
 	}
 	return resp
 }
 
-func (s *Server) handleGroupCoordinatorRequest(
-	nodeID int32, conn net.Conn, req *proto.GroupCoordinatorReq) response {
+// offsetsBefore returns the offsets of the messages with a timestamp before
+// or at timeMs, latest first, preceded by the offset of the next message if
+// timeMs is not in the past. Messages without timestamp count as written
+// before any time.
+func offsetsBefore(messages []*proto.Message, timeMs int64) []int64 {
+	t := time.Unix(0, timeMs*int64(time.Millisecond))
+	var offsets []int64
+	if !t.Before(time.Now()) {
+		offsets = append(offsets, int64(len(messages)))
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if !messages[i].Timestamp.After(t) {
+			offsets = append(offsets, int64(i))
+		}
+	}
+	return offsets
+}
+
+// apiVersions are the versions of the requests the server answers.
+var apiVersions = []proto.APIVersion{
+	{APIKey: proto.ProduceReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: proto.FetchReqKind, MinVersion: 0, MaxVersion: 10},
+	{APIKey: proto.OffsetReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: proto.MetadataReqKind, MinVersion: 0, MaxVersion: 1},
+	{APIKey: proto.OffsetCommitReqKind, MinVersion: 0, MaxVersion: 2},
+	{APIKey: proto.OffsetFetchReqKind, MinVersion: 0, MaxVersion: 1},
+	{APIKey: proto.GroupCoordinatorReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: proto.APIVersionsReqKind, MinVersion: 0, MaxVersion: 0},
+}
 
-	// Fetches the read-lock, so try not to do this inside our own RLock
-	// as that can lead to deadlock state if someone happens to try to Lock
-	// while we're inside the first RLock
-	addr := s.Addr()
+func (s *Server) handleAPIVersionsRequest(
+	nodeID int32, conn net.Conn, req *proto.APIVersionsReq) response {
 
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	log.Infof("requested api versions")
+
+	versions := apiVersions
+	if len(s.apiVersions) > 0 {
+		versions = s.apiVersions
+	}
+	return &proto.APIVersionsResp{
+		CorrelationID: req.CorrelationID,
+		APIVersions:   versions,
+	}
+}
+
+func (s *Server) handleGroupCoordinatorRequest(
+	nodeID int32, conn net.Conn, req *proto.GroupCoordinatorReq) response {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	log.Infof("requested consumer metadata")
 
-	addrps := strings.Split(addr, ":")
-	port, _ := strconv.Atoi(addrps[1])
+	inj := s.injection(proto.GroupCoordinatorReqKind)
+	defer inj.done()
+	if err := inj.err("", -1); err != nil {
+		return &proto.GroupCoordinatorResp{
+			CorrelationID: req.CorrelationID,
+			Err:           err,
+		}
+	}
 
+	host, port, err := splitHostPort(s.addr)
+	if err != nil {
+		log.Errorf("%s", err)
+		return &proto.GroupCoordinatorResp{
+			CorrelationID: req.CorrelationID,
+			Err:           proto.ErrNoCoordinator,
+		}
+	}
 	return &proto.GroupCoordinatorResp{
 		CorrelationID:   req.CorrelationID,
-		CoordinatorID:   0,
-		CoordinatorHost: addrps[0],
-		CoordinatorPort: int32(port),
+		CoordinatorID:   nodeID,
+		CoordinatorHost: host,
+		CoordinatorPort: port,
 	}
 }
 
@@ -546,6 +1713,9 @@ func (s *Server) handleOffsetFetchRequest(
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	inj := s.injection(proto.OffsetFetchReqKind)
+	defer inj.done()
+
 	resp := &proto.OffsetFetchResp{
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.OffsetFetchRespTopic, len(req.Topics)),
@@ -555,8 +1725,19 @@ func (s *Server) handleOffsetFetchRequest(
 		resp.Topics[ti].Name = topic.Name
 		resp.Topics[ti].Partitions = respPart
 		for pi, part := range topic.Partitions {
-			toffset := s.getTopicOffset(req.ConsumerGroup, topic.Name, part)
 			respPart[pi].ID = part
+			if err := inj.err(topic.Name, part); err != nil {
+				respPart[pi].Offset = -1
+				respPart[pi].Err = err
+				continue
+			}
+			// like a broker, report partitions without a committed
+			// offset with offset -1 and no error
+			toffset, ok := s.offsets[topic.Name][part][req.ConsumerGroup]
+			if !ok {
+				respPart[pi].Offset = -1
+				continue
+			}
 			respPart[pi].Metadata = toffset.metadata
 			respPart[pi].Offset = toffset.offset
 			log.Infof("requested committed offset for group %s from %s:%d, returning %d",
@@ -572,6 +1753,9 @@ func (s *Server) handleOffsetCommitRequest(
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	inj := s.injection(proto.OffsetCommitReqKind)
+	defer inj.done()
+
 	resp := &proto.OffsetCommitResp{
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.OffsetCommitRespTopic, len(req.Topics)),
@@ -581,11 +1765,15 @@ func (s *Server) handleOffsetCommitRequest(
 		resp.Topics[ti].Name = topic.Name
 		resp.Topics[ti].Partitions = respPart
 		for pi, part := range topic.Partitions {
+			respPart[pi].ID = part.ID
+			if err := inj.err(topic.Name, part.ID); err != nil {
+				respPart[pi].Err = err
+				continue
+			}
+
 			toffset := s.getTopicOffset(req.ConsumerGroup, topic.Name, part.ID)
 			toffset.metadata = part.Metadata
 			toffset.offset = part.Offset
-
-			respPart[pi].ID = part.ID
 			log.Infof("committed offset for group %s from %s:%d, saved %d",
 				req.ConsumerGroup, topic.Name, part.ID, part.Offset)
 		}
@@ -601,13 +1789,25 @@ func (s *Server) handleMetadataRequest(
 
 	log.Infof("requested metadata")
 
+	inj := s.injection(proto.MetadataReqKind)
+	defer inj.done()
+
 	resp := &proto.MetadataResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.MetadataRespTopic, 0, len(s.topics)),
 		Brokers:       s.brokers,
 	}
+	if s.cluster != nil {
+		resp.Brokers = s.cluster.brokers()
+	}
+	if s.metaBrokers != nil {
+		resp.Brokers = s.metaBrokers
+	}
 
-	if req.Topics != nil && len(req.Topics) > 0 {
+	if s.metaTopics != nil {
+		resp.Topics = configuredTopics(s.metaTopics, req.Topics)
+	} else if req.Topics != nil && len(req.Topics) > 0 {
 		// if particular topic was requested, create empty log if does not yet exists
 		for _, name := range req.Topics {
 			partitions, ok := s.topics[name]
@@ -617,14 +1817,7 @@ func (s *Server) handleMetadataRequest(
 				s.topics[name] = partitions
 			}
 
-			parts := make([]proto.MetadataRespPartition, len(partitions))
-			for pid := range partitions {
-				p := &parts[pid]
-				p.ID = pid
-				p.Leader = nodeID
-				p.Replicas = []int32{nodeID}
-				p.Isrs = []int32{nodeID}
-			}
+			parts := s.metadataPartitions(nodeID, name, partitions, inj)
 			resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
 				Name:       name,
 				Partitions: parts,
@@ -633,14 +1826,7 @@ func (s *Server) handleMetadataRequest(
 		}
 	} else {
 		for name, partitions := range s.topics {
-			parts := make([]proto.MetadataRespPartition, len(partitions))
-			for pid := range partitions {
-				p := &parts[pid]
-				p.ID = pid
-				p.Leader = nodeID
-				p.Replicas = []int32{nodeID}
-				p.Isrs = []int32{nodeID}
-			}
+			parts := s.metadataPartitions(nodeID, name, partitions, inj)
 			resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
 				Name:       name,
 				Partitions: parts,
@@ -649,3 +1835,169 @@ func (s *Server) handleMetadataRequest(
 	}
 	return resp
 }
+
+// configuredTopics returns the topics of configured that are requested, or
+// all of them if none are.
+func configuredTopics(configured []proto.MetadataRespTopic, requested []string) []proto.MetadataRespTopic {
+	if len(requested) == 0 {
+		return configured
+	}
+	topics := make([]proto.MetadataRespTopic, 0, len(requested))
+	for _, name := range requested {
+		topic := proto.MetadataRespTopic{Name: name, Err: proto.ErrUnknownTopicOrPartition}
+		for _, t := range configured {
+			if t.Name == name {
+				topic = t
+				break
+			}
+		}
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// metadataPartitions returns the metadata of the partitions of a topic. Moved
+// leaders are reported and no longer rejected from then on. Partitions led
+// by a stopped server of the cluster have no leader.
+func (s *Server) metadataPartitions(
+	nodeID int32, topic string, partitions map[int32][]*proto.Message, inj *injection) []proto.MetadataRespPartition {
+
+	parts := make([]proto.MetadataRespPartition, len(partitions))
+	for pid := range partitions {
+		leader := s.leader(nodeID, topic, pid)
+		p := &parts[pid]
+		p.ID = pid
+		p.Leader = leader
+		p.Replicas = []int32{leader}
+		p.Isrs = []int32{leader}
+		p.Err = inj.err(topic, pid)
+		if s.cluster != nil && s.cluster.Server(leader).stopped {
+			p.Leader = -1
+			p.Isrs = []int32{}
+			if p.Err == nil {
+				p.Err = proto.ErrLeaderNotAvailable
+			}
+		}
+		delete(s.moved, topicPartition{topic: topic, partition: pid})
+	}
+	return parts
+}
+
+// Cluster is a number of servers that share their topics and committed
+// offsets, to simulate a cluster of brokers. Every partition is led by one
+// of the servers, the others answer produce and fetch requests for it with
+// proto.ErrNotLeaderForPartition.
+type Cluster struct {
+	servers []*Server
+
+	// leaders holds the partitions moved by SetLeader. It's protected by
+	// the lock the servers share.
+	leaders map[topicPartition]int32
+}
+
+// NewCluster returns a cluster of n running servers, with node IDs starting
+// from 100. Partition p is led by the server with node ID 100 + p % n, until
+// it's moved with SetLeader.
+func NewCluster(n int) *Cluster {
+	cluster := &Cluster{leaders: make(map[topicPartition]int32)}
+	for i := 0; i < n; i++ {
+		s := NewServer()
+		s.nodeID = int32(100 + i)
+		s.cluster = cluster
+		if i > 0 {
+			first := cluster.servers[0]
+			s.mu = first.mu
+			s.topics = first.topics
+			s.offsets = first.offsets
+			s.seeded = first.seeded
+		}
+		cluster.servers = append(cluster.servers, s)
+	}
+	for _, s := range cluster.servers {
+		s.MustSpawn()
+	}
+	return cluster
+}
+
+// Server returns the server with given node ID, or nil.
+func (c *Cluster) Server(nodeID int32) *Server {
+	for _, s := range c.servers {
+		if s.nodeID == nodeID {
+			return s
+		}
+	}
+	return nil
+}
+
+// Addrs returns the addresses of the servers, to bootstrap clients with.
+func (c *Cluster) Addrs() []string {
+	addrs := make([]string, len(c.servers))
+	for i, s := range c.servers {
+		addrs[i] = s.Addr()
+	}
+	return addrs
+}
+
+// AddMessages adds messages to a partition like Server.AddMessages, no
+// matter which server leads it.
+func (c *Cluster) AddMessages(topic string, partition int32, messages ...*proto.Message) {
+	c.servers[0].AddMessages(topic, partition, messages...)
+}
+
+// SetLeader moves the leadership of the partition to the server with given
+// node ID. Clients learn about it from the next metadata response, until
+// then the previous leader answers their requests for the partition with
+// proto.ErrNotLeaderForPartition.
+func (c *Cluster) SetLeader(topic string, partition int32, nodeID int32) {
+	mu := c.servers[0].mu
+	mu.Lock()
+	defer mu.Unlock()
+
+	c.leaders[topicPartition{topic: topic, partition: partition}] = nodeID
+}
+
+// StopBroker closes the server with given node ID, as if the broker went
+// away. Metadata no longer lists it, and reports the partitions it leads
+// without leader. It can be spawned again with MustSpawn.
+func (c *Cluster) StopBroker(nodeID int32) {
+	if s := c.Server(nodeID); s != nil {
+		_ = s.Close()
+	}
+}
+
+// Close closes all servers of the cluster.
+func (c *Cluster) Close() {
+	for _, s := range c.servers {
+		_ = s.Close()
+	}
+}
+
+// leader returns the node ID of the server that leads the partition. The
+// caller must hold the lock of the servers.
+func (c *Cluster) leader(topic string, partition int32) int32 {
+	if leader, ok := c.leaders[topicPartition{topic: topic, partition: partition}]; ok {
+		return leader
+	}
+	return c.servers[int(partition)%len(c.servers)].nodeID
+}
+
+// brokers returns the running servers, as listed in metadata. The caller
+// must hold the lock of the servers.
+func (c *Cluster) brokers() []proto.MetadataRespBroker {
+	var brokers []proto.MetadataRespBroker
+	for _, s := range c.servers {
+		if s.stopped || s.ln == nil {
+			continue
+		}
+		host, port, err := splitHostPort(s.addr)
+		if err != nil {
+			continue
+		}
+		brokers = append(brokers, proto.MetadataRespBroker{
+			NodeID: s.nodeID,
+			Host:   host,
+			Port:   port,
+		})
+	}
+	return brokers
+}
@@ -0,0 +1,1037 @@
+package kafkatest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zorkian/kafka"
+	"github.com/zorkian/kafka/proto"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&ServerSuite{})
+
+type ServerSuite struct{}
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *ServerSuite) newBroker(c *C, srv *Server) *kafka.Broker {
+	conf := kafka.NewBrokerConf("tester")
+	conf.LeaderRetryWait = 5 * time.Millisecond
+	broker, err := kafka.NewBroker("test-cluster", []string{srv.Addr()}, conf)
+	c.Assert(err, IsNil)
+	return broker
+}
+
+// produceEventually produces a message until it succeeds, for up to a second.
+func produceEventually(producer kafka.Producer, topic string, partition int32) error {
+	var err error
+	for i := 0; i < 100; i++ {
+		if _, err = producer.Produce(topic, partition, &proto.Message{Value: []byte("msg")}); err == nil {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+func (s *ServerSuite) TestSetLeader(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddMessages("test", 1)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	producer := broker.Producer(kafka.NewProducerConf())
+	_, err := producer.Produce("test", 1, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+
+	// the client learns about the new leader from the metadata
+	srv.SetLeader("test", 1, 101)
+	_, err = producer.Produce("test", 1, &proto.Message{Value: []byte("second")})
+	c.Assert(err, IsNil)
+	meta, err := broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(meta.Brokers, HasLen, 2)
+	c.Assert(meta.Brokers[1].NodeID, Equals, int32(101))
+	for _, topic := range meta.Topics {
+		c.Assert(topic.Partitions[1].Leader, Equals, int32(101))
+		c.Assert(topic.Partitions[0].Leader, Equals, int32(100))
+	}
+
+	// other partitions are not affected
+	_, err = producer.Produce("test", 0, &proto.Message{Value: []byte("other")})
+	c.Assert(err, IsNil)
+}
+
+func (s *ServerSuite) TestLeaderChangeMidStream(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddMessages("test", 0)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	prodConf := kafka.NewProducerConf()
+	prodConf.RetryWait = time.Millisecond
+	producer := broker.Producer(prodConf)
+	consConf := kafka.NewConsumerConf("test", 0)
+	consConf.StartOffset = 0
+	consConf.RetryErrWait = time.Millisecond
+	consumer, err := broker.Consumer(consConf)
+	c.Assert(err, IsNil)
+
+	// the leader moves while messages are produced and consumed, without
+	// either of them failing
+	for i := 0; i < 10; i++ {
+		if i == 3 {
+			srv.SetLeader("test", 0, 101)
+		}
+		if i == 7 {
+			srv.SetLeader("test", 0, 102)
+		}
+		value := strconv.Itoa(i)
+		offset, err := producer.Produce("test", 0, &proto.Message{Value: []byte(value)})
+		c.Assert(err, IsNil)
+		c.Assert(offset, Equals, int64(i))
+
+		if i == 5 {
+			srv.SetLeader("test", 0, 100)
+		}
+		msg, err := consumer.Consume()
+		c.Assert(err, IsNil)
+		c.Assert(string(msg.Value), Equals, value)
+	}
+
+	meta, err := broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(meta.Topics[0].Partitions[0].Leader, Equals, int32(102))
+}
+
+func (s *ServerSuite) TestCloseConnections(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddMessages("test", 0)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	producer := broker.Producer(kafka.NewProducerConf())
+	_, err := producer.Produce("test", 0, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+
+	srv.CloseConnections()
+	srv.mu.RLock()
+	c.Assert(srv.conns, HasLen, 0)
+	srv.mu.RUnlock()
+
+	// the client reconnects
+	c.Assert(produceEventually(producer, "test", 0), IsNil)
+	srv.mu.RLock()
+	c.Assert(len(srv.topics["test"][0]) >= 2, Equals, true)
+	srv.mu.RUnlock()
+}
+
+func (s *ServerSuite) TestProducerCrc(c *C) {
+	broker := NewBroker()
+	producer := broker.Producer(kafka.NewProducerConf())
+
+	messages := []*proto.Message{
+		{Value: []byte("format 0")},
+		{Value: []byte("format 1"), Format: 1, Timestamp: time.Unix(1500000000, 0)},
+	}
+	go producer.Produce("test", 0, messages...)
+	produced, err := broker.ReadProducers(time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(produced.Messages, HasLen, 2)
+
+	// the crc covers the format and the timestamp of format 1
+	msg := *produced.Messages[1]
+	c.Assert(msg.Crc, Not(Equals), uint32(0))
+	msg.Timestamp = time.Time{}
+	c.Assert(proto.ComputeCrc(&msg, proto.CompressionNone), Not(Equals), produced.Messages[1].Crc)
+	msg.Format = 0
+	c.Assert(proto.ComputeCrc(&msg, proto.CompressionNone), Not(Equals), produced.Messages[1].Crc)
+}
+
+// newSeekConsumer returns a consumer of the partition that gives up waiting
+// for new messages after a few fetches.
+func (s *ServerSuite) newSeekConsumer(c *C, broker *kafka.Broker, partition int32) kafka.SeekConsumer {
+	conf := kafka.NewConsumerConf("test", partition)
+	conf.StartOffset = 0
+	conf.RetryWait = time.Millisecond
+	conf.RetryLimit = 2
+	consumer, err := broker.Consumer(conf)
+	c.Assert(err, IsNil)
+	return consumer.(kafka.SeekConsumer)
+}
+
+func (s *ServerSuite) TestConsumerSeekTo(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	for i := 0; i < 5; i++ {
+		srv.AddMessages("test", 0, &proto.Message{Value: []byte(strconv.Itoa(i))})
+	}
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	seeker := s.newSeekConsumer(c, broker, 0)
+	consumer := seeker.(kafka.Consumer)
+	for i := int64(0); i < 3; i++ {
+		msg, err := consumer.Consume()
+		c.Assert(err, IsNil)
+		c.Assert(msg.Offset, Equals, i)
+	}
+
+	// the buffered messages are discarded when seeking backwards
+	c.Assert(seeker.SeekTo(1), IsNil)
+	for i := int64(1); i < 5; i++ {
+		msg, err := consumer.Consume()
+		c.Assert(err, IsNil)
+		c.Assert(msg.Offset, Equals, i)
+		c.Assert(string(msg.Value), Equals, strconv.Itoa(int(i)))
+	}
+
+	// offsets outside of the partition are refused
+	c.Assert(seeker.SeekTo(6), Equals, proto.ErrOffsetOutOfRange)
+	c.Assert(seeker.SeekTo(-1), Equals, proto.ErrOffsetOutOfRange)
+	_, err := consumer.Consume()
+	c.Assert(err, Equals, kafka.ErrNoData)
+
+	// seeking to the tip waits for the next message
+	c.Assert(seeker.SeekTo(3), IsNil)
+	c.Assert(seeker.SeekTo(5), IsNil)
+	_, err = consumer.Consume()
+	c.Assert(err, Equals, kafka.ErrNoData)
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("5")})
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(msg.Offset, Equals, int64(5))
+}
+
+func (s *ServerSuite) TestConsumerSeekToWhileConsuming(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("0")}, &proto.Message{Value: []byte("1")})
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	conf := kafka.NewConsumerConf("test", 0)
+	conf.StartOffset = 2
+	conf.RetryWait = time.Millisecond
+	consumer, err := broker.Consumer(conf)
+	c.Assert(err, IsNil)
+
+	// the blocked call returns the message at the new offset
+	consumed := make(chan *proto.Message)
+	go func() {
+		msg, err := consumer.Consume()
+		c.Check(err, IsNil)
+		consumed <- msg
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(consumer.(kafka.SeekConsumer).SeekTo(0), IsNil)
+	select {
+	case msg := <-consumed:
+		c.Assert(msg, NotNil)
+		c.Assert(msg.Offset, Equals, int64(0))
+	case <-time.After(time.Second):
+		c.Fatal("consumer did not return the message at the new offset")
+	}
+}
+
+func (s *ServerSuite) TestOffsetForTime(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	// a message every half hour from 13:00 to 14:30
+	start := time.Date(2017, 6, 1, 13, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		srv.AddMessages("test", 0, &proto.Message{
+			Value:     []byte(strconv.Itoa(i)),
+			Format:    1,
+			Timestamp: start.Add(time.Duration(i) * 30 * time.Minute),
+		})
+	}
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+
+	offset, err := broker.OffsetForTime("test", 0, start.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(2))
+
+	// messages written before the time may be returned as well
+	offset, err = broker.OffsetForTime("test", 0, start.Add(70*time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(2))
+
+	// before all messages, the oldest offset is returned
+	offset, err = broker.OffsetForTime("test", 0, start.Add(-time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(0))
+
+	// after all messages, the offset of the next one is returned
+	offset, err = broker.OffsetForTime("test", 0, time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(4))
+
+	// replay from 14:00
+	seeker := s.newSeekConsumer(c, broker, 0)
+	consumer := seeker.(kafka.Consumer)
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(msg.Offset, Equals, int64(0))
+	offset, err = broker.OffsetForTime("test", 0, start.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(seeker.SeekTo(offset), IsNil)
+	msg, err = consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "2")
+	c.Assert(msg.Timestamp.Equal(start.Add(time.Hour)), Equals, true)
+}
+
+func (s *ServerSuite) TestOffsetForTimeUnknownTopic(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conf := kafka.NewBrokerConf("tester")
+	conf.LeaderRetryLimit = 2
+	conf.LeaderRetryWait = time.Millisecond
+	broker, err := kafka.NewBroker("test-cluster", []string{srv.Addr()}, conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	_, err = broker.OffsetForTime("missing", 0, time.Now())
+	c.Assert(err, Equals, proto.ErrUnknownTopicOrPartition)
+}
+func (s *ServerSuite) TestSetOffset(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("first")})
+	srv.AddMessages("retained", 0)
+	srv.SetOffset("test", 0, -2, 40)
+	srv.SetOffset("retained", 0, -1, 12)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+
+	offset, err := broker.OffsetEarliest("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(40))
+	offset, err = broker.OffsetLatest("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(1))
+
+	offset, err = broker.OffsetLatest("retained", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(12))
+	offset, err = broker.OffsetEarliest("retained", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(0))
+}
+
+func (s *ServerSuite) TestOffsetUnknownPartition(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.SetOffset("seeded", 0, -1, 7)
+
+	resp := srv.handleOffsetRequest(0, nil, &proto.OffsetReq{
+		Topics: []proto.OffsetReqTopic{
+			{Name: "test", Partitions: []proto.OffsetReqPartition{{ID: 0, TimeMs: -1, MaxOffsets: 1}, {ID: 1, TimeMs: -1, MaxOffsets: 1}}},
+			{Name: "missing", Partitions: []proto.OffsetReqPartition{{ID: 0, TimeMs: -2, MaxOffsets: 1}}},
+			{Name: "seeded", Partitions: []proto.OffsetReqPartition{{ID: 0, TimeMs: -1, MaxOffsets: 1}}},
+		},
+	}).(*proto.OffsetResp)
+
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Offsets, DeepEquals, []int64{0})
+	c.Assert(resp.Topics[0].Partitions[1].Err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(resp.Topics[0].Partitions[1].Offsets, DeepEquals, []int64{0})
+	c.Assert(resp.Topics[1].Partitions[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(resp.Topics[2].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[2].Partitions[0].Offsets, DeepEquals, []int64{7})
+}
+
+func (s *ServerSuite) TestRequests(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddMessages("test", 0)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+
+	_, err := broker.Producer(kafka.NewProducerConf()).Produce("test", 0, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+
+	requests := srv.Requests()
+	c.Assert(requests, HasLen, 2)
+	c.Assert(requests[0].Kind, Equals, int16(proto.MetadataReqKind))
+	c.Assert(requests[1].Kind, Equals, int16(proto.ProduceReqKind))
+	req, err := proto.ReadProduceReq(bytes.NewReader(requests[1].Bytes))
+	c.Assert(err, IsNil)
+	c.Assert(requests[1].CorrelationID, Equals, req.CorrelationID)
+	c.Assert(req.Topics[0].Partitions[0].Messages[0].Value, DeepEquals, []byte("first"))
+
+	srv.Reset()
+	c.Assert(srv.Requests(), HasLen, 0)
+}
+
+func metadataBroker(c *C, nodeID int32, srv *Server) proto.MetadataRespBroker {
+	host, port, err := net.SplitHostPort(srv.Addr())
+	c.Assert(err, IsNil)
+	prt, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+	return proto.MetadataRespBroker{NodeID: nodeID, Host: host, Port: int32(prt)}
+}
+
+func (s *ServerSuite) TestSetBrokersAndTopics(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	leader := NewServer()
+	leader.MustSpawn()
+	defer leader.Close()
+
+	// both servers describe the same three broker cluster
+	for _, server := range []*Server{srv, leader} {
+		server.SetBrokers([]proto.MetadataRespBroker{
+			metadataBroker(c, 1, srv),
+			metadataBroker(c, 2, leader),
+			metadataBroker(c, 3, srv),
+		})
+		server.SetTopics([]proto.MetadataRespTopic{
+			{
+				Name: "test",
+				Partitions: []proto.MetadataRespPartition{
+					{ID: 0, Leader: 2, Replicas: []int32{2, 1, 3}, Isrs: []int32{2, 3}},
+				},
+			},
+		})
+	}
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+
+	resp, err := broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers, HasLen, 3)
+	c.Assert(resp.Topics, HasLen, 1)
+	c.Assert(resp.Topics[0].Partitions[0].Isrs, DeepEquals, []int32{2, 3})
+
+	_, err = broker.Producer(kafka.NewProducerConf()).Produce("test", 0, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+	produced := func(server *Server) int {
+		n := 0
+		for _, req := range server.Requests() {
+			if req.Kind == proto.ProduceReqKind {
+				n++
+			}
+		}
+		return n
+	}
+	c.Assert(produced(leader), Equals, 1)
+	c.Assert(produced(srv), Equals, 0)
+
+	meta := srv.handleMetadataRequest(0, nil, &proto.MetadataReq{Topics: []string{"missing", "test"}}).(*proto.MetadataResp)
+	c.Assert(meta.Topics, HasLen, 2)
+	c.Assert(meta.Topics[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(meta.Topics[1].Partitions[0].Leader, Equals, int32(2))
+}
+
+func (s *ServerSuite) TestAPIVersions(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, err = (&proto.APIVersionsReq{CorrelationID: 7, ClientID: "tester"}).WriteTo(conn)
+	c.Assert(err, IsNil)
+	correlationID, b, err := proto.ReadResp(conn)
+	c.Assert(err, IsNil)
+	c.Assert(correlationID, Equals, int32(7))
+	resp, err := proto.ReadAPIVersionsResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Err, IsNil)
+	c.Assert(resp.APIVersions, DeepEquals, apiVersions)
+
+	// the connection is still usable
+	_, err = (&proto.MetadataReq{CorrelationID: 8, ClientID: "tester"}).WriteTo(conn)
+	c.Assert(err, IsNil)
+	correlationID, _, err = proto.ReadResp(conn)
+	c.Assert(err, IsNil)
+	c.Assert(correlationID, Equals, int32(8))
+}
+
+func (s *ServerSuite) TestAddTopic(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddTopic("test", 2)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	meta, err := broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(meta.Topics, HasLen, 1)
+	c.Assert(meta.Topics[0].Partitions, HasLen, 2)
+
+	offset, err := broker.Producer(kafka.NewProducerConf()).Produce("test", 1, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(0))
+
+	// fetching beyond the tip returns no messages, only unknown topics fail
+	resp := srv.handleFetchRequest(0, nil, &proto.FetchReq{
+		Topics: []proto.FetchReqTopic{
+			{Name: "test", Partitions: []proto.FetchReqPartition{{ID: 1, FetchOffset: 5}}},
+			{Name: "missing", Partitions: []proto.FetchReqPartition{{ID: 0}}},
+		},
+	}).(*proto.FetchResp)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 0)
+	c.Assert(resp.Topics[0].Partitions[0].TipOffset, Equals, int64(1))
+	c.Assert(resp.Topics[1].Partitions[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+}
+
+func (s *ServerSuite) TestCommittedOffset(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddTopic("test", 2)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	coordinator, err := broker.OffsetCoordinator(kafka.NewOffsetCoordinatorConf("group"))
+	c.Assert(err, IsNil)
+	c.Assert(coordinator.Commit("test", 0, 7), IsNil)
+
+	offset, metadata, ok := srv.CommittedOffset("group", "test", 0)
+	c.Assert(ok, Equals, true)
+	c.Assert(offset, Equals, int64(7))
+	c.Assert(metadata, Equals, "")
+	_, _, ok = srv.CommittedOffset("group", "test", 1)
+	c.Assert(ok, Equals, false)
+
+	// partitions without a committed offset have offset -1
+	resp := srv.handleOffsetFetchRequest(0, nil, &proto.OffsetFetchReq{
+		ConsumerGroup: "group",
+		Topics:        []proto.OffsetFetchReqTopic{{Name: "test", Partitions: []int32{0, 1}}},
+	}).(*proto.OffsetFetchResp)
+	c.Assert(resp.Topics[0].Partitions, DeepEquals, []proto.OffsetFetchRespPartition{
+		{ID: 0, Offset: 7},
+		{ID: 1, Offset: -1},
+	})
+}
+
+func (s *ServerSuite) TestRequestCount(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	// every client produces on a connection of its own
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			broker := s.newBroker(c, srv)
+			defer broker.Close()
+			producer := broker.Producer(kafka.NewProducerConf())
+			for j := 0; j < 10; j++ {
+				_, err := producer.Produce("test", 0, &proto.Message{Value: []byte("msg")})
+				c.Check(err, IsNil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(srv.RequestCount(proto.ProduceReqKind), Equals, 50)
+	c.Assert(srv.TotalRequests(), Equals, 50+srv.RequestCount(proto.MetadataReqKind))
+
+	// counts include the requests no longer kept
+	srv.SetRequestLimit(3)
+	requests := srv.Requests()
+	c.Assert(requests, HasLen, 3)
+	c.Assert(requests[2].ClientID, Equals, "tester")
+	c.Assert(srv.RequestsOf(proto.ProduceReqKind), HasLen, 3)
+	c.Assert(srv.RequestCount(proto.ProduceReqKind), Equals, 50)
+}
+
+func (s *ServerSuite) TestInjectError(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddTopic("test", 2)
+	srv.InjectError(proto.ProduceReqKind, "test", 0, proto.ErrLeaderNotAvailable, 2)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	conf := kafka.NewProducerConf()
+	conf.RetryWait = time.Millisecond
+	producer := broker.Producer(conf)
+
+	// the producer retries until the errors are used up
+	offset, err := producer.Produce("test", 0, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(0))
+	c.Assert(srv.RequestCount(proto.ProduceReqKind), Equals, 3)
+
+	// other partitions are not affected, until errors are injected forever
+	srv.InjectError(AnyRequest, "", 0, proto.ErrRequestTimeout, -1)
+	conf.RetryLimit = 1
+	_, err = broker.Producer(conf).Produce("test", 1, &proto.Message{Value: []byte("second")})
+	c.Assert(err, Equals, proto.ErrRequestTimeout)
+	srv.ClearErrors()
+	_, err = producer.Produce("test", 1, &proto.Message{Value: []byte("third")})
+	c.Assert(err, IsNil)
+}
+
+func (s *ServerSuite) TestLatency(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	srv.SetLatency(AnyRequest, time.Minute)
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// the client times out, although the request was received
+	_, err = (&proto.MetadataReq{CorrelationID: 1, ClientID: "tester"}).WriteTo(conn)
+	c.Assert(err, IsNil)
+	c.Assert(conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)), IsNil)
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, NotNil)
+	c.Assert(err.(net.Error).Timeout(), Equals, true)
+	c.Assert(srv.RequestCount(proto.MetadataReqKind), Equals, 1)
+
+	// closing the server doesn't wait for the delayed response
+	start := time.Now()
+	c.Assert(srv.Close(), IsNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *ServerSuite) TestCluster(c *C) {
+	cluster := NewCluster(2)
+	defer cluster.Close()
+	cluster.AddMessages("test", 1)
+
+	conf := kafka.NewBrokerConf("tester")
+	conf.LeaderRetryWait = 5 * time.Millisecond
+	broker, err := kafka.NewBroker("test-cluster", cluster.Addrs(), conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	meta, err := broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(meta.Brokers, HasLen, 2)
+	c.Assert(meta.Topics[0].Partitions[0].Leader, Equals, int32(100))
+	c.Assert(meta.Topics[0].Partitions[1].Leader, Equals, int32(101))
+
+	// requests go to the leader of the partition
+	producer := broker.Producer(kafka.NewProducerConf())
+	_, err = producer.Produce("test", 1, &proto.Message{Value: []byte("first")})
+	c.Assert(err, IsNil)
+	c.Assert(cluster.Server(101).RequestsOf(proto.ProduceReqKind), HasLen, 1)
+	c.Assert(cluster.Server(100).RequestsOf(proto.ProduceReqKind), HasLen, 0)
+
+	// and follow it when it moves
+	cluster.SetLeader("test", 1, 100)
+	offset, err := producer.Produce("test", 1, &proto.Message{Value: []byte("second")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(1))
+	c.Assert(cluster.Server(101).RequestsOf(proto.ProduceReqKind), HasLen, 2)
+	c.Assert(cluster.Server(100).RequestsOf(proto.ProduceReqKind), HasLen, 1)
+
+	// stopped brokers are gone from metadata, with their partitions
+	cluster.SetLeader("test", 0, 101)
+	cluster.StopBroker(101)
+	meta, err = broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(meta.Brokers, HasLen, 1)
+	c.Assert(meta.Topics[0].Partitions[0].Err, Equals, proto.ErrLeaderNotAvailable)
+	c.Assert(meta.Topics[0].Partitions[1].Leader, Equals, int32(100))
+}
+
+func (s *ServerSuite) TestRestart(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	addr := srv.Addr()
+
+	// a blocked client read ends once the server is closed
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(srv.Await(AnyRequest, 0, time.Second), IsNil)
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+	for {
+		srv.mu.RLock()
+		n := len(srv.conns)
+		srv.mu.RUnlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(srv.Close(), IsNil)
+	select {
+	case err := <-read:
+		c.Assert(err, Equals, io.EOF)
+	case <-time.After(time.Second):
+		c.Fatal("client connection not closed")
+	}
+
+	// the server comes back on the same address
+	for i := 0; i < 3; i++ {
+		srv.MustSpawn()
+		c.Assert(srv.Addr(), Equals, addr)
+		broker := s.newBroker(c, srv)
+		_, err = broker.Metadata()
+		c.Assert(err, IsNil)
+		broker.Close()
+		c.Assert(srv.Close(), IsNil)
+	}
+}
+
+func (s *ServerSuite) TestIPv6(c *C) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		c.Skip(fmt.Sprintf("IPv6 not available: %s", err))
+	}
+	_ = ln.Close()
+
+	srv := NewServer()
+	srv.MustSpawnOn("tcp6", "[::1]:0")
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+	c.Assert(strings.HasPrefix(srv.Addr(), "[::1]:"), Equals, true)
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	meta, err := broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(meta.Brokers, HasLen, 1)
+	c.Assert(meta.Brokers[0].Host, Equals, "::1")
+	_, err = broker.Producer(kafka.NewProducerConf()).Produce("test", 0, &proto.Message{Value: []byte("msg")})
+	c.Assert(err, IsNil)
+
+	coordinator := srv.handleGroupCoordinatorRequest(srv.nodeID, nil, &proto.GroupCoordinatorReq{}).(*proto.GroupCoordinatorResp)
+	c.Assert(coordinator.CoordinatorHost, Equals, "::1")
+	c.Assert(coordinator.CoordinatorPort, Equals, meta.Brokers[0].Port)
+}
+
+func (s *ServerSuite) TestOnError(c *C) {
+	srv := NewServer(func(nodeID int32, kind int16, content []byte) Response {
+		if kind == proto.OffsetReqKind {
+			panic("broken middleware")
+		}
+		return nil
+	})
+	errc := make(chan error, 10)
+	srv.OnError(func(conn net.Conn, err error) { errc <- err })
+	srv.MustSpawn()
+	defer srv.Close()
+
+	send := func(frame []byte) {
+		conn, err := net.Dial("tcp", srv.Addr())
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		_, err = conn.Write(frame)
+		c.Assert(err, IsNil)
+		c.Assert(conn.(*net.TCPConn).CloseWrite(), IsNil)
+		_, err = io.Copy(ioutil.Discard, conn)
+		c.Assert(err, IsNil)
+	}
+
+	// truncated, unknown and malformed requests close their connection
+	send([]byte{0x0, 0x0, 0x0, 0x10, 0x0, 0x3, 0x0, 0x0})
+	c.Assert(<-errc, ErrorMatches, "client read error: .*")
+	send([]byte{0x0, 0x0, 0x0, 0x4, 0x0, 0x63, 0x0, 0x0})
+	c.Assert(<-errc, ErrorMatches, "unknown request: 99")
+	send([]byte{
+		0x0, 0x0, 0x0, 0xe, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
+		0x0, 0x0, 0xff, 0xff, 0xff, 0xfe,
+	})
+	c.Assert(<-errc, ErrorMatches, "cannot parse request 3: .*")
+	b, err := (&proto.OffsetReq{CorrelationID: 1, ClientID: "tester"}).Bytes()
+	c.Assert(err, IsNil)
+	send(b)
+	c.Assert(<-errc, ErrorMatches, "cannot handle request 2: broken middleware")
+
+	// the server keeps serving other clients
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+	_, err = broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(errc, HasLen, 0)
+}
+
+func (s *ServerSuite) TestTLS(c *C) {
+	cert, err := LocalhostCertificate()
+	c.Assert(err, IsNil)
+
+	srv := NewServer()
+	errc := make(chan error, 10)
+	srv.OnError(func(conn net.Conn, err error) { errc <- err })
+	srv.MustSpawnTLS(&tls.Config{Certificates: []tls.Certificate{cert}})
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	conf := kafka.NewBrokerConf("tester")
+	conf.ClusterConnectionConf.Dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: timeout}
+		return tls.DialWithDialer(dialer, network, address, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	}
+	broker, err := kafka.NewBroker("test-cluster", []string{srv.Addr()}, conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	meta, err := broker.Metadata()
+	c.Assert(err, IsNil)
+	c.Assert(meta.Brokers, DeepEquals, []proto.MetadataRespBroker{metadataBroker(c, 100, srv)})
+	_, err = broker.Producer(kafka.NewProducerConf()).Produce("test", 0, &proto.Message{Value: []byte("msg")})
+	c.Assert(err, IsNil)
+
+	// plaintext clients are disconnected
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = (&proto.MetadataReq{CorrelationID: 1, ClientID: "tester"}).WriteTo(conn)
+	c.Assert(err, IsNil)
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, NotNil)
+	c.Assert(<-errc, ErrorMatches, "client read error: tls: .*")
+}
+
+func (s *ServerSuite) TestHandleTopic(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddTopic("a", 2)
+	srv.AddTopic("orders", 2)
+
+	produced := make(chan *proto.ProduceReq, 10)
+	srv.HandleTopic(proto.ProduceReqKind, "orders", func(nodeID int32, kind int16, content []byte) Response {
+		req, err := proto.ReadProduceReq(bytes.NewReader(content))
+		c.Check(err, IsNil)
+		produced <- req
+		resp := &proto.ProduceResp{CorrelationID: req.CorrelationID}
+		for _, t := range req.Topics {
+			rt := proto.ProduceRespTopic{Name: t.Name}
+			for _, p := range t.Partitions {
+				rt.Partitions = append(rt.Partitions, proto.ProduceRespPartition{ID: p.ID, Err: proto.ErrRequestTimeout, Offset: -1})
+			}
+			resp.Topics = append(resp.Topics, rt)
+		}
+		return resp
+	})
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	msgs := func(value string) []*proto.Message {
+		return []*proto.Message{{Value: []byte(value)}}
+	}
+	_, err = (&proto.ProduceReq{
+		CorrelationID: 7,
+		ClientID:      "tester",
+		RequiredAcks:  proto.RequiredAcksLocal,
+		Timeout:       time.Second,
+		Topics: []proto.ProduceReqTopic{
+			{Name: "a", Partitions: []proto.ProduceReqPartition{{ID: 1, Messages: msgs("a1")}}},
+			{Name: "orders", Partitions: []proto.ProduceReqPartition{{ID: 1, Messages: msgs("o1")}, {ID: 0, Messages: msgs("o0")}}},
+			{Name: "b", Partitions: []proto.ProduceReqPartition{{ID: 0, Messages: msgs("b0")}}},
+		},
+	}).WriteTo(conn)
+	c.Assert(err, IsNil)
+	resp, err := proto.ReadProduceResp(conn)
+	c.Assert(err, IsNil)
+	c.Assert(resp.CorrelationID, Equals, int32(7))
+	c.Assert(resp.Topics, DeepEquals, []proto.ProduceRespTopic{
+		{Name: "a", Partitions: []proto.ProduceRespPartition{{ID: 1, Offset: 0}}},
+		{Name: "orders", Partitions: []proto.ProduceRespPartition{
+			{ID: 1, Err: proto.ErrRequestTimeout, Offset: -1},
+			{ID: 0, Err: proto.ErrRequestTimeout, Offset: -1},
+		}},
+		{Name: "b", Partitions: []proto.ProduceRespPartition{{ID: 0, Offset: 0}}},
+	})
+
+	// the topic handler only sees its topic
+	req := <-produced
+	c.Assert(req.CorrelationID, Equals, int32(7))
+	c.Assert(req.Topics, HasLen, 1)
+	c.Assert(req.Topics[0].Name, Equals, "orders")
+	srv.mu.RLock()
+	c.Assert(srv.topics["orders"][0], HasLen, 0)
+	srv.mu.RUnlock()
+}
+
+func (s *ServerSuite) TestFetchCompression(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	broker := s.newBroker(c, srv)
+	defer broker.Close()
+
+	for _, compression := range []proto.Compression{proto.CompressionGzip, proto.CompressionSnappy} {
+		topic := fmt.Sprintf("test-%d", compression)
+		srv.AddTopic(topic, 1)
+		srv.SetFetchCompression(compression)
+
+		// compressed message sets are stored as individual messages
+		prodConf := kafka.NewProducerConf()
+		prodConf.Compression = compression
+		prodConf.CompressionMinBytes = 0
+		_, err := broker.Producer(prodConf).Produce(topic, 0,
+			&proto.Message{Value: []byte("first")},
+			&proto.Message{Value: []byte("second")})
+		c.Assert(err, IsNil)
+		srv.mu.RLock()
+		c.Assert(srv.topics[topic][0], HasLen, 2)
+		srv.mu.RUnlock()
+
+		// and delivered compressed to consumers
+		consConf := kafka.NewConsumerConf(topic, 0)
+		consConf.StartOffset = 0
+		consumer, err := broker.Consumer(consConf)
+		c.Assert(err, IsNil)
+		for i, value := range []string{"first", "second"} {
+			msg, err := consumer.Consume()
+			c.Assert(err, IsNil)
+			c.Assert(msg.Offset, Equals, int64(i))
+			c.Assert(string(msg.Value), Equals, value)
+		}
+	}
+}
+
+func (s *ServerSuite) TestAwaitAndLongPoll(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+	fetched := srv.Notify(proto.FetchReqKind)
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	fetch := func(maxWait time.Duration) {
+		_, err := (&proto.FetchReq{
+			CorrelationID: 1,
+			ClientID:      "tester",
+			MaxWaitTime:   maxWait,
+			MinBytes:      1,
+			Topics: []proto.FetchReqTopic{{
+				Name:       "test",
+				Partitions: []proto.FetchReqPartition{{ID: 0, MaxBytes: 1024}},
+			}},
+		}).WriteTo(conn)
+		c.Assert(err, IsNil)
+	}
+
+	// the fetch is held until a message is added
+	start := time.Now()
+	fetch(5 * time.Second)
+	c.Assert(srv.Await(proto.FetchReqKind, 1, 20*time.Millisecond), ErrorMatches,
+		"timed out waiting for 1 requests of kind 1, got 0")
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("first")})
+	resp, err := proto.ReadFetchResp(conn)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(srv.Await(proto.FetchReqKind, 1, time.Second), IsNil)
+	c.Assert((<-fetched).CorrelationID, Equals, int32(1))
+
+	// closing the server releases held fetches
+	fetch(time.Minute)
+	for srv.RequestCount(proto.FetchReqKind) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	start = time.Now()
+	c.Assert(srv.Close(), IsNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *ServerSuite) TestStrictValidation(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.AddTopic("test", 2)
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	produce := func() *proto.ProduceResp {
+		b, err := (&proto.ProduceReq{
+			CorrelationID: 1,
+			ClientID:      "tester",
+			RequiredAcks:  proto.RequiredAcksAll,
+			Timeout:       time.Second,
+			Topics: []proto.ProduceReqTopic{{
+				Name: "test",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: []byte("first")}, {Value: []byte("corrupted")}}},
+					{ID: 1, Messages: []*proto.Message{{Value: []byte("valid")}}},
+				},
+			}},
+		}).Bytes()
+		c.Assert(err, IsNil)
+		// change the value without updating its crc
+		b[bytes.Index(b, []byte("corrupted"))] = 'C'
+		_, err = conn.Write(b)
+		c.Assert(err, IsNil)
+		resp, err := proto.ReadProduceResp(conn)
+		c.Assert(err, IsNil)
+		return resp
+	}
+
+	// only the partition with the corrupt message is rejected
+	resp := produce()
+	c.Assert(resp.Topics[0].Partitions, DeepEquals, []proto.ProduceRespPartition{
+		{ID: 0, Err: proto.ErrInvalidMessage, Offset: -1},
+		{ID: 1, Offset: 0},
+	})
+
+	// anything is stored without validation
+	srv.SetStrictValidation(false)
+	resp = produce()
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	srv.mu.RLock()
+	c.Assert(string(srv.topics["test"][0][1].Value), Equals, "Corrupted")
+	srv.mu.RUnlock()
+}
@@ -0,0 +1,246 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics receives measurements from a broker and the producers and consumers
+// created from it, to be exported to a monitoring system. Methods are called
+// from the goroutine making the request, never while holding a lock of the
+// broker, and must not block.
+//
+// More methods may be added to this interface. Implementations should embed
+// NopMetrics so that they keep compiling.
+type Metrics interface {
+	// ProduceLatency is called for every acknowledged produce. total is the
+	// time from the Produce call until the acknowledgement, including leader
+	// lookup and waiting for a connection. request is the time of the produce
+	// request and response alone, which includes the broker's commit.
+	ProduceLatency(topic string, partition int32, total, request time.Duration)
+
+	// FetchSize is called for every fetch of a consumer that returned no
+	// error, including fetches that returned no messages. bytes is the size
+	// of the fetch response and messages the number of messages in it that
+	// the consumer hadn't seen yet. Their distribution shows whether
+	// MaxFetchSize and RequestTimeout fit the traffic of the partition.
+	FetchSize(topic string, partition int32, bytes, messages int)
+
+	// ObserveRequest is called for every request sent to a Kafka node, with
+	// the API key of the request, such as proto.FetchReqKind, the address
+	// of the node and the time until the response was read. err is the error
+	// of sending the request or reading the response; errors reported for
+	// single partitions within a response are counted by CountRetry when
+	// they are retried.
+	//
+	// Metadata refreshes done by the cluster metadata cache are shared by
+	// all brokers of a cluster and are not observed.
+	ObserveRequest(apiKey int16, broker string, duration time.Duration, err error)
+
+	// CountBytes is called after every observed request with the number of
+	// bytes written to the node and again with the number of bytes read.
+	CountBytes(direction BytesDirection, n int)
+
+	// CountRetry is called whenever a request is retried, with the error
+	// that caused the retry, e.g. proto.ErrNotLeaderForPartition.
+	CountRetry(reason error)
+
+	// CountFutureTimestamp is called by consumers configured with
+	// MaxTimestampSkew for every message whose timestamp is further ahead
+	// of the local clock than that, with how far ahead it is.
+	CountFutureTimestamp(topic string, partition int32, ahead time.Duration)
+
+	// CountStaleMessages is called by consumers configured with
+	// MaxMessageAge with the number of messages they skipped for being
+	// older than that.
+	CountStaleMessages(topic string, partition int32, n int)
+}
+
+// BytesDirection tells whether bytes counted by Metrics were sent to or
+// received from Kafka.
+type BytesDirection int
+
+const (
+	BytesOut BytesDirection = iota
+	BytesIn
+)
+
+func (d BytesDirection) String() string {
+	if d == BytesOut {
+		return "out"
+	}
+	return "in"
+}
+
+// NopMetrics is a Metrics implementation that ignores all measurements.
+type NopMetrics struct{}
+
+var _ Metrics = NopMetrics{}
+
+func (NopMetrics) ProduceLatency(topic string, partition int32, total, request time.Duration) {}
+
+func (NopMetrics) FetchSize(topic string, partition int32, bytes, messages int) {}
+
+func (NopMetrics) ObserveRequest(apiKey int16, broker string, duration time.Duration, err error) {}
+
+func (NopMetrics) CountBytes(direction BytesDirection, n int) {}
+
+func (NopMetrics) CountRetry(reason error) {}
+
+func (NopMetrics) CountFutureTimestamp(topic string, partition int32, ahead time.Duration) {}
+
+func (NopMetrics) CountStaleMessages(topic string, partition int32, n int) {}
+
+// measureRequest calls request, which sends a request with the given API key
+// using conn, and reports it to metrics.
+func measureRequest(metrics Metrics, apiKey int16, conn *connection, request func() error) error {
+	if _, ok := metrics.(NopMetrics); ok {
+		return request()
+	}
+
+	sent, received := conn.transferred()
+	start := time.Now()
+	err := request()
+	duration := time.Since(start)
+	nowSent, nowReceived := conn.transferred()
+
+	metrics.ObserveRequest(apiKey, conn.addr, duration, err)
+	metrics.CountBytes(BytesOut, int(nowSent-sent))
+	metrics.CountBytes(BytesIn, int(nowReceived-received))
+	return err
+}
+
+// RequestStats are the requests of a single API key counted by
+// CountingMetrics.
+type RequestStats struct {
+	Count  int64
+	Errors int64
+
+	// TotalTime is the time of all requests, MaxTime that of the slowest.
+	TotalTime time.Duration
+	MaxTime   time.Duration
+}
+
+// MetricsSnapshot holds the measurements of CountingMetrics at a point in
+// time.
+type MetricsSnapshot struct {
+	// Requests are the request stats by API key.
+	Requests map[int16]RequestStats
+
+	BytesOut int64
+	BytesIn  int64
+
+	// Retries counts retries by the text of the error that caused them.
+	Retries map[string]int64
+
+	// FutureTimestamps counts consumed messages with timestamps beyond
+	// MaxTimestampSkew.
+	FutureTimestamps int64
+
+	// StaleMessages counts messages skipped for being older than
+	// MaxMessageAge.
+	StaleMessages int64
+}
+
+// CountingMetrics is a Metrics implementation that counts requests, bytes,
+// retries, future timestamps and stale messages in memory, to be read with
+// Snapshot, for example to be published with expvar.
+type CountingMetrics struct {
+	NopMetrics
+
+	// mu protects the following.
+	mu       *sync.Mutex
+	requests map[int16]RequestStats
+	bytesOut int64
+	bytesIn  int64
+	retries  map[string]int64
+	future   int64
+	stale    int64
+}
+
+var _ Metrics = &CountingMetrics{}
+
+// NewCountingMetrics returns a CountingMetrics with all counts zero.
+func NewCountingMetrics() *CountingMetrics {
+	return &CountingMetrics{
+		mu:       &sync.Mutex{},
+		requests: make(map[int16]RequestStats),
+		retries:  make(map[string]int64),
+	}
+}
+
+func (m *CountingMetrics) ObserveRequest(apiKey int16, broker string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.requests[apiKey]
+	stats.Count++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.TotalTime += duration
+	if duration > stats.MaxTime {
+		stats.MaxTime = duration
+	}
+	m.requests[apiKey] = stats
+}
+
+func (m *CountingMetrics) CountBytes(direction BytesDirection, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if direction == BytesOut {
+		m.bytesOut += int64(n)
+	} else {
+		m.bytesIn += int64(n)
+	}
+}
+
+func (m *CountingMetrics) CountRetry(reason error) {
+	text := "unknown"
+	if reason != nil {
+		text = reason.Error()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.retries[text]++
+}
+
+func (m *CountingMetrics) CountFutureTimestamp(topic string, partition int32, ahead time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.future++
+}
+
+func (m *CountingMetrics) CountStaleMessages(topic string, partition int32, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stale += int64(n)
+}
+
+// Snapshot returns a copy of the current counts.
+func (m *CountingMetrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := MetricsSnapshot{
+		Requests: make(map[int16]RequestStats, len(m.requests)),
+		BytesOut: m.bytesOut,
+		BytesIn:  m.bytesIn,
+		Retries:  make(map[string]int64, len(m.retries)),
+
+		FutureTimestamps: m.future,
+		StaleMessages:    m.stale,
+	}
+	for apiKey, stats := range m.requests {
+		snapshot.Requests[apiKey] = stats
+	}
+	for reason, count := range m.retries {
+		snapshot.Retries[reason] = count
+	}
+	return snapshot
+}
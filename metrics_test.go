@@ -0,0 +1,182 @@
+package kafka
+
+import (
+	"errors"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&MetricsSuite{})
+
+type MetricsSuite struct{}
+
+func (s *MetricsSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *MetricsSuite) TestCountingMetrics(c *C) {
+	m := NewCountingMetrics()
+	m.ObserveRequest(proto.FetchReqKind, "a:9092", 10*time.Millisecond, nil)
+	m.ObserveRequest(proto.FetchReqKind, "a:9092", 30*time.Millisecond, errors.New("broken"))
+	m.ObserveRequest(proto.ProduceReqKind, "b:9092", 5*time.Millisecond, nil)
+	m.CountBytes(BytesOut, 100)
+	m.CountBytes(BytesIn, 1000)
+	m.CountBytes(BytesIn, 24)
+	m.CountRetry(proto.ErrNotLeaderForPartition)
+	m.CountRetry(proto.ErrNotLeaderForPartition)
+	m.CountRetry(nil)
+
+	snapshot := m.Snapshot()
+	c.Assert(snapshot, DeepEquals, MetricsSnapshot{
+		Requests: map[int16]RequestStats{
+			proto.FetchReqKind: {
+				Count:     2,
+				Errors:    1,
+				TotalTime: 40 * time.Millisecond,
+				MaxTime:   30 * time.Millisecond,
+			},
+			proto.ProduceReqKind: {
+				Count:     1,
+				TotalTime: 5 * time.Millisecond,
+				MaxTime:   5 * time.Millisecond,
+			},
+		},
+		BytesOut: 100,
+		BytesIn:  1024,
+		Retries: map[string]int64{
+			proto.ErrNotLeaderForPartition.Error(): 2,
+			"unknown":                              1,
+		},
+	})
+
+	// snapshots are not changed by later measurements
+	m.CountRetry(proto.ErrNotLeaderForPartition)
+	c.Assert(snapshot.Retries[proto.ErrNotLeaderForPartition.Error()], Equals, int64(2))
+	c.Assert(BytesOut.String(), Equals, "out")
+	c.Assert(BytesIn.String(), Equals, "in")
+}
+
+// newMetricsBroker returns a broker to srv reporting to a new CountingMetrics.
+func newMetricsBroker(c *C, srv *Server, clusterName string) (*Broker, *CountingMetrics) {
+	metrics := NewCountingMetrics()
+	conf := NewBrokerConf("tester")
+	conf.LeaderRetryWait = time.Millisecond
+	conf.Metrics = metrics
+	broker, err := NewBroker(clusterName, []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	return broker, metrics
+}
+
+func (s *MetricsSuite) TestRequestMetrics(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	broker, metrics := newMetricsBroker(c, srv, "test-cluster-request-metrics")
+	defer broker.Close()
+
+	_, err := broker.Metadata()
+	c.Assert(err, IsNil)
+	_, err = broker.Producer(NewProducerConf()).Produce("test", 0,
+		&proto.Message{Value: []byte("first")}, &proto.Message{Value: []byte("second")})
+	c.Assert(err, IsNil)
+	afterProduce := metrics.Snapshot()
+
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = StartOffsetOldest
+	consumer, err := broker.Consumer(consConf)
+	c.Assert(err, IsNil)
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "first")
+
+	snapshot := metrics.Snapshot()
+	for _, kind := range []int16{proto.MetadataReqKind, proto.ProduceReqKind, proto.FetchReqKind} {
+		stats, ok := snapshot.Requests[kind]
+		c.Assert(ok, Equals, true, Commentf("request %d", kind))
+		c.Assert(stats.Count >= 1, Equals, true)
+		c.Assert(stats.Errors, Equals, int64(0))
+		c.Assert(stats.TotalTime > 0, Equals, true)
+		c.Assert(stats.MaxTime <= stats.TotalTime, Equals, true)
+	}
+	c.Assert(snapshot.Requests[proto.ProduceReqKind].Count, Equals, int64(1))
+	c.Assert(snapshot.Retries, HasLen, 0)
+
+	// the produce request carries the messages, the fetch response returns
+	// them
+	c.Assert(afterProduce.BytesOut > int64(len("first")+len("second")), Equals, true)
+	c.Assert(snapshot.BytesIn-afterProduce.BytesIn > int64(len("first")+len("second")), Equals, true)
+	c.Assert(snapshot.BytesOut > afterProduce.BytesOut, Equals, true)
+}
+
+func (s *MetricsSuite) TestRetryMetrics(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("first")})
+
+	broker, metrics := newMetricsBroker(c, srv, "test-cluster-retry-metrics")
+	defer broker.Close()
+
+	srv.InjectError(FetchRequest, "test", 0, proto.ErrNotLeaderForPartition, 2)
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = StartOffsetOldest
+	consConf.RetryErrWait = time.Millisecond
+	consumer, err := broker.Consumer(consConf)
+	c.Assert(err, IsNil)
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "first")
+
+	snapshot := metrics.Snapshot()
+	c.Assert(snapshot.Retries, DeepEquals, map[string]int64{
+		proto.ErrNotLeaderForPartition.Error(): 2,
+	})
+	// the failed fetches still got a response
+	c.Assert(snapshot.Requests[proto.FetchReqKind].Count, Equals, int64(3))
+	c.Assert(snapshot.Requests[proto.FetchReqKind].Errors, Equals, int64(0))
+}
+
+// blockingMetrics blocks every measurement until release is closed.
+type blockingMetrics struct {
+	NopMetrics
+	release chan struct{}
+}
+
+func (m *blockingMetrics) ObserveRequest(apiKey int16, broker string, duration time.Duration, err error) {
+	<-m.release
+}
+
+func (s *MetricsSuite) TestSlowMetricsDoNotBlockBroker(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("test", 1)
+
+	metrics := &blockingMetrics{release: make(chan struct{})}
+	conf := NewBrokerConf("tester")
+	conf.Metrics = metrics
+	broker, err := NewBroker("test-cluster-slow-metrics", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := broker.Metadata()
+		done <- err
+	}()
+	c.Assert(srv.Await(MetadataRequest, 1, time.Second), IsNil)
+
+	// the broker is usable while a measurement is being taken
+	count, err := broker.PartitionCount("test")
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, int32(1))
+
+	close(metrics.release)
+	c.Assert(<-done, IsNil)
+}
@@ -0,0 +1,451 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// ErrMxClosed is returned as a result of closed multiplexer consumption.
+var ErrMxClosed = errors.New("closed")
+
+// MxError is returned by Mx.Consume when one of the merged consumers failed.
+// Topic and Partition are only set for consumers created by a Broker.
+type MxError struct {
+	Consumer  Consumer
+	Topic     string
+	Partition int32
+	Err       error
+}
+
+func (e *MxError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Topic, e.Partition, e.Err)
+}
+
+// MxSourceState describes the health of a single consumer merged by Mx.
+type MxSourceState struct {
+	Consumer  Consumer
+	Topic     string
+	Partition int32
+
+	// Healthy is false if the last Consume call of this consumer failed.
+	Healthy bool
+	// LastErr is the last error returned by this consumer, if any.
+	LastErr error
+	// Done is set once the consumer stopped being read, because it ran out
+	// of data or its broker was closed.
+	Done bool
+}
+
+// MxConf is the configuration of a multiplexer.
+type MxConf struct {
+	// RoundRobin makes Consume take messages from the merged consumers in
+	// turn, skipping consumers that have nothing to return at the moment.
+	// Each consumer then gets an equal share of the merged stream for as
+	// long as it has messages, even if another consumer returns messages
+	// much faster. Every consumer keeps one message read ahead.
+	//
+	// When false, Consume returns whatever message is ready first, which
+	// keeps latency lowest but lets fast consumers take a bigger share.
+	//
+	// Default is false.
+	RoundRobin bool
+
+	// OnSourceDone, if set, is called once a consumer stops being read
+	// because it returned ErrNoData or ErrClosed, with the final state of
+	// that consumer. It is not called for removed consumers or once the
+	// multiplexer is closed. The owner of the multiplexer can use it to
+	// replace the consumer with AddConsumer; doing so from within the
+	// callback keeps the multiplexer from closing in the meantime.
+	//
+	// The callback is called from the consumer's worker and must not block.
+	//
+	// Default is nil.
+	OnSourceDone func(MxSourceState)
+}
+
+// NewMxConf returns the default multiplexer configuration.
+func NewMxConf() MxConf {
+	return MxConf{
+		RoundRobin:   false,
+		OnSourceDone: nil,
+	}
+}
+
+// Mx is multiplexer combining into single stream number of consumers.
+//
+// Messages of a single consumer are returned in the order that consumer
+// returned them, so messages of a partition are delivered by ascending
+// offset. There is no ordering between messages of different consumers; how
+// consumers share the stream is controlled by MxConf.RoundRobin.
+//
+// It is responsibility of the user of the multiplexer and the consumer
+// implementation to handle errors. Errors of a single consumer are returned
+// as *MxError, so that the failing consumer can be told apart from the others.
+// A consumer that returned an error keeps being read; use RemoveConsumer to
+// stop reading from it.
+//
+// ErrNoData and ErrClosed returned by a consumer are not passed to the
+// caller. They stop reading from that consumer instead, and once all consumers
+// stopped this way, the multiplexer is closed. Use MxConf.OnSourceDone to be
+// told about consumers that stopped.
+//
+// Consumers can be added and removed at any time with AddConsumer and
+// RemoveConsumer, also while Consume is being called.
+type Mx struct {
+	conf MxConf
+	errc chan error
+	msgc chan *proto.Message
+	stop chan struct{}
+	// ready is signalled when a source has a result waiting in round robin
+	// mode.
+	ready chan struct{}
+
+	// mu protects the following and must not be used outside of Mx.
+	mu      *sync.Mutex
+	closed  bool
+	workers int
+	sources []*mxSource
+	next    int // source to look at first in round robin mode
+}
+
+// mxResult is a single result of a source's Consume call.
+type mxResult struct {
+	msg *proto.Message
+	err error
+}
+
+// mxSource is a consumer read by a single Mx worker. All state is protected
+// by Mx.mu.
+type mxSource struct {
+	consumer  Consumer
+	topic     string
+	partition int32
+	stop      chan struct{}
+	// out holds the result read ahead in round robin mode.
+	out chan mxResult
+
+	lastErr error
+	healthy bool
+	done    bool
+	removed bool
+}
+
+// Merge is merging consume result of any number of consumers into single stream
+// and expose them through returned multiplexer.
+func Merge(consumers ...Consumer) *Mx {
+	return NewMx(NewMxConf(), consumers...)
+}
+
+// NewMx works like Merge, but uses the given configuration.
+func NewMx(conf MxConf, consumers ...Consumer) *Mx {
+	p := &Mx{
+		conf:  conf,
+		errc:  make(chan error),
+		msgc:  make(chan *proto.Message),
+		stop:  make(chan struct{}),
+		ready: make(chan struct{}, 1),
+		mu:    &sync.Mutex{},
+	}
+
+	for _, c := range consumers {
+		p.start(c)
+	}
+	return p
+}
+
+// start begins reading from the consumer. Caller must hold the lock.
+func (p *Mx) start(c Consumer) {
+	src := &mxSource{
+		consumer: c,
+		stop:     make(chan struct{}),
+		out:      make(chan mxResult, 1),
+		healthy:  true,
+	}
+	if bc, ok := c.(*consumer); ok {
+		src.topic = bc.conf.Topic
+		src.partition = bc.conf.Partition
+	}
+	p.sources = append(p.sources, src)
+	p.workers++
+	go p.read(src)
+}
+
+// read consumes from a single source until it runs out of data, is removed
+// or the multiplexer is closed.
+func (p *Mx) read(src *mxSource) {
+	defer p.finish(src)
+
+	for {
+		msg, err := src.consumer.Consume()
+
+		p.mu.Lock()
+		removed := src.removed
+		src.healthy = err == nil
+		if err != nil {
+			src.lastErr = err
+		}
+		p.mu.Unlock()
+		if removed {
+			return
+		}
+
+		if err != nil {
+			if err == ErrNoData || err == ErrClosed {
+				return
+			}
+			err = &MxError{
+				Consumer:  src.consumer,
+				Topic:     src.topic,
+				Partition: src.partition,
+				Err:       err,
+			}
+		}
+		if !p.deliver(src, msg, err) {
+			return
+		}
+	}
+}
+
+// deliver hands a result over to Consume, returning false if the source or
+// the multiplexer was stopped instead.
+func (p *Mx) deliver(src *mxSource, msg *proto.Message, err error) bool {
+	if p.conf.RoundRobin {
+		select {
+		case <-p.stop:
+			return false
+		case <-src.stop:
+			return false
+		case src.out <- mxResult{msg, err}:
+		}
+		select {
+		case p.ready <- struct{}{}:
+		default:
+		}
+		return true
+	}
+
+	if err != nil {
+		select {
+		case <-p.stop:
+			return false
+		case <-src.stop:
+			return false
+		case p.errc <- err:
+		}
+	} else {
+		select {
+		case <-p.stop:
+			return false
+		case <-src.stop:
+			return false
+		case p.msgc <- msg:
+		}
+	}
+	return true
+}
+
+// finish marks the source as done, forgets it if it was removed and closes
+// the multiplexer once no worker is left.
+func (p *Mx) finish(src *mxSource) {
+	p.mu.Lock()
+	src.done = true
+	notify := !src.removed && !p.closed && p.conf.OnSourceDone != nil
+	state := src.state()
+	p.mu.Unlock()
+
+	// The worker is counted until the callback returned, so that a consumer
+	// added by it keeps the multiplexer open.
+	if notify {
+		p.conf.OnSourceDone(state)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.workers--
+	if src.removed {
+		p.forget(src)
+	}
+	// If this is the last worker, close the multiplexer. Sources that are
+	// left have all finished on their own; if every consumer was removed
+	// instead, the multiplexer stays open, see RemoveConsumer.
+	if p.workers == 0 && len(p.sources) > 0 && !p.closed {
+		close(p.stop)
+		p.closed = true
+	}
+}
+
+// Workers return number of active consumer workers that are pushing messages
+// to multiplexer consumer queue.
+func (p *Mx) Workers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.workers
+}
+
+// Sources returns the state of all consumers merged by the multiplexer, in
+// the order they were given to Merge. Removed consumers are not returned.
+func (p *Mx) Sources() []MxSourceState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	states := make([]MxSourceState, 0, len(p.sources))
+	for _, src := range p.sources {
+		if src.removed {
+			continue
+		}
+		states = append(states, src.state())
+	}
+	return states
+}
+
+// state returns the state of the source. Caller must hold the lock.
+func (src *mxSource) state() MxSourceState {
+	return MxSourceState{
+		Consumer:  src.consumer,
+		Topic:     src.topic,
+		Partition: src.partition,
+		Healthy:   src.healthy,
+		LastErr:   src.lastErr,
+		Done:      src.done,
+	}
+}
+
+// forget drops the source from the list of sources. Caller must hold the
+// lock.
+func (p *Mx) forget(src *mxSource) {
+	for i, s := range p.sources {
+		if s == src {
+			p.sources = append(p.sources[:i], p.sources[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddConsumer starts reading from the given consumer, merging its messages
+// with those of the other consumers. It returns ErrMxClosed if the
+// multiplexer was closed and an error if the consumer is being read already.
+// A consumer that stopped being read because it ran out of data can be added
+// again.
+func (p *Mx) AddConsumer(c Consumer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrMxClosed
+	}
+	for _, src := range p.sources {
+		if src.consumer != c || src.removed {
+			continue
+		}
+		if !src.done {
+			return errors.New("consumer already added")
+		}
+		p.forget(src)
+		break
+	}
+	p.start(c)
+	return nil
+}
+
+// RemoveConsumer stops reading from the given consumer without affecting the
+// others, returning false if the consumer is not part of the multiplexer. A
+// message the consumer is fetching at the time of removal is dropped. The
+// consumer's worker finishes as soon as the consumer's Consume call returns.
+//
+// Removing the last consumer does not close the multiplexer; Consume blocks
+// until Close is called or a consumer is added.
+func (p *Mx) RemoveConsumer(c Consumer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, src := range p.sources {
+		if src.consumer != c || src.removed {
+			continue
+		}
+		src.removed = true
+		close(src.stop)
+		if src.done {
+			p.forget(src)
+		}
+		return true
+	}
+	return false
+}
+
+// Close is closing multiplexer and stopping all underlying consumers.
+func (p *Mx) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.stop)
+	}
+}
+
+// Consume returns Consume result from any of the merged consumer.
+func (p *Mx) Consume() (*proto.Message, error) {
+	return p.consume(nil)
+}
+
+// consume works like Consume, but gives up with errCanceled once cancel is
+// closed.
+func (p *Mx) consume(cancel <-chan struct{}) (*proto.Message, error) {
+	if p.conf.RoundRobin {
+		return p.consumeRoundRobin(cancel)
+	}
+
+	select {
+	case <-cancel:
+		return nil, errCanceled
+	case <-p.stop:
+		return nil, ErrMxClosed
+	case msg := <-p.msgc:
+		return msg, nil
+	case err := <-p.errc:
+		return nil, err
+	}
+}
+
+// consumeRoundRobin returns the result of the next source in turn that has
+// one ready, waiting for one if none has.
+func (p *Mx) consumeRoundRobin(cancel <-chan struct{}) (*proto.Message, error) {
+	for {
+		if res, ok := p.nextReady(); ok {
+			return res.msg, res.err
+		}
+		select {
+		case <-cancel:
+			return nil, errCanceled
+		case <-p.stop:
+			return nil, ErrMxClosed
+		case <-p.ready:
+		}
+	}
+}
+
+// nextReady takes a waiting result from the first source with one, starting
+// after the source that delivered last.
+func (p *Mx) nextReady() (mxResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.sources {
+		idx := (p.next + i) % len(p.sources)
+		if p.sources[idx].removed {
+			continue
+		}
+		select {
+		case res := <-p.sources[idx].out:
+			p.next = idx + 1
+			return res, true
+		default:
+		}
+	}
+	return mxResult{}, false
+}
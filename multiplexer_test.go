@@ -0,0 +1,320 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&MultiplexerSuite{})
+
+type MultiplexerSuite struct{}
+
+func (s *MultiplexerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+type consumeResult struct {
+	msg *proto.Message
+	err error
+}
+
+// chanConsumer returns whatever is sent to its channel and ErrNoData once the
+// channel is closed.
+type chanConsumer struct {
+	results chan consumeResult
+}
+
+func newChanConsumer() *chanConsumer {
+	return &chanConsumer{results: make(chan consumeResult)}
+}
+
+func (c *chanConsumer) Consume() (*proto.Message, error) {
+	res, ok := <-c.results
+	if !ok {
+		return nil, ErrNoData
+	}
+	return res.msg, res.err
+}
+
+func (c *chanConsumer) SeekToLatest() error {
+	return nil
+}
+
+func consumeTimeout(c *C, mx *Mx) (*proto.Message, error) {
+	type result struct {
+		msg *proto.Message
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		msg, err := mx.Consume()
+		resc <- result{msg, err}
+	}()
+	select {
+	case res := <-resc:
+		return res.msg, res.err
+	case <-time.After(time.Second):
+		c.Fatal("timeout waiting for multiplexer")
+	}
+	return nil, nil
+}
+
+func (s *MultiplexerSuite) TestErrorsAreTaggedWithSource(c *C) {
+	c1, c2 := newChanConsumer(), newChanConsumer()
+	mx := Merge(c1, c2)
+	defer mx.Close()
+
+	failure := errors.New("broken")
+	c1.results <- consumeResult{err: failure}
+	_, err := consumeTimeout(c, mx)
+	mxErr, ok := err.(*MxError)
+	c.Assert(ok, Equals, true)
+	c.Assert(mxErr.Consumer, Equals, Consumer(c1))
+	c.Assert(mxErr.Err, Equals, failure)
+
+	sources := mx.Sources()
+	c.Assert(sources, HasLen, 2)
+	c.Assert(sources[0].Healthy, Equals, false)
+	c.Assert(sources[0].LastErr, Equals, failure)
+	c.Assert(sources[1].Healthy, Equals, true)
+
+	// the failing consumer is still read from
+	c1.results <- consumeResult{msg: &proto.Message{Value: []byte("1")}}
+	msg, err := consumeTimeout(c, mx)
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "1")
+	c2.results <- consumeResult{msg: &proto.Message{Value: []byte("2")}}
+	msg, err = consumeTimeout(c, mx)
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "2")
+}
+
+func (s *MultiplexerSuite) TestRemoveConsumer(c *C) {
+	c1, c2 := newChanConsumer(), newChanConsumer()
+	mx := Merge(c1, c2)
+	defer mx.Close()
+
+	c.Assert(mx.RemoveConsumer(c1), Equals, true)
+	c.Assert(mx.RemoveConsumer(c1), Equals, false)
+	c.Assert(mx.Sources(), HasLen, 1)
+
+	// the removed consumer's worker finishes with its next result, which
+	// is dropped
+	c1.results <- consumeResult{msg: &proto.Message{Value: []byte("dropped")}}
+	c2.results <- consumeResult{msg: &proto.Message{Value: []byte("2")}}
+	msg, err := consumeTimeout(c, mx)
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "2")
+
+	// once the remaining consumer runs out of data, the multiplexer closes
+	close(c2.results)
+	_, err = consumeTimeout(c, mx)
+	c.Assert(err, Equals, ErrMxClosed)
+	c.Assert(mx.Workers(), Equals, 0)
+	sources := mx.Sources()
+	c.Assert(sources, HasLen, 1)
+	c.Assert(sources[0].Done, Equals, true)
+	c.Assert(sources[0].LastErr, Equals, ErrNoData)
+}
+
+// seqConsumer always has a message ready, numbered by increasing offsets.
+type seqConsumer struct {
+	topic  string
+	offset int64
+}
+
+func (c *seqConsumer) Consume() (*proto.Message, error) {
+	c.offset++
+	return &proto.Message{Topic: c.topic, Offset: c.offset}, nil
+}
+
+func (c *seqConsumer) SeekToLatest() error {
+	return nil
+}
+
+func (s *MultiplexerSuite) TestRoundRobin(c *C) {
+	conf := NewMxConf()
+	conf.RoundRobin = true
+	mx := NewMx(conf,
+		&seqConsumer{topic: "a"}, &seqConsumer{topic: "b"}, &seqConsumer{topic: "c"})
+	defer mx.Close()
+
+	counts := make(map[string]int)
+	last := make(map[string]int64)
+	for i := 0; i < 3000; i++ {
+		msg, err := consumeTimeout(c, mx)
+		c.Assert(err, IsNil)
+		c.Assert(msg.Offset > last[msg.Topic], Equals, true)
+		last[msg.Topic] = msg.Offset
+		counts[msg.Topic]++
+	}
+	// all consumers are always ready, so each gets about a third; a consumer
+	// is only skipped while it is still reading ahead
+	c.Assert(counts, HasLen, 3)
+	for topic, count := range counts {
+		c.Assert(count > 900, Equals, true, Commentf("%s got %d messages", topic, count))
+	}
+}
+
+func (s *MultiplexerSuite) TestRoundRobinSkipsIdleConsumers(c *C) {
+	conf := NewMxConf()
+	conf.RoundRobin = true
+	idle := newChanConsumer()
+	mx := NewMx(conf, idle, &seqConsumer{topic: "busy"})
+	defer mx.Close()
+
+	for i := 0; i < 10; i++ {
+		msg, err := consumeTimeout(c, mx)
+		c.Assert(err, IsNil)
+		c.Assert(msg.Topic, Equals, "busy")
+	}
+
+	idle.results <- consumeResult{msg: &proto.Message{Topic: "idle"}}
+	seen := false
+	for i := 0; i < 10 && !seen; i++ {
+		msg, err := consumeTimeout(c, mx)
+		c.Assert(err, IsNil)
+		seen = msg.Topic == "idle"
+	}
+	c.Assert(seen, Equals, true)
+
+	close(idle.results)
+}
+
+func (s *MultiplexerSuite) TestAddConsumer(c *C) {
+	c1, c2 := newChanConsumer(), newChanConsumer()
+	mx := Merge(c1)
+	defer mx.Close()
+
+	c.Assert(mx.AddConsumer(c2), IsNil)
+	c.Assert(mx.AddConsumer(c2), ErrorMatches, "consumer already added")
+	c.Assert(mx.Workers(), Equals, 2)
+	c.Assert(mx.Sources(), HasLen, 2)
+
+	c2.results <- consumeResult{msg: &proto.Message{Value: []byte("2")}}
+	msg, err := consumeTimeout(c, mx)
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "2")
+
+	// a consumer can be added to a multiplexer that lost all its consumers
+	c.Assert(mx.RemoveConsumer(c1), Equals, true)
+	c.Assert(mx.RemoveConsumer(c2), Equals, true)
+	c.Assert(mx.Sources(), HasLen, 0)
+	c3 := newChanConsumer()
+	c.Assert(mx.AddConsumer(c3), IsNil)
+	c3.results <- consumeResult{msg: &proto.Message{Value: []byte("3")}}
+	msg, err = consumeTimeout(c, mx)
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "3")
+
+	mx.Close()
+	c.Assert(mx.AddConsumer(newChanConsumer()), Equals, ErrMxClosed)
+	_, err = consumeTimeout(c, mx)
+	c.Assert(err, Equals, ErrMxClosed)
+}
+
+func (s *MultiplexerSuite) TestOnSourceDone(c *C) {
+	c1, c2 := newChanConsumer(), newChanConsumer()
+	replacement := newChanConsumer()
+
+	var mx *Mx
+	done := make(chan MxSourceState, 2)
+	conf := NewMxConf()
+	conf.OnSourceDone = func(state MxSourceState) {
+		if state.Consumer == Consumer(c1) {
+			c.Check(mx.AddConsumer(replacement), IsNil)
+		}
+		done <- state
+	}
+	mx = NewMx(conf, c1, c2)
+	defer mx.Close()
+
+	// removed consumers are not reported
+	c.Assert(mx.RemoveConsumer(c2), Equals, true)
+	c2.results <- consumeResult{msg: &proto.Message{}}
+
+	// the replacement keeps the multiplexer open
+	close(c1.results)
+	select {
+	case state := <-done:
+		c.Assert(state.Consumer, Equals, Consumer(c1))
+		c.Assert(state.Done, Equals, true)
+		c.Assert(state.LastErr, Equals, ErrNoData)
+	case <-time.After(time.Second):
+		c.Fatal("consumer end not reported")
+	}
+	replacement.results <- consumeResult{msg: &proto.Message{Value: []byte("r")}}
+	msg, err := consumeTimeout(c, mx)
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "r")
+
+	// a consumer that stopped can be added again
+	c.Assert(mx.AddConsumer(c1), IsNil)
+	c.Assert(mx.Workers(), Equals, 2)
+
+	mx.Close()
+	close(replacement.results)
+	select {
+	case state := <-done:
+		c.Fatalf("unexpected end of %v reported", state.Consumer)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (s *MultiplexerSuite) TestAddRemoveConcurrently(c *C) {
+	for _, roundRobin := range []bool{false, true} {
+		conf := NewMxConf()
+		conf.RoundRobin = roundRobin
+		mx := NewMx(conf, &seqConsumer{topic: "base"})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					sc := &seqConsumer{topic: fmt.Sprintf("%d-%d", i, j)}
+					if err := mx.AddConsumer(sc); err != nil {
+						c.Errorf("cannot add consumer: %s", err)
+						return
+					}
+					mx.Sources()
+					if !mx.RemoveConsumer(sc) {
+						c.Errorf("cannot remove consumer %s", sc.topic)
+						return
+					}
+				}
+			}(i)
+		}
+
+		stop := make(chan struct{})
+		consumed := make(chan struct{})
+		go func() {
+			defer close(consumed)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := mx.Consume(); err != nil {
+					c.Errorf("cannot consume: %s", err)
+					return
+				}
+			}
+		}()
+
+		wg.Wait()
+		close(stop)
+		<-consumed
+		c.Assert(mx.Sources(), HasLen, 1)
+		mx.Close()
+		c.Assert(mx.AddConsumer(&seqConsumer{}), Equals, ErrMxClosed)
+	}
+}
@@ -0,0 +1,219 @@
+package kafka
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// PatternConsumerConf is the configuration of a PatternConsumer.
+type PatternConsumerConf struct {
+	// RefreshInterval is how often the topics of the cluster are listed to
+	// find topics that started or stopped matching the pattern.
+	//
+	// Defaults to 30s.
+	RefreshInterval time.Duration
+
+	// Consumer is the configuration of the partition consumers. Topic and
+	// Partition are set for every partition, and StartOffset is only used
+	// for the topics matching when the consumer is created.
+	//
+	// Defaults to NewConsumerConf.
+	Consumer ConsumerConf
+
+	// NewTopicStartOffset is the StartOffset of the partitions found by a
+	// later refresh, of new topics as well as partitions added to a topic.
+	// It is an offset or one of StartOffsetOldest and StartOffsetNewest.
+	//
+	// Defaults to StartOffsetOldest, so that messages written before the
+	// topic was found are not missed.
+	NewTopicStartOffset int64
+}
+
+// NewPatternConsumerConf returns the default pattern consumer configuration.
+func NewPatternConsumerConf() PatternConsumerConf {
+	return PatternConsumerConf{
+		RefreshInterval:     30 * time.Second,
+		Consumer:            NewConsumerConf("", 0),
+		NewTopicStartOffset: StartOffsetOldest,
+	}
+}
+
+// Validate returns an error describing the first invalid setting, or nil if
+// the configuration is valid.
+func (conf PatternConsumerConf) Validate() error {
+	switch {
+	case conf.RefreshInterval <= 0:
+		return fmt.Errorf("RefreshInterval %s must be positive", conf.RefreshInterval)
+	case conf.NewTopicStartOffset < StartOffsetNewest:
+		return fmt.Errorf("invalid NewTopicStartOffset %d", conf.NewTopicStartOffset)
+	}
+	consumerConf := conf.Consumer
+	consumerConf.Topic = "-"
+	if err := consumerConf.Validate(); err != nil {
+		return fmt.Errorf("invalid consumer configuration: %s", err)
+	}
+	return nil
+}
+
+// PatternConsumer consumes all partitions of the topics whose name matches a
+// regular expression. The topics are listed again every RefreshInterval:
+// partitions of topics that start matching are consumed from then on, and
+// those of topics that were deleted stop being consumed. Internal topics are
+// never consumed.
+//
+// Messages of all partitions are merged into a single stream like by Mx,
+// and errors of a partition consumer are returned as *MxError.
+type PatternConsumer struct {
+	broker  *Broker
+	pattern *regexp.Regexp
+	conf    PatternConsumerConf
+	mx      *Mx
+
+	// mu protects consumers.
+	mu        *sync.Mutex
+	consumers map[topicPartition]Consumer
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+// PatternConsumer starts consuming the topics whose whole name matches the
+// given regular expression. It returns an error if the pattern is invalid or
+// the topics of the cluster can't be listed.
+func (b *Broker) PatternConsumer(pattern string, conf PatternConsumerConf) (*PatternConsumer, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid pattern consumer configuration: %s", err)
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic pattern: %s", err)
+	}
+
+	c := &PatternConsumer{
+		broker:    b,
+		pattern:   re,
+		conf:      conf,
+		mx:        Merge(),
+		mu:        &sync.Mutex{},
+		consumers: make(map[topicPartition]Consumer),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	if err := c.refresh(conf.Consumer.StartOffset); err != nil {
+		c.mx.Close()
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// Consume returns the next message of any of the consumed partitions.
+func (c *PatternConsumer) Consume() (*proto.Message, error) {
+	return c.mx.Consume()
+}
+
+// Topics returns the names of the topics currently consumed, sorted.
+func (c *PatternConsumer) Topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var topics []string
+	for tp := range c.consumers {
+		if !seen[tp.topic] {
+			seen[tp.topic] = true
+			topics = append(topics, tp.topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Close stops consuming. Consume returns ErrMxClosed afterwards.
+func (c *PatternConsumer) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+		c.mx.Close()
+	})
+}
+
+// run refreshes the consumed topics every RefreshInterval until the consumer
+// is closed.
+func (c *PatternConsumer) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.conf.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := c.refresh(c.conf.NewTopicStartOffset); err != nil {
+			log.Warningf("cannot refresh topics matching %s: %s", c.pattern, err)
+		}
+	}
+}
+
+// refresh lists the topics of the cluster, starts consuming the partitions
+// of matching topics from startOffset and stops consuming the partitions of
+// topics that are gone. Partitions whose consumer can't be created are tried
+// again with the next refresh, the first such error is returned.
+func (c *PatternConsumer) refresh(startOffset int64) error {
+	topics, err := c.broker.ListTopics()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	found := make(map[topicPartition]bool)
+	for _, topic := range topics {
+		if !c.pattern.MatchString(topic.Name) {
+			continue
+		}
+		for partition := int32(0); partition < topic.Partitions; partition++ {
+			tp := topicPartition{topic.Name, partition}
+			found[tp] = true
+			if _, ok := c.consumers[tp]; ok {
+				continue
+			}
+
+			conf := c.conf.Consumer
+			conf.Topic = topic.Name
+			conf.Partition = partition
+			conf.StartOffset = startOffset
+			consumer, err := c.broker.Consumer(conf)
+			if err == nil {
+				err = c.mx.AddConsumer(consumer)
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("cannot consume %s: %s", tp, err)
+				}
+				continue
+			}
+			c.consumers[tp] = consumer
+		}
+	}
+
+	for tp, consumer := range c.consumers {
+		if !found[tp] {
+			c.mx.RemoveConsumer(consumer)
+			delete(c.consumers, tp)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,134 @@
+package kafka
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&PatternConsumerSuite{})
+
+type PatternConsumerSuite struct{}
+
+func (s *PatternConsumerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// topicsHandler serves metadata listing the topics in partitions, which can
+// be changed while the server runs.
+func topicsHandler(srv *Server, mu *sync.Mutex, partitions map[string]int) RequestHandler {
+	host, port := srv.HostPort()
+	return func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		resp := &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: host, Port: int32(port)},
+			},
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for name, n := range partitions {
+			topic := proto.MetadataRespTopic{Name: name}
+			for p := 0; p < n; p++ {
+				topic.Partitions = append(topic.Partitions, proto.MetadataRespPartition{
+					ID: int32(p), Leader: 1, Replicas: []int32{1}, Isrs: []int32{1},
+				})
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+	}
+}
+
+func consumeValues(c *C, consumer *PatternConsumer, n int) []string {
+	var values []string
+	for len(values) < n {
+		msg, err := consumer.Consume()
+		c.Assert(err, IsNil)
+		values = append(values, string(msg.Value))
+	}
+	sort.Strings(values)
+	return values
+}
+
+func (s *PatternConsumerSuite) TestFollowsMatchingTopics(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	mu := &sync.Mutex{}
+	partitions := map[string]int{
+		"orders.eu":          1,
+		"orders.us":          2,
+		"archive.orders.eu":  1,
+		"payments":           1,
+		"__consumer_offsets": 1,
+	}
+	srv.Handle(MetadataRequest, topicsHandler(srv, mu, partitions))
+	srv.AddMessages("orders.eu", 0, &proto.Message{Value: []byte("eu")})
+	srv.AddMessages("orders.us", 1, &proto.Message{Value: []byte("us")})
+	srv.AddMessages("archive.orders.eu", 0, &proto.Message{Value: []byte("archived")})
+	srv.AddMessages("payments", 0, &proto.Message{Value: []byte("paid")})
+
+	brokerConf := NewBrokerConf("tester")
+	brokerConf.LeaderRetryWait = 2 * time.Millisecond
+	broker, err := NewBroker("test-cluster-pattern", []string{srv.Address()}, brokerConf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewPatternConsumerConf()
+	conf.RefreshInterval = 10 * time.Millisecond
+	conf.Consumer.RetryWait = time.Millisecond
+	consumer, err := broker.PatternConsumer(`orders\..*`, conf)
+	c.Assert(err, IsNil)
+	defer consumer.Close()
+
+	c.Assert(consumer.Topics(), DeepEquals, []string{"orders.eu", "orders.us"})
+	c.Assert(consumeValues(c, consumer, 2), DeepEquals, []string{"eu", "us"})
+
+	// a topic created later is consumed from the start
+	srv.AddMessages("orders.asia", 0, &proto.Message{Value: []byte("asia")})
+	mu.Lock()
+	partitions["orders.asia"] = 1
+	mu.Unlock()
+	c.Assert(consumeValues(c, consumer, 1), DeepEquals, []string{"asia"})
+	c.Assert(consumer.Topics(), DeepEquals, []string{"orders.asia", "orders.eu", "orders.us"})
+
+	// a deleted topic is not consumed anymore
+	mu.Lock()
+	delete(partitions, "orders.eu")
+	mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for len(consumer.Topics()) > 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Assert(consumer.Topics(), DeepEquals, []string{"orders.asia", "orders.us"})
+
+	consumer.Close()
+	_, err = consumer.Consume()
+	c.Assert(err, Equals, ErrMxClosed)
+}
+
+func (s *PatternConsumerSuite) TestInvalidPattern(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	broker, err := NewBroker("test-cluster-pattern", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	_, err = broker.PatternConsumer(`orders(`, NewPatternConsumerConf())
+	c.Assert(err, NotNil)
+
+	conf := NewPatternConsumerConf()
+	conf.RefreshInterval = 0
+	_, err = broker.PatternConsumer(`orders`, conf)
+	c.Assert(err, NotNil)
+}
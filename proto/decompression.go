@@ -0,0 +1,75 @@
+package proto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DecompressionLimiter bounds the memory used to decompress message sets.
+//
+// At most limit message sets are decompressed at the same time; decoding a
+// compressed set blocks until a slot is free. Decompressed data is written
+// into buffers that are reused once the messages were copied out of them, so
+// a wide consumer does not allocate a fresh buffer for every compressed batch
+// of every partition.
+//
+// A single limiter is meant to be shared by all consumers whose memory should
+// be bounded together. It is safe for concurrent use.
+type DecompressionLimiter struct {
+	slots   chan struct{}
+	buffers sync.Pool
+
+	active int32
+	peak   int32
+}
+
+// NewDecompressionLimiter returns a limiter allowing up to limit concurrent
+// decompressions. A limit of 0 or less only pools buffers without bounding
+// concurrency.
+func NewDecompressionLimiter(limit int) *DecompressionLimiter {
+	l := &DecompressionLimiter{}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	l.buffers.New = func() interface{} {
+		return new([]byte)
+	}
+	return l
+}
+
+// Active returns the number of decompressions in progress.
+func (l *DecompressionLimiter) Active() int {
+	return int(atomic.LoadInt32(&l.active))
+}
+
+// Peak returns the highest number of decompressions that were in progress at
+// the same time.
+func (l *DecompressionLimiter) Peak() int {
+	return int(atomic.LoadInt32(&l.peak))
+}
+
+// acquire waits for a free slot and returns a buffer to decompress into. Each
+// call must be paired with a call to release.
+func (l *DecompressionLimiter) acquire() *[]byte {
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+	active := atomic.AddInt32(&l.active, 1)
+	for {
+		peak := atomic.LoadInt32(&l.peak)
+		if active <= peak || atomic.CompareAndSwapInt32(&l.peak, peak, active) {
+			break
+		}
+	}
+	return l.buffers.Get().(*[]byte)
+}
+
+// release returns the buffer to the pool and frees the slot.
+func (l *DecompressionLimiter) release(buf *[]byte) {
+	*buf = (*buf)[:0]
+	l.buffers.Put(buf)
+	atomic.AddInt32(&l.active, -1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,167 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&DecompressionSuite{})
+
+type DecompressionSuite struct{}
+
+func compressedMessageSet(compression Compression, count int) []byte {
+	messages := make([]*Message, count)
+	for i := range messages {
+		messages[i] = &Message{
+			Offset: int64(i),
+			Value:  bytes.Repeat([]byte(strconv.Itoa(i)), 100),
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := writeMessageSet(&buf, messages, compression, false); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func (s *DecompressionSuite) TestConcurrencyIsBounded(c *C) {
+	for _, compression := range []Compression{CompressionGzip, CompressionSnappy, CompressionLZ4} {
+		set := compressedMessageSet(compression, 50)
+		limiter := NewDecompressionLimiter(3)
+
+		// many partitions decompressing at the same time
+		var wg sync.WaitGroup
+		errc := make(chan error, 64)
+		for i := 0; i < 64; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				messages, err := readMessageSet(bytes.NewReader(set), int32(len(set)), limiter, crcReject)
+				if err == nil && len(messages) != 50 {
+					err = errors.New("wrong number of messages")
+				}
+				if err == nil && string(messages[49].Value) != string(bytes.Repeat([]byte("49"), 100)) {
+					err = errors.New("wrong message value")
+				}
+				errc <- err
+			}()
+		}
+		wg.Wait()
+		close(errc)
+		for err := range errc {
+			c.Assert(err, IsNil)
+		}
+
+		c.Assert(limiter.Active(), Equals, 0)
+		c.Assert(limiter.Peak() > 0, Equals, true)
+		c.Assert(limiter.Peak() <= 3, Equals, true)
+	}
+}
+
+func (s *DecompressionSuite) TestDecodedMessagesDoNotShareBuffers(c *C) {
+	limiter := NewDecompressionLimiter(1)
+	set1 := compressedMessageSet(CompressionGzip, 2)
+	first, err := readMessageSet(bytes.NewReader(set1), int32(len(set1)), limiter, crcReject)
+	c.Assert(err, IsNil)
+	want := string(first[1].Value)
+
+	// decoding again reuses the buffer, which must not change earlier messages
+	set2 := compressedMessageSet(CompressionGzip, 10)
+	_, err = readMessageSet(bytes.NewReader(set2), int32(len(set2)), limiter, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(string(first[1].Value), Equals, want)
+}
+
+func (s *DecompressionSuite) TestGzipDecodedSizeIsBounded(c *C) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(make([]byte, 4<<20))
+	c.Assert(err, IsNil)
+	c.Assert(gz.Close(), IsNil)
+	bomb := buf.Bytes()
+
+	decoded, err := gzipDecode(nil, bomb, 4<<20)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, 4<<20)
+
+	// decoding stops right after the limit instead of reading everything
+	decoded, err = gzipDecode(nil, bomb, 1<<20)
+	c.Assert(err, ErrorMatches, "gzip message exceeds the limit of 1048576 bytes")
+	c.Assert(decoded, IsNil)
+}
+
+func benchmarkReadCompressedMessageSet(b *testing.B, limiter *DecompressionLimiter) {
+	set := compressedMessageSet(CompressionGzip, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := readMessageSet(bytes.NewReader(set), int32(len(set)), limiter, crcReject); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReadCompressedMessageSet(b *testing.B) {
+	benchmarkReadCompressedMessageSet(b, nil)
+}
+
+func BenchmarkReadCompressedMessageSetLimited(b *testing.B) {
+	benchmarkReadCompressedMessageSet(b, NewDecompressionLimiter(2))
+}
+
+// messageSet returns an encoded message set of count messages with values of
+// the given size.
+func messageSet(compression Compression, count, size int) []byte {
+	messages := make([]*Message, count)
+	for i := range messages {
+		messages[i] = &Message{
+			Offset: int64(i),
+			Key:    []byte(strconv.Itoa(i)),
+			Value:  bytes.Repeat([]byte{byte('a' + i%26)}, size),
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := writeMessageSet(&buf, messages, compression, false); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkReadMessageSet(b *testing.B, set []byte) {
+	b.SetBytes(int64(len(set)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := readMessageSet(bytes.NewReader(set), int32(len(set)), nil, crcReject); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadMessageSetSmall(b *testing.B) {
+	benchmarkReadMessageSet(b, messageSet(CompressionNone, 1000, 100))
+}
+
+func BenchmarkReadMessageSetLarge(b *testing.B) {
+	benchmarkReadMessageSet(b, messageSet(CompressionNone, 10, 100000))
+}
+
+func BenchmarkReadMessageSetSmallGzip(b *testing.B) {
+	benchmarkReadMessageSet(b, messageSet(CompressionGzip, 1000, 100))
+}
+
+func BenchmarkReadMessageSetSmallSnappy(b *testing.B) {
+	benchmarkReadMessageSet(b, messageSet(CompressionSnappy, 1000, 100))
+}
+
+func BenchmarkReadMessageSetLargeSnappy(b *testing.B) {
+	benchmarkReadMessageSet(b, messageSet(CompressionSnappy, 10, 100000))
+}
@@ -5,36 +5,41 @@ import (
 )
 
 var (
-	ErrUnknown                                 = &KafkaError{-1, "unknown error"}
-	ErrOffsetOutOfRange                        = &KafkaError{1, "offset out of range"}
-	ErrInvalidMessage                          = &KafkaError{2, "invalid message"}
-	ErrUnknownTopicOrPartition                 = &KafkaError{3, "[transient] unknown topic or partition"}
-	ErrInvalidMessageSize                      = &KafkaError{4, "invalid message size"}
-	ErrLeaderNotAvailable                      = &KafkaError{5, "[transient] leader not available"}
-	ErrNotLeaderForPartition                   = &KafkaError{6, "[transient] not leader for partition"}
-	ErrRequestTimeout                          = &KafkaError{7, "[transient] request timed out"}
-	ErrBrokerNotAvailable                      = &KafkaError{8, "broker not available"}
-	ErrReplicaNotAvailable                     = &KafkaError{9, "replica not available"}
-	ErrMessageSizeTooLarge                     = &KafkaError{10, "message size too large"}
-	ErrScaleControllerEpoch                    = &KafkaError{11, "scale controller epoch"}
-	ErrOffsetMetadataTooLarge                  = &KafkaError{12, "offset metadata too large"}
-	ErrOffsetLoadInProgress                    = &KafkaError{14, "[transient] offsets load in progress"}
-	ErrNoCoordinator                           = &KafkaError{15, "[transient] consumer coordinator not available"}
-	ErrNotCoordinator                          = &KafkaError{16, "[transient] not coordinator for consumer"}
-	ErrInvalidTopic                            = &KafkaError{17, "operation on an invalid topic"}
-	ErrRecordListTooLarge                      = &KafkaError{18, "message batch larger than the configured segment size"}
-	ErrNotEnoughReplicas                       = &KafkaError{19, "[transient] not enough in-sync replicas"}
-	ErrNotEnoughReplicasAfterAppend            = &KafkaError{20, "[transient] messages are written to the log, but to fewer in-sync replicas than required"}
-	ErrInvalidRequiredAcks                     = &KafkaError{21, "invalid value for required acks"}
-	ErrIllegalGeneration                       = &KafkaError{22, "consumer generation id is not valid"}
-	ErrInconsistentPartitionAssignmentStrategy = &KafkaError{23, "partition assignment strategy does not match that of the group"}
-	ErrUnknownParititonAssignmentStrategy      = &KafkaError{24, "partition assignment strategy is unknown to the broker"}
-	ErrUnknownConsumerID                       = &KafkaError{25, "coordinator is not aware of this consumer"}
-	ErrInvalidSessionTimeout                   = &KafkaError{26, "invalid session timeout"}
-	ErrCommitingParitionsNotAssigned           = &KafkaError{27, "committing partitions are not assigned the committer"}
-	ErrInvalidCommitOffsetSize                 = &KafkaError{28, "offset data size is not valid"}
-	ErrAuthorizationFailed                     = &KafkaError{29, "not authorized"}
-	ErrRebalanceInProgress                     = &KafkaError{30, "group is rebalancing, rejoin is needed"}
+	ErrUnknown                      = &KafkaError{-1, "unknown error"}
+	ErrOffsetOutOfRange             = &KafkaError{1, "offset out of range"}
+	ErrInvalidMessage               = &KafkaError{2, "invalid message"}
+	ErrUnknownTopicOrPartition      = &KafkaError{3, "[transient] unknown topic or partition"}
+	ErrInvalidMessageSize           = &KafkaError{4, "invalid message size"}
+	ErrLeaderNotAvailable           = &KafkaError{5, "[transient] leader not available"}
+	ErrNotLeaderForPartition        = &KafkaError{6, "[transient] not leader for partition"}
+	ErrRequestTimeout               = &KafkaError{7, "[transient] request timed out"}
+	ErrBrokerNotAvailable           = &KafkaError{8, "broker not available"}
+	ErrReplicaNotAvailable          = &KafkaError{9, "replica not available"}
+	ErrMessageSizeTooLarge          = &KafkaError{10, "message size too large"}
+	ErrScaleControllerEpoch         = &KafkaError{11, "scale controller epoch"}
+	ErrOffsetMetadataTooLarge       = &KafkaError{12, "offset metadata too large"}
+	ErrOffsetLoadInProgress         = &KafkaError{14, "[transient] offsets load in progress"}
+	ErrNoCoordinator                = &KafkaError{15, "[transient] consumer coordinator not available"}
+	ErrNotCoordinator               = &KafkaError{16, "[transient] not coordinator for consumer"}
+	ErrInvalidTopic                 = &KafkaError{17, "operation on an invalid topic"}
+	ErrRecordListTooLarge           = &KafkaError{18, "message batch larger than the configured segment size"}
+	ErrNotEnoughReplicas            = &KafkaError{19, "[transient] not enough in-sync replicas"}
+	ErrNotEnoughReplicasAfterAppend = &KafkaError{20, "[transient] messages are written to the log, but to fewer in-sync replicas than required"}
+	ErrInvalidRequiredAcks          = &KafkaError{21, "invalid value for required acks"}
+	ErrIllegalGeneration            = &KafkaError{22, "consumer generation id is not valid"}
+	ErrInconsistentGroupProtocol    = &KafkaError{23, "group protocols of the member are incompatible with those of the group"}
+	ErrInvalidGroupID               = &KafkaError{24, "invalid group id"}
+	ErrUnknownConsumerID            = &KafkaError{25, "coordinator is not aware of this consumer"}
+	ErrInvalidSessionTimeout        = &KafkaError{26, "invalid session timeout"}
+	ErrRebalanceInProgress          = &KafkaError{27, "group is rebalancing, rejoin is needed"}
+	ErrInvalidCommitOffsetSize      = &KafkaError{28, "offset data size is not valid"}
+	ErrTopicAuthorizationFailed     = &KafkaError{29, "not authorized to access topic"}
+	ErrGroupAuthorizationFailed     = &KafkaError{30, "not authorized to access group"}
+	ErrClusterAuthorizationFailed   = &KafkaError{31, "not authorized to perform cluster action"}
+	ErrUnsupportedSASLMechanism     = &KafkaError{33, "SASL mechanism is not supported by the broker"}
+	ErrIllegalSASLState             = &KafkaError{34, "request is not valid in the current SASL state"}
+	ErrUnsupportedVersion           = &KafkaError{35, "version of the request is not supported"}
+	ErrSASLAuthenticationFailed     = &KafkaError{58, "SASL authentication failed"}
 
 	errnoToErr = map[int16]error{
 		-1: ErrUnknown,
@@ -59,17 +64,47 @@ var (
 		20: ErrNotEnoughReplicasAfterAppend,
 		21: ErrInvalidRequiredAcks,
 		22: ErrIllegalGeneration,
-		23: ErrInconsistentPartitionAssignmentStrategy,
-		24: ErrUnknownParititonAssignmentStrategy,
+		23: ErrInconsistentGroupProtocol,
+		24: ErrInvalidGroupID,
 		25: ErrUnknownConsumerID,
 		26: ErrInvalidSessionTimeout,
-		27: ErrCommitingParitionsNotAssigned,
+		27: ErrRebalanceInProgress,
 		28: ErrInvalidCommitOffsetSize,
-		29: ErrAuthorizationFailed,
-		30: ErrRebalanceInProgress,
+		29: ErrTopicAuthorizationFailed,
+		30: ErrGroupAuthorizationFailed,
+		31: ErrClusterAuthorizationFailed,
+		33: ErrUnsupportedSASLMechanism,
+		34: ErrIllegalSASLState,
+		35: ErrUnsupportedVersion,
+		58: ErrSASLAuthenticationFailed,
 	}
 )
 
+var (
+	// ErrInconsistentPartitionAssignmentStrategy is code 23, which is
+	// INCONSISTENT_GROUP_PROTOCOL.
+	//
+	// Deprecated: Use ErrInconsistentGroupProtocol.
+	ErrInconsistentPartitionAssignmentStrategy = ErrInconsistentGroupProtocol
+
+	// ErrUnknownParititonAssignmentStrategy is code 24, which is
+	// INVALID_GROUP_ID.
+	//
+	// Deprecated: Use ErrInvalidGroupID.
+	ErrUnknownParititonAssignmentStrategy = ErrInvalidGroupID
+
+	// ErrCommitingParitionsNotAssigned is code 27, which is
+	// REBALANCE_IN_PROGRESS.
+	//
+	// Deprecated: Use ErrRebalanceInProgress.
+	ErrCommitingParitionsNotAssigned = ErrRebalanceInProgress
+
+	// ErrAuthorizationFailed is code 29, which is TOPIC_AUTHORIZATION_FAILED.
+	//
+	// Deprecated: Use ErrTopicAuthorizationFailed.
+	ErrAuthorizationFailed = ErrTopicAuthorizationFailed
+)
+
 type KafkaError struct {
 	errno   int16
 	message string
@@ -93,3 +128,168 @@ func errFromNo(errno int16) error {
 	}
 	return err
 }
+
+// ShouldRefreshMetadata returns true if the given error indicates that the
+// cluster metadata known to the client is stale, for example because
+// partition leadership moved to another broker, and must be refreshed before
+// the request is retried.
+func ShouldRefreshMetadata(err error) bool {
+	switch err {
+	case ErrUnknownTopicOrPartition, ErrLeaderNotAvailable,
+		ErrNotLeaderForPartition, ErrBrokerNotAvailable:
+		return true
+	}
+	return false
+}
+
+// IsTransient returns true if a request that failed with err may succeed
+// when sent again, for example once a new partition leader was elected or
+// the coordinator loaded the group's offsets. Errors that are not Kafka
+// errors are never transient.
+func IsTransient(err error) bool {
+	switch err {
+	case ErrRequestTimeout, ErrOffsetLoadInProgress, ErrNoCoordinator,
+		ErrNotCoordinator, ErrNotEnoughReplicas, ErrNotEnoughReplicasAfterAppend:
+		return true
+	}
+	return ShouldRefreshMetadata(err)
+}
+
+// errnoToName maps error codes to the names used by the Kafka documentation
+// and broker logs. It covers all codes known to Kafka, not only the ones this
+// package has an error value for.
+var errnoToName = map[int16]string{
+	-1:  "UNKNOWN_SERVER_ERROR",
+	0:   "NONE",
+	1:   "OFFSET_OUT_OF_RANGE",
+	2:   "CORRUPT_MESSAGE",
+	3:   "UNKNOWN_TOPIC_OR_PARTITION",
+	4:   "INVALID_FETCH_SIZE",
+	5:   "LEADER_NOT_AVAILABLE",
+	6:   "NOT_LEADER_OR_FOLLOWER",
+	7:   "REQUEST_TIMED_OUT",
+	8:   "BROKER_NOT_AVAILABLE",
+	9:   "REPLICA_NOT_AVAILABLE",
+	10:  "MESSAGE_TOO_LARGE",
+	11:  "STALE_CONTROLLER_EPOCH",
+	12:  "OFFSET_METADATA_TOO_LARGE",
+	13:  "NETWORK_EXCEPTION",
+	14:  "COORDINATOR_LOAD_IN_PROGRESS",
+	15:  "COORDINATOR_NOT_AVAILABLE",
+	16:  "NOT_COORDINATOR",
+	17:  "INVALID_TOPIC_EXCEPTION",
+	18:  "RECORD_LIST_TOO_LARGE",
+	19:  "NOT_ENOUGH_REPLICAS",
+	20:  "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	21:  "INVALID_REQUIRED_ACKS",
+	22:  "ILLEGAL_GENERATION",
+	23:  "INCONSISTENT_GROUP_PROTOCOL",
+	24:  "INVALID_GROUP_ID",
+	25:  "UNKNOWN_MEMBER_ID",
+	26:  "INVALID_SESSION_TIMEOUT",
+	27:  "REBALANCE_IN_PROGRESS",
+	28:  "INVALID_COMMIT_OFFSET_SIZE",
+	29:  "TOPIC_AUTHORIZATION_FAILED",
+	30:  "GROUP_AUTHORIZATION_FAILED",
+	31:  "CLUSTER_AUTHORIZATION_FAILED",
+	32:  "INVALID_TIMESTAMP",
+	33:  "UNSUPPORTED_SASL_MECHANISM",
+	34:  "ILLEGAL_SASL_STATE",
+	35:  "UNSUPPORTED_VERSION",
+	36:  "TOPIC_ALREADY_EXISTS",
+	37:  "INVALID_PARTITIONS",
+	38:  "INVALID_REPLICATION_FACTOR",
+	39:  "INVALID_REPLICA_ASSIGNMENT",
+	40:  "INVALID_CONFIG",
+	41:  "NOT_CONTROLLER",
+	42:  "INVALID_REQUEST",
+	43:  "UNSUPPORTED_FOR_MESSAGE_FORMAT",
+	44:  "POLICY_VIOLATION",
+	45:  "OUT_OF_ORDER_SEQUENCE_NUMBER",
+	46:  "DUPLICATE_SEQUENCE_NUMBER",
+	47:  "INVALID_PRODUCER_EPOCH",
+	48:  "INVALID_TXN_STATE",
+	49:  "INVALID_PRODUCER_ID_MAPPING",
+	50:  "INVALID_TRANSACTION_TIMEOUT",
+	51:  "CONCURRENT_TRANSACTIONS",
+	52:  "TRANSACTION_COORDINATOR_FENCED",
+	53:  "TRANSACTIONAL_ID_AUTHORIZATION_FAILED",
+	54:  "SECURITY_DISABLED",
+	55:  "OPERATION_NOT_ATTEMPTED",
+	56:  "KAFKA_STORAGE_ERROR",
+	57:  "LOG_DIR_NOT_FOUND",
+	58:  "SASL_AUTHENTICATION_FAILED",
+	59:  "UNKNOWN_PRODUCER_ID",
+	60:  "REASSIGNMENT_IN_PROGRESS",
+	61:  "DELEGATION_TOKEN_AUTH_DISABLED",
+	62:  "DELEGATION_TOKEN_NOT_FOUND",
+	63:  "DELEGATION_TOKEN_OWNER_MISMATCH",
+	64:  "DELEGATION_TOKEN_REQUEST_NOT_ALLOWED",
+	65:  "DELEGATION_TOKEN_AUTHORIZATION_FAILED",
+	66:  "DELEGATION_TOKEN_EXPIRED",
+	67:  "INVALID_PRINCIPAL_TYPE",
+	68:  "NON_EMPTY_GROUP",
+	69:  "GROUP_ID_NOT_FOUND",
+	70:  "FETCH_SESSION_ID_NOT_FOUND",
+	71:  "INVALID_FETCH_SESSION_EPOCH",
+	72:  "LISTENER_NOT_FOUND",
+	73:  "TOPIC_DELETION_DISABLED",
+	74:  "FENCED_LEADER_EPOCH",
+	75:  "UNKNOWN_LEADER_EPOCH",
+	76:  "UNSUPPORTED_COMPRESSION_TYPE",
+	77:  "STALE_BROKER_EPOCH",
+	78:  "OFFSET_NOT_AVAILABLE",
+	79:  "MEMBER_ID_REQUIRED",
+	80:  "PREFERRED_LEADER_NOT_AVAILABLE",
+	81:  "GROUP_MAX_SIZE_REACHED",
+	82:  "FENCED_INSTANCE_ID",
+	83:  "ELIGIBLE_LEADERS_NOT_AVAILABLE",
+	84:  "ELECTION_NOT_NEEDED",
+	85:  "NO_REASSIGNMENT_IN_PROGRESS",
+	86:  "GROUP_SUBSCRIBED_TO_TOPIC",
+	87:  "INVALID_RECORD",
+	88:  "UNSTABLE_OFFSET_COMMIT",
+	89:  "THROTTLING_QUOTA_EXCEEDED",
+	90:  "PRODUCER_FENCED",
+	91:  "RESOURCE_NOT_FOUND",
+	92:  "DUPLICATE_RESOURCE",
+	93:  "UNACCEPTABLE_CREDENTIAL",
+	94:  "INCONSISTENT_VOTER_SET",
+	95:  "INVALID_UPDATE_VERSION",
+	96:  "FEATURE_UPDATE_FAILED",
+	97:  "PRINCIPAL_DESERIALIZATION_FAILURE",
+	98:  "SNAPSHOT_NOT_FOUND",
+	99:  "POSITION_OUT_OF_RANGE",
+	100: "UNKNOWN_TOPIC_ID",
+	101: "DUPLICATE_BROKER_REGISTRATION",
+	102: "BROKER_ID_NOT_REGISTERED",
+	103: "INCONSISTENT_TOPIC_ID",
+	104: "INCONSISTENT_CLUSTER_ID",
+	105: "TRANSACTIONAL_ID_NOT_FOUND",
+	106: "FETCH_SESSION_TOPIC_ID_ERROR",
+	107: "INELIGIBLE_REPLICA",
+	108: "NEW_LEADER_ELECTED",
+	109: "OFFSET_MOVED_TO_TIERED_STORAGE",
+	110: "FENCED_MEMBER_EPOCH",
+	111: "UNRELEASED_INSTANCE_ID",
+	112: "UNSUPPORTED_ASSIGNOR",
+	113: "STALE_MEMBER_EPOCH",
+	114: "MISMATCHED_ENDPOINT_TYPE",
+	115: "UNSUPPORTED_ENDPOINT_TYPE",
+	116: "UNKNOWN_CONTROLLER_ID",
+	117: "UNKNOWN_SUBSCRIPTION_ID",
+	118: "TELEMETRY_TOO_LARGE",
+	119: "INVALID_REGISTRATION",
+	120: "TRANSACTION_ABORTABLE",
+}
+
+// ErrorName returns the canonical Kafka name of the given error code, such as
+// "NOT_LEADER_OR_FOLLOWER", so that logs can be matched against the Kafka
+// documentation and broker logs. Codes unknown to this package are returned
+// as "UNKNOWN_ERROR_CODE(<code>)".
+func ErrorName(code int16) string {
+	if name, ok := errnoToName[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_CODE(%d)", code)
+}
@@ -0,0 +1,117 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ErrorsSuite{})
+
+type ErrorsSuite struct{}
+
+func (s *ErrorsSuite) TestShouldRefreshMetadata(c *C) {
+	refresh := []error{
+		ErrUnknownTopicOrPartition,
+		ErrLeaderNotAvailable,
+		ErrNotLeaderForPartition,
+		ErrBrokerNotAvailable,
+	}
+	for _, err := range refresh {
+		c.Assert(ShouldRefreshMetadata(err), Equals, true, Commentf("%s", err))
+	}
+
+	keep := []error{
+		nil,
+		ErrOffsetOutOfRange,
+		ErrRequestTimeout,
+		ErrReplicaNotAvailable,
+		ErrMessageSizeTooLarge,
+		ErrNotCoordinator,
+		errors.New("leader not available"),
+	}
+	for _, err := range keep {
+		c.Assert(ShouldRefreshMetadata(err), Equals, false, Commentf("%v", err))
+	}
+}
+
+func (s *ErrorsSuite) TestIsTransient(c *C) {
+	transient := []error{
+		ErrUnknownTopicOrPartition,
+		ErrLeaderNotAvailable,
+		ErrNotLeaderForPartition,
+		ErrRequestTimeout,
+		ErrBrokerNotAvailable,
+		ErrOffsetLoadInProgress,
+		ErrNoCoordinator,
+		ErrNotCoordinator,
+		ErrNotEnoughReplicas,
+		ErrNotEnoughReplicasAfterAppend,
+	}
+	for _, err := range transient {
+		c.Assert(IsTransient(err), Equals, true, Commentf("%s", err))
+	}
+
+	final := []error{
+		nil,
+		ErrOffsetOutOfRange,
+		ErrInvalidMessage,
+		ErrMessageSizeTooLarge,
+		ErrTopicAuthorizationFailed,
+		ErrInvalidMessageCRC,
+		errors.New("[transient] request timed out"),
+	}
+	for _, err := range final {
+		c.Assert(IsTransient(err), Equals, false, Commentf("%v", err))
+	}
+}
+
+func (s *ErrorsSuite) TestErrorName(c *C) {
+	c.Assert(ErrorName(0), Equals, "NONE")
+	c.Assert(ErrorName(-1), Equals, "UNKNOWN_SERVER_ERROR")
+	c.Assert(ErrorName(6), Equals, "NOT_LEADER_OR_FOLLOWER")
+	c.Assert(ErrorName(76), Equals, "UNSUPPORTED_COMPRESSION_TYPE")
+	c.Assert(ErrorName(9999), Equals, "UNKNOWN_ERROR_CODE(9999)")
+
+	// every error this package can return has a name
+	for code := range errnoToErr {
+		c.Assert(ErrorName(code), Not(Matches), "UNKNOWN_ERROR_CODE.*")
+	}
+	for code := int16(-1); code <= 120; code++ {
+		c.Assert(ErrorName(code), Matches, "[A-Z_]+", Commentf("code %d", code))
+	}
+}
+
+func (s *ErrorsSuite) TestErrorCodes(c *C) {
+	codes := map[error]int16{
+		ErrInconsistentGroupProtocol:  23,
+		ErrInvalidGroupID:             24,
+		ErrRebalanceInProgress:        27,
+		ErrInvalidCommitOffsetSize:    28,
+		ErrTopicAuthorizationFailed:   29,
+		ErrGroupAuthorizationFailed:   30,
+		ErrClusterAuthorizationFailed: 31,
+	}
+	for err, code := range codes {
+		c.Assert(err.(*KafkaError).Errno(), Equals, int(code), Commentf("%s", err))
+	}
+	c.Assert(ErrorName(23), Equals, "INCONSISTENT_GROUP_PROTOCOL")
+	c.Assert(ErrorName(24), Equals, "INVALID_GROUP_ID")
+	c.Assert(ErrorName(27), Equals, "REBALANCE_IN_PROGRESS")
+	c.Assert(ErrorName(29), Equals, "TOPIC_AUTHORIZATION_FAILED")
+	c.Assert(ErrorName(30), Equals, "GROUP_AUTHORIZATION_FAILED")
+	c.Assert(ErrorName(31), Equals, "CLUSTER_AUTHORIZATION_FAILED")
+}
+
+func (s *ErrorsSuite) TestErrorCodesRoundTrip(c *C) {
+	for code, kerr := range errnoToErr {
+		c.Assert(kerr.(*KafkaError).Errno(), Equals, int(code))
+
+		b, err := (&HeartbeatResp{CorrelationID: 1, Err: kerr}).Bytes()
+		c.Assert(err, IsNil)
+		resp, err := ReadHeartbeatResp(bytes.NewReader(b))
+		c.Assert(err, IsNil)
+		c.Assert(resp.Err, Equals, kerr, Commentf("code %d", code))
+	}
+}
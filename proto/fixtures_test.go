@@ -0,0 +1,338 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Fixtures are raw responses, including the size header, stored in
+// testdata/fixtures. They are built by hand after the protocol documentation
+// rather than captured from brokers. Every fixture is named
+// <api>_v<version>_<description>.bin; the api and version select the decoder
+// from fixtureDecoders and the whole file name selects the expected result
+// from fixtureExpectations. Adding a fixture without an expectation fails the
+// test, so new fixtures cannot be silently ignored.
+
+var _ = Suite(&FixturesSuite{})
+
+type FixturesSuite struct{}
+
+type fixtureDecoder func(r io.Reader) (interface{}, error)
+
+var fixtureDecoders = map[string]fixtureDecoder{
+	"metadata_v0": func(r io.Reader) (interface{}, error) { return ReadMetadataResp(r) },
+	"metadata_v1": func(r io.Reader) (interface{}, error) { return ReadVersionedMetadataResp(r, 1) },
+	"produce_v0":  func(r io.Reader) (interface{}, error) { return ReadProduceResp(r) },
+	"produce_v3":  func(r io.Reader) (interface{}, error) { return ReadVersionedProduceResp(r, 3) },
+	"fetch_v0":    func(r io.Reader) (interface{}, error) { return ReadFetchResp(r) },
+	"fetch_v4":    func(r io.Reader) (interface{}, error) { return ReadVersionedFetchResp(r, 4, nil) },
+}
+
+var fixtureFetchFooMessages = &FetchResp{
+	CorrelationID: 241,
+	Topics: []FetchRespTopic{
+		{
+			Name: "foo",
+			Partitions: []FetchRespPartition{
+				{
+					ID:        0,
+					TipOffset: 4,
+					Messages: []*Message{
+						{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
+						{Offset: 3, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
+					},
+				},
+				{
+					ID:        1,
+					Err:       ErrUnknownTopicOrPartition,
+					TipOffset: -1,
+					Messages:  []*Message{},
+				},
+			},
+		},
+	},
+}
+
+var fixtureExpectations = map[string]interface{}{
+	"metadata_v0_four_brokers.bin": &MetadataResp{
+		CorrelationID: 123,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 49168, Host: "172.17.42.1", Port: 49168},
+			{NodeID: 49170, Host: "172.17.42.1", Port: 49170},
+			{NodeID: 49169, Host: "172.17.42.1", Port: 49169},
+			{NodeID: 49171, Host: "172.17.42.1", Port: 49171},
+		},
+		Topics: []MetadataRespTopic{
+			{
+				Name: "foo",
+				Partitions: []MetadataRespPartition{
+					{ID: 2, Leader: 49171, Replicas: []int32{49171, 49168, 49169}, Isrs: []int32{49171, 49168, 49169}},
+					{ID: 5, Leader: 49170, Replicas: []int32{49170, 49168, 49169}, Isrs: []int32{49170, 49168, 49169}},
+					{ID: 4, Leader: 49169, Replicas: []int32{49169, 49171, 49168}, Isrs: []int32{49169, 49171, 49168}},
+					{ID: 1, Leader: 49170, Replicas: []int32{49170, 49171, 49168}, Isrs: []int32{49170, 49171, 49168}},
+					{ID: 3, Leader: 49168, Replicas: []int32{49168, 49169, 49170}, Isrs: []int32{49168, 49169, 49170}},
+					{ID: 0, Leader: 49169, Replicas: []int32{49169, 49170, 49171}, Isrs: []int32{49169, 49170, 49171}},
+				},
+			},
+			{
+				Name: "test",
+				Partitions: []MetadataRespPartition{
+					{ID: 1, Leader: 49169, Replicas: []int32{49169, 49170, 49171}, Isrs: []int32{49169, 49170, 49171}},
+					{ID: 0, Leader: 49168, Replicas: []int32{49168, 49169, 49170}, Isrs: []int32{49168, 49169, 49170}},
+				},
+			},
+		},
+	},
+	"produce_v0_unknown_topic.bin": &ProduceResp{
+		CorrelationID: 241,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "fruits",
+				Partitions: []ProduceRespPartition{
+					{ID: 93, Err: ErrUnknownTopicOrPartition, Offset: -1},
+				},
+			},
+		},
+	},
+	// the broker rack of kafka3 is null
+	"metadata_v1_racks.bin": &MetadataResp{
+		Version:       1,
+		CorrelationID: 123,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 1, Host: "kafka1", Port: 9092, Rack: "rack-a"},
+			{NodeID: 2, Host: "kafka2", Port: 9092, Rack: "rack-b"},
+			{NodeID: 3, Host: "kafka3", Port: 9093},
+		},
+		ControllerID: 2,
+		Topics: []MetadataRespTopic{
+			{
+				Name: "foo",
+				Partitions: []MetadataRespPartition{
+					{ID: 0, Leader: 1, Replicas: []int32{1, 2, 3}, Isrs: []int32{1, 2}},
+					{ID: 1, Err: ErrReplicaNotAvailable, Leader: 2, Replicas: []int32{2, 3, 1}, Isrs: []int32{2}},
+				},
+			},
+			{
+				Name:       "__consumer_offsets",
+				IsInternal: true,
+				Partitions: []MetadataRespPartition{
+					{ID: 0, Leader: 3, Replicas: []int32{3}, Isrs: []int32{3}},
+				},
+			},
+			{Name: "missing", Err: ErrUnknownTopicOrPartition, Partitions: []MetadataRespPartition{}},
+		},
+	},
+	"produce_v3_log_append_time.bin": &ProduceResp{
+		Version:       3,
+		CorrelationID: 241,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Offset: 42, LogAppendTime: time.Unix(1500000000, 123*int64(time.Millisecond))},
+					{ID: 1, Err: ErrNotLeaderForPartition, Offset: -1},
+				},
+			},
+		},
+		ThrottleTime: 25 * time.Millisecond,
+	},
+	"produce_v0_success.bin": &ProduceResp{
+		CorrelationID: 241,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Offset: 1},
+				},
+			},
+		},
+	},
+	"fetch_v0_uncompressed.bin": fixtureFetchFooMessages,
+	"fetch_v0_gzip.bin":         fixtureFetchFooMessages,
+	"fetch_v0_snappy.bin":       fixtureFetchFooMessages,
+	// the value of the second message of partition 0 was changed after its
+	// crc was computed
+	"fetch_v0_corrupt_crc.bin": &FetchResp{
+		CorrelationID: 241,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:        0,
+						Err:       ErrInvalidMessageCRC,
+						TipOffset: 4,
+						Messages: []*Message{
+							{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
+						},
+					},
+					{
+						ID:        1,
+						Err:       ErrUnknownTopicOrPartition,
+						TipOffset: -1,
+						Messages:  []*Message{},
+					},
+				},
+			},
+		},
+	},
+	// offsets 0 and 1 were written outside of a transaction, offsets 2 and 3
+	// by producer 7 in a transaction it aborted with the control batch at
+	// offset 4
+	"fetch_v4_aborted_transactions.bin": &FetchResp{
+		Version:       4,
+		CorrelationID: 241,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:                  0,
+						TipOffset:           5,
+						LastStableOffset:    5,
+						AbortedTransactions: []AbortedTransaction{{ProducerID: 7, FirstOffset: 2}},
+						Messages: []*Message{
+							fixtureRecord(0, "bar", 0, fixtureBatchPlain),
+							fixtureRecord(1, "bar", 1, fixtureBatchPlain),
+							fixtureRecord(2, "baz", 2, fixtureBatchAborted),
+							fixtureRecord(3, "baz", 3, fixtureBatchAborted),
+						},
+					},
+				},
+			},
+		},
+	},
+	// a gzip compressed record batch followed by an uncompressed one
+	"fetch_v4_gzip_record_batch.bin": &FetchResp{
+		Version:       4,
+		CorrelationID: 241,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:               3,
+						TipOffset:        13,
+						LastStableOffset: 13,
+						Messages: []*Message{
+							{
+								Offset: 10, Key: []byte("k1"), Value: []byte("first"),
+								Topic: "foo", Partition: 3, TipOffset: 13, Format: 2,
+								Timestamp: time.Unix(1500000000, 0),
+								Headers:   []RecordHeader{{Key: "trace-id", Value: []byte("a1")}},
+								Batch:     fixtureBatchGzip,
+							},
+							{
+								Offset: 11, Value: []byte("second"),
+								Topic: "foo", Partition: 3, TipOffset: 13, Format: 2,
+								Timestamp: time.Unix(1500000000, 5*int64(time.Millisecond)),
+								Headers:   []RecordHeader{{Key: "trace-id", Value: []byte("a2")}, {Key: "empty"}},
+								Batch:     fixtureBatchGzip,
+							},
+							{
+								Offset: 12, Key: []byte("k3"), Value: []byte("third"),
+								Topic: "foo", Partition: 3, TipOffset: 13, Format: 2,
+								Timestamp: time.Unix(1500000001, 0),
+								Batch:     &RecordBatchInfo{BaseOffset: 12, ProducerID: -1, ProducerEpoch: -1},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	"fetch_v0_unknown_partitions.bin": &FetchResp{
+		CorrelationID: 241,
+		Topics: []FetchRespTopic{
+			{
+				Name: "test",
+				Partitions: []FetchRespPartition{
+					{ID: 0, Err: ErrUnknownTopicOrPartition, TipOffset: -1, Messages: []*Message{}},
+					{ID: 1, Err: ErrUnknownTopicOrPartition, TipOffset: -1, Messages: []*Message{}},
+					{ID: 8, Err: ErrUnknownTopicOrPartition, TipOffset: -1, Messages: []*Message{}},
+				},
+			},
+		},
+	},
+}
+
+// The record batches of fetch_v4_aborted_transactions.bin holding messages,
+// and the compressed one of fetch_v4_gzip_record_batch.bin.
+var (
+	fixtureBatchPlain   = &RecordBatchInfo{BaseOffset: 0, LastOffsetDelta: 1, ProducerID: -1, ProducerEpoch: -1}
+	fixtureBatchAborted = &RecordBatchInfo{BaseOffset: 2, LastOffsetDelta: 1, ProducerID: 7, ProducerEpoch: 1}
+	fixtureBatchGzip    = &RecordBatchInfo{BaseOffset: 10, LastOffsetDelta: 1, ProducerID: -1, ProducerEpoch: -1}
+)
+
+// fixtureRecord returns the message with key "foo" and the given value read
+// from the given record batch of partition 0 of topic "foo" with tip offset
+// 5, whose timestamp is ms milliseconds after the first one of the fixture.
+func fixtureRecord(offset int64, value string, ms int64, batch *RecordBatchInfo) *Message {
+	return &Message{
+		Offset:    offset,
+		Key:       []byte("foo"),
+		Value:     []byte(value),
+		Topic:     "foo",
+		Partition: 0,
+		TipOffset: 5,
+		Format:    2,
+		Timestamp: time.Unix(1500000000, ms*int64(time.Millisecond)),
+		Batch:     batch,
+	}
+}
+
+// fixtureDecoderKey returns the "<api>_v<version>" prefix of a fixture name.
+func fixtureDecoderKey(name string) string {
+	parts := strings.SplitN(name, "_", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[0] + "_" + parts[1]
+}
+
+func (s *FixturesSuite) TestFixtures(c *C) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "fixtures", "*.bin"))
+	c.Assert(err, IsNil)
+	c.Assert(paths, Not(HasLen), 0)
+
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		seen[name] = true
+
+		decode, ok := fixtureDecoders[fixtureDecoderKey(name)]
+		if !ok {
+			c.Errorf("%s: no decoder for %q", name, fixtureDecoderKey(name))
+			continue
+		}
+		expected, ok := fixtureExpectations[name]
+		if !ok {
+			c.Errorf("%s: no expected result", name)
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(path)
+		c.Assert(err, IsNil)
+		resp, err := decode(bytes.NewReader(raw))
+		if err != nil {
+			c.Errorf("%s: cannot decode: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(resp, expected) {
+			c.Errorf("%s: decoded to unexpected result: %#v", name, resp)
+		}
+	}
+
+	for name := range fixtureExpectations {
+		if !seen[name] {
+			c.Errorf("%s: expected result for missing fixture", name)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// LZ4-compressed message sets use the LZ4 frame format, see
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md, with one quirk:
+// until message format 1 (Kafka 0.10), Kafka computed the header checksum of
+// the frame over the magic number as well as the frame descriptor. Brokers
+// still expect that broken checksum in messages with magic byte 0, while
+// messages with magic byte 1 and record batches need the standard checksum
+// over the frame descriptor only (KIP-57). lz4Encode writes the checksum for
+// the magic byte it is given, lz4Decode accepts either checksum.
+//
+// Frames are written with independent blocks of at most 64KB and without
+// block or content checksums, like the Java client does. Frames using a
+// dictionary can't be decoded, and neither can frames that decode to more
+// than maxDecodedLen bytes, like snappy messages.
+
+const (
+	lz4Magic        = 0x184D2204
+	lz4BlockMaxSize = 64 << 10
+
+	lz4FlagVersion       = 1 << 6
+	lz4FlagIndependent   = 1 << 5
+	lz4FlagBlockChecksum = 1 << 4
+	lz4FlagContentSize   = 1 << 3
+	lz4FlagContentCheck  = 1 << 2
+	lz4FlagDictID        = 1 << 0
+
+	lz4Uncompressed = 1 << 31
+
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // the last bytes of a block are always literals
+	lz4MatchLimit   = 12 // no match may start closer to the end of a block
+	lz4HashLog      = 14
+)
+
+var errLZ4Corrupt = errors.New("corrupt lz4 data")
+
+// lz4Encode returns src compressed to an LZ4 frame, with the header checksum
+// expected in messages with the given magic byte.
+func lz4Encode(src []byte, magic int8) []byte {
+	dst := make([]byte, 7, 7+len(src)+len(src)/255+16)
+	binary.LittleEndian.PutUint32(dst, lz4Magic)
+	dst[4] = lz4FlagVersion | lz4FlagIndependent
+	dst[5] = 4 << 4 // 64KB blocks
+	if magic == 0 {
+		dst[6] = byte(xxh32(dst[:6], 0) >> 8)
+	} else {
+		dst[6] = byte(xxh32(dst[4:6], 0) >> 8)
+	}
+
+	var table [1 << lz4HashLog]int32
+	for len(src) > 0 {
+		block := src
+		if len(block) > lz4BlockMaxSize {
+			block = block[:lz4BlockMaxSize]
+		}
+		src = src[len(block):]
+
+		start := len(dst)
+		dst = append(dst, 0, 0, 0, 0)
+		dst = lz4CompressBlock(dst, block, &table)
+		if size := len(dst) - start - 4; size < len(block) {
+			binary.LittleEndian.PutUint32(dst[start:], uint32(size))
+		} else {
+			// not compressible, store the block as it is
+			dst = append(dst[:start+4], block...)
+			binary.LittleEndian.PutUint32(dst[start:], uint32(len(block))|lz4Uncompressed)
+		}
+	}
+	return append(dst, 0, 0, 0, 0) // end mark
+}
+
+// lz4CompressBlock appends the compressed src to dst. table is the hash table
+// of positions, which is reset.
+func lz4CompressBlock(dst, src []byte, table *[1 << lz4HashLog]int32) []byte {
+	for i := range table {
+		table[i] = 0
+	}
+
+	anchor := 0
+	for i := 0; i < len(src)-lz4MatchLimit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1 // positions are stored plus one, zero is empty
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > 0xFFFF || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLiterals && src[ref+n] == src[i+n] {
+			n++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends the literals followed by a match of the given
+// length at offset to dst. The last sequence of a block has no match.
+func lz4AppendSequence(dst, literals []byte, offset, match int) []byte {
+	token := byte(0)
+	if len(literals) < 15 {
+		token = byte(len(literals)) << 4
+	} else {
+		token = 15 << 4
+	}
+	if match > 0 {
+		if match-lz4MinMatch < 15 {
+			token |= byte(match - lz4MinMatch)
+		} else {
+			token |= 15
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if match == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if match-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, match-lz4MinMatch-15)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4Decode decodes the LZ4 frame b, reusing the capacity of dst when
+// possible. It fails without decoding further once more than max bytes would
+// be decoded.
+func lz4Decode(dst, b []byte, max int) ([]byte, error) {
+	if len(b) < 7 || binary.LittleEndian.Uint32(b) != lz4Magic {
+		return dst, errors.New("not an lz4 frame")
+	}
+	flags := b[4]
+	if flags>>6 != 1 {
+		return dst, fmt.Errorf("unsupported lz4 frame version %d", flags>>6)
+	}
+	if flags&lz4FlagDictID != 0 {
+		return dst, errors.New("lz4 frames with dictionary are not supported")
+	}
+	hsize := 7
+	if flags&lz4FlagContentSize != 0 {
+		hsize += 8
+	}
+	if len(b) < hsize {
+		return dst, errLZ4Corrupt
+	}
+	hc := b[hsize-1]
+	if hc != byte(xxh32(b[4:hsize-1], 0)>>8) && hc != byte(xxh32(b[:hsize-1], 0)>>8) {
+		return dst, errors.New("lz4 frame header checksum mismatch")
+	}
+
+	out := dst[:0]
+	for b = b[hsize:]; ; {
+		if len(b) < 4 {
+			return dst, errLZ4Corrupt
+		}
+		size := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		if size == 0 {
+			break
+		}
+		n := int(size &^ lz4Uncompressed)
+		if n > len(b) {
+			return dst, errLZ4Corrupt
+		}
+		if size&lz4Uncompressed != 0 {
+			if n > max-len(out) {
+				return dst, lz4TooLarge(max)
+			}
+			out = append(out, b[:n]...)
+		} else {
+			var err error
+			if out, err = lz4DecompressBlock(out, b[:n], max); err != nil {
+				return dst, err
+			}
+		}
+		b = b[n:]
+		if flags&lz4FlagBlockChecksum != 0 {
+			if len(b) < 4 {
+				return dst, errLZ4Corrupt
+			}
+			b = b[4:]
+		}
+	}
+	if flags&lz4FlagContentCheck != 0 {
+		if len(b) < 4 {
+			return dst, errLZ4Corrupt
+		}
+		if binary.LittleEndian.Uint32(b) != xxh32(out, 0) {
+			return dst, errors.New("lz4 content checksum mismatch")
+		}
+	}
+	return out, nil
+}
+
+// lz4TooLarge returns the error of a frame that decodes to more than max
+// bytes.
+func lz4TooLarge(max int) error {
+	return fmt.Errorf("lz4 message exceeds the limit of %d bytes", max)
+}
+
+// lz4DecompressBlock appends the decompressed block src to dst, as long as
+// dst doesn't grow beyond max bytes. Matches may refer to data of earlier
+// blocks already in dst.
+func lz4DecompressBlock(dst, src []byte, max int) ([]byte, error) {
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			n, read, ok := lz4ReadLength(src[i:])
+			if !ok {
+				return nil, errLZ4Corrupt
+			}
+			literals += n
+			i += read
+		}
+		if literals > len(src)-i {
+			return nil, errLZ4Corrupt
+		}
+		if literals > max-len(dst) {
+			return nil, lz4TooLarge(max)
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			// the last sequence has no match
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errLZ4Corrupt
+		}
+		match := int(token & 15)
+		if match == 15 {
+			n, read, ok := lz4ReadLength(src[i:])
+			if !ok {
+				return nil, errLZ4Corrupt
+			}
+			match += n
+			i += read
+		}
+		match += lz4MinMatch
+		if match > max-len(dst) {
+			return nil, lz4TooLarge(max)
+		}
+
+		// copy byte by byte, the match may overlap the bytes it produces
+		pos := len(dst) - offset
+		for j := 0; j < match; j++ {
+			dst = append(dst, dst[pos+j])
+		}
+	}
+	return dst, nil
+}
+
+// lz4ReadLength reads the continuation bytes of a literal or match length.
+func lz4ReadLength(b []byte) (n, read int, ok bool) {
+	for read < len(b) {
+		v := b[read]
+		read++
+		n += int(v)
+		if v != 255 {
+			return n, read, true
+		}
+	}
+	return 0, 0, false
+}
+
+const (
+	xxhPrime1 uint32 = 2654435761
+	xxhPrime2 uint32 = 2246822519
+	xxhPrime3 uint32 = 3266489917
+	xxhPrime4 uint32 = 668265263
+	xxhPrime5 uint32 = 374761393
+)
+
+// xxh32 returns the 32 bit xxHash of b, which LZ4 frames use as checksum.
+func xxh32(b []byte, seed uint32) uint32 {
+	n := len(b)
+	var h uint32
+	if n >= 16 {
+		v1 := seed + xxhPrime1 + xxhPrime2
+		v2 := seed + xxhPrime2
+		v3 := seed
+		v4 := seed - xxhPrime1
+		for ; len(b) >= 16; b = b[16:] {
+			v1 = xxh32Round(v1, binary.LittleEndian.Uint32(b))
+			v2 = xxh32Round(v2, binary.LittleEndian.Uint32(b[4:]))
+			v3 = xxh32Round(v3, binary.LittleEndian.Uint32(b[8:]))
+			v4 = xxh32Round(v4, binary.LittleEndian.Uint32(b[12:]))
+		}
+		h = rotl32(v1, 1) + rotl32(v2, 7) +
+			rotl32(v3, 12) + rotl32(v4, 18)
+	} else {
+		h = seed + xxhPrime5
+	}
+	h += uint32(n)
+
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * xxhPrime3
+		h = rotl32(h, 17) * xxhPrime4
+	}
+	for _, c := range b {
+		h += uint32(c) * xxhPrime5
+		h = rotl32(h, 11) * xxhPrime1
+	}
+
+	h ^= h >> 15
+	h *= xxhPrime2
+	h ^= h >> 13
+	h *= xxhPrime3
+	h ^= h >> 16
+	return h
+}
+
+func xxh32Round(acc, in uint32) uint32 {
+	acc += in * xxhPrime2
+	return rotl32(acc, 13) * xxhPrime1
+}
+
+func rotl32(x uint32, r uint) uint32 {
+	return x<<r | x>>(32-r)
+}
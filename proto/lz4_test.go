@@ -0,0 +1,131 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&LZ4Suite{})
+
+type LZ4Suite struct{}
+
+func (s *LZ4Suite) TestRoundTrip(c *C) {
+	var large bytes.Buffer
+	for i := 0; large.Len() < 3*lz4BlockMaxSize; i++ {
+		fmt.Fprintf(&large, "message %d of a long message set\n", i)
+	}
+	for _, data := range [][]byte{
+		nil,
+		[]byte("short"),
+		bytes.Repeat([]byte("a"), 1000),
+		large.Bytes(),
+	} {
+		encoded := lz4Encode(data, 0)
+		decoded, err := lz4Decode(nil, encoded, maxDecodedLen)
+		c.Assert(err, IsNil)
+		c.Assert(decoded, HasLen, len(data))
+		c.Assert(bytes.Equal(decoded, data), Equals, true)
+	}
+	c.Assert(len(lz4Encode(large.Bytes(), 0)) < large.Len()/2, Equals, true)
+}
+
+func (s *LZ4Suite) TestDecodeStandardFrame(c *C) {
+	// written by the lz4 command line tool, with the standard header
+	// checksum and a content checksum
+	frame := []byte{
+		0x04, 0x22, 0x4d, 0x18, 0x64, 0x40, 0xa7, 0x10, 0x00, 0x00, 0x00, 0x6f,
+		0x6b, 0x61, 0x66, 0x6b, 0x61, 0x20, 0x06, 0x00, 0x06, 0x50, 0x61, 0x66,
+		0x6b, 0x61, 0x21, 0x00, 0x00, 0x00, 0x00, 0x9b, 0x1e, 0xcb, 0xe4,
+	}
+	decoded, err := lz4Decode(nil, frame, maxDecodedLen)
+	c.Assert(err, IsNil)
+	c.Assert(string(decoded), Equals, "kafka kafka kafka kafka kafka kafka!")
+
+	frame[len(frame)-1]++
+	_, err = lz4Decode(nil, frame, maxDecodedLen)
+	c.Assert(err, ErrorMatches, "lz4 content checksum mismatch")
+}
+
+func (s *LZ4Suite) TestDecodeLimit(c *C) {
+	data := bytes.Repeat([]byte("a"), 1000)
+	encoded := lz4Encode(data, 1)
+	decoded, err := lz4Decode(nil, encoded, len(data))
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, len(data))
+	_, err = lz4Decode(nil, encoded, len(data)-1)
+	c.Assert(err, ErrorMatches, "lz4 message exceeds the limit of 999 bytes")
+
+	// a frame of a megabyte whose only match decodes beyond the limit
+	block := []byte{0x1f, 'a', 1, 0}
+	for n := maxDecodedLen; n >= 255; n -= 255 {
+		block = append(block, 255)
+	}
+	block = append(block, 0)
+	frame := append([]byte(nil), encoded[:7]...)
+	frame = append(frame, byte(len(block)), byte(len(block)>>8), byte(len(block)>>16), 0)
+	frame = append(frame, block...)
+	frame = append(frame, 0, 0, 0, 0)
+	_, err = lz4Decode(nil, frame, maxDecodedLen)
+	c.Assert(err, ErrorMatches, "lz4 message exceeds the limit of 268435456 bytes")
+
+	// and through a compressed message set
+	b, err := appendMessage(nil, 0, &Message{Value: frame}, CompressionLZ4)
+	c.Assert(err, IsNil)
+	_, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, ErrorMatches, "error decoding lz4 message: lz4 message exceeds the limit of .*")
+}
+
+func (s *LZ4Suite) TestKafkaHeaderChecksum(c *C) {
+	// Kafka's checksum of messages with magic byte 0 includes the magic number
+	encoded := lz4Encode([]byte("foo"), 0)
+	c.Assert(encoded[6], Equals, byte(xxh32(encoded[:6], 0)>>8))
+	c.Assert(encoded[6], Not(Equals), byte(xxh32(encoded[4:6], 0)>>8))
+
+	encoded[6]++
+	_, err := lz4Decode(nil, encoded, maxDecodedLen)
+	c.Assert(err, ErrorMatches, "lz4 frame header checksum mismatch")
+}
+
+func (s *LZ4Suite) TestStandardHeaderChecksum(c *C) {
+	// messages with magic byte 1 and record batches use the checksum of the
+	// frame descriptor only
+	for _, magic := range []int8{1, 2} {
+		encoded := lz4Encode([]byte("foo"), magic)
+		c.Assert(encoded[6], Equals, byte(xxh32(encoded[4:6], 0)>>8))
+		c.Assert(encoded[6], Not(Equals), byte(xxh32(encoded[:6], 0)>>8))
+
+		decoded, err := lz4Decode(nil, encoded, maxDecodedLen)
+		c.Assert(err, IsNil)
+		c.Assert(string(decoded), Equals, "foo")
+	}
+}
+
+func (s *LZ4Suite) TestMessageSetRoundTrip(c *C) {
+	messages := make([]*Message, 20)
+	for i := range messages {
+		messages[i] = &Message{
+			Offset: int64(i),
+			Key:    []byte(fmt.Sprintf("key-%d", i)),
+			Value:  bytes.Repeat([]byte(fmt.Sprintf("value %d ", i)), 20),
+		}
+	}
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, messages, CompressionLZ4, false)
+	c.Assert(err, IsNil)
+
+	set, err := readMessageSet(bytes.NewReader(buf.Bytes()), int32(buf.Len()), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(set, HasLen, len(messages))
+	for i, msg := range set {
+		c.Assert(msg.Offset, Equals, messages[i].Offset)
+		c.Assert(msg.Key, DeepEquals, messages[i].Key)
+		c.Assert(msg.Value, DeepEquals, messages[i].Value)
+	}
+}
+
+func (s *LZ4Suite) TestXXH32(c *C) {
+	c.Assert(xxh32(nil, 0), Equals, uint32(0x02CC5D05))
+	c.Assert(xxh32([]byte("abc"), 0), Equals, uint32(0x32D153FF))
+}
@@ -9,9 +9,9 @@ import (
 	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"math"
+	"sync"
 	"time"
-
-	"github.com/golang/snappy"
 )
 
 /*
@@ -29,6 +29,13 @@ const (
 	OffsetCommitReqKind     = 8
 	OffsetFetchReqKind      = 9
 	GroupCoordinatorReqKind = 10
+	JoinGroupReqKind        = 11
+	HeartbeatReqKind        = 12
+	LeaveGroupReqKind       = 13
+	SyncGroupReqKind        = 14
+	SASLHandshakeReqKind    = 17
+	APIVersionsReqKind      = 18
+	SASLAuthenticateReqKind = 36
 
 	// receive the latest offset (i.e. the offset of the next coming message)
 	OffsetReqTimeLatest = -1
@@ -56,29 +63,52 @@ const (
 	CompressionNone   Compression = 0
 	CompressionGzip   Compression = 1
 	CompressionSnappy Compression = 2
+	CompressionLZ4    Compression = 3
+	// CompressionZstd is only supported by record batches, which are sent
+	// with produce requests of version 7 and later.
+	CompressionZstd Compression = 4
 )
 
 type Request interface {
 	WriteTo(io.Writer) (int64, error)
 }
 
+// DefaultMaxRequestSize is the size of the largest request ReadReq accepts,
+// in bytes. It is the default of the broker's socket.request.max.bytes.
+const DefaultMaxRequestSize = 100 << 20
+
 // ReadReq returns request kind ID and byte representation of the whole message
-// in wire protocol format.
+// in wire protocol format. Requests larger than DefaultMaxRequestSize are
+// rejected, see ReadReqLimited.
 func ReadReq(r io.Reader) (requestKind int16, b []byte, err error) {
+	return ReadReqLimited(r, DefaultMaxRequestSize)
+}
+
+// ReadReqLimited works like ReadReq, but returns ErrMessageSizeTooLarge
+// without reading the request if its size prefix is larger than maxSize, so
+// that a corrupt prefix doesn't cause a huge allocation. A size too small to
+// hold the request kind results in ErrInvalidMessageSize.
+func ReadReqLimited(r io.Reader, maxSize int32) (requestKind int16, b []byte, err error) {
 	dec := NewDecoder(r)
 	msgSize := dec.DecodeInt32()
 	requestKind = dec.DecodeInt16()
 	if err := dec.Err(); err != nil {
 		return 0, nil, err
 	}
+	if msgSize > maxSize {
+		return 0, nil, ErrMessageSizeTooLarge
+	}
+	if msgSize < 2 {
+		return 0, nil, ErrInvalidMessageSize
+	}
 	// size of the message + size of the message itself
-	b = make([]byte, msgSize+4)
+	b = make([]byte, 6)
 	binary.BigEndian.PutUint32(b, uint32(msgSize))
 	binary.BigEndian.PutUint16(b[4:], uint16(requestKind))
-	if _, err := io.ReadFull(r, b[6:]); err != nil {
+	if b, err = readAppend(b, r, int(msgSize)-2); err != nil {
 		return 0, nil, err
 	}
-	return requestKind, b, err
+	return requestKind, b, nil
 }
 
 // ReadResp returns message correlation ID and byte representation of the whole
@@ -86,6 +116,9 @@ func ReadReq(r io.Reader) (requestKind int16, b []byte, err error) {
 // including 4 bytes of message size itself.
 // Byte representation returned by ReadResp can be parsed by all response
 // reeaders to transform it into specialized response structure.
+// The buffer grows as the response arrives, so a corrupt size prefix costs no
+// more memory than the data actually sent; a size too small to hold the
+// correlation ID results in ErrInvalidMessageSize.
 func ReadResp(r io.Reader) (correlationID int32, b []byte, err error) {
 	dec := NewDecoder(r)
 	msgSize := dec.DecodeInt32()
@@ -93,11 +126,14 @@ func ReadResp(r io.Reader) (correlationID int32, b []byte, err error) {
 	if err := dec.Err(); err != nil {
 		return 0, nil, err
 	}
+	if msgSize < 4 {
+		return 0, nil, ErrInvalidMessageSize
+	}
 	// size of the message + size of the message itself
-	b = make([]byte, msgSize+4)
+	b = make([]byte, 8)
 	binary.BigEndian.PutUint32(b, uint32(msgSize))
 	binary.BigEndian.PutUint32(b[4:], uint32(correlationID))
-	_, err = io.ReadFull(r, b[8:])
+	b, err = readAppend(b, r, int(msgSize)-4)
 	return correlationID, b, err
 }
 
@@ -106,129 +142,271 @@ type Message struct {
 	Key       []byte
 	Value     []byte
 	Offset    int64  // set when fetching and after successful producing
-	Crc       uint32 // set when fetching, ignored when producing
+	Crc       uint32 // set when reading messages of format 0 and 1, ignored when writing them
 	Topic     string // set when fetching, ignored when producing
 	Partition int32  // set when fetching, ignored when producing
 	TipOffset int64  // set when fetching, ignored when processing
+
+	// Format is the message format, or magic byte, the message is written
+	// and was read in: 0, or 1 for messages with a timestamp, which brokers
+	// of Kafka 0.10 and later accept with produce version 2. Messages
+	// compressed together must have the same format. Produce requests of
+	// version 3 and later write all messages in format 2, the record batches
+	// of Kafka 0.11, ignoring Format, and messages read from record batches
+	// have Format 2.
+	Format int8
+
+	// Timestamp is supported by message formats 1 and 2, where it is zero if
+	// the message has none. TimestampType tells who set it, and is set when
+	// reading; messages are written with TimestampCreateTime.
+	Timestamp     time.Time
+	TimestampType TimestampType
+
+	// FutureTimestamp is set by consumers of package kafka configured with
+	// MaxTimestampSkew on messages whose timestamp is too far ahead of their
+	// clock. It is ignored when writing.
+	FutureTimestamp bool
+
+	// Headers are only supported by message format 2, see RecordHeader.
+	// Writing messages with headers in format 0 or 1 fails.
+	Headers []RecordHeader
+
+	// Batch describes the record batch the message was read from. It is set
+	// when reading messages of format 2, shared by all messages of a batch,
+	// and ignored when writing.
+	Batch *RecordBatchInfo
 }
 
-// ComputeCrc returns crc32 hash for given message content.
+// Age returns how long ago the message was created or appended to the log,
+// depending on its TimestampType, by the local clock. It returns false if the
+// message has no timestamp.
+func (m *Message) Age() (time.Duration, bool) {
+	if m.Timestamp.IsZero() {
+		return 0, false
+	}
+	return time.Since(m.Timestamp), true
+}
+
+// TimestampType tells who set the timestamp of a message.
+type TimestampType int8
+
+const (
+	// TimestampCreateTime is the time the producer created the message.
+	TimestampCreateTime TimestampType = 0
+
+	// TimestampLogAppendTime is the time the broker appended the message,
+	// for topics configured to use it.
+	TimestampLogAppendTime TimestampType = 1
+)
+
+const (
+	// attributeCompression are the bits of the message attributes holding
+	// the compression, attributeLogAppendTime is set for messages of format
+	// 1 whose timestamp is the log append time.
+	attributeCompression   = 0x07
+	attributeLogAppendTime = 0x08
+)
+
+// ComputeCrc returns crc32 hash for given message content, written in its
+// format with the attributes of given compression. Messages in a compressed
+// message set have no compression of their own, their wrapper message does.
 func ComputeCrc(m *Message, compression Compression) uint32 {
-	var buf bytes.Buffer
-	enc := NewEncoder(&buf)
-	enc.EncodeInt8(0) // magic byte is always 0
-	enc.EncodeInt8(int8(compression))
-	enc.EncodeBytes(m.Key)
-	enc.EncodeBytes(m.Value)
-	return crc32.ChecksumIEEE(buf.Bytes())
+	buf := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(buf)
+	*buf = appendMessageContent((*buf)[:0], m, compression)
+	return crc32.ChecksumIEEE(*buf)
+}
+
+// appendMessageContent appends the part of m its crc covers: the magic byte,
+// attributes, timestamp for format 1, key and value.
+func appendMessageContent(b []byte, m *Message, compression Compression) []byte {
+	attributes := int8(compression)
+	if m.Format == 1 && m.TimestampType == TimestampLogAppendTime {
+		attributes |= attributeLogAppendTime
+	}
+	b = append(b, byte(m.Format), byte(attributes))
+	if m.Format == 1 {
+		b = appendInt64(b, encodeTimestamp(m.Timestamp))
+	}
+	b = appendBytes(b, m.Key)
+	return appendBytes(b, m.Value)
+}
+
+// appendMessage appends m to b as an entry of a message set with the given
+// offset. Its size and crc are filled in once the rest of it is written.
+func appendMessage(b []byte, offset int64, m *Message, compression Compression) ([]byte, error) {
+	if len(m.Headers) > 0 {
+		return b, errHeadersRequireRecordBatch
+	}
+	if m.Format != 0 && m.Format != 1 {
+		return b, fmt.Errorf("unsupported message format %d", m.Format)
+	}
+	const crcoff = 8 + 4 // offset + message size
+	start := len(b)
+	b = appendInt64(b, offset)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0) // message size and crc32 placeholders
+	b = appendMessageContent(b, m, compression)
+	binary.BigEndian.PutUint32(b[start+8:], uint32(len(b)-start-crcoff))
+	binary.BigEndian.PutUint32(b[start+crcoff:], crc32.ChecksumIEEE(b[start+crcoff+4:]))
+	return b, nil
+}
+
+// scratchBuffers hold the uncompressed message sets of compressed ones, and
+// encoded requests until they are written.
+var scratchBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// gzipWriters are reused, since every gzip writer allocates its compression
+// state. They are pooled by compression level, with the default level at 0.
+var gzipWriters [gzip.BestCompression + 1]sync.Pool
+
+// getGzipWriter returns a gzip writer of the given level, 1 to 9, or of the
+// default level for 0. Put it back into gzipWriters[level] when done.
+func getGzipWriter(level int) (*gzip.Writer, error) {
+	if level < 0 || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level %d", level)
+	}
+	if gz, ok := gzipWriters[level].Get().(*gzip.Writer); ok {
+		return gz, nil
+	}
+	if level == 0 {
+		return gzip.NewWriter(nil), nil
+	}
+	return gzip.NewWriterLevel(nil, level)
 }
 
-// writeMessageSet writes a Message Set into w.
+// writeMessageSet writes a Message Set into w, see appendMessageSet.
 // It returns the number of bytes written and any error.
-func writeMessageSet(w io.Writer, messages []*Message, compression Compression) (int, error) {
+func writeMessageSet(w io.Writer, messages []*Message, compression Compression, snappyFraming bool) (int, error) {
+	b, err := appendMessageSet(nil, messages, compression, 0, snappyFraming)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(b)
+}
+
+// appendMessageSet appends a Message Set to b in a single pass. Gzip
+// compressed messages are compressed with the given level, see
+// ProduceReq.CompressionLevel, and snappy compressed messages are framed like
+// snappy-java does if snappyFraming is true. On error, b is returned as it
+// was.
+func appendMessageSet(b []byte, messages []*Message, compression Compression, level int, snappyFraming bool) ([]byte, error) {
 	if len(messages) == 0 {
-		return 0, nil
+		return b, nil
+	}
+	start := len(b)
+	if compression == CompressionNone {
+		for _, msg := range messages {
+			var err error
+			if b, err = appendMessage(b, msg.Offset, msg, CompressionNone); err != nil {
+				return b[:start], err
+			}
+		}
+		return b, nil
 	}
+
 	// NOTE(caleb): it doesn't appear to be documented, but I observed that the
 	// Java client sets the offset of the synthesized message set for a group of
 	// compressed messages to be the offset of the last message in the set.
 	compressOffset := messages[len(messages)-1].Offset
-	switch compression {
-	case CompressionGzip:
-		var buf bytes.Buffer
-		gz := gzip.NewWriter(&buf)
-		if _, err := writeMessageSet(gz, messages, CompressionNone); err != nil {
-			return 0, err
-		}
-		if err := gz.Close(); err != nil {
-			return 0, err
+	format := messages[0].Format
+	var timestamp time.Time
+	if format == 1 {
+		// offsets of compressed messages in format 1 are relative to
+		// the first one and the wrapper has the latest timestamp
+		compressOffset = messages[0].Offset + int64(len(messages)-1)
+	}
+
+	scratch := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(scratch)
+	inner := (*scratch)[:0]
+	for i, msg := range messages {
+		if msg.Format != format {
+			return b, errors.New("cannot compress messages of different formats together")
 		}
-		messages = []*Message{
-			{
-				Value:  buf.Bytes(),
-				Offset: compressOffset,
-			},
-		}
-	case CompressionSnappy:
-		var buf bytes.Buffer
-		if _, err := writeMessageSet(&buf, messages, CompressionNone); err != nil {
-			return 0, err
+		offset := msg.Offset
+		if format == 1 {
+			offset = int64(i)
+			if msg.Timestamp.After(timestamp) {
+				timestamp = msg.Timestamp
+			}
 		}
-		messages = []*Message{
-			{
-				Value:  snappy.Encode(nil, buf.Bytes()),
-				Offset: compressOffset,
-			},
+		var err error
+		if inner, err = appendMessage(inner, offset, msg, CompressionNone); err != nil {
+			return b, err
 		}
 	}
+	*scratch = inner
 
-	totalSize := 0
-	b := newSliceWriter(0)
-	for _, message := range messages {
-		bsize := 26 + len(message.Key) + len(message.Value)
-		b.Reset(bsize)
-
-		enc := NewEncoder(b)
-		enc.EncodeInt64(message.Offset)
-		msize := int32(14 + len(message.Key) + len(message.Value))
-		enc.EncodeInt32(msize)
-		enc.EncodeUint32(0) // crc32 placeholder
-		enc.EncodeInt8(0)   // magic byte
-		enc.EncodeInt8(int8(compression))
-		enc.EncodeBytes(message.Key)
-		enc.EncodeBytes(message.Value)
-
-		if err := enc.Err(); err != nil {
-			return totalSize, err
-		}
-
-		const hsize = 8 + 4 + 4 // offset + message size + crc32
-		const crcoff = 8 + 4    // offset + message size
-		binary.BigEndian.PutUint32(b.buf[crcoff:crcoff+4], crc32.ChecksumIEEE(b.buf[hsize:bsize]))
-
-		if n, err := w.Write(b.Slice()); err != nil {
-			return totalSize, err
-		} else {
-			totalSize += n
-		}
-
+	valbuf := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(valbuf)
+	value, err := appendCompressed((*valbuf)[:0], inner, compression, level, snappyFraming, format)
+	if err != nil {
+		return b, err
 	}
-	return totalSize, nil
-}
-
-type slicewriter struct {
-	buf  []byte
-	pos  int
-	size int
-}
-
-func newSliceWriter(bufsize int) *slicewriter {
-	return &slicewriter{
-		buf: make([]byte, bufsize),
-		pos: 0,
+	*valbuf = value
+	wrapper := Message{
+		Value:     value,
+		Format:    format,
+		Timestamp: timestamp,
 	}
+	return appendMessage(b, compressOffset, &wrapper, compression)
 }
 
-func (w *slicewriter) Write(p []byte) (int, error) {
-	if len(w.buf) < w.pos+len(p) {
-		return 0, errors.New("buffer too small")
+// appendCompressed appends src, compressed with the given method, to b. See
+// appendMessageSet for level and snappyFraming; magic is the message format
+// the compressed messages are written in.
+func appendCompressed(b, src []byte, compression Compression, level int, snappyFraming bool, magic int8) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return append(b, src...), nil
+	case CompressionGzip:
+		gz, err := getGzipWriter(level)
+		if err != nil {
+			return b, err
+		}
+		defer gzipWriters[level].Put(gz)
+		w := buffer(b)
+		gz.Reset(&w)
+		if _, err := gz.Write(src); err != nil {
+			return b, err
+		}
+		if err := gz.Close(); err != nil {
+			return b, err
+		}
+		return w, nil
+	case CompressionSnappy:
+		return append(b, snappyEncode(src, snappyFraming)...), nil
+	case CompressionLZ4:
+		return append(b, lz4Encode(src, magic)...), nil
+	case CompressionZstd:
+		if magic < 2 {
+			return b, errors.New("zstd compression requires record batches")
+		}
+		return append(b, zstdEncode(src)...), nil
+	default:
+		return b, fmt.Errorf("cannot handle compression method: %d", compression)
 	}
-	copy(w.buf[w.pos:], p)
-	w.pos += len(p)
-	return len(p), nil
 }
 
-func (w *slicewriter) Reset(size int) {
-	if size > len(w.buf) {
-		w.buf = make([]byte, size+1000) // allocate a bit more than required
-	}
-	w.size = size
-	w.pos = 0
-}
+// crcCheck tells how messages are checked against their crc when decoding.
+type crcCheck int8
 
-func (w *slicewriter) Slice() []byte {
-	return w.buf[:w.pos]
-}
+const (
+	// crcReject stops decoding at the first message that fails its crc
+	// check with ErrInvalidMessageCRC.
+	crcReject crcCheck = iota
+
+	// crcKeep returns messages that fail their crc check too, with the crc
+	// they were sent with, so that a broker can reject them.
+	crcKeep
+
+	// crcSkip does not compute the crc of messages at all.
+	crcSkip
+)
 
 // readMessageSet reads and return messages from the stream.
 // The size is known before a message set is decoded.
@@ -236,96 +414,146 @@ func (w *slicewriter) Slice() []byte {
 // off part of the last message. This also means that the last message can be
 // shorter than the header is saying. In such case just ignore the last
 // malformed message from the set and returned earlier data.
-func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
+//
+// If limiter is not nil, compressed message sets are decompressed within its
+// limits.
+//
+// Record batches of message format 2 may be mixed with messages of the older
+// formats.
+//
+// With crcReject, a complete message that fails its crc check is corrupt
+// rather than cut off: the messages before it are returned along with
+// ErrInvalidMessageCRC. With crcKeep, compressed messages that fail the
+// check are not decompressed, and record batches that fail theirs are an
+// ErrInvalidMessage error, since their messages have no crc of their own.
+//
+// Exactly size bytes are consumed from r, no matter where decoding stopped,
+// so that whatever follows the message set is read from the right position.
+func readMessageSet(r io.Reader, size int32, limiter *DecompressionLimiter, check crcCheck) ([]*Message, error) {
 	rd := io.LimitReader(r, int64(size))
-	dec := NewDecoder(rd)
+	set, err := decodeMessageSet(rd, limiter, check)
+	if err != nil && err != ErrInvalidMessageCRC {
+		return nil, err
+	}
+	if _, err := io.Copy(ioutil.Discard, rd); err != nil {
+		return nil, err
+	}
+	return set, err
+}
+
+// decodeMessageSet decodes messages until rd is exhausted or a message is
+// incomplete, or corrupt unless check is crcKeep. The messages decoded
+// before a corrupt one are returned along with ErrInvalidMessageCRC.
+func decodeMessageSet(rd io.Reader, limiter *DecompressionLimiter, check crcCheck) ([]*Message, error) {
 	set := make([]*Message, 0, 256)
 
-	var buf []byte
+	var header [12]byte
 	for {
-		offset := dec.DecodeInt64()
-		if err := dec.Err(); err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
-			}
-			return nil, err
-		}
-		// single message size
-		size := dec.DecodeInt32()
-		if err := dec.Err(); err != nil {
+		// offset and size of the message
+		if _, err := io.ReadFull(rd, header[:]); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				return set, nil
 			}
 			return nil, err
 		}
+		offset := int64(binary.BigEndian.Uint64(header[:8]))
+		size := int32(binary.BigEndian.Uint32(header[8:]))
 
-		// read message to buffer to compute its content crc
-		if int(size) > len(buf) {
-			// allocate a bit more than needed
-			buf = make([]byte, size+10240)
+		if size < 0 {
+			// corrupt, nothing after this can be trusted
+			return set, nil
 		}
-		msgbuf := buf[:size]
 
-		if _, err := io.ReadFull(rd, msgbuf); err != nil {
+		// Every message is read into its own buffer, which its key and value
+		// point into, so that they need no further allocation or copy.
+		msgbuf, err := readBytes(rd, int(size))
+		if err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				return set, nil
 			}
 			return nil, err
 		}
-		msgdec := NewDecoder(bytes.NewBuffer(msgbuf))
 
-		msg := &Message{
-			Offset: offset,
-			Crc:    msgdec.DecodeUint32(),
+		// The magic byte is at the same position in record batches as in
+		// messages of the older formats, after what is the crc of those
+		// and the partition leader epoch of record batches.
+		if len(msgbuf) > 4 && msgbuf[4] == recordBatchMagic {
+			batch := make([]byte, 0, len(header)+len(msgbuf))
+			batch = append(append(batch, header[:]...), msgbuf...)
+			msgs, err := readRecordBatch(batch, limiter, check)
+			if err == ErrInvalidMessageCRC {
+				if check == crcKeep {
+					return nil, ErrInvalidMessage
+				}
+				return set, err
+			}
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, msgs...)
+			continue
 		}
 
-		if msg.Crc != crc32.ChecksumIEEE(msgbuf[4:]) {
-			// ignore this message and because we want to have constant
-			// history, do not process anything more
-			return set, nil
+		corrupt := len(msgbuf) < 4 ||
+			check != crcSkip && binary.BigEndian.Uint32(msgbuf) != crc32.ChecksumIEEE(msgbuf[4:])
+		if corrupt && check != crcKeep {
+			// because we want to have constant history, do not process
+			// anything after this message
+			return set, ErrInvalidMessageCRC
 		}
 
-		// magic byte
-		_ = msgdec.DecodeInt8()
+		msg, attributes, err := decodeMessage(msgbuf)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode message: %s", err)
+		}
+		msg.Offset = offset
+		if corrupt {
+			set = append(set, msg)
+			continue
+		}
 
-		attributes := msgdec.DecodeInt8()
-		switch compression := Compression(attributes & 3); compression {
+		switch compression := Compression(attributes & attributeCompression); compression {
 		case CompressionNone:
-			msg.Key = msgdec.DecodeBytes()
-			msg.Value = msgdec.DecodeBytes()
-			if err := msgdec.Err(); err != nil {
-				return nil, fmt.Errorf("cannot decode message: %s", err)
-			}
 			set = append(set, msg)
-		case CompressionGzip, CompressionSnappy:
-			_ = msgdec.DecodeBytes() // ignore key
-			val := msgdec.DecodeBytes()
-			if err := msgdec.Err(); err != nil {
-				return nil, fmt.Errorf("cannot decode message: %s", err)
-			}
+		case CompressionGzip, CompressionSnappy, CompressionLZ4:
+			var buf *[]byte
 			var decoded []byte
-			switch compression {
-			case CompressionGzip:
-				cr, err := gzip.NewReader(bytes.NewReader(val))
-				if err != nil {
-					return nil, fmt.Errorf("error decoding gzip message: %s", err)
-				}
-				decoded, err = ioutil.ReadAll(cr)
-				if err != nil {
-					return nil, fmt.Errorf("error decoding gzip message: %s", err)
-				}
-				_ = cr.Close()
-			case CompressionSnappy:
-				var err error
-				decoded, err = snappyDecode(val)
-				if err != nil {
-					return nil, fmt.Errorf("error decoding snappy message: %s", err)
-				}
+			if limiter != nil {
+				buf = limiter.acquire()
+				decoded = *buf
+			}
+			decoded, err := decompress(compression, msg.Value, decoded)
+			var msgs []*Message
+			if err == nil {
+				// Messages are copied out of the decoded data, so the buffer
+				// can be reused right after this.
+				msgs, err = readMessageSet(bytes.NewReader(decoded), int32(len(decoded)), nil, check)
+			}
+			if buf != nil {
+				*buf = decoded
+				limiter.release(buf)
+			}
+			if err == ErrInvalidMessageCRC {
+				// the offsets of the messages before the corrupt one can't
+				// be made absolute, so none of them are returned
+				return set, err
 			}
-			msgs, err := readMessageSet(bytes.NewReader(decoded), int32(len(decoded)))
 			if err != nil {
 				return nil, err
 			}
+			if len(msgs) > 0 && relativeOffsets(msg, msgs) {
+				// the wrapper has the offset of the last message
+				base := offset - msgs[len(msgs)-1].Offset
+				for _, m := range msgs {
+					m.Offset += base
+				}
+			}
+			if msg.TimestampType == TimestampLogAppendTime {
+				for _, m := range msgs {
+					m.Timestamp = msg.Timestamp
+					m.TimestampType = TimestampLogAppendTime
+				}
+			}
 			set = append(set, msgs...)
 		default:
 			return nil, fmt.Errorf("cannot handle compression method: %d", compression)
@@ -333,10 +561,136 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 	}
 }
 
+// relativeOffsets returns true if the offsets of messages, decompressed from
+// wrapper, are relative to the first one rather than absolute. They always
+// are in format 1, and some brokers write them in format 0 as well, which is
+// recognized by the offsets starting at 0 while the wrapper's is beyond the
+// last one.
+func relativeOffsets(wrapper *Message, messages []*Message) bool {
+	if wrapper.Format >= 1 {
+		return true
+	}
+	return messages[0].Offset == 0 && wrapper.Offset > messages[len(messages)-1].Offset
+}
+
+// decodeMessage decodes a single message of format 0 or 1, starting with its
+// crc, and returns it along with its attributes. Key and value share the
+// memory of b.
+func decodeMessage(b []byte) (*Message, int8, error) {
+	// crc, magic byte and attributes
+	if len(b) < 6 {
+		return nil, 0, ErrNotEnoughData
+	}
+	msg := &Message{Crc: binary.BigEndian.Uint32(b), Format: int8(b[4])}
+	attributes := int8(b[5])
+	b = b[6:]
+
+	switch msg.Format {
+	case 0:
+	case 1:
+		if len(b) < 8 {
+			return nil, 0, ErrNotEnoughData
+		}
+		msg.Timestamp = decodeTimestamp(int64(binary.BigEndian.Uint64(b)))
+		if attributes&attributeLogAppendTime != 0 {
+			msg.TimestampType = TimestampLogAppendTime
+		}
+		b = b[8:]
+	default:
+		return nil, 0, fmt.Errorf("unsupported message format %d", msg.Format)
+	}
+
+	var ok bool
+	if msg.Key, b, ok = sliceBytes(b); !ok {
+		return nil, 0, ErrNotEnoughData
+	}
+	if msg.Value, _, ok = sliceBytes(b); !ok {
+		return nil, 0, ErrNotEnoughData
+	}
+	return msg, attributes, nil
+}
+
+// sliceBytes decodes a length prefixed byte array like decoder.DecodeBytes,
+// but returns a slice of b instead of a copy, along with the rest of b.
+func sliceBytes(b []byte) (val, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, b, false
+	}
+	size := int32(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	if size < 1 {
+		return nil, b, true
+	}
+	if int(size) > len(b) {
+		return nil, b, false
+	}
+	return b[:size:size], b[size:], true
+}
+
+// maxDecodedLen bounds the size of decompressed message sets, so that a
+// corrupt or hostile message doesn't make us allocate gigabytes.
+const maxDecodedLen = 256 << 20
+
+// decompress decodes a compressed message set, reusing the capacity of dst
+// when possible.
+func decompress(compression Compression, val []byte, dst []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		decoded, err := gzipDecode(dst, val, maxDecodedLen)
+		if err != nil {
+			return dst, fmt.Errorf("error decoding gzip message: %s", err)
+		}
+		return decoded, nil
+	case CompressionSnappy:
+		decoded, err := snappyDecode(dst, val)
+		if err != nil {
+			return dst, fmt.Errorf("error decoding snappy message: %s", err)
+		}
+		return decoded, nil
+	case CompressionLZ4:
+		decoded, err := lz4Decode(dst, val, maxDecodedLen)
+		if err != nil {
+			return dst, fmt.Errorf("error decoding lz4 message: %s", err)
+		}
+		return decoded, nil
+	case CompressionZstd:
+		decoded, err := zstdDecode(dst, val, maxDecodedLen)
+		if err != nil {
+			return dst, fmt.Errorf("error decoding zstd message: %s", err)
+		}
+		return decoded, nil
+	}
+	return dst, fmt.Errorf("cannot handle compression method: %d", compression)
+}
+
+// gzipDecode decodes the gzip data b, reusing the capacity of dst when
+// possible. It fails without decoding further once more than max bytes would
+// be decoded.
+func gzipDecode(dst, b []byte, max int) ([]byte, error) {
+	cr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return dst, err
+	}
+	defer cr.Close()
+
+	out := bytes.NewBuffer(dst[:0])
+	if _, err := out.ReadFrom(io.LimitReader(cr, int64(max)+1)); err != nil {
+		return dst, err
+	}
+	if out.Len() > max {
+		return dst, fmt.Errorf("gzip message exceeds the limit of %d bytes", max)
+	}
+	return out.Bytes(), nil
+}
+
 type MetadataReq struct {
+	// Version of the request, 0 or 1. Version 1 returns the rack of brokers,
+	// the controller and which topics are internal, see MetadataResp.
+	Version       int16
 	CorrelationID int32
 	ClientID      string
-	Topics        []string
+	// Topics to return the metadata of, all topics if empty.
+	Topics []string
 }
 
 func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
@@ -345,8 +699,9 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.Topics = make([]string, dec.DecodeArrayLen())
@@ -367,11 +722,17 @@ func (r *MetadataReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(MetadataReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
-	enc.EncodeArrayLen(len(r.Topics))
+	if r.Version >= 1 && len(r.Topics) == 0 {
+		// since version 1, all topics are requested with null and an empty
+		// array requests none
+		enc.EncodeArrayLen(-1)
+	} else {
+		enc.EncodeArrayLen(len(r.Topics))
+	}
 	for _, name := range r.Topics {
 		enc.Encode(name)
 	}
@@ -397,20 +758,32 @@ func (r *MetadataReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type MetadataResp struct {
+	// Version of the request this is a response to. It is not part of the
+	// encoded response, but determines which fields are present.
+	Version       int16
 	CorrelationID int32
 	Brokers       []MetadataRespBroker
-	Topics        []MetadataRespTopic
+	// ControllerID is the node ID of the controller broker. Only returned
+	// by version 1 and later.
+	ControllerID int32
+	Topics       []MetadataRespTopic
 }
 
 type MetadataRespBroker struct {
 	NodeID int32
 	Host   string
 	Port   int32
+	// Rack is the rack of the broker, if it has one. Only returned by
+	// version 1 and later.
+	Rack string
 }
 
 type MetadataRespTopic struct {
-	Name       string
-	Err        error
+	Name string
+	Err  error
+	// IsInternal is true for topics of the broker itself, like the one of
+	// committed offsets. Only returned by version 1 and later.
+	IsInternal bool
 	Partitions []MetadataRespPartition
 }
 
@@ -434,11 +807,28 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 		enc.Encode(broker.NodeID)
 		enc.Encode(broker.Host)
 		enc.Encode(broker.Port)
+		if r.Version >= 1 {
+			if broker.Rack == "" {
+				enc.Encode(int16(-1)) // null
+			} else {
+				enc.Encode(broker.Rack)
+			}
+		}
+	}
+	if r.Version >= 1 {
+		enc.Encode(r.ControllerID)
 	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.EncodeError(topic.Err)
 		enc.Encode(topic.Name)
+		if r.Version >= 1 {
+			if topic.IsInternal {
+				enc.Encode(int8(1))
+			} else {
+				enc.Encode(int8(0))
+			}
+		}
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.EncodeError(part.Err)
@@ -461,7 +851,11 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 }
 
 func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
-	var resp MetadataResp
+	return ReadVersionedMetadataResp(r, 0)
+}
+
+func ReadVersionedMetadataResp(r io.Reader, version int16) (*MetadataResp, error) {
+	resp := MetadataResp{Version: version}
 	dec := NewDecoder(r)
 
 	// total message size
@@ -474,6 +868,12 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		b.NodeID = dec.DecodeInt32()
 		b.Host = dec.DecodeString()
 		b.Port = dec.DecodeInt32()
+		if version >= 1 {
+			b.Rack = dec.DecodeString()
+		}
+	}
+	if version >= 1 {
+		resp.ControllerID = dec.DecodeInt32()
 	}
 
 	resp.Topics = make([]MetadataRespTopic, dec.DecodeArrayLen())
@@ -481,6 +881,9 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		var t = &resp.Topics[ti]
 		t.Err = errFromNo(dec.DecodeInt16())
 		t.Name = dec.DecodeString()
+		if version >= 1 {
+			t.IsInternal = dec.DecodeInt8() != 0
+		}
 		t.Partitions = make([]MetadataRespPartition, dec.DecodeArrayLen())
 		for pi := range t.Partitions {
 			var p = &t.Partitions[pi]
@@ -507,14 +910,45 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 }
 
 type FetchReq struct {
+	// Version of the request, 0 to 10. Version 1 returns the throttle time,
+	// see FetchResp, version 2 lets the broker return messages in format 1,
+	// version 3 adds MaxBytes and version 4 lets it return record batches of
+	// format 2, including the messages of aborted transactions. Version 5
+	// returns the log start offset of partitions, version 7 an error for the
+	// whole request, and version 10 lets the broker return zstd compressed
+	// batches. The others differ in fields this package leaves unset:
+	// fetch sessions (version 7) and leader epochs (version 9).
+	Version       int16
 	CorrelationID int32
 	ClientID      string
 	MaxWaitTime   time.Duration
 	MinBytes      int32
+	// MaxBytes limits the size of the whole response, like MaxBytes of the
+	// partitions does for each of them. Zero means no limit. Only sent by
+	// version 3 and later.
+	MaxBytes int32
+	// IsolationLevel selects the messages of transactions that are returned.
+	// Only sent by version 4 and later.
+	IsolationLevel IsolationLevel
 
 	Topics []FetchReqTopic
 }
 
+// IsolationLevel selects which messages of transactions a fetch returns.
+type IsolationLevel int8
+
+const (
+	// ReadUncommitted returns all messages, including those of open and
+	// aborted transactions.
+	ReadUncommitted IsolationLevel = 0
+
+	// ReadCommitted returns messages up to the last stable offset, before
+	// which all transactions are complete. The messages of aborted
+	// transactions are returned as well, but listed in the
+	// AbortedTransactions of the partition, so that they can be skipped.
+	ReadCommitted IsolationLevel = 1
+)
+
 type FetchReqTopic struct {
 	Name       string
 	Partitions []FetchReqPartition
@@ -532,14 +966,26 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	// replica id
 	_ = dec.DecodeInt32()
 	req.MaxWaitTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
 	req.MinBytes = dec.DecodeInt32()
+	if req.Version >= 3 {
+		req.MaxBytes = dec.DecodeInt32()
+	}
+	if req.Version >= 4 {
+		req.IsolationLevel = IsolationLevel(dec.DecodeInt8())
+	}
+	if req.Version >= 7 {
+		// session id and epoch
+		_ = dec.DecodeInt32()
+		_ = dec.DecodeInt32()
+	}
 	req.Topics = make([]FetchReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
@@ -548,10 +994,27 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 		for pi := range topic.Partitions {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
+			if req.Version >= 9 {
+				// current leader epoch
+				_ = dec.DecodeInt32()
+			}
 			part.FetchOffset = dec.DecodeInt64()
+			if req.Version >= 5 {
+				// log start offset, only set by followers
+				_ = dec.DecodeInt64()
+			}
 			part.MaxBytes = dec.DecodeInt32()
 		}
 	}
+	if req.Version >= 7 {
+		// topics removed from the fetch session
+		for i, n := 0, dec.DecodeArrayLen(); i < n; i++ {
+			_ = dec.DecodeString()
+			for j, m := 0, dec.DecodeArrayLen(); j < m; j++ {
+				_ = dec.DecodeInt32()
+			}
+		}
+	}
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -566,7 +1029,7 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(FetchReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
@@ -574,6 +1037,20 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 	enc.Encode(int32(-1))
 	enc.Encode(int32(r.MaxWaitTime / time.Millisecond))
 	enc.Encode(r.MinBytes)
+	if r.Version >= 3 {
+		maxBytes := r.MaxBytes
+		if maxBytes == 0 {
+			maxBytes = math.MaxInt32
+		}
+		enc.Encode(maxBytes)
+	}
+	if r.Version >= 4 {
+		enc.EncodeInt8(int8(r.IsolationLevel))
+	}
+	if r.Version >= 7 {
+		enc.Encode(int32(0))  // no fetch session
+		enc.Encode(int32(-1)) // session epoch of full requests
+	}
 
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
@@ -581,10 +1058,19 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
+			if r.Version >= 9 {
+				enc.Encode(int32(-1)) // no current leader epoch
+			}
 			enc.Encode(part.FetchOffset)
+			if r.Version >= 5 {
+				enc.Encode(int64(-1)) // log start offset
+			}
 			enc.Encode(part.MaxBytes)
 		}
 	}
+	if r.Version >= 7 {
+		enc.EncodeArrayLen(0) // no topics removed from the session
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -607,8 +1093,18 @@ func (r *FetchReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type FetchResp struct {
+	// Version of the request this is a response to. It is not part of the
+	// encoded response, but determines which fields are present.
+	Version       int16
 	CorrelationID int32
-	Topics        []FetchRespTopic
+	Compression   Compression // only used when writing FetchResps
+	// ThrottleTime is the time the request was delayed by a quota. Only
+	// returned by version 1 and later.
+	ThrottleTime time.Duration
+	// Err is the error of the whole request, such as a failed fetch
+	// session. Only returned by version 7 and later.
+	Err    error
+	Topics []FetchRespTopic
 }
 
 type FetchRespTopic struct {
@@ -620,7 +1116,25 @@ type FetchRespPartition struct {
 	ID        int32
 	Err       error
 	TipOffset int64
-	Messages  []*Message
+	// LastStableOffset is the offset up to which all transactions are
+	// complete. Only returned by version 4 and later.
+	LastStableOffset int64
+	// LogStartOffset is the offset of the first message the partition
+	// still has. Only returned by version 5 and later.
+	LogStartOffset int64
+	// AbortedTransactions are the transactions whose messages in this
+	// response were aborted. Only returned by version 4 and later, for
+	// requests with ReadCommitted.
+	AbortedTransactions []AbortedTransaction
+	Messages            []*Message
+}
+
+// AbortedTransaction is a transaction of a producer that was aborted. Its
+// messages are those of the producer from FirstOffset up to the control batch
+// that marks the abort.
+type AbortedTransaction struct {
+	ProducerID  int64
+	FirstOffset int64
 }
 
 func (r *FetchResp) Bytes() ([]byte, error) {
@@ -629,6 +1143,13 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 
 	enc.Encode(int32(0)) // placeholder
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
+	if r.Version >= 7 {
+		enc.EncodeError(r.Err)
+		enc.Encode(int32(0)) // session id
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -637,15 +1158,35 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.TipOffset)
+			if r.Version >= 4 {
+				enc.Encode(part.LastStableOffset)
+				if r.Version >= 5 {
+					enc.Encode(part.LogStartOffset)
+				}
+				if part.AbortedTransactions == nil {
+					enc.EncodeArrayLen(-1)
+				} else {
+					enc.EncodeArrayLen(len(part.AbortedTransactions))
+				}
+				for _, txn := range part.AbortedTransactions {
+					enc.Encode(txn.ProducerID)
+					enc.Encode(txn.FirstOffset)
+				}
+			}
 			i := len(buf)
 			enc.Encode(int32(0)) // placeholder
-			// NOTE(caleb): writing compressed fetch response isn't implemented
-			// for now, since that's not needed for clients.
-			n, err := writeMessageSet(&buf, part.Messages, CompressionNone)
+			var b []byte
+			var err error
+			if r.Version >= 4 {
+				b, err = appendRecordBatch(buf, part.Messages, r.Compression, 0, false)
+			} else {
+				b, err = appendMessageSet(buf, part.Messages, r.Compression, 0, false)
+			}
 			if err != nil {
 				return nil, err
 			}
-			binary.BigEndian.PutUint32(buf[i:i+4], uint32(n))
+			buf = b
+			binary.BigEndian.PutUint32(buf[i:i+4], uint32(len(buf)-i-4))
 		}
 	}
 
@@ -658,14 +1199,49 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 }
 
 func ReadFetchResp(r io.Reader) (*FetchResp, error) {
+	return ReadVersionedFetchResp(r, 0, nil)
+}
+
+// ReadFetchRespLimited reads a fetch response like ReadFetchResp, but
+// decompresses message sets within the limits of the given limiter.
+func ReadFetchRespLimited(r io.Reader, limiter *DecompressionLimiter) (*FetchResp, error) {
+	return ReadVersionedFetchResp(r, 0, limiter)
+}
+
+// ReadVersionedFetchResp reads a fetch response to a request of the given
+// version, decompressing message sets within the limits of limiter, which
+// may be nil.
+//
+// Messages are checked against their crc. If a partition has a corrupt
+// message, its Err is ErrInvalidMessageCRC and its Messages are the ones
+// before the corrupt message.
+func ReadVersionedFetchResp(r io.Reader, version int16, limiter *DecompressionLimiter) (*FetchResp, error) {
+	return readFetchResp(r, version, limiter, crcReject)
+}
+
+// ReadVersionedFetchRespSkipCRC reads a fetch response like
+// ReadVersionedFetchResp, but without checking messages against their crc.
+func ReadVersionedFetchRespSkipCRC(r io.Reader, version int16, limiter *DecompressionLimiter) (*FetchResp, error) {
+	return readFetchResp(r, version, limiter, crcSkip)
+}
+
+func readFetchResp(r io.Reader, version int16, limiter *DecompressionLimiter, check crcCheck) (*FetchResp, error) {
 	var err error
-	var resp FetchResp
+	resp := FetchResp{Version: version}
 
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
+	if version >= 7 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+		// session id
+		_ = dec.DecodeInt32()
+	}
 
 	resp.Topics = make([]FetchRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
@@ -677,6 +1253,20 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 			part.ID = dec.DecodeInt32()
 			part.Err = errFromNo(dec.DecodeInt16())
 			part.TipOffset = dec.DecodeInt64()
+			if version >= 4 {
+				part.LastStableOffset = dec.DecodeInt64()
+				if version >= 5 {
+					part.LogStartOffset = dec.DecodeInt64()
+				}
+				if n := dec.DecodeArrayLen(); n > 0 {
+					part.AbortedTransactions = make([]AbortedTransaction, n)
+					for i := range part.AbortedTransactions {
+						txn := &part.AbortedTransactions[i]
+						txn.ProducerID = dec.DecodeInt64()
+						txn.FirstOffset = dec.DecodeInt64()
+					}
+				}
+			}
 			if dec.Err() != nil {
 				return nil, dec.Err()
 			}
@@ -684,7 +1274,10 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 			if dec.Err() != nil {
 				return nil, dec.Err()
 			}
-			if part.Messages, err = readMessageSet(r, msgSetSize); err != nil {
+			part.Messages, err = readMessageSet(r, msgSetSize, limiter, check)
+			if err == ErrInvalidMessageCRC && part.Err == nil {
+				part.Err = err
+			} else if err != nil && err != ErrInvalidMessageCRC {
 				return nil, err
 			}
 			for _, msg := range part.Messages {
@@ -807,53 +1400,44 @@ func (r *GroupCoordinatorResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-type OffsetCommitReq struct {
-	CorrelationID int32
-	ClientID      string
-	ConsumerGroup string
-	Topics        []OffsetCommitReqTopic
-}
-
-type OffsetCommitReqTopic struct {
-	Name       string
-	Partitions []OffsetCommitReqPartition
+// GroupProtocol is one of the protocols a member supports, along with the
+// opaque metadata the group leader uses to compute the assignment.
+type GroupProtocol struct {
+	Name     string
+	Metadata []byte
 }
 
-type OffsetCommitReqPartition struct {
-	ID        int32
-	Offset    int64
-	TimeStamp time.Time
-	Metadata  string
+type JoinGroupReq struct {
+	CorrelationID  int32
+	ClientID       string
+	ConsumerGroup  string
+	SessionTimeout time.Duration
+	MemberID       string
+	ProtocolType   string
+	GroupProtocols []GroupProtocol
 }
 
-func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
-	var req OffsetCommitReq
+func ReadJoinGroupReq(r io.Reader) (*JoinGroupReq, error) {
+	var req JoinGroupReq
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key
-	_ = dec.DecodeInt16()
-	apiVersion := dec.DecodeInt16()
+	// api key + api version
+	_ = dec.DecodeInt32()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.ConsumerGroup = dec.DecodeString()
-	if apiVersion == 1 {
-		_ = dec.DecodeInt32()
-		_ = dec.DecodeString()
+	req.SessionTimeout = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	req.MemberID = dec.DecodeString()
+	req.ProtocolType = dec.DecodeString()
+	n := dec.DecodeArrayLen()
+	if n > 0 {
+		req.GroupProtocols = make([]GroupProtocol, n)
 	}
-	req.Topics = make([]OffsetCommitReqTopic, dec.DecodeArrayLen())
-	for ti := range req.Topics {
-		var topic = &req.Topics[ti]
-		topic.Name = dec.DecodeString()
-		topic.Partitions = make([]OffsetCommitReqPartition, dec.DecodeArrayLen())
-		for pi := range topic.Partitions {
-			var part = &topic.Partitions[pi]
-			part.ID = dec.DecodeInt32()
-			part.Offset = dec.DecodeInt64()
-			part.TimeStamp = time.Unix(0, dec.DecodeInt64()*int64(time.Millisecond))
-			part.Metadata = dec.DecodeString()
-		}
+	for i := range req.GroupProtocols {
+		req.GroupProtocols[i].Name = dec.DecodeString()
+		req.GroupProtocols[i].Metadata = dec.DecodeBytes()
 	}
 
 	if dec.Err() != nil {
@@ -862,29 +1446,1057 @@ func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
 	return &req, nil
 }
 
-func (r *OffsetCommitReq) Bytes() ([]byte, error) {
+func (r *JoinGroupReq) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
-	enc.Encode(int16(OffsetCommitReqKind))
-	enc.Encode(int16(1)) // version - must be 1 to use Kafka committed offsets instead of ZK
+	enc.Encode(int16(JoinGroupReqKind))
+	enc.Encode(int16(0))
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
 	enc.Encode(r.ConsumerGroup)
-	enc.Encode(int32(-1)) // ConsumerGroupGenerationId
-	enc.Encode("")        // ConsumerId
+	enc.Encode(int32(r.SessionTimeout / time.Millisecond))
+	enc.Encode(r.MemberID)
+	enc.Encode(r.ProtocolType)
+	enc.EncodeArrayLen(len(r.GroupProtocols))
+	for _, p := range r.GroupProtocols {
+		enc.Encode(p.Name)
+		enc.EncodeBytes(p.Metadata)
+	}
 
-	enc.EncodeArrayLen(len(r.Topics))
-	for _, topic := range r.Topics {
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *JoinGroupReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// GroupMember is a member of a group as reported to the group leader, with
+// the metadata it sent for the protocol the coordinator selected.
+type GroupMember struct {
+	MemberID string
+	Metadata []byte
+}
+
+type JoinGroupResp struct {
+	CorrelationID int32
+	Err           error
+	GenerationID  int32
+	GroupProtocol string
+	LeaderID      string
+	MemberID      string
+	// Members is only set in the response sent to the group leader.
+	Members []GroupMember
+}
+
+func ReadJoinGroupResp(r io.Reader) (*JoinGroupResp, error) {
+	var resp JoinGroupResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.GenerationID = dec.DecodeInt32()
+	resp.GroupProtocol = dec.DecodeString()
+	resp.LeaderID = dec.DecodeString()
+	resp.MemberID = dec.DecodeString()
+	n := dec.DecodeArrayLen()
+	if n > 0 {
+		resp.Members = make([]GroupMember, n)
+	}
+	for i := range resp.Members {
+		resp.Members[i].MemberID = dec.DecodeString()
+		resp.Members[i].Metadata = dec.DecodeBytes()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *JoinGroupResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.Encode(r.GenerationID)
+	enc.Encode(r.GroupProtocol)
+	enc.Encode(r.LeaderID)
+	enc.Encode(r.MemberID)
+	enc.EncodeArrayLen(len(r.Members))
+	for _, m := range r.Members {
+		enc.Encode(m.MemberID)
+		enc.EncodeBytes(m.Metadata)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type HeartbeatReq struct {
+	CorrelationID int32
+	ClientID      string
+	ConsumerGroup string
+	GenerationID  int32
+	MemberID      string
+}
+
+func ReadHeartbeatReq(r io.Reader) (*HeartbeatReq, error) {
+	var req HeartbeatReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.ConsumerGroup = dec.DecodeString()
+	req.GenerationID = dec.DecodeInt32()
+	req.MemberID = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *HeartbeatReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(HeartbeatReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.ConsumerGroup)
+	enc.Encode(r.GenerationID)
+	enc.Encode(r.MemberID)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *HeartbeatReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type HeartbeatResp struct {
+	CorrelationID int32
+	Err           error
+}
+
+func ReadHeartbeatResp(r io.Reader) (*HeartbeatResp, error) {
+	var resp HeartbeatResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *HeartbeatResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type LeaveGroupReq struct {
+	CorrelationID int32
+	ClientID      string
+	ConsumerGroup string
+	MemberID      string
+}
+
+func ReadLeaveGroupReq(r io.Reader) (*LeaveGroupReq, error) {
+	var req LeaveGroupReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.ConsumerGroup = dec.DecodeString()
+	req.MemberID = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *LeaveGroupReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(LeaveGroupReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.ConsumerGroup)
+	enc.Encode(r.MemberID)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *LeaveGroupReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type LeaveGroupResp struct {
+	CorrelationID int32
+	Err           error
+}
+
+func ReadLeaveGroupResp(r io.Reader) (*LeaveGroupResp, error) {
+	var resp LeaveGroupResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *LeaveGroupResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// GroupAssignment is the opaque assignment the group leader computed for a
+// single member.
+type GroupAssignment struct {
+	MemberID   string
+	Assignment []byte
+}
+
+type SyncGroupReq struct {
+	CorrelationID int32
+	ClientID      string
+	ConsumerGroup string
+	GenerationID  int32
+	MemberID      string
+	// GroupAssignments is only set by the group leader.
+	GroupAssignments []GroupAssignment
+}
+
+func ReadSyncGroupReq(r io.Reader) (*SyncGroupReq, error) {
+	var req SyncGroupReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.ConsumerGroup = dec.DecodeString()
+	req.GenerationID = dec.DecodeInt32()
+	req.MemberID = dec.DecodeString()
+	n := dec.DecodeArrayLen()
+	if n > 0 {
+		req.GroupAssignments = make([]GroupAssignment, n)
+	}
+	for i := range req.GroupAssignments {
+		req.GroupAssignments[i].MemberID = dec.DecodeString()
+		req.GroupAssignments[i].Assignment = dec.DecodeBytes()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *SyncGroupReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(SyncGroupReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.ConsumerGroup)
+	enc.Encode(r.GenerationID)
+	enc.Encode(r.MemberID)
+	enc.EncodeArrayLen(len(r.GroupAssignments))
+	for _, a := range r.GroupAssignments {
+		enc.Encode(a.MemberID)
+		enc.EncodeBytes(a.Assignment)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *SyncGroupReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type SyncGroupResp struct {
+	CorrelationID    int32
+	Err              error
+	MemberAssignment []byte
+}
+
+func ReadSyncGroupResp(r io.Reader) (*SyncGroupResp, error) {
+	var resp SyncGroupResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.MemberAssignment = dec.DecodeBytes()
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *SyncGroupResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.EncodeBytes(r.MemberAssignment)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// ConsumerProtocolType is the protocol type of consumer groups. Members of
+// such groups send GroupMemberMetadata with their JoinGroup requests and the
+// group leader sends them GroupMemberAssignment with its SyncGroup request.
+const ConsumerProtocolType = "consumer"
+
+// GroupMemberMetadata is the metadata of a consumer group member, as sent in
+// GroupProtocol.Metadata. It lists the topics the member consumes.
+type GroupMemberMetadata struct {
+	Version  int16
+	Topics   []string
+	UserData []byte
+}
+
+func ReadGroupMemberMetadata(r io.Reader) (*GroupMemberMetadata, error) {
+	var m GroupMemberMetadata
+	dec := NewDecoder(r)
+
+	m.Version = dec.DecodeInt16()
+	n := dec.DecodeArrayLen()
+	if n > 0 {
+		m.Topics = make([]string, n)
+	}
+	for i := range m.Topics {
+		m.Topics[i] = dec.DecodeString()
+	}
+	m.UserData = dec.DecodeBytes()
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *GroupMemberMetadata) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	enc.Encode(m.Version)
+	enc.EncodeArrayLen(len(m.Topics))
+	for _, topic := range m.Topics {
+		enc.Encode(topic)
+	}
+	enc.EncodeBytes(m.UserData)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+	return buf.Bytes(), nil
+}
+
+// GroupMemberAssignment is the assignment of a consumer group member, as sent
+// in GroupAssignment.Assignment and SyncGroupResp.MemberAssignment.
+type GroupMemberAssignment struct {
+	Version  int16
+	Topics   []GroupMemberAssignmentTopic
+	UserData []byte
+}
+
+type GroupMemberAssignmentTopic struct {
+	Name       string
+	Partitions []int32
+}
+
+// ReadGroupMemberAssignment reads an assignment. Members that are assigned
+// nothing may get an empty assignment, which is read as one without topics.
+func ReadGroupMemberAssignment(r io.Reader) (*GroupMemberAssignment, error) {
+	var a GroupMemberAssignment
+	if n, ok := available(r); ok && n == 0 {
+		return &a, nil
+	}
+	dec := NewDecoder(r)
+
+	a.Version = dec.DecodeInt16()
+	n := dec.DecodeArrayLen()
+	if n > 0 {
+		a.Topics = make([]GroupMemberAssignmentTopic, n)
+	}
+	for i := range a.Topics {
+		a.Topics[i].Name = dec.DecodeString()
+		np := dec.DecodeArrayLen()
+		if np > 0 {
+			a.Topics[i].Partitions = make([]int32, np)
+		}
+		for j := range a.Topics[i].Partitions {
+			a.Topics[i].Partitions[j] = dec.DecodeInt32()
+		}
+	}
+	a.UserData = dec.DecodeBytes()
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (a *GroupMemberAssignment) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	enc.Encode(a.Version)
+	enc.EncodeArrayLen(len(a.Topics))
+	for _, topic := range a.Topics {
+		enc.Encode(topic.Name)
+		enc.Encode(topic.Partitions)
+	}
+	enc.EncodeBytes(a.UserData)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+	return buf.Bytes(), nil
+}
+
+// SASLHandshakeReq asks the broker to authenticate the connection with a
+// SASL mechanism. If the broker supports it, the SASL exchange follows as
+// length prefixed tokens, without request headers, and the connection can be
+// used for other requests once it succeeds.
+type SASLHandshakeReq struct {
+	// Version of the request, 0 or 1. After version 1, the tokens of the
+	// SASL exchange are sent in SASLAuthenticate requests instead.
+	Version       int16
+	CorrelationID int32
+	ClientID      string
+	Mechanism     string
+}
+
+func ReadSASLHandshakeReq(r io.Reader) (*SASLHandshakeReq, error) {
+	var req SASLHandshakeReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.Mechanism = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *SASLHandshakeReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(SASLHandshakeReqKind))
+	enc.Encode(r.Version)
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+	enc.Encode(r.Mechanism)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *SASLHandshakeReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type SASLHandshakeResp struct {
+	CorrelationID int32
+	// Err is ErrUnsupportedSASLMechanism if the broker does not support the
+	// requested mechanism.
+	Err               error
+	EnabledMechanisms []string
+}
+
+func ReadSASLHandshakeResp(r io.Reader) (*SASLHandshakeResp, error) {
+	var resp SASLHandshakeResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	n := dec.DecodeArrayLen()
+	if n > 0 {
+		resp.EnabledMechanisms = make([]string, n)
+	}
+	for i := range resp.EnabledMechanisms {
+		resp.EnabledMechanisms[i] = dec.DecodeString()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *SASLHandshakeResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.EncodeArrayLen(len(r.EnabledMechanisms))
+	for _, name := range r.EnabledMechanisms {
+		enc.Encode(name)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// SASLAuthenticateReq carries a token of the SASL exchange that follows a
+// version 1 SASLHandshake request.
+type SASLAuthenticateReq struct {
+	CorrelationID int32
+	ClientID      string
+	AuthBytes     []byte
+}
+
+func ReadSASLAuthenticateReq(r io.Reader) (*SASLAuthenticateReq, error) {
+	var req SASLAuthenticateReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.AuthBytes = dec.DecodeBytes()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *SASLAuthenticateReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(SASLAuthenticateReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+	if r.AuthBytes == nil {
+		enc.Encode([]byte{})
+	} else {
+		enc.Encode(r.AuthBytes)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *SASLAuthenticateReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type SASLAuthenticateResp struct {
+	CorrelationID int32
+	// Err is ErrSASLAuthenticationFailed if the broker rejected the token,
+	// with ErrMessage telling why.
+	Err        error
+	ErrMessage string
+	AuthBytes  []byte
+}
+
+func ReadSASLAuthenticateResp(r io.Reader) (*SASLAuthenticateResp, error) {
+	var resp SASLAuthenticateResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.ErrMessage = dec.DecodeString()
+	resp.AuthBytes = dec.DecodeBytes()
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *SASLAuthenticateResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	if r.ErrMessage == "" {
+		enc.Encode(int16(-1))
+	} else {
+		enc.Encode(r.ErrMessage)
+	}
+	if r.AuthBytes == nil {
+		enc.Encode([]byte{})
+	} else {
+		enc.Encode(r.AuthBytes)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// APIVersion is the range of versions of a request kind a broker supports.
+type APIVersion struct {
+	APIKey     int16
+	MinVersion int16
+	MaxVersion int16
+}
+
+// SupportedAPIVersions are the versions of the requests this package reads
+// and writes.
+var SupportedAPIVersions = []APIVersion{
+	{APIKey: ProduceReqKind, MinVersion: 0, MaxVersion: 7},
+	{APIKey: FetchReqKind, MinVersion: 0, MaxVersion: 10},
+	{APIKey: OffsetReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: MetadataReqKind, MinVersion: 0, MaxVersion: 1},
+	{APIKey: OffsetCommitReqKind, MinVersion: 0, MaxVersion: 2},
+	{APIKey: OffsetFetchReqKind, MinVersion: 0, MaxVersion: 1},
+	{APIKey: GroupCoordinatorReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: JoinGroupReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: HeartbeatReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: LeaveGroupReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: SyncGroupReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: SASLHandshakeReqKind, MinVersion: 0, MaxVersion: 1},
+	{APIKey: APIVersionsReqKind, MinVersion: 0, MaxVersion: 0},
+	{APIKey: SASLAuthenticateReqKind, MinVersion: 0, MaxVersion: 0},
+}
+
+type APIVersionsReq struct {
+	CorrelationID int32
+	ClientID      string
+}
+
+func ReadAPIVersionsReq(r io.Reader) (*APIVersionsReq, error) {
+	var req APIVersionsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *APIVersionsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(APIVersionsReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *APIVersionsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type APIVersionsResp struct {
+	CorrelationID int32
+	Err           error
+	APIVersions   []APIVersion
+}
+
+func ReadAPIVersionsResp(r io.Reader) (*APIVersionsResp, error) {
+	var resp APIVersionsResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	n := dec.DecodeArrayLen()
+	if n > 0 {
+		resp.APIVersions = make([]APIVersion, n)
+	}
+	for i := range resp.APIVersions {
+		resp.APIVersions[i].APIKey = dec.DecodeInt16()
+		resp.APIVersions[i].MinVersion = dec.DecodeInt16()
+		resp.APIVersions[i].MaxVersion = dec.DecodeInt16()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *APIVersionsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.EncodeArrayLen(len(r.APIVersions))
+	for _, v := range r.APIVersions {
+		enc.Encode(v.APIKey)
+		enc.Encode(v.MinVersion)
+		enc.Encode(v.MaxVersion)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type OffsetCommitReq struct {
+	// Version of the request, 1 or 2. Version 0, which commits offsets to
+	// ZooKeeper, is not supported, so the zero value sends version 1.
+	// Version 2 sends RetentionTime instead of partition timestamps.
+	Version       int16
+	CorrelationID int32
+	ClientID      string
+	ConsumerGroup string
+
+	// GenerationID and MemberID identify the group member that commits, so
+	// that the coordinator rejects commits of a member that lost its
+	// partitions with ErrIllegalGeneration or ErrUnknownConsumerID. Without a
+	// MemberID the commit is sent with generation -1, which the coordinator
+	// accepts from clients that don't use group membership.
+	GenerationID int32
+	MemberID     string
+
+	// RetentionTime is how long the committed offsets are kept. Zero keeps
+	// them for the retention time the broker is configured with. Only sent
+	// by version 2 and later.
+	RetentionTime time.Duration
+
+	Topics []OffsetCommitReqTopic
+}
+
+type OffsetCommitReqTopic struct {
+	Name       string
+	Partitions []OffsetCommitReqPartition
+}
+
+type OffsetCommitReqPartition struct {
+	ID        int32
+	Offset    int64
+	TimeStamp time.Time
+	Metadata  string
+}
+
+func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
+	var req OffsetCommitReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.ConsumerGroup = dec.DecodeString()
+	if req.Version >= 1 {
+		req.GenerationID = dec.DecodeInt32()
+		req.MemberID = dec.DecodeString()
+	}
+	if req.Version >= 2 {
+		if retention := dec.DecodeInt64(); retention > 0 {
+			req.RetentionTime = time.Duration(retention) * time.Millisecond
+		}
+	}
+	req.Topics = make([]OffsetCommitReqTopic, dec.DecodeArrayLen())
+	for ti := range req.Topics {
+		var topic = &req.Topics[ti]
+		topic.Name = dec.DecodeString()
+		topic.Partitions = make([]OffsetCommitReqPartition, dec.DecodeArrayLen())
+		for pi := range topic.Partitions {
+			var part = &topic.Partitions[pi]
+			part.ID = dec.DecodeInt32()
+			part.Offset = dec.DecodeInt64()
+			if req.Version <= 1 {
+				part.TimeStamp = time.Unix(0, dec.DecodeInt64()*int64(time.Millisecond))
+			}
+			part.Metadata = dec.DecodeString()
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *OffsetCommitReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	// version must be at least 1 to use Kafka committed offsets instead of ZK
+	version := r.Version
+	if version < 1 {
+		version = 1
+	}
+	enc.Encode(int16(OffsetCommitReqKind))
+	enc.Encode(version)
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.ConsumerGroup)
+	if r.MemberID == "" {
+		enc.Encode(int32(-1))
+	} else {
+		enc.Encode(r.GenerationID)
+	}
+	enc.Encode(r.MemberID)
+	if version >= 2 {
+		if r.RetentionTime > 0 {
+			enc.Encode(int64(r.RetentionTime / time.Millisecond))
+		} else {
+			enc.Encode(int64(-1)) // -1 is "use the broker's retention time"
+		}
+	}
+
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.Encode(part.Offset)
-			enc.Encode(int64(-1)) // -1 is "use current time"
+			if version == 1 {
+				enc.Encode(int64(-1)) // -1 is "use current time"
+			}
 			enc.Encode(part.Metadata)
 		}
 	}
@@ -1133,9 +2745,22 @@ func (r *OffsetFetchResp) Bytes() ([]byte, error) {
 }
 
 type ProduceReq struct {
+	// Version of the request, 0 to 7. Versions 1 and 2 only differ in the
+	// response, see ProduceResp, and version 3 writes the messages in a
+	// record batch, see Message.Format. Version 5 returns the log start
+	// offset, and version 7 lets the messages be zstd compressed. Versions
+	// 4 and 6 only differ in the errors the broker may return.
+	Version       int16
 	CorrelationID int32
 	ClientID      string
 	Compression   Compression // only used when sending ProduceReqs
+	// CompressionLevel is the level of gzip compressed messages, from 1
+	// (gzip.BestSpeed) to 9 (gzip.BestCompression), or 0 for the default
+	// level of compress/gzip. Only used when sending.
+	CompressionLevel int
+	// SnappyFraming frames snappy compressed messages like snappy-java,
+	// which Java consumers before 0.8.2 need. Only used when sending.
+	SnappyFraming bool
 	RequiredAcks  int16
 	Timeout       time.Duration
 	Topics        []ProduceReqTopic
@@ -1151,16 +2776,25 @@ type ProduceReqPartition struct {
 	Messages []*Message
 }
 
+// ReadProduceReq decodes a produce request. Unlike messages of fetch
+// responses, messages that fail their crc check are kept, with the crc they
+// were sent with, so that the receiver can compare it to ComputeCrc and
+// reject them.
 func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 	var req ProduceReq
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
+	if req.Version >= 3 {
+		// transactional ID
+		_ = dec.DecodeString()
+	}
 	req.RequiredAcks = dec.DecodeInt16()
 	req.Timeout = time.Duration(dec.DecodeInt32()) * time.Millisecond
 	req.Topics = make([]ProduceReqTopic, dec.DecodeArrayLen())
@@ -1179,7 +2813,7 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 				return nil, dec.Err()
 			}
 			var err error
-			if part.Messages, err = readMessageSet(r, msgSetSize); err != nil {
+			if part.Messages, err = readMessageSet(r, msgSetSize, nil, crcKeep); err != nil {
 				return nil, err
 			}
 		}
@@ -1192,43 +2826,84 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 }
 
 func (r *ProduceReq) Bytes() ([]byte, error) {
-	var buf buffer
-	enc := NewEncoder(&buf)
-
-	enc.EncodeInt32(0) // placeholder
-	enc.EncodeInt16(ProduceReqKind)
-	enc.EncodeInt16(0)
-	enc.EncodeInt32(r.CorrelationID)
-	enc.EncodeString(r.ClientID)
+	b, err := r.AppendTo(make([]byte, 0, r.sizeHint()))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
 
-	enc.EncodeInt16(r.RequiredAcks)
-	enc.EncodeInt32(int32(r.Timeout / time.Millisecond))
-	enc.EncodeArrayLen(len(r.Topics))
+// AppendTo appends the request in wire protocol format to b and returns the
+// extended slice, like Bytes does for a new one. Apart from compressing
+// messages, it allocates nothing if b has enough capacity, so that a producer
+// can encode its requests into a buffer it reuses. On error, b is returned as
+// it was.
+func (r *ProduceReq) AppendTo(b []byte) ([]byte, error) {
+	start := len(b)
+	b = appendInt32(b, 0) // placeholder
+	b = appendInt16(b, ProduceReqKind)
+	b = appendInt16(b, r.Version)
+	b = appendInt32(b, r.CorrelationID)
+	b = appendString(b, r.ClientID)
+
+	if r.Version >= 3 {
+		b = appendInt16(b, -1) // no transactional ID
+	}
+	b = appendInt16(b, r.RequiredAcks)
+	b = appendInt32(b, int32(r.Timeout/time.Millisecond))
+	b = appendInt32(b, int32(len(r.Topics)))
 	for _, t := range r.Topics {
-		enc.EncodeString(t.Name)
-		enc.EncodeArrayLen(len(t.Partitions))
+		b = appendString(b, t.Name)
+		b = appendInt32(b, int32(len(t.Partitions)))
 		for _, p := range t.Partitions {
-			enc.EncodeInt32(p.ID)
-			i := len(buf)
-			enc.EncodeInt32(0) // placeholder
-			n, err := writeMessageSet(&buf, p.Messages, r.Compression)
+			b = appendInt32(b, p.ID)
+			i := len(b)
+			b = appendInt32(b, 0) // placeholder
+			var err error
+			if r.Version >= 3 {
+				b, err = appendRecordBatch(b, p.Messages, r.Compression, r.CompressionLevel, r.SnappyFraming)
+			} else {
+				b, err = appendMessageSet(b, p.Messages, r.Compression, r.CompressionLevel, r.SnappyFraming)
+			}
 			if err != nil {
-				return nil, err
+				return b[:start], err
 			}
-			binary.BigEndian.PutUint32(buf[i:i+4], uint32(n))
+			binary.BigEndian.PutUint32(b[i:], uint32(len(b)-i-4))
 		}
 	}
 
-	if enc.Err() != nil {
-		return nil, enc.Err()
-	}
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b, nil
+}
 
-	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
-	return []byte(buf), nil
+// sizeHint returns the size of the request if its messages are not
+// compressed, and of the request without them otherwise.
+func (r *ProduceReq) sizeHint() int {
+	size := 4 + 2 + 2 + 4 + 2 + len(r.ClientID) + 2 + 4 + 4
+	for _, t := range r.Topics {
+		size += 2 + len(t.Name) + 4
+		for _, p := range t.Partitions {
+			size += 4 + 4
+			if r.Compression != CompressionNone {
+				continue
+			}
+			for _, m := range p.Messages {
+				size += 8 + 4 + 4 + 1 + 1 + 4 + len(m.Key) + 4 + len(m.Value)
+				if m.Format == 1 {
+					size += 8
+				}
+			}
+		}
+	}
+	return size
 }
 
+// WriteTo writes the request to w, encoding it into a reused buffer.
 func (r *ProduceReq) WriteTo(w io.Writer) (int64, error) {
-	b, err := r.Bytes()
+	buf := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(buf)
+	b, err := r.AppendTo((*buf)[:0])
+	*buf = b
 	if err != nil {
 		return 0, err
 	}
@@ -1237,8 +2912,14 @@ func (r *ProduceReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type ProduceResp struct {
+	// Version of the request this is a response to. It is not part of the
+	// encoded response, but determines which fields are present.
+	Version       int16
 	CorrelationID int32
 	Topics        []ProduceRespTopic
+	// ThrottleTime is the time the request was delayed by a quota. Only
+	// returned by version 1 and later.
+	ThrottleTime time.Duration
 }
 
 type ProduceRespTopic struct {
@@ -1250,6 +2931,30 @@ type ProduceRespPartition struct {
 	ID     int32
 	Err    error
 	Offset int64
+	// LogAppendTime is the time the broker appended the messages, if the topic
+	// uses log append time for its timestamps, zero otherwise. Only returned
+	// by version 2 and later.
+	LogAppendTime time.Time
+	// LogStartOffset is the offset of the first message the partition
+	// still has. Only returned by version 5 and later.
+	LogStartOffset int64
+}
+
+// encodeTimestamp converts t to milliseconds since the epoch as used by the
+// protocol, with -1 standing for no timestamp.
+func encodeTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// decodeTimestamp is the inverse of encodeTimestamp.
+func decodeTimestamp(ms int64) time.Time {
+	if ms < 0 {
+		return time.Time{}
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
 }
 
 func (r *ProduceResp) Bytes() ([]byte, error) {
@@ -1267,8 +2972,17 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.Offset)
+			if r.Version >= 2 {
+				enc.Encode(encodeTimestamp(part.LogAppendTime))
+			}
+			if r.Version >= 5 {
+				enc.Encode(part.LogStartOffset)
+			}
 		}
 	}
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1282,7 +2996,13 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 }
 
 func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
-	var resp ProduceResp
+	return ReadVersionedProduceResp(r, 0)
+}
+
+// ReadVersionedProduceResp reads a response to a produce request of the given
+// version.
+func ReadVersionedProduceResp(r io.Reader, version int16) (*ProduceResp, error) {
+	resp := ProduceResp{Version: version}
 	dec := NewDecoder(r)
 
 	// total message size
@@ -1298,8 +3018,18 @@ func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
 			p.ID = dec.DecodeInt32()
 			p.Err = errFromNo(dec.DecodeInt16())
 			p.Offset = dec.DecodeInt64()
+			if version >= 2 {
+				p.LogAppendTime = decodeTimestamp(dec.DecodeInt64())
+			}
+			if version >= 5 {
+				p.LogStartOffset = dec.DecodeInt64()
+			}
 		}
 	}
+	if version >= 1 {
+		// some brokers leave out the throttle time, treat that as no throttling
+		resp.ThrottleTime = time.Duration(dec.DecodeOptionalInt32()) * time.Millisecond
+	}
 
 	if err := dec.Err(); err != nil {
 		return nil, err
@@ -2,11 +2,13 @@ package proto
 
 import (
 	"bytes"
+	"compress/gzip"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"reflect"
 	"runtime"
-	"strconv"
-	"strings"
 	"testing"
 	"time"
 
@@ -28,6 +30,12 @@ var _ TestRequest = &MetadataReq{}
 var _ TestRequest = &ProduceReq{}
 var _ TestRequest = &FetchReq{}
 var _ TestRequest = &GroupCoordinatorReq{}
+var _ TestRequest = &JoinGroupReq{}
+var _ TestRequest = &HeartbeatReq{}
+var _ TestRequest = &LeaveGroupReq{}
+var _ TestRequest = &SyncGroupReq{}
+var _ TestRequest = &SASLHandshakeReq{}
+var _ TestRequest = &SASLAuthenticateReq{}
 var _ TestRequest = &OffsetReq{}
 var _ TestRequest = &OffsetCommitReq{}
 var _ TestRequest = &OffsetFetchReq{}
@@ -81,6 +89,78 @@ func (s *MessagesSuite) TestMetadataRequest(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestReadReqLimited(c *C) {
+	req := &MetadataReq{CorrelationID: 123, ClientID: "testcli"}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+
+	kind, raw, err := ReadReqLimited(bytes.NewReader(b), int32(len(b)-4))
+	c.Assert(err, IsNil)
+	c.Assert(kind, Equals, int16(MetadataReqKind))
+	c.Assert(raw, DeepEquals, b)
+
+	_, _, err = ReadReqLimited(bytes.NewReader(b), int32(len(b)-5))
+	c.Assert(err, Equals, ErrMessageSizeTooLarge)
+
+	// a corrupt size prefix is rejected before anything is allocated
+	_, _, err = ReadReq(bytes.NewReader([]byte{0x7f, 0xff, 0xff, 0xff, 0x0, 0x3}))
+	c.Assert(err, Equals, ErrMessageSizeTooLarge)
+	_, _, err = ReadReq(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x0, 0x3}))
+	c.Assert(err, Equals, ErrInvalidMessageSize)
+}
+
+func (s *MessagesSuite) TestReadGarbage(c *C) {
+	readers := []interface{}{
+		ReadMetadataReq, ReadMetadataResp,
+		ReadFetchReq, ReadFetchResp,
+		ReadProduceReq, ReadProduceResp,
+		ReadOffsetReq, ReadOffsetResp,
+		ReadOffsetCommitReq, ReadOffsetCommitResp,
+		ReadOffsetFetchReq, ReadOffsetFetchResp,
+		ReadGroupCoordinatorReq, ReadGroupCoordinatorResp,
+		ReadJoinGroupReq, ReadJoinGroupResp,
+		ReadSyncGroupReq, ReadSyncGroupResp,
+		ReadHeartbeatReq, ReadHeartbeatResp,
+		ReadLeaveGroupReq, ReadLeaveGroupResp,
+		ReadAPIVersionsReq, ReadAPIVersionsResp,
+	}
+	read := func(b []byte) {
+		_, _, _ = ReadReq(bytes.NewReader(b))
+		_, _, _ = ReadResp(bytes.NewReader(b))
+		for _, fn := range readers {
+			reflect.ValueOf(fn).Call([]reflect.Value{reflect.ValueOf(bytes.NewReader(b))})
+		}
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		b := make([]byte, rng.Intn(256))
+		rng.Read(b)
+		read(b)
+	}
+
+	// every length field claims the most data it can
+	for _, fill := range []byte{0x7f, 0xff} {
+		read(bytes.Repeat([]byte{fill}, 128))
+	}
+	for _, prefix := range [][]byte{
+		{0x7f, 0xff, 0xff, 0xff},
+		{0x80, 0x0, 0x0, 0x0},
+		{0x6, 0x3f, 0xff, 0xff},
+		{0xff, 0xff, 0xff, 0xfe},
+	} {
+		read(append(prefix, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1))
+	}
+
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+		c.Fatalf("reading garbage allocated %d bytes", alloc)
+	}
+}
+
 func (s *MessagesSuite) TestMetadataResponse(c *C) {
 	msgb := []byte{0x0, 0x0, 0x1, 0xc7, 0x0, 0x0, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0xc0, 0x10, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x12, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x11, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x6, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12}
 	resp, err := ReadMetadataResp(bytes.NewBuffer(msgb))
@@ -132,11 +212,6 @@ func (s *MessagesSuite) TestMetadataResponse(c *C) {
 	}
 }
 
-func getGoMinorVersion() string {
-	min := strings.Split(runtime.Version(), ".")[1]
-	return strings.Split(min, "beta")[0]
-}
-
 func (s *MessagesSuite) TestProduceRequest(c *C) {
 	req := &ProduceReq{
 		CorrelationID: 241,
@@ -163,29 +238,27 @@ func (s *MessagesSuite) TestProduceRequest(c *C) {
 		},
 	}
 
-	var gzipBytes []byte
-	if v, err := strconv.Atoi(getGoMinorVersion()); err != nil {
-		c.Fatalf("failed to parse golang version: %s", err)
-	} else if v < 8 {
-		gzipBytes = []byte{0x0, 0x0, 0x0, 0x6d, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0x0, 0x0, 0x3, 0xe8, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x44, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x38, 0x9d, 0x81, 0x74, 0xc4, 0x0, 0x1, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x2a, 0x1f, 0x8b, 0x8, 0x0, 0x0, 0x9, 0x6e, 0x88, 0x0, 0xff, 0x62, 0x40, 0x0, 0x91, 0x1d, 0xbb, 0xe2, 0xc3, 0xc1, 0x2c, 0xe6, 0xb4, 0xfc, 0x7c, 0x10, 0x95, 0x94, 0x58, 0x4, 0x8, 0x0, 0x0, 0xff, 0xff, 0xa0, 0xbc, 0x10, 0xc2, 0x20, 0x0, 0x0, 0x0}
-	} else {
-		gzipBytes = []byte{0x0, 0x0, 0x0, 0x6d, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0x0, 0x0, 0x3, 0xe8, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x44, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x38, 0x8a, 0xa7, 0x46, 0xe2, 0x0, 0x1, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x2a, 0x1f, 0x8b, 0x8, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xff, 0x62, 0x40, 0x0, 0x91, 0x1d, 0xbb, 0xe2, 0xc3, 0xc1, 0x2c, 0xe6, 0xb4, 0xfc, 0x7c, 0x10, 0x95, 0x94, 0x58, 0x4, 0x8, 0x0, 0x0, 0xff, 0xff, 0xa0, 0xbc, 0x10, 0xc2, 0x20, 0x0, 0x0, 0x0}
-	}
+	// Gzip output depends on the compress/flate version, so the request
+	// only has to decode from the gzip fixture, not encode to it.
 	tests := []struct {
 		Compression Compression
 		Expected    []byte
+		Stable      bool
 	}{
 		{
 			CompressionNone,
 			[]byte{0x0, 0x0, 0x0, 0x49, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0x0, 0x0, 0x3, 0xe8, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x20, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72},
+			true,
 		},
 		{
 			CompressionGzip,
-			gzipBytes,
+			[]byte{0x0, 0x0, 0x0, 0x6d, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0x0, 0x0, 0x3, 0xe8, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x44, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x38, 0x8a, 0xa7, 0x46, 0xe2, 0x0, 0x1, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x2a, 0x1f, 0x8b, 0x8, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xff, 0x62, 0x40, 0x0, 0x91, 0x1d, 0xbb, 0xe2, 0xc3, 0xc1, 0x2c, 0xe6, 0xb4, 0xfc, 0x7c, 0x10, 0x95, 0x94, 0x58, 0x4, 0x8, 0x0, 0x0, 0xff, 0xff, 0xa0, 0xbc, 0x10, 0xc2, 0x20, 0x0, 0x0, 0x0},
+			false,
 		},
 		{
 			CompressionSnappy,
 			[]byte{0x0, 0x0, 0x0, 0x5c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0x0, 0x0, 0x3, 0xe8, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x33, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x27, 0x2e, 0xd4, 0xed, 0xcd, 0x0, 0x2, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x19, 0x20, 0x0, 0x0, 0x19, 0x1, 0x10, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x5, 0xf, 0x28, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72},
+			true,
 		},
 	}
 
@@ -194,18 +267,49 @@ func (s *MessagesSuite) TestProduceRequest(c *C) {
 		testRequestSerialization(c, req)
 		b, _ := req.Bytes()
 
-		if !bytes.Equal(b, tt.Expected) {
+		if tt.Stable && !bytes.Equal(b, tt.Expected) {
 			c.Fatalf("expected different bytes representation: %#v != %#v", b, tt.Expected)
 		}
 
-		r, _ := ReadProduceReq(bytes.NewBuffer(tt.Expected))
-		req.Compression = CompressionNone // isn't set on deserialization
-		if !reflect.DeepEqual(r, req) {
-			c.Fatalf("malformed request: %#v", r)
+		for _, encoded := range [][]byte{b, tt.Expected} {
+			r, _ := ReadProduceReq(bytes.NewBuffer(encoded))
+			req.Compression = CompressionNone // isn't set on deserialization
+			if !reflect.DeepEqual(r, req) {
+				c.Fatalf("malformed request: %#v", r)
+			}
+			req.Compression = tt.Compression
 		}
 	}
 }
 
+func (s *MessagesSuite) TestProduceRequestCorruptMessage(c *C) {
+	req := &ProduceReq{
+		CorrelationID: 1,
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{{
+			Name: "foo",
+			Partitions: []ProduceReqPartition{{
+				ID:       0,
+				Messages: []*Message{{Value: []byte("corrupted")}, {Value: []byte("last")}},
+			}},
+		}},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	b[bytes.Index(b, []byte("corrupted"))] = 'C'
+
+	// the corrupt message is kept, along with the rest
+	got, err := ReadProduceReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	messages := got.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	c.Assert(string(messages[0].Value), Equals, "Corrupted")
+	c.Assert(messages[0].Crc, Not(Equals), ComputeCrc(messages[0], CompressionNone))
+	c.Assert(messages[1].Crc, Equals, ComputeCrc(messages[1], CompressionNone))
+}
+
 func (s *MessagesSuite) TestProduceResponse(c *C) {
 	msgb1 := []byte{0x0, 0x0, 0x0, 0x22, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x6, 0x66, 0x72, 0x75, 0x69, 0x74, 0x73, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x5d, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 	resp1, err := ReadProduceResp(bytes.NewBuffer(msgb1))
@@ -271,6 +375,112 @@ func (s *MessagesSuite) TestProduceResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestProduceResponseV2(c *C) {
+	msgb := []byte{0x0, 0x0, 0x0, 0x2b, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x5d, 0x3e, 0xf7, 0x98, 0x7b, 0x0, 0x0, 0x0, 0x14}
+	resp, err := ReadVersionedProduceResp(bytes.NewBuffer(msgb), 2)
+	c.Assert(err, IsNil)
+	expected := &ProduceResp{
+		Version:       2,
+		CorrelationID: 241,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{
+						ID:            0,
+						Offset:        1,
+						LogAppendTime: time.Unix(1500000000, 123*int64(time.Millisecond)),
+					},
+				},
+			},
+		},
+		ThrottleTime: 20 * time.Millisecond,
+	}
+	c.Assert(resp, DeepEquals, expected)
+
+	b, err := resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, msgb)
+
+	// version 1 has throttle time, but no log append time
+	resp.Version = 1
+	resp.Topics[0].Partitions[0].LogAppendTime = time.Time{}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	resp1, err := ReadVersionedProduceResp(bytes.NewBuffer(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(resp1, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestProduceResponseMissingThrottleTime(c *C) {
+	// version 2 response without the trailing throttle time
+	msgb := []byte{0x0, 0x0, 0x0, 0x27, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x5d, 0x3e, 0xf7, 0x98, 0x7b}
+	resp, err := ReadVersionedProduceResp(bytes.NewBuffer(msgb), 2)
+	c.Assert(err, IsNil)
+	c.Assert(resp.ThrottleTime, Equals, time.Duration(0))
+	c.Assert(resp.Topics[0].Partitions[0].Offset, Equals, int64(1))
+	c.Assert(resp.Topics[0].Partitions[0].LogAppendTime,
+		DeepEquals, time.Unix(1500000000, 123*int64(time.Millisecond)))
+
+	// a partially present field is still an error
+	_, err = ReadVersionedProduceResp(bytes.NewBuffer(append(msgb, 0x0, 0x0)), 2)
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+
+	// fields other than the trailing one are not optional
+	_, err = ReadVersionedProduceResp(bytes.NewBuffer(msgb[:len(msgb)-8]), 2)
+	c.Assert(err, NotNil)
+}
+
+func (s *MessagesSuite) TestProduceVersion7(c *C) {
+	req := &ProduceReq{
+		Version:       7,
+		CorrelationID: 241,
+		ClientID:      "test",
+		Compression:   CompressionZstd,
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{ID: 0, Messages: []*Message{{Value: []byte("foo")}, {Value: []byte("bar")}}},
+				},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadProduceReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(got.Version, Equals, int16(7))
+	messages := got.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	c.Assert(string(messages[0].Value), Equals, "foo")
+	c.Assert(string(messages[1].Value), Equals, "bar")
+
+	// the broker's response has the log start offset from version 5 on
+	resp := &ProduceResp{
+		Version:       7,
+		CorrelationID: 241,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Offset: 12, LogStartOffset: 3},
+				},
+			},
+		},
+		ThrottleTime: 20 * time.Millisecond,
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b[len(b)-12:], DeepEquals, []byte{0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0x14})
+	gotResp, err := ReadVersionedProduceResp(bytes.NewReader(b), 7)
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+}
+
 func (s *MessagesSuite) TestFetchRequest(c *C) {
 	req := &FetchReq{
 		CorrelationID: 241,
@@ -405,7 +615,7 @@ func (s *MessagesSuite) TestFetchResponse(c *C) {
 func (s *MessagesSuite) TestSerializeEmptyMessageSet(c *C) {
 	var buf bytes.Buffer
 	messages := []*Message{}
-	n, err := writeMessageSet(&buf, messages, CompressionNone)
+	n, err := writeMessageSet(&buf, messages, CompressionNone, false)
 	if err != nil {
 		c.Fatalf("cannot serialize messages: %s", err)
 	}
@@ -417,13 +627,801 @@ func (s *MessagesSuite) TestSerializeEmptyMessageSet(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestOffsetCommitReqGeneration(c *C) {
+	for _, tc := range []struct {
+		req        OffsetCommitReq
+		generation int32
+	}{
+		{req: OffsetCommitReq{GenerationID: 7}, generation: -1},
+		{req: OffsetCommitReq{GenerationID: 7, MemberID: "member-1"}, generation: 7},
+	} {
+		tc.req.ConsumerGroup = "group"
+		tc.req.Topics = []OffsetCommitReqTopic{
+			{Name: "test", Partitions: []OffsetCommitReqPartition{{ID: 1, Offset: 10}}},
+		}
+		b, err := tc.req.Bytes()
+		c.Assert(err, IsNil)
+
+		req, err := ReadOffsetCommitReq(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(req.GenerationID, Equals, tc.generation)
+		c.Assert(req.MemberID, Equals, tc.req.MemberID)
+		c.Assert(req.Topics[0].Partitions[0].Offset, Equals, int64(10))
+	}
+}
+
+func (s *MessagesSuite) TestFetchVersion2(c *C) {
+	req := &FetchReq{
+		Version:       2,
+		CorrelationID: 5,
+		ClientID:      "c",
+		MaxWaitTime:   100 * time.Millisecond,
+		MinBytes:      1,
+		Topics: []FetchReqTopic{
+			{Name: "t", Partitions: []FetchReqPartition{{ID: 0, FetchOffset: 7, MaxBytes: 1024}}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x32, // size
+		0x0, 0x1, 0x0, 0x2, // fetch, version 2
+		0x0, 0x0, 0x0, 0x5, 0x0, 0x1, 0x63, // correlation ID, client ID
+		0xff, 0xff, 0xff, 0xff, // replica ID
+		0x0, 0x0, 0x0, 0x64, 0x0, 0x0, 0x0, 0x1, // max wait time, min bytes
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x74, // topics
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, // partitions
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x7, 0x0, 0x0, 0x4, 0x0, // offset, max bytes
+	})
+	gotReq, err := ReadFetchReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotReq, DeepEquals, req)
+
+	raw := []byte{
+		0x0, 0x0, 0x0, 0x25, // size
+		0x0, 0x0, 0x0, 0x5, // correlation ID
+		0x0, 0x0, 0x0, 0xfa, // throttle time
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x74, // topics
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // partitions, no error
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x7, // high water mark
+		0x0, 0x0, 0x0, 0x0, // empty message set
+	}
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(raw), 2, nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Version, Equals, int16(2))
+	c.Assert(resp.CorrelationID, Equals, int32(5))
+	c.Assert(resp.ThrottleTime, Equals, 250*time.Millisecond)
+	c.Assert(resp.Topics, HasLen, 1)
+	c.Assert(resp.Topics[0].Name, Equals, "t")
+	c.Assert(resp.Topics[0].Partitions, HasLen, 1)
+	c.Assert(resp.Topics[0].Partitions[0].TipOffset, Equals, int64(7))
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 0)
+
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, raw)
+}
+
+func (s *MessagesSuite) TestFetchAbortedTransactions(c *C) {
+	req := &FetchReq{
+		Version:        4,
+		CorrelationID:  5,
+		ClientID:       "c",
+		MaxWaitTime:    100 * time.Millisecond,
+		MinBytes:       1,
+		IsolationLevel: ReadCommitted,
+		Topics: []FetchReqTopic{
+			{Name: "t", Partitions: []FetchReqPartition{{ID: 0, FetchOffset: 7, MaxBytes: 1024}}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b[31], Equals, byte(1)) // isolation level
+	gotReq, err := ReadFetchReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotReq.IsolationLevel, Equals, ReadCommitted)
+
+	resp := &FetchResp{
+		Version:       4,
+		CorrelationID: 5,
+		Topics: []FetchRespTopic{
+			{
+				Name: "t",
+				Partitions: []FetchRespPartition{
+					{
+						ID:               0,
+						TipOffset:        9,
+						LastStableOffset: 8,
+						AbortedTransactions: []AbortedTransaction{
+							{ProducerID: 3, FirstOffset: 4},
+							{ProducerID: 5, FirstOffset: 6},
+						},
+						Messages: []*Message{},
+					},
+					{ID: 1, TipOffset: 2, LastStableOffset: 2, Messages: []*Message{}},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadVersionedFetchResp(bytes.NewReader(b), 4, nil)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestFetchVersion10(c *C) {
+	req := &FetchReq{
+		Version:       10,
+		CorrelationID: 5,
+		ClientID:      "c",
+		MaxWaitTime:   100 * time.Millisecond,
+		MinBytes:      1,
+		Topics: []FetchReqTopic{
+			{Name: "t", Partitions: []FetchReqPartition{{ID: 0, FetchOffset: 7, MaxBytes: 1024}}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x4f, // size
+		0x0, 0x1, 0x0, 0xa, 0x0, 0x0, 0x0, 0x5, 0x0, 0x1, 0x63,
+		0xff, 0xff, 0xff, 0xff, // replica id
+		0x0, 0x0, 0x0, 0x64, 0x0, 0x0, 0x0, 0x1, 0x7f, 0xff, 0xff, 0xff,
+		0x0,                // isolation level
+		0x0, 0x0, 0x0, 0x0, // session id
+		0xff, 0xff, 0xff, 0xff, // session epoch
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x74, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0,
+		0xff, 0xff, 0xff, 0xff, // current leader epoch
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x7,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // log start offset
+		0x0, 0x0, 0x4, 0x0,
+		0x0, 0x0, 0x0, 0x0, // forgotten topics
+	})
+	gotReq, err := ReadFetchReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotReq, DeepEquals, &FetchReq{
+		Version:       10,
+		CorrelationID: 5,
+		ClientID:      "c",
+		MaxWaitTime:   100 * time.Millisecond,
+		MinBytes:      1,
+		MaxBytes:      math.MaxInt32,
+		Topics:        req.Topics,
+	})
+
+	batch := &RecordBatchInfo{BaseOffset: 7, LastOffsetDelta: 1, ProducerID: -1, ProducerEpoch: -1}
+	resp := &FetchResp{
+		Version:       10,
+		CorrelationID: 5,
+		Compression:   CompressionZstd,
+		Topics: []FetchRespTopic{
+			{
+				Name: "t",
+				Partitions: []FetchRespPartition{
+					{
+						ID:               0,
+						TipOffset:        9,
+						LastStableOffset: 9,
+						LogStartOffset:   3,
+						Messages: []*Message{
+							{Offset: 7, Value: []byte("foo"), Format: 2, Batch: batch},
+							{Offset: 8, Value: []byte("bar"), Format: 2, Batch: batch},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadVersionedFetchResp(bytes.NewReader(b), 10, nil)
+	c.Assert(err, IsNil)
+	for _, msg := range resp.Topics[0].Partitions[0].Messages {
+		msg.Topic = "t"
+		msg.TipOffset = 9
+		msg.Crc = got.Topics[0].Partitions[0].Messages[0].Crc
+	}
+	resp.Compression = CompressionNone
+	c.Assert(got, DeepEquals, resp)
+
+	// an error of the whole request
+	resp = &FetchResp{Version: 7, CorrelationID: 5, Err: ErrUnknown, Topics: []FetchRespTopic{}}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	got, err = ReadVersionedFetchResp(bytes.NewReader(b), 7, nil)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestOffsetCommitVersion2(c *C) {
+	req := &OffsetCommitReq{
+		Version:       2,
+		CorrelationID: 5,
+		ClientID:      "c",
+		ConsumerGroup: "g",
+		GenerationID:  3,
+		MemberID:      "m",
+		RetentionTime: time.Hour,
+		Topics: []OffsetCommitReqTopic{
+			{Name: "t", Partitions: []OffsetCommitReqPartition{{ID: 0, Offset: 7}}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x36, // size
+		0x0, 0x8, 0x0, 0x2, // offset commit, version 2
+		0x0, 0x0, 0x0, 0x5, 0x0, 0x1, 0x63, // correlation ID, client ID
+		0x0, 0x1, 0x67, 0x0, 0x0, 0x0, 0x3, 0x0, 0x1, 0x6d, // group, generation, member
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x36, 0xee, 0x80, // retention time
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x74, // topics
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, // partitions
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x7, 0x0, 0x0, // offset, metadata
+	})
+	got, err := ReadOffsetCommitReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, req)
+
+	// without a retention time the broker's default is used
+	req.RetentionTime = 0
+	b, err = req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b[25:33], DeepEquals, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	got, err = ReadOffsetCommitReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, req)
+}
+
+func (s *MessagesSuite) TestMetadataVersion1(c *C) {
+	req := &MetadataReq{Version: 1, CorrelationID: 5, ClientID: "c"}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0xf, 0x0, 0x3, 0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x0, 0x1, 0x63,
+		0xff, 0xff, 0xff, 0xff, // all topics
+	})
+
+	resp := &MetadataResp{
+		Version:       1,
+		CorrelationID: 5,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 1, Host: "a", Port: 9092, Rack: "r1"},
+			{NodeID: 2, Host: "b", Port: 9092},
+		},
+		ControllerID: 2,
+		Topics: []MetadataRespTopic{
+			{
+				Name:       "__consumer_offsets",
+				IsInternal: true,
+				Partitions: []MetadataRespPartition{
+					{ID: 0, Leader: 2, Replicas: []int32{2, 1}, Isrs: []int32{2}},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b[8:27], DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x2, // brokers
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x61, 0x0, 0x0, 0x23, 0x84, 0x0, 0x2, 0x72, 0x31, // rack "r1"
+	})
+	c.Assert(b[38:44], DeepEquals, []byte{0xff, 0xff, 0x0, 0x0, 0x0, 0x2}) // null rack, controller
+	got, err := ReadVersionedMetadataResp(bytes.NewReader(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestSASLHandshake(c *C) {
+	req := &SASLHandshakeReq{CorrelationID: 3, ClientID: "c", Mechanism: "PLAIN"}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x12, 0x0, 0x11, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x1, 0x63,
+		0x0, 0x5, 0x50, 0x4c, 0x41, 0x49, 0x4e,
+	})
+	gotReq, err := ReadSASLHandshakeReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotReq, DeepEquals, req)
+
+	resp := &SASLHandshakeResp{CorrelationID: 3, EnabledMechanisms: []string{"PLAIN"}}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x5, 0x50, 0x4c, 0x41, 0x49, 0x4e,
+	})
+	gotResp, err := ReadSASLHandshakeResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+
+	resp = &SASLHandshakeResp{CorrelationID: 3, Err: ErrUnsupportedSASLMechanism, EnabledMechanisms: []string{"GSSAPI"}}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	gotResp, err = ReadSASLHandshakeResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestSASLAuthenticate(c *C) {
+	handshake := &SASLHandshakeReq{Version: 1, CorrelationID: 3, Mechanism: "PLAIN"}
+	b, err := handshake.Bytes()
+	c.Assert(err, IsNil)
+	gotHandshake, err := ReadSASLHandshakeReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotHandshake, DeepEquals, handshake)
+
+	req := &SASLAuthenticateReq{CorrelationID: 4, ClientID: "c", AuthBytes: []byte("\x00alice\x00secret")}
+	testRequestSerialization(c, req)
+	b, err = req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b[4:8], DeepEquals, []byte{0x0, 0x24, 0x0, 0x0})
+	gotReq, err := ReadSASLAuthenticateReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotReq, DeepEquals, req)
+
+	resp := &SASLAuthenticateResp{CorrelationID: 4}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0xc, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0,
+	})
+	gotResp, err := ReadSASLAuthenticateResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+
+	resp = &SASLAuthenticateResp{CorrelationID: 4, Err: ErrSASLAuthenticationFailed, ErrMessage: "invalid credentials"}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	gotResp, err = ReadSASLAuthenticateResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestGroupMemberMetadata(c *C) {
+	meta := &GroupMemberMetadata{Version: 0, Topics: []string{"foo", "bar"}}
+	b, err := meta.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, // version
+		0x0, 0x0, 0x0, 0x2, // topics
+		0x0, 0x3, 'f', 'o', 'o',
+		0x0, 0x3, 'b', 'a', 'r',
+		0xff, 0xff, 0xff, 0xff, // user data
+	})
+	got, err := ReadGroupMemberMetadata(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, meta)
+
+	assignment := &GroupMemberAssignment{
+		Version: 0,
+		Topics: []GroupMemberAssignmentTopic{
+			{Name: "foo", Partitions: []int32{0, 2}},
+		},
+	}
+	b, err = assignment.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, // version
+		0x0, 0x0, 0x0, 0x1, // topics
+		0x0, 0x3, 'f', 'o', 'o',
+		0x0, 0x0, 0x0, 0x2, // partitions
+		0x0, 0x0, 0x0, 0x0,
+		0x0, 0x0, 0x0, 0x2,
+		0xff, 0xff, 0xff, 0xff, // user data
+	})
+	gotAssignment, err := ReadGroupMemberAssignment(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotAssignment, DeepEquals, assignment)
+
+	// members that are assigned nothing may get no assignment at all
+	gotAssignment, err = ReadGroupMemberAssignment(bytes.NewReader(nil))
+	c.Assert(err, IsNil)
+	c.Assert(gotAssignment.Topics, HasLen, 0)
+}
+
+func (s *MessagesSuite) TestAPIVersions(c *C) {
+	req := &APIVersionsReq{CorrelationID: 3, ClientID: "tester"}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x10, 0x0, 0x12, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3,
+		0x0, 0x6, 0x74, 0x65, 0x73, 0x74, 0x65, 0x72,
+	})
+	got, err := ReadAPIVersionsReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, req)
+
+	resp := &APIVersionsResp{CorrelationID: 3, APIVersions: SupportedAPIVersions}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b[:14], DeepEquals, []byte{
+		0x0, 0x0, 0x0, byte(len(b) - 4), 0x0, 0x0, 0x0, 0x3, 0x0, 0x0,
+		0x0, 0x0, 0x0, byte(len(SupportedAPIVersions)),
+	})
+	gotResp, err := ReadAPIVersionsResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+
+	// correlation ID, error code and an array of api key, min and max
+	// version, as in the protocol spec
+	resp = &APIVersionsResp{CorrelationID: 5, APIVersions: []APIVersion{
+		{APIKey: ProduceReqKind, MinVersion: 0, MaxVersion: 2},
+		{APIKey: APIVersionsReqKind, MinVersion: 0, MaxVersion: 0},
+	}}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x16, 0x0, 0x0, 0x0, 0x5, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2,
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x2,
+		0x0, 0x12, 0x0, 0x0, 0x0, 0x0,
+	})
+	gotResp, err = ReadAPIVersionsResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+
+	resp = &APIVersionsResp{CorrelationID: 4, Err: ErrUnsupportedVersion}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	gotResp, err = ReadAPIVersionsResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestJoinGroup(c *C) {
+	req := &JoinGroupReq{
+		CorrelationID:  1,
+		ClientID:       "cli",
+		ConsumerGroup:  "grp",
+		SessionTimeout: 30 * time.Second,
+		ProtocolType:   "consumer",
+		GroupProtocols: []GroupProtocol{
+			{Name: "range", Metadata: []byte{0x1, 0x2}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x33, 0x0, 0xb, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
+		0x0, 0x3, 0x63, 0x6c, 0x69, // client id
+		0x0, 0x3, 0x67, 0x72, 0x70, // group id
+		0x0, 0x0, 0x75, 0x30, // session timeout in milliseconds
+		0x0, 0x0, // empty member id
+		0x0, 0x8, 0x63, 0x6f, 0x6e, 0x73, 0x75, 0x6d, 0x65, 0x72,
+		0x0, 0x0, 0x0, 0x1,
+		0x0, 0x5, 0x72, 0x61, 0x6e, 0x67, 0x65,
+		0x0, 0x0, 0x0, 0x2, 0x1, 0x2,
+	})
+	got, err := ReadJoinGroupReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, req)
+
+	resp := &JoinGroupResp{
+		CorrelationID: 1,
+		GenerationID:  2,
+		GroupProtocol: "range",
+		LeaderID:      "m1",
+		MemberID:      "m1",
+		Members: []GroupMember{
+			{MemberID: "m1", Metadata: []byte{0x1, 0x2}},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x27, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0,
+		0x0, 0x0, 0x0, 0x2,
+		0x0, 0x5, 0x72, 0x61, 0x6e, 0x67, 0x65,
+		0x0, 0x2, 0x6d, 0x31, // leader id
+		0x0, 0x2, 0x6d, 0x31, // member id
+		0x0, 0x0, 0x0, 0x1,
+		0x0, 0x2, 0x6d, 0x31, 0x0, 0x0, 0x0, 0x2, 0x1, 0x2,
+	})
+	gotResp, err := ReadJoinGroupResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+
+	// followers get no member list
+	resp = &JoinGroupResp{CorrelationID: 2, Err: ErrInvalidSessionTimeout}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	gotResp, err = ReadJoinGroupResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestSyncGroup(c *C) {
+	req := &SyncGroupReq{
+		CorrelationID: 1,
+		ClientID:      "cli",
+		ConsumerGroup: "grp",
+		GenerationID:  2,
+		MemberID:      "m1",
+		GroupAssignments: []GroupAssignment{
+			{MemberID: "m1", Assignment: []byte{0x3}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x27, 0x0, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
+		0x0, 0x3, 0x63, 0x6c, 0x69,
+		0x0, 0x3, 0x67, 0x72, 0x70,
+		0x0, 0x0, 0x0, 0x2,
+		0x0, 0x2, 0x6d, 0x31,
+		0x0, 0x0, 0x0, 0x1,
+		0x0, 0x2, 0x6d, 0x31, 0x0, 0x0, 0x0, 0x1, 0x3,
+	})
+	got, err := ReadSyncGroupReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, req)
+
+	resp := &SyncGroupResp{CorrelationID: 1, MemberAssignment: []byte{0x3}}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0xb, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0,
+		0x0, 0x0, 0x0, 0x1, 0x3,
+	})
+	gotResp, err := ReadSyncGroupResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestHeartbeatAndLeaveGroup(c *C) {
+	hreq := &HeartbeatReq{
+		CorrelationID: 1,
+		ClientID:      "cli",
+		ConsumerGroup: "grp",
+		GenerationID:  2,
+		MemberID:      "m1",
+	}
+	testRequestSerialization(c, hreq)
+	b, err := hreq.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x1a, 0x0, 0xc, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
+		0x0, 0x3, 0x63, 0x6c, 0x69,
+		0x0, 0x3, 0x67, 0x72, 0x70,
+		0x0, 0x0, 0x0, 0x2,
+		0x0, 0x2, 0x6d, 0x31,
+	})
+	gotHreq, err := ReadHeartbeatReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotHreq, DeepEquals, hreq)
+
+	hresp := &HeartbeatResp{CorrelationID: 1, Err: ErrIllegalGeneration}
+	b, err = hresp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0x0, 0x0, 0x0, 0x6, 0x0, 0x0, 0x0, 0x1, 0x0, 0x16})
+	gotHresp, err := ReadHeartbeatResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotHresp, DeepEquals, hresp)
+
+	lreq := &LeaveGroupReq{
+		CorrelationID: 1,
+		ClientID:      "cli",
+		ConsumerGroup: "grp",
+		MemberID:      "m1",
+	}
+	testRequestSerialization(c, lreq)
+	b, err = lreq.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x0, 0x0, 0x16, 0x0, 0xd, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1,
+		0x0, 0x3, 0x63, 0x6c, 0x69,
+		0x0, 0x3, 0x67, 0x72, 0x70,
+		0x0, 0x2, 0x6d, 0x31,
+	})
+	gotLreq, err := ReadLeaveGroupReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotLreq, DeepEquals, lreq)
+
+	lresp := &LeaveGroupResp{CorrelationID: 1}
+	b, err = lresp.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0x0, 0x0, 0x0, 0x6, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0})
+	gotLresp, err := ReadLeaveGroupResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(gotLresp, DeepEquals, lresp)
+}
+
+func (s *MessagesSuite) TestProduceRequestGzipLevel(c *C) {
+	value := bytes.Repeat([]byte("gzip level "), 100)
+	for _, level := range []int{0, gzip.BestSpeed, gzip.BestCompression} {
+		req := &ProduceReq{
+			CorrelationID:    1,
+			ClientID:         "tester",
+			Compression:      CompressionGzip,
+			CompressionLevel: level,
+			RequiredAcks:     RequiredAcksAll,
+			Timeout:          time.Second,
+			Topics: []ProduceReqTopic{
+				{
+					Name: "test",
+					Partitions: []ProduceReqPartition{
+						{ID: 0, Messages: []*Message{{Value: value}, {Value: value}}},
+					},
+				},
+			},
+		}
+		testRequestSerialization(c, req)
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		c.Assert(len(b) < len(value), Equals, true)
+
+		got, err := ReadProduceReq(bytes.NewReader(b))
+		c.Assert(err, IsNil)
+		messages := got.Topics[0].Partitions[0].Messages
+		c.Assert(messages, HasLen, 2)
+		c.Assert(messages[0].Value, DeepEquals, value)
+		c.Assert(messages[1].Value, DeepEquals, value)
+	}
+
+	req := &ProduceReq{
+		Compression:      CompressionGzip,
+		CompressionLevel: gzip.BestCompression + 1,
+		Topics: []ProduceReqTopic{
+			{Name: "test", Partitions: []ProduceReqPartition{{ID: 0, Messages: []*Message{{Value: value}}}}},
+		},
+	}
+	_, err := req.Bytes()
+	c.Assert(err, ErrorMatches, "invalid gzip compression level 10")
+}
+
+func (s *MessagesSuite) TestFetchResponseCompressed(c *C) {
+	for _, compression := range []Compression{CompressionGzip, CompressionSnappy, CompressionLZ4} {
+		resp := &FetchResp{
+			CorrelationID: 241,
+			Compression:   compression,
+			Topics: []FetchRespTopic{{
+				Name: "foo",
+				Partitions: []FetchRespPartition{{
+					ID:        0,
+					TipOffset: 4,
+					Messages: []*Message{
+						{Offset: 2, Key: []byte("foo"), Value: []byte("bar")},
+						{Offset: 3, Key: []byte("foo"), Value: []byte("baz")},
+					},
+				}},
+			}},
+		}
+		b, err := resp.Bytes()
+		c.Assert(err, IsNil)
+
+		// the messages are sent in a single wrapper message
+		c.Assert(b[56], Equals, byte(compression))
+
+		got, err := ReadFetchResp(bytes.NewReader(b))
+		c.Assert(err, IsNil)
+		c.Assert(got.CorrelationID, Equals, int32(241))
+		messages := got.Topics[0].Partitions[0].Messages
+		c.Assert(messages, HasLen, 2)
+		for i, msg := range messages {
+			c.Assert(msg.Offset, Equals, int64(2+i))
+			c.Assert(msg.Crc, Equals, ComputeCrc(msg, CompressionNone))
+			c.Assert(string(msg.Value), Equals, string(resp.Topics[0].Partitions[0].Messages[i].Value))
+		}
+	}
+}
+
+func (s *MessagesSuite) TestFetchRespMessageSetBoundary(c *C) {
+	var set0, set1 bytes.Buffer
+	_, err := writeMessageSet(&set0, []*Message{
+		{Value: []byte("111111111111111")},
+		{Value: []byte("222222222222222")},
+		{Value: []byte("333333333333333")},
+	}, CompressionNone, false)
+	c.Assert(err, IsNil)
+	_, err = writeMessageSet(&set1, []*Message{{Value: []byte("444")}}, CompressionNone, false)
+	c.Assert(err, IsNil)
+
+	// the first partition's message set ends with a partial message, or
+	// contains a corrupt one, and is followed by the second partition
+	truncated := set0.Bytes()[:set0.Len()-4]
+	corrupt := append([]byte(nil), set0.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	for _, tc := range []struct {
+		set   []byte
+		valid int
+		err   error
+	}{
+		{set: truncated, valid: 2},
+		{set: corrupt, valid: 1, err: ErrInvalidMessageCRC},
+	} {
+		var body bytes.Buffer
+		enc := NewEncoder(&body)
+		enc.EncodeInt32(1) // correlation ID
+		enc.EncodeArrayLen(1)
+		enc.EncodeString("test")
+		enc.EncodeArrayLen(2)
+		for id, set := range [][]byte{tc.set, set1.Bytes()} {
+			enc.EncodeInt32(int32(id))
+			enc.EncodeInt16(0)
+			enc.EncodeInt64(10)
+			enc.EncodeInt32(int32(len(set)))
+			_, _ = body.Write(set)
+		}
+		c.Assert(enc.Err(), IsNil)
+
+		var b bytes.Buffer
+		enc = NewEncoder(&b)
+		enc.EncodeInt32(int32(body.Len()))
+		_, _ = b.Write(body.Bytes())
+
+		resp, err := ReadFetchResp(&b)
+		c.Assert(err, IsNil)
+		parts := resp.Topics[0].Partitions
+		c.Assert(parts, HasLen, 2)
+		c.Assert(parts[0].Err, Equals, tc.err)
+		c.Assert(parts[0].Messages, HasLen, tc.valid)
+		c.Assert(string(parts[0].Messages[0].Value), Equals, "111111111111111")
+		c.Assert(parts[1].ID, Equals, int32(1))
+		c.Assert(parts[1].Messages, HasLen, 1)
+		c.Assert(string(parts[1].Messages[0].Value), Equals, "444")
+	}
+}
+
+func (s *MessagesSuite) TestReadInvalidMessageCRC(c *C) {
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{
+		{Offset: 0, Value: []byte("111111111111111")},
+		{Offset: 1, Value: []byte("222222222222222")},
+	}, CompressionNone, false)
+	c.Assert(err, IsNil)
+	_, err = writeMessageSet(&buf, []*Message{
+		{Offset: 2, Value: []byte("333333333333333")},
+	}, CompressionNone, false)
+	c.Assert(err, IsNil)
+	b := buf.Bytes()
+	b[bytes.Index(b, []byte("222"))] = 'X'
+
+	messages, err := readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, Equals, ErrInvalidMessageCRC)
+	c.Assert(messages, HasLen, 1)
+	c.Assert(string(messages[0].Value), Equals, "111111111111111")
+
+	messages, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcSkip)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 3)
+	c.Assert(string(messages[1].Value), Equals, "X22222222222222")
+
+	// a corrupt message within a compressed one, whose crc is intact
+	inner, err := appendMessage(nil, 0, &Message{Value: []byte("444444444444444")}, CompressionNone)
+	c.Assert(err, IsNil)
+	inner[len(inner)-1] = 'X'
+	b, err = appendMessage(nil, 3, &Message{Value: snappyEncode(inner, false)}, CompressionSnappy)
+	c.Assert(err, IsNil)
+	messages, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, Equals, ErrInvalidMessageCRC)
+	c.Assert(messages, HasLen, 0)
+
+	// record batches are checked against their own crc
+	b, err = appendRecordBatch(nil, []*Message{{Value: []byte("555555555555555")}}, CompressionNone, 0, false)
+	c.Assert(err, IsNil)
+	b[bytes.Index(b, []byte("555"))] = 'X'
+	_, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, Equals, ErrInvalidMessageCRC)
+	messages, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcSkip)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 1)
+	c.Assert(string(messages[0].Value), Equals, "X55555555555555")
+}
+
 func (s *MessagesSuite) TestReadIncompleteMessage(c *C) {
 	var buf bytes.Buffer
 	_, err := writeMessageSet(&buf, []*Message{
 		{Value: []byte("111111111111111")},
 		{Value: []byte("222222222222222")},
 		{Value: []byte("333333333333333")},
-	}, CompressionNone)
+	}, CompressionNone, false)
 	if err != nil {
 		c.Fatalf("cannot serialize messages: %s", err)
 	}
@@ -431,7 +1429,7 @@ func (s *MessagesSuite) TestReadIncompleteMessage(c *C) {
 	b := buf.Bytes()
 	// cut off the last bytes as kafka can do
 	b = b[:len(b)-4]
-	messages, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
+	messages, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)), nil, crcReject)
 	if err != nil {
 		c.Fatalf("cannot deserialize messages: %s", err)
 	}
@@ -443,6 +1441,227 @@ func (s *MessagesSuite) TestReadIncompleteMessage(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestReadIncompleteCompressedMessage(c *C) {
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{
+		{Offset: 0, Value: []byte("111111111111111")},
+	}, CompressionNone, false)
+	c.Assert(err, IsNil)
+	_, err = writeMessageSet(&buf, []*Message{
+		{Offset: 1, Value: []byte("222222222222222")},
+		{Offset: 2, Value: []byte("333333333333333")},
+	}, CompressionGzip, false)
+	c.Assert(err, IsNil)
+	b := buf.Bytes()
+
+	messages, err := readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 3)
+	for i, msg := range messages {
+		c.Assert(msg.Offset, Equals, int64(i))
+		c.Assert(msg.Value[0], Equals, byte('1'+i))
+	}
+
+	// the compressed message is cut off, as kafka can do
+	b = b[:len(b)-4]
+	messages, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 1)
+	c.Assert(string(messages[0].Value), Equals, "111111111111111")
+}
+
+func (s *MessagesSuite) TestReadUnsupportedCompression(c *C) {
+	b, err := appendMessage(nil, 0, &Message{Value: []byte("plain")}, CompressionNone)
+	c.Assert(err, IsNil)
+	b, err = appendMessage(b, 1, &Message{Value: []byte("not a message set")}, Compression(5))
+	c.Assert(err, IsNil)
+
+	_, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, ErrorMatches, "cannot handle compression method: 5")
+}
+
+func (s *MessagesSuite) TestMessageFormats(c *C) {
+	created := time.Unix(1500000000, 123*int64(time.Millisecond))
+	messages := []*Message{
+		{Offset: 3, Key: []byte("foo"), Value: []byte("bar")},
+		{Offset: 4, Value: []byte("stamped"), Format: 1, Timestamp: created},
+		{Offset: 5, Value: []byte("unstamped"), Format: 1},
+	}
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, messages, CompressionNone, false)
+	c.Assert(err, IsNil)
+
+	b := buf.Bytes()
+	got, err := readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(got, HasLen, 3)
+	for i, msg := range got {
+		c.Assert(msg.Offset, Equals, messages[i].Offset)
+		c.Assert(msg.Format, Equals, messages[i].Format)
+		c.Assert(msg.Timestamp.Equal(messages[i].Timestamp), Equals, true)
+		c.Assert(msg.TimestampType, Equals, TimestampCreateTime)
+		c.Assert(string(msg.Value), Equals, string(messages[i].Value))
+		c.Assert(msg.Crc, Equals, ComputeCrc(messages[i], CompressionNone))
+	}
+	c.Assert(ComputeCrc(messages[0], CompressionNone), Equals, uint32(0xb8ba5f57))
+
+	// formats can't be mixed in a compressed set
+	_, err = writeMessageSet(&buf, messages, CompressionGzip, false)
+	c.Assert(err, ErrorMatches, "cannot compress messages of different formats together")
+	_, err = writeMessageSet(&buf, []*Message{{Format: 2}}, CompressionNone, false)
+	c.Assert(err, ErrorMatches, "unsupported message format 2")
+}
+
+func (s *MessagesSuite) TestMessageFormat1Compressed(c *C) {
+	created := time.Unix(1500000000, 0)
+	resp := &FetchResp{
+		CorrelationID: 1,
+		Compression:   CompressionSnappy,
+		Topics: []FetchRespTopic{{
+			Name: "foo",
+			Partitions: []FetchRespPartition{{
+				ID:        0,
+				TipOffset: 13,
+				Messages: []*Message{
+					{Offset: 10, Value: []byte("first"), Format: 1, Timestamp: created},
+					{Offset: 11, Value: []byte("second"), Format: 1, Timestamp: created.Add(time.Second)},
+					{Offset: 12, Value: []byte("third"), Format: 1},
+				},
+			}},
+		}},
+	}
+	b, err := resp.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadFetchResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	messages := got.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 3)
+	for i, msg := range messages {
+		want := resp.Topics[0].Partitions[0].Messages[i]
+		c.Assert(msg.Offset, Equals, want.Offset)
+		c.Assert(msg.Format, Equals, int8(1))
+		c.Assert(msg.Timestamp.Equal(want.Timestamp), Equals, true)
+		c.Assert(string(msg.Value), Equals, string(want.Value))
+	}
+
+	// a wrapper with the log append time, as written by a broker
+	var inner bytes.Buffer
+	_, err = writeMessageSet(&inner, []*Message{
+		{Offset: 0, Value: []byte("first"), Format: 1, Timestamp: created},
+		{Offset: 1, Value: []byte("second"), Format: 1, Timestamp: created},
+	}, CompressionNone, false)
+	c.Assert(err, IsNil)
+	appended := created.Add(time.Minute)
+	wrapper := &Message{
+		Value:         snappyEncode(inner.Bytes(), false),
+		Format:        1,
+		Timestamp:     appended,
+		TimestampType: TimestampLogAppendTime,
+	}
+	var set bytes.Buffer
+	enc := NewEncoder(&set)
+	enc.EncodeInt64(21)
+	enc.EncodeInt32(int32(4 + 1 + 1 + 8 + 4 + 4 + len(wrapper.Value)))
+	enc.EncodeUint32(ComputeCrc(wrapper, CompressionSnappy))
+	_, err = set.Write(appendMessageContent(nil, wrapper, CompressionSnappy))
+	c.Assert(err, IsNil)
+	c.Assert(enc.Err(), IsNil)
+
+	messages, err = readMessageSet(bytes.NewReader(set.Bytes()), int32(set.Len()), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 2)
+	for i, msg := range messages {
+		c.Assert(msg.Offset, Equals, int64(20+i))
+		c.Assert(msg.Timestamp.Equal(appended), Equals, true)
+		c.Assert(msg.TimestampType, Equals, TimestampLogAppendTime)
+	}
+}
+
+func (s *MessagesSuite) TestCompressedRelativeOffsets(c *C) {
+	newMessages := func(format int8, offsets ...int64) []*Message {
+		var messages []*Message
+		for _, offset := range offsets {
+			messages = append(messages, &Message{Offset: offset, Value: []byte("msg"), Format: format})
+		}
+		return messages
+	}
+
+	// two wrappers in format 1, whose messages are written with offsets
+	// 0 to 2, which naive decoding would return twice
+	var set bytes.Buffer
+	_, err := writeMessageSet(&set, newMessages(1, 10, 11, 12), CompressionGzip, false)
+	c.Assert(err, IsNil)
+	_, err = writeMessageSet(&set, newMessages(1, 13, 14, 15), CompressionGzip, false)
+	c.Assert(err, IsNil)
+
+	// and a wrapper in format 0 with relative offsets
+	var inner bytes.Buffer
+	_, err = writeMessageSet(&inner, newMessages(0, 0, 1, 2), CompressionNone, false)
+	c.Assert(err, IsNil)
+	wrapper := &Message{Value: lz4Encode(inner.Bytes(), 0)}
+	enc := NewEncoder(&set)
+	enc.EncodeInt64(18)
+	enc.EncodeInt32(int32(4 + 1 + 1 + 4 + 4 + len(wrapper.Value)))
+	enc.EncodeUint32(ComputeCrc(wrapper, CompressionLZ4))
+	_, err = set.Write(appendMessageContent(nil, wrapper, CompressionLZ4))
+	c.Assert(err, IsNil)
+	c.Assert(enc.Err(), IsNil)
+
+	b := set.Bytes()
+	messages, err := readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 9)
+	for i, msg := range messages {
+		c.Assert(msg.Offset, Equals, int64(10+i))
+	}
+
+	// absolute offsets in format 0 are kept
+	set.Reset()
+	_, err = writeMessageSet(&set, newMessages(0, 7, 8, 9), CompressionSnappy, false)
+	c.Assert(err, IsNil)
+	b = set.Bytes()
+	messages, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 3)
+	for i, msg := range messages {
+		c.Assert(msg.Offset, Equals, int64(7+i))
+	}
+}
+
+func (s *MessagesSuite) TestProduceRequestFormat1(c *C) {
+	created := time.Unix(1500000000, 0)
+	req := &ProduceReq{
+		Version:       2,
+		CorrelationID: 1,
+		ClientID:      "test",
+		Compression:   CompressionGzip,
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{{
+			Name: "foo",
+			Partitions: []ProduceReqPartition{{
+				ID: 0,
+				Messages: []*Message{
+					{Value: []byte("first"), Format: 1, Timestamp: created},
+					{Value: []byte("second"), Format: 1, Timestamp: created},
+				},
+			}},
+		}},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadProduceReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	messages := got.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	for i, msg := range messages {
+		c.Assert(msg.Format, Equals, int8(1))
+		c.Assert(msg.Timestamp.Equal(created), Equals, true)
+		c.Assert(msg.Crc, Equals, ComputeCrc(msg, CompressionNone))
+		c.Assert(msg.Offset, Equals, int64(i))
+	}
+}
+
 func BenchmarkProduceRequestMarshal(b *testing.B) {
 	messages := make([]*Message, 100)
 	for i := range messages {
@@ -481,6 +1700,79 @@ func BenchmarkProduceRequestMarshal(b *testing.B) {
 	}
 }
 
+func benchmarkMessages(n int) []*Message {
+	messages := make([]*Message, n)
+	for i := range messages {
+		messages[i] = &Message{
+			Offset: int64(i),
+			Key:    []byte("key"),
+			Value:  bytes.Repeat([]byte("value "), 50),
+		}
+	}
+	return messages
+}
+
+func BenchmarkProduceReqWriteTo(b *testing.B) {
+	req := &ProduceReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{ID: 0, Messages: benchmarkMessages(100)},
+				},
+			},
+		},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := req.WriteTo(ioutil.Discard); err != nil {
+			b.Fatalf("could not write request: %s", err)
+		}
+	}
+}
+
+func benchmarkMessageSetEncode(b *testing.B, compression Compression) {
+	messages := benchmarkMessages(100)
+	var buf []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = appendMessageSet(buf[:0], messages, compression, 0, false); err != nil {
+			b.Fatalf("could not encode messages: %s", err)
+		}
+	}
+}
+
+func BenchmarkMessageSetEncode(b *testing.B) {
+	benchmarkMessageSetEncode(b, CompressionNone)
+}
+
+func BenchmarkMessageSetEncodeGzip(b *testing.B) {
+	benchmarkMessageSetEncode(b, CompressionGzip)
+}
+
+func BenchmarkMessageSetEncodeSnappy(b *testing.B) {
+	benchmarkMessageSetEncode(b, CompressionSnappy)
+}
+
+func BenchmarkComputeCrc(b *testing.B) {
+	msg := benchmarkMessages(1)[0]
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ComputeCrc(msg, CompressionNone)
+	}
+}
+
 func BenchmarkProduceResponseUnmarshal(b *testing.B) {
 	resp := &ProduceResp{
 		CorrelationID: 241,
@@ -0,0 +1,313 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Record batches are the message format 2 (magic byte 2) of Kafka 0.11 and
+// later, which adds headers to messages, see
+// https://kafka.apache.org/documentation/#recordbatch. Produce requests of
+// version 3 and later carry their messages in a single record batch, and fetch
+// responses of version 4 and later return record batches, or message sets of
+// the older formats for messages the broker stored in those.
+//
+// Record batches are written without producer ID, epoch and sequence, so not
+// for idempotent or transactional producing. Control batches, which mark the
+// end of transactions, hold no messages and are skipped when reading.
+
+const recordBatchMagic = 2
+
+// recordBatchHeaderSize is the size of a record batch before its records:
+// base offset, batch length, partition leader epoch, magic, crc, attributes,
+// last offset delta, first and max timestamp, producer ID and epoch, base
+// sequence and record count.
+const recordBatchHeaderSize = 8 + 4 + 4 + 1 + 4 + 2 + 4 + 8 + 8 + 8 + 2 + 4 + 4
+
+// recordBatchCrcOffset is where the crc of a record batch starts, which covers the
+// rest of the batch from the attributes on.
+const recordBatchCrcOffset = 8 + 4 + 4 + 1
+
+// attributeControl is set in the attributes of control batches. Compression
+// and log append time use the same bits as in the attributes of messages.
+const attributeControl = 0x20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// errHeadersRequireRecordBatch is returned when writing messages with headers
+// in a format that can't carry them.
+var errHeadersRequireRecordBatch = errors.New("message headers require message format 2")
+
+// RecordHeader is a header of a message. Headers are only supported by
+// message format 2.
+type RecordHeader struct {
+	Key   string
+	Value []byte
+}
+
+// RecordBatchInfo describes a record batch messages were read from.
+type RecordBatchInfo struct {
+	// BaseOffset is the offset of the first message written to the batch.
+	BaseOffset int64
+
+	// LastOffsetDelta is the offset of the last message written to the
+	// batch relative to BaseOffset. The batch takes up all offsets up to the
+	// last one, even if compaction has removed some of its messages since.
+	LastOffsetDelta int32
+
+	// ProducerID and ProducerEpoch identify the session of the idempotent
+	// or transactional producer that wrote the batch. Both are -1 for
+	// batches of other producers.
+	ProducerID    int64
+	ProducerEpoch int16
+}
+
+// NextOffset returns the offset following the batch.
+func (b *RecordBatchInfo) NextOffset() int64 {
+	return b.BaseOffset + int64(b.LastOffsetDelta) + 1
+}
+
+// appendRecordBatch appends the messages as a single record batch to b,
+// starting at the offset of the first message, with their formats ignored.
+// See appendMessageSet for level and snappyFraming. On error, b is returned
+// as it was.
+func appendRecordBatch(b []byte, messages []*Message, compression Compression, level int, snappyFraming bool) ([]byte, error) {
+	if len(messages) == 0 {
+		return b, nil
+	}
+	firstTimestamp := encodeTimestamp(messages[0].Timestamp)
+	maxTimestamp := firstTimestamp
+	for _, msg := range messages[1:] {
+		if ts := encodeTimestamp(msg.Timestamp); ts > maxTimestamp {
+			maxTimestamp = ts
+		}
+	}
+
+	scratch := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(scratch)
+	records := (*scratch)[:0]
+	for i, msg := range messages {
+		records = appendRecord(records, int64(i), encodeTimestamp(msg.Timestamp)-firstTimestamp, msg)
+	}
+	*scratch = records
+
+	start := len(b)
+	var header [recordBatchHeaderSize]byte
+	b = append(b, header[:]...)
+	b, err := appendCompressed(b, records, compression, level, snappyFraming, recordBatchMagic)
+	if err != nil {
+		return b[:start], err
+	}
+
+	h := b[start:]
+	binary.BigEndian.PutUint64(h[0:], uint64(messages[0].Offset))
+	binary.BigEndian.PutUint32(h[8:], uint32(len(h)-12))
+	binary.BigEndian.PutUint32(h[12:], 0xFFFFFFFF) // partition leader epoch, set by the broker
+	h[16] = recordBatchMagic
+	binary.BigEndian.PutUint16(h[21:], uint16(compression))
+	binary.BigEndian.PutUint32(h[23:], uint32(len(messages)-1)) // last offset delta
+	binary.BigEndian.PutUint64(h[27:], uint64(firstTimestamp))
+	binary.BigEndian.PutUint64(h[35:], uint64(maxTimestamp))
+	binary.BigEndian.PutUint64(h[43:], 0xFFFFFFFFFFFFFFFF) // producer ID
+	binary.BigEndian.PutUint16(h[51:], 0xFFFF)             // producer epoch
+	binary.BigEndian.PutUint32(h[53:], 0xFFFFFFFF)         // base sequence
+	binary.BigEndian.PutUint32(h[57:], uint32(len(messages)))
+	crc := crc32.Checksum(h[recordBatchCrcOffset+4:], castagnoli)
+	binary.BigEndian.PutUint32(h[recordBatchCrcOffset:], crc)
+	return b, nil
+}
+
+// appendRecord appends the record of msg, with the given offset and timestamp
+// relative to the first message of the batch, to b.
+func appendRecord(b []byte, offsetDelta, timestampDelta int64, msg *Message) []byte {
+	var body []byte
+	body = append(body, 0) // attributes
+	body = appendVarint(body, timestampDelta)
+	body = appendVarint(body, offsetDelta)
+	body = appendVarintBytes(body, msg.Key)
+	body = appendVarintBytes(body, msg.Value)
+	body = appendVarint(body, int64(len(msg.Headers)))
+	for _, h := range msg.Headers {
+		body = appendVarint(body, int64(len(h.Key)))
+		body = append(body, h.Key...)
+		body = appendVarintBytes(body, h.Value)
+	}
+
+	b = appendVarint(b, int64(len(body)))
+	return append(b, body...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendVarintBytes appends the length of v, or -1 if v is nil, and v.
+func appendVarintBytes(b, v []byte) []byte {
+	if v == nil {
+		return appendVarint(b, -1)
+	}
+	b = appendVarint(b, int64(len(v)))
+	return append(b, v...)
+}
+
+// readRecordBatch decodes the messages of the single record batch b,
+// decompressing them within the limits of limiter, which may be nil. Unless
+// check is crcSkip, a batch that fails its crc check is an
+// ErrInvalidMessageCRC error.
+func readRecordBatch(b []byte, limiter *DecompressionLimiter, check crcCheck) ([]*Message, error) {
+	if len(b) < recordBatchHeaderSize {
+		return nil, ErrNotEnoughData
+	}
+	baseOffset := int64(binary.BigEndian.Uint64(b))
+	size := int(int32(binary.BigEndian.Uint32(b[8:]))) + 12
+	if size < recordBatchHeaderSize || size > len(b) {
+		return nil, ErrNotEnoughData
+	}
+	b = b[:size]
+	if b[16] != recordBatchMagic {
+		return nil, fmt.Errorf("unsupported magic byte %d", b[16])
+	}
+	if check != crcSkip && binary.BigEndian.Uint32(b[recordBatchCrcOffset:]) != crc32.Checksum(b[recordBatchCrcOffset+4:], castagnoli) {
+		return nil, ErrInvalidMessageCRC
+	}
+	attributes := binary.BigEndian.Uint16(b[21:])
+	if attributes&attributeControl != 0 {
+		return nil, nil
+	}
+	batch := &RecordBatchInfo{
+		BaseOffset:      baseOffset,
+		LastOffsetDelta: int32(binary.BigEndian.Uint32(b[23:])),
+		ProducerID:      int64(binary.BigEndian.Uint64(b[43:])),
+		ProducerEpoch:   int16(binary.BigEndian.Uint16(b[51:])),
+	}
+	compression := Compression(attributes & attributeCompression)
+	firstTimestamp := int64(binary.BigEndian.Uint64(b[27:]))
+	maxTimestamp := int64(binary.BigEndian.Uint64(b[35:]))
+	count := int(int32(binary.BigEndian.Uint32(b[57:])))
+
+	records := b[recordBatchHeaderSize:]
+	if compression != CompressionNone {
+		var buf *[]byte
+		var dst []byte
+		if limiter != nil {
+			buf = limiter.acquire()
+			dst = *buf
+			// records are copied out of the decompressed data
+			defer limiter.release(buf)
+		}
+		decoded, err := decompress(compression, records, dst)
+		if buf != nil {
+			*buf = decoded
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = decoded
+	}
+
+	if count < 0 || count > len(records) {
+		return nil, ErrNotEnoughData
+	}
+	messages := make([]*Message, 0, count)
+	for i := 0; i < count; i++ {
+		msg, timestampDelta, rest, err := readRecord(records)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode record: %s", err)
+		}
+		msg.Offset += baseOffset
+		msg.Format = recordBatchMagic
+		msg.Batch = batch
+		if attributes&attributeLogAppendTime != 0 {
+			msg.Timestamp = decodeTimestamp(maxTimestamp)
+			msg.TimestampType = TimestampLogAppendTime
+		} else {
+			msg.Timestamp = decodeTimestamp(firstTimestamp + timestampDelta)
+		}
+		messages = append(messages, msg)
+		records = rest
+	}
+	return messages, nil
+}
+
+// readRecord decodes the record at the start of b and returns it, with its
+// offset relative to the start of the batch, along with its timestamp delta
+// and the rest of b.
+func readRecord(b []byte) (*Message, int64, []byte, error) {
+	r := &varintReader{b: b}
+	size := r.varint()
+	if r.err != nil || size < 0 || size > int64(len(r.b)) {
+		return nil, 0, nil, ErrNotEnoughData
+	}
+	rest := r.b[size:]
+	r.b = r.b[:size]
+
+	msg := &Message{}
+	r.skip(1) // attributes
+	timestampDelta := r.varint()
+	msg.Offset = r.varint()
+	msg.Key = r.bytes()
+	msg.Value = r.bytes()
+	if n := r.varint(); n > 0 && n <= int64(len(r.b)) {
+		msg.Headers = make([]RecordHeader, n)
+		for i := range msg.Headers {
+			msg.Headers[i].Key = string(r.bytes())
+			msg.Headers[i].Value = r.bytes()
+		}
+	} else if n != 0 {
+		return nil, 0, nil, ErrNotEnoughData
+	}
+	if r.err != nil {
+		return nil, 0, nil, r.err
+	}
+	return msg, timestampDelta, rest, nil
+}
+
+// varintReader decodes the varint encoded fields of records. The first error
+// is kept and makes all further reads return zero values.
+type varintReader struct {
+	b   []byte
+	err error
+}
+
+func (r *varintReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = ErrNotEnoughData
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *varintReader) skip(n int) {
+	if r.err == nil && len(r.b) < n {
+		r.err = ErrNotEnoughData
+	}
+	if r.err == nil {
+		r.b = r.b[n:]
+	}
+}
+
+// bytes reads a varint length prefixed byte array, which is nil for length
+// -1. The result is a copy.
+func (r *varintReader) bytes() []byte {
+	n := r.varint()
+	if r.err != nil || n < 0 {
+		return nil
+	}
+	if n > int64(len(r.b)) {
+		r.err = ErrNotEnoughData
+		return nil
+	}
+	v := make([]byte, n)
+	copy(v, r.b)
+	r.b = r.b[n:]
+	return v
+}
@@ -0,0 +1,249 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RecordBatchSuite{})
+
+type RecordBatchSuite struct{}
+
+func (s *RecordBatchSuite) TestHeadersRoundTrip(c *C) {
+	batch := &RecordBatchInfo{BaseOffset: 42, LastOffsetDelta: 2, ProducerID: -1, ProducerEpoch: -1}
+	messages := []*Message{
+		{
+			Offset: 42,
+			Key:    []byte("key"),
+			Value:  []byte("traced"),
+			Format: 2,
+			Headers: []RecordHeader{
+				{Key: "trace-id", Value: []byte("4bf92f3577b34da6")},
+				{Key: "span-id", Value: []byte("00f067aa0ba902b7")},
+			},
+			Batch: batch,
+		},
+		{Offset: 43, Value: []byte("no headers"), Format: 2, Batch: batch},
+		{Offset: 44, Headers: []RecordHeader{{Key: "null-value"}}, Format: 2, Batch: batch},
+	}
+	for _, compression := range []Compression{
+		CompressionNone, CompressionGzip, CompressionSnappy, CompressionLZ4, CompressionZstd,
+	} {
+		b, err := appendRecordBatch(nil, messages, compression, 0, false)
+		c.Assert(err, IsNil)
+
+		decoded, err := readRecordBatch(b, nil, crcReject)
+		c.Assert(err, IsNil)
+		c.Assert(decoded, DeepEquals, messages)
+
+		decoded, err = readRecordBatch(b, NewDecompressionLimiter(1), crcReject)
+		c.Assert(err, IsNil)
+		c.Assert(decoded, DeepEquals, messages)
+	}
+}
+
+func (s *RecordBatchSuite) TestTimestamps(c *C) {
+	batch := &RecordBatchInfo{BaseOffset: 7, LastOffsetDelta: 3, ProducerID: -1, ProducerEpoch: -1}
+	messages := []*Message{
+		{Offset: 7, Value: []byte("first"), Format: 2, Timestamp: time.Unix(1500000000, 250*int64(time.Millisecond)), Batch: batch},
+		{Offset: 8, Value: []byte("latest"), Format: 2, Timestamp: time.Unix(1500000002, 0), Batch: batch},
+		{Offset: 9, Value: []byte("earlier"), Format: 2, Timestamp: time.Unix(1499999999, 0), Batch: batch},
+		{Offset: 10, Value: []byte("none"), Format: 2, Batch: batch},
+	}
+	b, err := appendRecordBatch(nil, messages, CompressionNone, 0, false)
+	c.Assert(err, IsNil)
+
+	c.Assert(int64(binary.BigEndian.Uint64(b[27:])), Equals, int64(1500000000250))
+	c.Assert(int64(binary.BigEndian.Uint64(b[35:])), Equals, int64(1500000002000))
+
+	decoded, err := readRecordBatch(b, nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, DeepEquals, messages)
+
+	// with log append time, all messages have the max timestamp
+	b[22] |= attributeLogAppendTime
+	crc := crc32Castagnoli(b[recordBatchCrcOffset+4:])
+	binary.BigEndian.PutUint32(b[recordBatchCrcOffset:], crc)
+	decoded, err = readRecordBatch(b, nil, crcReject)
+	c.Assert(err, IsNil)
+	for _, msg := range decoded {
+		c.Assert(msg.Timestamp.Equal(time.Unix(1500000002, 0)), Equals, true)
+		c.Assert(msg.TimestampType, Equals, TimestampLogAppendTime)
+	}
+}
+
+func (s *RecordBatchSuite) TestBatchInfo(c *C) {
+	b, err := appendRecordBatch(nil, []*Message{
+		{Offset: 20, Value: []byte("first")},
+		{Offset: 21, Value: []byte("second")},
+	}, CompressionNone, 0, false)
+	c.Assert(err, IsNil)
+	// the batch was written by an idempotent producer with offsets up to 25,
+	// and compaction removed all but the first two messages
+	binary.BigEndian.PutUint32(b[23:], 5)
+	binary.BigEndian.PutUint64(b[43:], 1000)
+	binary.BigEndian.PutUint16(b[51:], 3)
+	binary.BigEndian.PutUint32(b[recordBatchCrcOffset:], crc32Castagnoli(b[recordBatchCrcOffset+4:]))
+
+	decoded, err := readRecordBatch(b, nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, 2)
+	c.Assert(decoded[0].Batch, Equals, decoded[1].Batch)
+	c.Assert(decoded[0].Batch, DeepEquals, &RecordBatchInfo{BaseOffset: 20, LastOffsetDelta: 5, ProducerID: 1000, ProducerEpoch: 3})
+	c.Assert(decoded[0].Batch.NextOffset(), Equals, int64(26))
+}
+
+func (s *RecordBatchSuite) TestControlBatch(c *C) {
+	b, err := appendRecordBatch(nil, []*Message{{Value: []byte("marker")}}, CompressionNone, 0, false)
+	c.Assert(err, IsNil)
+	b[22] |= attributeControl
+	binary.BigEndian.PutUint32(b[recordBatchCrcOffset:], crc32Castagnoli(b[recordBatchCrcOffset+4:]))
+
+	decoded, err := readRecordBatch(b, nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, 0)
+}
+
+func (s *RecordBatchSuite) TestCorruptBatch(c *C) {
+	b, err := appendRecordBatch(nil, []*Message{{Value: []byte("value")}}, CompressionNone, 0, false)
+	c.Assert(err, IsNil)
+
+	_, err = readRecordBatch(b[:len(b)-1], nil, crcReject)
+	c.Assert(err, Equals, ErrNotEnoughData)
+
+	b[len(b)-2]++
+	_, err = readRecordBatch(b, nil, crcReject)
+	c.Assert(err, Equals, ErrInvalidMessageCRC)
+}
+
+func (s *RecordBatchSuite) TestMessageSetRejectsHeaders(c *C) {
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{{Value: []byte("value")}}, CompressionNone, false)
+	c.Assert(err, IsNil)
+
+	msg := &Message{Value: []byte("value"), Headers: []RecordHeader{{Key: "k"}}}
+	_, err = writeMessageSet(&buf, []*Message{msg}, CompressionNone, false)
+	c.Assert(err, Equals, errHeadersRequireRecordBatch)
+	_, err = writeMessageSet(&buf, []*Message{msg}, CompressionGzip, false)
+	c.Assert(err, Equals, errHeadersRequireRecordBatch)
+}
+
+func (s *RecordBatchSuite) TestMixedFormats(c *C) {
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{{Offset: 3, Value: []byte("old")}}, CompressionNone, false)
+	c.Assert(err, IsNil)
+	b, err := appendRecordBatch(buf.Bytes(), []*Message{
+		{Offset: 4, Value: []byte("new"), Headers: []RecordHeader{{Key: "k", Value: []byte("v")}}},
+	}, CompressionGzip, 0, false)
+	c.Assert(err, IsNil)
+
+	messages, err := readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].Offset, Equals, int64(3))
+	c.Assert(messages[0].Format, Equals, int8(0))
+	c.Assert(messages[1].Offset, Equals, int64(4))
+	c.Assert(messages[1].Format, Equals, int8(2))
+	c.Assert(messages[1].Headers, DeepEquals, []RecordHeader{{Key: "k", Value: []byte("v")}})
+}
+
+func (s *RecordBatchSuite) TestProduceReqRecordBatch(c *C) {
+	req := &ProduceReq{
+		Version:       3,
+		CorrelationID: 241,
+		ClientID:      "test",
+		Compression:   CompressionSnappy,
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{
+						ID: 0,
+						Messages: []*Message{
+							{Value: []byte("first"), Headers: []RecordHeader{{Key: "trace-id", Value: []byte("1")}}},
+							{Value: []byte("second"), Timestamp: time.Unix(1500000000, 0)},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+
+	decoded, err := ReadProduceReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(decoded.Version, Equals, int16(3))
+	c.Assert(decoded.RequiredAcks, Equals, req.RequiredAcks)
+	c.Assert(decoded.Timeout, Equals, req.Timeout)
+	messages := decoded.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].Offset, Equals, int64(0))
+	c.Assert(messages[0].Headers, DeepEquals, []RecordHeader{{Key: "trace-id", Value: []byte("1")}})
+	c.Assert(messages[1].Offset, Equals, int64(1))
+	c.Assert(messages[1].Value, DeepEquals, []byte("second"))
+	c.Assert(messages[1].Timestamp.Equal(time.Unix(1500000000, 0)), Equals, true)
+}
+
+func (s *RecordBatchSuite) TestFetchRecordBatch(c *C) {
+	req := &FetchReq{
+		Version:       4,
+		CorrelationID: 241,
+		ClientID:      "test",
+		MaxWaitTime:   time.Second,
+		MinBytes:      1,
+		Topics: []FetchReqTopic{
+			{Name: "foo", Partitions: []FetchReqPartition{{ID: 1, FetchOffset: 5, MaxBytes: 1024}}},
+		},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decodedReq, err := ReadFetchReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	req.MaxBytes = 1<<31 - 1
+	c.Assert(decodedReq, DeepEquals, req)
+
+	resp := &FetchResp{
+		Version:       4,
+		CorrelationID: 241,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:               1,
+						TipOffset:        20,
+						LastStableOffset: 18,
+						Messages: []*Message{
+							{Offset: 5, Value: []byte("first"), Headers: []RecordHeader{{Key: "k", Value: []byte("v")}}},
+							{Offset: 6, Value: []byte("second")},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	decoded, err := ReadVersionedFetchResp(bytes.NewReader(b), 4, nil)
+	c.Assert(err, IsNil)
+	part := decoded.Topics[0].Partitions[0]
+	c.Assert(part.TipOffset, Equals, int64(20))
+	c.Assert(part.LastStableOffset, Equals, int64(18))
+	c.Assert(part.Messages, HasLen, 2)
+	c.Assert(part.Messages[0].Offset, Equals, int64(5))
+	c.Assert(part.Messages[0].Topic, Equals, "foo")
+	c.Assert(part.Messages[0].Headers, DeepEquals, []RecordHeader{{Key: "k", Value: []byte("v")}})
+	c.Assert(part.Messages[1].Offset, Equals, int64(6))
+	c.Assert(part.Messages[1].Value, DeepEquals, []byte("second"))
+}
+
+func crc32Castagnoli(b []byte) uint32 {
+	return crc32.Checksum(b, castagnoli)
+}
@@ -9,6 +9,85 @@ import (
 
 var ErrNotEnoughData = errors.New("not enough data")
 
+// ErrInvalidMessageCRC is returned when decoding a message, or record batch,
+// whose crc does not match its content.
+var ErrInvalidMessageCRC = errors.New("message crc mismatch")
+
+// ErrInvalidLength is returned when decoding a string, byte array or array
+// with a negative length other than -1, which stands for null.
+var ErrInvalidLength = errors.New("invalid length")
+
+// allocChunk is the most readAppend allocates ahead of the data it reads, when
+// it can't tell whether all of the data is there.
+const allocChunk = 64 << 10
+
+// available returns the number of bytes left in r, if r can tell.
+func available(r io.Reader) (int, bool) {
+	switch r := r.(type) {
+	case interface {
+		Len() int
+	}:
+		return r.Len(), true
+	case *io.LimitedReader:
+		n, ok := available(r.R)
+		if ok && int64(n) > r.N {
+			n = int(r.N)
+		}
+		return n, ok
+	}
+	return 0, false
+}
+
+// readBytes reads n bytes from r, see readAppend.
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	return readAppend(nil, r, n)
+}
+
+// readAppend reads n bytes from r and appends them to b. Unless r has all of
+// them already, the buffer grows as the data arrives instead of being
+// allocated up front, so that a corrupt length costs no more memory than the
+// data that is actually there.
+func readAppend(b []byte, r io.Reader, n int) ([]byte, error) {
+	start := len(b)
+	want := start + n
+	chunk := n
+	if left, ok := available(r); !ok {
+		if chunk > allocChunk {
+			chunk = allocChunk
+		}
+	} else if left < n {
+		// only read what is there, to fail like io.ReadFull
+		chunk = left + 1
+	}
+	for len(b) < want {
+		m := want - len(b)
+		if m > chunk {
+			m = chunk
+		}
+		if cap(b)-len(b) < m {
+			size := 2 * cap(b)
+			if size < len(b)+m {
+				size = len(b) + m
+			}
+			if size > want {
+				size = want
+			}
+			grown := make([]byte, len(b), size)
+			copy(grown, b)
+			b = grown
+		}
+		read, err := io.ReadFull(r, b[len(b):len(b)+m])
+		b = b[:len(b)+read]
+		if err != nil {
+			if err == io.EOF && len(b) > start {
+				err = io.ErrUnexpectedEOF
+			}
+			return b, err
+		}
+	}
+	return b, nil
+}
+
 type decoder struct {
 	buf []byte
 	r   io.Reader
@@ -73,6 +152,26 @@ func (d *decoder) DecodeInt32() int32 {
 	return int32(binary.BigEndian.Uint32(b))
 }
 
+// DecodeOptionalInt32 decodes a trailing field that some brokers omit even
+// though the response version includes it. If the input ends right where
+// the field starts, zero is returned and no error is recorded. A partially
+// present field is still an error.
+func (d *decoder) DecodeOptionalInt32() int32 {
+	if d.err != nil {
+		return 0
+	}
+	b := d.buf[:4]
+	n, err := io.ReadFull(d.r, b)
+	if err == io.EOF && n == 0 {
+		return 0
+	}
+	if err != nil {
+		d.err = err
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
 func (d *decoder) DecodeUint32() uint32 {
 	if d.err != nil {
 		return 0
@@ -115,30 +214,50 @@ func (d *decoder) DecodeString() string {
 	if d.err != nil {
 		return ""
 	}
+	if slen < -1 {
+		d.err = ErrInvalidLength
+		return ""
+	}
 	if slen < 1 {
 		return ""
 	}
 
 	var b []byte
+	var err error
 	if int(slen) > len(d.buf) {
-		b = make([]byte, slen)
+		b, err = readBytes(d.r, int(slen))
 	} else {
 		b = d.buf[:int(slen)]
+		_, err = io.ReadFull(d.r, b)
 	}
-	n, err := io.ReadFull(d.r, b)
 	if err != nil {
 		d.err = err
 		return ""
 	}
-	if n != int(slen) {
-		d.err = ErrNotEnoughData
-		return ""
-	}
 	return string(b)
 }
 
+// DecodeArrayLen decodes the number of elements of an array, which is 0 for
+// the null array. Every element takes at least a byte, so if the decoder can
+// tell how much data is left, a larger number is an error rather than a
+// reason for a huge allocation.
 func (d *decoder) DecodeArrayLen() int {
-	return int(d.DecodeInt32())
+	n := int(d.DecodeInt32())
+	if d.err != nil {
+		return 0
+	}
+	if n < -1 {
+		d.err = ErrInvalidLength
+		return 0
+	}
+	if n == -1 {
+		return 0
+	}
+	if left, ok := available(d.r); ok && n > left {
+		d.err = ErrNotEnoughData
+		return 0
+	}
+	return n
 }
 
 func (d *decoder) DecodeBytes() []byte {
@@ -149,20 +268,19 @@ func (d *decoder) DecodeBytes() []byte {
 	if d.err != nil {
 		return nil
 	}
+	if slen < -1 {
+		d.err = ErrInvalidLength
+		return nil
+	}
 	if slen < 1 {
 		return nil
 	}
 
-	b := make([]byte, slen)
-	n, err := io.ReadFull(d.r, b)
+	b, err := readBytes(d.r, int(slen))
 	if err != nil {
 		d.err = err
 		return nil
 	}
-	if n != int(slen) {
-		d.err = ErrNotEnoughData
-		return nil
-	}
 	return b
 }
 
@@ -362,3 +480,35 @@ func writeAll(w io.Writer, b []byte) error {
 	}
 	return nil
 }
+
+// The append functions encode values like the encoder does, but append them
+// to a byte slice, so that hot paths can encode into reused buffers without
+// an encoder and its writer in between.
+
+func appendInt16(b []byte, val int16) []byte {
+	return append(b, byte(val>>8), byte(val))
+}
+
+func appendInt32(b []byte, val int32) []byte {
+	return append(b, byte(val>>24), byte(val>>16), byte(val>>8), byte(val))
+}
+
+func appendInt64(b []byte, val int64) []byte {
+	return append(b,
+		byte(val>>56), byte(val>>48), byte(val>>40), byte(val>>32),
+		byte(val>>24), byte(val>>16), byte(val>>8), byte(val))
+}
+
+func appendString(b []byte, val string) []byte {
+	b = appendInt16(b, int16(len(val)))
+	return append(b, val...)
+}
+
+// appendBytes appends the length of val, or -1 if val is nil, and val.
+func appendBytes(b []byte, val []byte) []byte {
+	if val == nil {
+		return appendInt32(b, -1)
+	}
+	b = appendInt32(b, int32(len(val)))
+	return append(b, val...)
+}
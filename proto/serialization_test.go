@@ -2,6 +2,7 @@ package proto
 
 import (
 	"bytes"
+	"io"
 
 	. "gopkg.in/check.v1"
 )
@@ -74,3 +75,48 @@ func (s *SerializationSuite) TestDecoder(c *C) {
 		c.Fatalf("bytes are not the same")
 	}
 }
+
+// streamReader hides the length of the data it reads, like a connection does.
+type streamReader struct {
+	io.Reader
+}
+
+func (s *SerializationSuite) TestDecodeLengths(c *C) {
+	// -1 is null, other negative lengths are errors
+	d := NewDecoder(bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	c.Assert(d.DecodeBytes(), IsNil)
+	c.Assert(d.DecodeString(), Equals, "")
+	c.Assert(d.Err(), IsNil)
+	d = NewDecoder(bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff}))
+	c.Assert(d.DecodeArrayLen(), Equals, 0)
+	c.Assert(d.Err(), IsNil)
+
+	for _, decode := range []func(d *decoder){
+		func(d *decoder) { d.DecodeBytes() },
+		func(d *decoder) { d.DecodeString() },
+		func(d *decoder) { d.DecodeArrayLen() },
+	} {
+		d = NewDecoder(bytes.NewBuffer([]byte{0xff, 0xfe, 0xff, 0xfe}))
+		decode(d)
+		c.Assert(d.Err(), Equals, ErrInvalidLength)
+	}
+
+	// lengths beyond the data fail without allocating them
+	d = NewDecoder(bytes.NewBuffer([]byte{0x7f, 0xff, 0xff, 0xff, 0x0, 0x0}))
+	c.Assert(d.DecodeArrayLen(), Equals, 0)
+	c.Assert(d.Err(), Equals, ErrNotEnoughData)
+	d = NewDecoder(bytes.NewBuffer([]byte{0x7f, 0xff, 0xff, 0xff, 0x0, 0x0}))
+	c.Assert(d.DecodeBytes(), IsNil)
+	c.Assert(d.Err(), Equals, io.ErrUnexpectedEOF)
+	d = NewDecoder(streamReader{bytes.NewBuffer([]byte{0x7f, 0xff, 0xff, 0xff, 0x0, 0x0})})
+	c.Assert(d.DecodeBytes(), IsNil)
+	c.Assert(d.Err(), Equals, io.ErrUnexpectedEOF)
+
+	// data read in chunks is complete
+	val := bytes.Repeat([]byte("kafka"), 3*allocChunk)
+	var buf bytes.Buffer
+	NewEncoder(&buf).Encode(val)
+	d = NewDecoder(streamReader{&buf})
+	c.Assert(bytes.Equal(d.DecodeBytes(), val), Equals, true)
+	c.Assert(d.Err(), IsNil)
+}
@@ -3,6 +3,7 @@ package proto
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/golang/snappy"
@@ -14,37 +15,105 @@ import (
 // by sniffing its special header.
 //
 // That library will still read plain (unframed) snappy-encoded messages,
-// so we don't need to implement that codec on the compression side.
+// so plain snappy is what we write by default. Framed messages are only
+// needed for old Java consumers, see ProduceReq.SnappyFraming.
 //
 // (This is the same behavior as several of the other popular Kafka clients.)
 
 var snappyJavaMagic = []byte("\x82SNAPPY\x00")
 
-func snappyDecode(b []byte) ([]byte, error) {
+const (
+	// snappyJavaHeaderSize is the size of the magic, version and compatible
+	// version of framed messages.
+	snappyJavaHeaderSize = 16
+
+	// snappyJavaBlockSize is the size of the blocks snappy-java compresses
+	// separately.
+	snappyJavaBlockSize = 32 << 10
+)
+
+var errSnappyJavaCorrupt = errors.New("corrupt snappy-java framing")
+
+// snappyEncode returns src compressed with snappy, framed like snappy-java
+// does if framed is true.
+func snappyEncode(src []byte, framed bool) []byte {
+	if !framed {
+		return snappy.Encode(nil, src)
+	}
+	dst := make([]byte, snappyJavaHeaderSize, snappyJavaHeaderSize+snappy.MaxEncodedLen(len(src))+4)
+	copy(dst, snappyJavaMagic)
+	binary.BigEndian.PutUint32(dst[8:], 1)  // version
+	binary.BigEndian.PutUint32(dst[12:], 1) // compatible version
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyJavaBlockSize {
+			block = block[:snappyJavaBlockSize]
+		}
+		src = src[len(block):]
+
+		chunk := snappy.Encode(nil, block)
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		dst = append(dst, size[:]...)
+		dst = append(dst, chunk...)
+	}
+	return dst
+}
+
+// snappyDecode decodes b, reusing the capacity of dst when possible.
+func snappyDecode(dst, b []byte) ([]byte, error) {
 	if !bytes.HasPrefix(b, snappyJavaMagic) {
-		return snappy.Decode(nil, b)
+		if err := checkSnappyDecodedLen(b, 0); err != nil {
+			return nil, err
+		}
+		return snappy.Decode(dst[:cap(dst)], b)
 	}
 
 	// See https://github.com/xerial/snappy-java/blob/develop/src/main/java/org/xerial/snappy/SnappyInputStream.java
+	if len(b) < snappyJavaHeaderSize {
+		return nil, errSnappyJavaCorrupt
+	}
 	version := binary.BigEndian.Uint32(b[8:12])
 	if version != 1 {
 		return nil, fmt.Errorf("cannot handle snappy-java codec version other than 1 (got %d)", version)
 	}
 	// b[12:16] is the "compatible version"; ignore for now
 	var (
-		decoded = make([]byte, 0, len(b))
+		decoded = dst[:0]
 		chunk   []byte
 		err     error
 	)
-	for i := 16; i < len(b); {
-		n := int(binary.BigEndian.Uint32(b[i : i+4]))
+	for i := snappyJavaHeaderSize; i < len(b); {
+		if len(b)-i < 4 {
+			return nil, errSnappyJavaCorrupt
+		}
+		n := binary.BigEndian.Uint32(b[i : i+4])
 		i += 4
-		chunk, err = snappy.Decode(chunk, b[i:i+n])
+		if uint64(n) > uint64(len(b)-i) {
+			return nil, fmt.Errorf("snappy-java chunk of %d bytes exceeds the %d bytes left", n, len(b)-i)
+		}
+		if err := checkSnappyDecodedLen(b[i:i+int(n)], len(decoded)); err != nil {
+			return nil, err
+		}
+		chunk, err = snappy.Decode(chunk[:cap(chunk)], b[i:i+int(n)])
 		if err != nil {
 			return nil, err
 		}
-		i += n
+		i += int(n)
 		decoded = append(decoded, chunk...)
 	}
 	return decoded, nil
 }
+
+// checkSnappyDecodedLen returns an error if snappy encoded b, decoded after
+// size bytes already decoded, is corrupt or too large.
+func checkSnappyDecodedLen(b []byte, size int) error {
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return err
+	}
+	if n > maxDecodedLen-size {
+		return fmt.Errorf("snappy message of %d bytes exceeds the limit of %d bytes", size+n, maxDecodedLen)
+	}
+	return nil
+}
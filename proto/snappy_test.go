@@ -2,7 +2,10 @@ package proto
 
 import (
 	"bytes"
+	"encoding/binary"
+	"time"
 
+	"github.com/golang/snappy"
 	. "gopkg.in/check.v1"
 )
 
@@ -13,7 +16,7 @@ type SnappySuite struct{}
 var snappyChunk = []byte("\x03\x08foo") // snappy encoding of "foo"
 
 func (s *SnappySuite) TestSnappyDecodeNormal(c *C) {
-	got, err := snappyDecode(snappyChunk)
+	got, err := snappyDecode(nil, snappyChunk)
 	if err != nil {
 		c.Fatal(err)
 	}
@@ -32,7 +35,7 @@ func (s *SnappySuite) TestSnappyDecodeJava(c *C) {
 		0, 0, 0, 5, // chunk size
 		0x3, 0x8, 'f', 'o', 'o', // chunk data
 	}
-	got, err := snappyDecode(javafied)
+	got, err := snappyDecode(nil, javafied)
 	if err != nil {
 		c.Fatal(err)
 	}
@@ -40,3 +43,123 @@ func (s *SnappySuite) TestSnappyDecodeJava(c *C) {
 		c.Fatalf("got: %v; want: %v", got, want)
 	}
 }
+
+// snappyLiteral returns b snappy encoded as a single literal, the way
+// snappy-java encodes data it finds nothing to compress in.
+func snappyLiteral(b []byte) []byte {
+	enc := []byte{byte(len(b))} // varint decoded length, for up to 127 bytes
+	if len(b) <= 60 {
+		enc = append(enc, byte(len(b)-1)<<2)
+	} else {
+		enc = append(enc, 60<<2, byte(len(b)-1))
+	}
+	return append(enc, b...)
+}
+
+func (s *SnappySuite) TestSnappyDecodeJavaMessageSet(c *C) {
+	var set bytes.Buffer
+	_, err := writeMessageSet(&set, []*Message{
+		{Offset: 7, Key: []byte("foo"), Value: []byte("bar")},
+		{Offset: 8, Value: []byte("baz")},
+	}, CompressionNone, false)
+	c.Assert(err, IsNil)
+	chunk := snappyLiteral(set.Bytes())
+
+	// a message set compressed by snappy-java, in a wrapper message
+	framed := []byte{
+		0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0x0, // magic
+		0, 0, 0, 1, // version
+		0, 0, 0, 1, // compatible version
+		0, 0, 0, byte(len(chunk)), // chunk size
+	}
+	framed = append(framed, chunk...)
+	var wrapper bytes.Buffer
+	enc := NewEncoder(&wrapper)
+	enc.EncodeInt64(8)
+	enc.EncodeInt32(int32(4 + 1 + 1 + 4 + 4 + len(framed)))
+	enc.EncodeUint32(ComputeCrc(&Message{Value: framed}, CompressionSnappy))
+	enc.EncodeInt8(0)
+	enc.EncodeInt8(int8(CompressionSnappy))
+	enc.EncodeBytes(nil)
+	enc.EncodeBytes(framed)
+	c.Assert(enc.Err(), IsNil)
+
+	b := wrapper.Bytes()
+	messages, err := readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].Offset, Equals, int64(7))
+	c.Assert(string(messages[0].Key), Equals, "foo")
+	c.Assert(string(messages[0].Value), Equals, "bar")
+	c.Assert(messages[1].Offset, Equals, int64(8))
+	c.Assert(string(messages[1].Value), Equals, "baz")
+}
+
+func (s *SnappySuite) TestSnappyEncodeFramed(c *C) {
+	src := bytes.Repeat([]byte("0123456789abcdef"), 5000) // three blocks
+	framed := snappyEncode(src, true)
+	c.Assert(bytes.HasPrefix(framed, snappyJavaMagic), Equals, true)
+	c.Assert(framed[8:16], DeepEquals, []byte{0, 0, 0, 1, 0, 0, 0, 1})
+
+	var chunks int
+	for i := snappyJavaHeaderSize; i < len(framed); chunks++ {
+		i += 4 + int(binary.BigEndian.Uint32(framed[i:]))
+	}
+	c.Assert(chunks, Equals, 3)
+
+	got, err := snappyDecode(nil, framed)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(got, src), Equals, true)
+
+	// plain snappy by default
+	got, err = snappy.Decode(nil, snappyEncode(src, false))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(got, src), Equals, true)
+}
+
+func (s *SnappySuite) TestProduceSnappyFraming(c *C) {
+	req := &ProduceReq{
+		CorrelationID: 1,
+		ClientID:      "test",
+		Compression:   CompressionSnappy,
+		SnappyFraming: true,
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{{
+			Name: "foo",
+			Partitions: []ProduceReqPartition{{
+				ID:       0,
+				Messages: []*Message{{Value: []byte("framed")}},
+			}},
+		}},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(b, snappyJavaMagic), Equals, true)
+
+	got, err := ReadProduceReq(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	messages := got.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 1)
+	c.Assert(string(messages[0].Value), Equals, "framed")
+}
+
+func (s *SnappySuite) TestSnappyDecodeCorrupt(c *C) {
+	header := append(append([]byte{}, snappyJavaMagic...), 0, 0, 0, 1, 0, 0, 0, 1)
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"truncated header", snappyJavaMagic, "corrupt snappy-java framing"},
+		{"truncated chunk size", append(header, 0, 0), "corrupt snappy-java framing"},
+		{"chunk beyond data", append(header, 0x7f, 0xff, 0xff, 0xff, 0x3, 0x8), "snappy-java chunk of 2147483647 bytes exceeds the 2 bytes left"},
+		// decoded lengths of 4GB, which must not be allocated
+		{"huge plain", []byte{0xff, 0xff, 0xff, 0xff, 0x0f, 0x0}, "snappy message of 4294967295 bytes exceeds the limit of 268435456 bytes"},
+		{"huge chunk", append(header, 0, 0, 0, 6, 0xff, 0xff, 0xff, 0xff, 0x0f, 0x0), "snappy message of 4294967295 bytes exceeds the limit of 268435456 bytes"},
+	}
+	for _, tt := range tests {
+		_, err := snappyDecode(nil, tt.data)
+		c.Assert(err, ErrorMatches, tt.err, Commentf(tt.name))
+	}
+}
@@ -0,0 +1,1272 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Zstandard-compressed record batches use the frame format of RFC 8878, see
+// https://tools.ietf.org/html/rfc8878. Brokers of Kafka 2.1 and later accept
+// them in produce requests of version 7 and return them for fetch requests
+// of version 10 and later, and only in record batches.
+//
+// zstdEncode writes a single frame with a content checksum. Its blocks hold
+// the literals uncompressed and the sequences coded with the predefined
+// distributions, so the frame carries no tables. That compresses somewhat
+// less than the reference implementation, which Huffman codes the literals
+// and picks matches more carefully, but all decoders read it. zstdDecode
+// reads everything the format allows except dictionaries, up to the same
+// limit as the other codecs.
+
+const (
+	zstdMagic          = 0xFD2FB528
+	zstdSkippableMagic = 0x184D2A50 // the low 4 bits are free
+	zstdBlockMaxSize   = 128 << 10
+
+	zstdBlockRaw        = 0
+	zstdBlockRLE        = 1
+	zstdBlockCompressed = 2
+
+	zstdMinMatch     = 4
+	zstdHashLog      = 16
+	zstdMaxWindowLog = 22 // of written frames, which limits match offsets
+)
+
+var errZstdCorrupt = errors.New("corrupt zstd data")
+
+// zstdTooLarge returns the error of a frame that decodes to more than max
+// bytes.
+func zstdTooLarge(max int) error {
+	return fmt.Errorf("zstd message exceeds the limit of %d bytes", max)
+}
+
+// Literal length and match length codes stand for a baseline, to which as
+// many bits as given are added.
+var (
+	zstdLLBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLLBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMLBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMLBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// The predefined distributions of literal length, offset and match length
+// codes, and the accuracy of their tables.
+var (
+	zstdLLDefault = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	zstdOFDefault = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+	zstdMLDefault = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+
+	zstdLLDefaultTable = mustZstdFSETable(zstdLLDefault, 6)
+	zstdOFDefaultTable = mustZstdFSETable(zstdOFDefault, 5)
+	zstdMLDefaultTable = mustZstdFSETable(zstdMLDefault, 6)
+
+	zstdLLDefaultEncoder = newZstdFSEEncoder(zstdLLDefault, 6)
+	zstdOFDefaultEncoder = newZstdFSEEncoder(zstdOFDefault, 5)
+	zstdMLDefaultEncoder = newZstdFSEEncoder(zstdMLDefault, 6)
+)
+
+// zstdEncode returns src compressed to a zstd frame.
+func zstdEncode(src []byte) []byte {
+	windowLog := uint(10)
+	for windowLog < zstdMaxWindowLog && 1<<windowLog < len(src) {
+		windowLog++
+	}
+
+	dst := make([]byte, 10, 10+len(src)/2+16)
+	binary.LittleEndian.PutUint32(dst, zstdMagic)
+	dst[4] = 2<<6 | 1<<2 // 4 byte content size, content checksum
+	dst[5] = byte(windowLog-10) << 3
+	binary.LittleEndian.PutUint32(dst[6:], uint32(len(src)))
+
+	table := new([1 << zstdHashLog]int32)
+	var seqs []zstdSequence
+	var literals []byte
+	for start := 0; ; start += zstdBlockMaxSize {
+		end := start + zstdBlockMaxSize
+		if end > len(src) {
+			end = len(src)
+		}
+		last := end == len(src)
+
+		seqs, literals = zstdFindSequences(seqs[:0], literals[:0], src, start, end, 1<<windowLog, table)
+		header := len(dst)
+		dst = append(dst, 0, 0, 0)
+		blockType := zstdBlockCompressed
+		dst = zstdAppendBlock(dst, seqs, literals)
+		if size := len(dst) - header - 3; size >= end-start {
+			// not compressible, store the block as it is
+			blockType = zstdBlockRaw
+			dst = append(dst[:header+3], src[start:end]...)
+		}
+		h := uint32(blockType)<<1 | uint32(len(dst)-header-3)<<3
+		if last {
+			h |= 1
+		}
+		dst[header] = byte(h)
+		dst[header+1] = byte(h >> 8)
+		dst[header+2] = byte(h >> 16)
+		if last {
+			break
+		}
+	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(xxh64(src, 0)))
+	return append(dst, sum[:]...)
+}
+
+// zstdSequence is a run of literals followed by a match.
+type zstdSequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+// zstdFindSequences appends the sequences of the block src[start:end] to
+// seqs and its literals to literals. Matches may refer to earlier blocks up
+// to window bytes back. table is the hash table of positions, shared by all
+// blocks of a frame.
+func zstdFindSequences(seqs []zstdSequence, literals, src []byte, start, end, window int, table *[1 << zstdHashLog]int32) ([]zstdSequence, []byte) {
+	anchor := start
+	for i := start; i+zstdMinMatch <= end; {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 2654435761) >> (32 - zstdHashLog)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > window || binary.LittleEndian.Uint32(src[cand:]) != v {
+			i++
+			continue
+		}
+		n := zstdMinMatch
+		for i+n < end && src[cand+n] == src[i+n] {
+			n++
+		}
+		seqs = append(seqs, zstdSequence{
+			litLen:   uint32(i - anchor),
+			matchLen: uint32(n),
+			offset:   uint32(i - cand),
+		})
+		literals = append(literals, src[anchor:i]...)
+		i += n
+		anchor = i
+	}
+	return seqs, append(literals, src[anchor:end]...)
+}
+
+// zstdAppendBlock appends the content of a compressed block to dst: the
+// literals uncompressed, followed by the sequences.
+func zstdAppendBlock(dst []byte, seqs []zstdSequence, literals []byte) []byte {
+	switch n := len(literals); {
+	case n < 1<<5:
+		dst = append(dst, byte(n<<3))
+	case n < 1<<12:
+		dst = append(dst, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		dst = append(dst, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	dst = append(dst, literals...)
+
+	switch n := len(seqs); {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7F00:
+		dst = append(dst, byte(n>>8+128), byte(n))
+	default:
+		dst = append(dst, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	if len(seqs) == 0 {
+		return dst
+	}
+	dst = append(dst, 0) // predefined distributions
+
+	// The decoder reads the bitstream backwards, so the sequences are
+	// written last to first.
+	w := zstdBitWriter{b: dst}
+	var ll, of, ml zstdFSEState
+	for i := len(seqs) - 1; i >= 0; i-- {
+		s := seqs[i]
+		llCode := zstdLLCode(s.litLen)
+		mlCode := zstdMLCode(s.matchLen - 3)
+		offValue := s.offset + 3
+		ofCode := uint8(zstdHighBit(offValue))
+		if i == len(seqs)-1 {
+			ll.init(zstdLLDefaultEncoder, llCode)
+			of.init(zstdOFDefaultEncoder, ofCode)
+			ml.init(zstdMLDefaultEncoder, mlCode)
+		} else {
+			w.encode(&of, zstdOFDefaultEncoder, ofCode)
+			w.encode(&ml, zstdMLDefaultEncoder, mlCode)
+			w.encode(&ll, zstdLLDefaultEncoder, llCode)
+		}
+		w.add(uint64(s.litLen-zstdLLBase[llCode]), uint(zstdLLBits[llCode]))
+		w.add(uint64(s.matchLen-zstdMLBase[mlCode]), uint(zstdMLBits[mlCode]))
+		w.add(uint64(offValue-1<<ofCode), uint(ofCode))
+	}
+	w.add(uint64(ml.value), zstdMLDefaultEncoder.log)
+	w.add(uint64(of.value), zstdOFDefaultEncoder.log)
+	w.add(uint64(ll.value), zstdLLDefaultEncoder.log)
+	return w.close()
+}
+
+// zstdLLCode returns the code of the literal length n.
+func zstdLLCode(n uint32) uint8 {
+	if n < 16 {
+		return uint8(n)
+	}
+	if n >= 64 {
+		return uint8(zstdHighBit(n) + 19)
+	}
+	code := uint8(16)
+	for code < 24 && zstdLLBase[code+1] <= n {
+		code++
+	}
+	return code
+}
+
+// zstdMLCode returns the code of the match length n+3.
+func zstdMLCode(n uint32) uint8 {
+	if n < 32 {
+		return uint8(n)
+	}
+	if n >= 128 {
+		return uint8(zstdHighBit(n) + 36)
+	}
+	code := uint8(32)
+	for code < 42 && zstdMLBase[code+1] <= n+3 {
+		code++
+	}
+	return code
+}
+
+// zstdHighBit returns the position of the highest set bit of v, which must
+// not be zero.
+func zstdHighBit(v uint32) uint {
+	n := uint(0)
+	for v > 1 {
+		v >>= 1
+		n++
+	}
+	return n
+}
+
+// zstdBitWriter writes a bitstream that is read backwards.
+type zstdBitWriter struct {
+	b     []byte
+	bits  uint64
+	nbits uint
+}
+
+// add writes the low n bits of v, at most 32.
+func (w *zstdBitWriter) add(v uint64, n uint) {
+	w.bits |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.b = append(w.b, byte(w.bits))
+		w.bits >>= 8
+		w.nbits -= 8
+	}
+}
+
+// close writes the end mark and returns the bitstream.
+func (w *zstdBitWriter) close() []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.b = append(w.b, byte(w.bits))
+	}
+	return w.b
+}
+
+// zstdFSEEncoder is the encoding table of an FSE distribution.
+type zstdFSEEncoder struct {
+	log        uint
+	stateTable []uint16
+	symbols    []zstdSymbolTransform
+}
+
+type zstdSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+// zstdFSEState is the state of an FSE encoder.
+type zstdFSEState struct {
+	value uint32
+}
+
+func newZstdFSEEncoder(norm []int16, log uint) *zstdFSEEncoder {
+	size := 1 << log
+	symbols := zstdSpreadSymbols(norm, log)
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + int(n)
+	}
+	e := &zstdFSEEncoder{
+		log:        log,
+		stateTable: make([]uint16, size),
+		symbols:    make([]zstdSymbolTransform, len(norm)),
+	}
+	for u, s := range symbols {
+		e.stateTable[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := int32(0)
+	for s, n := range norm {
+		switch n {
+		case 0:
+			e.symbols[s].deltaNbBits = uint32(log+1)<<16 - uint32(size)
+		case -1, 1:
+			e.symbols[s].deltaNbBits = uint32(log)<<16 - uint32(size)
+			e.symbols[s].deltaFindState = total - 1
+			total++
+		default:
+			maxBitsOut := uint32(log - zstdHighBit(uint32(n-1)))
+			minStatePlus := uint32(n) << maxBitsOut
+			e.symbols[s].deltaNbBits = maxBitsOut<<16 - minStatePlus
+			e.symbols[s].deltaFindState = total - int32(n)
+			total += int32(n)
+		}
+	}
+	return e
+}
+
+// init sets the state to the one the decoder ends in after symbol.
+func (s *zstdFSEState) init(e *zstdFSEEncoder, symbol uint8) {
+	t := e.symbols[symbol]
+	nbBits := (t.deltaNbBits + 1<<15) >> 16
+	v := nbBits<<16 - t.deltaNbBits
+	s.value = uint32(e.stateTable[int32(v>>nbBits)+t.deltaFindState])
+}
+
+// encode writes the bits that lead the decoder from symbol to the current
+// state and moves to the state of symbol.
+func (w *zstdBitWriter) encode(s *zstdFSEState, e *zstdFSEEncoder, symbol uint8) {
+	t := e.symbols[symbol]
+	nbBits := (s.value + t.deltaNbBits) >> 16
+	w.add(uint64(s.value), uint(nbBits))
+	s.value = uint32(e.stateTable[int32(s.value>>nbBits)+t.deltaFindState])
+}
+
+// zstdSpreadSymbols returns the symbol of every state of the FSE table of
+// the given distribution.
+func zstdSpreadSymbols(norm []int16, log uint) []uint8 {
+	size := 1 << log
+	symbols := make([]uint8, size)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+	return symbols
+}
+
+// zstdFSETable is the decoding table of an FSE distribution.
+type zstdFSETable struct {
+	log     uint
+	entries []zstdFSEEntry
+}
+
+type zstdFSEEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	newState uint16
+}
+
+// newZstdFSETable builds the decoding table of the given distribution,
+// whose probabilities must add up to 1<<log.
+func newZstdFSETable(norm []int16, log uint) (*zstdFSETable, error) {
+	size := 1 << log
+	total := 0
+	for _, n := range norm {
+		switch {
+		case n == -1:
+			total++
+		case n < 0:
+			return nil, errZstdCorrupt
+		default:
+			total += int(n)
+		}
+	}
+	if total != size {
+		return nil, errZstdCorrupt
+	}
+
+	next := make([]uint16, len(norm))
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint16(n)
+		}
+	}
+	t := &zstdFSETable{log: log, entries: make([]zstdFSEEntry, size)}
+	for u, s := range zstdSpreadSymbols(norm, log) {
+		state := next[s]
+		next[s]++
+		nbBits := log - zstdHighBit(uint32(state))
+		t.entries[u] = zstdFSEEntry{
+			symbol:   s,
+			nbBits:   uint8(nbBits),
+			newState: uint16(int(state)<<nbBits - size),
+		}
+	}
+	return t, nil
+}
+
+func mustZstdFSETable(norm []int16, log uint) *zstdFSETable {
+	t, err := newZstdFSETable(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// zstdRLETable returns the table of a distribution of a single symbol.
+func zstdRLETable(symbol uint8) *zstdFSETable {
+	return &zstdFSETable{entries: []zstdFSEEntry{{symbol: symbol}}}
+}
+
+// zstdReadFSETable reads the description of an FSE distribution at the start
+// of b and returns its decoding table and the number of bytes read.
+func zstdReadFSETable(b []byte, maxSymbol int, maxLog uint) (*zstdFSETable, int, error) {
+	r := zstdForwardReader{b: b}
+	log := uint(r.read(4)) + 5
+	if log > maxLog {
+		return nil, 0, errZstdCorrupt
+	}
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	var norm []int16
+	for remaining > 1 {
+		if len(norm) > maxSymbol {
+			return nil, 0, errZstdCorrupt
+		}
+		max := 2*threshold - 1 - remaining
+		var count int
+		if low := int(r.peek(nbBits - 1)); low < max {
+			count = low
+			r.skip(nbBits - 1)
+		} else {
+			count = int(r.peek(nbBits))
+			if count >= threshold {
+				count -= max
+			}
+			r.skip(nbBits)
+		}
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		if count == 0 {
+			// followed by the number of further symbols of probability 0
+			for {
+				repeat := int(r.read(2))
+				for i := 0; i < repeat; i++ {
+					norm = append(norm, 0)
+				}
+				if repeat < 3 {
+					break
+				}
+			}
+		}
+		for remaining < threshold && nbBits > 1 {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	n := (r.pos + 7) / 8
+	if remaining != 1 || len(norm) > maxSymbol+1 || n > len(b) {
+		return nil, 0, errZstdCorrupt
+	}
+	t, err := newZstdFSETable(norm, log)
+	return t, n, err
+}
+
+// zstdForwardReader reads the little endian bitstream of FSE distributions.
+// Bits beyond the end read as zero.
+type zstdForwardReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *zstdForwardReader) peek(n uint) uint64 {
+	var v uint64
+	i := r.pos >> 3
+	for k := uint(0); k < 8 && i+int(k) < len(r.b); k++ {
+		v |= uint64(r.b[i+int(k)]) << (8 * k)
+	}
+	return v >> uint(r.pos&7) & (1<<n - 1)
+}
+
+func (r *zstdForwardReader) skip(n uint) {
+	r.pos += int(n)
+}
+
+func (r *zstdForwardReader) read(n uint) uint64 {
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+// zstdBitReader reads a bitstream backwards, from its end mark, the highest
+// set bit of its last byte, to its first bit. Bits before the start read as
+// zero, and leave pos negative.
+type zstdBitReader struct {
+	b   []byte
+	pos int // number of bits left
+}
+
+func newZstdBitReader(b []byte) (*zstdBitReader, error) {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	return &zstdBitReader{
+		b:   b,
+		pos: 8*(len(b)-1) + int(zstdHighBit(uint32(b[len(b)-1]))),
+	}, nil
+}
+
+// peek returns the next n bits, at most 56, without consuming them.
+func (r *zstdBitReader) peek(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	start := r.pos - int(n)
+	if start >= 0 {
+		return r.bitsAt(start, n)
+	}
+	if r.pos <= 0 {
+		return 0
+	}
+	return r.bitsAt(0, uint(r.pos)) << uint(-start)
+}
+
+func (r *zstdBitReader) bitsAt(start int, n uint) uint64 {
+	i := start >> 3
+	var v uint64
+	if i+8 <= len(r.b) {
+		v = binary.LittleEndian.Uint64(r.b[i:])
+	} else {
+		for k := uint(0); i+int(k) < len(r.b); k++ {
+			v |= uint64(r.b[i+int(k)]) << (8 * k)
+		}
+	}
+	return v >> uint(start&7) & (1<<n - 1)
+}
+
+func (r *zstdBitReader) read(n uint) uint64 {
+	v := r.peek(n)
+	r.pos -= int(n)
+	return v
+}
+
+// zstdDecodingState is the state of an FSE decoder.
+type zstdDecodingState struct {
+	table *zstdFSETable
+	state uint16
+}
+
+func (s *zstdDecodingState) init(t *zstdFSETable, r *zstdBitReader) {
+	s.table = t
+	s.state = uint16(r.read(t.log))
+}
+
+func (s *zstdDecodingState) symbol() uint8 {
+	return s.table.entries[s.state].symbol
+}
+
+func (s *zstdDecodingState) update(r *zstdBitReader) {
+	e := s.table.entries[s.state]
+	s.state = e.newState + uint16(r.read(uint(e.nbBits)))
+}
+
+// zstdHuffmanTable decodes Huffman coded literals. It is indexed by the next
+// maxBits bits of the stream.
+type zstdHuffmanTable struct {
+	maxBits uint
+	entries []zstdHuffmanEntry
+}
+
+type zstdHuffmanEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// zstdReadHuffmanTable reads the Huffman tree description at the start of b
+// and returns its table and the number of bytes read.
+func zstdReadHuffmanTable(b []byte) (*zstdHuffmanTable, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	var weights []uint8
+	var n int
+	if header := int(b[0]); header < 128 {
+		// weights compressed with FSE, decoded by two interleaved states
+		n = 1 + header
+		if n > len(b) {
+			return nil, 0, errZstdCorrupt
+		}
+		t, tn, err := zstdReadFSETable(b[1:n], 12, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, err := newZstdBitReader(b[1+tn : n])
+		if err != nil {
+			return nil, 0, err
+		}
+		var s1, s2 zstdDecodingState
+		s1.init(t, r)
+		s2.init(t, r)
+		for {
+			if len(weights) > 254 {
+				return nil, 0, errZstdCorrupt
+			}
+			weights = append(weights, s1.symbol())
+			s1.update(r)
+			if r.pos < 0 {
+				weights = append(weights, s2.symbol())
+				break
+			}
+			weights = append(weights, s2.symbol())
+			s2.update(r)
+			if r.pos < 0 {
+				weights = append(weights, s1.symbol())
+				break
+			}
+		}
+	} else {
+		// weights in 4 bits each
+		count := header - 127
+		n = 1 + (count+1)/2
+		if n > len(b) {
+			return nil, 0, errZstdCorrupt
+		}
+		for i := 0; i < count; i++ {
+			w := b[1+i/2]
+			if i%2 == 0 {
+				w >>= 4
+			}
+			weights = append(weights, w&15)
+		}
+	}
+
+	// The weight of the last symbol is implied, it completes the sum of
+	// the others to a power of two.
+	total := 0
+	for _, w := range weights {
+		if w > 11 {
+			return nil, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 || len(weights) > 255 {
+		return nil, 0, errZstdCorrupt
+	}
+	maxBits := zstdHighBit(uint32(total)) + 1
+	rest := 1<<maxBits - total
+	if maxBits > 11 || rest&(rest-1) != 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights = append(weights, uint8(zstdHighBit(uint32(rest))+1))
+
+	// Codes are assigned in order of weight, and of symbol within a weight.
+	t := &zstdHuffmanTable{maxBits: maxBits, entries: make([]zstdHuffmanEntry, 1<<maxBits)}
+	pos := 0
+	for w := uint8(1); uint(w) <= maxBits; w++ {
+		for s, sw := range weights {
+			if sw != w {
+				continue
+			}
+			e := zstdHuffmanEntry{symbol: uint8(s), nbBits: uint8(maxBits + 1 - uint(w))}
+			for i := 0; i < 1<<(w-1); i++ {
+				t.entries[pos] = e
+				pos++
+			}
+		}
+	}
+	return t, n, nil
+}
+
+// decode appends the n literals of the Huffman coded stream src to dst.
+func (t *zstdHuffmanTable) decode(dst, src []byte, n int) ([]byte, error) {
+	r, err := newZstdBitReader(src)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		e := t.entries[r.peek(t.maxBits)]
+		dst = append(dst, e.symbol)
+		r.pos -= int(e.nbBits)
+	}
+	if r.pos != 0 {
+		return nil, errZstdCorrupt
+	}
+	return dst, nil
+}
+
+// zstdDecoder holds the state of a frame carried from block to block.
+type zstdDecoder struct {
+	out        []byte
+	frameStart int
+	max        int
+
+	literals []byte
+	huffman  *zstdHuffmanTable
+	ll       *zstdFSETable
+	of       *zstdFSETable
+	ml       *zstdFSETable
+	rep      [3]uint32
+}
+
+// zstdDecode decodes the zstd frames b, reusing the capacity of dst when
+// possible. It fails without decoding further once more than max bytes would
+// be decoded.
+func zstdDecode(dst, b []byte, max int) ([]byte, error) {
+	d := &zstdDecoder{out: dst[:0], max: max}
+	if len(b) == 0 {
+		return dst, errZstdCorrupt
+	}
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return dst, errZstdCorrupt
+		}
+		magic := binary.LittleEndian.Uint32(b)
+		if magic&^0xF == zstdSkippableMagic {
+			size := binary.LittleEndian.Uint32(b[4:])
+			if uint64(size) > uint64(len(b)-8) {
+				return dst, errZstdCorrupt
+			}
+			b = b[8+size:]
+			continue
+		}
+		if magic != zstdMagic {
+			return dst, errors.New("not a zstd frame")
+		}
+		var err error
+		if b, err = d.frame(b[4:]); err != nil {
+			return dst, err
+		}
+	}
+	return d.out, nil
+}
+
+// frame decodes the frame at the start of b, after its magic number, and
+// returns the rest of b.
+func (d *zstdDecoder) frame(b []byte) ([]byte, error) {
+	descriptor := b[0]
+	if descriptor&(1<<3) != 0 {
+		return nil, errZstdCorrupt
+	}
+	singleSegment := descriptor&(1<<5) != 0
+	checksum := descriptor&(1<<2) != 0
+	pos := 1
+	if !singleSegment {
+		pos++ // window descriptor
+	}
+	dictIDSize := [4]int{0, 1, 2, 4}[descriptor&3]
+	contentSizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeSize == 0 && singleSegment {
+		contentSizeSize = 1
+	}
+	if len(b) < pos+dictIDSize+contentSizeSize {
+		return nil, errZstdCorrupt
+	}
+	var dictID uint32
+	for i := 0; i < dictIDSize; i++ {
+		dictID |= uint32(b[pos+i]) << (8 * uint(i))
+	}
+	if dictID != 0 {
+		return nil, errors.New("zstd frames with dictionary are not supported")
+	}
+	pos += dictIDSize
+	contentSize := int64(-1)
+	if contentSizeSize > 0 {
+		var v uint64
+		for i := 0; i < contentSizeSize; i++ {
+			v |= uint64(b[pos+i]) << (8 * uint(i))
+		}
+		if contentSizeSize == 2 {
+			v += 256
+		}
+		if v > uint64(d.max-len(d.out)) {
+			return nil, zstdTooLarge(d.max)
+		}
+		contentSize = int64(v)
+	}
+	b = b[pos+contentSizeSize:]
+
+	d.frameStart = len(d.out)
+	d.huffman = nil
+	d.ll, d.of, d.ml = nil, nil, nil
+	d.rep = [3]uint32{1, 4, 8}
+	for last := false; !last; {
+		if len(b) < 3 {
+			return nil, errZstdCorrupt
+		}
+		header := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		b = b[3:]
+		last = header&1 != 0
+		size := int(header >> 3)
+		if size > zstdBlockMaxSize {
+			return nil, errZstdCorrupt
+		}
+		switch header >> 1 & 3 {
+		case zstdBlockRaw:
+			if size > len(b) {
+				return nil, errZstdCorrupt
+			}
+			if size > d.max-len(d.out) {
+				return nil, zstdTooLarge(d.max)
+			}
+			d.out = append(d.out, b[:size]...)
+		case zstdBlockRLE:
+			if len(b) < 1 {
+				return nil, errZstdCorrupt
+			}
+			if size > d.max-len(d.out) {
+				return nil, zstdTooLarge(d.max)
+			}
+			for i := 0; i < size; i++ {
+				d.out = append(d.out, b[0])
+			}
+			size = 1
+		case zstdBlockCompressed:
+			if size > len(b) {
+				return nil, errZstdCorrupt
+			}
+			if err := d.block(b[:size]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errZstdCorrupt
+		}
+		b = b[size:]
+	}
+
+	if contentSize >= 0 && int64(len(d.out)-d.frameStart) != contentSize {
+		return nil, errZstdCorrupt
+	}
+	if checksum {
+		if len(b) < 4 {
+			return nil, errZstdCorrupt
+		}
+		if binary.LittleEndian.Uint32(b) != uint32(xxh64(d.out[d.frameStart:], 0)) {
+			return nil, errors.New("zstd content checksum mismatch")
+		}
+		b = b[4:]
+	}
+	return b, nil
+}
+
+// block decodes a compressed block.
+func (d *zstdDecoder) block(b []byte) error {
+	n, err := d.readLiterals(b)
+	if err != nil {
+		return err
+	}
+	b = b[n:]
+
+	if len(b) < 1 {
+		return errZstdCorrupt
+	}
+	count := int(b[0])
+	switch {
+	case count == 0:
+		if len(b) != 1 {
+			return errZstdCorrupt
+		}
+		return d.appendLiterals(d.literals)
+	case count < 128:
+		b = b[1:]
+	case count < 255:
+		if len(b) < 2 {
+			return errZstdCorrupt
+		}
+		count = (count-128)<<8 + int(b[1])
+		b = b[2:]
+	default:
+		if len(b) < 3 {
+			return errZstdCorrupt
+		}
+		count = int(b[1]) + int(b[2])<<8 + 0x7F00
+		b = b[3:]
+	}
+
+	if len(b) < 1 || b[0]&3 != 0 {
+		return errZstdCorrupt
+	}
+	modes := b[0]
+	b = b[1:]
+	if d.ll, n, err = zstdSequenceTable(b, modes>>6, d.ll, zstdLLDefaultTable, 35, 9); err != nil {
+		return err
+	}
+	b = b[n:]
+	if d.of, n, err = zstdSequenceTable(b, modes>>4&3, d.of, zstdOFDefaultTable, 31, 8); err != nil {
+		return err
+	}
+	b = b[n:]
+	if d.ml, n, err = zstdSequenceTable(b, modes>>2&3, d.ml, zstdMLDefaultTable, 52, 9); err != nil {
+		return err
+	}
+	b = b[n:]
+
+	r, err := newZstdBitReader(b)
+	if err != nil {
+		return err
+	}
+	var ll, of, ml zstdDecodingState
+	ll.init(d.ll, r)
+	of.init(d.of, r)
+	ml.init(d.ml, r)
+	literals := d.literals
+	for i := 0; i < count; i++ {
+		llCode, ofCode, mlCode := ll.symbol(), of.symbol(), ml.symbol()
+		if llCode > 35 || ofCode > 31 || mlCode > 52 {
+			return errZstdCorrupt
+		}
+		offValue := uint32(1)<<ofCode + uint32(r.read(uint(ofCode)))
+		matchLen := zstdMLBase[mlCode] + uint32(r.read(uint(zstdMLBits[mlCode])))
+		litLen := zstdLLBase[llCode] + uint32(r.read(uint(zstdLLBits[llCode])))
+		if i < count-1 {
+			ll.update(r)
+			ml.update(r)
+			of.update(r)
+		}
+		if r.pos < 0 {
+			return errZstdCorrupt
+		}
+
+		offset, err := d.offset(offValue, litLen)
+		if err != nil {
+			return err
+		}
+		if int(litLen) > len(literals) {
+			return errZstdCorrupt
+		}
+		if err := d.appendLiterals(literals[:litLen]); err != nil {
+			return err
+		}
+		literals = literals[litLen:]
+		if err := d.appendMatch(int(offset), int(matchLen)); err != nil {
+			return err
+		}
+	}
+	if r.pos != 0 {
+		return errZstdCorrupt
+	}
+	return d.appendLiterals(literals)
+}
+
+// offset returns the offset of a match given its offset value, which refers
+// to one of the recent offsets if it is 3 or less, and updates those.
+func (d *zstdDecoder) offset(value, litLen uint32) (uint32, error) {
+	if value > 3 {
+		d.rep[2], d.rep[1], d.rep[0] = d.rep[1], d.rep[0], value-3
+		return value - 3, nil
+	}
+	if litLen == 0 {
+		value++
+	}
+	var offset uint32
+	switch value {
+	case 1:
+		return d.rep[0], nil
+	case 2:
+		offset = d.rep[1]
+		d.rep[1] = d.rep[0]
+	case 3:
+		offset = d.rep[2]
+		d.rep[2], d.rep[1] = d.rep[1], d.rep[0]
+	default:
+		offset = d.rep[0] - 1
+		if offset == 0 {
+			return 0, errZstdCorrupt
+		}
+		d.rep[2], d.rep[1] = d.rep[1], d.rep[0]
+	}
+	d.rep[0] = offset
+	return offset, nil
+}
+
+func (d *zstdDecoder) appendLiterals(literals []byte) error {
+	if len(literals) > d.max-len(d.out) {
+		return zstdTooLarge(d.max)
+	}
+	d.out = append(d.out, literals...)
+	return nil
+}
+
+func (d *zstdDecoder) appendMatch(offset, n int) error {
+	start := len(d.out) - offset
+	if offset == 0 || start < d.frameStart {
+		return errZstdCorrupt
+	}
+	if n > d.max-len(d.out) {
+		return zstdTooLarge(d.max)
+	}
+	if offset >= n {
+		d.out = append(d.out, d.out[start:start+n]...)
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		d.out = append(d.out, d.out[start+i])
+	}
+	return nil
+}
+
+// zstdSequenceTable returns the decoding table of literal lengths, offsets
+// or match lengths given by mode, and the number of bytes of b it takes up.
+func zstdSequenceTable(b []byte, mode uint8, previous, predefined *zstdFSETable, maxSymbol int, maxLog uint) (*zstdFSETable, int, error) {
+	switch mode {
+	case 0:
+		return predefined, 0, nil
+	case 1:
+		if len(b) < 1 || int(b[0]) > maxSymbol {
+			return nil, 0, errZstdCorrupt
+		}
+		return zstdRLETable(b[0]), 1, nil
+	case 2:
+		return zstdReadFSETable(b, maxSymbol, maxLog)
+	default:
+		if previous == nil {
+			return nil, 0, errZstdCorrupt
+		}
+		return previous, 0, nil
+	}
+}
+
+// readLiterals reads the literals section at the start of a compressed block
+// into d.literals and returns its size.
+func (d *zstdDecoder) readLiterals(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, errZstdCorrupt
+	}
+	litType := b[0] & 3
+	sizeFormat := b[0] >> 2 & 3
+
+	if litType < 2 {
+		// raw or a single byte repeated
+		var size, n int
+		switch sizeFormat {
+		case 0, 2:
+			size, n = int(b[0]>>3), 1
+		case 1:
+			if len(b) < 2 {
+				return 0, errZstdCorrupt
+			}
+			size, n = int(b[0]>>4)+int(b[1])<<4, 2
+		default:
+			if len(b) < 3 {
+				return 0, errZstdCorrupt
+			}
+			size, n = int(b[0]>>4)+int(b[1])<<4+int(b[2])<<12, 3
+		}
+		if size > zstdBlockMaxSize {
+			return 0, errZstdCorrupt
+		}
+		d.literals = d.literals[:0]
+		if litType == 0 {
+			if n+size > len(b) {
+				return 0, errZstdCorrupt
+			}
+			d.literals = append(d.literals, b[n:n+size]...)
+			return n + size, nil
+		}
+		if n+1 > len(b) {
+			return 0, errZstdCorrupt
+		}
+		for i := 0; i < size; i++ {
+			d.literals = append(d.literals, b[n])
+		}
+		return n + 1, nil
+	}
+
+	// Huffman coded, with a new table or the one of the previous block
+	var header uint64
+	n := [4]int{3, 3, 4, 5}[sizeFormat]
+	if len(b) < n {
+		return 0, errZstdCorrupt
+	}
+	for i := 0; i < n; i++ {
+		header |= uint64(b[i]) << (8 * uint(i))
+	}
+	sizeBits := [4]uint{10, 10, 14, 18}[sizeFormat]
+	size := int(header >> 4 & (1<<sizeBits - 1))
+	compressedSize := int(header >> (4 + sizeBits) & (1<<sizeBits - 1))
+	streams := 4
+	if sizeFormat == 0 {
+		streams = 1
+	}
+	if size > zstdBlockMaxSize || n+compressedSize > len(b) {
+		return 0, errZstdCorrupt
+	}
+	src := b[n : n+compressedSize]
+	if litType == 2 {
+		t, tn, err := zstdReadHuffmanTable(src)
+		if err != nil {
+			return 0, err
+		}
+		d.huffman = t
+		src = src[tn:]
+	} else if d.huffman == nil {
+		return 0, errZstdCorrupt
+	}
+
+	d.literals = d.literals[:0]
+	var err error
+	if streams == 1 {
+		if d.literals, err = d.huffman.decode(d.literals, src, size); err != nil {
+			return 0, err
+		}
+		return n + compressedSize, nil
+	}
+	if len(src) < 6 {
+		return 0, errZstdCorrupt
+	}
+	var sizes [4]int
+	sizes[0] = int(binary.LittleEndian.Uint16(src))
+	sizes[1] = int(binary.LittleEndian.Uint16(src[2:]))
+	sizes[2] = int(binary.LittleEndian.Uint16(src[4:]))
+	sizes[3] = len(src) - 6 - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 0 {
+		return 0, errZstdCorrupt
+	}
+	src = src[6:]
+	perStream := (size + 3) / 4
+	for i, streamSize := range sizes {
+		count := perStream
+		if i == 3 {
+			count = size - 3*perStream
+		}
+		if count < 0 {
+			return 0, errZstdCorrupt
+		}
+		if d.literals, err = d.huffman.decode(d.literals, src[:streamSize], count); err != nil {
+			return 0, err
+		}
+		src = src[streamSize:]
+	}
+	return n + compressedSize, nil
+}
+
+const (
+	xxh64Prime1 uint64 = 11400714785074694791
+	xxh64Prime2 uint64 = 14029467366897019727
+	xxh64Prime3 uint64 = 1609587929392839161
+	xxh64Prime4 uint64 = 9650029242287828579
+	xxh64Prime5 uint64 = 2870177450012600261
+)
+
+// xxh64 returns the 64 bit xxHash of b, whose low 32 bits zstd frames use as
+// content checksum.
+func xxh64(b []byte, seed uint64) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		v1 := seed + xxh64Prime1 + xxh64Prime2
+		v2 := seed + xxh64Prime2
+		v3 := seed
+		v4 := seed - xxh64Prime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxh64Round(v1, binary.LittleEndian.Uint64(b))
+			v2 = xxh64Round(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxh64Round(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxh64Round(v4, binary.LittleEndian.Uint64(b[24:]))
+		}
+		h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+		h = xxh64Merge(h, v1)
+		h = xxh64Merge(h, v2)
+		h = xxh64Merge(h, v3)
+		h = xxh64Merge(h, v4)
+	} else {
+		h = seed + xxh64Prime5
+	}
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxh64Round(0, binary.LittleEndian.Uint64(b))
+		h = rotl64(h, 27)*xxh64Prime1 + xxh64Prime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxh64Prime1
+		h = rotl64(h, 23)*xxh64Prime2 + xxh64Prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxh64Prime5
+		h = rotl64(h, 11) * xxh64Prime1
+	}
+
+	h ^= h >> 33
+	h *= xxh64Prime2
+	h ^= h >> 29
+	h *= xxh64Prime3
+	h ^= h >> 32
+	return h
+}
+
+func xxh64Round(acc, in uint64) uint64 {
+	acc += in * xxh64Prime2
+	return rotl64(acc, 31) * xxh64Prime1
+}
+
+func xxh64Merge(acc, v uint64) uint64 {
+	acc ^= xxh64Round(0, v)
+	return acc*xxh64Prime1 + xxh64Prime4
+}
+
+func rotl64(x uint64, r uint) uint64 {
+	return x<<r | x>>(64-r)
+}
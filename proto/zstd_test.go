@@ -0,0 +1,177 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ZstdSuite{})
+
+type ZstdSuite struct{}
+
+// zstdTestData returns the data compressed in testdata/zstd by the zstd
+// command line tool, using the reference implementation that Kafka uses as
+// well, at levels 1 and 19: <name>.<level>.zst. Between them the frames
+// have raw, RLE and compressed blocks, Huffman coded literals in one and four
+// streams, and sequences coded with predefined, RLE and transmitted
+// distributions.
+func zstdTestData() map[string][]byte {
+	var messages bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&messages, "message %d of topic events, partition %d\n", i, i%3)
+	}
+	skewed := make([]byte, 20000)
+	r := rand.New(rand.NewSource(1))
+	for i := range skewed {
+		skewed[i] = []byte{0, 0, 0, 1, 2, 255}[r.Intn(6)]
+	}
+	return map[string][]byte{
+		"messages": messages.Bytes(),
+		"repeated": bytes.Repeat([]byte("a"), 300000),
+		"skewed":   skewed,
+	}
+}
+
+func (s *ZstdSuite) TestRoundTrip(c *C) {
+	var large bytes.Buffer
+	for i := 0; large.Len() < 3*zstdBlockMaxSize; i++ {
+		fmt.Fprintf(&large, "message %d of a long message set\n", i)
+	}
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, data := range [][]byte{
+		nil,
+		[]byte("short"),
+		bytes.Repeat([]byte("a"), 1000),
+		random,
+		large.Bytes(),
+	} {
+		encoded := zstdEncode(data)
+		decoded, err := zstdDecode(nil, encoded, maxDecodedLen)
+		c.Assert(err, IsNil)
+		c.Assert(decoded, HasLen, len(data))
+		c.Assert(bytes.Equal(decoded, data), Equals, true)
+	}
+	c.Assert(len(zstdEncode(large.Bytes())) < large.Len()/2, Equals, true)
+	// incompressible blocks are stored as they are
+	c.Assert(len(zstdEncode(random)) < len(random)+20, Equals, true)
+}
+
+func (s *ZstdSuite) TestDecodeReferenceFrames(c *C) {
+	for name, data := range zstdTestData() {
+		for _, level := range []int{1, 19} {
+			path := filepath.Join("testdata", "zstd", fmt.Sprintf("%s.%d.zst", name, level))
+			frame, err := ioutil.ReadFile(path)
+			c.Assert(err, IsNil)
+			decoded, err := zstdDecode(nil, frame, maxDecodedLen)
+			c.Assert(err, IsNil, Commentf(path))
+			c.Assert(bytes.Equal(decoded, data), Equals, true, Commentf(path))
+		}
+	}
+}
+
+func (s *ZstdSuite) TestDecodeSmallFrame(c *C) {
+	// written by the zstd command line tool at level 19, with Huffman coded
+	// literals and a content checksum
+	frame := []byte{
+		0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x68, 0x95, 0x02, 0x00, 0x62, 0x83, 0x0c,
+		0x12, 0x90, 0xcf, 0x01, 0x08, 0x9a, 0xf4, 0xa4, 0x88, 0xba, 0x7b, 0x03,
+		0x0f, 0x64, 0xe0, 0x62, 0xec, 0x4c, 0x0e, 0xbb, 0x61, 0x13, 0x3a, 0xa6,
+		0x90, 0x21, 0xc4, 0xee, 0xc3, 0x61, 0x74, 0xed, 0x7a, 0x2a, 0x79, 0x40,
+		0x1b, 0x72, 0xe5, 0x2f, 0x27, 0x63, 0x9f, 0xc5, 0x87, 0x73, 0x53, 0x94,
+		0xf2, 0x0b, 0x0e, 0xa0, 0x10, 0xe8, 0xeb, 0xff, 0x19, 0xa0, 0x33, 0x3b,
+		0x3a, 0x37, 0xcd, 0x3f, 0x9f, 0x4f, 0xcf, 0xe7, 0x67, 0x9f, 0xf8, 0x5b,
+		0xb0, 0x05, 0xb2, 0xbb, 0x22, 0x7e, 0x0a, 0xf5, 0x62, 0x38, 0xd4,
+	}
+	var want []string
+	for i := 0; i < 12; i++ {
+		want = append(want, fmt.Sprintf("message %d of topic events, partition %d", i, i%3))
+	}
+	decoded, err := zstdDecode(nil, frame, maxDecodedLen)
+	c.Assert(err, IsNil)
+	c.Assert(string(decoded), Equals, strings.Join(want, " "))
+
+	frame[len(frame)-1]++
+	_, err = zstdDecode(nil, frame, maxDecodedLen)
+	c.Assert(err, ErrorMatches, "zstd content checksum mismatch")
+}
+
+func (s *ZstdSuite) TestSkippableFrames(c *C) {
+	skippable := []byte{0x53, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'x', 'y', 'z'}
+	var b []byte
+	b = append(b, skippable...)
+	b = append(b, zstdEncode([]byte("foo"))...)
+	b = append(b, skippable...)
+	b = append(b, zstdEncode([]byte("bar"))...)
+	decoded, err := zstdDecode(nil, b, maxDecodedLen)
+	c.Assert(err, IsNil)
+	c.Assert(string(decoded), Equals, "foobar")
+}
+
+func (s *ZstdSuite) TestDecodeLimit(c *C) {
+	data := bytes.Repeat([]byte("a"), 1000)
+	encoded := zstdEncode(data)
+	decoded, err := zstdDecode(nil, encoded, len(data))
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, len(data))
+	_, err = zstdDecode(nil, encoded, len(data)-1)
+	c.Assert(err, ErrorMatches, "zstd message exceeds the limit of 999 bytes")
+
+	// a frame without content size whose RLE blocks decode beyond the limit
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58}
+	for n := 0; n <= maxDecodedLen; n += zstdBlockMaxSize {
+		frame = append(frame, byte(zstdBlockRLE<<1), 0, zstdBlockMaxSize>>13, 'a')
+	}
+	frame[len(frame)-4] |= 1
+	_, err = zstdDecode(nil, frame, maxDecodedLen)
+	c.Assert(err, ErrorMatches, "zstd message exceeds the limit of 268435456 bytes")
+
+	// and through a record batch
+	b, err := appendRecordBatch(nil, []*Message{{Value: []byte("value")}}, CompressionNone, 0, false)
+	c.Assert(err, IsNil)
+	b = append(b[:recordBatchHeaderSize], frame...)
+	b[22] |= byte(CompressionZstd)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(b)-12))
+	binary.BigEndian.PutUint32(b[recordBatchCrcOffset:], crc32Castagnoli(b[recordBatchCrcOffset+4:]))
+	_, err = readMessageSet(bytes.NewReader(b), int32(len(b)), nil, crcReject)
+	c.Assert(err, ErrorMatches, "error decoding zstd message: zstd message exceeds the limit of .*")
+}
+
+func (s *ZstdSuite) TestCorruptFrames(c *C) {
+	encoded := zstdEncode(bytes.Repeat([]byte("kafka "), 100))
+	for _, frame := range [][]byte{
+		nil,
+		encoded[:4],
+		encoded[:len(encoded)-5],
+		append([]byte{0, 0, 0, 0}, encoded[4:]...),
+	} {
+		_, err := zstdDecode(nil, frame, maxDecodedLen)
+		c.Assert(err, NotNil)
+	}
+
+	// nor does flipping any single bit make the decoder panic
+	for i := 4; i < len(encoded); i++ {
+		for bit := uint(0); bit < 8; bit++ {
+			frame := append([]byte(nil), encoded...)
+			frame[i] ^= 1 << bit
+			zstdDecode(nil, frame, maxDecodedLen)
+		}
+	}
+}
+
+func (s *ZstdSuite) TestMessageSetRejectsZstd(c *C) {
+	_, err := appendMessageSet(nil, []*Message{{Value: []byte("value")}}, CompressionZstd, 0, false)
+	c.Assert(err, ErrorMatches, "zstd compression requires record batches")
+}
+
+func (s *ZstdSuite) TestXXH64(c *C) {
+	c.Assert(xxh64(nil, 0), Equals, uint64(0xEF46DB3751D8E999))
+	c.Assert(xxh64([]byte("abc"), 0), Equals, uint64(0x44BC2CF5AD770999))
+}
@@ -0,0 +1,116 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// RangeConsumerConf is the configuration of a RangeConsumer.
+type RangeConsumerConf struct {
+	// Broker is used to create the consumer. Required.
+	Broker *Broker
+
+	// ConsumerConf configures the consumer. Its StartOffset is the offset of
+	// the first message to replay and must not be negative.
+	ConsumerConf ConsumerConf
+
+	// EndOffset is the offset after the last message to replay.
+	EndOffset int64
+
+	// Rate limits the delivery to this many messages per second, evenly
+	// spaced.
+	//
+	// Defaults to 0 which means no limit.
+	Rate float64
+}
+
+// RangeConsumer replays the messages of a partition between two offsets, at
+// a limited rate so that a backfill doesn't overwhelm whatever the messages
+// are written to. Once all messages before EndOffset were returned, Consume
+// returns ErrNoData.
+type RangeConsumer struct {
+	conf     RangeConsumerConf
+	consumer Consumer
+	interval time.Duration
+
+	// mu protects the following.
+	mu   *sync.Mutex
+	next time.Time // earliest time the next message is delivered
+	done bool
+}
+
+var _ Consumer = &RangeConsumer{}
+
+// NewRangeConsumer returns a consumer for the configured range.
+func NewRangeConsumer(conf RangeConsumerConf) (*RangeConsumer, error) {
+	if conf.Broker == nil {
+		return nil, fmt.Errorf("RangeConsumerConf.Broker is required")
+	}
+	if conf.ConsumerConf.StartOffset < 0 {
+		return nil, fmt.Errorf("invalid start offset %d", conf.ConsumerConf.StartOffset)
+	}
+	if conf.Rate < 0 {
+		return nil, fmt.Errorf("invalid rate %f", conf.Rate)
+	}
+
+	c := &RangeConsumer{
+		conf: conf,
+		mu:   &sync.Mutex{},
+		done: conf.ConsumerConf.StartOffset >= conf.EndOffset,
+	}
+	if conf.Rate > 0 {
+		c.interval = time.Duration(float64(time.Second) / conf.Rate)
+	}
+	if !c.done {
+		consumer, err := conf.Broker.Consumer(conf.ConsumerConf)
+		if err != nil {
+			return nil, err
+		}
+		c.consumer = consumer
+	}
+	return c, nil
+}
+
+// Consume returns the next message of the range, waiting as long as needed
+// to keep to the configured rate.
+func (c *RangeConsumer) Consume() (*proto.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return nil, ErrNoData
+	}
+	msg, err := c.consumer.Consume()
+	if err != nil {
+		return nil, err
+	}
+	if msg.Offset >= c.conf.EndOffset {
+		c.done = true
+		return nil, ErrNoData
+	}
+	if msg.Offset == c.conf.EndOffset-1 {
+		c.done = true
+	}
+
+	if c.interval > 0 {
+		now := time.Now()
+		if wait := c.next.Sub(now); wait > 0 {
+			time.Sleep(wait)
+			now = c.next
+		}
+		c.next = now.Add(c.interval)
+	}
+	return msg, nil
+}
+
+// SeekToLatest ends the replay; Consume returns ErrNoData from then on.
+func (c *RangeConsumer) SeekToLatest() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.done = true
+	return nil
+}
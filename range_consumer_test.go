@@ -0,0 +1,91 @@
+package kafka
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&RangeConsumerSuite{})
+
+type RangeConsumerSuite struct{}
+
+func (s *RangeConsumerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+func (s *RangeConsumerSuite) TestReplayRange(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		offset := req.Topics[0].Partitions[0].FetchOffset
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{
+							ID:        0,
+							TipOffset: offset + 2,
+							Messages: []*proto.Message{
+								{Offset: offset},
+								{Offset: offset + 1},
+							},
+						},
+					},
+				},
+			},
+		}
+	})
+
+	broker, err := NewBroker("test-cluster-range", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = 3
+	consumer, err := NewRangeConsumer(RangeConsumerConf{
+		Broker:       broker,
+		ConsumerConf: consConf,
+		EndOffset:    8,
+		Rate:         100,
+	})
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	var offsets []int64
+	for {
+		msg, err := consumer.Consume()
+		if err == ErrNoData {
+			break
+		}
+		c.Assert(err, IsNil)
+		offsets = append(offsets, msg.Offset)
+	}
+	c.Assert(offsets, DeepEquals, []int64{3, 4, 5, 6, 7})
+	// five messages 10ms apart
+	c.Assert(time.Since(start) >= 40*time.Millisecond, Equals, true)
+
+	_, err = consumer.Consume()
+	c.Assert(err, Equals, ErrNoData)
+}
+
+func (s *RangeConsumerSuite) TestEmptyRange(c *C) {
+	consConf := NewConsumerConf("test", 0)
+	consConf.StartOffset = 5
+	consumer, err := NewRangeConsumer(RangeConsumerConf{
+		Broker:       &Broker{},
+		ConsumerConf: consConf,
+		EndOffset:    5,
+	})
+	c.Assert(err, IsNil)
+	_, err = consumer.Consume()
+	c.Assert(err, Equals, ErrNoData)
+}
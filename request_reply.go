@@ -0,0 +1,105 @@
+package kafka
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// RequestReply sends payload as a request over Kafka and returns the value of
+// the reply. The request is produced to a random partition of reqTopic with a
+// header correlationHeader holding a new random ID. The replier is expected
+// to produce its reply to replyTopic with the same header, to any partition.
+//
+// Every partition of replyTopic is consumed from its latest offset as of
+// before the request is sent, so a reply can't be missed, and messages
+// without the ID are skipped. Once timeout passes without a reply,
+// RequestReply gives up with ErrDeadlineExceeded.
+//
+// Headers require produce request version 3 and fetch request version 4,
+// which need Kafka 0.11 or later.
+func (b *Broker) RequestReply(reqTopic, replyTopic, correlationHeader string,
+	payload []byte, timeout time.Duration) ([]byte, error) {
+
+	deadline := time.Now().Add(timeout)
+	cancel := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(cancel) }) }
+	defer stop()
+	timer := time.AfterFunc(timeout, stop)
+	defer timer.Stop()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	correlationID := []byte(hex.EncodeToString(id))
+
+	reqPartitions, err := b.PartitionCount(reqTopic)
+	if err != nil {
+		return nil, err
+	}
+	replyPartitions, err := b.PartitionCount(replyTopic)
+	if err != nil {
+		return nil, err
+	}
+	consumers := make([]*consumer, replyPartitions)
+	for i := range consumers {
+		conf := NewConsumerConf(replyTopic, int32(i))
+		conf.StartOffset = StartOffsetNewest
+		conf.RequestVersion = 4
+		if consumers[i], err = b.consumer(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	prodConf := NewProducerConf()
+	prodConf.RequestVersion = 3
+	prod := b.Producer(prodConf).(*producer)
+	msg := &proto.Message{
+		Value:   payload,
+		Headers: []proto.RecordHeader{{Key: correlationHeader, Value: correlationID}},
+	}
+	partition := int32(rndIntn(int(reqPartitions)))
+	if _, err := prod.produceBefore(deadline, cancel, reqTopic, partition, msg); err != nil {
+		if err == errCanceled {
+			err = ErrDeadlineExceeded
+		}
+		return nil, err
+	}
+
+	type reply struct {
+		value []byte
+		err   error
+	}
+	replies := make(chan reply, len(consumers))
+	for _, c := range consumers {
+		go func(c *consumer) {
+			for {
+				msg, err := c.consumeOne(cancel)
+				if err == errCanceled {
+					return
+				}
+				if err != nil {
+					replies <- reply{err: err}
+					return
+				}
+				if value, ok := messageHeader(msg, correlationHeader); ok && bytes.Equal(value, correlationID) {
+					replies <- reply{value: msg.Value}
+					return
+				}
+			}
+		}(c)
+	}
+
+	select {
+	case r := <-replies:
+		return r.value, r.err
+	case <-cancel:
+		return nil, ErrDeadlineExceeded
+	}
+}
@@ -0,0 +1,74 @@
+package kafka
+
+import (
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RequestReplySuite{})
+
+type RequestReplySuite struct{}
+
+func (s *RequestReplySuite) TestRequestReply(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("requests", 1)
+	srv.AddTopic("replies", 2)
+
+	broker, err := NewBroker("test-cluster-request-reply", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	// an unrelated message already in the reply topic is skipped
+	prodConf := NewProducerConf()
+	prodConf.RequestVersion = 3
+	producer := broker.Producer(prodConf)
+	_, err = producer.Produce("replies", 1, &proto.Message{
+		Value:   []byte("stale"),
+		Headers: []proto.RecordHeader{{Key: "correlation-id", Value: []byte("old")}},
+	})
+	c.Assert(err, IsNil)
+
+	// the replier answers every request on partition 1 of the reply topic,
+	// after another reply that isn't meant for the requester
+	go func() {
+		consConf := NewConsumerConf("requests", 0)
+		consConf.StartOffset = 0
+		consConf.RequestVersion = 4
+		consumer, err := broker.Consumer(consConf)
+		if err != nil {
+			return
+		}
+		msg, err := consumer.Consume()
+		if err != nil {
+			return
+		}
+		producer.Produce("replies", 1,
+			&proto.Message{Value: []byte("other"), Headers: []proto.RecordHeader{{Key: "correlation-id", Value: []byte("x")}}},
+			&proto.Message{Value: append([]byte("re: "), msg.Value...), Headers: msg.Headers})
+	}()
+
+	reply, err := broker.RequestReply("requests", "replies", "correlation-id", []byte("ping"), 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(string(reply), Equals, "re: ping")
+}
+
+func (s *RequestReplySuite) TestTimeout(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	srv.AddTopic("requests", 1)
+	srv.AddTopic("replies", 1)
+
+	broker, err := NewBroker("test-cluster-request-reply", []string{srv.Address()}, NewBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	start := time.Now()
+	_, err = broker.RequestReply("requests", "replies", "correlation-id", []byte("ping"), 200*time.Millisecond)
+	c.Assert(err, Equals, ErrDeadlineExceeded)
+	c.Assert(time.Since(start) < 2*time.Second, Equals, true)
+}
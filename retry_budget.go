@@ -0,0 +1,71 @@
+package kafka
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retryBudget is a token bucket shared by all retries of a broker. Every retry
+// takes a token and tokens are added back at a fixed rate, so that during an
+// outage the retries of many failing requests together can't exceed that
+// rate. A nil budget allows all retries.
+type retryBudget struct {
+	size float64
+	rate float64 // tokens per second
+
+	// mu protects tokens and last.
+	mu     *sync.Mutex
+	tokens float64
+	last   time.Time
+
+	exhausted *int64
+}
+
+// newRetryBudget returns a full budget of the given size, or nil if size is
+// not positive.
+func newRetryBudget(size int, rate float64) *retryBudget {
+	if size <= 0 {
+		return nil
+	}
+	return &retryBudget{
+		size:      float64(size),
+		rate:      rate,
+		mu:        &sync.Mutex{},
+		tokens:    float64(size),
+		last:      time.Now(),
+		exhausted: new(int64),
+	}
+}
+
+// take returns true if a retry may be attempted.
+func (rb *retryBudget) take() bool {
+	if rb == nil {
+		return true
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	now := time.Now()
+	rb.tokens += now.Sub(rb.last).Seconds() * rb.rate
+	if rb.tokens > rb.size {
+		rb.tokens = rb.size
+	}
+	rb.last = now
+
+	if rb.tokens < 1 {
+		atomic.AddInt64(rb.exhausted, 1)
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// Exhausted returns how many retries were refused.
+func (rb *retryBudget) Exhausted() int64 {
+	if rb == nil {
+		return 0
+	}
+	return atomic.LoadInt64(rb.exhausted)
+}
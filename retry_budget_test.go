@@ -0,0 +1,35 @@
+package kafka
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RetryBudgetSuite{})
+
+type RetryBudgetSuite struct{}
+
+func (s *RetryBudgetSuite) TestTake(c *C) {
+	rb := newRetryBudget(2, 100)
+	c.Assert(rb.take(), Equals, true)
+	c.Assert(rb.take(), Equals, true)
+	c.Assert(rb.take(), Equals, false)
+	c.Assert(rb.Exhausted(), Equals, int64(1))
+
+	// refilled at the configured rate, up to the size
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(rb.take(), Equals, true)
+	c.Assert(rb.take(), Equals, true)
+	c.Assert(rb.take(), Equals, false)
+	c.Assert(rb.Exhausted(), Equals, int64(2))
+}
+
+func (s *RetryBudgetSuite) TestDisabled(c *C) {
+	rb := newRetryBudget(0, 10)
+	c.Assert(rb, IsNil)
+	for i := 0; i < 100; i++ {
+		c.Assert(rb.take(), Equals, true)
+	}
+	c.Assert(rb.Exhausted(), Equals, int64(0))
+}
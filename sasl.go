@@ -0,0 +1,197 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// SASLMechanismPlain is the SASL/PLAIN mechanism. It sends the password in
+// clear text, so it should only be used together with TLS.
+const SASLMechanismPlain = "PLAIN"
+
+// SASLConf is the configuration of SASL authentication.
+type SASLConf struct {
+	// Mechanism is the SASL mechanism to authenticate with. Only
+	// SASLMechanismPlain is supported.
+	//
+	// Defaults to SASLMechanismPlain.
+	Mechanism string
+
+	// Username and Password are the credentials to authenticate with.
+	Username string
+	Password string
+
+	// DisableHandshake makes connections start the SASL exchange right away
+	// instead of sending a SASLHandshake request first, as brokers older than
+	// Kafka 0.10 expect.
+	//
+	// Defaults to false.
+	DisableHandshake bool
+
+	// AuthenticateRequests makes connections send the token of the SASL
+	// exchange in a SASLAuthenticate request, after a version 1 SASLHandshake
+	// request, as Kafka 1.0 and later support. Brokers then reject
+	// credentials with proto.ErrSASLAuthenticationFailed instead of closing
+	// the connection. It can't be combined with DisableHandshake.
+	//
+	// Defaults to false.
+	AuthenticateRequests bool
+}
+
+// AuthenticationError is returned when a broker rejects the SASL
+// authentication of a new connection, as opposed to errors of the connection
+// itself.
+type AuthenticationError struct {
+	Addr string
+	Err  error
+}
+
+func (e *AuthenticationError) Error() string {
+	return fmt.Sprintf("cannot authenticate to %s: %s", e.Addr, e.Err)
+}
+
+// errSASLRejected is the error of an AuthenticationError when the broker
+// closes the connection in response to the credentials, which is how brokers
+// reject them.
+var errSASLRejected = errors.New("credentials rejected")
+
+// saslDial returns a DialFunc that establishes connections using dial and
+// authenticates them with conf. The authentication has to finish within the
+// timeout of the dial.
+func saslDial(dial DialFunc, conf *SASLConf) DialFunc {
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if timeout > 0 {
+			_ = conn.SetDeadline(start.Add(timeout))
+		}
+		if err := conf.authenticate(conn, address); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// authenticate performs the SASL handshake and exchange on conn, a new
+// connection to the broker at addr.
+func (conf *SASLConf) authenticate(conn net.Conn, addr string) error {
+	mechanism := conf.Mechanism
+	if mechanism == "" {
+		mechanism = SASLMechanismPlain
+	}
+	if mechanism != SASLMechanismPlain {
+		return &AuthenticationError{
+			Addr: addr,
+			Err:  fmt.Errorf("unsupported SASL mechanism %q", mechanism),
+		}
+	}
+
+	if conf.AuthenticateRequests && conf.DisableHandshake {
+		return &AuthenticationError{
+			Addr: addr,
+			Err:  errors.New("SASLAuthenticate requests require a handshake"),
+		}
+	}
+
+	if !conf.DisableHandshake {
+		req := &proto.SASLHandshakeReq{
+			CorrelationID: newCorrelationID(),
+			Mechanism:     mechanism,
+		}
+		if conf.AuthenticateRequests {
+			req.Version = 1
+		}
+		b, err := saslRoundTrip(conn, req, req.CorrelationID, "handshake")
+		if err != nil {
+			return err
+		}
+		resp, err := proto.ReadSASLHandshakeResp(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		if resp.Err != nil {
+			return &AuthenticationError{Addr: addr, Err: resp.Err}
+		}
+	}
+
+	// authorization identity, authentication identity and password
+	token := make([]byte, 0, 2+len(conf.Username)+len(conf.Password))
+	token = append(token, 0)
+	token = append(token, conf.Username...)
+	token = append(token, 0)
+	token = append(token, conf.Password...)
+	if conf.AuthenticateRequests {
+		req := &proto.SASLAuthenticateReq{
+			CorrelationID: newCorrelationID(),
+			AuthBytes:     token,
+		}
+		b, err := saslRoundTrip(conn, req, req.CorrelationID, "authenticate")
+		if err != nil {
+			return err
+		}
+		resp, err := proto.ReadSASLAuthenticateResp(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		if resp.Err != nil {
+			return &AuthenticationError{Addr: addr, Err: resp.Err}
+		}
+		return nil
+	}
+	if err := writeSASLToken(conn, token); err != nil {
+		return err
+	}
+	if _, err := readSASLToken(conn); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &AuthenticationError{Addr: addr, Err: errSASLRejected}
+		}
+		return err
+	}
+	return nil
+}
+
+// saslRoundTrip writes req to conn and returns the response, which must have
+// the given correlation ID.
+func saslRoundTrip(conn net.Conn, req io.WriterTo, correlationID int32, name string) ([]byte, error) {
+	if _, err := req.WriteTo(conn); err != nil {
+		return nil, err
+	}
+	respID, b, err := proto.ReadResp(conn)
+	if err != nil {
+		return nil, err
+	}
+	if respID != correlationID {
+		return nil, fmt.Errorf("SASL %s response with correlation ID %d, expected %d",
+			name, respID, correlationID)
+	}
+	return b, nil
+}
+
+// writeSASLToken writes a token of the SASL exchange, which is prefixed with
+// its length.
+func writeSASLToken(w io.Writer, token []byte) error {
+	b := make([]byte, 4+len(token))
+	binary.BigEndian.PutUint32(b, uint32(len(token)))
+	copy(b[4:], token)
+	_, err := w.Write(b)
+	return err
+}
+
+// readSASLToken reads a token of the SASL exchange.
+func readSASLToken(r io.Reader) ([]byte, error) {
+	dec := proto.NewDecoder(r)
+	token := dec.DecodeBytes()
+	return token, dec.Err()
+}
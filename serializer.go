@@ -0,0 +1,164 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// Serializer encodes values to the bytes of a message key or value.
+type Serializer interface {
+	Encode(v interface{}) ([]byte, error)
+}
+
+// Deserializer decodes the bytes of a message key or value into v, which is
+// a pointer like for json.Unmarshal.
+type Deserializer interface {
+	Decode(data []byte, v interface{}) error
+}
+
+// JSONSerializer is a Serializer and Deserializer using encoding/json.
+type JSONSerializer struct{}
+
+var (
+	_ Serializer   = JSONSerializer{}
+	_ Deserializer = JSONSerializer{}
+)
+
+// Encode returns the JSON encoding of v.
+func (JSONSerializer) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Decode parses the JSON encoded data into v.
+func (JSONSerializer) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// SerializingProducerConf is the configuration of a SerializingProducer.
+type SerializingProducerConf struct {
+	// Producer writes the encoded messages. Required.
+	Producer Producer
+
+	// ValueSerializer encodes message values. Required.
+	ValueSerializer Serializer
+
+	// KeySerializer encodes message keys.
+	//
+	// Defaults to nil, which only accepts nil and []byte keys.
+	KeySerializer Serializer
+}
+
+// SerializingProducer produces Go values, encoded by the configured
+// serializers, instead of messages.
+type SerializingProducer struct {
+	conf SerializingProducerConf
+}
+
+// NewSerializingProducer returns a producer encoding values with the
+// configured serializers.
+func NewSerializingProducer(conf SerializingProducerConf) (*SerializingProducer, error) {
+	if conf.Producer == nil {
+		return nil, fmt.Errorf("SerializingProducerConf.Producer is required")
+	}
+	if conf.ValueSerializer == nil {
+		return nil, fmt.Errorf("SerializingProducerConf.ValueSerializer is required")
+	}
+	return &SerializingProducer{conf: conf}, nil
+}
+
+// Produce encodes key and value and writes them as a single message to the
+// given topic and partition. A nil key is written as a message without key.
+func (p *SerializingProducer) Produce(topic string, partition int32, key, value interface{}) (int64, error) {
+	msg, err := p.Message(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return p.conf.Producer.Produce(topic, partition, msg)
+}
+
+// Message encodes key and value to a message, e.g. to produce many values
+// with a single Produce call of the underlying producer.
+func (p *SerializingProducer) Message(key, value interface{}) (*proto.Message, error) {
+	msg := &proto.Message{}
+	switch {
+	case key == nil:
+	case p.conf.KeySerializer != nil:
+		b, err := p.conf.KeySerializer.Encode(key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode key: %s", err)
+		}
+		msg.Key = b
+	default:
+		b, ok := key.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("cannot encode key of type %T without KeySerializer", key)
+		}
+		msg.Key = b
+	}
+
+	b, err := p.conf.ValueSerializer.Encode(value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode value: %s", err)
+	}
+	msg.Value = b
+	return msg, nil
+}
+
+// DeserializingConsumerConf is the configuration of a DeserializingConsumer.
+type DeserializingConsumerConf struct {
+	// Consumer reads the encoded messages. Required.
+	Consumer Consumer
+
+	// ValueDeserializer decodes message values. Required.
+	ValueDeserializer Deserializer
+
+	// KeyDeserializer decodes message keys.
+	//
+	// Defaults to nil, which doesn't decode keys.
+	KeyDeserializer Deserializer
+}
+
+// DeserializingConsumer consumes messages and decodes them into Go values
+// with the configured deserializers.
+type DeserializingConsumer struct {
+	conf DeserializingConsumerConf
+}
+
+// NewDeserializingConsumer returns a consumer decoding messages with the
+// configured deserializers.
+func NewDeserializingConsumer(conf DeserializingConsumerConf) (*DeserializingConsumer, error) {
+	if conf.Consumer == nil {
+		return nil, fmt.Errorf("DeserializingConsumerConf.Consumer is required")
+	}
+	if conf.ValueDeserializer == nil {
+		return nil, fmt.Errorf("DeserializingConsumerConf.ValueDeserializer is required")
+	}
+	return &DeserializingConsumer{conf: conf}, nil
+}
+
+// Consume reads the next message and decodes its value into value and its
+// key into key, both pointers. The key is only decoded if key is not nil, a
+// KeyDeserializer is configured and the message has a key. The message is
+// returned as well, even if decoding fails, so that the caller can skip it.
+func (c *DeserializingConsumer) Consume(key, value interface{}) (*proto.Message, error) {
+	msg, err := c.conf.Consumer.Consume()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil && c.conf.KeyDeserializer != nil && msg.Key != nil {
+		if err := c.conf.KeyDeserializer.Decode(msg.Key, key); err != nil {
+			return msg, fmt.Errorf("cannot decode key at offset %d: %s", msg.Offset, err)
+		}
+	}
+	if err := c.conf.ValueDeserializer.Decode(msg.Value, value); err != nil {
+		return msg, fmt.Errorf("cannot decode value at offset %d: %s", msg.Offset, err)
+	}
+	return msg, nil
+}
+
+// SeekToLatest moves the underlying consumer to the newest messages.
+func (c *DeserializingConsumer) SeekToLatest() error {
+	return c.conf.Consumer.SeekToLatest()
+}
@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&SerializerSuite{})
+
+type SerializerSuite struct{}
+
+func (s *SerializerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+type event struct {
+	Name  string
+	Count int
+}
+
+func (s *SerializerSuite) TestRoundTrip(c *C) {
+	rec := newRecordingProducer(nil)
+	producer, err := NewSerializingProducer(SerializingProducerConf{
+		Producer:        rec,
+		ValueSerializer: JSONSerializer{},
+		KeySerializer:   JSONSerializer{},
+	})
+	c.Assert(err, IsNil)
+
+	_, err = producer.Produce("test", 0, 42, event{Name: "first", Count: 1})
+	c.Assert(err, IsNil)
+	_, err = producer.Produce("test", 0, nil, event{Name: "second", Count: 2})
+	c.Assert(err, IsNil)
+	c.Assert(rec.msgs, HasLen, 2)
+	c.Assert(string(rec.msgs[0].Key), Equals, "42")
+	c.Assert(rec.msgs[1].Key, IsNil)
+
+	src := newChanConsumer()
+	consumer, err := NewDeserializingConsumer(DeserializingConsumerConf{
+		Consumer:          src,
+		ValueDeserializer: JSONSerializer{},
+		KeyDeserializer:   JSONSerializer{},
+	})
+	c.Assert(err, IsNil)
+
+	go func() {
+		for _, msg := range rec.msgs {
+			src.results <- consumeResult{msg: msg}
+		}
+		// undecodable
+		src.results <- consumeResult{msg: &proto.Message{Offset: 7, Value: []byte("{")}}
+	}()
+	var key int
+	var value event
+	_, err = consumer.Consume(&key, &value)
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, 42)
+	c.Assert(value, Equals, event{Name: "first", Count: 1})
+
+	_, err = consumer.Consume(nil, &value)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, event{Name: "second", Count: 2})
+
+	// undecodable messages are returned along with the error
+	msg, err := consumer.Consume(nil, &value)
+	c.Assert(err, ErrorMatches, "cannot decode value at offset 7: .*")
+	c.Assert(msg.Offset, Equals, int64(7))
+}
+
+func (s *SerializerSuite) TestRawKeys(c *C) {
+	producer, err := NewSerializingProducer(SerializingProducerConf{
+		Producer:        newRecordingProducer(nil),
+		ValueSerializer: JSONSerializer{},
+	})
+	c.Assert(err, IsNil)
+
+	msg, err := producer.Message([]byte("key"), "value")
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Key), Equals, "key")
+	c.Assert(string(msg.Value), Equals, `"value"`)
+
+	_, err = producer.Message(42, "value")
+	c.Assert(err, ErrorMatches, "cannot encode key of type int without KeySerializer")
+}
+
+func (s *SerializerSuite) TestRequiredFields(c *C) {
+	_, err := NewSerializingProducer(SerializingProducerConf{Producer: newRecordingProducer(nil)})
+	c.Assert(err, ErrorMatches, "SerializingProducerConf.ValueSerializer is required")
+	_, err = NewDeserializingConsumer(DeserializingConsumerConf{ValueDeserializer: JSONSerializer{}})
+	c.Assert(err, ErrorMatches, "DeserializingConsumerConf.Consumer is required")
+}
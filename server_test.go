@@ -2,9 +2,20 @@ package kafka
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,27 +31,250 @@ const (
 	OffsetCommitRequest     = 8
 	OffsetFetchRequest      = 9
 	GroupCoordinatorRequest = 10
+	JoinGroupRequest        = 11
+	HeartbeatRequest        = 12
+	LeaveGroupRequest       = 13
+	SyncGroupRequest        = 14
+	APIVersionsRequest      = 18
 )
 
 type Serializable interface {
 	Bytes() ([]byte, error)
 }
 
+// defaultHistoryLimit is the number of requests the server keeps in its
+// history unless SetHistoryLimit is called.
+const defaultHistoryLimit = 1000
+
+// RequestContext describes a request received by the server.
+type RequestContext struct {
+	Kind          int16
+	CorrelationID int32
+	ClientID      string
+	RemoteAddr    string
+}
+
+// RequestRecord is a request received by the server, as kept in its history.
+type RequestRecord struct {
+	RequestContext
+	Request Serializable
+}
+
+// ContextHandler is a RequestHandler that is passed the context of the
+// request as well.
+type ContextHandler func(ctx RequestContext, request Serializable) (response Serializable)
+
+// Middleware wraps the handler of requests, see Use.
+type Middleware func(next ContextHandler) ContextHandler
+
+// LogRequests is a middleware that logs every request and whether it was
+// answered.
+func LogRequests(next ContextHandler) ContextHandler {
+	return func(ctx RequestContext, request Serializable) Serializable {
+		response := next(ctx, request)
+		log.Debugf("test server: request %d (%d) from %s (%s) answered with %T",
+			ctx.Kind, ctx.CorrelationID, ctx.ClientID, ctx.RemoteAddr, response)
+		return response
+	}
+}
+
+// DelayRequests returns a middleware that delays handling every request by
+// d.
+func DelayRequests(d time.Duration) Middleware {
+	return func(next ContextHandler) ContextHandler {
+		return func(ctx RequestContext, request Serializable) Serializable {
+			time.Sleep(d)
+			return next(ctx, request)
+		}
+	}
+}
+
 type RequestHandler func(request Serializable) (response Serializable)
 
+// RawRequest is a request of a kind the server can't decode, as passed to
+// the handler registered for AnyRequest.
+type RawRequest struct {
+	Kind int16
+
+	// Payload is the whole request, including its size and kind.
+	Payload []byte
+}
+
+func (r *RawRequest) Bytes() ([]byte, error) {
+	return r.Payload, nil
+}
+
 type Server struct {
+	// Processed is the number of requests the server handled. It's only safe
+	// to read once all clients are done, use TotalRequests otherwise.
 	Processed int
 
-	mu       sync.RWMutex
-	ln       net.Listener
-	clients  map[int64]net.Conn
-	handlers map[int16]RequestHandler
+	// OnError, if set before Start, is called with every error that made the
+	// server close a client connection, such as a request that can't be
+	// decoded or a handler that panicked. Clients closing their connection
+	// are not reported. By default, errors are logged.
+	OnError func(conn net.Conn, err error)
+
+	// MaxRequestSize, if set before Start, is the size of the largest
+	// request the server reads; a larger size prefix closes the connection
+	// with proto.ErrMessageSizeTooLarge. It defaults to
+	// proto.DefaultMaxRequestSize.
+	MaxRequestSize int32
+
+	// mu is shared by the servers of a ServerCluster, along with the topics
+	// and committed offsets.
+	mu        *sync.RWMutex
+	ln        net.Listener
+	clients   map[int64]net.Conn
+	clientID  int64
+	handlers  map[int16]RequestHandler
+	topicFns  map[int16]map[string]RequestHandler
+	mws       []Middleware
+	committed map[committedKey]committedOffset
+	groups    map[string]*testGroup
+	requests  map[int16]int
+	injected  []*injectedError
+
+	// handled counts the requests of every kind that were answered, for
+	// Await. handledc is closed and replaced whenever one is.
+	handled  map[int16]int
+	handledc chan struct{}
+	notify   []notification
+
+	// fetchCompression is how the default handler compresses the messages
+	// of fetch responses.
+	fetchCompression proto.Compression
+
+	// apiVersions are the versions the default handler advertises, if set.
+	apiVersions []proto.APIVersion
+
+	// strict makes the default handler reject invalid produce requests.
+	strict bool
+
+	// latency is how long responses to requests of every kind are delayed,
+	// unless latencyFn is set. closing interrupts delays on Close.
+	latency   map[int16]time.Duration
+	latencyFn func(kind int16) time.Duration
+	closing   chan struct{}
+
+	// network and addr are where the server listens, kept across restarts.
+	// wg tracks the goroutines serving the listener and its clients.
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	wg        sync.WaitGroup
+
+	// saslCreds are the credentials clients have to authenticate with, if
+	// set, see RequireSASL.
+	saslCreds *saslCredentials
+
+	// history holds the latest requests received, up to historyLimit.
+	history      []RequestRecord
+	historyLimit int
+
+	// topics are the topics known to the default handler, with the messages
+	// of every partition. stored is closed and replaced whenever messages
+	// are stored, to wake up fetches waiting for them.
+	topics map[string][][]*proto.Message
+	stored chan struct{}
+
+	// nodeID is the ID of the server in metadata. cluster is set for the
+	// servers of a ServerCluster.
+	nodeID  int32
+	cluster *ServerCluster
+}
+
+// committedKey identifies an offset committed to the default handler.
+type committedKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+// notification is a channel the requests of given kind are sent to once
+// they're answered.
+type notification struct {
+	kind int16
+	ch   chan Serializable
+}
+
+type committedOffset struct {
+	offset   int64
+	metadata string
+}
+
+// injectedError is an error the default handler responds with instead of
+// handling the request.
+type injectedError struct {
+	kind      int16
+	topic     string
+	partition int32
+	err       error
+	count     int // requests left to fail, or -1 for all
+}
+
+// matches returns true if the error is injected into responses for given
+// partition to requests of given kind.
+func (inj *injectedError) matches(kind int16, topic string, partition int32) bool {
+	if inj.kind != AnyRequest && inj.kind != kind {
+		return false
+	}
+	return inj.topic == "" || (inj.topic == topic && inj.partition == partition)
+}
+
+// injection looks up the errors injected into a single request. Injected
+// errors are used up once per request, no matter how many of its partitions
+// they apply to.
+type injection struct {
+	srv  *Server
+	kind int16
+	used map[*injectedError]bool
+}
+
+// err returns the error injected for given partition, or nil.
+func (in *injection) err(topic string, partition int32) error {
+	for _, inj := range in.srv.injected {
+		if inj.count != 0 && inj.matches(in.kind, topic, partition) {
+			in.used[inj] = true
+			return inj.err
+		}
+	}
+	return nil
+}
+
+// done uses up the injected errors the request was answered with.
+func (in *injection) done() {
+	injected := in.srv.injected[:0]
+	for _, inj := range in.srv.injected {
+		if in.used[inj] && inj.count > 0 {
+			inj.count--
+		}
+		if inj.count != 0 {
+			injected = append(injected, inj)
+		}
+	}
+	in.srv.injected = injected
 }
 
 func NewServer() *Server {
 	srv := &Server{
-		clients:  make(map[int64]net.Conn),
-		handlers: make(map[int16]RequestHandler),
+		mu:        &sync.RWMutex{},
+		clients:   make(map[int64]net.Conn),
+		handlers:  make(map[int16]RequestHandler),
+		topicFns:  make(map[int16]map[string]RequestHandler),
+		committed: make(map[committedKey]committedOffset),
+		groups:    make(map[string]*testGroup),
+		requests:  make(map[int16]int),
+		handled:   make(map[int16]int),
+		handledc:  make(chan struct{}),
+		latency:   make(map[int16]time.Duration),
+		closing:   make(chan struct{}),
+		topics:    make(map[string][][]*proto.Message),
+		stored:    make(chan struct{}),
+
+		historyLimit: defaultHistoryLimit,
+		nodeID:       1,
+		strict:       true,
 	}
 	srv.handlers[AnyRequest] = srv.defaultRequestHandler
 	return srv
@@ -55,12 +289,414 @@ func (srv *Server) Handle(reqKind int16, handler RequestHandler) {
 	srv.mu.Unlock()
 }
 
+// HandleTopic registers handler for requests of given kind for topic. It
+// takes precedence over the handler registered for the kind, or AnyRequest.
+// Produce and fetch requests for several topics are split: handler gets the
+// part of the request for topic, the other topics go to the less specific
+// handlers and the server merges their responses into one. Requests of other
+// kinds are passed to handler only if topic is the only topic they are for.
+func (srv *Server) HandleTopic(reqKind int16, topic string, handler RequestHandler) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.topicFns[reqKind] == nil {
+		srv.topicFns[reqKind] = make(map[string]RequestHandler)
+	}
+	srv.topicFns[reqKind][topic] = handler
+}
+
+// InjectError makes the default handler respond with err to the next count
+// requests of given kind for given partition, instead of handling them. A
+// count of -1 injects the error until ClearErrors is called. AnyRequest
+// matches requests of every kind and an empty topic matches every partition,
+// as well as requests without partitions.
+func (srv *Server) InjectError(reqKind int16, topic string, partition int32, err error, count int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.injected = append(srv.injected, &injectedError{
+		kind:      reqKind,
+		topic:     topic,
+		partition: partition,
+		err:       err,
+		count:     count,
+	})
+}
+
+// ClearErrors removes all errors injected with InjectError.
+func (srv *Server) ClearErrors() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.injected = nil
+}
+
+// injection returns the lookup of injected errors for a request of given
+// kind. The caller must hold the lock and call done once the response is
+// ready.
+func (srv *Server) injection(kind int16) *injection {
+	return &injection{srv: srv, kind: kind, used: make(map[*injectedError]bool)}
+}
+
+// Use adds mw to the middlewares that wrap the handler of every request, the
+// one registered for its kind or for AnyRequest. Middlewares are called in
+// the order they are added, after the server counted and recorded the
+// request, and before the response is delayed by SetLatency.
+func (srv *Server) Use(mw Middleware) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.mws = append(srv.mws, mw)
+}
+
+// chain returns fn wrapped in the middlewares, including those of the server
+// itself, which record the request and delay the response unless closing is
+// closed first.
+func (srv *Server) chain(fn RequestHandler, closing chan struct{}) ContextHandler {
+	srv.mu.RLock()
+	mws := append([]Middleware{srv.recordRequests, srv.delayResponses(closing)}, srv.mws...)
+	srv.mu.RUnlock()
+
+	h := func(ctx RequestContext, request Serializable) Serializable {
+		return fn(request)
+	}
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// recordRequests is a middleware that counts requests and keeps them in the
+// history.
+func (srv *Server) recordRequests(next ContextHandler) ContextHandler {
+	return func(ctx RequestContext, request Serializable) Serializable {
+		srv.mu.Lock()
+		srv.Processed++
+		srv.requests[ctx.Kind]++
+		srv.history = append(srv.history, RequestRecord{RequestContext: ctx, Request: request})
+		srv.trimHistory()
+		srv.mu.Unlock()
+
+		return next(ctx, request)
+	}
+}
+
+// delayResponses returns a middleware that delays responses by the latency
+// set for the request kind, unless closing is closed first.
+func (srv *Server) delayResponses(closing chan struct{}) Middleware {
+	return func(next ContextHandler) ContextHandler {
+		return func(ctx RequestContext, request Serializable) Serializable {
+			response := next(ctx, request)
+			if d := srv.responseLatency(ctx.Kind); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-closing:
+					return nil
+				}
+			}
+			return response
+		}
+	}
+}
+
+// SetAPIVersions sets the versions of requests the default handler answers
+// API versions requests with, e.g. to pretend to be an older broker. Default
+// is proto.SupportedAPIVersions.
+func (srv *Server) SetAPIVersions(versions ...proto.APIVersion) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.apiVersions = append([]proto.APIVersion(nil), versions...)
+}
+
+// SetStrictValidation sets whether the default handler validates produce
+// requests like a broker, rejecting partitions with corrupt messages with
+// ErrInvalidMessage and the like, instead of storing whatever it's sent.
+// Default is true.
+func (srv *Server) SetStrictValidation(strict bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.strict = strict
+}
+
+// RequireSASL makes clients authenticate with SASL/PLAIN and the given
+// credentials before they can send requests, with or without a SASLHandshake
+// request first. Like brokers do, the server closes the connections of
+// clients that fail to authenticate.
+func (srv *Server) RequireSASL(username, password string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.saslCreds = &saslCredentials{username: username, password: password}
+}
+
+// saslCredentials are the credentials of the SASL mode of a Server.
+type saslCredentials struct {
+	username string
+	password string
+}
+
+// SetFetchCompression makes the default handler compress the messages of
+// every partition in fetch responses into a single wrapper message.
+func (srv *Server) SetFetchCompression(compression proto.Compression) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.fetchCompression = compression
+}
+
+// SetLatency delays responses to requests of given kind by d. Latency set
+// for AnyRequest applies to kinds without latency of their own. Responses
+// are no longer delayed once the server is closed.
+func (srv *Server) SetLatency(reqKind int16, d time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.latency[reqKind] = d
+}
+
+// SetLatencyFunc delays responses by the duration fn returns for the kind of
+// the request, e.g. to add jitter. It overrides latency set with SetLatency,
+// until it's reset with nil.
+func (srv *Server) SetLatencyFunc(fn func(kind int16) time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.latencyFn = fn
+}
+
+// responseLatency returns how long to delay the response to a request of
+// given kind.
+func (srv *Server) responseLatency(kind int16) time.Duration {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	if srv.latencyFn != nil {
+		return srv.latencyFn(kind)
+	}
+	if d, ok := srv.latency[kind]; ok {
+		return d
+	}
+	return srv.latency[AnyRequest]
+}
+
+// History returns the requests the server received, oldest first. Only the
+// latest requests are kept, see SetHistoryLimit.
+func (srv *Server) History() []RequestRecord {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	history := make([]RequestRecord, len(srv.history))
+	copy(history, srv.history)
+	return history
+}
+
+// HistoryOf returns the requests of given kind the server received, oldest
+// first.
+func (srv *Server) HistoryOf(kind int16) []RequestRecord {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	var history []RequestRecord
+	for _, rec := range srv.history {
+		if rec.Kind == kind {
+			history = append(history, rec)
+		}
+	}
+	return history
+}
+
+// ClearHistory forgets all requests the server received so far.
+func (srv *Server) ClearHistory() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.history = nil
+}
+
+// SetHistoryLimit sets the number of latest requests the server keeps in its
+// history, dropping older ones. Default is 1000.
+func (srv *Server) SetHistoryLimit(n int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+	srv.historyLimit = n
+	srv.trimHistory()
+}
+
+// trimHistory drops the oldest requests beyond the history limit. The caller
+// must hold the lock.
+func (srv *Server) trimHistory() {
+	if over := len(srv.history) - srv.historyLimit; over > 0 {
+		srv.history = append([]RequestRecord(nil), srv.history[over:]...)
+	}
+}
+
+// RequestCount returns the number of requests of given kind the server
+// handled.
+func (srv *Server) RequestCount(kind int16) int {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.requests[kind]
+}
+
+// TotalRequests returns the number of requests the server handled.
+func (srv *Server) TotalRequests() int {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.Processed
+}
+
+// Await blocks until the server answered at least n requests of given kind,
+// or of any kind for AnyRequest, counting from its start. It returns an error
+// if that doesn't happen within timeout.
+func (srv *Server) Await(kind int16, n int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		srv.mu.RLock()
+		handled := srv.handled[kind]
+		if kind == AnyRequest {
+			handled = 0
+			for _, count := range srv.handled {
+				handled += count
+			}
+		}
+		changed := srv.handledc
+		srv.mu.RUnlock()
+
+		if handled >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("timed out waiting for %d requests of kind %d, got %d", n, kind, handled)
+		}
+	}
+}
+
+// Notify returns a channel every request of given kind, or of any kind for
+// AnyRequest, is sent to once the server wrote its response. The channel is
+// buffered, but once it's full the client waits for the request to be
+// received, or for the server to close.
+func (srv *Server) Notify(kind int16) <-chan Serializable {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	ch := make(chan Serializable, 100)
+	srv.notify = append(srv.notify, notification{kind: kind, ch: ch})
+	return ch
+}
+
+// answered counts request of given kind as answered and sends it to the
+// channels returned by Notify, unless closing is closed first.
+func (srv *Server) answered(kind int16, request Serializable, closing chan struct{}) {
+	srv.mu.Lock()
+	srv.handled[kind]++
+	close(srv.handledc)
+	srv.handledc = make(chan struct{})
+	var notify []chan Serializable
+	for _, n := range srv.notify {
+		if n.kind == AnyRequest || n.kind == kind {
+			notify = append(notify, n.ch)
+		}
+	}
+	srv.mu.Unlock()
+
+	for _, ch := range notify {
+		select {
+		case ch <- request:
+		case <-closing:
+			return
+		}
+	}
+}
+
+// CommittedOffset returns the offset and metadata last committed to the
+// default handler for given consumer group and partition. The last value is
+// false if nothing was committed.
+func (srv *Server) CommittedOffset(group, topic string, partition int32) (int64, string, bool) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	c, ok := srv.committed[committedKey{group: group, topic: topic, partition: partition}]
+	return c.offset, c.metadata, ok
+}
+
+// AddTopic registers a topic with the given number of partitions with the
+// default handler, which serves metadata, produce and fetch requests for it.
+// Adding a known topic again only adds partitions.
+func (srv *Server) AddTopic(name string, partitions int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.addTopic(name, partitions)
+}
+
+func (srv *Server) addTopic(name string, partitions int) {
+	for len(srv.topics[name]) < partitions {
+		srv.topics[name] = append(srv.topics[name], []*proto.Message{})
+	}
+}
+
+// AddMessages appends messages to a partition as if they were produced,
+// adding the topic and partition if they are not known yet. The offsets of
+// the messages are set.
+func (srv *Server) AddMessages(topic string, partition int32, messages ...*proto.Message) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.addTopic(topic, int(partition)+1)
+	srv.appendMessages(topic, partition, messages)
+}
+
+// appendMessages stores copies of the messages and returns the offset of the
+// first one.
+func (srv *Server) appendMessages(topic string, partition int32, messages []*proto.Message) int64 {
+	stored := srv.topics[topic][partition]
+	offset := int64(len(stored))
+	for _, msg := range messages {
+		msg.Offset = int64(len(stored))
+		m := *msg
+		m.Topic = topic
+		m.Partition = partition
+		stored = append(stored, &m)
+	}
+	srv.topics[topic][partition] = stored
+
+	servers := []*Server{srv}
+	if srv.cluster != nil {
+		servers = srv.cluster.servers
+	}
+	for _, s := range servers {
+		close(s.stored)
+		s.stored = make(chan struct{})
+	}
+	return offset
+}
+
+// partitionMessages returns the messages of a known partition.
+func (srv *Server) partitionMessages(topic string, partition int32) ([]*proto.Message, bool) {
+	parts := srv.topics[topic]
+	if partition < 0 || int(partition) >= len(parts) {
+		return nil, false
+	}
+	return parts[partition], true
+}
+
 func (srv *Server) Address() string {
-	return srv.ln.Addr().String()
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.addr
 }
 
 func (srv *Server) HostPort() (string, int) {
-	host, sport, err := net.SplitHostPort(srv.ln.Addr().String())
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.hostPort()
+}
+
+// hostPort returns the host and port the server listens on. The caller must
+// hold the lock.
+func (srv *Server) hostPort() (string, int) {
+	host, sport, err := net.SplitHostPort(srv.addr)
 	if err != nil {
 		panic(fmt.Sprintf("cannot split server address: %s", err))
 	}
@@ -74,47 +710,109 @@ func (srv *Server) HostPort() (string, int) {
 	return host, port
 }
 
+// Start starts listening for clients on a random port of 127.0.0.1. A server
+// can be started again after Close, on the same address, to simulate a broker
+// restart.
 func (srv *Server) Start() {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
-	if srv.ln != nil {
+	if srv.addr == "" {
+		srv.listen("tcp4", "127.0.0.1:0")
+	} else {
+		srv.listen(srv.network, srv.addr)
+	}
+}
+
+// StartOn starts listening for clients on given network and address, e.g.
+// "tcp6" and "[::1]:0".
+func (srv *Server) StartOn(network, addr string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.listen(network, addr)
+}
+
+// StartTLS starts listening for TLS clients on a random port of 127.0.0.1,
+// like Start. Restarts keep using TLS.
+func (srv *Server) StartTLS(cfg *tls.Config) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.tlsConfig = cfg
+	srv.listen("tcp4", "127.0.0.1:0")
+}
+
+// listen starts serving clients. The caller must hold the lock.
+func (srv *Server) listen(network, addr string) {
+	if srv.ln != nil && !srv.isClosed() {
 		panic("server already started")
 	}
-	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		panic(fmt.Sprintf("cannot start server: %s", err))
 	}
+	if srv.tlsConfig != nil {
+		ln = tls.NewListener(ln, srv.tlsConfig)
+	}
 	srv.ln = ln
+	srv.network = network
+	srv.addr = ln.Addr().String()
+	if srv.isClosed() {
+		srv.closing = make(chan struct{})
+	}
 
+	closing := srv.closing
+	srv.wg.Add(1)
 	go func() {
+		defer srv.wg.Done()
 		for {
 			client, err := ln.Accept()
 			if err != nil {
 				return
 			}
-			go srv.handleClient(client)
+			srv.wg.Add(1)
+			go srv.handleClient(client, closing)
 		}
 	}()
 }
 
+// Close stops listening, closes all client connections and waits for the
+// requests being handled.
 func (srv *Server) Close() {
 	srv.mu.Lock()
-	defer srv.mu.Unlock()
-
+	if srv.ln == nil {
+		srv.mu.Unlock()
+		return
+	}
+	if !srv.isClosed() {
+		close(srv.closing)
+	}
 	_ = srv.ln.Close()
 	for _, cli := range srv.clients {
 		_ = cli.Close()
 	}
 	srv.clients = make(map[int64]net.Conn)
+	srv.mu.Unlock()
+
+	srv.wg.Wait()
 }
 
-func (srv *Server) handleClient(c net.Conn) {
-	clientID := time.Now().UnixNano()
+// handleClient serves the requests of client c, until the client or the
+// server, by closing closing, closes the connection.
+func (srv *Server) handleClient(c net.Conn, closing chan struct{}) {
+	defer srv.wg.Done()
+
 	srv.mu.Lock()
-	if _, ok := srv.clients[clientID]; ok {
-		panic("Programmer error: Duplicate clientID generated.")
+	select {
+	case <-closing:
+		// accepted while closing
+		srv.mu.Unlock()
+		_ = c.Close()
+		return
+	default:
 	}
+	srv.clientID++
+	clientID := srv.clientID
 	srv.clients[clientID] = c
 	srv.mu.Unlock()
 
@@ -122,11 +820,32 @@ func (srv *Server) handleClient(c net.Conn) {
 		srv.mu.Lock()
 		delete(srv.clients, clientID)
 		srv.mu.Unlock()
+		_ = c.Close()
 	}()
 
+	maxSize := srv.MaxRequestSize
+	if maxSize == 0 {
+		maxSize = proto.DefaultMaxRequestSize
+	}
+
+	srv.mu.RLock()
+	creds := srv.saslCreds
+	srv.mu.RUnlock()
+	if creds != nil {
+		if ok, err := srv.authenticate(c, creds); err != nil {
+			srv.fail(c, err)
+			return
+		} else if !ok {
+			return
+		}
+	}
+
 	for {
-		kind, b, err := proto.ReadReq(c)
+		kind, b, err := proto.ReadReqLimited(c, maxSize)
 		if err != nil {
+			if err != io.EOF && !isClosedConnError(err) {
+				srv.fail(c, fmt.Errorf("cannot read request: %s", err))
+			}
 			return
 		}
 		srv.mu.RLock()
@@ -134,14 +853,26 @@ func (srv *Server) handleClient(c net.Conn) {
 		if !ok {
 			fn, ok = srv.handlers[AnyRequest]
 		}
+		topicFns := make(map[string]RequestHandler, len(srv.topicFns[kind]))
+		for topic, h := range srv.topicFns[kind] {
+			topicFns[topic] = h
+		}
 		srv.mu.RUnlock()
 
 		if !ok {
-			panic(fmt.Sprintf("no handler for %d", kind))
+			srv.fail(c, fmt.Errorf("no handler for %d", kind))
+			return
 		}
 
-		var request Serializable
-
+		// every request starts with the API version, correlation ID and
+		// client ID, which must at least be an empty string
+		if len(b) < 14 {
+			srv.fail(c, fmt.Errorf("request %d too short: %d bytes", kind, len(b)))
+			return
+		}
+
+		var request Serializable
+
 		switch kind {
 		case FetchRequest:
 			request, err = proto.ReadFetchReq(bytes.NewBuffer(b))
@@ -157,33 +888,569 @@ func (srv *Server) handleClient(c net.Conn) {
 			request, err = proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
 		case OffsetFetchRequest:
 			request, err = proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
+		case JoinGroupRequest:
+			request, err = proto.ReadJoinGroupReq(bytes.NewBuffer(b))
+		case HeartbeatRequest:
+			request, err = proto.ReadHeartbeatReq(bytes.NewBuffer(b))
+		case LeaveGroupRequest:
+			request, err = proto.ReadLeaveGroupReq(bytes.NewBuffer(b))
+		case SyncGroupRequest:
+			request, err = proto.ReadSyncGroupReq(bytes.NewBuffer(b))
+		case APIVersionsRequest:
+			request, err = proto.ReadAPIVersionsReq(bytes.NewBuffer(b))
+		default:
+			request = &RawRequest{Kind: kind, Payload: b}
 		}
 
 		if err != nil {
-			panic(fmt.Sprintf("could not read message %d: %s", kind, err))
+			srv.fail(c, fmt.Errorf("could not read message %d: %s", kind, err))
+			return
 		}
 
-		response := fn(request)
+		// the request kind is followed by the API version, correlation ID
+		// and client ID
+		dec := proto.NewDecoder(bytes.NewReader(b[8:]))
+		ctx := RequestContext{
+			Kind:          kind,
+			CorrelationID: dec.DecodeInt32(),
+			ClientID:      dec.DecodeString(),
+			RemoteAddr:    c.RemoteAddr().String(),
+		}
+
+		if len(topicFns) > 0 {
+			fn = routeTopics(fn, topicFns)
+		}
+		response, err := callHandler(srv.chain(fn, closing), ctx, request)
+		if err != nil {
+			srv.fail(c, err)
+			return
+		}
 		if response != nil {
 			b, err := response.Bytes()
 			if err != nil {
-				panic(fmt.Sprintf("cannot serialize %T: %s", response, err))
+				srv.fail(c, fmt.Errorf("cannot serialize %T: %s", response, err))
+				return
 			}
 			c.Write(b)
 		}
+		srv.answered(kind, request, closing)
+	}
+}
+
+// topicRoute is the handler of some of the topics of a request, given by
+// their index.
+type topicRoute struct {
+	fn      RequestHandler
+	indexes []int
+}
+
+// routeTopics returns a handler that passes requests to the handlers
+// registered for their topics with HandleTopic, and the rest to fn.
+func routeTopics(fn RequestHandler, topicFns map[string]RequestHandler) RequestHandler {
+	return func(request Serializable) Serializable {
+		switch req := request.(type) {
+		case *proto.ProduceReq:
+			names := make([]string, len(req.Topics))
+			for i, t := range req.Topics {
+				names[i] = t.Name
+			}
+			routes := splitTopics(names, fn, topicFns)
+			if len(routes) == 1 {
+				return routes[0].fn(request)
+			}
+			if len(routes) > 1 {
+				return produceRoutes(req, names, routes)
+			}
+		case *proto.FetchReq:
+			names := make([]string, len(req.Topics))
+			for i, t := range req.Topics {
+				names[i] = t.Name
+			}
+			routes := splitTopics(names, fn, topicFns)
+			if len(routes) == 1 {
+				return routes[0].fn(request)
+			}
+			if len(routes) > 1 {
+				return fetchRoutes(req, names, routes)
+			}
+		}
+		if topic, ok := singleTopic(request); ok {
+			if h, ok := topicFns[topic]; ok {
+				return h(request)
+			}
+		}
+		return fn(request)
+	}
+}
+
+// splitTopics groups the topics of a request by their handler, in the order
+// the topics are requested.
+func splitTopics(names []string, fn RequestHandler, topicFns map[string]RequestHandler) []*topicRoute {
+	var routes []*topicRoute
+	var fallback *topicRoute
+	byTopic := make(map[string]*topicRoute)
+	for i, name := range names {
+		route := fallback
+		if h, ok := topicFns[name]; ok {
+			route = byTopic[name]
+			if route == nil {
+				route = &topicRoute{fn: h}
+				byTopic[name] = route
+				routes = append(routes, route)
+			}
+		} else if fallback == nil {
+			fallback = &topicRoute{fn: fn}
+			route = fallback
+			routes = append(routes, route)
+		}
+		route.indexes = append(route.indexes, i)
+	}
+	return routes
+}
+
+// singleTopic returns the topic of a request that isn't split by topic, if it
+// is for a single topic.
+func singleTopic(request Serializable) (string, bool) {
+	var names []string
+	switch req := request.(type) {
+	case *proto.MetadataReq:
+		names = req.Topics
+	case *proto.OffsetReq:
+		for _, t := range req.Topics {
+			names = append(names, t.Name)
+		}
+	case *proto.OffsetCommitReq:
+		for _, t := range req.Topics {
+			names = append(names, t.Name)
+		}
+	case *proto.OffsetFetchReq:
+		for _, t := range req.Topics {
+			names = append(names, t.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	for _, name := range names[1:] {
+		if name != names[0] {
+			return "", false
+		}
+	}
+	return names[0], true
+}
+
+// mergeOrder returns the indexes of the responded topics in the order the
+// topics are requested, followed by topics that weren't requested.
+func mergeOrder(requested, responded []string) []int {
+	order := make([]int, 0, len(responded))
+	added := make(map[string]bool)
+	for _, name := range requested {
+		if added[name] {
+			continue
+		}
+		added[name] = true
+		for i, n := range responded {
+			if n == name {
+				order = append(order, i)
+			}
+		}
+	}
+	for i, n := range responded {
+		if !added[n] {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// produceRoutes passes the topics of req to the handlers of routes and merges
+// their responses, or returns nil if none responds.
+func produceRoutes(req *proto.ProduceReq, names []string, routes []*topicRoute) Serializable {
+	var resps []*proto.ProduceResp
+	for _, route := range routes {
+		sub := *req
+		sub.Topics = make([]proto.ProduceReqTopic, len(route.indexes))
+		for i, idx := range route.indexes {
+			sub.Topics[i] = req.Topics[idx]
+		}
+		switch resp := route.fn(&sub).(type) {
+		case nil:
+		case *proto.ProduceResp:
+			resps = append(resps, resp)
+		default:
+			panic(fmt.Sprintf("cannot merge %T into produce response", resp))
+		}
+	}
+	if len(resps) == 0 {
+		return nil
+	}
+
+	merged := &proto.ProduceResp{
+		Version:       req.Version,
+		CorrelationID: req.CorrelationID,
+	}
+	var topics []proto.ProduceRespTopic
+	var responded []string
+	for _, resp := range resps {
+		for _, t := range resp.Topics {
+			topics = append(topics, t)
+			responded = append(responded, t.Name)
+		}
+		if resp.ThrottleTime > merged.ThrottleTime {
+			merged.ThrottleTime = resp.ThrottleTime
+		}
+	}
+	for _, i := range mergeOrder(names, responded) {
+		merged.Topics = append(merged.Topics, topics[i])
+	}
+	return merged
+}
+
+// fetchRoutes passes the topics of req to the handlers of routes and merges
+// their responses, or returns nil if none responds.
+func fetchRoutes(req *proto.FetchReq, names []string, routes []*topicRoute) Serializable {
+	var resps []*proto.FetchResp
+	for _, route := range routes {
+		sub := *req
+		sub.Topics = make([]proto.FetchReqTopic, len(route.indexes))
+		for i, idx := range route.indexes {
+			sub.Topics[i] = req.Topics[idx]
+		}
+		switch resp := route.fn(&sub).(type) {
+		case nil:
+		case *proto.FetchResp:
+			resps = append(resps, resp)
+		default:
+			panic(fmt.Sprintf("cannot merge %T into fetch response", resp))
+		}
+	}
+	if len(resps) == 0 {
+		return nil
+	}
+
+	merged := &proto.FetchResp{
+		Version:       req.Version,
+		CorrelationID: req.CorrelationID,
+		Compression:   resps[0].Compression,
+	}
+	var topics []proto.FetchRespTopic
+	var responded []string
+	for _, resp := range resps {
+		for _, t := range resp.Topics {
+			topics = append(topics, t)
+			responded = append(responded, t.Name)
+		}
+	}
+	for _, i := range mergeOrder(names, responded) {
+		merged.Topics = append(merged.Topics, topics[i])
+	}
+	return merged
+}
+
+// callHandler returns the response of fn to request, or an error if fn
+// panics.
+func callHandler(fn ContextHandler, ctx RequestContext, request Serializable) (response Serializable, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot handle %T: %v", request, r)
+		}
+	}()
+	return fn(ctx, request), nil
+}
+
+// fail reports an error that made the server close client connection c.
+// authenticate performs the SASL exchange of client c, which is preceded by a
+// SASLHandshake request unless the client pretends to be older than Kafka
+// 0.10. After a version 1 handshake, the token comes in a SASLAuthenticate
+// request. Returns false if the client is rejected.
+func (srv *Server) authenticate(c net.Conn, creds *saslCredentials) (bool, error) {
+	token, err := readSASLToken(c)
+	if err != nil {
+		return false, fmt.Errorf("cannot read SASL token: %s", err)
+	}
+	var authenticateReq bool
+	if len(token) >= 2 && binary.BigEndian.Uint16(token) == proto.SASLHandshakeReqKind {
+		// the reader skips the size, which the token is missing
+		req, err := proto.ReadSASLHandshakeReq(bytes.NewReader(append(make([]byte, 4), token...)))
+		if err != nil {
+			return false, fmt.Errorf("cannot read SASL handshake: %s", err)
+		}
+		resp := &proto.SASLHandshakeResp{
+			CorrelationID:     req.CorrelationID,
+			EnabledMechanisms: []string{SASLMechanismPlain},
+		}
+		if req.Mechanism != SASLMechanismPlain {
+			resp.Err = proto.ErrUnsupportedSASLMechanism
+		}
+		b, err := resp.Bytes()
+		if err != nil {
+			return false, err
+		}
+		if _, err := c.Write(b); err != nil || resp.Err != nil {
+			return false, nil
+		}
+		if token, err = readSASLToken(c); err != nil {
+			return false, fmt.Errorf("cannot read SASL token: %s", err)
+		}
+		authenticateReq = req.Version >= 1
+	}
+
+	if authenticateReq {
+		req, err := proto.ReadSASLAuthenticateReq(bytes.NewReader(append(make([]byte, 4), token...)))
+		if err != nil {
+			return false, fmt.Errorf("cannot read SASL authenticate request: %s", err)
+		}
+		resp := &proto.SASLAuthenticateResp{CorrelationID: req.CorrelationID}
+		if !creds.match(req.AuthBytes) {
+			resp.Err = proto.ErrSASLAuthenticationFailed
+			resp.ErrMessage = "invalid credentials"
+		}
+		b, err := resp.Bytes()
+		if err != nil {
+			return false, err
+		}
+		_, err = c.Write(b)
+		return err == nil && resp.Err == nil, nil
+	}
+
+	if !creds.match(token) {
+		return false, nil
+	}
+	return writeSASLToken(c, nil) == nil, nil
+}
+
+// match returns whether the SASL/PLAIN token has the credentials.
+func (creds *saslCredentials) match(token []byte) bool {
+	// authorization identity, authentication identity and password
+	parts := bytes.Split(token, []byte{0})
+	return len(parts) == 3 && string(parts[1]) == creds.username && string(parts[2]) == creds.password
+}
+
+func (srv *Server) fail(c net.Conn, err error) {
+	if srv.OnError != nil {
+		srv.OnError(c, err)
+		return
+	}
+	log.Warningf("test server closing connection from %s: %s", c.RemoteAddr(), err)
+}
+
+// LocalhostCertificate returns a new self-signed certificate for localhost,
+// 127.0.0.1 and ::1, to serve TLS clients with StartTLS. Its Leaf is set, so
+// that clients can trust it.
+func LocalhostCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// partitionOffsets returns the offsets a broker answers an offset request
+// with for a partition with a single log segment, which starts at offset 0
+// and ends at tip: the tip and the segment start for the latest offset (-1),
+// the segment start for the earliest offset (-2), and no offsets for other
+// times, since the segment is never older than those.
+func partitionOffsets(tip, timeMs int64, maxOffsets int32) []int64 {
+	var offsets []int64
+	switch timeMs {
+	case -1:
+		offsets = []int64{tip}
+		if tip > 0 {
+			offsets = append(offsets, 0)
+		}
+	case -2:
+		offsets = []int64{0}
+	}
+	if int(maxOffsets) < len(offsets) {
+		offsets = offsets[:maxOffsets]
+	}
+	return offsets
+}
+
+// metadataBrokers returns the brokers to list in metadata: the server, or all
+// running servers of its cluster. The caller must hold the lock.
+func (srv *Server) metadataBrokers() []proto.MetadataRespBroker {
+	servers := []*Server{srv}
+	if srv.cluster != nil {
+		servers = srv.cluster.servers
+	}
+	var brokers []proto.MetadataRespBroker
+	for _, s := range servers {
+		if s.isClosed() {
+			continue
+		}
+		host, port := s.hostPort()
+		brokers = append(brokers, proto.MetadataRespBroker{
+			NodeID: s.nodeID,
+			Host:   host,
+			Port:   int32(port),
+		})
+	}
+	return brokers
+}
+
+// partitionLeader returns the node ID of the leader of given partition. The
+// caller must hold the lock.
+func (srv *Server) partitionLeader(topic string, partition int32) int32 {
+	if srv.cluster == nil {
+		return srv.nodeID
+	}
+	return srv.cluster.leader(topic, partition)
+}
+
+// isLeader returns true if the server leads given partition. The caller must
+// hold the lock.
+func (srv *Server) isLeader(topic string, partition int32) bool {
+	return srv.partitionLeader(topic, partition) == srv.nodeID
+}
+
+// isClosed returns true once Close was called.
+func (srv *Server) isClosed() bool {
+	select {
+	case <-srv.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// isClosedConnError returns true for the error of reading from a connection
+// that was closed on this side, e.g. by Close.
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// awaitFetch holds fetch request req until the messages after the fetched
+// offsets amount to its MinBytes, for at most its MaxWaitTime, or until the
+// server is closed.
+func (srv *Server) awaitFetch(req *proto.FetchReq) {
+	if req.MinBytes <= 0 || req.MaxWaitTime <= 0 {
+		return
+	}
+	deadline := time.NewTimer(req.MaxWaitTime)
+	defer deadline.Stop()
+
+	for {
+		srv.mu.RLock()
+		ready := srv.fetchReady(req)
+		stored, closing := srv.stored, srv.closing
+		srv.mu.RUnlock()
+
+		if ready {
+			return
+		}
+		select {
+		case <-stored:
+		case <-closing:
+			return
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+// fetchReady returns true if fetch request req can be answered right away,
+// either with at least MinBytes of messages or with an error. The caller
+// must hold the lock.
+func (srv *Server) fetchReady(req *proto.FetchReq) bool {
+	var size int
+	for _, topic := range req.Topics {
+		for _, part := range topic.Partitions {
+			messages, ok := srv.partitionMessages(topic.Name, part.ID)
+			if !ok || !srv.isLeader(topic.Name, part.ID) || part.FetchOffset < 0 {
+				return true
+			}
+			for _, inj := range srv.injected {
+				if inj.count != 0 && inj.matches(FetchRequest, topic.Name, part.ID) {
+					return true
+				}
+			}
+			if part.FetchOffset >= int64(len(messages)) {
+				continue
+			}
+			for _, msg := range messages[part.FetchOffset:] {
+				// offset, size, crc, magic byte, attributes, key and value
+				size += 8 + 4 + 4 + 1 + 1 + 4 + len(msg.Key) + 4 + len(msg.Value)
+			}
+		}
+	}
+	return size >= int(req.MinBytes)
+}
+
+// validateProduce returns the error a broker answers the part of produce
+// request req for given partition with, if it is invalid and the server is
+// strict. The caller must hold the lock.
+func (srv *Server) validateProduce(req *proto.ProduceReq, topic string, part proto.ProduceReqPartition) error {
+	if !srv.strict {
+		return nil
+	}
+	switch {
+	case req.RequiredAcks < proto.RequiredAcksAll || req.RequiredAcks > proto.RequiredAcksLocal:
+		return proto.ErrInvalidRequiredAcks
+	case topic == "":
+		return proto.ErrInvalidTopic
+	case part.ID < 0:
+		return proto.ErrUnknownTopicOrPartition
+	}
+	// Compressed messages are decoded, so the crc of every message covers
+	// it uncompressed, except for compressed messages that failed the check
+	// and weren't decoded, which fail it here too. Messages of format 2 have
+	// no crc of their own, their record batch was checked when decoding it.
+	for _, msg := range part.Messages {
+		if msg.Format < 2 && msg.Crc != proto.ComputeCrc(msg, proto.CompressionNone) {
+			return proto.ErrInvalidMessage
+		}
 	}
+	return nil
 }
 
 func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
-	srv.mu.RLock()
-	defer srv.mu.RUnlock()
+	// join and sync requests wait for the other members of the group
+	switch req := request.(type) {
+	case *proto.FetchReq:
+		srv.awaitFetch(req)
+	case *proto.JoinGroupReq:
+		return srv.joinGroup(req)
+	case *proto.SyncGroupReq:
+		return srv.syncGroup(req)
+	}
 
-	srv.Processed++
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
 
 	switch req := request.(type) {
 	case *proto.FetchReq:
+		inj := srv.injection(FetchRequest)
+		defer inj.done()
 		resp := &proto.FetchResp{
+			Version:       req.Version,
 			CorrelationID: req.CorrelationID,
+			Compression:   srv.fetchCompression,
 			Topics:        make([]proto.FetchRespTopic, len(req.Topics)),
 		}
 		for ti, topic := range req.Topics {
@@ -192,17 +1459,35 @@ func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
 				Partitions: make([]proto.FetchRespPartition, len(topic.Partitions)),
 			}
 			for pi, part := range topic.Partitions {
-				resp.Topics[ti].Partitions[pi] = proto.FetchRespPartition{
+				messages, ok := srv.partitionMessages(topic.Name, part.ID)
+				respPart := proto.FetchRespPartition{
 					ID:        part.ID,
-					Err:       proto.ErrUnknownTopicOrPartition,
-					TipOffset: -1,
+					TipOffset: int64(len(messages)),
 					Messages:  []*proto.Message{},
 				}
+				switch err := inj.err(topic.Name, part.ID); {
+				case err != nil:
+					respPart.Err = err
+				case !ok:
+					respPart.Err = proto.ErrUnknownTopicOrPartition
+					respPart.TipOffset = -1
+				case !srv.isLeader(topic.Name, part.ID):
+					respPart.Err = proto.ErrNotLeaderForPartition
+					respPart.TipOffset = -1
+				case part.FetchOffset < 0:
+					respPart.Err = proto.ErrOffsetOutOfRange
+				case part.FetchOffset < int64(len(messages)):
+					respPart.Messages = messages[part.FetchOffset:]
+				}
+				resp.Topics[ti].Partitions[pi] = respPart
 			}
 		}
 		return resp
 	case *proto.ProduceReq:
+		inj := srv.injection(ProduceRequest)
+		defer inj.done()
 		resp := &proto.ProduceResp{
+			Version:       req.Version,
 			CorrelationID: req.CorrelationID,
 		}
 		resp.Topics = make([]proto.ProduceRespTopic, len(req.Topics))
@@ -212,24 +1497,47 @@ func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
 				Partitions: make([]proto.ProduceRespPartition, len(topic.Partitions)),
 			}
 			for pi, part := range topic.Partitions {
-				resp.Topics[ti].Partitions[pi] = proto.ProduceRespPartition{
-					ID:     part.ID,
-					Err:    proto.ErrUnknownTopicOrPartition,
-					Offset: -1,
+				respPart := proto.ProduceRespPartition{ID: part.ID, Offset: -1}
+				if err := inj.err(topic.Name, part.ID); err != nil {
+					respPart.Err = err
+				} else if err := srv.validateProduce(req, topic.Name, part); err != nil {
+					respPart.Err = err
+				} else if _, ok := srv.partitionMessages(topic.Name, part.ID); !ok {
+					respPart.Err = proto.ErrUnknownTopicOrPartition
+				} else if !srv.isLeader(topic.Name, part.ID) {
+					respPart.Err = proto.ErrNotLeaderForPartition
+				} else {
+					respPart.Offset = srv.appendMessages(topic.Name, part.ID, part.Messages)
 				}
+				resp.Topics[ti].Partitions[pi] = respPart
 			}
 		}
 		return resp
 	case *proto.OffsetReq:
+		inj := srv.injection(OffsetRequest)
+		defer inj.done()
 		topics := make([]proto.OffsetRespTopic, len(req.Topics))
 		for ti := range req.Topics {
 			var topic = &topics[ti]
 			topic.Name = req.Topics[ti].Name
 			topic.Partitions = make([]proto.OffsetRespPartition, len(req.Topics[ti].Partitions))
-			for pi := range topic.Partitions {
+			for pi, reqPart := range req.Topics[ti].Partitions {
 				var part = &topic.Partitions[pi]
-				part.ID = req.Topics[ti].Partitions[pi].ID
-				part.Err = proto.ErrUnknownTopicOrPartition
+				part.ID = reqPart.ID
+				if err := inj.err(topic.Name, reqPart.ID); err != nil {
+					part.Err = err
+					continue
+				}
+				messages, ok := srv.partitionMessages(topic.Name, reqPart.ID)
+				if !ok {
+					part.Err = proto.ErrUnknownTopicOrPartition
+					continue
+				}
+				if !srv.isLeader(topic.Name, reqPart.ID) {
+					part.Err = proto.ErrNotLeaderForPartition
+					continue
+				}
+				part.Offsets = partitionOffsets(int64(len(messages)), reqPart.TimeMs, reqPart.MaxOffsets)
 			}
 		}
 
@@ -238,31 +1546,487 @@ func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
 			Topics:        topics,
 		}
 	case *proto.MetadataReq:
-		host, sport, err := net.SplitHostPort(srv.ln.Addr().String())
-		if err != nil {
-			panic(fmt.Sprintf("cannot split server address: %s", err))
-		}
-		port, err := strconv.Atoi(sport)
-		if err != nil {
-			panic(fmt.Sprintf("port '%s' is not a number: %s", sport, err))
+		inj := srv.injection(MetadataRequest)
+		defer inj.done()
+		resp := &proto.MetadataResp{
+			Version:       req.Version,
+			CorrelationID: req.CorrelationID,
+			Brokers:       srv.metadataBrokers(),
+			Topics:        []proto.MetadataRespTopic{},
 		}
-		if host == "" {
-			host = "localhost"
+		names := req.Topics
+		if len(names) == 0 {
+			for name := range srv.topics {
+				names = append(names, name)
+			}
 		}
-		return &proto.MetadataResp{
-			CorrelationID: req.CorrelationID,
-			Brokers: []proto.MetadataRespBroker{
-				{NodeID: 1, Host: host, Port: int32(port)},
-			},
-			Topics: []proto.MetadataRespTopic{},
+		for _, name := range names {
+			parts, ok := srv.topics[name]
+			if !ok {
+				resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
+					Name: name,
+					Err:  proto.ErrUnknownTopicOrPartition,
+				})
+				continue
+			}
+			topic := proto.MetadataRespTopic{
+				Name:       name,
+				Partitions: make([]proto.MetadataRespPartition, len(parts)),
+			}
+			for pi := range parts {
+				leader := srv.partitionLeader(name, int32(pi))
+				part := proto.MetadataRespPartition{
+					ID:       int32(pi),
+					Leader:   leader,
+					Replicas: []int32{leader},
+					Isrs:     []int32{leader},
+					Err:      inj.err(name, int32(pi)),
+				}
+				if srv.cluster != nil && srv.cluster.Server(leader).isClosed() {
+					part.Leader = -1
+					part.Isrs = []int32{}
+					if part.Err == nil {
+						part.Err = proto.ErrLeaderNotAvailable
+					}
+				}
+				topic.Partitions[pi] = part
+			}
+			resp.Topics = append(resp.Topics, topic)
 		}
+		return resp
 	case *proto.GroupCoordinatorReq:
-		panic("not implemented")
+		inj := srv.injection(GroupCoordinatorRequest)
+		defer inj.done()
+		if err := inj.err("", -1); err != nil {
+			return &proto.GroupCoordinatorResp{
+				CorrelationID: req.CorrelationID,
+				Err:           err,
+			}
+		}
+		host, port := srv.hostPort()
+		return &proto.GroupCoordinatorResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   srv.nodeID,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
 	case *proto.OffsetCommitReq:
-		panic("not implemented")
+		inj := srv.injection(OffsetCommitRequest)
+		defer inj.done()
+		resp := &proto.OffsetCommitResp{
+			CorrelationID: req.CorrelationID,
+			Topics:        make([]proto.OffsetCommitRespTopic, len(req.Topics)),
+		}
+		// commits of members of a coordinated group must be of its
+		// current generation
+		var groupErr error
+		if g := srv.groups[req.ConsumerGroup]; g != nil && req.MemberID != "" {
+			groupErr = g.check(req.MemberID, req.GenerationID)
+		}
+		for ti, topic := range req.Topics {
+			resp.Topics[ti] = proto.OffsetCommitRespTopic{
+				Name:       topic.Name,
+				Partitions: make([]proto.OffsetCommitRespPartition, len(topic.Partitions)),
+			}
+			for pi, part := range topic.Partitions {
+				resp.Topics[ti].Partitions[pi] = proto.OffsetCommitRespPartition{ID: part.ID}
+				if groupErr != nil {
+					resp.Topics[ti].Partitions[pi].Err = groupErr
+					continue
+				}
+				if err := inj.err(topic.Name, part.ID); err != nil {
+					resp.Topics[ti].Partitions[pi].Err = err
+					continue
+				}
+				key := committedKey{group: req.ConsumerGroup, topic: topic.Name, partition: part.ID}
+				srv.committed[key] = committedOffset{offset: part.Offset, metadata: part.Metadata}
+			}
+		}
+		return resp
 	case *proto.OffsetFetchReq:
-		panic("not implemented")
+		inj := srv.injection(OffsetFetchRequest)
+		defer inj.done()
+		resp := &proto.OffsetFetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics:        make([]proto.OffsetFetchRespTopic, len(req.Topics)),
+		}
+		for ti, topic := range req.Topics {
+			resp.Topics[ti] = proto.OffsetFetchRespTopic{
+				Name:       topic.Name,
+				Partitions: make([]proto.OffsetFetchRespPartition, len(topic.Partitions)),
+			}
+			for pi, partID := range topic.Partitions {
+				key := committedKey{group: req.ConsumerGroup, topic: topic.Name, partition: partID}
+				part := proto.OffsetFetchRespPartition{ID: partID}
+				if err := inj.err(topic.Name, partID); err != nil {
+					part.Offset = -1
+					part.Err = err
+				} else if c, ok := srv.committed[key]; ok {
+					part.Offset = c.offset
+					part.Metadata = c.metadata
+				} else {
+					// like a broker, report partitions without a
+					// committed offset with offset -1 and no error
+					part.Offset = -1
+				}
+				resp.Topics[ti].Partitions[pi] = part
+			}
+		}
+		return resp
+	case *proto.HeartbeatReq:
+		inj := srv.injection(HeartbeatRequest)
+		defer inj.done()
+		resp := &proto.HeartbeatResp{CorrelationID: req.CorrelationID}
+		if err := inj.err("", -1); err != nil {
+			resp.Err = err
+		} else if g := srv.groups[req.ConsumerGroup]; g == nil {
+			resp.Err = proto.ErrUnknownConsumerID
+		} else if resp.Err = g.check(req.MemberID, req.GenerationID); resp.Err == nil && g.round != nil {
+			resp.Err = proto.ErrRebalanceInProgress
+		}
+		return resp
+	case *proto.LeaveGroupReq:
+		resp := &proto.LeaveGroupResp{CorrelationID: req.CorrelationID}
+		g := srv.groups[req.ConsumerGroup]
+		if g == nil || g.members[req.MemberID] == nil {
+			resp.Err = proto.ErrUnknownConsumerID
+			return resp
+		}
+		delete(g.members, req.MemberID)
+		if len(g.members) > 0 {
+			g.rebalance()
+			g.completeJoin(false)
+		}
+		return resp
+	case *proto.APIVersionsReq:
+		versions := srv.apiVersions
+		if versions == nil {
+			versions = proto.SupportedAPIVersions
+		}
+		return &proto.APIVersionsResp{
+			CorrelationID: req.CorrelationID,
+			APIVersions:   versions,
+		}
 	default:
 		panic(fmt.Sprintf("unknown message type: %T", req))
 	}
 }
+
+// testGroup is a consumer group coordinated by the default handler. Members
+// join in rounds: once a member joins, all other members have to join again
+// before the round completes with a new generation. Members that don't join
+// within their session timeout are removed from the group. Members are not
+// removed for missing heartbeats.
+type testGroup struct {
+	generation int32
+	leader     string
+	members    map[string]*testGroupMember
+	nextID     int
+
+	// round is the current join round, nil while none is in progress.
+	round *testJoinRound
+
+	// assignments are those of the current generation, set by the SyncGroup
+	// request of the leader. synced is closed once they are.
+	assignments map[string][]byte
+	synced      chan struct{}
+}
+
+type testGroupMember struct {
+	protocols []proto.GroupProtocol
+	joined    bool // joined in the current round
+}
+
+// testJoinRound is a round of joins. Once done is closed, the other fields
+// describe the resulting generation.
+type testJoinRound struct {
+	done       chan struct{}
+	generation int32
+	leader     string
+	protocol   string
+	members    []proto.GroupMember
+}
+
+// check returns the error of requests by given member for given generation.
+func (g *testGroup) check(memberID string, generation int32) error {
+	if g.members[memberID] == nil {
+		return proto.ErrUnknownConsumerID
+	}
+	if generation != g.generation {
+		return proto.ErrIllegalGeneration
+	}
+	return nil
+}
+
+// rebalance starts a join round, unless one is in progress. Members waiting
+// for their assignment give up.
+func (g *testGroup) rebalance() {
+	if g.round != nil {
+		return
+	}
+	g.round = &testJoinRound{done: make(chan struct{})}
+	for _, m := range g.members {
+		m.joined = false
+	}
+	if g.synced != nil && g.assignments == nil {
+		close(g.synced)
+	}
+	g.synced = nil
+	g.assignments = nil
+}
+
+// completeJoin completes the join round once all members joined, or right
+// away if force is set, removing the members that did not join.
+func (g *testGroup) completeJoin(force bool) {
+	if g.round == nil {
+		return
+	}
+	for id, m := range g.members {
+		if !m.joined {
+			if !force {
+				return
+			}
+			delete(g.members, id)
+		}
+	}
+	round := g.round
+	g.round = nil
+	if len(g.members) == 0 {
+		close(round.done)
+		return
+	}
+
+	ids := make([]string, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if g.members[g.leader] == nil {
+		g.leader = ids[0]
+	}
+	g.generation++
+	g.synced = make(chan struct{})
+
+	round.generation = g.generation
+	round.leader = g.leader
+	round.protocol = g.members[g.leader].protocols[0].Name
+	for _, id := range ids {
+		for _, p := range g.members[id].protocols {
+			if p.Name == round.protocol {
+				round.members = append(round.members, proto.GroupMember{MemberID: id, Metadata: p.Metadata})
+			}
+		}
+	}
+	close(round.done)
+}
+
+// joinGroup handles a JoinGroup request, waiting for the join round to
+// complete.
+func (srv *Server) joinGroup(req *proto.JoinGroupReq) Serializable {
+	resp := &proto.JoinGroupResp{CorrelationID: req.CorrelationID}
+
+	srv.mu.Lock()
+	inj := srv.injection(JoinGroupRequest)
+	err := inj.err("", -1)
+	inj.done()
+	if err != nil {
+		srv.mu.Unlock()
+		resp.Err = err
+		return resp
+	}
+	g := srv.groups[req.ConsumerGroup]
+	if g == nil {
+		g = &testGroup{members: make(map[string]*testGroupMember)}
+		srv.groups[req.ConsumerGroup] = g
+	}
+	memberID := req.MemberID
+	if memberID == "" {
+		g.nextID++
+		memberID = fmt.Sprintf("%s-%d", req.ClientID, g.nextID)
+		g.members[memberID] = &testGroupMember{}
+	} else if g.members[memberID] == nil {
+		srv.mu.Unlock()
+		resp.Err = proto.ErrUnknownConsumerID
+		return resp
+	}
+	g.rebalance()
+	g.members[memberID].protocols = req.GroupProtocols
+	g.members[memberID].joined = true
+	round := g.round
+	g.completeJoin(false)
+	closing := srv.closing
+	srv.mu.Unlock()
+
+	select {
+	case <-round.done:
+	case <-time.After(req.SessionTimeout):
+		srv.mu.Lock()
+		if g.round == round {
+			g.completeJoin(true)
+		}
+		srv.mu.Unlock()
+	case <-closing:
+		return nil
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if g.members[memberID] == nil {
+		resp.Err = proto.ErrUnknownConsumerID
+		return resp
+	}
+	resp.GenerationID = round.generation
+	resp.GroupProtocol = round.protocol
+	resp.LeaderID = round.leader
+	resp.MemberID = memberID
+	if memberID == round.leader {
+		resp.Members = round.members
+	}
+	return resp
+}
+
+// syncGroup handles a SyncGroup request, waiting for the leader to send the
+// assignments.
+func (srv *Server) syncGroup(req *proto.SyncGroupReq) Serializable {
+	resp := &proto.SyncGroupResp{CorrelationID: req.CorrelationID}
+
+	srv.mu.Lock()
+	g := srv.groups[req.ConsumerGroup]
+	if g == nil {
+		srv.mu.Unlock()
+		resp.Err = proto.ErrUnknownConsumerID
+		return resp
+	}
+	if resp.Err = g.check(req.MemberID, req.GenerationID); resp.Err == nil && g.round != nil {
+		resp.Err = proto.ErrRebalanceInProgress
+	}
+	if resp.Err != nil {
+		srv.mu.Unlock()
+		return resp
+	}
+	if req.MemberID == g.leader && g.assignments == nil {
+		g.assignments = make(map[string][]byte, len(req.GroupAssignments))
+		for _, a := range req.GroupAssignments {
+			g.assignments[a.MemberID] = a.Assignment
+		}
+		close(g.synced)
+	}
+	synced := g.synced
+	closing := srv.closing
+	srv.mu.Unlock()
+
+	select {
+	case <-synced:
+	case <-closing:
+		return nil
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if g.round != nil || g.generation != req.GenerationID || g.assignments == nil {
+		resp.Err = proto.ErrRebalanceInProgress
+		return resp
+	}
+	resp.MemberAssignment = g.assignments[req.MemberID]
+	return resp
+}
+
+// ServerCluster is a cluster of test servers, which share their topics and
+// committed offsets. Every partition is led by a single server, the others
+// answer requests for it with ErrNotLeaderForPartition.
+type ServerCluster struct {
+	mu      *sync.RWMutex
+	servers []*Server
+
+	// leaders are the partitions moved with SetLeader.
+	leaders map[partitionKey]int32
+}
+
+// partitionKey identifies a partition of a topic.
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// NewServerCluster starts a cluster of n servers, with node IDs 1 to n.
+// Partitions are spread over the servers, partition p of every topic is led
+// by node p%n+1 unless moved with SetLeader.
+func NewServerCluster(n int) *ServerCluster {
+	cluster := &ServerCluster{
+		mu:      &sync.RWMutex{},
+		leaders: make(map[partitionKey]int32),
+	}
+	topics := make(map[string][][]*proto.Message)
+	committed := make(map[committedKey]committedOffset)
+	groups := make(map[string]*testGroup)
+	for i := 0; i < n; i++ {
+		srv := NewServer()
+		srv.mu = cluster.mu
+		srv.topics = topics
+		srv.committed = committed
+		srv.groups = groups
+		srv.nodeID = int32(i + 1)
+		srv.cluster = cluster
+		cluster.servers = append(cluster.servers, srv)
+	}
+	for _, srv := range cluster.servers {
+		srv.Start()
+	}
+	return cluster
+}
+
+// Server returns the server with given node ID, or nil.
+func (cluster *ServerCluster) Server(nodeID int32) *Server {
+	if nodeID < 1 || int(nodeID) > len(cluster.servers) {
+		return nil
+	}
+	return cluster.servers[nodeID-1]
+}
+
+// Addresses returns the addresses of all servers of the cluster.
+func (cluster *ServerCluster) Addresses() []string {
+	addrs := make([]string, len(cluster.servers))
+	for i, srv := range cluster.servers {
+		addrs[i] = srv.Address()
+	}
+	return addrs
+}
+
+// AddTopic registers a topic with the given number of partitions with all
+// servers of the cluster.
+func (cluster *ServerCluster) AddTopic(name string, partitions int) {
+	cluster.servers[0].AddTopic(name, partitions)
+}
+
+// SetLeader moves the leadership of given partition to the server with given
+// node ID. Metadata reports the new leader right away.
+func (cluster *ServerCluster) SetLeader(topic string, partition int32, nodeID int32) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.leaders[partitionKey{topic: topic, partition: partition}] = nodeID
+}
+
+// StopBroker closes the server with given node ID. It's no longer listed in
+// metadata, and the partitions it leads have no leader until moved with
+// SetLeader.
+func (cluster *ServerCluster) StopBroker(nodeID int32) {
+	cluster.Server(nodeID).Close()
+}
+
+// Close closes all servers of the cluster.
+func (cluster *ServerCluster) Close() {
+	for _, srv := range cluster.servers {
+		srv.Close()
+	}
+}
+
+// leader returns the node ID of the leader of given partition. The caller
+// must hold the lock.
+func (cluster *ServerCluster) leader(topic string, partition int32) int32 {
+	if nodeID, ok := cluster.leaders[partitionKey{topic: topic, partition: partition}]; ok {
+		return nodeID
+	}
+	return partition%int32(len(cluster.servers)) + 1
+}
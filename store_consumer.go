@@ -0,0 +1,121 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// MessageStore is the sink of a StoreConsumer. It keeps the offset of the
+// last message it stored for every partition together with the processed
+// data, so that it never stores the same message twice.
+//
+// Store must write the message, or whatever is derived from it, and its
+// offset in a single transaction: either both are stored or neither is.
+// Offset returns the offset stored by the last successful Store for the
+// partition, or -1 if nothing was stored yet.
+type MessageStore interface {
+	Store(msg *proto.Message) error
+	Offset(topic string, partition int32) (int64, error)
+}
+
+// StoreConsumerConf is the configuration of a StoreConsumer.
+type StoreConsumerConf struct {
+	// Broker is used to create the consumer. Required.
+	Broker *Broker
+
+	// ConsumerConf configures the consumer. StartOffset is only used if the
+	// store has no offset for the partition yet.
+	ConsumerConf ConsumerConf
+
+	// Store receives the consumed messages. Required.
+	Store MessageStore
+}
+
+// StoreConsumer is a Consumer that passes every message to a MessageStore
+// before returning it and resumes from the offset kept in the store, instead
+// of committing offsets to Kafka. If the store writes messages and offsets
+// atomically, every message is processed exactly once, even across restarts,
+// without Kafka transactions.
+type StoreConsumer struct {
+	conf     StoreConsumerConf
+	consumer Consumer
+
+	// mu protects the following.
+	mu      *sync.Mutex
+	last    int64          // offset of the last stored message, -1 if none
+	pending *proto.Message // consumed, but failed to store
+}
+
+var _ Consumer = &StoreConsumer{}
+
+// NewStoreConsumer reads the last stored offset of the configured partition
+// and returns a consumer starting right after it.
+func NewStoreConsumer(conf StoreConsumerConf) (*StoreConsumer, error) {
+	if conf.Broker == nil {
+		return nil, fmt.Errorf("StoreConsumerConf.Broker is required")
+	}
+	if conf.Store == nil {
+		return nil, fmt.Errorf("StoreConsumerConf.Store is required")
+	}
+
+	topic, partition := conf.ConsumerConf.Topic, conf.ConsumerConf.Partition
+	last, err := conf.Store.Offset(topic, partition)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read stored offset: %s", err)
+	}
+	consConf := conf.ConsumerConf
+	if last >= 0 {
+		log.Infof("Resuming [%s:%d] after stored offset %d", topic, partition, last)
+		consConf.StartOffset = last + 1
+	}
+	consumer, err := conf.Broker.Consumer(consConf)
+	if err != nil {
+		return nil, err
+	}
+	return &StoreConsumer{
+		conf:     conf,
+		consumer: consumer,
+		mu:       &sync.Mutex{},
+		last:     last,
+	}, nil
+}
+
+// Consume returns the next message once it was stored. If storing fails, the
+// error is returned and the same message is stored again by the next call.
+// Messages at or before the last stored offset are skipped.
+func (c *StoreConsumer) Consume() (*proto.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msg := c.pending
+	for msg == nil {
+		var err error
+		if msg, err = c.consumer.Consume(); err != nil {
+			return nil, err
+		}
+		if msg.Offset <= c.last {
+			// compressed message sets can start before the requested offset
+			msg = nil
+		}
+	}
+
+	if err := c.conf.Store.Store(msg); err != nil {
+		c.pending = msg
+		return nil, err
+	}
+	c.pending = nil
+	c.last = msg.Offset
+	return msg, nil
+}
+
+// SeekToLatest moves the consumer to the end of the partition, skipping all
+// messages that were not consumed yet, including one that failed to store.
+func (c *StoreConsumer) SeekToLatest() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending = nil
+	return c.consumer.SeekToLatest()
+}
@@ -0,0 +1,101 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&StoreConsumerSuite{})
+
+type StoreConsumerSuite struct{}
+
+func (s *StoreConsumerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// memoryStore keeps stored message values and fails the first failStores
+// calls to Store.
+type memoryStore struct {
+	failStores int
+	values     []string
+	offset     int64
+}
+
+func (m *memoryStore) Store(msg *proto.Message) error {
+	if m.failStores > 0 {
+		m.failStores--
+		return errors.New("store unavailable")
+	}
+	m.values = append(m.values, string(msg.Value))
+	m.offset = msg.Offset
+	return nil
+}
+
+func (m *memoryStore) Offset(topic string, partition int32) (int64, error) {
+	return m.offset, nil
+}
+
+func (s *StoreConsumerSuite) TestResumeFromStoredOffset(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	var fetchOffsets []int64
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		offset := req.Topics[0].Partitions[0].FetchOffset
+		fetchOffsets = append(fetchOffsets, offset)
+		// like a compressed message set, the response starts before the
+		// requested offset
+		messages := make([]*proto.Message, 0, 3)
+		for o := offset - 1; o <= offset+1; o++ {
+			messages = append(messages, &proto.Message{Offset: o, Value: []byte(fmt.Sprintf("msg-%d", o))})
+		}
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: offset + 2, Messages: messages},
+					},
+				},
+			},
+		}
+	})
+
+	conf := NewBrokerConf("tester")
+	broker, err := NewBroker("test-cluster-store-consumer", []string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	store := &memoryStore{offset: 4, failStores: 1}
+	consumer, err := NewStoreConsumer(StoreConsumerConf{
+		Broker:       broker,
+		ConsumerConf: NewConsumerConf("test", 0),
+		Store:        store,
+	})
+	c.Assert(err, IsNil)
+
+	// a failed store returns the same message again
+	_, err = consumer.Consume()
+	c.Assert(err, ErrorMatches, "store unavailable")
+	for _, want := range []string{"msg-5", "msg-6"} {
+		msg, err := consumer.Consume()
+		c.Assert(err, IsNil)
+		c.Assert(string(msg.Value), Equals, want)
+	}
+	c.Assert(store.values, DeepEquals, []string{"msg-5", "msg-6"})
+	c.Assert(store.offset, Equals, int64(6))
+	c.Assert(fetchOffsets, DeepEquals, []int64{5})
+}
+
+func (s *StoreConsumerSuite) TestRequiredConf(c *C) {
+	_, err := NewStoreConsumer(StoreConsumerConf{Store: &memoryStore{}})
+	c.Assert(err, ErrorMatches, ".*Broker is required")
+}
@@ -0,0 +1,62 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+// clientThrottleVersion is the first produce request version for which the
+// client has to back off after being throttled (KIP-219). Brokers delay their
+// responses to older versions by the throttle time themselves, so backing off
+// again would delay each throttled request twice.
+const clientThrottleVersion = 6
+
+// throttler delays produce requests to brokers that throttled an earlier
+// request to enforce a quota, instead of sending more requests that would
+// only be throttled further. Quotas apply to all connections of a client to a
+// broker, so requests are delayed per broker address. A nil throttler never
+// delays.
+type throttler struct {
+	mu    *sync.Mutex
+	until map[string]time.Time
+}
+
+func newThrottler() *throttler {
+	return &throttler{
+		mu:    &sync.Mutex{},
+		until: make(map[string]time.Time),
+	}
+}
+
+// throttle records that the broker at addr throttled a request for d.
+func (t *throttler) throttle(addr string, d time.Duration) {
+	if t == nil || d <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(t.until[addr]) {
+		t.until[addr] = until
+	}
+}
+
+// wait blocks until requests to the broker at addr are no longer throttled.
+// It returns false if cancel was closed first.
+func (t *throttler) wait(addr string, cancel <-chan struct{}) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	until, ok := t.until[addr]
+	if ok && !until.After(time.Now()) {
+		delete(t.until, addr)
+	}
+	t.mu.Unlock()
+
+	if d := until.Sub(time.Now()); ok && d > 0 {
+		log.Debugf("delaying request to %s by %s for quota throttling", addr, d)
+		return sleep(d, cancel)
+	}
+	return true
+}
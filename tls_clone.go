@@ -0,0 +1,10 @@
+//go:build go1.8
+// +build go1.8
+
+package kafka
+
+import "crypto/tls"
+
+func cloneTLSConfig(config *tls.Config) *tls.Config {
+	return config.Clone()
+}
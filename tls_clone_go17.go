@@ -0,0 +1,28 @@
+//go:build !go1.8
+// +build !go1.8
+
+package kafka
+
+import "crypto/tls"
+
+// cloneTLSConfig copies the fields of config that a client uses. Copying the
+// struct itself would copy its locks.
+func cloneTLSConfig(config *tls.Config) *tls.Config {
+	return &tls.Config{
+		Rand:                     config.Rand,
+		Time:                     config.Time,
+		Certificates:             config.Certificates,
+		NameToCertificate:        config.NameToCertificate,
+		RootCAs:                  config.RootCAs,
+		NextProtos:               config.NextProtos,
+		ServerName:               config.ServerName,
+		InsecureSkipVerify:       config.InsecureSkipVerify,
+		CipherSuites:             config.CipherSuites,
+		PreferServerCipherSuites: config.PreferServerCipherSuites,
+		SessionTicketsDisabled:   config.SessionTicketsDisabled,
+		ClientSessionCache:       config.ClientSessionCache,
+		MinVersion:               config.MinVersion,
+		MaxVersion:               config.MaxVersion,
+		CurvePreferences:         config.CurvePreferences,
+	}
+}
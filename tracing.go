@@ -0,0 +1,60 @@
+package kafka
+
+// RequestSpan describes a single request sent to a Kafka node. It is passed to
+// the Tracer configured in BrokerConf.
+type RequestSpan struct {
+	// Request is the kind of the request: "produce", "fetch" or "metadata".
+	Request string
+
+	// Broker is the address of the node the request is sent to.
+	Broker string
+
+	// Topic and Partition are the destination of produce and fetch requests.
+	// Metadata requests only set Topic, and only when asking about a single
+	// topic.
+	Topic     string
+	Partition int32
+
+	CorrelationID int32
+	Version       int16
+
+	// Data is not used by this package. StartSpan can store the span of the
+	// tracing library in it, to be finished in EndSpan.
+	Data interface{}
+}
+
+// Tracer is called around every produce, fetch and metadata request a broker
+// sends, so that requests can be reported to a tracing system such as
+// OpenTelemetry.
+//
+// StartSpan is called right before the request is sent and EndSpan once the
+// response was read, with the error of the request, if any. Errors reported
+// for single partitions within a response are not passed to EndSpan. Both
+// are called from the goroutine sending the request and must not block.
+//
+// Metadata refreshes done by the cluster metadata cache are shared by all
+// brokers of a cluster and are not traced.
+type Tracer interface {
+	StartSpan(span *RequestSpan)
+	EndSpan(span *RequestSpan, err error)
+}
+
+// traceRequest calls request, reporting it as span if tracer is not nil.
+func traceRequest(tracer Tracer, span *RequestSpan, request func() error) error {
+	if tracer == nil {
+		return request()
+	}
+	tracer.StartSpan(span)
+	err := request()
+	tracer.EndSpan(span, err)
+	return err
+}
+
+// newCorrelationID returns a random correlation ID for a request, so that it
+// is known before the request is sent.
+func newCorrelationID() int32 {
+	rndmu.Lock()
+	defer rndmu.Unlock()
+
+	return rnd.Int31()
+}
@@ -0,0 +1,346 @@
+package kafka
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+// WALEntry is a single produce call stored in the write-ahead log.
+type WALEntry struct {
+	ID        uint64
+	Topic     string
+	Partition int32
+	Messages  []*proto.Message
+}
+
+// WALStorage persists produce calls until the broker has acknowledged them.
+//
+// Append must not return before the entry is durably stored. Entries returns
+// all entries that were appended and not removed, in the order they were
+// appended.
+type WALStorage interface {
+	Append(topic string, partition int32, messages []*proto.Message) (id uint64, err error)
+	Remove(id uint64) error
+	Entries() ([]*WALEntry, error)
+}
+
+// WALProducerConf is the configuration of a WALProducer.
+type WALProducerConf struct {
+	// Producer is used to send messages to the broker. Required.
+	Producer Producer
+
+	// Storage keeps messages until they are acknowledged. Required; use
+	// NewFileWALStorage for a directory backed log.
+	Storage WALStorage
+}
+
+// WALProducer is a Producer that appends messages to a write-ahead log before
+// sending them and removes them once the broker has acknowledged the write.
+// After a crash, Replay sends whatever is left in the log, which gives
+// at-least-once delivery across process restarts.
+type WALProducer struct {
+	conf WALProducerConf
+
+	// mu protects failed.
+	mu *sync.Mutex
+	// failed are the entries whose write failed and that are still in the
+	// log, so that a retry of the same messages reuses their entry.
+	failed map[uint64]*WALEntry
+}
+
+var _ Producer = &WALProducer{}
+
+// NewWALProducer returns a producer that writes through the configured
+// storage. Call Replay on startup, before producing new messages, to resend
+// messages left over from a previous run.
+func NewWALProducer(conf WALProducerConf) (*WALProducer, error) {
+	if conf.Producer == nil {
+		return nil, fmt.Errorf("WALProducerConf.Producer is required")
+	}
+	if conf.Storage == nil {
+		return nil, fmt.Errorf("WALProducerConf.Storage is required")
+	}
+	return &WALProducer{
+		conf:   conf,
+		mu:     &sync.Mutex{},
+		failed: make(map[uint64]*WALEntry),
+	}, nil
+}
+
+// Produce stores the messages in the log, writes them to the given topic and
+// partition and removes them from the log once acknowledged. If the broker
+// returns an error, the messages stay in the log, so that they are sent by
+// the next Replay even if the process crashes while the caller retries.
+//
+// A retry is recognized by passing the same *proto.Message values to the
+// same topic and partition again: it writes the entry already in the log
+// instead of appending another one, which Replay would send as well.
+// Messages that are built anew are appended again, so callers that don't
+// keep the messages should call Replay to retry instead.
+func (p *WALProducer) Produce(topic string, partition int32, messages ...*proto.Message) (int64, error) {
+	id, ok := p.takeFailed(topic, partition, messages)
+	if !ok {
+		var err error
+		id, err = p.conf.Storage.Append(topic, partition, messages)
+		if err != nil {
+			return 0, fmt.Errorf("cannot write to log: %s", err)
+		}
+	}
+	offset, err := p.conf.Producer.Produce(topic, partition, messages...)
+	if err != nil {
+		p.mu.Lock()
+		p.failed[id] = &WALEntry{ID: id, Topic: topic, Partition: partition, Messages: messages}
+		p.mu.Unlock()
+		return 0, err
+	}
+	p.remove(id)
+	return offset, nil
+}
+
+// takeFailed returns the identifier of the failed entry holding exactly the
+// given messages and forgets that it failed. It returns false if there is
+// none.
+func (p *WALProducer) takeFailed(topic string, partition int32, messages []*proto.Message) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, entry := range p.failed {
+		if entry.Topic != topic || entry.Partition != partition || len(entry.Messages) != len(messages) {
+			continue
+		}
+		same := true
+		for i, msg := range entry.Messages {
+			if msg != messages[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			delete(p.failed, id)
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// Replay sends all messages left in the log, oldest first. Replay stops at
+// the first failed write and returns its error; the failed entry and all
+// following ones stay in the log. Entries of failed Produce calls are sent
+// as well, so they must not be retried with Produce afterwards.
+func (p *WALProducer) Replay() error {
+	entries, err := p.conf.Storage.Entries()
+	if err != nil {
+		return fmt.Errorf("cannot read log: %s", err)
+	}
+	for _, entry := range entries {
+		log.Infof("Replaying %d messages from log entry %d to %s:%d",
+			len(entry.Messages), entry.ID, entry.Topic, entry.Partition)
+		if _, err := p.conf.Producer.Produce(entry.Topic, entry.Partition, entry.Messages...); err != nil {
+			return err
+		}
+		p.remove(entry.ID)
+	}
+	return nil
+}
+
+// remove drops an entry from the log. Failing to do so only means the
+// messages are sent again by the next Replay, so the error is just logged.
+func (p *WALProducer) remove(id uint64) {
+	p.mu.Lock()
+	delete(p.failed, id)
+	p.mu.Unlock()
+
+	if err := p.conf.Storage.Remove(id); err != nil {
+		log.Warningf("Cannot remove entry %d from log: %s", id, err)
+	}
+}
+
+// fileWALStorage keeps every entry in a separate file of a single directory.
+// Entries are written to a temporary file, synced and renamed, and the
+// directory is synced after the rename, so a crash never leaves a partially
+// written entry behind and a power failure doesn't lose the rename.
+type fileWALStorage struct {
+	dir string
+
+	mu     *sync.Mutex
+	nextID uint64
+}
+
+const walFileSuffix = ".wal"
+
+// walMessage is the on-disk representation of a message. Only what the
+// producer sets is kept; everything else is assigned by the broker.
+type walMessage struct {
+	Key       []byte
+	Value     []byte
+	Format    int8
+	Timestamp time.Time
+	Headers   []proto.RecordHeader
+}
+
+type walRecord struct {
+	Topic     string
+	Partition int32
+	Messages  []walMessage
+}
+
+// NewFileWALStorage returns a WALStorage keeping its entries in the given
+// directory, which is created if it does not exist. The directory must not be
+// shared by multiple producers.
+func NewFileWALStorage(dir string) (WALStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &fileWALStorage{dir: dir, mu: &sync.Mutex{}, nextID: 1}
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		s.nextID = ids[len(ids)-1] + 1
+	}
+	return s, nil
+}
+
+func (s *fileWALStorage) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, walFileSuffix))
+}
+
+// ids returns identifiers of all stored entries in ascending order.
+func (s *fileWALStorage) ids() ([]uint64, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, walFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, walFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids, nil
+}
+
+func (s *fileWALStorage) Append(topic string, partition int32, messages []*proto.Message) (uint64, error) {
+	rec := walRecord{
+		Topic:     topic,
+		Partition: partition,
+		Messages:  make([]walMessage, len(messages)),
+	}
+	for i, m := range messages {
+		rec.Messages[i] = walMessage{
+			Key:       m.Key,
+			Value:     m.Value,
+			Format:    m.Format,
+			Timestamp: m.Timestamp,
+			Headers:   m.Headers,
+		}
+	}
+
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(s.dir, "append-")
+	if err != nil {
+		return 0, err
+	}
+	err = gob.NewEncoder(tmp).Encode(&rec)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(id))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := syncDir(s.dir); err != nil {
+		_ = os.Remove(s.path(id))
+		return 0, err
+	}
+	return id, nil
+}
+
+// syncDir syncs the directory dir, which makes the renames of files into it
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *fileWALStorage) Remove(id uint64) error {
+	return os.Remove(s.path(id))
+}
+
+func (s *fileWALStorage) Entries() ([]*WALEntry, error) {
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*WALEntry, 0, len(ids))
+	for _, id := range ids {
+		f, err := os.Open(s.path(id))
+		if err != nil {
+			return nil, err
+		}
+		var rec walRecord
+		err = gob.NewDecoder(f).Decode(&rec)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode log entry %d: %s", id, err)
+		}
+		entry := &WALEntry{
+			ID:        id,
+			Topic:     rec.Topic,
+			Partition: rec.Partition,
+			Messages:  make([]*proto.Message, len(rec.Messages)),
+		}
+		for i, m := range rec.Messages {
+			entry.Messages[i] = &proto.Message{
+				Key:       m.Key,
+				Value:     m.Value,
+				Format:    m.Format,
+				Timestamp: m.Timestamp,
+				Headers:   m.Headers,
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,167 @@
+package kafka
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/zorkian/kafka/proto"
+)
+
+var _ = Suite(&WALProducerSuite{})
+
+type WALProducerSuite struct {
+	dir string
+}
+
+func (s *WALProducerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+	dir, err := ioutil.TempDir("", "kafka-wal")
+	c.Assert(err, IsNil)
+	s.dir = dir
+}
+
+func (s *WALProducerSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.dir)
+}
+
+type failingProducer struct{}
+
+func (failingProducer) Produce(string, int32, ...*proto.Message) (int64, error) {
+	return 0, errors.New("broker unavailable")
+}
+
+// crashingStorage forgets to remove entries, as if the process died before
+// the acknowledgement was processed.
+type crashingStorage struct {
+	WALStorage
+}
+
+func (crashingStorage) Remove(uint64) error { return nil }
+
+func (s *WALProducerSuite) TestProduceRemovesAcknowledged(c *C) {
+	storage, err := NewFileWALStorage(s.dir)
+	c.Assert(err, IsNil)
+	rec := newRecordingProducer(nil)
+	p, err := NewWALProducer(WALProducerConf{Producer: rec, Storage: storage})
+	c.Assert(err, IsNil)
+
+	_, err = p.Produce("test", 1, &proto.Message{Value: []byte("a")})
+	c.Assert(err, IsNil)
+	c.Assert(rec.msgs, HasLen, 1)
+
+	entries, err := storage.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	// failed writes are reported to the caller and kept for replay, in case
+	// the process crashes before the caller's retry succeeds
+	p, err = NewWALProducer(WALProducerConf{Producer: failingProducer{}, Storage: storage})
+	c.Assert(err, IsNil)
+	_, err = p.Produce("test", 1, &proto.Message{Value: []byte("b")})
+	c.Assert(err, NotNil)
+	entries, err = storage.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(string(entries[0].Messages[0].Value), Equals, "b")
+}
+
+func (s *WALProducerSuite) TestRetryAfterFailure(c *C) {
+	storage, err := NewFileWALStorage(s.dir)
+	c.Assert(err, IsNil)
+	disabled := map[int32]struct{}{1: {}}
+	rec := newRecordingProducer(disabled)
+	p, err := NewWALProducer(WALProducerConf{Producer: rec, Storage: storage})
+	c.Assert(err, IsNil)
+
+	msgs := []*proto.Message{{Value: []byte("a")}, {Value: []byte("b")}}
+	for i := 0; i < 3; i++ {
+		_, err = p.Produce("test", 1, msgs...)
+		c.Assert(err, NotNil)
+	}
+	entries, err := storage.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+
+	// the retry writes the entry already in the log, so there is nothing
+	// left to replay
+	delete(disabled, 1)
+	_, err = p.Produce("test", 1, msgs...)
+	c.Assert(err, IsNil)
+	entries, err = storage.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+	c.Assert(p.Replay(), IsNil)
+	c.Assert(rec.msgs, HasLen, 2)
+
+	// messages built anew are a new entry
+	disabled[1] = struct{}{}
+	_, err = p.Produce("test", 1, &proto.Message{Value: []byte("c")})
+	c.Assert(err, NotNil)
+	_, err = p.Produce("test", 1, &proto.Message{Value: []byte("c")})
+	c.Assert(err, NotNil)
+	entries, err = storage.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+}
+
+func (s *WALProducerSuite) TestReplay(c *C) {
+	storage, err := NewFileWALStorage(s.dir)
+	c.Assert(err, IsNil)
+	p, err := NewWALProducer(WALProducerConf{
+		Producer: newRecordingProducer(nil),
+		Storage:  crashingStorage{storage},
+	})
+	c.Assert(err, IsNil)
+	timestamp := time.Unix(1500000000, 0)
+	_, err = p.Produce("test", 1, &proto.Message{
+		Key:       []byte("k1"),
+		Value:     []byte("a"),
+		Format:    1,
+		Timestamp: timestamp,
+		Headers:   []proto.RecordHeader{{Key: "h", Value: []byte("v")}},
+	})
+	c.Assert(err, IsNil)
+	_, err = p.Produce("test", 2, &proto.Message{Value: []byte("b")}, &proto.Message{Value: []byte("c")})
+	c.Assert(err, IsNil)
+
+	// restart with a fresh storage reading the same directory
+	storage, err = NewFileWALStorage(s.dir)
+	c.Assert(err, IsNil)
+	entries, err := storage.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+
+	p, err = NewWALProducer(WALProducerConf{Producer: failingProducer{}, Storage: storage})
+	c.Assert(err, IsNil)
+	c.Assert(p.Replay(), NotNil)
+	entries, err = storage.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+
+	rec := newRecordingProducer(nil)
+	p, err = NewWALProducer(WALProducerConf{Producer: rec, Storage: storage})
+	c.Assert(err, IsNil)
+	c.Assert(p.Replay(), IsNil)
+	c.Assert(rec.msgs, HasLen, 3)
+	c.Assert(string(rec.msgs[0].Key), Equals, "k1")
+	c.Assert(string(rec.msgs[0].Value), Equals, "a")
+	c.Assert(rec.msgs[0].Partition, Equals, int32(1))
+	c.Assert(rec.msgs[0].Format, Equals, int8(1))
+	c.Assert(rec.msgs[0].Timestamp.Equal(timestamp), Equals, true)
+	c.Assert(rec.msgs[0].Headers, DeepEquals, []proto.RecordHeader{{Key: "h", Value: []byte("v")}})
+	c.Assert(string(rec.msgs[2].Value), Equals, "c")
+	c.Assert(rec.msgs[2].Partition, Equals, int32(2))
+
+	entries, err = storage.Entries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	// identifiers keep increasing across restarts
+	id, err := storage.Append("test", 0, nil)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, uint64(3))
+}